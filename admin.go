@@ -0,0 +1,325 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// With --admin-socket, the mount serves a small HTTP API with JSON bodies on
+// a unix socket, through which tooling can manage it without signals or the
+// extended attributes of the mount point:
+//
+//     GET  /mounts                 the mounts served by this process
+//     GET  /status                 the status, as with `gcsfuse status`
+//     POST /flush                  write out every modified file now
+//     POST /invalidate?name=a/b    forget cached metadata for a name
+//     GET  /log, PUT /log          read or change debug logging
+//     POST /drain                  start a drain, as with `gcsfuse drain`
+//
+// Errors are reported with a 4xx or 5xx status and a body of the form
+// {"error": "..."}.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcscaching"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	"golang.org/x/net/context"
+)
+
+// The operations of the mounted file system used by the admin API,
+// implemented by *fs.Admin.
+type adminFileSystem interface {
+	Status() (s fs.Status, err error)
+	Flush(ctx context.Context) (synced int, bytes int64, err error)
+	Invalidate(name string) (err error)
+	Drain() (err error)
+}
+
+// A writer that passes output through to the wrapped writer only while
+// enabled, so that debug logging can be turned on and off at run time.
+//
+// Safe for concurrent access.
+type logSwitch struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	enabled bool
+}
+
+func newLogSwitch(enabled bool) *logSwitch {
+	return &logSwitch{enabled: enabled}
+}
+
+// LOCKS_EXCLUDED(s.mu)
+func (s *logSwitch) Enabled() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.enabled
+}
+
+// LOCKS_EXCLUDED(s.mu)
+func (s *logSwitch) SetEnabled(enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.enabled = enabled
+}
+
+// Return a writer that writes to w while the switch is enabled.
+func (s *logSwitch) Wrap(w io.Writer) io.Writer {
+	return &switchedWriter{s: s, w: w}
+}
+
+type switchedWriter struct {
+	s *logSwitch
+	w io.Writer
+}
+
+func (w *switchedWriter) Write(p []byte) (n int, err error) {
+	if !w.s.Enabled() {
+		n = len(p)
+		return
+	}
+
+	n, err = w.w.Write(p)
+	return
+}
+
+// The state of the mount managed through the admin API, filled in as the
+// mount is set up.
+type adminServer struct {
+	bucketName string
+	mountPoint string
+
+	// The file system, once mountWithConn has created it.
+	fs adminFileSystem
+
+	// The stat cache in front of the bucket, or nil if there is none.
+	statCache gcscaching.StatCache
+
+	// Switches for the loggers enabled by --debug_fuse and --debug_gcs, which
+	// are always installed when there is an admin API.
+	debugFuse *logSwitch
+	debugGCS  *logSwitch
+
+	listener net.Listener
+}
+
+func newAdminServer(
+	bucketName string,
+	mountPoint string,
+	flags *flagStorage) (s *adminServer) {
+	s = &adminServer{
+		bucketName: bucketName,
+		mountPoint: mountPoint,
+		debugFuse:  newLogSwitch(flags.DebugFuse),
+		debugGCS:   newLogSwitch(flags.DebugGCS),
+	}
+
+	return
+}
+
+// Start serving the API on a unix socket at the supplied path, replacing any
+// socket left there by an earlier mount. The socket is made accessible only
+// to the user running gcsfuse.
+func (s *adminServer) Listen(path string) (err error) {
+	fi, err := os.Lstat(path)
+	switch {
+	case os.IsNotExist(err):
+		err = nil
+
+	case err != nil:
+		return
+
+	case fi.Mode()&os.ModeSocket == 0:
+		err = fmt.Errorf("%s exists and is not a socket", path)
+		return
+
+	default:
+		if err = os.Remove(path); err != nil {
+			return
+		}
+	}
+
+	s.listener, err = net.Listen("unix", path)
+	if err != nil {
+		err = fmt.Errorf("Listen: %v", err)
+		return
+	}
+
+	if err = os.Chmod(path, 0600); err != nil {
+		s.listener.Close()
+		return
+	}
+
+	go func() {
+		err := http.Serve(s.listener, s)
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Printf("Admin API: %v", err)
+		}
+	}()
+
+	return
+}
+
+// Stop serving the API and remove the socket.
+func (s *adminServer) Close() {
+	if s.listener != nil {
+		s.listener.Close()
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// HTTP API
+////////////////////////////////////////////////////////////////////////
+
+// The body of GET /mounts, one per mount.
+type adminMount struct {
+	Bucket     string `json:"bucket"`
+	MountPoint string `json:"mount_point"`
+	PID        int    `json:"pid"`
+}
+
+// The body of POST /flush.
+type adminFlushResult struct {
+	SyncedFiles int   `json:"synced_files"`
+	SyncedBytes int64 `json:"synced_bytes"`
+}
+
+// The body of GET and PUT /log. Fields omitted from a PUT are left alone.
+type adminLogConfig struct {
+	DebugFuse *bool `json:"debug_fuse,omitempty"`
+	DebugGCS  *bool `json:"debug_gcs,omitempty"`
+}
+
+func (s *adminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var v interface{}
+	var err error
+	status := http.StatusOK
+
+	route := r.Method + " " + r.URL.Path
+	switch route {
+	case "GET /mounts":
+		v = []adminMount{{s.bucketName, s.mountPoint, os.Getpid()}}
+
+	case "GET /status":
+		v, err = s.fs.Status()
+
+	case "POST /flush":
+		var res adminFlushResult
+		res.SyncedFiles, res.SyncedBytes, err = s.fs.Flush(r.Context())
+		v = res
+
+	case "POST /invalidate":
+		v, status, err = s.invalidate(r.URL.Query().Get("name"))
+
+	case "GET /log":
+		v = s.logConfig()
+
+	case "PUT /log":
+		v, status, err = s.setLogConfig(r.Body)
+
+	case "POST /drain":
+		v, err = struct{}{}, s.fs.Drain()
+
+	default:
+		status = http.StatusNotFound
+		err = fmt.Errorf("Unknown request: %s", route)
+	}
+
+	if err != nil {
+		if status == http.StatusOK {
+			status = http.StatusInternalServerError
+		}
+
+		log.Printf("Admin API: %s %s: %v", r.Method, r.URL.Path, err)
+		v = struct {
+			Error string `json:"error"`
+		}{err.Error()}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Forget cached metadata for the named file or directory.
+func (s *adminServer) invalidate(
+	name string) (v interface{}, status int, err error) {
+	status = http.StatusOK
+	v = struct{}{}
+
+	if strings.Trim(name, "/") == "" {
+		status = http.StatusBadRequest
+		err = errors.New("A non-empty name parameter is required")
+		return
+	}
+
+	// The stat cache sits in front of the bucket, out of sight of the file
+	// system. Directories are cached under names with a trailing slash.
+	if s.statCache != nil {
+		name := strings.Trim(name, "/")
+		s.statCache.Erase(name)
+		s.statCache.Erase(name + "/")
+	}
+
+	err = s.fs.Invalidate(name)
+	return
+}
+
+func (s *adminServer) logConfig() (c adminLogConfig) {
+	debugFuse := s.debugFuse.Enabled()
+	debugGCS := s.debugGCS.Enabled()
+
+	c.DebugFuse = &debugFuse
+	c.DebugGCS = &debugGCS
+	return
+}
+
+func (s *adminServer) setLogConfig(
+	body io.Reader) (v interface{}, status int, err error) {
+	status = http.StatusOK
+
+	var c adminLogConfig
+	if err = json.NewDecoder(body).Decode(&c); err != nil {
+		status = http.StatusBadRequest
+		err = fmt.Errorf("Decoding body: %v", err)
+		return
+	}
+
+	if c.DebugFuse != nil {
+		s.debugFuse.SetEnabled(*c.DebugFuse)
+	}
+
+	if c.DebugGCS != nil {
+		s.debugGCS.SetEnabled(*c.DebugGCS)
+	}
+
+	log.Printf(
+		"Admin API: debug_fuse=%v debug_gcs=%v",
+		s.debugFuse.Enabled(),
+		s.debugGCS.Enabled())
+
+	v = s.logConfig()
+	return
+}
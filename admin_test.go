@@ -0,0 +1,287 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcscaching"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+)
+
+////////////////////////////////////////////////////////////////////////
+// fakeAdminFileSystem
+////////////////////////////////////////////////////////////////////////
+
+type fakeAdminFileSystem struct {
+	flushErr    error
+	flushes     int
+	invalidated []string
+	drains      int
+}
+
+func (f *fakeAdminFileSystem) Status() (s fs.Status, err error) {
+	s.ConfigHash = "0123456789abcdef"
+	s.PendingUploads = 2
+	return
+}
+
+func (f *fakeAdminFileSystem) Flush(
+	ctx context.Context) (synced int, bytes int64, err error) {
+	f.flushes++
+	synced, bytes, err = 3, 1024, f.flushErr
+	return
+}
+
+func (f *fakeAdminFileSystem) Invalidate(name string) (err error) {
+	f.invalidated = append(f.invalidated, name)
+	return
+}
+
+func (f *fakeAdminFileSystem) Drain() (err error) {
+	f.drains++
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type AdminTest struct {
+	fs        fakeAdminFileSystem
+	statCache gcscaching.StatCache
+	server    *adminServer
+}
+
+var _ SetUpInterface = &AdminTest{}
+
+func init() { RegisterTestSuite(&AdminTest{}) }
+
+func (t *AdminTest) SetUp(ti *TestInfo) {
+	t.statCache = gcscaching.NewStatCache(10)
+	t.server = newAdminServer(
+		"some-bucket",
+		"/mnt/gcs",
+		parseArgs([]string{"--debug_fuse"}))
+
+	t.server.fs = &t.fs
+	t.server.statCache = t.statCache
+}
+
+// Make a request of the server, returning the status and decoding the body
+// into v.
+func (t *AdminTest) do(
+	method string,
+	url string,
+	body string,
+	v interface{}) (status int) {
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	t.server.ServeHTTP(w, r)
+
+	ExpectEq("application/json", w.Header().Get("Content-Type"))
+	err := json.Unmarshal(w.Body.Bytes(), v)
+	AssertEq(nil, err, "%s", w.Body.String())
+
+	status = w.Code
+	return
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *AdminTest) Mounts() {
+	var mounts []adminMount
+	AssertEq(http.StatusOK, t.do("GET", "/mounts", "", &mounts))
+
+	AssertEq(1, len(mounts))
+	ExpectEq("some-bucket", mounts[0].Bucket)
+	ExpectEq("/mnt/gcs", mounts[0].MountPoint)
+	ExpectEq(os.Getpid(), mounts[0].PID)
+}
+
+func (t *AdminTest) Status() {
+	var s fs.Status
+	AssertEq(http.StatusOK, t.do("GET", "/status", "", &s))
+
+	ExpectEq("0123456789abcdef", s.ConfigHash)
+	ExpectEq(2, s.PendingUploads)
+}
+
+func (t *AdminTest) Flush() {
+	var res adminFlushResult
+	AssertEq(http.StatusOK, t.do("POST", "/flush", "", &res))
+
+	ExpectEq(1, t.fs.flushes)
+	ExpectEq(3, res.SyncedFiles)
+	ExpectEq(1024, res.SyncedBytes)
+}
+
+func (t *AdminTest) FlushFails() {
+	t.fs.flushErr = errors.New("taco")
+
+	var res adminError
+	ExpectEq(http.StatusInternalServerError, t.do("POST", "/flush", "", &res))
+	ExpectEq("taco", res.Error)
+}
+
+func (t *AdminTest) Invalidate() {
+	now := time.Now()
+	expiration := now.Add(time.Hour)
+	t.statCache.Insert(&gcs.Object{Name: "a/b", Generation: 1}, expiration)
+	t.statCache.Insert(&gcs.Object{Name: "a/b/", Generation: 1}, expiration)
+	t.statCache.Insert(&gcs.Object{Name: "a/c", Generation: 1}, expiration)
+
+	var res struct{}
+	AssertEq(
+		http.StatusOK,
+		t.do("POST", "/invalidate?name=a%2Fb", "", &res))
+
+	ExpectThat(t.fs.invalidated, ElementsAre("a/b"))
+
+	hit, _ := t.statCache.LookUp("a/b", now)
+	ExpectFalse(hit)
+
+	hit, _ = t.statCache.LookUp("a/b/", now)
+	ExpectFalse(hit)
+
+	hit, _ = t.statCache.LookUp("a/c", now)
+	ExpectTrue(hit)
+}
+
+func (t *AdminTest) InvalidateWithoutName() {
+	var res adminError
+	ExpectEq(http.StatusBadRequest, t.do("POST", "/invalidate", "", &res))
+	ExpectThat(res.Error, HasSubstr("name"))
+	ExpectEq(0, len(t.fs.invalidated))
+}
+
+func (t *AdminTest) Log() {
+	var c adminLogConfig
+	AssertEq(http.StatusOK, t.do("GET", "/log", "", &c))
+	ExpectTrue(*c.DebugFuse)
+	ExpectFalse(*c.DebugGCS)
+
+	// Fields left out are unchanged.
+	AssertEq(http.StatusOK, t.do("PUT", "/log", `{"debug_gcs": true}`, &c))
+	ExpectTrue(*c.DebugFuse)
+	ExpectTrue(*c.DebugGCS)
+
+	AssertEq(http.StatusOK, t.do("PUT", "/log", `{"debug_fuse": false}`, &c))
+	ExpectFalse(*c.DebugFuse)
+	ExpectTrue(*c.DebugGCS)
+
+	var res adminError
+	ExpectEq(http.StatusBadRequest, t.do("PUT", "/log", "{", &res))
+}
+
+func (t *AdminTest) LogSwitch() {
+	var buf bytes.Buffer
+	s := newLogSwitch(false)
+	w := s.Wrap(&buf)
+
+	n, err := w.Write([]byte("taco"))
+	AssertEq(nil, err)
+	ExpectEq(4, n)
+
+	s.SetEnabled(true)
+	_, err = w.Write([]byte("burrito"))
+	AssertEq(nil, err)
+
+	ExpectEq("burrito", buf.String())
+}
+
+func (t *AdminTest) Drain() {
+	var res struct{}
+	AssertEq(http.StatusOK, t.do("POST", "/drain", "", &res))
+	ExpectEq(1, t.fs.drains)
+}
+
+func (t *AdminTest) UnknownRequests() {
+	var res adminError
+	ExpectEq(http.StatusNotFound, t.do("GET", "/taco", "", &res))
+	ExpectEq(http.StatusNotFound, t.do("GET", "/drain", "", &res))
+	ExpectEq(0, t.fs.drains)
+}
+
+func (t *AdminTest) UnixSocket() {
+	dir, err := ioutil.TempDir("", "admin_test")
+	AssertEq(nil, err)
+	defer os.RemoveAll(dir)
+
+	// A stale socket is replaced.
+	p := path.Join(dir, "admin.sock")
+	l, err := net.Listen("unix", p)
+	AssertEq(nil, err)
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	err = t.server.Listen(p)
+	AssertEq(nil, err)
+
+	fi, err := os.Stat(p)
+	AssertEq(nil, err)
+	ExpectEq(os.FileMode(0600), fi.Mode().Perm())
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial("unix", p)
+			},
+		},
+	}
+
+	resp, err := client.Get("http://gcsfuse/mounts")
+	AssertEq(nil, err)
+	resp.Body.Close()
+	ExpectEq(http.StatusOK, resp.StatusCode)
+
+	// Closing removes the socket.
+	t.server.Close()
+	_, err = os.Stat(p)
+	ExpectTrue(os.IsNotExist(err), "err: %v", err)
+}
+
+func (t *AdminTest) ListenRefusesOtherFiles() {
+	dir, err := ioutil.TempDir("", "admin_test")
+	AssertEq(nil, err)
+	defer os.RemoveAll(dir)
+
+	p := path.Join(dir, "admin.sock")
+	err = ioutil.WriteFile(p, []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = t.server.Listen(p)
+	ExpectThat(err, Error(HasSubstr("not a socket")))
+}
@@ -0,0 +1,196 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Replay a trace recorded with gcsfuse --read-trace under a range of cache
+// sizes and readahead settings, reporting the cache hit rate and the GCS
+// traffic each would lead to.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/googlecloudplatform/gcsfuse/benchmarks/internal/format"
+	"github.com/googlecloudplatform/gcsfuse/internal/readtrace"
+	"golang.org/x/net/context"
+)
+
+var fTrace = flag.String("trace", "", "Path to a trace recorded with --read-trace.")
+var fCacheSizes = flag.String("cache_sizes", "0,64M,256M,1G", "Comma-separated cache sizes to simulate.")
+var fReadaheads = flag.String("readaheads", "0,128K,1M", "Comma-separated readahead sizes to simulate.")
+var fBlockSize = flag.String("block_size", "4K", "Granularity of the simulated cache.")
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Parse a size in bytes with an optional K, M, or G suffix.
+func parseSize(s string) (n int64, err error) {
+	var multiplier int64 = 1
+	switch {
+	case strings.HasSuffix(s, "K"):
+		multiplier = 1 << 10
+
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1 << 20
+
+	case strings.HasSuffix(s, "G"):
+		multiplier = 1 << 30
+	}
+
+	if multiplier != 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err = strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return
+	}
+
+	if n < 0 {
+		err = fmt.Errorf("Negative size: %d", n)
+		return
+	}
+
+	n *= multiplier
+	return
+}
+
+func parseSizes(s string) (sizes []int64, err error) {
+	for _, part := range strings.Split(s, ",") {
+		var n int64
+		n, err = parseSize(strings.TrimSpace(part))
+		if err != nil {
+			err = fmt.Errorf("parseSize(%q): %v", part, err)
+			return
+		}
+
+		sizes = append(sizes, n)
+	}
+
+	return
+}
+
+// Replay the trace at the given path under the supplied configuration.
+func replay(
+	ctx context.Context,
+	path string,
+	cfg readtrace.Config) (s readtrace.Stats, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	s, err = readtrace.Simulate(ctx, readtrace.NewReader(f), cfg)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// main logic
+////////////////////////////////////////////////////////////////////////
+
+func run() (err error) {
+	if *fTrace == "" {
+		err = errors.New("You must set --trace.")
+		return
+	}
+
+	cacheSizes, err := parseSizes(*fCacheSizes)
+	if err != nil {
+		err = fmt.Errorf("--cache_sizes: %v", err)
+		return
+	}
+
+	readaheads, err := parseSizes(*fReadaheads)
+	if err != nil {
+		err = fmt.Errorf("--readaheads: %v", err)
+		return
+	}
+
+	blockSize, err := parseSize(*fBlockSize)
+	if err != nil || blockSize == 0 {
+		err = fmt.Errorf("Invalid --block_size: %q", *fBlockSize)
+		return
+	}
+
+	ctx := context.Background()
+	printedTotals := false
+
+	for _, cacheSize := range cacheSizes {
+		for _, readahead := range readaheads {
+			cfg := readtrace.Config{
+				CacheSize: cacheSize,
+				BlockSize: blockSize,
+				Readahead: readahead,
+			}
+
+			var s readtrace.Stats
+			s, err = replay(ctx, *fTrace, cfg)
+			if err != nil {
+				err = fmt.Errorf("replay: %v", err)
+				return
+			}
+
+			if !printedTotals {
+				fmt.Printf(
+					"Replayed %d reads (%s).\n\n",
+					s.Reads,
+					format.Bytes(float64(s.Bytes)))
+
+				fmt.Printf(
+					"%-12s %-12s %-10s %-14s %s\n",
+					"cache",
+					"readahead",
+					"hit rate",
+					"GCS requests",
+					"GCS bytes")
+
+				printedTotals = true
+			}
+
+			var hitRate float64
+			if s.Bytes > 0 {
+				hitRate = float64(s.CacheHitBytes) / float64(s.Bytes)
+			}
+
+			fmt.Printf(
+				"%-12s %-12s %-10s %-14d %s\n",
+				format.Bytes(float64(cacheSize)),
+				format.Bytes(float64(readahead)),
+				fmt.Sprintf("%.1f%%", 100*hitRate),
+				s.GCSRequests,
+				format.Bytes(float64(s.GCSBytes)))
+		}
+	}
+
+	return
+}
+
+func main() {
+	log.SetFlags(log.Lmicroseconds | log.Lshortfile)
+	flag.Parse()
+
+	err := run()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
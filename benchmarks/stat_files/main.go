@@ -29,7 +29,7 @@ import (
 	"golang.org/x/net/context"
 
 	"github.com/googlecloudplatform/gcsfuse/benchmarks/internal/format"
-	"github.com/jacobsa/fuse/fsutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fsutil"
 	"github.com/jacobsa/syncutil"
 )
 
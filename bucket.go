@@ -23,10 +23,11 @@ import (
 	"golang.org/x/net/context"
 
 	"github.com/googlecloudplatform/gcsfuse/internal/canned"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcscaching"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/ratelimit"
 	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
-	"github.com/jacobsa/gcloud/gcs"
-	"github.com/jacobsa/gcloud/gcs/gcscaching"
-	"github.com/jacobsa/ratelimit"
+	"github.com/googlecloudplatform/gcsfuse/internal/scrub"
 	"github.com/jacobsa/timeutil"
 )
 
@@ -75,16 +76,105 @@ func setUpRateLimiting(
 	opThrottle := ratelimit.NewThrottle(opRateLimitHz, opCapacity)
 	egressThrottle := ratelimit.NewThrottle(egressBandwidthLimit, egressCapacity)
 
-	// And the bucket.
+	// And the bucket. The bandwidth limit applies to uploads as well as
+	// downloads.
 	out = ratelimit.NewThrottledBucket(
 		opThrottle,
 		egressThrottle,
-		in)
+		gcsx.NewUploadThrottledBucket(egressThrottle, in))
 
 	return
 }
 
-// Configure a bucket based on the supplied flags.
+func setUpFaultInjection(
+	in gcs.Bucket,
+	scenarioPath string) (out gcs.Bucket, err error) {
+	f, err := os.Open(scenarioPath)
+	if err != nil {
+		err = fmt.Errorf("Open: %v", err)
+		return
+	}
+
+	defer f.Close()
+
+	s, err := gcsx.ParseFaultScenario(f)
+	if err != nil {
+		err = fmt.Errorf("ParseFaultScenario: %v", err)
+		return
+	}
+
+	out = gcsx.NewFaultInjectingBucket(s, in)
+	return
+}
+
+func setUpNameMapping(
+	in gcs.Bucket,
+	mappingPath string) (out gcs.Bucket, err error) {
+	f, err := os.Open(mappingPath)
+	if err != nil {
+		err = fmt.Errorf("Open: %v", err)
+		return
+	}
+
+	defer f.Close()
+
+	m, err := gcsx.ParseNameMapping(f)
+	if err != nil {
+		err = fmt.Errorf("ParseNameMapping: %v", err)
+		return
+	}
+
+	out = gcsx.NewNameMappingBucket(m, in)
+	return
+}
+
+// Return the prefix of the object names within --only-dir, e.g. "foo/bar/",
+// or the empty string if the whole bucket is mounted.
+func onlyDirPrefix(flags *flagStorage) string {
+	if flags.OnlyDir == "" {
+		return ""
+	}
+
+	return path.Clean(flags.OnlyDir) + "/"
+}
+
+// Configure a bucket based on the supplied flags. The result is the only
+// bucket used by the mount, so every subsystem (the file system, the syncer,
+// and temporary object garbage collection) shares the same connection pool
+// and the same layers, which are applied in this order from the bottom up:
+//
+//  *  fault injection, if requested, so that injected failures look like
+//     real ones to everything above;
+//
+//  *  failover of reads to --failover-bucket, so that it sees injected
+//     failures and every layer above is shared by both buckets;
+//
+//  *  throttling backoff, so that it observes every failed request;
+//
+//  *  retries of requests that fail transiently, so that each attempt waits
+//     out any throttling penalty;
+//
+//  *  stats and listings served from inventory reports, if requested, which
+//     name objects as GCS does;
+//
+//  *  restriction to --only-dir;
+//
+//  *  name mapping, so that mapping rules are relative to --only-dir;
+//
+//  *  rate limiting, so that it counts only requests that reach GCS;
+//
+//  *  compression of objects matching --compress-suffixes, so that the
+//     layers above see uncompressed sizes and contents;
+//
+//  *  a snapshot of the bucket, if requested, taken through all of the above;
+//
+//  *  stat storm protection, so that it sees stats that miss the stat cache;
+//     and
+//
+//  *  stat caching.
+//
+// The stat cache, if any, is also returned, so that entries can be erased
+// through the admin API.
 //
 // Special case: if the bucket name is canned.FakeBucketName, set up a fake
 // bucket as described in that package.
@@ -92,7 +182,7 @@ func setUpBucket(
 	ctx context.Context,
 	flags *flagStorage,
 	conn gcs.Conn,
-	name string) (b gcs.Bucket, err error) {
+	name string) (b gcs.Bucket, statCache gcscaching.StatCache, err error) {
 	// Set up the appropriate backing bucket.
 	if name == canned.FakeBucketName {
 		b = canned.MakeFakeBucket(ctx)
@@ -104,15 +194,85 @@ func setUpBucket(
 		}
 	}
 
+	// Inject faults for testing, if requested.
+	if flags.FaultInjectionScenario != "" {
+		b, err = setUpFaultInjection(b, flags.FaultInjectionScenario)
+		if err != nil {
+			err = fmt.Errorf("setUpFaultInjection: %v", err)
+			return
+		}
+	}
+
+	// Fail reads over to a mirror of the bucket, if requested.
+	if flags.FailoverBucket != "" {
+		var secondary gcs.Bucket
+		secondary, err = conn.OpenBucket(ctx, &gcs.OpenBucketOptions{Name: flags.FailoverBucket, BillingProject: flags.BillingProject})
+		if err != nil {
+			err = fmt.Errorf("OpenBucket(%q): %v", flags.FailoverBucket, err)
+			return
+		}
+
+		const failoverThreshold = 3
+		b = gcsx.NewFailoverBucket(
+			ctx,
+			failoverThreshold,
+			flags.FailoverCheckInterval,
+			onlyDirPrefix(flags),
+			b,
+			secondary)
+	}
+
+	// Back off the whole mount when GCS tells us we're being throttled.
+	if flags.MaxThrottlePenalty > 0 {
+		const minThrottlePenalty = 250 * time.Millisecond
+		b = gcsx.NewBackoffBucket(
+			gcsx.NewThrottleBackoff(
+				minThrottlePenalty,
+				flags.MaxThrottlePenalty,
+				timeutil.RealClock()),
+			b)
+	}
+
+	// Retry requests that fail transiently, unless disabled.
+	if flags.MaxRetrySleep > 0 {
+		b = gcsx.NewRetryBucket(flags.MaxRetrySleep, flags.RetryMultiplier, b)
+	}
+
+	// Serve stats and listings from inventory reports for a while, if
+	// requested.
+	if len(flags.InventoryReports) > 0 {
+		b, err = gcsx.NewInventoryBucket(
+			flags.InventoryReports,
+			flags.InventoryTTL,
+			timeutil.RealClock(),
+			flags.SnapshotSpoolThreshold,
+			flags.TempDir,
+			b)
+
+		if err != nil {
+			err = fmt.Errorf("NewInventoryBucket: %v", err)
+			return
+		}
+	}
+
 	// Limit to a requested prefix of the bucket, if any.
 	if flags.OnlyDir != "" {
-		b, err = gcsx.NewPrefixBucket(path.Clean(flags.OnlyDir)+"/", b)
+		b, err = gcsx.NewPrefixBucket(onlyDirPrefix(flags), b)
 		if err != nil {
 			err = fmt.Errorf("NewPrefixBucket: %v", err)
 			return
 		}
 	}
 
+	// Map file system paths to object names, if requested.
+	if flags.NameMapping != "" {
+		b, err = setUpNameMapping(b, flags.NameMapping)
+		if err != nil {
+			err = fmt.Errorf("setUpNameMapping: %v", err)
+			return
+		}
+	}
+
 	// Enable rate limiting, if requested.
 	b, err = setUpRateLimiting(
 		b,
@@ -124,12 +284,87 @@ func setUpBucket(
 		return
 	}
 
+	// Compress objects with matching names, if requested.
+	if flags.CompressSuffixes != "" {
+		var rules []gcsx.CompressionRule
+		rules, err = gcsx.ParseCompressionRules(flags.CompressSuffixes)
+		if err != nil {
+			err = fmt.Errorf("ParseCompressionRules: %v", err)
+			return
+		}
+
+		b = gcsx.NewCompressingBucket(rules, flags.TempDir, b)
+	}
+
+	// Pin the mount to the bucket's current or past contents, if requested.
+	if flags.Snapshot && flags.AsOf != "" {
+		var asOf time.Time
+		asOf, err = time.Parse(time.RFC3339, flags.AsOf)
+		if err != nil {
+			err = fmt.Errorf("Parsing --as-of: %v", err)
+			return
+		}
+
+		b, err = gcsx.NewAsOfBucket(
+			ctx,
+			b,
+			asOf,
+			flags.SnapshotSpoolThreshold,
+			flags.TempDir)
+
+		if err != nil {
+			err = fmt.Errorf("NewAsOfBucket: %v", err)
+			return
+		}
+	} else if flags.Snapshot {
+		b, err = gcsx.NewSnapshotBucket(
+			ctx,
+			b,
+			flags.SnapshotSpoolThreshold,
+			flags.TempDir)
+
+		if err != nil {
+			err = fmt.Errorf("NewSnapshotBucket: %v", err)
+			return
+		}
+	}
+
+	// Serve query results, if requested.
+	if len(flags.QueryHandlers) > 0 {
+		var handlers map[string]gcsx.QueryHandler
+		handlers, err = gcsx.ParseQueryCommands(flags.QueryHandlers)
+		if err != nil {
+			err = fmt.Errorf("ParseQueryCommands: %v", err)
+			return
+		}
+
+		b = gcsx.NewQueryBucket(handlers, b)
+	}
+
+	// Protect GCS from applications that stat the same object in a loop.
+	if flags.StatStormThreshold > 0 {
+		b = gcsx.NewStatStormBucket(
+			flags.StatStormThreshold,
+			timeutil.RealClock(),
+			b)
+	}
+
+	// Keep stats of objects in active use fresh by polling, if requested.
+	if flags.PollInterval > 0 {
+		b = gcsx.NewPollingBucket(
+			ctx,
+			flags.PollInterval,
+			timeutil.RealClock(),
+			b)
+	}
+
 	// Enable cached StatObject results, if appropriate.
 	if flags.StatCacheTTL != 0 {
 		cacheCapacity := flags.StatCacheCapacity
+		statCache = gcscaching.NewStatCache(cacheCapacity)
 		b = gcscaching.NewFastStatBucket(
 			flags.StatCacheTTL,
-			gcscaching.NewStatCache(cacheCapacity),
+			statCache,
 			timeutil.RealClock(),
 			b)
 	}
@@ -139,7 +374,10 @@ func setUpBucket(
 	{
 		_, err := b.ListObjects(ctx, &gcs.ListObjectsRequest{MaxResults: 1})
 		if err != nil {
-			fmt.Fprintln(os.Stdout, "WARNING, bucket doesn't appear to work: ", err)
+			fmt.Fprintln(
+				os.Stdout,
+				"WARNING, bucket doesn't appear to work: ",
+				scrub.New(flags.RedactObjectNames).Error(err))
 		}
 	}
 
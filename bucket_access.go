@@ -0,0 +1,138 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// The IAM permissions whose presence we check for.
+var bucketAccessPermissions = []string{
+	"storage.objects.get",
+	"storage.objects.list",
+	"storage.objects.create",
+	"storage.objects.delete",
+}
+
+// Ask the supplied endpoint which of bucketAccessPermissions the client's
+// credentials hold on the named bucket.
+func fetchBucketAccess(
+	ctx context.Context,
+	client *http.Client,
+	endpoint string,
+	bucketName string,
+	billingProject string) (a fs.BucketAccess, err error) {
+	query := url.Values{
+		"permissions": bucketAccessPermissions,
+	}
+
+	if billingProject != "" {
+		query.Set("userProject", billingProject)
+	}
+
+	req, err := http.NewRequest(
+		"GET",
+		endpoint+url.PathEscape(bucketName)+"/iam/testPermissions?"+
+			query.Encode(),
+		nil)
+
+	if err != nil {
+		err = fmt.Errorf("NewRequest: %v", err)
+		return
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return
+	}
+
+	defer resp.Body.Close()
+
+	err = googleapi.CheckResponse(resp)
+	if err != nil {
+		return
+	}
+
+	var body struct {
+		Permissions []string `json:"permissions"`
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		err = fmt.Errorf("Decoding permissions: %v", err)
+		return
+	}
+
+	held := make(map[string]bool)
+	for _, p := range body.Permissions {
+		held[p] = true
+	}
+
+	a = fs.BucketAccess{
+		Read:  held["storage.objects.get"],
+		List:  held["storage.objects.list"],
+		Write: held["storage.objects.create"] && held["storage.objects.delete"],
+	}
+
+	return
+}
+
+// Return a function that finds out the access of the credentials configured
+// by the supplied flags to the named bucket.
+func newBucketAccessFunc(
+	flags *flagStorage,
+	bucketName string) (f fs.BucketAccessFunc, err error) {
+	tokenSrc, err := newTokenSource(flags)
+	if err != nil {
+		return
+	}
+
+	client := &http.Client{
+		Transport: &oauth2.Transport{
+			Source: tokenSrc,
+			Base:   newHTTPTransport(flags),
+		},
+	}
+
+	f = func(ctx context.Context) (a fs.BucketAccess, err error) {
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+
+		a, err = fetchBucketAccess(
+			ctx,
+			client,
+			bucketsEndpoint,
+			bucketName,
+			flags.BillingProject)
+
+		if err != nil {
+			err = fmt.Errorf("fetchBucketAccess: %v", err)
+			return
+		}
+
+		return
+	}
+
+	return
+}
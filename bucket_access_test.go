@@ -0,0 +1,150 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type BucketAccessTest struct {
+	ctx    context.Context
+	server *httptest.Server
+
+	// The request most recently received by the server.
+	req *http.Request
+
+	// The response the server gives.
+	status int
+	body   string
+}
+
+var _ SetUpInterface = &BucketAccessTest{}
+var _ TearDownInterface = &BucketAccessTest{}
+
+func init() { RegisterTestSuite(&BucketAccessTest{}) }
+
+func (t *BucketAccessTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.status = http.StatusOK
+	t.server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			t.req = r
+			w.WriteHeader(t.status)
+			fmt.Fprint(w, t.body)
+		}))
+}
+
+func (t *BucketAccessTest) TearDown() {
+	t.server.Close()
+}
+
+func (t *BucketAccessTest) fetch(
+	billingProject string) (a fs.BucketAccess, err error) {
+	a, err = fetchBucketAccess(
+		t.ctx,
+		http.DefaultClient,
+		t.server.URL+"/b/",
+		"some-bucket",
+		billingProject)
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *BucketAccessTest) Request() {
+	t.body = `{}`
+
+	_, err := t.fetch("")
+	AssertEq(nil, err)
+
+	ExpectEq("/b/some-bucket/iam/testPermissions", t.req.URL.Path)
+	ExpectThat(t.req.URL.Query()["permissions"], ElementsAre(
+		"storage.objects.get",
+		"storage.objects.list",
+		"storage.objects.create",
+		"storage.objects.delete",
+	))
+
+	ExpectEq("", t.req.URL.Query().Get("userProject"))
+}
+
+func (t *BucketAccessTest) AllPermissions() {
+	t.body = `{"permissions": [
+		"storage.objects.get",
+		"storage.objects.list",
+		"storage.objects.create",
+		"storage.objects.delete"
+	]}`
+
+	a, err := t.fetch("")
+	AssertEq(nil, err)
+	ExpectThat(a, DeepEquals(fs.BucketAccess{Read: true, List: true, Write: true}))
+}
+
+func (t *BucketAccessTest) ReadOnly() {
+	t.body = `{"permissions": ["storage.objects.get", "storage.objects.list"]}`
+
+	a, err := t.fetch("")
+	AssertEq(nil, err)
+	ExpectThat(a, DeepEquals(fs.BucketAccess{Read: true, List: true}))
+}
+
+func (t *BucketAccessTest) CreateWithoutDelete() {
+	t.body = `{"permissions": ["storage.objects.get", "storage.objects.create"]}`
+
+	a, err := t.fetch("")
+	AssertEq(nil, err)
+	ExpectThat(a, DeepEquals(fs.BucketAccess{Read: true}))
+}
+
+func (t *BucketAccessTest) NoPermissions() {
+	// GCS omits the field entirely.
+	t.body = `{"kind": "storage#testIamPermissionsResponse"}`
+
+	a, err := t.fetch("")
+	AssertEq(nil, err)
+	ExpectThat(a, DeepEquals(fs.BucketAccess{}))
+}
+
+func (t *BucketAccessTest) BillingProject() {
+	t.body = `{}`
+
+	_, err := t.fetch("burrito")
+	AssertEq(nil, err)
+
+	ExpectEq("burrito", t.req.URL.Query().Get("userProject"))
+}
+
+func (t *BucketAccessTest) RequestFails() {
+	t.status = http.StatusNotFound
+	t.body = `{"error": {"code": 404, "message": "No such bucket."}}`
+
+	_, err := t.fetch("")
+	ExpectThat(err, Error(HasSubstr("No such bucket")))
+}
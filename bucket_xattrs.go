@@ -0,0 +1,191 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/lifecycle"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// The JSON API endpoint under which bucket resources are found.
+const bucketsEndpoint = "https://www.googleapis.com/storage/v1/b/"
+
+// The prefix of the names of the extended attributes through which the root
+// directory reports properties of the bucket.
+const bucketXattrPrefix = "user.gcs.bucket."
+
+// The properties of a bucket that we report, as returned by the JSON API.
+// (The vendored API package predates retention policies.)
+type bucketResource struct {
+	Location     string `json:"location"`
+	LocationType string `json:"locationType"`
+	StorageClass string `json:"storageClass"`
+
+	Versioning struct {
+		Enabled bool `json:"enabled"`
+	} `json:"versioning"`
+
+	RetentionPolicy *struct {
+		RetentionPeriod int64 `json:"retentionPeriod,string"`
+		IsLocked        bool  `json:"isLocked"`
+	} `json:"retentionPolicy"`
+
+	Labels map[string]string `json:"labels"`
+
+	Lifecycle struct {
+		Rule []lifecycle.Rule `json:"rule"`
+	} `json:"lifecycle"`
+}
+
+// Fetch the properties of the named bucket from the supplied endpoint.
+func fetchBucketResource(
+	ctx context.Context,
+	client *http.Client,
+	endpoint string,
+	bucketName string,
+	billingProject string) (b *bucketResource, err error) {
+	query := url.Values{
+		"fields": {"location,locationType,storageClass,versioning," +
+			"retentionPolicy,labels,lifecycle"},
+	}
+
+	if billingProject != "" {
+		query.Set("userProject", billingProject)
+	}
+
+	req, err := http.NewRequest(
+		"GET",
+		endpoint+url.PathEscape(bucketName)+"?"+query.Encode(),
+		nil)
+
+	if err != nil {
+		err = fmt.Errorf("NewRequest: %v", err)
+		return
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return
+	}
+
+	defer resp.Body.Close()
+
+	err = googleapi.CheckResponse(resp)
+	if err != nil {
+		return
+	}
+
+	b = new(bucketResource)
+	err = json.NewDecoder(resp.Body).Decode(b)
+	if err != nil {
+		err = fmt.Errorf("Decoding bucket resource: %v", err)
+		return
+	}
+
+	return
+}
+
+// Return the extended attributes describing the supplied bucket, by name.
+// Properties that GCS didn't report are omitted.
+func bucketXattrs(b *bucketResource) (xattrs map[string]string) {
+	xattrs = make(map[string]string)
+	set := func(name string, v string) {
+		if v != "" {
+			xattrs[bucketXattrPrefix+name] = v
+		}
+	}
+
+	set("location", b.Location)
+	set("location_type", b.LocationType)
+	set("storage_class", b.StorageClass)
+	set("versioning", strconv.FormatBool(b.Versioning.Enabled))
+
+	if p := b.RetentionPolicy; p != nil {
+		set("retention_period", strconv.FormatInt(p.RetentionPeriod, 10))
+		set("retention_locked", strconv.FormatBool(p.IsLocked))
+	}
+
+	for k, v := range b.Labels {
+		set("label."+k, v)
+	}
+
+	return
+}
+
+// Return the lifecycle configuration of the supplied bucket, including its
+// retention policy.
+func bucketLifecycle(b *bucketResource) (lc *lifecycle.Config) {
+	lc = &lifecycle.Config{
+		Rules:               b.Lifecycle.Rule,
+		DefaultStorageClass: b.StorageClass,
+	}
+
+	if p := b.RetentionPolicy; p != nil {
+		lc.RetentionPeriod = time.Duration(p.RetentionPeriod) * time.Second
+	}
+
+	return
+}
+
+// Fetch the properties of the named bucket using the credentials configured
+// by the supplied flags, returning the extended attributes that describe it
+// and its lifecycle configuration.
+func getBucketProperties(
+	ctx context.Context,
+	flags *flagStorage,
+	bucketName string) (
+	xattrs map[string]string,
+	lc *lifecycle.Config,
+	err error) {
+	tokenSrc, err := newTokenSource(flags)
+	if err != nil {
+		return
+	}
+
+	client := &http.Client{
+		Transport: &oauth2.Transport{
+			Source: tokenSrc,
+			Base:   newHTTPTransport(flags),
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	b, err := fetchBucketResource(
+		ctx,
+		client,
+		bucketsEndpoint,
+		bucketName,
+		flags.BillingProject)
+
+	if err != nil {
+		err = fmt.Errorf("fetchBucketResource: %v", err)
+		return
+	}
+
+	xattrs = bucketXattrs(b)
+	lc = bucketLifecycle(b)
+	return
+}
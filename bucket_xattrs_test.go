@@ -0,0 +1,170 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type BucketXattrsTest struct {
+	ctx    context.Context
+	server *httptest.Server
+
+	// The request most recently received by the server.
+	req *http.Request
+
+	// The response the server gives.
+	status int
+	body   string
+}
+
+var _ SetUpInterface = &BucketXattrsTest{}
+var _ TearDownInterface = &BucketXattrsTest{}
+
+func init() { RegisterTestSuite(&BucketXattrsTest{}) }
+
+func (t *BucketXattrsTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.status = http.StatusOK
+	t.server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			t.req = r
+			w.WriteHeader(t.status)
+			fmt.Fprint(w, t.body)
+		}))
+}
+
+func (t *BucketXattrsTest) TearDown() {
+	t.server.Close()
+}
+
+func (t *BucketXattrsTest) fetch(
+	billingProject string) (xattrs map[string]string, err error) {
+	b, err := fetchBucketResource(
+		t.ctx,
+		http.DefaultClient,
+		t.server.URL+"/b/",
+		"some-bucket",
+		billingProject)
+
+	if err != nil {
+		return
+	}
+
+	xattrs = bucketXattrs(b)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *BucketXattrsTest) AllProperties() {
+	t.body = `{
+		"location": "US-EAST1",
+		"locationType": "region",
+		"storageClass": "NEARLINE",
+		"versioning": {"enabled": true},
+		"retentionPolicy": {"retentionPeriod": "86400", "isLocked": false},
+		"labels": {"team": "tacos", "env": "prod"}
+	}`
+
+	xattrs, err := t.fetch("")
+	AssertEq(nil, err)
+
+	ExpectEq("/b/some-bucket", t.req.URL.Path)
+	ExpectEq("", t.req.URL.Query().Get("userProject"))
+
+	ExpectThat(xattrs, DeepEquals(map[string]string{
+		"user.gcs.bucket.location":         "US-EAST1",
+		"user.gcs.bucket.location_type":    "region",
+		"user.gcs.bucket.storage_class":    "NEARLINE",
+		"user.gcs.bucket.versioning":       "true",
+		"user.gcs.bucket.retention_period": "86400",
+		"user.gcs.bucket.retention_locked": "false",
+		"user.gcs.bucket.label.team":       "tacos",
+		"user.gcs.bucket.label.env":        "prod",
+	}))
+}
+
+func (t *BucketXattrsTest) MinimalProperties() {
+	t.body = `{"location": "EU", "storageClass": "STANDARD"}`
+
+	xattrs, err := t.fetch("")
+	AssertEq(nil, err)
+
+	ExpectThat(xattrs, DeepEquals(map[string]string{
+		"user.gcs.bucket.location":      "EU",
+		"user.gcs.bucket.storage_class": "STANDARD",
+		"user.gcs.bucket.versioning":    "false",
+	}))
+}
+
+func (t *BucketXattrsTest) BillingProject() {
+	t.body = `{}`
+
+	_, err := t.fetch("burrito")
+	AssertEq(nil, err)
+
+	ExpectEq("burrito", t.req.URL.Query().Get("userProject"))
+}
+
+func (t *BucketXattrsTest) PermissionDenied() {
+	t.status = http.StatusForbidden
+	t.body = `{"error": {"code": 403, "message": "Access denied."}}`
+
+	_, err := t.fetch("")
+	ExpectThat(err, Error(HasSubstr("Access denied")))
+}
+
+func (t *BucketXattrsTest) Lifecycle() {
+	t.body = `{
+		"storageClass": "NEARLINE",
+		"retentionPolicy": {"retentionPeriod": "86400", "isLocked": false},
+		"lifecycle": {"rule": [
+			{"action": {"type": "Delete"}, "condition": {"age": 30}}
+		]}
+	}`
+
+	b, err := fetchBucketResource(
+		t.ctx,
+		http.DefaultClient,
+		t.server.URL+"/b/",
+		"some-bucket",
+		"")
+
+	AssertEq(nil, err)
+	ExpectThat(t.req.URL.Query().Get("fields"), HasSubstr("lifecycle"))
+
+	lc := bucketLifecycle(b)
+	ExpectEq("NEARLINE", lc.DefaultStorageClass)
+	ExpectEq(24*time.Hour, lc.RetentionPeriod)
+
+	AssertEq(1, len(lc.Rules))
+	ExpectEq("Delete", lc.Rules[0].Action.Type)
+	AssertNe(nil, lc.Rules[0].Condition.Age)
+	ExpectEq(30, *lc.Rules[0].Condition.Age)
+}
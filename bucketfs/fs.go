@@ -0,0 +1,335 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bucketfs
+
+import (
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// NewFS returns a read-only view of the bucket as an io/fs.FS, using the
+// supplied context for all requests to GCS.
+//
+// As with the gcsfuse --implicit-dirs flag, every object name prefix ending
+// in a slash is treated as a directory, whether or not a placeholder object
+// exists for it. When a directory and a file have the same name, the
+// directory wins, matching the behavior of the mounted file system. Objects
+// whose names are not valid io/fs paths (e.g. "foo//bar") are not visible.
+//
+// Each file reads the object generation that existed when it was opened.
+func NewFS(ctx context.Context, bucket gcs.Bucket) fs.FS {
+	return &bucketFS{
+		ctx:    ctx,
+		bucket: bucket,
+	}
+}
+
+type bucketFS struct {
+	ctx    context.Context
+	bucket gcs.Bucket
+}
+
+func (b *bucketFS) Open(name string) (f fs.File, err error) {
+	if !fs.ValidPath(name) {
+		err = &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+		return
+	}
+
+	f, err = b.open(name)
+	if err != nil {
+		err = &fs.PathError{Op: "open", Path: name, Err: err}
+		return
+	}
+
+	return
+}
+
+func (b *bucketFS) open(name string) (f fs.File, err error) {
+	// The root is always a directory.
+	if name == "." {
+		f = b.newDir(name, "")
+		return
+	}
+
+	// Prefer a directory, either explicit or implicit.
+	dirName := name + "/"
+	_, err = b.bucket.StatObject(
+		b.ctx,
+		&gcs.StatObjectRequest{Name: dirName})
+
+	switch err.(type) {
+	case nil:
+		f = b.newDir(name, dirName)
+		return
+
+	case *gcs.NotFoundError:
+
+	default:
+		return
+	}
+
+	listing, err := b.bucket.ListObjects(
+		b.ctx,
+		&gcs.ListObjectsRequest{
+			Prefix:     dirName,
+			MaxResults: 1,
+		})
+
+	if err != nil {
+		return
+	}
+
+	if len(listing.Objects) != 0 {
+		f = b.newDir(name, dirName)
+		return
+	}
+
+	// Otherwise this must be a file.
+	o, err := b.bucket.StatObject(
+		b.ctx,
+		&gcs.StatObjectRequest{Name: name})
+
+	if _, ok := err.(*gcs.NotFoundError); ok {
+		err = fs.ErrNotExist
+		return
+	}
+
+	if err != nil {
+		return
+	}
+
+	f = &file{
+		ctx:    b.ctx,
+		bucket: b.bucket,
+		info:   fileInfo{name: path.Base(name), o: o},
+	}
+
+	return
+}
+
+func (b *bucketFS) newDir(name string, prefix string) *dir {
+	return &dir{
+		ctx:    b.ctx,
+		bucket: b.bucket,
+		prefix: prefix,
+		info:   fileInfo{name: path.Base(name), dir: true},
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// fileInfo
+////////////////////////////////////////////////////////////////////////
+
+// fileInfo implements both fs.FileInfo and fs.DirEntry. o is nil for
+// directories, which may not have a backing object.
+type fileInfo struct {
+	name string
+	o    *gcs.Object
+	dir  bool
+}
+
+func (fi fileInfo) Name() string { return fi.name }
+func (fi fileInfo) IsDir() bool  { return fi.dir }
+func (fi fileInfo) Sys() any     { return fi.o }
+
+func (fi fileInfo) Size() int64 {
+	if fi.o == nil {
+		return 0
+	}
+
+	return int64(fi.o.Size)
+}
+
+func (fi fileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0555
+	}
+
+	return 0444
+}
+
+func (fi fileInfo) ModTime() (t time.Time) {
+	if fi.o != nil {
+		t = fi.o.Updated
+	}
+
+	return
+}
+
+func (fi fileInfo) Type() fs.FileMode                   { return fi.Mode().Type() }
+func (fi fileInfo) Info() (info fs.FileInfo, err error) { return fi, nil }
+
+////////////////////////////////////////////////////////////////////////
+// file
+////////////////////////////////////////////////////////////////////////
+
+type file struct {
+	ctx    context.Context
+	bucket gcs.Bucket
+	info   fileInfo
+
+	// A reader for the object's contents, opened lazily on the first read.
+	rc io.ReadCloser
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *file) Read(p []byte) (n int, err error) {
+	if f.rc == nil {
+		f.rc, err = f.bucket.NewReader(
+			f.ctx,
+			&gcs.ReadObjectRequest{
+				Name:       f.info.o.Name,
+				Generation: f.info.o.Generation,
+			})
+
+		if err != nil {
+			return
+		}
+	}
+
+	n, err = f.rc.Read(p)
+	return
+}
+
+func (f *file) Close() (err error) {
+	if f.rc != nil {
+		err = f.rc.Close()
+		f.rc = nil
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// dir
+////////////////////////////////////////////////////////////////////////
+
+type dir struct {
+	ctx    context.Context
+	bucket gcs.Bucket
+	prefix string
+	info   fileInfo
+
+	// Entries not yet returned by ReadDir, loaded on the first call.
+	loaded  bool
+	entries []fs.DirEntry
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *dir) Read(p []byte) (n int, err error) {
+	err = &fs.PathError{Op: "read", Path: d.info.name, Err: fs.ErrInvalid}
+	return
+}
+
+func (d *dir) Close() error {
+	return nil
+}
+
+func (d *dir) ReadDir(n int) (entries []fs.DirEntry, err error) {
+	if !d.loaded {
+		d.entries, err = d.load()
+		if err != nil {
+			return
+		}
+
+		d.loaded = true
+	}
+
+	// As required by fs.ReadDirFile, return io.EOF at the end of the directory
+	// only when a positive count was requested.
+	if n > 0 && len(d.entries) == 0 {
+		err = io.EOF
+		return
+	}
+
+	if n <= 0 || n > len(d.entries) {
+		n = len(d.entries)
+	}
+
+	entries = d.entries[:n]
+	d.entries = d.entries[n:]
+
+	return
+}
+
+// List all of the directory's children, sorted by name.
+func (d *dir) load() (entries []fs.DirEntry, err error) {
+	dirs := make(map[string]bool)
+	var files []*gcs.Object
+
+	req := &gcs.ListObjectsRequest{
+		Prefix:    d.prefix,
+		Delimiter: "/",
+	}
+
+	for {
+		var listing *gcs.Listing
+		listing, err = d.bucket.ListObjects(d.ctx, req)
+		if err != nil {
+			return
+		}
+
+		for _, p := range listing.CollapsedRuns {
+			dirs[strings.TrimSuffix(p[len(d.prefix):], "/")] = true
+		}
+
+		files = append(files, listing.Objects...)
+
+		if listing.ContinuationToken == "" {
+			break
+		}
+
+		req.ContinuationToken = listing.ContinuationToken
+	}
+
+	for name := range dirs {
+		if name == "" || name == "." || name == ".." {
+			continue
+		}
+
+		entries = append(entries, fileInfo{name: name, dir: true})
+	}
+
+	for _, o := range files {
+		name := o.Name[len(d.prefix):]
+
+		// Skip the directory's own placeholder object, and files shadowed by
+		// directories.
+		if name == "" || name == "." || name == ".." || dirs[name] {
+			continue
+		}
+
+		entries = append(entries, fileInfo{name: name, o: o})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	return
+}
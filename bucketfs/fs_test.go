@@ -0,0 +1,122 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bucketfs_test
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/bucketfs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestFS(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type FSTest struct {
+	ctx    context.Context
+	bucket gcs.Bucket
+	fs     fs.FS
+}
+
+var _ SetUpInterface = &FSTest{}
+
+func init() { RegisterTestSuite(&FSTest{}) }
+
+func (t *FSTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.bucket = gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket")
+	t.fs = bucketfs.NewFS(t.ctx, t.bucket)
+
+	err := gcsutil.CreateObjects(
+		t.ctx,
+		t.bucket,
+		map[string][]byte{
+			"foo":              []byte("taco"),
+			"dir/":             []byte(""),
+			"dir/bar":          []byte("burrito"),
+			"implicit/baz":     []byte("enchilada"),
+			"implicit/sub/qux": []byte(""),
+			"conflict":         []byte("shadowed"),
+			"conflict/":        []byte(""),
+		})
+
+	AssertEq(nil, err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *FSTest) ConformsToInterface() {
+	err := fstest.TestFS(
+		t.fs,
+		"foo",
+		"dir/bar",
+		"implicit/baz",
+		"implicit/sub/qux")
+
+	ExpectEq(nil, err)
+}
+
+func (t *FSTest) ReadFile() {
+	contents, err := fs.ReadFile(t.fs, "implicit/baz")
+	AssertEq(nil, err)
+	ExpectEq("enchilada", string(contents))
+}
+
+func (t *FSTest) ReadDir() {
+	entries, err := fs.ReadDir(t.fs, ".")
+	AssertEq(nil, err)
+
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+
+	ExpectThat(names, ElementsAre("conflict", "dir", "foo", "implicit"))
+	ExpectTrue(entries[0].IsDir())
+	ExpectTrue(entries[1].IsDir())
+	ExpectFalse(entries[2].IsDir())
+	ExpectTrue(entries[3].IsDir())
+}
+
+func (t *FSTest) DirectoryShadowsFile() {
+	fi, err := fs.Stat(t.fs, "conflict")
+	AssertEq(nil, err)
+	ExpectTrue(fi.IsDir())
+}
+
+func (t *FSTest) NonExistentFile() {
+	_, err := t.fs.Open("taco")
+	ExpectTrue(errors.Is(err, fs.ErrNotExist), "%v", err)
+}
+
+func (t *FSTest) InvalidPath() {
+	_, err := t.fs.Open("/foo")
+	ExpectTrue(errors.Is(err, fs.ErrInvalid), "%v", err)
+}
@@ -0,0 +1,151 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bucketfs allows Go programs to embed gcsfuse's file system
+// semantics without shelling out to the gcsfuse binary.
+//
+// A bucket may either be served as a fuse file system, using NewServer or
+// Mount, or accessed in-process as a read-only io/fs.FS, using NewFS.
+package bucketfs
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	"github.com/jacobsa/timeutil"
+)
+
+// Config describes a file system to be served by NewServer or Mount. The zero
+// value of each field other than Bucket gives the same behavior as the
+// corresponding gcsfuse flag's default.
+type Config struct {
+	// The bucket to export. Required.
+	Bucket gcs.Bucket
+
+	// The temporary directory to use for local copies of objects being
+	// modified, or the empty string to use the system default.
+	TempDir string
+
+	// Allow directories to be inferred from object names, as with the
+	// --implicit-dirs flag. See docs/semantics.md for the drawbacks.
+	ImplicitDirectories bool
+
+	// How long the kernel may cache inode attributes, and how long to cache the
+	// types of directory entries. See the --stat-cache-ttl and --type-cache-ttl
+	// flags.
+	StatCacheTTL time.Duration
+	TypeCacheTTL time.Duration
+
+	// The owner of all inodes in the file system. Zero means root.
+	Uid uint32
+	Gid uint32
+
+	// Permission bits for files and directories. If zero, 0644 and 0755 are
+	// used respectively.
+	FilePerms os.FileMode
+	DirPerms  os.FileMode
+
+	// How long to wait after a file is flushed before syncing it, as with the
+	// --sync-delay flag. Zero syncs straight away.
+	SyncDelay time.Duration
+
+	// The clock used for cache expiration and for the times of new inodes,
+	// and the function used to schedule delayed syncs, which behaves like
+	// time.AfterFunc and returns a function that cancels the call. If nil,
+	// the wall clock and time.AfterFunc are used. Tests can supply a
+	// timeutil.SimulatedClock and a function driven by it, so that TTL expiry
+	// and delayed syncs happen when they advance time rather than after real
+	// waits.
+	Clock     timeutil.Clock
+	AfterFunc func(d time.Duration, f func()) (stop func() bool)
+}
+
+// NewServer creates a fuse server for the file system described by cfg. The
+// server may be mounted with fuse.Mount.
+func NewServer(cfg *Config) (server fuse.Server, err error) {
+	if cfg.Bucket == nil {
+		err = fmt.Errorf("You must set Bucket.")
+		return
+	}
+
+	serverCfg := &fs.ServerConfig{
+		CacheClock:             cfg.Clock,
+		MtimeClock:             cfg.Clock,
+		AfterFunc:              fs.AfterFunc(cfg.AfterFunc),
+		Bucket:                 cfg.Bucket,
+		TempDir:                cfg.TempDir,
+		ImplicitDirectories:    cfg.ImplicitDirectories,
+		InodeAttributeCacheTTL: cfg.StatCacheTTL,
+		DirTypeCacheTTL:        cfg.TypeCacheTTL,
+		Uid:                    cfg.Uid,
+		Gid:                    cfg.Gid,
+		FilePerms:              cfg.FilePerms,
+		DirPerms:               cfg.DirPerms,
+		SyncDelay:              cfg.SyncDelay,
+
+		// Match the values used by the gcsfuse binary.
+		AppendThreshold: 1 << 21,
+		TmpObjectPrefix: ".gcsfuse_tmp/",
+	}
+
+	if serverCfg.FilePerms == 0 {
+		serverCfg.FilePerms = 0644
+	}
+
+	if serverCfg.DirPerms == 0 {
+		serverCfg.DirPerms = 0755
+	}
+
+	server, err = fs.NewServer(serverCfg)
+	if err != nil {
+		err = fmt.Errorf("fs.NewServer: %v", err)
+		return
+	}
+
+	return
+}
+
+// Mount creates a server for the file system described by cfg and mounts it
+// at the given directory. The caller should join the result to wait for the
+// file system to be unmounted. mountCfg may be nil, in which case the bucket
+// name is used as the file system name.
+func Mount(
+	dir string,
+	cfg *Config,
+	mountCfg *fuse.MountConfig) (mfs *fuse.MountedFileSystem, err error) {
+	server, err := NewServer(cfg)
+	if err != nil {
+		err = fmt.Errorf("NewServer: %v", err)
+		return
+	}
+
+	if mountCfg == nil {
+		mountCfg = &fuse.MountConfig{
+			FSName:     cfg.Bucket.Name(),
+			VolumeName: cfg.Bucket.Name(),
+		}
+	}
+
+	mfs, err = fuse.Mount(dir, server, mountCfg)
+	if err != nil {
+		err = fmt.Errorf("Mount: %v", err)
+		return
+	}
+
+	return
+}
@@ -0,0 +1,54 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Parse the contents of a cgroup v2 io.max file, returning the write limit in
+// bytes per second that it sets for the device with the supplied "MAJ:MIN"
+// number, or zero if it sets none.
+//
+// Each line is of the form "8:16 rbps=2097152 wbps=max riops=max wiops=120",
+// and keys may be missing.
+func parseIOMaxWriteLimit(r io.Reader, dev string) (bps float64, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] != dev {
+			continue
+		}
+
+		for _, f := range fields[1:] {
+			if !strings.HasPrefix(f, "wbps=") || f == "wbps=max" {
+				continue
+			}
+
+			bps, err = strconv.ParseFloat(strings.TrimPrefix(f, "wbps="), 64)
+			if err != nil {
+				err = fmt.Errorf("Parsing %q: %v", f, err)
+				return
+			}
+		}
+	}
+
+	err = scanner.Err()
+	return
+}
@@ -0,0 +1,147 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+)
+
+// The mount point of the cgroup v2 hierarchy.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// Return the write rate limit in bytes per second for the device holding the
+// supplied directory set by the io.max files of the cgroup v2 cgroups
+// containing this process, i.e. the strictest of the limits set by its cgroup
+// and that cgroup's ancestors. Return zero if there is none.
+func cgroupWriteLimit(dir string) (bps float64, err error) {
+	dev, err := blockDevice(dir)
+	if err != nil {
+		err = fmt.Errorf("blockDevice: %v", err)
+		return
+	}
+
+	cg, err := ownCgroup()
+	if err != nil {
+		err = fmt.Errorf("ownCgroup: %v", err)
+		return
+	}
+
+	for ; ; cg = path.Dir(cg) {
+		var limit float64
+		limit, err = readIOMaxWriteLimit(path.Join(cgroupRoot, cg, "io.max"), dev)
+		if err != nil {
+			return
+		}
+
+		if limit > 0 && (bps == 0 || limit < bps) {
+			bps = limit
+		}
+
+		if cg == "/" {
+			break
+		}
+	}
+
+	return
+}
+
+// Return the "MAJ:MIN" number of the whole disk holding the supplied
+// directory, since io.max limits can't be set for partitions.
+func blockDevice(dir string) (dev string, err error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return
+	}
+
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		err = fmt.Errorf("Unexpected stat result for %q", dir)
+		return
+	}
+
+	// Decode the device number as glibc's gnu_dev_major and gnu_dev_minor do.
+	d := uint64(st.Dev)
+	major := (d>>8)&0xfff | (d>>32)&^0xfff
+	minor := d&0xff | (d>>12)&^0xff
+	dev = fmt.Sprintf("%d:%d", major, minor)
+
+	// For a partition, find its disk. The path is resolved through the symlink
+	// to the device's directory before applying "..".
+	sysDir := path.Join("/sys/dev/block", dev)
+	if _, err = os.Stat(path.Join(sysDir, "partition")); os.IsNotExist(err) {
+		err = nil
+		return
+	}
+
+	if err != nil {
+		return
+	}
+
+	b, err := ioutil.ReadFile(sysDir + "/../dev")
+	if err != nil {
+		return
+	}
+
+	dev = strings.TrimSpace(string(b))
+	return
+}
+
+// Return the path of this process's cgroup in the cgroup v2 hierarchy.
+func ownCgroup() (cg string, err error) {
+	b, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return
+	}
+
+	// The v2 hierarchy is the one with ID zero and no controllers.
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			cg = path.Join("/", strings.TrimPrefix(line, "0::"))
+			return
+		}
+	}
+
+	err = fmt.Errorf("Not in a cgroup v2 hierarchy")
+	return
+}
+
+// Read the write limit for the device from the supplied io.max file, which
+// may not exist if the io controller isn't enabled for the cgroup.
+func readIOMaxWriteLimit(p string, dev string) (bps float64, err error) {
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	bps, err = parseIOMaxWriteLimit(f, dev)
+	if err != nil {
+		err = fmt.Errorf("%s: %v", p, err)
+		return
+	}
+
+	return
+}
@@ -0,0 +1,66 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type CgroupTest struct {
+}
+
+func init() { RegisterTestSuite(&CgroupTest{}) }
+
+const ioMax = `8:0 rbps=max wbps=1048576 riops=max wiops=max
+8:16 rbps=2097152 wbps=max riops=max wiops=120
+259:0 riops=100
+`
+
+func (t *CgroupTest) parse(contents string, dev string) float64 {
+	bps, err := parseIOMaxWriteLimit(strings.NewReader(contents), dev)
+	AssertEq(nil, err)
+
+	return bps
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *CgroupTest) WriteLimit() {
+	ExpectEq(1048576, t.parse(ioMax, "8:0"))
+}
+
+func (t *CgroupTest) NoWriteLimit() {
+	ExpectEq(0, t.parse(ioMax, "8:16"))
+	ExpectEq(0, t.parse(ioMax, "259:0"))
+}
+
+func (t *CgroupTest) OtherDevice() {
+	ExpectEq(0, t.parse(ioMax, "8:1"))
+	ExpectEq(0, t.parse("", "8:0"))
+}
+
+func (t *CgroupTest) Malformed() {
+	_, err := parseIOMaxWriteLimit(strings.NewReader("8:0 wbps=lots\n"), "8:0")
+	ExpectThat(err, Error(HasSubstr("wbps=lots")))
+}
@@ -0,0 +1,145 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+)
+
+// How often to check on a drain in progress.
+const drainPollInterval = time.Second
+
+// The "drain" subcommand, which prepares a mounted file system for the
+// machine going away.
+var drainCommand = cli.Command{
+	Name:      "drain",
+	HelpName:  "gcsfuse drain",
+	Usage:     "Refuse new modifications to a mounted file system and write out everything already written",
+	ArgsUsage: "mountpoint",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "unmount",
+			Usage: "Unmount the file system once it has been drained.",
+		},
+
+		cli.DurationFlag{
+			Name: "timeout",
+			Usage: "Give up if the file system hasn't been drained (and " +
+				"unmounted, if requested) after this long. Zero means wait forever.",
+		},
+	},
+	Action: runDrain,
+}
+
+func runDrain(c *cli.Context) (err error) {
+	if len(c.Args()) != 1 {
+		err = fmt.Errorf(
+			"%s drain takes exactly one argument. Run `%s drain --help` for "+
+				"more info.",
+			path.Base(os.Args[0]),
+			path.Base(os.Args[0]))
+
+		return
+	}
+
+	mountPoint := c.Args()[0]
+
+	var deadline <-chan time.Time
+	if timeout := c.Duration("timeout"); timeout > 0 {
+		deadline = time.After(timeout)
+	}
+
+	// Start the drain.
+	err = setXattr(mountPoint, fs.DrainXattr, []byte("1"))
+	if err != nil {
+		err = fmt.Errorf("Starting drain of %s: %v", mountPoint, err)
+		return
+	}
+
+	// Wait for it to finish, reporting progress whenever it changes.
+	var last *fs.Status
+	for {
+		var s *fs.Status
+		s, err = readStatus(mountPoint)
+		if err != nil {
+			return
+		}
+
+		if s.Drained {
+			break
+		}
+
+		if last == nil ||
+			s.PendingUploads != last.PendingUploads ||
+			s.DirtyBytes != last.DirtyBytes ||
+			s.PendingDeletes != last.PendingDeletes {
+			fmt.Fprintf(
+				os.Stdout,
+				"Waiting for %d files (%d bytes) to be written out and %d "+
+					"objects to be deleted...\n",
+				s.PendingUploads,
+				s.DirtyBytes,
+				s.PendingDeletes)
+		}
+
+		last = s
+
+		select {
+		case <-deadline:
+			err = fmt.Errorf(
+				"Timed out with %d files (%d bytes) not written out and %d "+
+					"objects not deleted",
+				s.PendingUploads,
+				s.DirtyBytes,
+				s.PendingDeletes)
+			return
+
+		case <-time.After(drainPollInterval):
+		}
+	}
+
+	fmt.Fprintln(os.Stdout, "Drained.")
+
+	if !c.Bool("unmount") {
+		return
+	}
+
+	// Unmount, retrying while the file system is busy, e.g. because files are
+	// still open.
+	for {
+		err = fuse.Unmount(mountPoint)
+		if err == nil {
+			break
+		}
+
+		select {
+		case <-deadline:
+			err = fmt.Errorf("Unmount: %v", err)
+			return
+
+		case <-time.After(drainPollInterval):
+		}
+	}
+
+	fmt.Fprintln(os.Stdout, "Unmounted.")
+	return
+}
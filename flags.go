@@ -17,10 +17,16 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/codegangsta/cli"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/handle"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
 	mountpkg "github.com/googlecloudplatform/gcsfuse/internal/mount"
 )
 
@@ -59,6 +65,10 @@ func newApp() (app *cli.App) {
 		Version: getVersion(),
 		Usage:   "Mount a GCS bucket locally",
 		Writer:  os.Stderr,
+		Commands: []cli.Command{
+			statusCommand,
+			drainCommand,
+		},
 		Flags: []cli.Flag{
 
 			cli.BoolFlag{
@@ -105,11 +115,344 @@ func newApp() (app *cli.App) {
 					"docs/semantics.md",
 			},
 
+			cli.BoolTFlag{
+				Name: "create-dir-placeholders",
+				Usage: "Create a placeholder object when making a directory. If " +
+					"false, new directories exist only in memory until they have " +
+					"contents. Requires --implicit-dirs when false. (default: true)",
+			},
+
+			cli.BoolTFlag{
+				Name: "delete-dir-placeholders",
+				Usage: "Delete a directory's placeholder object when removing it. " +
+					"If false, removing such a directory fails with EPERM. " +
+					"(default: true)",
+			},
+
+			cli.BoolFlag{
+				Name: "hide-dir-placeholders",
+				Usage: "Ignore directory placeholder objects, so that directories " +
+					"exist only if they have contents. Requires --implicit-dirs.",
+			},
+
 			cli.StringFlag{
 				Name:  "only-dir",
 				Usage: "Mount only the given directory, relative to the bucket root.",
 			},
 
+			cli.StringFlag{
+				Name:  "prefetch-manifest",
+				Value: "",
+				Usage: "Absolute path to a file listing paths or glob patterns, one " +
+					"per line, of files to read before reporting the mount ready, " +
+					"warming caches. See docs/semantics.md",
+			},
+
+			cli.StringFlag{
+				Name:  "name-mapping",
+				Value: "",
+				Usage: "Path to a JSON file describing how to map file system " +
+					"paths to object names, e.g. to present sharded layouts as " +
+					"plain directories. See docs/semantics.md",
+			},
+
+			cli.BoolFlag{
+				Name: "snapshot",
+				Usage: "Pin the mount read-only to the bucket's contents at mount " +
+					"time, listing the whole bucket up front. See docs/semantics.md",
+			},
+
+			cli.StringFlag{
+				Name:  "as-of",
+				Value: "",
+				Usage: "With --snapshot, pin the mount to the bucket's contents at " +
+					"this RFC 3339 time instead, using noncurrent object versions. " +
+					"See docs/semantics.md",
+			},
+
+			cli.BoolFlag{
+				Name: "create-only",
+				Usage: "Allow new files and directories to be created, but refuse " +
+					"with EPERM to modify, rename, or delete existing ones. See " +
+					"docs/semantics.md",
+			},
+
+			cli.BoolFlag{
+				Name: "metadata-only",
+				Usage: "Serve lookups, listings, and stats, but refuse with EACCES " +
+					"to open files for reading or writing, so that nothing reads " +
+					"object contents. See docs/semantics.md",
+			},
+
+			cli.BoolFlag{
+				Name: "read-only",
+				Usage: "Mount read-only, refusing with EROFS to create, modify, or " +
+					"delete anything. The same as -o ro. See docs/semantics.md",
+			},
+
+			cli.BoolFlag{
+				Name: "stream-writes",
+				Usage: "Upload data written sequentially to a new or empty file " +
+					"as it is written, rather than staging it in --temp-dir until " +
+					"the file is closed. See docs/semantics.md",
+			},
+
+			cli.IntFlag{
+				Name:  "stream-chunk-size",
+				Value: 8 << 20,
+				Usage: "With --stream-writes, the number of bytes to collect in " +
+					"memory before sending them to GCS.",
+			},
+
+			cli.IntFlag{
+				Name:  "download-parallelism",
+				Value: 1,
+				Usage: "The number of ranges of a large object to fetch from GCS at " +
+					"once when its contents are first needed locally, e.g. before " +
+					"a write. See docs/semantics.md.",
+			},
+
+			cli.IntFlag{
+				Name:  "download-chunk-size-mb",
+				Value: 32,
+				Usage: "With --download-parallelism, the size in MiB of each range. " +
+					"Smaller objects are fetched with a single request.",
+			},
+
+			cli.IntFlag{
+				Name:  "upload-parallelism",
+				Value: 1,
+				Usage: "The number of parts of a large new file to upload to GCS at " +
+					"once, composing them into the object afterwards. See " +
+					"docs/semantics.md.",
+			},
+
+			cli.IntFlag{
+				Name:  "upload-chunk-size-mb",
+				Value: 32,
+				Usage: "With --upload-parallelism, the size in MiB (at least 8) of " +
+					"each part.",
+			},
+
+			cli.IntFlag{
+				Name:  "upload-threshold-mb",
+				Value: 64,
+				Usage: "With --upload-parallelism, the size in MiB below which new " +
+					"files are uploaded with a single request.",
+			},
+
+			cli.StringFlag{
+				Name:  "write-isolation",
+				Value: "shared",
+				Usage: "How concurrent writes to a file through different file " +
+					"descriptors interact: shared, last-close-wins, or merge. See " +
+					"docs/semantics.md",
+			},
+
+			cli.DurationFlag{
+				Name:  "sync-delay",
+				Value: 0,
+				Usage: "On close or flush, wait until a file has gone this long " +
+					"without another before uploading it, so that rapid rewrites " +
+					"are uploaded once. fsync still uploads immediately. See " +
+					"docs/semantics.md (use 0 to disable)",
+			},
+
+			cli.IntFlag{
+				Name:  "deferred-delete-workers",
+				Value: 0,
+				Usage: "Have unlink and rmdir return straight away, hiding the " +
+					"objects until this many background workers have deleted them. " +
+					"fsync on a directory waits for pending deletes. See " +
+					"docs/semantics.md (use 0 to disable)",
+			},
+
+			cli.BoolFlag{
+				Name: "checkpoint-mode",
+				Usage: "Write files as suits ML checkpoints: upload large files in " +
+					"parallel parts, fail fsync unless GCS has the data intact, and " +
+					"make --checkpoint-markers visible last. See docs/semantics.md",
+			},
+
+			cli.StringFlag{
+				Name:  "checkpoint-markers",
+				Value: "commit_success.txt,.metadata",
+				Usage: "With --checkpoint-mode, comma-separated names of the files " +
+					"that mark a checkpoint directory complete.",
+			},
+
+			cli.IntFlag{
+				Name:  "checkpoint-upload-parts",
+				Value: 16,
+				Usage: "With --checkpoint-mode, the number of parts (at most 32) " +
+					"uploaded in parallel for each large file.",
+			},
+
+			cli.StringFlag{
+				Name:  "on-conflict",
+				Value: "discard",
+				Usage: "What to do with local changes to a file whose object was " +
+					"replaced by another writer before they were uploaded: " +
+					"discard, fail (with ESTALE), or copy. See docs/semantics.md",
+			},
+
+			cli.StringFlag{
+				Name:  "compress-suffixes",
+				Value: "",
+				Usage: "Comma-separated list of file name suffixes, e.g. " +
+					"\".log,.csv\", whose contents are stored gzip-compressed " +
+					"and decompressed when read. See docs/semantics.md",
+			},
+
+			cli.StringSliceFlag{
+				Name: "query-handler",
+				Usage: "A handler for queries of a kind, as KIND=COMMAND, e.g. " +
+					"\"select=csv-select\". Reading \"file.csv#KIND=QUERY\" " +
+					"gives the output of COMMAND run over the file. May be " +
+					"repeated. See docs/semantics.md",
+			},
+
+			cli.BoolFlag{
+				Name: "read-latest-generation",
+				Usage: "When a file open for reading is overwritten by another " +
+					"actor, continue reading the new contents instead of failing " +
+					"with ESTALE. See docs/semantics.md",
+			},
+
+			cli.BoolFlag{
+				Name: "tail-follow",
+				Usage: "When a read reaches the end of a file, or its size is " +
+					"checked, switch to a newer generation that is at least as " +
+					"large, so that files growing remotely can be followed. See " +
+					"docs/semantics.md",
+			},
+
+			cli.DurationFlag{
+				Name:  "watch-interval",
+				Value: 0,
+				Usage: "While a file is held open, check for a newer generation at " +
+					"most this often as it is read, and continue reading that. " +
+					"Implies --read-latest-generation. (use 0 to disable)",
+			},
+
+			cli.StringFlag{
+				Name:  "direct-io",
+				Value: "",
+				Usage: "Comma-separated list of patterns (e.g. \"status/*.json\") " +
+					"naming files to open with direct I/O, bypassing the kernel's " +
+					"page cache. Patterns without a slash match base names, so " +
+					"\"*\" matches every file. See docs/semantics.md",
+			},
+
+			cli.BoolFlag{
+				Name: "stale-listing-fallback",
+				Usage: "If listing a directory fails part way through, take the " +
+					"rest of the listing from the last complete one rather than " +
+					"failing. See docs/semantics.md",
+			},
+
+			cli.StringFlag{
+				Name: "batch-rename-manifest",
+				Usage: "Name of a file in the root directory that, when written, " +
+					"is read as a list of renames to carry out in bulk, with " +
+					"results written to the same name plus \".result\". See " +
+					"docs/semantics.md",
+			},
+
+			cli.IntFlag{
+				Name:  "rename-dir-limit",
+				Value: 0,
+				Usage: "How many objects renaming a directory may move; renaming " +
+					"a larger directory fails with ENOTSUP. Renames aren't atomic. " +
+					"See docs/semantics.md",
+			},
+
+			cli.StringFlag{
+				Name:  "upload-log",
+				Value: "",
+				Usage: "Absolute path to a local file to which a JSON record is " +
+					"appended for each object written through the file system. " +
+					"See docs/semantics.md",
+			},
+
+			cli.StringFlag{
+				Name:  "read-trace",
+				Value: "",
+				Usage: "Absolute path to a local file to which each read reaching " +
+					"gcsfuse is recorded, for replaying with " +
+					"benchmarks/replay_read_trace. See docs/semantics.md",
+			},
+
+			cli.StringFlag{
+				Name:  "admin-socket",
+				Value: "",
+				Usage: "Absolute path at which to create a unix socket serving an " +
+					"HTTP API for managing the mount. See docs/mounting.md",
+			},
+
+			cli.StringFlag{
+				Name:  "allow-writers",
+				Value: "",
+				Usage: "Comma-separated list of executables (e.g. /usr/bin/python3) " +
+					"or cgroups (e.g. cgroup:/system.slice/train.service) whose " +
+					"processes alone may modify the file system. Others get " +
+					"EACCES. See docs/semantics.md",
+			},
+
+			cli.StringFlag{
+				Name:  "deny-writers",
+				Value: "",
+				Usage: "Comma-separated list of executables or cgroups, as for " +
+					"--allow-writers, whose processes may not modify the file " +
+					"system.",
+			},
+
+			cli.IntFlag{
+				Name:  "upload-max-size",
+				Value: 0,
+				Usage: "Refuse with EPERM to write out files larger than this many " +
+					"bytes. (use 0 for no limit)",
+			},
+
+			cli.StringFlag{
+				Name:  "upload-allowed-extensions",
+				Value: "",
+				Usage: "Comma-separated list of file name extensions (e.g. " +
+					"\".txt,.csv\") that files may have. Others are refused with " +
+					"EPERM. (default: all extensions allowed)",
+			},
+
+			cli.IntFlag{
+				Name:  "write-budget",
+				Value: 0,
+				Usage: "Total bytes that may be written to the bucket through the " +
+					"mount, after which writes fail with EDQUOT. (use 0 for no " +
+					"limit)",
+			},
+
+			cli.IntFlag{
+				Name:  "dirty-limit-mb",
+				Value: 0,
+				Usage: "MiB of data written to files but not yet uploaded above " +
+					"which writes wait for uploads to catch up. See " +
+					"docs/semantics.md (use 0 for no limit)",
+			},
+
+			cli.BoolFlag{
+				Name: "dirty-limit-hard",
+				Usage: "Fail writes over --dirty-limit-mb with EDQUOT when no " +
+					"upload could bring the total down, rather than letting them " +
+					"go ahead.",
+			},
+
+			cli.StringFlag{
+				Name:  "upload-scan-command",
+				Value: "",
+				Usage: "Shell command to run before writing out a file, with its " +
+					"contents on stdin. A non-zero exit status causes the write to " +
+					"fail with EPERM. See docs/semantics.md",
+			},
+
 			/////////////////////////
 			// GCS
 			/////////////////////////
@@ -128,11 +471,81 @@ func newApp() (app *cli.App) {
 					"(default: none, Google application default credentials used)",
 			},
 
+			cli.StringFlag{
+				Name:  "s3-endpoint",
+				Value: "",
+				Usage: "URL of an S3-compatible object store to use instead of GCS, " +
+					"e.g. https://s3.us-east-1.amazonaws.com. Credentials are read " +
+					"from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and " +
+					"AWS_SESSION_TOKEN. See docs/semantics.md for caveats. " +
+					"(default: none, GCS is used)",
+			},
+
+			cli.StringFlag{
+				Name:  "s3-region",
+				Value: "us-east-1",
+				Usage: "Region with which to sign requests to --s3-endpoint.",
+			},
+
+			cli.IntFlag{
+				Name:  "max-conns-per-host",
+				Value: 0,
+				Usage: "The most connections to open to GCS at once, all kept open " +
+					"for reuse while idle. (use 0 for no limit)",
+			},
+
+			cli.DurationFlag{
+				Name:  "http-client-timeout",
+				Value: 0,
+				Usage: "How long to wait for GCS to start responding to a request " +
+					"before failing it, so that it is retried. (use 0 to wait " +
+					"indefinitely)",
+			},
+
+			cli.BoolTFlag{
+				Name: "http2",
+				Usage: "Use HTTP/2 where GCS supports it, multiplexing requests " +
+					"over fewer connections. If false, use HTTP/1.1, with a " +
+					"connection per request in flight. (default: true)",
+			},
+
+			cli.StringFlag{
+				Name:  "failover-bucket",
+				Value: "",
+				Usage: "A mirror of the bucket to serve reads from while the bucket " +
+					"keeps failing. See docs/semantics.md",
+			},
+
+			cli.DurationFlag{
+				Name:  "failover-check-interval",
+				Value: 30 * time.Second,
+				Usage: "With --failover-bucket, how often to check whether the " +
+					"bucket works again while reads are failed over.",
+			},
+
+			cli.DurationFlag{
+				Name:  "access-check-interval",
+				Value: 5 * time.Minute,
+				Usage: "How often to check which IAM permissions the credentials " +
+					"hold on the bucket, clearing permission bits they don't back " +
+					"up. See docs/semantics.md (use 0 to disable)",
+			},
+
+			cli.DurationFlag{
+				Name:  "denied-prefix-ttl",
+				Value: time.Minute,
+				Usage: "After GCS denies access to an object, e.g. because IAM " +
+					"conditions limit the credentials to other prefixes, fail " +
+					"requests in the same directory with EACCES for this long " +
+					"without sending them. See docs/semantics.md (use 0 to " +
+					"disable)",
+			},
+
 			cli.Float64Flag{
 				Name:  "limit-bytes-per-sec",
 				Value: -1,
-				Usage: "Bandwidth limit for reading data, measured over a 30-second " +
-					"window. (use -1 for no limit)",
+				Usage: "Bandwidth limit for reading and writing data together, " +
+					"measured over a 30-second window. (use -1 for no limit)",
 			},
 
 			cli.Float64Flag{
@@ -152,12 +565,36 @@ func newApp() (app *cli.App) {
 				Usage: "How many entries can the stat cache hold (impacts memory consumption)",
 			},
 
+			cli.IntFlag{
+				Name:  "inode-limit",
+				Value: 0,
+				Usage: "How many inodes to keep before asking the kernel to forget " +
+					"the least recently used ones, to bound memory use when walking " +
+					"large trees. See docs/semantics.md (use 0 for no limit)",
+			},
+
 			cli.DurationFlag{
 				Name:  "stat-cache-ttl",
 				Value: time.Minute,
 				Usage: "How long to cache StatObject results and inode attributes.",
 			},
 
+			cli.DurationFlag{
+				Name:  "poll-interval",
+				Value: 0,
+				Usage: "Revalidate the stat results of objects in active use in " +
+					"the background this often, serving stats of them locally in " +
+					"between. Lowers --stat-cache-ttl to match. (use 0 to disable)",
+			},
+
+			cli.IntFlag{
+				Name:  "stat-storm-threshold",
+				Value: 100,
+				Usage: "How many times per second an object may be statted before " +
+					"further stats of it are briefly served from a cache, " +
+					"regardless of --stat-cache-ttl. Zero disables this.",
+			},
+
 			cli.DurationFlag{
 				Name:  "type-cache-ttl",
 				Value: time.Minute,
@@ -165,6 +602,145 @@ func newApp() (app *cli.App) {
 					"inodes.",
 			},
 
+			cli.DurationFlag{
+				Name:  "list-cache-ttl",
+				Value: time.Minute,
+				Usage: "How long to serve repeated listings of a directory from " +
+					"memory. (use 0 to disable)",
+			},
+
+			cli.DurationFlag{
+				Name:  "kernel-list-cache-ttl",
+				Value: 0,
+				Usage: "How long the kernel may serve repeated listings of a " +
+					"directory from its own cache, without asking gcsfuse. Requires " +
+					"Linux 4.20 or later. (0 disables)",
+			},
+
+			cli.DurationFlag{
+				Name:  "max-throttle-penalty",
+				Value: 32 * time.Second,
+				Usage: "When GCS responds that requests are being throttled, delay " +
+					"all requests for a penalty that doubles with each such " +
+					"response, up to this value, and decays while there are none. " +
+					"(use 0 to disable)",
+			},
+
+			cli.DurationFlag{
+				Name:  "max-retry-sleep",
+				Value: time.Minute,
+				Usage: "Retry GCS requests that fail with throttling, server, or " +
+					"network errors, sleeping for exponentially longer between " +
+					"attempts until the sleep would exceed this value. See " +
+					"docs/semantics.md (use 0 to disable)",
+			},
+
+			cli.Float64Flag{
+				Name:  "retry-multiplier",
+				Value: 2,
+				Usage: "The factor by which the sleep between retries of a failed " +
+					"GCS request grows each time.",
+			},
+
+			cli.IntFlag{
+				Name:  "snapshot-spool-threshold",
+				Value: 100000,
+				Usage: "With --snapshot or --inventory-report, keep the objects' " +
+					"records in files in --temp-dir rather than in memory if there " +
+					"are more than this many. (use 0 to always keep them in memory)",
+			},
+
+			cli.StringSliceFlag{
+				Name: "inventory-report",
+				Usage: "Absolute path of a CSV inventory report of the bucket, such " +
+					"as those of Storage Insights, from which to serve stats and " +
+					"listings for --inventory-ttl after mounting. May be repeated. " +
+					"See docs/semantics.md",
+			},
+
+			cli.DurationFlag{
+				Name:  "inventory-ttl",
+				Value: time.Hour,
+				Usage: "How long after mounting to serve stats and listings from " +
+					"--inventory-report.",
+			},
+
+			cli.IntFlag{
+				Name:  "compaction-threshold",
+				Value: 0,
+				Usage: "Rewrite objects composed of at least this many components, " +
+					"e.g. by repeated appends, as single objects in the background " +
+					"once they are idle. See docs/semantics.md (use 0 to disable)",
+			},
+
+			cli.IntFlag{
+				Name:  "sequential-read-size-mb",
+				Value: 8,
+				Usage: "With --sequential-read-depth, the number of MiB to fetch " +
+					"from GCS at a time ahead of sequential reads.",
+			},
+
+			cli.IntFlag{
+				Name:  "sequential-read-depth",
+				Value: 0,
+				Usage: "Fetch this many chunks of --sequential-read-size-mb in the " +
+					"background ahead of sequential reads. See docs/semantics.md " +
+					"(use 0 to disable)",
+			},
+
+			cli.BoolFlag{
+				Name: "tune-sequential-reads",
+				Usage: "Shortly after mounting, time sequential reads from the " +
+					"bucket with a few chunk sizes and depths, and use the fastest " +
+					"in place of --sequential-read-size-mb and " +
+					"--sequential-read-depth. See docs/semantics.md.",
+			},
+
+			cli.StringFlag{
+				Name:  "file-cache-dir",
+				Value: "",
+				Usage: "Absolute path to a directory in which to keep the contents " +
+					"of objects read in full, for later reads and mounts. See " +
+					"docs/semantics.md (default: no file cache)",
+			},
+
+			cli.IntFlag{
+				Name:  "file-cache-max-size-mb",
+				Value: 1024,
+				Usage: "With --file-cache-dir, the number of MiB of contents to keep " +
+					"before evicting the least recently used.",
+			},
+
+			cli.IntFlag{
+				Name:  "file-cache-min-free-mb",
+				Value: 0,
+				Usage: "With --file-cache-dir, evict contents to keep at least this " +
+					"many MiB free on the device holding the directory.",
+			},
+
+			cli.Float64Flag{
+				Name:  "file-cache-write-mb-per-sec",
+				Value: 0,
+				Usage: "With --file-cache-dir, skip caching contents that would make " +
+					"writes to the directory exceed this rate. (use 0 for no limit)",
+			},
+
+			cli.BoolFlag{
+				Name: "file-cache-respect-cgroup",
+				Usage: "With --file-cache-dir, also limit writes to the directory to " +
+					"the wbps limit that gcsfuse's cgroup sets in io.max for its " +
+					"device. See docs/semantics.md",
+			},
+
+			cli.IntFlag{
+				Name:  "traversal-lookahead",
+				Value: 0,
+				Usage: "When files are looked up in the order their directory " +
+					"listed them, as by grep -r or find -exec, fetch this many of the " +
+					"next ones in the background. See docs/semantics.md (use 0 to " +
+					"disable)",
+			},
+
 			cli.StringFlag{
 				Name:  "temp-dir",
 				Value: "",
@@ -172,6 +748,13 @@ func newApp() (app *cli.App) {
 					"copies. (default: system default, likely /tmp)",
 			},
 
+			cli.IntFlag{
+				Name:  "temp-dir-min-free-mb",
+				Value: 0,
+				Usage: "Fail writes with ENOSPC while the device holding --temp-dir " +
+					"has less than this many MiB free. (0 disables)",
+			},
+
 			/////////////////////////
 			// Debugging
 			/////////////////////////
@@ -195,6 +778,19 @@ func newApp() (app *cli.App) {
 				Name:  "debug_invariants",
 				Usage: "Panic when internal invariants are violated.",
 			},
+
+			cli.BoolFlag{
+				Name: "redact-object-names",
+				Usage: "Redact object names from log output and error messages. " +
+					"Credentials are always redacted.",
+			},
+
+			cli.StringFlag{
+				Name:  "fault-injection-scenario",
+				Value: "",
+				Usage: "Path to a JSON file describing faults to inject into GCS " +
+					"requests, for resilience testing. Never use in production.",
+			},
 		},
 	}
 
@@ -205,31 +801,110 @@ type flagStorage struct {
 	Foreground bool
 
 	// File system
-	MountOptions map[string]string
-	DirMode      os.FileMode
-	FileMode     os.FileMode
-	Uid          int64
-	Gid          int64
-	ImplicitDirs bool
-	OnlyDir      string
+	MountOptions          map[string]string
+	DirMode               os.FileMode
+	FileMode              os.FileMode
+	Uid                   int64
+	Gid                   int64
+	ImplicitDirs          bool
+	CreateDirPlaceholders bool
+	DeleteDirPlaceholders bool
+	HideDirPlaceholders   bool
+	OnlyDir               string
+	NameMapping           string
+	PrefetchManifest      string
+	Snapshot              bool
+	AsOf                  string
+	CreateOnly            bool
+	MetadataOnly          bool
+	ReadOnly              bool
+	StreamWrites          bool
+	StreamChunkSize       int
+	DownloadParallelism   int
+	DownloadChunkSizeMb   int
+	UploadParallelism     int
+	UploadChunkSizeMb     int
+	UploadThresholdMb     int
+	WriteIsolation        string
+	SyncDelay             time.Duration
+	DeferredDeleteWorkers int
+	CheckpointMode        bool
+	CheckpointMarkers     []string
+	CheckpointUploadParts int
+	OnConflict            string
+	CompressSuffixes      string
+	QueryHandlers         []string
+	ReadLatestGeneration  bool
+	TailFollow            bool
+	WatchInterval         time.Duration
+	DirectIOPatterns      []string
+	StaleListingFallback  bool
+	BatchRenameManifest   string
+	RenameDirLimit        int
+	UploadLog             string
+	ReadTrace             string
+	AdminSocket           string
+	AllowWriters          []string
+	DenyWriters           []string
+
+	// Upload policy
+	UploadMaxSize           int64
+	UploadAllowedExtensions []string
+	UploadScanCommand       string
+	WriteBudget             int64
+	DirtyLimitMb            int
+	DirtyLimitHard          bool
 
 	// GCS
 	BillingProject                     string
 	KeyFile                            string
+	S3Endpoint                         string
+	S3Region                           string
+	MaxConnsPerHost                    int
+	HTTPClientTimeout                  time.Duration
+	HTTP2                              bool
+	FailoverBucket                     string
+	FailoverCheckInterval              time.Duration
+	AccessCheckInterval                time.Duration
+	DeniedPrefixTTL                    time.Duration
 	EgressBandwidthLimitBytesPerSecond float64
 	OpRateLimitHz                      float64
 
 	// Tuning
-	StatCacheCapacity int
-	StatCacheTTL      time.Duration
-	TypeCacheTTL      time.Duration
-	TempDir           string
+	StatCacheCapacity      int
+	InodeLimit             int
+	StatCacheTTL           time.Duration
+	PollInterval           time.Duration
+	StatStormThreshold     int
+	TypeCacheTTL           time.Duration
+	ListCacheTTL           time.Duration
+	KernelListCacheTTL     time.Duration
+	MaxThrottlePenalty     time.Duration
+	MaxRetrySleep          time.Duration
+	RetryMultiplier        float64
+	SnapshotSpoolThreshold int
+	InventoryReports       []string
+	InventoryTTL           time.Duration
+	CompactionThreshold    int
+	SequentialReadSizeMb   int
+	SequentialReadDepth    int
+	TuneSequentialReads    bool
+	FileCacheDir           string
+	FileCacheMaxSizeMb     int
+	FileCacheMinFreeMb     int
+	FileCacheWriteMbPerSec float64
+	FileCacheRespectCgroup bool
+	TraversalLookahead     int
+	TempDir                string
+	TempDirMinFreeMb       int
 
 	// Debugging
-	DebugFuse       bool
-	DebugGCS        bool
-	DebugHTTP       bool
-	DebugInvariants bool
+	DebugFuse              bool
+	DebugGCS               bool
+	DebugHTTP              bool
+	DebugInvariants        bool
+	RedactObjectNames      bool
+	FaultInjectionScenario string
 }
 
 // Add the flags accepted by run to the supplied flag set, returning the
@@ -239,31 +914,110 @@ func populateFlags(c *cli.Context) (flags *flagStorage) {
 		Foreground: c.Bool("foreground"),
 
 		// File system
-		MountOptions: make(map[string]string),
-		DirMode:      os.FileMode(*c.Generic("dir-mode").(*OctalInt)),
-		FileMode:     os.FileMode(*c.Generic("file-mode").(*OctalInt)),
-		Uid:          int64(c.Int("uid")),
-		Gid:          int64(c.Int("gid")),
-		ImplicitDirs: c.Bool("implicit-dirs"),
-		OnlyDir:      c.String("only-dir"),
+		MountOptions:          make(map[string]string),
+		DirMode:               os.FileMode(*c.Generic("dir-mode").(*OctalInt)),
+		FileMode:              os.FileMode(*c.Generic("file-mode").(*OctalInt)),
+		Uid:                   int64(c.Int("uid")),
+		Gid:                   int64(c.Int("gid")),
+		ImplicitDirs:          c.Bool("implicit-dirs"),
+		CreateDirPlaceholders: c.BoolT("create-dir-placeholders"),
+		DeleteDirPlaceholders: c.BoolT("delete-dir-placeholders"),
+		HideDirPlaceholders:   c.Bool("hide-dir-placeholders"),
+		OnlyDir:               c.String("only-dir"),
+		NameMapping:           c.String("name-mapping"),
+		PrefetchManifest:      c.String("prefetch-manifest"),
+		Snapshot:              c.Bool("snapshot"),
+		AsOf:                  c.String("as-of"),
+		CreateOnly:            c.Bool("create-only"),
+		MetadataOnly:          c.Bool("metadata-only"),
+		ReadOnly:              c.Bool("read-only"),
+		StreamWrites:          c.Bool("stream-writes"),
+		StreamChunkSize:       c.Int("stream-chunk-size"),
+		DownloadParallelism:   c.Int("download-parallelism"),
+		DownloadChunkSizeMb:   c.Int("download-chunk-size-mb"),
+		UploadParallelism:     c.Int("upload-parallelism"),
+		UploadChunkSizeMb:     c.Int("upload-chunk-size-mb"),
+		UploadThresholdMb:     c.Int("upload-threshold-mb"),
+		WriteIsolation:        c.String("write-isolation"),
+		SyncDelay:             c.Duration("sync-delay"),
+		DeferredDeleteWorkers: c.Int("deferred-delete-workers"),
+		CheckpointMode:        c.Bool("checkpoint-mode"),
+		CheckpointMarkers:     splitList(c.String("checkpoint-markers")),
+		CheckpointUploadParts: c.Int("checkpoint-upload-parts"),
+		OnConflict:            c.String("on-conflict"),
+		CompressSuffixes:      c.String("compress-suffixes"),
+		QueryHandlers:         c.StringSlice("query-handler"),
+		ReadLatestGeneration:  c.Bool("read-latest-generation"),
+		TailFollow:            c.Bool("tail-follow"),
+		WatchInterval:         c.Duration("watch-interval"),
+		DirectIOPatterns:      splitList(c.String("direct-io")),
+		StaleListingFallback:  c.Bool("stale-listing-fallback"),
+		BatchRenameManifest:   c.String("batch-rename-manifest"),
+		RenameDirLimit:        c.Int("rename-dir-limit"),
+		UploadLog:             c.String("upload-log"),
+		ReadTrace:             c.String("read-trace"),
+		AdminSocket:           c.String("admin-socket"),
+		AllowWriters:          splitList(c.String("allow-writers")),
+		DenyWriters:           splitList(c.String("deny-writers")),
+
+		// Upload policy
+		UploadMaxSize:           int64(c.Int("upload-max-size")),
+		UploadAllowedExtensions: splitList(c.String("upload-allowed-extensions")),
+		UploadScanCommand:       c.String("upload-scan-command"),
+		WriteBudget:             int64(c.Int("write-budget")),
+		DirtyLimitMb:            c.Int("dirty-limit-mb"),
+		DirtyLimitHard:          c.Bool("dirty-limit-hard"),
 
 		// GCS,
 		BillingProject:                     c.String("billing-project"),
 		KeyFile:                            c.String("key-file"),
+		S3Endpoint:                         c.String("s3-endpoint"),
+		S3Region:                           c.String("s3-region"),
+		MaxConnsPerHost:                    c.Int("max-conns-per-host"),
+		HTTPClientTimeout:                  c.Duration("http-client-timeout"),
+		HTTP2:                              c.BoolT("http2"),
+		FailoverBucket:                     c.String("failover-bucket"),
+		FailoverCheckInterval:              c.Duration("failover-check-interval"),
+		AccessCheckInterval:                c.Duration("access-check-interval"),
+		DeniedPrefixTTL:                    c.Duration("denied-prefix-ttl"),
 		EgressBandwidthLimitBytesPerSecond: c.Float64("limit-bytes-per-sec"),
 		OpRateLimitHz:                      c.Float64("limit-ops-per-sec"),
 
 		// Tuning,
-		StatCacheCapacity: c.Int("stat-cache-capacity"),
-		StatCacheTTL:      c.Duration("stat-cache-ttl"),
-		TypeCacheTTL:      c.Duration("type-cache-ttl"),
-		TempDir:           c.String("temp-dir"),
+		StatCacheCapacity:      c.Int("stat-cache-capacity"),
+		InodeLimit:             c.Int("inode-limit"),
+		StatCacheTTL:           c.Duration("stat-cache-ttl"),
+		PollInterval:           c.Duration("poll-interval"),
+		StatStormThreshold:     c.Int("stat-storm-threshold"),
+		TypeCacheTTL:           c.Duration("type-cache-ttl"),
+		ListCacheTTL:           c.Duration("list-cache-ttl"),
+		KernelListCacheTTL:     c.Duration("kernel-list-cache-ttl"),
+		MaxThrottlePenalty:     c.Duration("max-throttle-penalty"),
+		MaxRetrySleep:          c.Duration("max-retry-sleep"),
+		RetryMultiplier:        c.Float64("retry-multiplier"),
+		SnapshotSpoolThreshold: c.Int("snapshot-spool-threshold"),
+		InventoryReports:       c.StringSlice("inventory-report"),
+		InventoryTTL:           c.Duration("inventory-ttl"),
+		CompactionThreshold:    c.Int("compaction-threshold"),
+		SequentialReadSizeMb:   c.Int("sequential-read-size-mb"),
+		SequentialReadDepth:    c.Int("sequential-read-depth"),
+		TuneSequentialReads:    c.Bool("tune-sequential-reads"),
+		FileCacheDir:           c.String("file-cache-dir"),
+		FileCacheMaxSizeMb:     c.Int("file-cache-max-size-mb"),
+		FileCacheMinFreeMb:     c.Int("file-cache-min-free-mb"),
+		FileCacheWriteMbPerSec: c.Float64("file-cache-write-mb-per-sec"),
+		FileCacheRespectCgroup: c.Bool("file-cache-respect-cgroup"),
+		TraversalLookahead:     c.Int("traversal-lookahead"),
+		TempDir:                c.String("temp-dir"),
+		TempDirMinFreeMb:       c.Int("temp-dir-min-free-mb"),
 
 		// Debugging,
-		DebugFuse:       c.Bool("debug_fuse"),
-		DebugGCS:        c.Bool("debug_gcs"),
-		DebugHTTP:       c.Bool("debug_http"),
-		DebugInvariants: c.Bool("debug_invariants"),
+		DebugFuse:              c.Bool("debug_fuse"),
+		DebugGCS:               c.Bool("debug_gcs"),
+		DebugHTTP:              c.Bool("debug_http"),
+		DebugInvariants:        c.Bool("debug_invariants"),
+		RedactObjectNames:      c.Bool("redact-object-names"),
+		FaultInjectionScenario: c.String("fault-injection-scenario"),
 	}
 
 	// Handle the repeated "-o" flag.
@@ -271,6 +1025,588 @@ func populateFlags(c *cli.Context) (flags *flagStorage) {
 		mountpkg.ParseOptions(flags.MountOptions, o)
 	}
 
+	// "-o ro" is another way of saying --read-only.
+	if _, ok := flags.MountOptions["ro"]; ok {
+		flags.ReadOnly = true
+	}
+
+	return
+}
+
+// Check the supplied flags for combinations that can't work or that wouldn't
+// do what the user expects. Combinations that can't work are refused with an
+// error. Settings that would have no effect, or that are defeated by other
+// settings, are corrected in place, and a warning describing each correction
+// is returned for display to the user.
+func validateFlags(flags *flagStorage) (warnings []string, err error) {
+	/////////////////////////
+	// Errors
+	/////////////////////////
+
+	// Only permission bits can be applied to inodes; setuid, setgid, and the
+	// sticky bit aren't supported.
+	if flags.DirMode&^os.ModePerm != 0 {
+		err = fmt.Errorf("--dir-mode must be at most 0777: %o", flags.DirMode)
+		return
+	}
+
+	if flags.FileMode&^os.ModePerm != 0 {
+		err = fmt.Errorf("--file-mode must be at most 0777: %o", flags.FileMode)
+		return
+	}
+
+	if flags.StatCacheCapacity < 0 {
+		err = fmt.Errorf(
+			"--stat-cache-capacity must not be negative: %d",
+			flags.StatCacheCapacity)
+		return
+	}
+
+	if flags.InodeLimit < 0 {
+		err = fmt.Errorf(
+			"--inode-limit must not be negative: %d",
+			flags.InodeLimit)
+		return
+	}
+
+	if flags.TraversalLookahead < 0 {
+		err = fmt.Errorf(
+			"--traversal-lookahead must not be negative: %d",
+			flags.TraversalLookahead)
+		return
+	}
+
+	if flags.RenameDirLimit < 0 {
+		err = fmt.Errorf(
+			"--rename-dir-limit must not be negative: %d",
+			flags.RenameDirLimit)
+		return
+	}
+
+	if flags.WriteBudget < 0 {
+		err = fmt.Errorf(
+			"--write-budget must not be negative: %d",
+			flags.WriteBudget)
+		return
+	}
+
+	if flags.DirtyLimitMb < 0 {
+		err = fmt.Errorf(
+			"--dirty-limit-mb must not be negative: %d",
+			flags.DirtyLimitMb)
+		return
+	}
+
+	if flags.TempDirMinFreeMb < 0 {
+		err = fmt.Errorf(
+			"--temp-dir-min-free-mb must not be negative: %d",
+			flags.TempDirMinFreeMb)
+		return
+	}
+
+	if flags.CheckpointUploadParts < 1 ||
+		flags.CheckpointUploadParts > gcs.MaxSourcesPerComposeRequest {
+		err = fmt.Errorf(
+			"--checkpoint-upload-parts must be between 1 and %d: %d",
+			gcs.MaxSourcesPerComposeRequest,
+			flags.CheckpointUploadParts)
+		return
+	}
+
+	for _, m := range flags.CheckpointMarkers {
+		if strings.Contains(m, "/") {
+			err = fmt.Errorf(
+				"--checkpoint-markers must be file names without directories: %q",
+				m)
+			return
+		}
+	}
+
+	if flags.CompactionThreshold < 0 || flags.CompactionThreshold == 1 {
+		err = fmt.Errorf(
+			"--compaction-threshold must be 0 or at least 2: %d",
+			flags.CompactionThreshold)
+		return
+	}
+
+	if flags.StreamChunkSize <= 0 {
+		err = fmt.Errorf(
+			"--stream-chunk-size must be positive: %d",
+			flags.StreamChunkSize)
+		return
+	}
+
+	if flags.DownloadParallelism <= 0 {
+		err = fmt.Errorf(
+			"--download-parallelism must be positive: %d",
+			flags.DownloadParallelism)
+		return
+	}
+
+	if flags.DownloadChunkSizeMb <= 0 {
+		err = fmt.Errorf(
+			"--download-chunk-size-mb must be positive: %d",
+			flags.DownloadChunkSizeMb)
+		return
+	}
+
+	if flags.UploadParallelism <= 0 {
+		err = fmt.Errorf(
+			"--upload-parallelism must be positive: %d",
+			flags.UploadParallelism)
+		return
+	}
+
+	if flags.UploadChunkSizeMb < gcsx.MinParallelUploadPartSize/gcsx.MB {
+		err = fmt.Errorf(
+			"--upload-chunk-size-mb must be at least %d: %d",
+			gcsx.MinParallelUploadPartSize/gcsx.MB,
+			flags.UploadChunkSizeMb)
+		return
+	}
+
+	if flags.UploadThresholdMb <= 0 {
+		err = fmt.Errorf(
+			"--upload-threshold-mb must be positive: %d",
+			flags.UploadThresholdMb)
+		return
+	}
+
+	if flags.SequentialReadSizeMb <= 0 {
+		err = fmt.Errorf(
+			"--sequential-read-size-mb must be positive: %d",
+			flags.SequentialReadSizeMb)
+		return
+	}
+
+	if flags.SequentialReadDepth < 0 {
+		err = fmt.Errorf(
+			"--sequential-read-depth must not be negative: %d",
+			flags.SequentialReadDepth)
+		return
+	}
+
+	if flags.PollInterval < 0 {
+		err = fmt.Errorf(
+			"--poll-interval must not be negative: %v",
+			flags.PollInterval)
+		return
+	}
+
+	if flags.SyncDelay < 0 {
+		err = fmt.Errorf(
+			"--sync-delay must not be negative: %v",
+			flags.SyncDelay)
+		return
+	}
+
+	if flags.DeferredDeleteWorkers < 0 {
+		err = fmt.Errorf(
+			"--deferred-delete-workers must not be negative: %d",
+			flags.DeferredDeleteWorkers)
+		return
+	}
+
+	if flags.MaxRetrySleep < 0 {
+		err = fmt.Errorf(
+			"--max-retry-sleep must not be negative: %v",
+			flags.MaxRetrySleep)
+		return
+	}
+
+	if flags.RetryMultiplier <= 1 {
+		err = fmt.Errorf(
+			"--retry-multiplier must be greater than 1: %v",
+			flags.RetryMultiplier)
+		return
+	}
+
+	if flags.WatchInterval < 0 {
+		err = fmt.Errorf(
+			"--watch-interval must not be negative: %v",
+			flags.WatchInterval)
+		return
+	}
+
+	if flags.FailoverCheckInterval <= 0 {
+		err = fmt.Errorf(
+			"--failover-check-interval must be positive: %v",
+			flags.FailoverCheckInterval)
+		return
+	}
+
+	if flags.AccessCheckInterval < 0 {
+		err = fmt.Errorf(
+			"--access-check-interval must not be negative: %v",
+			flags.AccessCheckInterval)
+		return
+	}
+
+	if flags.DeniedPrefixTTL < 0 {
+		err = fmt.Errorf(
+			"--denied-prefix-ttl must not be negative: %v",
+			flags.DeniedPrefixTTL)
+		return
+	}
+
+	if flags.ListCacheTTL < 0 {
+		err = fmt.Errorf(
+			"--list-cache-ttl must not be negative: %v",
+			flags.ListCacheTTL)
+		return
+	}
+
+	if flags.KernelListCacheTTL < 0 {
+		err = fmt.Errorf(
+			"--kernel-list-cache-ttl must not be negative: %v",
+			flags.KernelListCacheTTL)
+		return
+	}
+
+	if flags.InventoryTTL < 0 {
+		err = fmt.Errorf(
+			"--inventory-ttl must not be negative: %v",
+			flags.InventoryTTL)
+		return
+	}
+
+	// The daemon runs in the root directory.
+	for _, p := range flags.InventoryReports {
+		if !filepath.IsAbs(p) {
+			err = fmt.Errorf("--inventory-report must be an absolute path: %q", p)
+			return
+		}
+	}
+
+	if flags.PrefetchManifest != "" && !filepath.IsAbs(flags.PrefetchManifest) {
+		err = fmt.Errorf(
+			"--prefetch-manifest must be an absolute path: %q",
+			flags.PrefetchManifest)
+		return
+	}
+
+	if flags.UploadLog != "" && !filepath.IsAbs(flags.UploadLog) {
+		err = fmt.Errorf(
+			"--upload-log must be an absolute path: %q",
+			flags.UploadLog)
+		return
+	}
+
+	if flags.FileCacheDir != "" && !filepath.IsAbs(flags.FileCacheDir) {
+		err = fmt.Errorf(
+			"--file-cache-dir must be an absolute path: %q",
+			flags.FileCacheDir)
+		return
+	}
+
+	if flags.FileCacheMaxSizeMb <= 0 {
+		err = fmt.Errorf(
+			"--file-cache-max-size-mb must be positive: %d",
+			flags.FileCacheMaxSizeMb)
+		return
+	}
+
+	if flags.FileCacheMinFreeMb < 0 {
+		err = fmt.Errorf(
+			"--file-cache-min-free-mb must not be negative: %d",
+			flags.FileCacheMinFreeMb)
+		return
+	}
+
+	if flags.FileCacheWriteMbPerSec < 0 {
+		err = fmt.Errorf(
+			"--file-cache-write-mb-per-sec must not be negative: %v",
+			flags.FileCacheWriteMbPerSec)
+		return
+	}
+
+	if flags.ReadTrace != "" && !filepath.IsAbs(flags.ReadTrace) {
+		err = fmt.Errorf(
+			"--read-trace must be an absolute path: %q",
+			flags.ReadTrace)
+		return
+	}
+
+	if flags.AdminSocket != "" && !filepath.IsAbs(flags.AdminSocket) {
+		err = fmt.Errorf(
+			"--admin-socket must be an absolute path: %q",
+			flags.AdminSocket)
+		return
+	}
+
+	if flags.MaxConnsPerHost < 0 {
+		err = fmt.Errorf(
+			"--max-conns-per-host must not be negative: %d",
+			flags.MaxConnsPerHost)
+		return
+	}
+
+	if flags.HTTPClientTimeout < 0 {
+		err = fmt.Errorf(
+			"--http-client-timeout must not be negative: %v",
+			flags.HTTPClientTimeout)
+		return
+	}
+
+	if _, err = handle.ParseWriteIsolation(flags.WriteIsolation); err != nil {
+		err = fmt.Errorf("--write-isolation: %v", err)
+		return
+	}
+
+	if _, err = inode.ParseConflictPolicy(flags.OnConflict); err != nil {
+		err = fmt.Errorf("--on-conflict: %v", err)
+		return
+	}
+
+	if _, err = gcsx.ParseCompressionRules(flags.CompressSuffixes); err != nil {
+		err = fmt.Errorf("--compress-suffixes: %v", err)
+		return
+	}
+
+	if _, err = gcsx.ParseQueryCommands(flags.QueryHandlers); err != nil {
+		err = fmt.Errorf("--query-handler: %v", err)
+		return
+	}
+
+	if !flags.ImplicitDirs {
+		if flags.HideDirPlaceholders {
+			err = fmt.Errorf("--hide-dir-placeholders requires --implicit-dirs")
+			return
+		}
+
+		if !flags.CreateDirPlaceholders {
+			err = fmt.Errorf("--create-dir-placeholders=false requires --implicit-dirs")
+			return
+		}
+	}
+
+	if flags.AsOf != "" {
+		if !flags.Snapshot {
+			err = fmt.Errorf("--as-of requires --snapshot")
+			return
+		}
+
+		if _, err = time.Parse(time.RFC3339, flags.AsOf); err != nil {
+			err = fmt.Errorf("--as-of must be an RFC 3339 time: %v", err)
+			return
+		}
+	}
+
+	if flags.MetadataOnly && flags.PrefetchManifest != "" {
+		err = fmt.Errorf(
+			"--prefetch-manifest is incompatible with --metadata-only, " +
+				"which refuses to read files")
+		return
+	}
+
+	if flags.BatchRenameManifest != "" {
+		if flags.CreateOnly {
+			err = fmt.Errorf(
+				"--batch-rename-manifest is incompatible with --create-only, " +
+					"which refuses renames")
+			return
+		}
+
+		if flags.Snapshot {
+			err = fmt.Errorf(
+				"--batch-rename-manifest is incompatible with --snapshot, " +
+					"whose mounts are read-only")
+			return
+		}
+
+		if flags.MetadataOnly {
+			err = fmt.Errorf(
+				"--batch-rename-manifest is incompatible with --metadata-only, " +
+					"which refuses to write files")
+			return
+		}
+
+		if flags.ReadOnly {
+			err = fmt.Errorf(
+				"--batch-rename-manifest is incompatible with --read-only, " +
+					"which refuses to write files")
+			return
+		}
+	}
+
+	/////////////////////////
+	// Corrections
+	/////////////////////////
+
+	warn := func(format string, v ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, v...))
+	}
+
+	// Credentials and billing for GCS mean nothing to other object stores.
+	if flags.S3Endpoint != "" {
+		if flags.KeyFile != "" {
+			warn("Ignoring --key-file, which has no effect with --s3-endpoint.")
+			flags.KeyFile = ""
+		}
+
+		if flags.BillingProject != "" {
+			warn("Ignoring --billing-project, which has no effect with --s3-endpoint.")
+			flags.BillingProject = ""
+		}
+	}
+
+	// Snapshots are read-only and frozen, so options for writing or for
+	// following changes in the bucket can't do anything.
+	if flags.Snapshot {
+		if flags.ReadLatestGeneration {
+			warn("Ignoring --read-latest-generation, which has no effect with --snapshot.")
+			flags.ReadLatestGeneration = false
+		}
+
+		if flags.WatchInterval != 0 {
+			warn("Ignoring --watch-interval, which has no effect with --snapshot.")
+			flags.WatchInterval = 0
+		}
+
+		if flags.TailFollow {
+			warn("Ignoring --tail-follow, which has no effect with --snapshot.")
+			flags.TailFollow = false
+		}
+
+		if flags.StaleListingFallback {
+			warn("Ignoring --stale-listing-fallback, which has no effect with --snapshot.")
+			flags.StaleListingFallback = false
+		}
+
+		if len(flags.InventoryReports) > 0 {
+			warn("Ignoring --inventory-report, which has no effect with --snapshot.")
+			flags.InventoryReports = nil
+		}
+
+		if flags.CreateOnly {
+			warn("Ignoring --create-only, since --snapshot mounts are read-only.")
+			flags.CreateOnly = false
+		}
+
+		if flags.StreamWrites {
+			warn("Ignoring --stream-writes, since --snapshot mounts are read-only.")
+			flags.StreamWrites = false
+		}
+
+		if flags.WriteIsolation != "shared" {
+			warn("Ignoring --write-isolation, since --snapshot mounts are read-only.")
+			flags.WriteIsolation = "shared"
+		}
+
+		if flags.OnConflict != "discard" {
+			warn("Ignoring --on-conflict, since --snapshot mounts are read-only.")
+			flags.OnConflict = "discard"
+		}
+
+		if flags.UploadMaxSize != 0 ||
+			len(flags.UploadAllowedExtensions) != 0 ||
+			flags.UploadScanCommand != "" {
+			warn("Ignoring --upload-* flags, since --snapshot mounts are read-only.")
+			flags.UploadMaxSize = 0
+			flags.UploadAllowedExtensions = nil
+			flags.UploadScanCommand = ""
+		}
+
+		if flags.WriteBudget != 0 {
+			warn("Ignoring --write-budget, since --snapshot mounts are read-only.")
+			flags.WriteBudget = 0
+		}
+
+		if len(flags.AllowWriters) != 0 || len(flags.DenyWriters) != 0 {
+			warn("Ignoring --allow-writers and --deny-writers, since --snapshot " +
+				"mounts are read-only.")
+			flags.AllowWriters = nil
+			flags.DenyWriters = nil
+		}
+
+		if flags.UploadLog != "" {
+			warn("Ignoring --upload-log, since --snapshot mounts are read-only.")
+			flags.UploadLog = ""
+		}
+
+		if flags.CompactionThreshold != 0 {
+			warn("Ignoring --compaction-threshold, since --snapshot mounts are " +
+				"read-only.")
+			flags.CompactionThreshold = 0
+		}
+	}
+
+	// The upload policy and write budget must see contents before anything is
+	// written to the bucket, which streaming would defeat.
+	if flags.StreamWrites &&
+		(flags.UploadMaxSize != 0 ||
+			len(flags.UploadAllowedExtensions) != 0 ||
+			flags.UploadScanCommand != "" ||
+			flags.WriteBudget != 0) {
+		warn("Ignoring --stream-writes, which is incompatible with the " +
+			"--upload-* flags and --write-budget.")
+		flags.StreamWrites = false
+	}
+
+	// Compaction rewrites objects, which a mount the user asked to be read-only
+	// shouldn't do.
+	if flags.ReadOnly && flags.CompactionThreshold != 0 {
+		warn("Ignoring --compaction-threshold, since the mount is read-only.")
+		flags.CompactionThreshold = 0
+	}
+
+	// Without a limit, there is nothing to enforce.
+	if flags.DirtyLimitHard && flags.DirtyLimitMb == 0 {
+		warn("Ignoring --dirty-limit-hard, which has no effect without " +
+			"--dirty-limit-mb.")
+		flags.DirtyLimitHard = false
+	}
+
+	// Checkpoint mode only changes how files are written.
+	if (flags.ReadOnly || flags.Snapshot) && flags.CheckpointMode {
+		warn("Ignoring --checkpoint-mode, since the mount is read-only.")
+		flags.CheckpointMode = false
+	}
+
+	// Compaction reads the contents of objects, which a metadata-only mount
+	// promises not to do.
+	if flags.MetadataOnly && flags.CompactionThreshold != 0 {
+		warn("Ignoring --compaction-threshold, since --metadata-only mounts " +
+			"don't read object contents.")
+		flags.CompactionThreshold = 0
+	}
+
+	// Stat results cached for longer than the poll interval would hide the
+	// results of polling.
+	if flags.PollInterval != 0 && flags.StatCacheTTL > flags.PollInterval {
+		warn(
+			"Lowering --stat-cache-ttl from %v to --poll-interval (%v), since "+
+				"the stat cache would otherwise hide the results of polling.",
+			flags.StatCacheTTL,
+			flags.PollInterval)
+
+		flags.StatCacheTTL = flags.PollInterval
+	}
+
+	// Checking for new generations more often than the stat cache expires
+	// returns the same cached answer each time.
+	if flags.WatchInterval != 0 && flags.WatchInterval < flags.StatCacheTTL {
+		warn(
+			"Raising --watch-interval from %v to --stat-cache-ttl (%v), since "+
+				"checks can't see changes more often than that.",
+			flags.WatchInterval,
+			flags.StatCacheTTL)
+
+		flags.WatchInterval = flags.StatCacheTTL
+	}
+
+	return
+}
+
+// Split a comma-separated list, dropping empty elements.
+func splitList(s string) (l []string) {
+	for _, e := range strings.Split(s, ",") {
+		e = strings.TrimSpace(e)
+		if e != "" {
+			l = append(l, e)
+		}
+	}
+
 	return
 }
 
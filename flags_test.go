@@ -69,32 +69,128 @@ func (t *FlagsTest) Defaults() {
 	ExpectEq(-1, f.Uid)
 	ExpectEq(-1, f.Gid)
 	ExpectFalse(f.ImplicitDirs)
+	ExpectTrue(f.CreateDirPlaceholders)
+	ExpectTrue(f.HTTP2)
+	ExpectTrue(f.DeleteDirPlaceholders)
+	ExpectFalse(f.HideDirPlaceholders)
+	ExpectFalse(f.ReadLatestGeneration)
+	ExpectFalse(f.TailFollow)
+	ExpectFalse(f.Snapshot)
+	ExpectEq("", f.AsOf)
+	ExpectFalse(f.CreateOnly)
+	ExpectFalse(f.MetadataOnly)
+	ExpectFalse(f.ReadOnly)
+	ExpectFalse(f.StreamWrites)
+	ExpectEq(8<<20, f.StreamChunkSize)
+	ExpectEq(1, f.DownloadParallelism)
+	ExpectEq(32, f.DownloadChunkSizeMb)
+	ExpectEq(1, f.UploadParallelism)
+	ExpectEq(32, f.UploadChunkSizeMb)
+	ExpectEq(64, f.UploadThresholdMb)
+	ExpectEq("shared", f.WriteIsolation)
+	ExpectEq("discard", f.OnConflict)
+	ExpectEq("", f.CompressSuffixes)
+	ExpectEq(0, f.MaxConnsPerHost)
+	ExpectEq(0, f.HTTPClientTimeout)
+	ExpectEq(0, len(f.QueryHandlers))
+	ExpectFalse(f.StaleListingFallback)
+	ExpectEq("", f.NameMapping)
+	ExpectEq("", f.PrefetchManifest)
+	ExpectEq("", f.BatchRenameManifest)
+	ExpectEq(0, f.RenameDirLimit)
+	ExpectEq("", f.UploadLog)
+	ExpectEq("", f.ReadTrace)
+	ExpectEq("", f.AdminSocket)
+	ExpectEq(0, len(f.AllowWriters))
+	ExpectEq(0, len(f.DenyWriters))
+	ExpectEq(0, f.WatchInterval)
+	ExpectEq(0, f.SyncDelay)
+	ExpectEq(0, f.DeferredDeleteWorkers)
+	ExpectEq(0, len(f.DirectIOPatterns))
+	ExpectFalse(f.CheckpointMode)
+	ExpectFalse(f.DirtyLimitHard)
+	ExpectThat(f.CheckpointMarkers, ElementsAre("commit_success.txt", ".metadata"))
+	ExpectEq(16, f.CheckpointUploadParts)
+
+	// Upload policy
+	ExpectEq(0, f.UploadMaxSize)
+	ExpectEq(0, len(f.UploadAllowedExtensions))
+	ExpectEq("", f.UploadScanCommand)
+	ExpectEq(0, f.WriteBudget)
+	ExpectEq(0, f.DirtyLimitMb)
 
 	// GCS
 	ExpectEq("", f.KeyFile)
+	ExpectEq("", f.S3Endpoint)
+	ExpectEq("us-east-1", f.S3Region)
+	ExpectEq("", f.FailoverBucket)
+	ExpectEq(30*time.Second, f.FailoverCheckInterval)
+	ExpectEq(5*time.Minute, f.AccessCheckInterval)
+	ExpectEq(time.Minute, f.DeniedPrefixTTL)
 	ExpectEq(-1, f.EgressBandwidthLimitBytesPerSecond)
 	ExpectEq(5, f.OpRateLimitHz)
 
 	// Tuning
 	ExpectEq(4096, f.StatCacheCapacity)
+	ExpectEq(0, f.InodeLimit)
 	ExpectEq(time.Minute, f.StatCacheTTL)
+	ExpectEq(0, f.PollInterval)
+	ExpectEq(100, f.StatStormThreshold)
 	ExpectEq(time.Minute, f.TypeCacheTTL)
+	ExpectEq(time.Minute, f.ListCacheTTL)
+	ExpectEq(0, f.KernelListCacheTTL)
+	ExpectEq(32*time.Second, f.MaxThrottlePenalty)
+	ExpectEq(time.Minute, f.MaxRetrySleep)
+	ExpectEq(2, f.RetryMultiplier)
+	ExpectEq(100000, f.SnapshotSpoolThreshold)
+	ExpectEq(0, len(f.InventoryReports))
+	ExpectEq(time.Hour, f.InventoryTTL)
+	ExpectEq(0, f.CompactionThreshold)
+	ExpectEq(8, f.SequentialReadSizeMb)
+	ExpectEq(0, f.SequentialReadDepth)
+	ExpectFalse(f.TuneSequentialReads)
+	ExpectEq("", f.FileCacheDir)
+	ExpectEq(1024, f.FileCacheMaxSizeMb)
+	ExpectEq(0, f.FileCacheMinFreeMb)
+	ExpectEq(0, f.FileCacheWriteMbPerSec)
+	ExpectFalse(f.FileCacheRespectCgroup)
+	ExpectEq(0, f.TraversalLookahead)
 	ExpectEq("", f.TempDir)
+	ExpectEq(0, f.TempDirMinFreeMb)
 
 	// Debugging
 	ExpectFalse(f.DebugFuse)
 	ExpectFalse(f.DebugGCS)
 	ExpectFalse(f.DebugHTTP)
 	ExpectFalse(f.DebugInvariants)
+	ExpectFalse(f.RedactObjectNames)
+	ExpectEq("", f.FaultInjectionScenario)
 }
 
 func (t *FlagsTest) Bools() {
 	names := []string{
 		"implicit-dirs",
+		"read-latest-generation",
+		"tail-follow",
+		"snapshot",
+		"create-only",
+		"metadata-only",
+		"read-only",
+		"checkpoint-mode",
+		"dirty-limit-hard",
+		"stream-writes",
+		"stale-listing-fallback",
+		"create-dir-placeholders",
+		"http2",
+		"delete-dir-placeholders",
+		"hide-dir-placeholders",
 		"debug_fuse",
 		"debug_gcs",
 		"debug_http",
 		"debug_invariants",
+		"redact-object-names",
+		"file-cache-respect-cgroup",
+		"tune-sequential-reads",
 	}
 
 	var args []string
@@ -108,10 +204,27 @@ func (t *FlagsTest) Bools() {
 
 	f = parseArgs(args)
 	ExpectTrue(f.ImplicitDirs)
+	ExpectTrue(f.ReadLatestGeneration)
+	ExpectTrue(f.TailFollow)
+	ExpectTrue(f.Snapshot)
+	ExpectTrue(f.CreateOnly)
+	ExpectTrue(f.MetadataOnly)
+	ExpectTrue(f.ReadOnly)
+	ExpectTrue(f.CheckpointMode)
+	ExpectTrue(f.DirtyLimitHard)
+	ExpectTrue(f.StreamWrites)
+	ExpectTrue(f.StaleListingFallback)
+	ExpectTrue(f.CreateDirPlaceholders)
+	ExpectTrue(f.HTTP2)
+	ExpectTrue(f.DeleteDirPlaceholders)
+	ExpectTrue(f.HideDirPlaceholders)
 	ExpectTrue(f.DebugFuse)
 	ExpectTrue(f.DebugGCS)
 	ExpectTrue(f.DebugHTTP)
 	ExpectTrue(f.DebugInvariants)
+	ExpectTrue(f.RedactObjectNames)
+	ExpectTrue(f.FileCacheRespectCgroup)
+	ExpectTrue(f.TuneSequentialReads)
 
 	// --foo=false form
 	args = nil
@@ -121,10 +234,27 @@ func (t *FlagsTest) Bools() {
 
 	f = parseArgs(args)
 	ExpectFalse(f.ImplicitDirs)
+	ExpectFalse(f.ReadLatestGeneration)
+	ExpectFalse(f.TailFollow)
+	ExpectFalse(f.Snapshot)
+	ExpectFalse(f.CreateOnly)
+	ExpectFalse(f.MetadataOnly)
+	ExpectFalse(f.ReadOnly)
+	ExpectFalse(f.CheckpointMode)
+	ExpectFalse(f.DirtyLimitHard)
+	ExpectFalse(f.StreamWrites)
+	ExpectFalse(f.StaleListingFallback)
+	ExpectFalse(f.CreateDirPlaceholders)
+	ExpectFalse(f.HTTP2)
+	ExpectFalse(f.DeleteDirPlaceholders)
+	ExpectFalse(f.HideDirPlaceholders)
 	ExpectFalse(f.DebugFuse)
 	ExpectFalse(f.DebugGCS)
 	ExpectFalse(f.DebugHTTP)
 	ExpectFalse(f.DebugInvariants)
+	ExpectFalse(f.RedactObjectNames)
+	ExpectFalse(f.FileCacheRespectCgroup)
+	ExpectFalse(f.TuneSequentialReads)
 
 	// --foo=true form
 	args = nil
@@ -134,10 +264,27 @@ func (t *FlagsTest) Bools() {
 
 	f = parseArgs(args)
 	ExpectTrue(f.ImplicitDirs)
+	ExpectTrue(f.ReadLatestGeneration)
+	ExpectTrue(f.TailFollow)
+	ExpectTrue(f.Snapshot)
+	ExpectTrue(f.CreateOnly)
+	ExpectTrue(f.MetadataOnly)
+	ExpectTrue(f.ReadOnly)
+	ExpectTrue(f.CheckpointMode)
+	ExpectTrue(f.DirtyLimitHard)
+	ExpectTrue(f.StreamWrites)
+	ExpectTrue(f.StaleListingFallback)
+	ExpectTrue(f.CreateDirPlaceholders)
+	ExpectTrue(f.HTTP2)
+	ExpectTrue(f.DeleteDirPlaceholders)
+	ExpectTrue(f.HideDirPlaceholders)
 	ExpectTrue(f.DebugFuse)
 	ExpectTrue(f.DebugGCS)
 	ExpectTrue(f.DebugHTTP)
 	ExpectTrue(f.DebugInvariants)
+	ExpectTrue(f.RedactObjectNames)
+	ExpectTrue(f.FileCacheRespectCgroup)
+	ExpectTrue(f.TuneSequentialReads)
 }
 
 func (t *FlagsTest) DecimalNumbers() {
@@ -147,6 +294,31 @@ func (t *FlagsTest) DecimalNumbers() {
 		"--limit-bytes-per-sec=123.4",
 		"--limit-ops-per-sec=56.78",
 		"--stat-cache-capacity=8192",
+		"--inode-limit=100000",
+		"--rename-dir-limit=1000",
+		"--stat-storm-threshold=0",
+		"--upload-max-size=1048576",
+		"--write-budget=1073741824",
+		"--snapshot-spool-threshold=0",
+		"--compaction-threshold=512",
+		"--stream-chunk-size=1048576",
+		"--download-parallelism=8",
+		"--download-chunk-size-mb=64",
+		"--upload-parallelism=16",
+		"--upload-chunk-size-mb=8",
+		"--upload-threshold-mb=256",
+		"--sequential-read-size-mb=16",
+		"--sequential-read-depth=4",
+		"--file-cache-max-size-mb=2048",
+		"--file-cache-min-free-mb=512",
+		"--file-cache-write-mb-per-sec=12.5",
+		"--retry-multiplier=1.5",
+		"--traversal-lookahead=8",
+		"--dirty-limit-mb=256",
+		"--temp-dir-min-free-mb=1024",
+		"--checkpoint-upload-parts=32",
+		"--deferred-delete-workers=64",
+		"--max-conns-per-host=64",
 	}
 
 	f := parseArgs(args)
@@ -155,6 +327,31 @@ func (t *FlagsTest) DecimalNumbers() {
 	ExpectEq(123.4, f.EgressBandwidthLimitBytesPerSecond)
 	ExpectEq(56.78, f.OpRateLimitHz)
 	ExpectEq(8192, f.StatCacheCapacity)
+	ExpectEq(100000, f.InodeLimit)
+	ExpectEq(1000, f.RenameDirLimit)
+	ExpectEq(0, f.StatStormThreshold)
+	ExpectEq(1048576, f.UploadMaxSize)
+	ExpectEq(1073741824, f.WriteBudget)
+	ExpectEq(0, f.SnapshotSpoolThreshold)
+	ExpectEq(512, f.CompactionThreshold)
+	ExpectEq(1048576, f.StreamChunkSize)
+	ExpectEq(8, f.DownloadParallelism)
+	ExpectEq(64, f.DownloadChunkSizeMb)
+	ExpectEq(16, f.UploadParallelism)
+	ExpectEq(8, f.UploadChunkSizeMb)
+	ExpectEq(256, f.UploadThresholdMb)
+	ExpectEq(16, f.SequentialReadSizeMb)
+	ExpectEq(4, f.SequentialReadDepth)
+	ExpectEq(2048, f.FileCacheMaxSizeMb)
+	ExpectEq(512, f.FileCacheMinFreeMb)
+	ExpectEq(12.5, f.FileCacheWriteMbPerSec)
+	ExpectEq(1.5, f.RetryMultiplier)
+	ExpectEq(8, f.TraversalLookahead)
+	ExpectEq(256, f.DirtyLimitMb)
+	ExpectEq(1024, f.TempDirMinFreeMb)
+	ExpectEq(32, f.CheckpointUploadParts)
+	ExpectEq(64, f.DeferredDeleteWorkers)
+	ExpectEq(64, f.MaxConnsPerHost)
 }
 
 func (t *FlagsTest) OctalNumbers() {
@@ -173,23 +370,106 @@ func (t *FlagsTest) Strings() {
 		"--key-file", "-asdf",
 		"--temp-dir=foobar",
 		"--only-dir=baz",
+		"--name-mapping=mapping.json",
+		"--batch-rename-manifest=.renames",
+		"--prefetch-manifest=/etc/warm.txt",
+		"--upload-log=/var/log/uploads.json",
+		"--read-trace=/tmp/reads.trace",
+		"--admin-socket=/run/gcsfuse.sock",
+		"--as-of=2017-06-01T12:00:00Z",
+		"--fault-injection-scenario=chaos.json",
+		"--s3-endpoint=http://localhost:9000",
+		"--s3-region", "eu-west-1",
+		"--failover-bucket=mirror",
+		"--upload-scan-command=clamscan -",
+		"--write-isolation=merge",
+		"--on-conflict=fail",
+		"--compress-suffixes=.log,.csv",
 	}
 
 	f := parseArgs(args)
 	ExpectEq("-asdf", f.KeyFile)
 	ExpectEq("foobar", f.TempDir)
 	ExpectEq("baz", f.OnlyDir)
+	ExpectEq("mapping.json", f.NameMapping)
+	ExpectEq(".renames", f.BatchRenameManifest)
+	ExpectEq("/etc/warm.txt", f.PrefetchManifest)
+	ExpectEq("/var/log/uploads.json", f.UploadLog)
+	ExpectEq("/tmp/reads.trace", f.ReadTrace)
+	ExpectEq("/run/gcsfuse.sock", f.AdminSocket)
+	ExpectEq("2017-06-01T12:00:00Z", f.AsOf)
+	ExpectEq("chaos.json", f.FaultInjectionScenario)
+	ExpectEq("http://localhost:9000", f.S3Endpoint)
+	ExpectEq("eu-west-1", f.S3Region)
+	ExpectEq("mirror", f.FailoverBucket)
+	ExpectEq("clamscan -", f.UploadScanCommand)
+	ExpectEq("merge", f.WriteIsolation)
+	ExpectEq("fail", f.OnConflict)
+	ExpectEq(".log,.csv", f.CompressSuffixes)
+}
+
+func (t *FlagsTest) Lists() {
+	args := []string{
+		"--upload-allowed-extensions", ".txt, .csv,,md",
+		"--direct-io", "status/*.json,*.lock",
+		"--allow-writers", "/usr/bin/python3,cgroup:/system.slice/train.service",
+		"--deny-writers", "/bin/rm",
+		"--checkpoint-markers", "checkpoint,commit_success.txt",
+		"--query-handler", "select=csv-select",
+		"--query-handler", "head=head -n \"$GCSFUSE_QUERY\"",
+		"--inventory-report", "/var/lib/inventory/0.csv",
+		"--inventory-report", "/var/lib/inventory/1.csv",
+	}
+
+	f := parseArgs(args)
+	ExpectThat(f.UploadAllowedExtensions, ElementsAre(".txt", ".csv", "md"))
+	ExpectThat(f.DirectIOPatterns, ElementsAre("status/*.json", "*.lock"))
+	ExpectThat(
+		f.AllowWriters,
+		ElementsAre("/usr/bin/python3", "cgroup:/system.slice/train.service"))
+	ExpectThat(f.DenyWriters, ElementsAre("/bin/rm"))
+	ExpectThat(f.CheckpointMarkers, ElementsAre("checkpoint", "commit_success.txt"))
+	ExpectThat(
+		f.QueryHandlers,
+		ElementsAre("select=csv-select", "head=head -n \"$GCSFUSE_QUERY\""))
+	ExpectThat(
+		f.InventoryReports,
+		ElementsAre("/var/lib/inventory/0.csv", "/var/lib/inventory/1.csv"))
 }
 
 func (t *FlagsTest) Durations() {
 	args := []string{
 		"--stat-cache-ttl", "1m17s",
 		"--type-cache-ttl", "19ns",
+		"--list-cache-ttl", "0",
+		"--kernel-list-cache-ttl", "30s",
+		"--failover-check-interval", "1m",
+		"--access-check-interval", "0",
+		"--denied-prefix-ttl", "0",
+		"--max-throttle-penalty=0",
+		"--max-retry-sleep", "10s",
+		"--watch-interval", "30s",
+		"--sync-delay", "2s",
+		"--poll-interval", "5s",
+		"--inventory-ttl", "24h",
+		"--http-client-timeout", "30s",
 	}
 
 	f := parseArgs(args)
 	ExpectEq(77*time.Second, f.StatCacheTTL)
 	ExpectEq(19*time.Nanosecond, f.TypeCacheTTL)
+	ExpectEq(0, f.ListCacheTTL)
+	ExpectEq(30*time.Second, f.KernelListCacheTTL)
+	ExpectEq(time.Minute, f.FailoverCheckInterval)
+	ExpectEq(0, f.AccessCheckInterval)
+	ExpectEq(0, f.DeniedPrefixTTL)
+	ExpectEq(0, f.MaxThrottlePenalty)
+	ExpectEq(10*time.Second, f.MaxRetrySleep)
+	ExpectEq(30*time.Second, f.WatchInterval)
+	ExpectEq(2*time.Second, f.SyncDelay)
+	ExpectEq(5*time.Second, f.PollInterval)
+	ExpectEq(24*time.Hour, f.InventoryTTL)
+	ExpectEq(30*time.Second, f.HTTPClientTimeout)
 }
 
 func (t *FlagsTest) Maps() {
@@ -213,3 +493,279 @@ func (t *FlagsTest) Maps() {
 	ExpectEq("", f.MountOptions["rw"])
 	ExpectEq("jacobsa", f.MountOptions["user"])
 }
+
+func (t *FlagsTest) Validation_Defaults() {
+	f := parseArgs([]string{})
+
+	warnings, err := validateFlags(f)
+	AssertEq(nil, err)
+	ExpectEq(0, len(warnings), "Warnings: %v", warnings)
+}
+
+func (t *FlagsTest) Validation_Errors() {
+	testCases := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"--stat-cache-capacity=-1"}, "--stat-cache-capacity"},
+		{[]string{"--inode-limit=-1"}, "--inode-limit"},
+		{[]string{"--rename-dir-limit=-1"}, "--rename-dir-limit"},
+		{[]string{"--traversal-lookahead=-1"}, "--traversal-lookahead"},
+		{[]string{"--dir-mode=1777"}, "--dir-mode"},
+		{[]string{"--file-mode=4755"}, "--file-mode"},
+		{[]string{"--watch-interval=-1s"}, "--watch-interval"},
+		{[]string{"--sync-delay=-1s"}, "--sync-delay"},
+		{[]string{"--deferred-delete-workers=-1"}, "--deferred-delete-workers"},
+		{[]string{"--max-retry-sleep=-1s"}, "--max-retry-sleep"},
+		{[]string{"--retry-multiplier=1"}, "--retry-multiplier"},
+		{[]string{"--poll-interval=-1s"}, "--poll-interval"},
+		{[]string{"--list-cache-ttl=-1s"}, "--list-cache-ttl"},
+		{[]string{"--kernel-list-cache-ttl=-1s"}, "--kernel-list-cache-ttl"},
+		{[]string{"--failover-check-interval=0"}, "--failover-check-interval"},
+		{[]string{"--access-check-interval=-1s"}, "--access-check-interval"},
+		{[]string{"--denied-prefix-ttl=-1s"}, "--denied-prefix-ttl"},
+		{[]string{"--write-budget=-1"}, "--write-budget"},
+		{[]string{"--dirty-limit-mb=-1"}, "--dirty-limit-mb"},
+		{[]string{"--temp-dir-min-free-mb=-1"}, "--temp-dir-min-free-mb"},
+		{[]string{"--checkpoint-upload-parts=0"}, "--checkpoint-upload-parts"},
+		{[]string{"--query-handler=select"}, "--query-handler"},
+		{[]string{"--query-handler=a/b=cat"}, "--query-handler"},
+		{[]string{"--inventory-ttl=-1s"}, "--inventory-ttl"},
+		{[]string{"--inventory-report=report.csv"}, "--inventory-report"},
+		{[]string{"--checkpoint-upload-parts=33"}, "--checkpoint-upload-parts"},
+		{[]string{"--checkpoint-markers=ckpt/done"}, "--checkpoint-markers"},
+		{[]string{"--stream-chunk-size=0"}, "--stream-chunk-size"},
+		{[]string{"--download-parallelism=0"}, "--download-parallelism"},
+		{[]string{"--download-chunk-size-mb=0"}, "--download-chunk-size-mb"},
+		{[]string{"--upload-parallelism=0"}, "--upload-parallelism"},
+		{[]string{"--upload-chunk-size-mb=4"}, "--upload-chunk-size-mb"},
+		{[]string{"--upload-threshold-mb=0"}, "--upload-threshold-mb"},
+		{[]string{"--sequential-read-size-mb=0"}, "--sequential-read-size-mb"},
+		{[]string{"--sequential-read-depth=-1"}, "--sequential-read-depth"},
+		{[]string{"--compaction-threshold=-1"}, "--compaction-threshold"},
+		{[]string{"--compaction-threshold=1"}, "--compaction-threshold"},
+		{[]string{"--write-isolation=exclusive"}, "--write-isolation"},
+		{[]string{"--on-conflict=merge"}, "--on-conflict"},
+		{[]string{"--max-conns-per-host=-1"}, "--max-conns-per-host"},
+		{[]string{"--http-client-timeout=-1s"}, "--http-client-timeout"},
+		{[]string{"--compress-suffixes=.log=zstd"}, "--compress-suffixes"},
+		{[]string{"--prefetch-manifest=warm.txt"}, "absolute path"},
+		{[]string{"--upload-log=uploads.json"}, "absolute path"},
+		{[]string{"--read-trace=reads.trace"}, "absolute path"},
+		{[]string{"--admin-socket=gcsfuse.sock"}, "absolute path"},
+		{[]string{"--file-cache-dir=cache"}, "absolute path"},
+		{[]string{"--file-cache-max-size-mb=0"}, "--file-cache-max-size-mb"},
+		{[]string{"--file-cache-min-free-mb=-1"}, "--file-cache-min-free-mb"},
+		{
+			[]string{"--file-cache-write-mb-per-sec=-1"},
+			"--file-cache-write-mb-per-sec",
+		},
+		{[]string{"--hide-dir-placeholders"}, "requires --implicit-dirs"},
+		{[]string{"--create-dir-placeholders=false"}, "requires --implicit-dirs"},
+		{[]string{"--as-of=2017-06-01T12:00:00Z"}, "requires --snapshot"},
+		{[]string{"--snapshot", "--as-of=2017-06-01"}, "RFC 3339"},
+		{
+			[]string{"--metadata-only", "--prefetch-manifest=/etc/warm.txt"},
+			"--metadata-only",
+		},
+		{
+			[]string{"--create-only", "--batch-rename-manifest=renames"},
+			"--create-only",
+		},
+		{
+			[]string{"--snapshot", "--batch-rename-manifest=renames"},
+			"--snapshot",
+		},
+		{
+			[]string{"--metadata-only", "--batch-rename-manifest=renames"},
+			"--metadata-only",
+		},
+		{
+			[]string{"-o", "ro", "--batch-rename-manifest=renames"},
+			"--read-only",
+		},
+	}
+
+	for _, tc := range testCases {
+		f := parseArgs(tc.args)
+		_, err := validateFlags(f)
+		ExpectThat(err, Error(HasSubstr(tc.expected)), "Args: %v", tc.args)
+	}
+}
+
+func (t *FlagsTest) Validation_S3() {
+	args := []string{
+		"--s3-endpoint=https://example.com",
+		"--key-file=/some/file",
+		"--billing-project=taco",
+	}
+
+	f := parseArgs(args)
+	warnings, err := validateFlags(f)
+
+	AssertEq(nil, err)
+	ExpectEq(2, len(warnings), "Warnings: %v", warnings)
+	ExpectEq("", f.KeyFile)
+	ExpectEq("", f.BillingProject)
+	ExpectEq("https://example.com", f.S3Endpoint)
+}
+
+func (t *FlagsTest) Validation_Snapshot() {
+	args := []string{
+		"--snapshot",
+		"--read-latest-generation",
+		"--watch-interval=1h",
+		"--tail-follow",
+		"--stale-listing-fallback",
+		"--inventory-report=/var/lib/inventory.csv",
+		"--create-only",
+		"--stream-writes",
+		"--write-isolation=last-close-wins",
+		"--on-conflict=copy",
+		"--upload-max-size=100",
+		"--upload-allowed-extensions=.txt",
+		"--upload-log=/var/log/uploads.json",
+		"--write-budget=100",
+		"--allow-writers=/usr/bin/python3",
+		"--compaction-threshold=512",
+	}
+
+	f := parseArgs(args)
+	warnings, err := validateFlags(f)
+
+	AssertEq(nil, err)
+	ExpectEq(14, len(warnings), "Warnings: %v", warnings)
+	ExpectTrue(f.Snapshot)
+	ExpectFalse(f.ReadLatestGeneration)
+	ExpectEq(0, f.WatchInterval)
+	ExpectFalse(f.TailFollow)
+	ExpectFalse(f.StaleListingFallback)
+	ExpectEq(0, len(f.InventoryReports))
+	ExpectFalse(f.CreateOnly)
+	ExpectFalse(f.StreamWrites)
+	ExpectEq("shared", f.WriteIsolation)
+	ExpectEq("discard", f.OnConflict)
+	ExpectEq(0, f.UploadMaxSize)
+	ExpectEq(0, len(f.UploadAllowedExtensions))
+	ExpectEq("", f.UploadLog)
+	ExpectEq(0, f.WriteBudget)
+	ExpectEq(0, len(f.AllowWriters))
+	ExpectEq(0, f.CompactionThreshold)
+}
+
+func (t *FlagsTest) Validation_CompactionOnReadOnlyMount() {
+	args := []string{
+		"-o", "ro",
+		"--compaction-threshold=512",
+	}
+
+	f := parseArgs(args)
+	warnings, err := validateFlags(f)
+
+	AssertEq(nil, err)
+	ExpectEq(1, len(warnings), "Warnings: %v", warnings)
+	ExpectTrue(f.ReadOnly)
+	ExpectEq(0, f.CompactionThreshold)
+}
+
+func (t *FlagsTest) Validation_CheckpointModeOnReadOnlyMount() {
+	args := []string{
+		"--read-only",
+		"--checkpoint-mode",
+	}
+
+	f := parseArgs(args)
+	warnings, err := validateFlags(f)
+
+	AssertEq(nil, err)
+	ExpectEq(1, len(warnings), "Warnings: %v", warnings)
+	ExpectFalse(f.CheckpointMode)
+}
+
+func (t *FlagsTest) Validation_DirtyLimitHardWithoutLimit() {
+	args := []string{
+		"--dirty-limit-hard",
+	}
+
+	f := parseArgs(args)
+	warnings, err := validateFlags(f)
+
+	AssertEq(nil, err)
+	ExpectEq(1, len(warnings), "Warnings: %v", warnings)
+	ExpectFalse(f.DirtyLimitHard)
+}
+
+func (t *FlagsTest) Validation_CompactionOnMetadataOnlyMount() {
+	args := []string{
+		"--metadata-only",
+		"--compaction-threshold=512",
+	}
+
+	f := parseArgs(args)
+	warnings, err := validateFlags(f)
+
+	AssertEq(nil, err)
+	ExpectEq(1, len(warnings), "Warnings: %v", warnings)
+	ExpectTrue(f.MetadataOnly)
+	ExpectEq(0, f.CompactionThreshold)
+}
+
+func (t *FlagsTest) Validation_StreamWritesWithWriteBudget() {
+	args := []string{
+		"--stream-writes",
+		"--write-budget=100",
+	}
+
+	f := parseArgs(args)
+	warnings, err := validateFlags(f)
+
+	AssertEq(nil, err)
+	ExpectEq(1, len(warnings), "Warnings: %v", warnings)
+	ExpectFalse(f.StreamWrites)
+	ExpectEq(100, f.WriteBudget)
+}
+
+func (t *FlagsTest) Validation_WatchIntervalBelowStatCacheTTL() {
+	args := []string{
+		"--stat-cache-ttl=1m",
+		"--watch-interval=10s",
+	}
+
+	f := parseArgs(args)
+	warnings, err := validateFlags(f)
+
+	AssertEq(nil, err)
+	AssertEq(1, len(warnings))
+	ExpectThat(warnings[0], HasSubstr("--watch-interval"))
+	ExpectEq(time.Minute, f.WatchInterval)
+}
+
+func (t *FlagsTest) Validation_WatchIntervalWithoutStatCache() {
+	args := []string{
+		"--stat-cache-ttl=0",
+		"--watch-interval=10s",
+	}
+
+	f := parseArgs(args)
+	warnings, err := validateFlags(f)
+
+	AssertEq(nil, err)
+	ExpectEq(0, len(warnings), "Warnings: %v", warnings)
+	ExpectEq(10*time.Second, f.WatchInterval)
+}
+
+func (t *FlagsTest) Validation_PollIntervalBelowStatCacheTTL() {
+	args := []string{
+		"--stat-cache-ttl=1m",
+		"--poll-interval=10s",
+	}
+
+	f := parseArgs(args)
+	warnings, err := validateFlags(f)
+
+	AssertEq(nil, err)
+	AssertEq(1, len(warnings))
+	ExpectThat(warnings[0], HasSubstr("--stat-cache-ttl"))
+	ExpectEq(10*time.Second, f.StatCacheTTL)
+	ExpectEq(10*time.Second, f.PollInterval)
+}
@@ -0,0 +1,791 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package filecache keeps the contents of GCS objects in files in a local
+// directory, so that reading them again doesn't go to GCS. Entries are keyed
+// by bucket, name, and generation, and since a generation's contents never
+// change they never go stale. When the total size of the entries exceeds a
+// limit, the least recently used are evicted.
+//
+// The directory outlives the process, so the cache is reused by later mounts.
+// Each entry is a file named after a hash of its key, whose mtime records when
+// it was last used, next to a file of the same name with the suffix ".crc"
+// holding the CRC32C of each block of its contents, against which reads are
+// checked: see Entry. Files in the directory that don't look like entries are
+// left alone, except for partially written entries, which are removed when
+// the process that was writing them is known to be gone: see New.
+//
+// The cache can also be asked to leave space free on its device and to limit
+// the rate at which it writes, so that it doesn't crowd out other users of a
+// shared disk. See Limits.
+package filecache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/timeutil"
+)
+
+// The prefix of files holding entries being written. It is followed by the
+// owner of the cache that is writing them and a hyphen, unless the owner is
+// empty, and then by a random suffix.
+const tmpPrefix = "tmp-"
+
+// How long after it was last written a partially written entry of another
+// owner is assumed to have been abandoned.
+const staleTmpAge = 24 * time.Hour
+
+// The suffix of the files holding the block checksums of entries.
+const checksumSuffix = ".crc"
+
+// The size of the blocks of an entry's contents that are checksummed
+// separately, and so the granularity at which corruption is detected and
+// repaired.
+const BlockSize = 64 * 1024
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Key identifies the contents of an object.
+type Key struct {
+	Bucket     string
+	Name       string
+	Generation int64
+}
+
+// Return the name of the file holding the entry for the key.
+func (k Key) fileName() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%d", k.Bucket, k.Name, k.Generation)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Report whether the supplied name could be that of an entry.
+func isEntryName(name string) bool {
+	if len(name) != 2*sha256.Size {
+		return false
+	}
+
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+// Limits bound the resources used by a cache.
+type Limits struct {
+	// Entries are evicted once their total size exceeds this many bytes.
+	MaxSize int64
+
+	// If positive, the least recently used entries are also evicted while the
+	// device holding the directory has fewer than this many bytes available,
+	// and entries that couldn't fit even then aren't added.
+	MinFree int64
+
+	// If positive, the rate in bytes per second to which writes of new entries
+	// are limited. Rather than being delayed, entries that would exceed it
+	// aren't added.
+	WriteRate float64
+}
+
+type entry struct {
+	fileName string
+	size     int64
+}
+
+// Cache is a cache of object contents on local disk. Safe for concurrent
+// access.
+type Cache struct {
+	dir    string
+	owner  string
+	limits Limits
+	clock  timeutil.Clock
+
+	mu sync.Mutex
+
+	// The entries, from most to least recently used, and an index of them by
+	// file name.
+	//
+	// INVARIANT: For each e in lru, index[e.Value.(*entry).fileName] == e
+	// INVARIANT: len(index) == lru.Len()
+	//
+	// GUARDED_BY(mu)
+	lru   list.List
+	index map[string]*list.Element
+
+	// The total size of the entries.
+	//
+	// INVARIANT: size is the sum of the entries' sizes
+	// INVARIANT: size <= limits.MaxSize
+	//
+	// GUARDED_BY(mu)
+	size int64
+
+	// With a write rate limit, the time before which no new entry may be
+	// started, as the entries started so far have used up the allowance.
+	//
+	// GUARDED_BY(mu)
+	nextWrite time.Time
+}
+
+// New opens the cache in the supplied directory, creating the directory if
+// necessary, and picks up the entries left by earlier processes. Entries are
+// evicted as the supplied limits require.
+//
+// The owner, which may be empty but mustn't contain a hyphen, names the user
+// of the cache in the files of entries being written, so that each user can
+// tell which it may clean up: when a cache is opened, partially written
+// entries of the same owner, left by an earlier process that crashed, are
+// removed at once, while those of other owners are removed only once they
+// have gone untouched for a day. For a mount, an owner that stays the same
+// when the mount is restarted works best.
+//
+// Only one process may use the directory at a time, other than for writing
+// entries.
+func New(
+	dir string,
+	owner string,
+	limits Limits,
+	clock timeutil.Clock) (c *Cache, err error) {
+	if strings.Contains(owner, "-") {
+		err = fmt.Errorf("Invalid owner: %q", owner)
+		return
+	}
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		err = fmt.Errorf("MkdirAll: %v", err)
+		return
+	}
+
+	c = &Cache{
+		dir:    dir,
+		owner:  owner,
+		limits: limits,
+		clock:  clock,
+		index:  make(map[string]*list.Element),
+	}
+
+	c.lru.Init()
+
+	err = c.load()
+	if err != nil {
+		err = fmt.Errorf("load: %v", err)
+		return
+	}
+
+	return
+}
+
+// Return the prefix of the files of entries being written by the cache.
+func (c *Cache) ownTmpPrefix() string {
+	if c.owner == "" {
+		return tmpPrefix
+	}
+
+	return tmpPrefix + c.owner + "-"
+}
+
+// Return true if the supplied file, which holds an entry being written, may
+// be removed because whoever was writing it is gone.
+func (c *Cache) isAbandoned(fi os.FileInfo) bool {
+	// Find the owner.
+	rest := strings.TrimPrefix(fi.Name(), tmpPrefix)
+	owner := ""
+	if i := strings.Index(rest, "-"); i >= 0 {
+		owner = rest[:i]
+	}
+
+	if owner == c.owner {
+		return true
+	}
+
+	return c.clock.Now().Sub(fi.ModTime()) > staleTmpAge
+}
+
+// Pick up the entries in the directory, and remove abandoned partially
+// written ones.
+func (c *Cache) load() (err error) {
+	infos, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		err = fmt.Errorf("ReadDir: %v", err)
+		return
+	}
+
+	// Add the least recently used first, so that it ends up at the back.
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var checksumFiles []string
+	for _, fi := range infos {
+		switch {
+		case strings.HasPrefix(fi.Name(), tmpPrefix):
+			if c.isAbandoned(fi) {
+				os.Remove(filepath.Join(c.dir, fi.Name()))
+			}
+
+		case fi.Mode().IsRegular() && isEntryName(fi.Name()):
+			c.add(fi.Name(), fi.Size())
+
+		case isEntryName(strings.TrimSuffix(fi.Name(), checksumSuffix)):
+			checksumFiles = append(checksumFiles, fi.Name())
+		}
+	}
+
+	// Remove checksums whose entries are gone.
+	for _, name := range checksumFiles {
+		if _, ok := c.index[strings.TrimSuffix(name, checksumSuffix)]; !ok {
+			os.Remove(filepath.Join(c.dir, name))
+		}
+	}
+
+	c.evict()
+	return
+}
+
+// Size returns the total size of the entries in the cache.
+func (c *Cache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.size
+}
+
+// Open returns the entry for the supplied key, marking it used, or nil if
+// there is none. Its contents remain readable after it is evicted.
+func (c *Cache) Open(k Key) (ent *Entry) {
+	name := k.fileName()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.index[name]
+	if !ok {
+		return
+	}
+
+	p := filepath.Join(c.dir, name)
+	ent, err := openEntry(p)
+	if err != nil {
+		log.Printf("File cache: dropping unreadable entry: %v", err)
+		c.remove(e)
+		ent = nil
+		return
+	}
+
+	// Record the use, for the benefit of later processes.
+	now := c.clock.Now()
+	os.Chtimes(p, now, now)
+	c.lru.MoveToFront(e)
+
+	return
+}
+
+// Remove deletes the entry for the supplied key, if any. Entries already
+// open remain readable.
+func (c *Cache) Remove(k Key) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.index[k.fileName()]; ok {
+		c.remove(e)
+	}
+}
+
+// NewWriter returns a writer for the contents of the entry for the supplied
+// key, which has the given size, or nil if an entry of that size can't be
+// cached, or can't be at the moment. Nothing is visible until the writer is
+// committed.
+func (c *Cache) NewWriter(k Key, size int64) (w *Writer, err error) {
+	if size <= 0 || size > c.limits.MaxSize || !c.admit(size) {
+		return
+	}
+
+	f, err := ioutil.TempFile(c.dir, c.ownTmpPrefix())
+	if err != nil {
+		err = fmt.Errorf("TempFile: %v", err)
+		return
+	}
+
+	w = &Writer{
+		c:        c,
+		f:        f,
+		fileName: k.fileName(),
+		size:     size,
+		block:    crc32.New(crc32cTable),
+	}
+
+	return
+}
+
+// Decide whether a new entry of the given size may be written now, according
+// to the free space and write rate limits, and if so charge it against the
+// write rate.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Cache) admit(size int64) (ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Even evicting everything must leave enough space free.
+	if c.limits.MinFree > 0 {
+		c.evict()
+		if c.available()+c.size-size < c.limits.MinFree {
+			return
+		}
+	}
+
+	if c.limits.WriteRate > 0 {
+		now := c.clock.Now()
+		if now.Before(c.nextWrite) {
+			return
+		}
+
+		d := time.Duration(float64(size) / c.limits.WriteRate * float64(time.Second))
+		c.nextWrite = now.Add(d)
+	}
+
+	ok = true
+	return
+}
+
+// Return the number of bytes available on the device holding the directory,
+// or a huge number if that can't be found out.
+func (c *Cache) available() (n int64) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(c.dir, &st); err != nil {
+		log.Printf("File cache: Statfs: %v", err)
+		n = 1 << 62
+		return
+	}
+
+	n = int64(st.Bavail) * int64(st.Bsize)
+	return
+}
+
+// Add the supplied entry as the most recently used, replacing any existing
+// record of it. Its file must already be in place.
+//
+// LOCKS_REQUIRED(c.mu)
+func (c *Cache) add(fileName string, size int64) {
+	if e, ok := c.index[fileName]; ok {
+		c.forget(e)
+	}
+
+	c.index[fileName] = c.lru.PushFront(&entry{fileName: fileName, size: size})
+	c.size += size
+}
+
+// Forget the supplied entry, leaving its file alone.
+//
+// LOCKS_REQUIRED(c.mu)
+func (c *Cache) forget(e *list.Element) {
+	ent := e.Value.(*entry)
+	c.lru.Remove(e)
+	delete(c.index, ent.fileName)
+	c.size -= ent.size
+}
+
+// Forget the supplied entry and delete its files.
+//
+// LOCKS_REQUIRED(c.mu)
+func (c *Cache) remove(e *list.Element) {
+	c.forget(e)
+
+	p := filepath.Join(c.dir, e.Value.(*entry).fileName)
+	os.Remove(p)
+	os.Remove(p + checksumSuffix)
+}
+
+// Evict the least recently used entries until they fit, and leave enough
+// space free on the device.
+//
+// LOCKS_REQUIRED(c.mu)
+func (c *Cache) evict() {
+	for c.size > c.limits.MaxSize {
+		c.remove(c.lru.Back())
+	}
+
+	if c.limits.MinFree <= 0 {
+		return
+	}
+
+	for c.lru.Len() > 0 && c.available() < c.limits.MinFree {
+		c.remove(c.lru.Back())
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Writer
+////////////////////////////////////////////////////////////////////////
+
+// Writer writes the contents of a new entry. Not safe for concurrent access.
+type Writer struct {
+	c        *Cache
+	f        *os.File
+	fileName string
+	size     int64
+
+	// The checksums of the complete blocks written so far, and of what has
+	// been written of the current one.
+	checksums []uint32
+	block     hash.Hash32
+	inBlock   int
+}
+
+// Write appends to the contents.
+func (w *Writer) Write(p []byte) (n int, err error) {
+	n, err = w.f.Write(p)
+
+	// Checksum what was written, block by block.
+	for b := p[:n]; len(b) > 0; {
+		m := BlockSize - w.inBlock
+		if m > len(b) {
+			m = len(b)
+		}
+
+		w.block.Write(b[:m])
+		w.inBlock += m
+		b = b[m:]
+
+		if w.inBlock == BlockSize {
+			w.checksums = append(w.checksums, w.block.Sum32())
+			w.block.Reset()
+			w.inBlock = 0
+		}
+	}
+
+	return
+}
+
+// Commit adds the entry to the cache as the most recently used, evicting
+// others to make room. The contents must have the size given to NewWriter.
+// The writer must not be used afterward.
+func (w *Writer) Commit() (err error) {
+	err = w.commit()
+	if err != nil {
+		w.Abort()
+	}
+
+	return
+}
+
+func (w *Writer) commit() (err error) {
+	fi, err := w.f.Stat()
+	if err != nil {
+		err = fmt.Errorf("Stat: %v", err)
+		return
+	}
+
+	if fi.Size() != w.size {
+		err = fmt.Errorf("Wrote %d bytes, expected %d", fi.Size(), w.size)
+		return
+	}
+
+	err = w.f.Close()
+	if err != nil {
+		err = fmt.Errorf("Close: %v", err)
+		return
+	}
+
+	now := w.c.clock.Now()
+	err = os.Chtimes(w.f.Name(), now, now)
+	if err != nil {
+		err = fmt.Errorf("Chtimes: %v", err)
+		return
+	}
+
+	// Finish off the last block.
+	if w.inBlock > 0 {
+		w.checksums = append(w.checksums, w.block.Sum32())
+	}
+
+	checksumFile, err := w.writeChecksums()
+	if err != nil {
+		err = fmt.Errorf("writeChecksums: %v", err)
+		return
+	}
+
+	w.c.mu.Lock()
+	defer w.c.mu.Unlock()
+
+	// Move the checksums into place first, so that any entry found has them.
+	p := filepath.Join(w.c.dir, w.fileName)
+	err = os.Rename(checksumFile, p+checksumSuffix)
+	if err != nil {
+		os.Remove(checksumFile)
+		err = fmt.Errorf("Rename: %v", err)
+		return
+	}
+
+	err = os.Rename(w.f.Name(), p)
+	if err != nil {
+		err = fmt.Errorf("Rename: %v", err)
+		return
+	}
+
+	w.c.add(w.fileName, w.size)
+	w.c.evict()
+
+	return
+}
+
+// Abort discards the contents. The writer must not be used afterward.
+func (w *Writer) Abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+// Write the block checksums to a new temporary file, returning its path.
+func (w *Writer) writeChecksums() (path string, err error) {
+	f, err := ioutil.TempFile(w.c.dir, w.c.ownTmpPrefix())
+	if err != nil {
+		err = fmt.Errorf("TempFile: %v", err)
+		return
+	}
+
+	path = f.Name()
+	err = binary.Write(f, binary.BigEndian, w.checksums)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+
+	if err != nil {
+		os.Remove(path)
+		err = fmt.Errorf("Write: %v", err)
+		return
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Entry
+////////////////////////////////////////////////////////////////////////
+
+// CorruptBlockError is returned by Entry.ReadAt when a block of the contents
+// doesn't match its checksum, e.g. because the local disk corrupted it.
+type CorruptBlockError struct {
+	// The range of the contents covered by the block.
+	Offset int64
+	Length int
+}
+
+func (e *CorruptBlockError) Error() string {
+	return fmt.Sprintf(
+		"Corrupt block of %d bytes at offset %d",
+		e.Length,
+		e.Offset)
+}
+
+// Entry gives access to the contents of a cached object. Each block of the
+// contents is checked against its checksum the first time it is read, and
+// reads of a block that doesn't match fail until it is repaired. Entries
+// written by versions of gcsfuse that didn't record checksums aren't checked.
+//
+// Not safe for concurrent access.
+type Entry struct {
+	f    *os.File
+	size int64
+
+	// The checksum of each block, or nil if there are none to check against.
+	checksums []uint32
+
+	// Whether each block has been checked since the entry was opened.
+	//
+	// INVARIANT: checksums == nil || len(verified) == len(checksums)
+	verified []bool
+}
+
+// Open the entry whose contents are in the supplied file.
+func openEntry(p string) (e *Entry, err error) {
+	f, err := os.OpenFile(p, os.O_RDWR, 0)
+	if err != nil {
+		return
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		err = fmt.Errorf("Stat: %v", err)
+		return
+	}
+
+	e = &Entry{
+		f:    f,
+		size: fi.Size(),
+	}
+
+	// Load the checksums, if any.
+	b, err := ioutil.ReadFile(p + checksumSuffix)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+
+	blocks := (e.size + BlockSize - 1) / BlockSize
+	if err == nil && int64(len(b)) != 4*blocks {
+		err = fmt.Errorf("%d bytes of checksums for %d blocks", len(b), blocks)
+	}
+
+	if err != nil {
+		f.Close()
+		e = nil
+		return
+	}
+
+	e.checksums = make([]uint32, blocks)
+	e.verified = make([]bool, blocks)
+	for i := range e.checksums {
+		e.checksums[i] = binary.BigEndian.Uint32(b[4*i:])
+	}
+
+	return
+}
+
+// Size returns the size of the contents.
+func (e *Entry) Size() int64 {
+	return e.size
+}
+
+// Read the supplied block, returning its contents if they match its checksum
+// and *CorruptBlockError otherwise.
+func (e *Entry) readBlock(i int64) (b []byte, err error) {
+	b = make([]byte, BlockSize)
+	if e.size-i*BlockSize < BlockSize {
+		b = b[:e.size-i*BlockSize]
+	}
+
+	_, err = e.f.ReadAt(b, i*BlockSize)
+	if err != nil {
+		err = fmt.Errorf("ReadAt: %v", err)
+		return
+	}
+
+	if crc32.Checksum(b, crc32cTable) != e.checksums[i] {
+		err = &CorruptBlockError{Offset: i * BlockSize, Length: len(b)}
+		return
+	}
+
+	e.verified[i] = true
+	return
+}
+
+// ReadAt matches the semantics of io.ReaderAt, except that it returns
+// *CorruptBlockError if a block in the range doesn't match its checksum.
+func (e *Entry) ReadAt(p []byte, offset int64) (n int, err error) {
+	if e.checksums == nil || offset >= e.size || len(p) == 0 {
+		n, err = e.f.ReadAt(p, offset)
+		return
+	}
+
+	end := offset + int64(len(p))
+	if end > e.size {
+		end = e.size
+	}
+
+	// Check each block in the range that hasn't been already, copying out
+	// what it holds of the range, and read what the others hold directly.
+	for i := offset / BlockSize; i*BlockSize < end; i++ {
+		start := i * BlockSize
+		limit := start + BlockSize
+		if limit > end {
+			limit = end
+		}
+
+		var b []byte
+		if e.verified[i] {
+			if start < offset {
+				start = offset
+			}
+
+			_, err = e.f.ReadAt(p[start-offset:limit-offset], start)
+			if err != nil {
+				err = fmt.Errorf("ReadAt: %v", err)
+				return
+			}
+
+			continue
+		}
+
+		b, err = e.readBlock(i)
+		if err != nil {
+			return
+		}
+
+		if start < offset {
+			b = b[offset-start:]
+			start = offset
+		}
+
+		copy(p[start-offset:limit-offset], b)
+	}
+
+	n = int(end - offset)
+	if n < len(p) {
+		err = io.EOF
+	}
+
+	return
+}
+
+// Repair overwrites the block reported by a *CorruptBlockError with the
+// supplied contents, which must match its checksum.
+func (e *Entry) Repair(offset int64, p []byte) (err error) {
+	i := offset / BlockSize
+	if e.checksums == nil || offset%BlockSize != 0 || i >= int64(len(e.checksums)) {
+		err = fmt.Errorf("No block at offset %d", offset)
+		return
+	}
+
+	if crc32.Checksum(p, crc32cTable) != e.checksums[i] {
+		err = fmt.Errorf("Contents for block at offset %d don't match it", offset)
+		return
+	}
+
+	_, err = e.f.WriteAt(p, offset)
+	if err != nil {
+		err = fmt.Errorf("WriteAt: %v", err)
+		return
+	}
+
+	e.verified[i] = true
+	return
+}
+
+// Close releases the resources of the entry, which must not be used
+// afterward.
+func (e *Entry) Close() (err error) {
+	err = e.f.Close()
+	return
+}
@@ -0,0 +1,427 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filecache_test
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/filecache"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestFileCache(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type FileCacheTest struct {
+	clock timeutil.SimulatedClock
+	dir   string
+	cache *filecache.Cache
+}
+
+var _ SetUpInterface = &FileCacheTest{}
+var _ TearDownInterface = &FileCacheTest{}
+
+func init() { RegisterTestSuite(&FileCacheTest{}) }
+
+func (t *FileCacheTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.clock.SetTime(time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC))
+
+	t.dir, err = ioutil.TempDir("", "filecache_test")
+	AssertEq(nil, err)
+
+	t.open(10)
+}
+
+func (t *FileCacheTest) TearDown() {
+	err := os.RemoveAll(t.dir)
+	AssertEq(nil, err)
+}
+
+// (Re)open the cache, as a new mount would.
+func (t *FileCacheTest) open(maxSize int64) {
+	t.openWithLimits(filecache.Limits{MaxSize: maxSize})
+}
+
+func (t *FileCacheTest) openWithLimits(limits filecache.Limits) {
+	var err error
+	t.cache, err = filecache.New(t.dir, "", limits, &t.clock)
+	AssertEq(nil, err)
+}
+
+func key(name string) filecache.Key {
+	return filecache.Key{Bucket: "some_bucket", Name: name, Generation: 17}
+}
+
+// Add an entry, a minute after the last one.
+func (t *FileCacheTest) insert(k filecache.Key, contents string) {
+	t.clock.AdvanceTime(time.Minute)
+
+	w, err := t.cache.NewWriter(k, int64(len(contents)))
+	AssertEq(nil, err)
+	AssertNe(nil, w)
+
+	_, err = w.Write([]byte(contents))
+	AssertEq(nil, err)
+
+	err = w.Commit()
+	AssertEq(nil, err)
+}
+
+// Return the contents of the entry, or "" if there is none.
+func (t *FileCacheTest) read(k filecache.Key) string {
+	t.clock.AdvanceTime(time.Minute)
+
+	e := t.cache.Open(k)
+	if e == nil {
+		return ""
+	}
+
+	defer e.Close()
+
+	b, err := ioutil.ReadAll(io.NewSectionReader(e, 0, e.Size()))
+	AssertEq(nil, err)
+
+	return string(b)
+}
+
+// Overwrite the start of the contents of the entry in its file.
+func (t *FileCacheTest) corrupt(contents string) {
+	matches, err := filepath.Glob(path.Join(t.dir, "*"))
+	AssertEq(nil, err)
+
+	for _, m := range matches {
+		if filepath.Ext(m) == "" {
+			err = ioutil.WriteFile(m, []byte(contents), 0600)
+			AssertEq(nil, err)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *FileCacheTest) Empty() {
+	ExpectEq(0, t.cache.Size())
+	ExpectEq("", t.read(key("foo")))
+}
+
+func (t *FileCacheTest) InsertAndOpen() {
+	t.insert(key("foo"), "taco")
+	ExpectEq(4, t.cache.Size())
+	ExpectEq("taco", t.read(key("foo")))
+
+	// Other generations and buckets are different entries.
+	k := key("foo")
+	k.Generation++
+	ExpectEq("", t.read(k))
+
+	k = key("foo")
+	k.Bucket = "other_bucket"
+	ExpectEq("", t.read(k))
+}
+
+func (t *FileCacheTest) Replace() {
+	t.insert(key("foo"), "taco")
+	t.insert(key("foo"), "burr")
+
+	ExpectEq(4, t.cache.Size())
+	ExpectEq("burr", t.read(key("foo")))
+}
+
+func (t *FileCacheTest) TooLarge() {
+	w, err := t.cache.NewWriter(key("foo"), 11)
+	AssertEq(nil, err)
+	ExpectEq(nil, w)
+}
+
+func (t *FileCacheTest) WrongSize() {
+	w, err := t.cache.NewWriter(key("foo"), 4)
+	AssertEq(nil, err)
+
+	_, err = w.Write([]byte("tac"))
+	AssertEq(nil, err)
+
+	ExpectNe(nil, w.Commit())
+	ExpectEq(0, t.cache.Size())
+	ExpectEq("", t.read(key("foo")))
+}
+
+func (t *FileCacheTest) Abort() {
+	w, err := t.cache.NewWriter(key("foo"), 4)
+	AssertEq(nil, err)
+
+	_, err = w.Write([]byte("taco"))
+	AssertEq(nil, err)
+
+	w.Abort()
+	ExpectEq("", t.read(key("foo")))
+
+	// Nothing is left behind.
+	entries, err := ioutil.ReadDir(t.dir)
+	AssertEq(nil, err)
+	ExpectEq(0, len(entries))
+}
+
+func (t *FileCacheTest) EvictsLeastRecentlyUsed() {
+	t.insert(key("foo"), "taco")
+	t.insert(key("bar"), "burr")
+
+	// Use foo, so that bar is the least recently used.
+	ExpectEq("taco", t.read(key("foo")))
+
+	t.insert(key("baz"), "enchi")
+	ExpectEq(9, t.cache.Size())
+	ExpectEq("taco", t.read(key("foo")))
+	ExpectEq("", t.read(key("bar")))
+	ExpectEq("enchi", t.read(key("baz")))
+}
+
+func (t *FileCacheTest) OpenFileSurvivesEviction() {
+	t.insert(key("foo"), "tacos")
+	e := t.cache.Open(key("foo"))
+	AssertNe(nil, e)
+	defer e.Close()
+
+	t.insert(key("bar"), "burrito")
+	ExpectEq("", t.read(key("foo")))
+
+	b, err := ioutil.ReadAll(io.NewSectionReader(e, 0, e.Size()))
+	AssertEq(nil, err)
+	ExpectEq("tacos", string(b))
+}
+
+func (t *FileCacheTest) PersistsAcrossOpens() {
+	t.insert(key("foo"), "taco")
+	t.insert(key("bar"), "burr")
+	ExpectEq("taco", t.read(key("foo")))
+
+	// Reopening picks up both entries, remembering which was used last.
+	t.open(10)
+	ExpectEq(8, t.cache.Size())
+
+	t.insert(key("baz"), "enchi")
+	ExpectEq("taco", t.read(key("foo")))
+	ExpectEq("", t.read(key("bar")))
+}
+
+func (t *FileCacheTest) ReopenWithSmallerLimit() {
+	t.insert(key("foo"), "taco")
+	t.insert(key("bar"), "burr")
+
+	t.open(5)
+	ExpectEq(4, t.cache.Size())
+	ExpectEq("", t.read(key("foo")))
+	ExpectEq("burr", t.read(key("bar")))
+}
+
+func (t *FileCacheTest) CleansUpAndIgnoresOtherFiles() {
+	err := ioutil.WriteFile(path.Join(t.dir, "tmp-123"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = ioutil.WriteFile(path.Join(t.dir, "README"), []byte("burrito"), 0600)
+	AssertEq(nil, err)
+
+	t.open(10)
+	ExpectEq(0, t.cache.Size())
+
+	_, err = os.Stat(path.Join(t.dir, "tmp-123"))
+	ExpectTrue(os.IsNotExist(err))
+
+	_, err = os.Stat(path.Join(t.dir, "README"))
+	ExpectEq(nil, err)
+}
+
+func (t *FileCacheTest) CleansUpOnlyOwnAndAbandonedFiles() {
+	var err error
+	names := []string{"tmp-abcd-123", "tmp-ef01-456", "tmp-ef01-789"}
+	for _, name := range names {
+		err = ioutil.WriteFile(path.Join(t.dir, name), []byte("taco"), 0600)
+		AssertEq(nil, err)
+	}
+
+	// Another owner's file untouched for over a day is abandoned.
+	old := t.clock.Now().Add(-25 * time.Hour)
+	err = os.Chtimes(path.Join(t.dir, "tmp-ef01-789"), old, old)
+	AssertEq(nil, err)
+
+	// Other owners' recent files may still be being written.
+	recent := t.clock.Now().Add(-time.Hour)
+	err = os.Chtimes(path.Join(t.dir, "tmp-ef01-456"), recent, recent)
+	AssertEq(nil, err)
+
+	t.cache, err = filecache.New(
+		t.dir,
+		"abcd",
+		filecache.Limits{MaxSize: 10},
+		&t.clock)
+
+	AssertEq(nil, err)
+
+	_, err = os.Stat(path.Join(t.dir, "tmp-abcd-123"))
+	ExpectTrue(os.IsNotExist(err))
+
+	_, err = os.Stat(path.Join(t.dir, "tmp-ef01-456"))
+	ExpectEq(nil, err)
+
+	_, err = os.Stat(path.Join(t.dir, "tmp-ef01-789"))
+	ExpectTrue(os.IsNotExist(err))
+
+	// Entries are written under the owner's name.
+	w, err := t.cache.NewWriter(key("foo"), 4)
+	AssertEq(nil, err)
+	AssertNe(nil, w)
+	defer w.Abort()
+
+	matches, err := filepath.Glob(path.Join(t.dir, "tmp-abcd-*"))
+	AssertEq(nil, err)
+	ExpectEq(1, len(matches))
+}
+
+func (t *FileCacheTest) InvalidOwner() {
+	_, err := filecache.New(t.dir, "a-b", filecache.Limits{MaxSize: 10}, &t.clock)
+	ExpectThat(err, Error(HasSubstr("owner")))
+}
+
+func (t *FileCacheTest) WriteRateLimit() {
+	// Allow four bytes a second.
+	t.openWithLimits(filecache.Limits{MaxSize: 10, WriteRate: 4})
+
+	w, err := t.cache.NewWriter(key("foo"), 4)
+	AssertEq(nil, err)
+	AssertNe(nil, w)
+	w.Abort()
+
+	// The allowance is used up for the next second, aborted or not.
+	w, err = t.cache.NewWriter(key("bar"), 4)
+	AssertEq(nil, err)
+	ExpectEq(nil, w)
+
+	t.clock.AdvanceTime(999 * time.Millisecond)
+	w, err = t.cache.NewWriter(key("bar"), 4)
+	AssertEq(nil, err)
+	ExpectEq(nil, w)
+
+	t.clock.AdvanceTime(time.Millisecond)
+	w, err = t.cache.NewWriter(key("bar"), 4)
+	AssertEq(nil, err)
+	AssertNe(nil, w)
+	w.Abort()
+}
+
+func (t *FileCacheTest) MinFreeUnattainable() {
+	t.insert(key("foo"), "taco")
+
+	// No device has this much space free, so reopening evicts everything and
+	// nothing new is added.
+	t.openWithLimits(filecache.Limits{MaxSize: 10, MinFree: 1 << 62})
+	ExpectEq(0, t.cache.Size())
+
+	w, err := t.cache.NewWriter(key("bar"), 4)
+	AssertEq(nil, err)
+	ExpectEq(nil, w)
+}
+
+func (t *FileCacheTest) CorruptBlockRepaired() {
+	t.insert(key("foo"), "taco")
+	t.corrupt("tack")
+
+	e := t.cache.Open(key("foo"))
+	AssertNe(nil, e)
+	defer e.Close()
+
+	buf := make([]byte, 2)
+	_, err := e.ReadAt(buf, 2)
+	AssertThat(err, HasSameTypeAs(&filecache.CorruptBlockError{}))
+
+	cbe := err.(*filecache.CorruptBlockError)
+	ExpectEq(0, cbe.Offset)
+	ExpectEq(4, cbe.Length)
+
+	// Contents that don't match the checksum aren't accepted.
+	ExpectNe(nil, e.Repair(0, []byte("tack")))
+
+	err = e.Repair(0, []byte("taco"))
+	AssertEq(nil, err)
+
+	n, err := e.ReadAt(buf, 2)
+	AssertEq(nil, err)
+	ExpectEq("co", string(buf[:n]))
+
+	// The entry is repaired for later readers too.
+	ExpectEq("taco", t.read(key("foo")))
+}
+
+func (t *FileCacheTest) RemoveDeletesChecksums() {
+	t.insert(key("foo"), "taco")
+	t.cache.Remove(key("foo"))
+
+	ExpectEq(0, t.cache.Size())
+	ExpectEq("", t.read(key("foo")))
+
+	entries, err := ioutil.ReadDir(t.dir)
+	AssertEq(nil, err)
+	ExpectEq(0, len(entries))
+}
+
+func (t *FileCacheTest) ReadsAcrossBlocks() {
+	t.open(4 * filecache.BlockSize)
+
+	contents := strings.Repeat("0123456789", filecache.BlockSize/4)
+	t.insert(key("foo"), contents)
+
+	e := t.cache.Open(key("foo"))
+	AssertNe(nil, e)
+	defer e.Close()
+
+	// Within, across, and past the end of blocks, some checked already.
+	ranges := []struct {
+		offset int64
+		size   int
+	}{
+		{filecache.BlockSize - 3, 6},
+		{10, 2 * filecache.BlockSize},
+		{int64(len(contents)) - 5, 10},
+	}
+
+	for _, r := range ranges {
+		buf := make([]byte, r.size)
+		n, err := e.ReadAt(buf, r.offset)
+
+		end := r.offset + int64(r.size)
+		if end > int64(len(contents)) {
+			end = int64(len(contents))
+			ExpectEq(io.EOF, err)
+		} else {
+			ExpectEq(nil, err)
+		}
+
+		ExpectEq(contents[r.offset:end], string(buf[:n]), "%v", r)
+	}
+}
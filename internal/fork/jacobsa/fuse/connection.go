@@ -26,10 +26,10 @@ import (
 
 	"golang.org/x/net/context"
 
-	"github.com/jacobsa/fuse/fuseops"
-	"github.com/jacobsa/fuse/internal/buffer"
-	"github.com/jacobsa/fuse/internal/freelist"
-	"github.com/jacobsa/fuse/internal/fusekernel"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseops"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/internal/buffer"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/internal/freelist"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/internal/fusekernel"
 )
 
 type contextKeyType uint64
@@ -134,8 +134,8 @@ func (c *Connection) Init() (err error) {
 
 	// Make sure the protocol version spoken by the kernel is new enough.
 	min := fusekernel.Protocol{
-		fusekernel.ProtoVersionMinMajor,
-		fusekernel.ProtoVersionMinMinor,
+		Major: fusekernel.ProtoVersionMinMajor,
+		Minor: fusekernel.ProtoVersionMinMinor,
 	}
 
 	if initOp.Kernel.LT(min) {
@@ -146,8 +146,8 @@ func (c *Connection) Init() (err error) {
 
 	// Downgrade our protocol if necessary.
 	c.protocol = fusekernel.Protocol{
-		fusekernel.ProtoVersionMaxMajor,
-		fusekernel.ProtoVersionMaxMinor,
+		Major: fusekernel.ProtoVersionMaxMajor,
+		Minor: fusekernel.ProtoVersionMaxMinor,
 	}
 
 	if initOp.Kernel.LT(c.protocol) {
@@ -448,6 +448,22 @@ func (c *Connection) shouldLogError(
 	return true
 }
 
+// CallerPid returns the ID of the process (more precisely, the thread) whose
+// system call caused the kernel to send the op being served with the supplied
+// context, which must be derived from the context returned by ReadOp. The ID
+// is in the PID namespace of the process that mounted the file system, and is
+// zero for ops the kernel sends on its own behalf. ok is false if the context
+// isn't associated with an op.
+func CallerPid(ctx context.Context) (pid uint32, ok bool) {
+	state, ok := ctx.Value(contextKey).(opState)
+	if !ok {
+		return
+	}
+
+	pid = state.inMsg.Header().Pid
+	return
+}
+
 // Reply replies to an op previously read using ReadOp, with the supplied error
 // (or nil if successful). The context must be the context returned by ReadOp.
 //
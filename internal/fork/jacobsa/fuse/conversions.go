@@ -24,9 +24,9 @@ import (
 	"time"
 	"unsafe"
 
-	"github.com/jacobsa/fuse/fuseops"
-	"github.com/jacobsa/fuse/internal/buffer"
-	"github.com/jacobsa/fuse/internal/fusekernel"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseops"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/internal/buffer"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/internal/fusekernel"
 )
 
 ////////////////////////////////////////////////////////////////////////
@@ -255,8 +255,16 @@ func convertInMessage(
 		}
 
 	case fusekernel.OpOpen:
+		type input fusekernel.OpenIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			err = errors.New("Corrupt OpOpen")
+			return
+		}
+
 		o = &fuseops.OpenFileOp{
 			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
+			Flags: in.Flags,
 		}
 
 	case fusekernel.OpOpendir:
@@ -340,6 +348,19 @@ func convertInMessage(
 			Handle: fuseops.HandleID(in.Fh),
 		}
 
+	case fusekernel.OpFsyncdir:
+		type input fusekernel.FsyncIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			err = errors.New("Corrupt OpFsyncdir")
+			return
+		}
+
+		o = &fuseops.SyncDirOp{
+			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle: fuseops.HandleID(in.Fh),
+		}
+
 	case fusekernel.OpWrite:
 		in := (*fusekernel.WriteIn)(inMsg.Consume(fusekernel.WriteInSize(protocol)))
 		if in == nil {
@@ -360,6 +381,25 @@ func convertInMessage(
 			Offset: int64(in.Offset),
 		}
 
+	case fusekernel.OpCopyFileRange:
+		type input fusekernel.CopyFileRangeIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			err = errors.New("Corrupt OpCopyFileRange")
+			return
+		}
+
+		o = &fuseops.CopyFileRangeOp{
+			InputInode:   fuseops.InodeID(inMsg.Header().Nodeid),
+			InputHandle:  fuseops.HandleID(in.FhIn),
+			InputOffset:  int64(in.OffIn),
+			OutputInode:  fuseops.InodeID(in.NodeidOut),
+			OutputHandle: fuseops.HandleID(in.FhOut),
+			OutputOffset: int64(in.OffOut),
+			Length:       in.Len,
+			Flags:        in.Flags,
+		}
+
 	case fusekernel.OpFsync:
 		type input fusekernel.FsyncIn
 		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
@@ -415,7 +455,7 @@ func convertInMessage(
 		}
 
 		o = &initOp{
-			Kernel:       fusekernel.Protocol{in.Major, in.Minor},
+			Kernel:       fusekernel.Protocol{Major: in.Major, Minor: in.Minor},
 			MaxReadahead: in.MaxReadahead,
 			Flags:        fusekernel.InitFlags(in.Flags),
 		}
@@ -642,6 +682,10 @@ func (c *Connection) kernelResponseForOp(
 		oo := (*fusekernel.OpenOut)(m.Grow(int(unsafe.Sizeof(fusekernel.OpenOut{}))))
 		oo.Fh = uint64(o.Handle)
 
+		if o.UseDirectIO {
+			oo.OpenFlags |= uint32(fusekernel.OpenDirectIO)
+		}
+
 	case *fuseops.CreateSymlinkOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
@@ -660,6 +704,14 @@ func (c *Connection) kernelResponseForOp(
 		out := (*fusekernel.OpenOut)(m.Grow(int(unsafe.Sizeof(fusekernel.OpenOut{}))))
 		out.Fh = uint64(o.Handle)
 
+		if o.CacheDir {
+			out.OpenFlags |= uint32(fusekernel.OpenCacheDir)
+		}
+
+		if o.KeepCache {
+			out.OpenFlags |= uint32(fusekernel.OpenKeepCache)
+		}
+
 	case *fuseops.ReadDirOp:
 		// convertInMessage already set up the destination buffer to be at the end
 		// of the out message. We need only shrink to the right size based on how
@@ -669,6 +721,9 @@ func (c *Connection) kernelResponseForOp(
 	case *fuseops.ReleaseDirHandleOp:
 		// Empty response
 
+	case *fuseops.SyncDirOp:
+		// Empty response
+
 	case *fuseops.OpenFileOp:
 		out := (*fusekernel.OpenOut)(m.Grow(int(unsafe.Sizeof(fusekernel.OpenOut{}))))
 		out.Fh = uint64(o.Handle)
@@ -691,6 +746,10 @@ func (c *Connection) kernelResponseForOp(
 		out := (*fusekernel.WriteOut)(m.Grow(int(unsafe.Sizeof(fusekernel.WriteOut{}))))
 		out.Size = uint32(len(o.Data))
 
+	case *fuseops.CopyFileRangeOp:
+		out := (*fusekernel.WriteOut)(m.Grow(int(unsafe.Sizeof(fusekernel.WriteOut{}))))
+		out.Size = uint32(o.BytesCopied)
+
 	case *fuseops.SyncFileOp:
 		// Empty response
 
@@ -738,6 +797,7 @@ func (c *Connection) kernelResponseForOp(
 		// statfs::f_bsize (which affects free space display in the Finder).
 		out.St.Bsize = o.IoSize
 		out.St.Frsize = o.BlockSize
+		out.St.Namelen = o.NameLen
 
 	case *fuseops.RemoveXattrOp:
 		// Empty response
@@ -745,15 +805,16 @@ func (c *Connection) kernelResponseForOp(
 	case *fuseops.GetXattrOp:
 		// convertInMessage already set up the destination buffer to be at the end
 		// of the out message. We need only shrink to the right size based on how
-		// much the user read.
-		if o.BytesRead == 0 {
+		// much the user read. If the kernel supplied no buffer, it asked for the
+		// size alone.
+		if len(o.Dst) == 0 {
 			writeXattrSize(m, uint32(o.BytesRead))
 		} else {
 			m.ShrinkTo(buffer.OutMessageHeaderSize + o.BytesRead)
 		}
 
 	case *fuseops.ListXattrOp:
-		if o.BytesRead == 0 {
+		if len(o.Dst) == 0 {
 			writeXattrSize(m, uint32(o.BytesRead))
 		} else {
 			m.ShrinkTo(buffer.OutMessageHeaderSize + o.BytesRead)
@@ -19,7 +19,7 @@ import (
 	"reflect"
 	"strings"
 
-	"github.com/jacobsa/fuse/fuseops"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseops"
 )
 
 // Decide on the name of the given op.
@@ -90,6 +90,15 @@ func describeRequest(op interface{}) (s string) {
 		addComponent("offset %d", typed.Offset)
 		addComponent("%d bytes", len(typed.Data))
 
+	case *fuseops.CopyFileRangeOp:
+		addComponent("inode %v", typed.InputInode)
+		addComponent("handle %d", typed.InputHandle)
+		addComponent("offset %d", typed.InputOffset)
+		addComponent("to inode %d", typed.OutputInode)
+		addComponent("handle %d", typed.OutputHandle)
+		addComponent("offset %d", typed.OutputOffset)
+		addComponent("%d bytes", typed.Length)
+
 	case *fuseops.RemoveXattrOp:
 		addComponent("name %s", typed.Name)
 
@@ -92,6 +92,11 @@ type StatFSOp struct {
 	// The total number of inodes in the file system, and how many remain free.
 	Inodes     uint64
 	InodesFree uint64
+
+	// The maximum length in bytes of a file name, reported as statfs::f_namelen
+	// and used by pathconf(3) for _PC_NAME_MAX. Zero means no limit is
+	// reported.
+	NameLen uint32
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -295,6 +300,9 @@ type CreateFileOp struct {
 	// file handle. The file system must ensure this ID remains valid until a
 	// later call to ReleaseFileHandle.
 	Handle HandleID
+
+	// As for OpenFileOp.
+	UseDirectIO bool
 }
 
 // Create a symlink inode. If the name already exists, the file system should
@@ -417,6 +425,17 @@ type OpenDirOp struct {
 	// directory handle. The file system must ensure this ID remains valid until
 	// a later call to ReleaseDirHandle.
 	Handle HandleID
+
+	// Set by the file system: whether the kernel may cache the entries read
+	// through this handle and serve later reads of the directory from that
+	// cache, rather than sending ReadDirOps. Requires Linux 4.20 or later;
+	// ignored elsewhere.
+	CacheDir bool
+
+	// Set by the file system: whether the kernel should keep any entries it
+	// has cached for the directory from earlier opens. By default they are
+	// discarded when the directory is opened.
+	KeepCache bool
 }
 
 // Read entries from a directory previously opened with OpenDir.
@@ -526,6 +545,17 @@ type ReleaseDirHandleOp struct {
 	Handle HandleID
 }
 
+// Synchronize the contents of an open directory to storage, as requested by
+// fsync(2) on a directory handle.
+//
+// Returning ENOSYS makes the kernel treat this and later fsyncs of
+// directories as successful without sending them.
+type SyncDirOp struct {
+	// The directory and handle being synced.
+	Inode  InodeID
+	Handle HandleID
+}
+
 ////////////////////////////////////////////////////////////////////////
 // File handles
 ////////////////////////////////////////////////////////////////////////
@@ -540,6 +570,10 @@ type OpenFileOp struct {
 	// The ID of the inode to be opened.
 	Inode InodeID
 
+	// The flags passed to open(2), e.g. syscall.O_RDWR. The kernel strips
+	// O_CREAT, O_EXCL, and O_NOCTTY.
+	Flags uint32
+
 	// An opaque ID that will be echoed in follow-up calls for this file using
 	// the same struct file in the kernel. In practice this usually means
 	// follow-up calls using the file descriptor returned by open(2).
@@ -664,6 +698,36 @@ type WriteFileOp struct {
 	Data []byte
 }
 
+// Copy a range of data from one open file to another, as requested by
+// copy_file_range(2). The kernel sends this only for files in the same file
+// system, and only on Linux 4.20 and later. It limits the length so that the
+// number of bytes copied fits in 32 bits.
+//
+// File systems that can't copy a particular range more efficiently than by
+// reading and writing it should return EOPNOTSUPP, in which case the kernel
+// (from Linux 5.3) does exactly that instead. Returning ENOSYS disables the op
+// for the lifetime of the mount.
+type CopyFileRangeOp struct {
+	// The file and handle from which to read.
+	InputInode  InodeID
+	InputHandle HandleID
+	InputOffset int64
+
+	// The file and handle to which to write.
+	OutputInode  InodeID
+	OutputHandle HandleID
+	OutputOffset int64
+
+	// The number of bytes to copy, and flags passed to copy_file_range, which
+	// are currently always zero.
+	Length uint64
+	Flags  uint64
+
+	// Set by the file system: the number of bytes copied, which may be fewer
+	// than Length if the input ends sooner.
+	BytesCopied uint64
+}
+
 // Synchronize the current contents of an open file to storage.
 //
 // vfs.txt documents this as being called for by the fsync(2) system call
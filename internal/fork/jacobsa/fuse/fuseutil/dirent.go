@@ -18,7 +18,7 @@ import (
 	"syscall"
 	"unsafe"
 
-	"github.com/jacobsa/fuse/fuseops"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseops"
 )
 
 type DirentType uint32
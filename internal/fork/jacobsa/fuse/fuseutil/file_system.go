@@ -20,8 +20,8 @@ import (
 
 	"golang.org/x/net/context"
 
-	"github.com/jacobsa/fuse"
-	"github.com/jacobsa/fuse/fuseops"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseops"
 )
 
 // An interface with a method for each op type in the fuseops package. This can
@@ -50,9 +50,11 @@ type FileSystem interface {
 	OpenDir(context.Context, *fuseops.OpenDirOp) error
 	ReadDir(context.Context, *fuseops.ReadDirOp) error
 	ReleaseDirHandle(context.Context, *fuseops.ReleaseDirHandleOp) error
+	SyncDir(context.Context, *fuseops.SyncDirOp) error
 	OpenFile(context.Context, *fuseops.OpenFileOp) error
 	ReadFile(context.Context, *fuseops.ReadFileOp) error
 	WriteFile(context.Context, *fuseops.WriteFileOp) error
+	CopyFileRange(context.Context, *fuseops.CopyFileRangeOp) error
 	SyncFile(context.Context, *fuseops.SyncFileOp) error
 	FlushFile(context.Context, *fuseops.FlushFileOp) error
 	ReleaseFileHandle(context.Context, *fuseops.ReleaseFileHandleOp) error
@@ -170,6 +172,9 @@ func (s *fileSystemServer) handleOp(
 	case *fuseops.ReleaseDirHandleOp:
 		err = s.fs.ReleaseDirHandle(ctx, typed)
 
+	case *fuseops.SyncDirOp:
+		err = s.fs.SyncDir(ctx, typed)
+
 	case *fuseops.OpenFileOp:
 		err = s.fs.OpenFile(ctx, typed)
 
@@ -179,6 +184,9 @@ func (s *fileSystemServer) handleOp(
 	case *fuseops.WriteFileOp:
 		err = s.fs.WriteFile(ctx, typed)
 
+	case *fuseops.CopyFileRangeOp:
+		err = s.fs.CopyFileRange(ctx, typed)
+
 	case *fuseops.SyncFileOp:
 		err = s.fs.SyncFile(ctx, typed)
 
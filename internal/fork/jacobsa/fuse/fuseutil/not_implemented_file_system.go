@@ -15,8 +15,8 @@
 package fuseutil
 
 import (
-	"github.com/jacobsa/fuse"
-	"github.com/jacobsa/fuse/fuseops"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseops"
 	"golang.org/x/net/context"
 )
 
@@ -134,6 +134,13 @@ func (fs *NotImplementedFileSystem) ReleaseDirHandle(
 	return
 }
 
+func (fs *NotImplementedFileSystem) SyncDir(
+	ctx context.Context,
+	op *fuseops.SyncDirOp) (err error) {
+	err = fuse.ENOSYS
+	return
+}
+
 func (fs *NotImplementedFileSystem) OpenFile(
 	ctx context.Context,
 	op *fuseops.OpenFileOp) (err error) {
@@ -155,6 +162,13 @@ func (fs *NotImplementedFileSystem) WriteFile(
 	return
 }
 
+func (fs *NotImplementedFileSystem) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) (err error) {
+	err = fuse.ENOSYS
+	return
+}
+
 func (fs *NotImplementedFileSystem) SyncFile(
 	ctx context.Context,
 	op *fuseops.SyncFileOp) (err error) {
@@ -20,7 +20,7 @@ import (
 	"reflect"
 	"unsafe"
 
-	"github.com/jacobsa/fuse/internal/fusekernel"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/internal/fusekernel"
 )
 
 // OutMessageHeaderSize is the size of the leading header in every
@@ -154,11 +154,12 @@ func (m *OutMessage) Len() int {
 // the leading header.
 func (m *OutMessage) Bytes() []byte {
 	l := m.Len()
-	sh := reflect.SliceHeader{
-		Data: uintptr(unsafe.Pointer(&m.header)),
-		Len:  l,
-		Cap:  l,
-	}
 
-	return *(*[]byte)(unsafe.Pointer(&sh))
+	var b []byte
+	sh := (*reflect.SliceHeader)(unsafe.Pointer(&b))
+	sh.Data = uintptr(unsafe.Pointer(&m.header))
+	sh.Len = l
+	sh.Cap = l
+
+	return b
 }
@@ -0,0 +1,57 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"unsafe"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseops"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/internal/fusekernel"
+)
+
+// InvalidateEntry asks the kernel to drop any cached directory entry for the
+// child of the given parent with the given name. If nothing else holds on to
+// the child's inode, the kernel then forgets it, sending a ForgetInodeOp.
+// Returns ENOENT if the kernel has no such entry.
+//
+// The kernel may hold the parent locked while waiting for the reply to an op
+// on it, so this must not be called while handling such an op.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) InvalidateEntry(
+	parent fuseops.InodeID,
+	name string) (err error) {
+	m := c.getOutMessage()
+	defer c.putOutMessage(m)
+
+	// Notifications are identified by a zero unique ID, with the notification
+	// code in place of the error.
+	h := m.OutHeader()
+	h.Error = fusekernel.NotifyCodeInvalEntry
+
+	size := int(unsafe.Sizeof(fusekernel.NotifyInvalEntryOut{}))
+	out := (*fusekernel.NotifyInvalEntryOut)(m.Grow(size))
+	out.Parent = uint64(parent)
+	out.Namelen = uint32(len(name))
+
+	// The kernel expects the name to be NUL-terminated.
+	m.AppendString(name)
+	m.Append([]byte{0})
+
+	h.Len = uint32(m.Len())
+
+	err = c.writeMessage(m.Bytes())
+	return
+}
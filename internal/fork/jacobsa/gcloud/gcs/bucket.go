@@ -21,10 +21,9 @@ import (
 	"net/http"
 	"net/url"
 
-	"github.com/jacobsa/gcloud/httputil"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/httputil"
 	"golang.org/x/net/context"
 	"google.golang.org/api/googleapi"
-	storagev1 "google.golang.org/api/storage/v1"
 )
 
 // Bucket represents a GCS bucket, pre-bound with a bucket name and necessary
@@ -161,6 +160,14 @@ func (b *bucket) ListObjects(
 		query.Set("maxResults", fmt.Sprintf("%v", req.MaxResults))
 	}
 
+	if req.Versions {
+		query.Set("versions", "true")
+	}
+
+	if req.MatchGlob != "" {
+		query.Set("matchGlob", req.MatchGlob)
+	}
+
 	if b.billingProject != "" {
 		query.Set("userProject", b.billingProject)
 	}
@@ -193,7 +200,7 @@ func (b *bucket) ListObjects(
 	}
 
 	// Parse the response.
-	var rawListing *storagev1.Objects
+	var rawListing *listingResource
 	if err = json.NewDecoder(httpRes.Body).Decode(&rawListing); err != nil {
 		return
 	}
@@ -257,7 +264,7 @@ func (b *bucket) StatObject(
 	}
 
 	// Parse the response.
-	var rawObject *storagev1.Object
+	var rawObject *objectResource
 	if err = json.NewDecoder(httpRes.Body).Decode(&rawObject); err != nil {
 		return
 	}
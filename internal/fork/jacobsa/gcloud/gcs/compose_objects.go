@@ -24,7 +24,7 @@ import (
 	"net/url"
 	"unicode/utf8"
 
-	"github.com/jacobsa/gcloud/httputil"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/httputil"
 	"google.golang.org/api/googleapi"
 	storagev1 "google.golang.org/api/storage/v1"
 
@@ -149,7 +149,7 @@ func (b *bucket) ComposeObjects(
 	}
 
 	// Parse the response.
-	var rawObject *storagev1.Object
+	var rawObject *objectResource
 	if err = json.NewDecoder(httpRes.Body).Decode(&rawObject); err != nil {
 		return
 	}
@@ -23,6 +23,25 @@ import (
 	storagev1 "google.golang.org/api/storage/v1"
 )
 
+////////////////////////////////////////////////////////////////////////
+// Raw types
+////////////////////////////////////////////////////////////////////////
+
+// The object resource as returned by GCS, including fields added since the
+// vendored storagev1 package was generated.
+type objectResource struct {
+	storagev1.Object
+	CustomTime    string `json:"customTime,omitempty"`
+	TemporaryHold bool   `json:"temporaryHold,omitempty"`
+}
+
+// A page of a listing as returned by GCS, with objects as above.
+type listingResource struct {
+	Items         []*objectResource `json:"items,omitempty"`
+	NextPageToken string            `json:"nextPageToken,omitempty"`
+	Prefixes      []string          `json:"prefixes,omitempty"`
+}
+
 ////////////////////////////////////////////////////////////////////////
 // To our types
 ////////////////////////////////////////////////////////////////////////
@@ -35,7 +54,7 @@ func toTime(s string) (t time.Time, err error) {
 	return
 }
 
-func toObjects(in []*storagev1.Object) (out []*Object, err error) {
+func toObjects(in []*objectResource) (out []*Object, err error) {
 	for _, rawObject := range in {
 		var o *Object
 		o, err = toObject(rawObject)
@@ -50,7 +69,7 @@ func toObjects(in []*storagev1.Object) (out []*Object, err error) {
 	return
 }
 
-func toListing(in *storagev1.Objects) (out *Listing, err error) {
+func toListing(in *listingResource) (out *Listing, err error) {
 	out = &Listing{
 		CollapsedRuns:     in.Prefixes,
 		ContinuationToken: in.NextPageToken,
@@ -65,7 +84,7 @@ func toListing(in *storagev1.Objects) (out *Listing, err error) {
 	return
 }
 
-func toObject(in *storagev1.Object) (out *Object, err error) {
+func toObject(in *objectResource) (out *Object, err error) {
 	// Convert the easy fields.
 	out = &Object{
 		Name:            in.Name,
@@ -80,6 +99,7 @@ func toObject(in *storagev1.Object) (out *Object, err error) {
 		Generation:      in.Generation,
 		MetaGeneration:  in.Metageneration,
 		StorageClass:    in.StorageClass,
+		TemporaryHold:   in.TemporaryHold,
 	}
 
 	// Work around Google-internal bug 21572928. See notes on the ComponentCount
@@ -93,6 +113,12 @@ func toObject(in *storagev1.Object) (out *Object, err error) {
 		out.Owner = in.Owner.Entity
 	}
 
+	// Creation time
+	if out.Created, err = toTime(in.TimeCreated); err != nil {
+		err = fmt.Errorf("Decoding TimeCreated field: %v", err)
+		return
+	}
+
 	// Deletion time
 	if out.Deleted, err = toTime(in.TimeDeleted); err != nil {
 		err = fmt.Errorf("Decoding TimeDeleted field: %v", err)
@@ -105,6 +131,12 @@ func toObject(in *storagev1.Object) (out *Object, err error) {
 		return
 	}
 
+	// Custom time
+	if out.CustomTime, err = toTime(in.CustomTime); err != nil {
+		err = fmt.Errorf("Decoding CustomTime field: %v", err)
+		return
+	}
+
 	// MD5
 	if in.Md5Hash != "" {
 		var md5Slice []byte
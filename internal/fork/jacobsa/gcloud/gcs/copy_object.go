@@ -22,9 +22,8 @@ import (
 	"net/url"
 	"unicode/utf8"
 
-	"github.com/jacobsa/gcloud/httputil"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/httputil"
 	"google.golang.org/api/googleapi"
-	storagev1 "google.golang.org/api/storage/v1"
 
 	"golang.org/x/net/context"
 )
@@ -105,7 +104,7 @@ func (b *bucket) CopyObject(
 	}
 
 	// Parse the response.
-	var rawObject *storagev1.Object
+	var rawObject *objectResource
 	if err = json.NewDecoder(httpRes.Body).Decode(&rawObject); err != nil {
 		return
 	}
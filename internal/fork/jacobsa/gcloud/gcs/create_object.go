@@ -25,10 +25,9 @@ import (
 	"strings"
 	"unicode/utf8"
 
-	"github.com/jacobsa/gcloud/httputil"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/httputil"
 	"golang.org/x/net/context"
 	"google.golang.org/api/googleapi"
-	storagev1 "google.golang.org/api/storage/v1"
 )
 
 // Create the JSON for an "object resource", for use as an Objects.insert body.
@@ -213,7 +212,7 @@ func (b *bucket) CreateObject(
 	}
 
 	// Parse the response.
-	var rawObject *storagev1.Object
+	var rawObject *objectResource
 	if err = json.NewDecoder(httpRes.Body).Decode(&rawObject); err != nil {
 		return
 	}
@@ -17,7 +17,7 @@ package gcscaching
 import (
 	"time"
 
-	"github.com/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
 	"github.com/jacobsa/util/lrucache"
 )
 
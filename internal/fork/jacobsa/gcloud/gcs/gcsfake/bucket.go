@@ -27,7 +27,7 @@ import (
 	"strings"
 	"unicode/utf8"
 
-	"github.com/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
 	"github.com/jacobsa/syncutil"
 	"github.com/jacobsa/timeutil"
 	"golang.org/x/net/context"
@@ -197,6 +197,7 @@ func (b *bucket) mintObject(
 	md5Sum := md5.Sum(contents)
 
 	// Set up basic info.
+	now := b.clock.Now()
 	b.prevGeneration++
 	o.metadata = gcs.Object{
 		Name:            req.Name,
@@ -214,7 +215,8 @@ func (b *bucket) mintObject(
 		Generation:      b.prevGeneration,
 		MetaGeneration:  1,
 		StorageClass:    "STANDARD",
-		Updated:         b.clock.Now(),
+		Created:         now,
+		Updated:         now,
 	}
 
 	// Set up data.
@@ -435,6 +437,15 @@ func (b *bucket) ListObjects(
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
+	var glob *gcs.Glob
+	if req.MatchGlob != "" {
+		glob, err = gcs.ParseGlob(req.MatchGlob)
+		if err != nil {
+			err = fmt.Errorf("ParseGlob: %v", err)
+			return
+		}
+	}
+
 	// Set up the result object.
 	listing = new(gcs.Listing)
 
@@ -461,6 +472,10 @@ func (b *bucket) ListObjects(
 		var o fakeObject = b.objects[i]
 		name := o.metadata.Name
 
+		if glob != nil && !glob.Match(name) {
+			continue
+		}
+
 		// Search for a delimiter if necessary.
 		if req.Delimiter != "" {
 			// Search only in the part after the prefix.
@@ -544,10 +559,21 @@ func (b *bucket) NewReader(
 func (b *bucket) CreateObject(
 	ctx context.Context,
 	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	// Snarf the contents before locking, so that a slow writer doesn't block
+	// other requests, as with the real service.
+	contents, err := ioutil.ReadAll(req.Contents)
+	if err != nil {
+		err = fmt.Errorf("ReadAll: %v", err)
+		return
+	}
+
+	reqCopy := *req
+	reqCopy.Contents = bytes.NewReader(contents)
+
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	o, err = b.createObjectLocked(req)
+	o, err = b.createObjectLocked(&reqCopy)
 	return
 }
 
@@ -766,6 +792,16 @@ func (b *bucket) UpdateObject(
 		return
 	}
 
+	// GCS refuses to move a custom time earlier.
+	if req.CustomTime != nil && req.CustomTime.Before(obj.CustomTime) {
+		err = fmt.Errorf(
+			"Custom time %v of object %q can't be moved earlier",
+			obj.CustomTime,
+			obj.Name)
+
+		return
+	}
+
 	// Update the entry's basic fields according to the request.
 	if req.ContentType != nil {
 		obj.ContentType = *req.ContentType
@@ -783,6 +819,14 @@ func (b *bucket) UpdateObject(
 		obj.CacheControl = *req.CacheControl
 	}
 
+	if req.CustomTime != nil {
+		obj.CustomTime = *req.CustomTime
+	}
+
+	if req.TemporaryHold != nil {
+		obj.TemporaryHold = *req.TemporaryHold
+	}
+
 	// Update the user metadata if necessary.
 	if len(req.Metadata) > 0 {
 		if obj.Metadata == nil {
@@ -15,7 +15,7 @@
 package gcsutil
 
 import (
-	"github.com/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
 	"golang.org/x/net/context"
 )
 
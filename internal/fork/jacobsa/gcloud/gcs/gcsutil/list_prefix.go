@@ -17,7 +17,7 @@ package gcsutil
 import (
 	"fmt"
 
-	"github.com/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
 	"golang.org/x/net/context"
 )
 
@@ -0,0 +1,157 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcs
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// A Glob is a compiled pattern for ListObjectsRequest.MatchGlob.
+type Glob struct {
+	re *regexp.Regexp
+}
+
+// ParseGlob compiles a pattern with the syntax accepted by GCS for the
+// matchGlob parameter to objects.list:
+//
+//  *  "*" matches any sequence of characters other than '/'.
+//
+//  *  "**" matches any sequence of characters, including '/'. "**/" also
+//     matches the empty string, so that "a/**/b" matches "a/b".
+//
+//  *  "?" matches any single character other than '/'.
+//
+//  *  "[abc]" and "[a-z]" match any one of the characters in the brackets, and
+//     "[!abc]" any character not among them.
+//
+//  *  "{a,b}" matches any one of the comma-separated alternatives.
+//
+// All other characters match themselves. See QuoteGlob for matching the
+// special characters literally.
+func ParseGlob(pattern string) (g *Glob, err error) {
+	var re strings.Builder
+	re.WriteString("^")
+
+	var depth int
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			re.WriteString("(?:.*/)?")
+			i += 2
+
+		case strings.HasPrefix(pattern[i:], "**"):
+			re.WriteString(".*")
+			i++
+
+		case c == '*':
+			re.WriteString("[^/]*")
+
+		case c == '?':
+			re.WriteString("[^/]")
+
+		case c == '[':
+			// A ']' straight after the opening bracket (or its negation) is part
+			// of the class.
+			j := i + 1
+			if j < len(pattern) && pattern[j] == '!' {
+				j++
+			}
+
+			if j < len(pattern) && pattern[j] == ']' {
+				j++
+			}
+
+			k := strings.IndexByte(pattern[j:], ']')
+			if k < 0 {
+				err = errors.New("Unterminated character class")
+				return
+			}
+
+			re.WriteString("[")
+			class := pattern[i+1 : j+k]
+			if strings.HasPrefix(class, "!") {
+				re.WriteString("^")
+				class = class[1:]
+			}
+
+			for _, r := range class {
+				if strings.ContainsRune(`\[]^`, r) {
+					re.WriteByte('\\')
+				}
+
+				re.WriteRune(r)
+			}
+
+			re.WriteString("]")
+			i = j + k
+
+		case c == '{':
+			re.WriteString("(?:")
+			depth++
+
+		case c == '}' && depth > 0:
+			re.WriteString(")")
+			depth--
+
+		case c == ',' && depth > 0:
+			re.WriteString("|")
+
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	if depth > 0 {
+		err = errors.New("Unterminated alternatives")
+		return
+	}
+
+	re.WriteString("$")
+
+	compiled, err := regexp.Compile(re.String())
+	if err != nil {
+		err = fmt.Errorf("Compiling %q: %v", pattern, err)
+		return
+	}
+
+	g = &Glob{re: compiled}
+	return
+}
+
+// Match reports whether the object name matches the glob.
+func (g *Glob) Match(name string) bool {
+	return g.re.MatchString(name)
+}
+
+// QuoteGlob returns a pattern that matches exactly the supplied string, e.g.
+// for prefixing a pattern with an object name prefix.
+func QuoteGlob(s string) string {
+	var quoted strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', '{':
+			quoted.WriteString("[" + string(r) + "]")
+
+		default:
+			quoted.WriteRune(r)
+		}
+	}
+
+	return quoted.String()
+}
@@ -41,9 +41,15 @@ type Object struct {
 	Generation      int64
 	MetaGeneration  int64
 	StorageClass    string
+	Created         time.Time
 	Deleted         time.Time
 	Updated         time.Time
 
+	// Properties that drive lifecycle rules and retention. CustomTime is zero
+	// if it has never been set.
+	CustomTime    time.Time
+	TemporaryHold bool
+
 	// NOTE(jacobsa): As of 2015-06-03, the official GCS documentation for this
 	// property (https://goo.gl/GwD5Dq) says this:
 	//
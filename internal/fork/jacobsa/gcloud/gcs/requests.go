@@ -18,6 +18,7 @@ import (
 	"crypto/md5"
 	"fmt"
 	"io"
+	"time"
 )
 
 // A request to create an object, accepted by Bucket.CreateObject.
@@ -204,6 +205,17 @@ type ListObjectsRequest struct {
 	// this number may actually be returned. If this is zero, a sensible default
 	// is used.
 	MaxResults int
+
+	// If true, return a record for each generation of an object that the bucket
+	// retains, including noncurrent ones (which have Deleted set), rather than
+	// only the live generation. Noncurrent generations are retained only by
+	// buckets with object versioning enabled.
+	Versions bool
+
+	// If non-empty, return only objects whose full names match this pattern,
+	// with the syntax described for ParseGlob. Collapsed runs are formed from
+	// the matching objects alone.
+	MatchGlob string
 }
 
 // Listing contains a set of objects and delimter-based collapsed runs returned
@@ -282,6 +294,13 @@ type UpdateObjectRequest struct {
 	// supplied string. There is no facility for completely removing user
 	// metadata.
 	Metadata map[string]*string
+
+	// If non-nil, the object's custom time is set to *CustomTime. GCS refuses
+	// to move a custom time earlier, and there is no way to remove one.
+	CustomTime *time.Time
+
+	// If non-nil, a temporary hold is placed on the object or released from it.
+	TemporaryHold *bool
 }
 
 // A request to delete an object by name. Non-existence is not treated as an
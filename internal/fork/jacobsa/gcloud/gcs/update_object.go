@@ -21,11 +21,11 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"time"
 
-	"github.com/jacobsa/gcloud/httputil"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/httputil"
 	"golang.org/x/net/context"
 	"google.golang.org/api/googleapi"
-	storagev1 "google.golang.org/api/storage/v1"
 )
 
 func (b *bucket) makeUpdateObjectBody(
@@ -63,10 +63,19 @@ func (b *bucket) makeUpdateObjectBody(
 		jsonMap["metadata"] = req.Metadata
 	}
 
+	// Likewise for the lifecycle properties.
+	if req.CustomTime != nil {
+		jsonMap["customTime"] = req.CustomTime.UTC().Format(time.RFC3339Nano)
+	}
+
+	if req.TemporaryHold != nil {
+		jsonMap["temporaryHold"] = *req.TemporaryHold
+	}
+
 	// Set up a reader.
 	r, err := googleapi.WithoutDataWrapper.JSONReader(jsonMap)
 	if err != nil {
-		err = fmt.Errorf("JSONReader", err)
+		err = fmt.Errorf("JSONReader: %v", err)
 		return
 	}
 
@@ -161,7 +170,7 @@ func (b *bucket) UpdateObject(
 	}
 
 	// Parse the response.
-	var rawObject *storagev1.Object
+	var rawObject *objectResource
 	if err = json.NewDecoder(httpRes.Body).Decode(&rawObject); err != nil {
 		return
 	}
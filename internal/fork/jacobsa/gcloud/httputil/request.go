@@ -63,6 +63,9 @@ func NewRequest(
 		Cancel:        ctx.Done(),
 	}
 
+	// Make values carried by the context available to transports.
+	req = req.WithContext(ctx)
+
 	// Set the User-Agent header.
 	req.Header.Set("User-Agent", userAgent)
 
@@ -17,7 +17,7 @@ package ratelimit
 import (
 	"io"
 
-	"github.com/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
 	"golang.org/x/net/context"
 )
 
@@ -0,0 +1,152 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/net/context"
+)
+
+// Admin lets the process serving a file system manage it directly, rather
+// than through the extended attributes of the mount point. Pass one to
+// NewServer in ServerConfig.Admin; until then, its methods fail.
+//
+// Safe for concurrent access.
+type Admin struct {
+	mu sync.Mutex
+
+	// The file system being managed, or nil if NewServer hasn't been called.
+	//
+	// GUARDED_BY(mu)
+	fs *fileSystem
+}
+
+// LOCKS_EXCLUDED(a.mu)
+func (a *Admin) attach(fs *fileSystem) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.fs = fs
+}
+
+// LOCKS_EXCLUDED(a.mu)
+func (a *Admin) fileSystem() (fs *fileSystem, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	fs = a.fs
+	if fs == nil {
+		err = errors.New("No file system is being served")
+	}
+
+	return
+}
+
+// Status returns the current state of the file system, as reported through
+// StatusXattr.
+func (a *Admin) Status() (s Status, err error) {
+	fs, err := a.fileSystem()
+	if err != nil {
+		return
+	}
+
+	s = fs.status()
+	return
+}
+
+// Flush writes out every file with local modifications now, as fsync would,
+// regardless of any sync delay, and returns the number of files and bytes
+// written. Files that fail to sync are logged, and counted in the error.
+func (a *Admin) Flush(ctx context.Context) (synced int, bytes int64, err error) {
+	fs, err := a.fileSystem()
+	if err != nil {
+		return
+	}
+
+	synced, bytes, failed := fs.syncAll(ctx, "Flushing")
+	if failed > 0 {
+		err = fmt.Errorf("%d files failed to sync; see the log", failed)
+		return
+	}
+
+	return
+}
+
+// Invalidate forgets what the file system and the kernel have cached about
+// whether the file or directory with the supplied name (relative to the root,
+// e.g. "foo/bar") exists and what it is, so that the next lookup asks GCS.
+// Nothing is forgotten about files that are open.
+func (a *Admin) Invalidate(name string) (err error) {
+	fs, err := a.fileSystem()
+	if err != nil {
+		return
+	}
+
+	name = strings.Trim(name, "/")
+	if name == "" {
+		err = errors.New("The root can't be invalidated")
+		return
+	}
+
+	fs.mu.Lock()
+	parent, childName := fs.parentDirInode(name)
+	conn := fs.conn
+	fs.mu.Unlock()
+
+	// Special case: if the parent has no inode, the kernel has no entry for
+	// the child and we have nothing cached about it.
+	if parent == nil {
+		return
+	}
+
+	parent.Lock()
+	parent.ForgetChild(childName)
+	parent.Unlock()
+
+	if conn == nil {
+		return
+	}
+
+	err = conn.InvalidateEntry(parent.ID(), childName)
+
+	// Special case: the kernel has no entry to drop.
+	if err == syscall.ENOENT {
+		err = nil
+	}
+
+	if err != nil {
+		err = fmt.Errorf("InvalidateEntry: %v", err)
+		return
+	}
+
+	return
+}
+
+// Drain starts draining the file system, as setting DrainXattr does. Progress
+// is reported in the status.
+func (a *Admin) Drain() (err error) {
+	fs, err := a.fileSystem()
+	if err != nil {
+		return
+	}
+
+	fs.startDrain()
+	return
+}
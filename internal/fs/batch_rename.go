@@ -0,0 +1,471 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/jacobsa/syncutil"
+)
+
+// The suffix appended to the name of the batch rename manifest to form the
+// name of the object to which results are written.
+const batchRenameResultSuffix = ".result"
+
+// How often the result object of a batch rename in progress is rewritten to
+// report how far it has got.
+const batchRenameProgressInterval = 10 * time.Second
+
+// A single entry in a batch rename manifest.
+type renamePair struct {
+	Src string
+	Dst string
+}
+
+// The outcome of attempting to carry out a renamePair.
+type renameResult struct {
+	renamePair
+	Err error
+}
+
+// Parse a batch rename manifest. Each non-empty line that doesn't begin with
+// '#' must consist of a source and a destination object name separated by a
+// single tab, which permits names containing spaces.
+func parseRenameManifest(r io.Reader) (pairs []renamePair, err error) {
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) != 2 || fields[0] == "" || fields[1] == "" {
+			err = fmt.Errorf(
+				"Line %d: expected a source and destination separated by a tab",
+				lineNum)
+			return
+		}
+
+		pairs = append(pairs, renamePair{Src: fields[0], Dst: fields[1]})
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		err = fmt.Errorf("Scan: %v", err)
+		return
+	}
+
+	return
+}
+
+// Move the supplied generation of an object to a new name by copying it
+// server-side and then deleting exactly that generation, in the same manner
+// as fileSystem.Rename.
+func moveObject(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	src *gcs.Object,
+	dst string) (err error) {
+	// Copy it to the destination.
+	_, err = bucket.CopyObject(
+		ctx,
+		&gcs.CopyObjectRequest{
+			SrcName:                       src.Name,
+			DstName:                       dst,
+			SrcGeneration:                 src.Generation,
+			SrcMetaGenerationPrecondition: &src.MetaGeneration,
+		})
+
+	if err != nil {
+		err = fmt.Errorf("CopyObject: %w", err)
+		return
+	}
+
+	// Delete behind.
+	err = bucket.DeleteObject(
+		ctx,
+		&gcs.DeleteObjectRequest{
+			Name:                       src.Name,
+			Generation:                 src.Generation,
+			MetaGenerationPrecondition: &src.MetaGeneration,
+		})
+
+	if err != nil {
+		err = fmt.Errorf("DeleteObject: %w", err)
+		return
+	}
+
+	return
+}
+
+// Call f for each index in [0, n) from a pool of goroutines, returning early
+// with an error if the context is cancelled.
+func forEachParallel(
+	ctx context.Context,
+	n int,
+	f func(ctx context.Context, i int)) (err error) {
+	const parallelism = 64
+	b := syncutil.NewBundle(ctx)
+
+	// Feed indices to the workers.
+	indices := make(chan int, 100)
+	b.Add(func(ctx context.Context) (err error) {
+		defer close(indices)
+		for i := 0; i < n; i++ {
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+				return
+
+			case indices <- i:
+			}
+		}
+
+		return
+	})
+
+	// Run the workers.
+	for i := 0; i < parallelism; i++ {
+		b.Add(func(ctx context.Context) (err error) {
+			for i := range indices {
+				f(ctx, i)
+			}
+
+			return
+		})
+	}
+
+	err = b.Join()
+	return
+}
+
+// Returned for renames that were abandoned because the batch was cancelled.
+var errRenameNotAttempted = errors.New("Not attempted")
+
+// Carry out the supplied renames with some parallelism, returning a result for
+// each in the same order. The check function, if non-nil, is applied to each
+// destination name before doing anything. The progress function, if non-nil,
+// is called after each rename is attempted, from any goroutine.
+//
+// The batch proceeds in two phases: first every source is statted, then the
+// renames of those that exist are recorded in a single journal under the
+// supplied prefix and carried out. Failures of individual renames are
+// recorded in the results rather than aborting the batch; only cancellation
+// of the context or failure to write the journal stops it early.
+func batchRename(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	journalPrefix string,
+	pairs []renamePair,
+	check func(name string) error,
+	progress func()) (results []renameResult) {
+	results = make([]renameResult, len(pairs))
+	for i, p := range pairs {
+		results[i] = renameResult{renamePair: p, Err: errRenameNotAttempted}
+
+		// We don't support renaming directories.
+		if inode.IsDirName(p.Src) || inode.IsDirName(p.Dst) {
+			results[i].Err = errors.New("Renaming directories is not supported")
+			continue
+		}
+
+		if check != nil {
+			if err := check(p.Dst); err != nil {
+				results[i].Err = err
+			}
+		}
+	}
+
+	// Find the current generation of each source. Each goroutine writes only
+	// to the entries for the indices it receives.
+	srcs := make([]*gcs.Object, len(pairs))
+	err := forEachParallel(ctx, len(pairs), func(ctx context.Context, i int) {
+		r := &results[i]
+		if r.Err != errRenameNotAttempted {
+			return
+		}
+
+		o, err := bucket.StatObject(ctx, &gcs.StatObjectRequest{Name: r.Src})
+		if err != nil {
+			r.Err = fmt.Errorf("StatObject: %w", err)
+			return
+		}
+
+		srcs[i] = o
+	})
+
+	if err != nil {
+		return
+	}
+
+	// Journal the renames we're about to make.
+	var entries []journalEntry
+	for i, o := range srcs {
+		if o != nil {
+			entries = append(entries, journalEntry{
+				Src:               o.Name,
+				SrcGeneration:     o.Generation,
+				SrcMetaGeneration: o.MetaGeneration,
+				Dst:               pairs[i].Dst,
+			})
+		}
+	}
+
+	journal, err := writeJournal(ctx, bucket, journalPrefix, entries)
+	if err != nil {
+		err = fmt.Errorf("writeJournal: %w", err)
+		for i := range srcs {
+			if srcs[i] != nil {
+				results[i].Err = err
+			}
+		}
+
+		return
+	}
+
+	// Carry them out.
+	err = forEachParallel(ctx, len(pairs), func(ctx context.Context, i int) {
+		if srcs[i] != nil {
+			results[i].Err = moveObject(ctx, bucket, srcs[i], pairs[i].Dst)
+			if progress != nil {
+				progress()
+			}
+		}
+	})
+
+	// If we were cancelled part way through, leave the journal for recovery.
+	if err != nil {
+		return
+	}
+
+	clearJournal(ctx, bucket, journal)
+	return
+}
+
+// Produce the contents of the result object for a batch rename: a summary line
+// followed by a line for each failure, in manifest order, with the source,
+// destination, and error separated by tabs.
+func formatRenameResults(
+	results []renameResult,
+	elapsed time.Duration) []byte {
+	var failures []renameResult
+	for _, r := range results {
+		if r.Err != nil {
+			failures = append(failures, r)
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(
+		&buf,
+		"Renamed %d of %d objects in %v; %d failed.\n",
+		len(results)-len(failures),
+		len(results),
+		elapsed,
+		len(failures))
+
+	for _, r := range failures {
+		fmt.Fprintf(&buf, "%s\t%s\t%v\n", r.Src, r.Dst, r.Err)
+	}
+
+	return buf.Bytes()
+}
+
+// Write the supplied contents to the result object for the manifest with the
+// given name.
+func (fs *fileSystem) writeRenameResult(
+	ctx context.Context,
+	manifestName string,
+	contents []byte) (err error) {
+	_, err = fs.bucket.CreateObject(
+		ctx,
+		&gcs.CreateObjectRequest{
+			Name:     manifestName + batchRenameResultSuffix,
+			Contents: bytes.NewReader(contents),
+		})
+
+	if err != nil {
+		err = fmt.Errorf("CreateObject: %w", err)
+		return
+	}
+
+	return
+}
+
+// Carry out the batch rename described by the contents of the supplied
+// manifest object, writing a summary to the result object. While the renames
+// are under way the result object instead says how many have been attempted,
+// updated every batchRenameProgressInterval.
+func (fs *fileSystem) runBatchRename(
+	ctx context.Context,
+	manifest *gcs.Object) (err error) {
+	fs.batchRenameMu.Lock()
+	defer fs.batchRenameMu.Unlock()
+
+	startTime := time.Now()
+	var contents []byte
+
+	// Read the generation of the manifest that was just written.
+	rc, err := fs.bucket.NewReader(
+		ctx,
+		&gcs.ReadObjectRequest{
+			Name:       manifest.Name,
+			Generation: manifest.Generation,
+		})
+
+	if err != nil {
+		err = fmt.Errorf("NewReader: %w", err)
+		return
+	}
+
+	pairs, err := parseRenameManifest(rc)
+	rc.Close()
+
+	// A malformed manifest is reported in the result object, not logged.
+	if err != nil {
+		contents = []byte(fmt.Sprintf("Invalid manifest: %v\n", err))
+		err = fs.writeRenameResult(ctx, manifest.Name, contents)
+		return
+	}
+
+	// Replace any result left by an earlier batch, so that nobody mistakes it
+	// for the result of this one.
+	progressLine := func(done int64) []byte {
+		return []byte(fmt.Sprintf(
+			"Renaming %d objects; %d done so far.\n",
+			len(pairs),
+			done))
+	}
+
+	err = fs.writeRenameResult(ctx, manifest.Name, progressLine(0))
+	if err != nil {
+		return
+	}
+
+	// Report progress periodically until the batch is done.
+	var done int64
+	stopProgress := make(chan struct{})
+	progressDone := make(chan struct{})
+	go func() {
+		defer close(progressDone)
+
+		ticker := time.NewTicker(batchRenameProgressInterval)
+		defer ticker.Stop()
+
+		var reported int64
+		for {
+			select {
+			case <-stopProgress:
+				return
+
+			case <-ticker.C:
+				n := atomic.LoadInt64(&done)
+				if n == reported {
+					continue
+				}
+
+				reported = n
+				if err := fs.writeRenameResult(
+					ctx,
+					manifest.Name,
+					progressLine(n)); err != nil {
+					log.Printf("Reporting batch rename progress: %v", err)
+				}
+			}
+		}
+	}()
+
+	// Report policy violations in full, rather than as EPERM.
+	var check func(string) error
+	if fs.uploadPolicy != nil {
+		check = fs.uploadPolicy.CheckName
+	}
+
+	log.Printf("Starting a batch rename of %d objects.", len(pairs))
+	results := batchRename(
+		ctx,
+		fs.bucket,
+		fs.journalPrefix,
+		pairs,
+		check,
+		func() { atomic.AddInt64(&done, 1) })
+
+	close(stopProgress)
+	<-progressDone
+
+	contents = formatRenameResults(results, time.Since(startTime))
+	log.Printf("Batch rename finished in %v.", time.Since(startTime))
+
+	// Write out the result.
+	err = fs.writeRenameResult(ctx, manifest.Name, contents)
+	return
+}
+
+// Sync the supplied file inode. If it is the batch rename manifest and syncing
+// it produced a new generation, start the batch rename it describes in the
+// background, so that the flush or close that wrote the manifest returns
+// before the renames are done. Checking for a new generation means that merely
+// opening and closing the manifest, or closing a second descriptor for it,
+// doesn't repeat the batch.
+//
+// LOCKS_REQUIRED(in)
+func (fs *fileSystem) syncFileAndMaybeRename(
+	ctx context.Context,
+	in *inode.FileInode) (err error) {
+	oldGen := in.SourceGeneration()
+
+	err = fs.syncFile(ctx, in)
+	if err != nil {
+		return
+	}
+
+	if fs.batchRenameManifest == "" ||
+		in.Name() != fs.batchRenameManifest ||
+		in.SourceGeneration() == oldGen {
+		return
+	}
+
+	fs.mu.Lock()
+	fs.batchRenamesInProgress++
+	fs.mu.Unlock()
+
+	// Don't tie the batch to the operation that happened to flush the
+	// manifest; it is abandoned only when the file system is unmounted.
+	manifest := in.Source()
+	go func() {
+		if err := fs.runBatchRename(fs.backgroundCtx, manifest); err != nil {
+			log.Printf("Batch rename of %q: %v", manifest.Name, err)
+		}
+
+		fs.mu.Lock()
+		fs.batchRenamesInProgress--
+		fs.mu.Unlock()
+	}()
+
+	return
+}
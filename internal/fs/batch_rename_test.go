@@ -0,0 +1,177 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Tests for renaming objects in bulk by writing a manifest file.
+
+package fs_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const batchRenameManifest = ".rename_manifest"
+
+type BatchRenameTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&BatchRenameTest{}) }
+
+func (t *BatchRenameTest) SetUp(ti *TestInfo) {
+	t.serverCfg.BatchRenameManifest = batchRenameManifest
+	t.fsTest.SetUp(ti)
+}
+
+// Write the supplied manifest through the file system, closing the file, and
+// return the contents of the result file once the batch it starts, which runs
+// in the background, has finished.
+func (t *BatchRenameTest) runManifest(contents string) string {
+	p := path.Join(t.mfs.Dir(), batchRenameManifest)
+	err := ioutil.WriteFile(p, []byte(contents), 0600)
+	AssertEq(nil, err)
+
+	// Read the result from the bucket, so as not to see a stale version cached
+	// by the file system.
+	var result []byte
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		result, err = gcsutil.ReadObject(
+			t.ctx,
+			t.bucket,
+			batchRenameManifest+".result")
+
+		if err == nil &&
+			(bytes.HasPrefix(result, []byte("Renamed")) ||
+				bytes.HasPrefix(result, []byte("Invalid manifest"))) {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	AssertEq(nil, err)
+	return string(result)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *BatchRenameTest) RenamesObjects() {
+	const n = 200
+
+	// Set up contents, and a manifest moving them all into a directory.
+	objects := map[string]string{"dir/": ""}
+	var manifest []string
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("foo %d", i)
+		objects[name] = name
+		manifest = append(manifest, fmt.Sprintf("%s\tdir/%s", name, name))
+	}
+
+	AssertEq(nil, t.createObjects(objects))
+
+	// Run it.
+	result := t.runManifest(
+		"# A comment.\n\n" + strings.Join(manifest, "\n") + "\n")
+
+	ExpectThat(result, HasSubstr(fmt.Sprintf("Renamed %d of %d objects", n, n)))
+	ExpectThat(result, HasSubstr("0 failed"))
+
+	// The objects should have moved, and be visible through the file system.
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("foo %d", i)
+
+		_, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: name})
+		ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+		contents, err := ioutil.ReadFile(path.Join(t.mfs.Dir(), "dir", name))
+		AssertEq(nil, err)
+		ExpectEq(name, string(contents))
+	}
+}
+
+func (t *BatchRenameTest) ReportsFailures() {
+	AssertEq(nil, t.createWithContents("foo", "taco"))
+
+	result := t.runManifest("foo\tbar\nmissing\tbaz\nqux/\tnorf/\n")
+
+	ExpectThat(result, HasSubstr("Renamed 1 of 3 objects"))
+	ExpectThat(result, HasSubstr("2 failed"))
+	ExpectThat(result, HasSubstr("missing\tbaz\tStatObject"))
+	ExpectThat(result, HasSubstr("qux/\tnorf/\tRenaming directories"))
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "bar")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *BatchRenameTest) InvalidManifest() {
+	AssertEq(nil, t.createWithContents("foo", "taco"))
+
+	result := t.runManifest("foo bar\n")
+
+	ExpectThat(result, HasSubstr("Invalid manifest"))
+	ExpectThat(result, HasSubstr("Line 1"))
+
+	_, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	ExpectEq(nil, err)
+}
+
+func (t *BatchRenameTest) ReopeningDoesNotRepeat() {
+	AssertEq(nil, t.createWithContents("foo", "taco"))
+
+	result := t.runManifest("foo\tbar\n")
+	AssertThat(result, HasSubstr("Renamed 1 of 1 objects"))
+
+	// Opening and closing the manifest again without modifying it should not
+	// cause the (now failing) rename to be attempted again.
+	p := path.Join(t.mfs.Dir(), batchRenameManifest)
+	f, err := os.OpenFile(p, os.O_RDWR, 0)
+	AssertEq(nil, err)
+	AssertEq(nil, f.Close())
+
+	contents, err := ioutil.ReadFile(p + ".result")
+	AssertEq(nil, err)
+	ExpectEq(result, string(contents))
+}
+
+func (t *BatchRenameTest) OtherFilesAreUnaffected() {
+	AssertEq(nil, t.createWithContents("foo", "taco"))
+
+	p := path.Join(t.mfs.Dir(), "not_the_manifest")
+	err := ioutil.WriteFile(p, []byte("foo\tbar\n"), 0600)
+	AssertEq(nil, err)
+
+	_, err = os.Stat(p + ".result")
+	ExpectTrue(os.IsNotExist(err), "err: %v", err)
+
+	_, err = gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	ExpectEq(nil, err)
+}
@@ -0,0 +1,151 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseops"
+	"golang.org/x/net/context"
+)
+
+// BucketAccess describes what the credentials used by the file system may do
+// to objects in the bucket.
+type BucketAccess struct {
+	// Objects may be read (storage.objects.get).
+	Read bool
+
+	// Objects may be listed (storage.objects.list).
+	List bool
+
+	// Objects may be created and deleted (storage.objects.create and
+	// storage.objects.delete).
+	Write bool
+}
+
+// BucketAccessFunc finds out the current BucketAccess, e.g. by asking GCS.
+type BucketAccessFunc func(ctx context.Context) (a BucketAccess, err error)
+
+// Keeps track of the BucketAccess of the file system, and removes permission
+// bits from attributes to match, so that the kernel's permission checks (e.g.
+// for access(2)) agree with what GCS would allow.
+type accessTracker struct {
+	/////////////////////////
+	// Dependencies
+	/////////////////////////
+
+	fetch BucketAccessFunc
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// The access last fetched successfully.
+	//
+	// GUARDED_BY(mu)
+	access BucketAccess
+}
+
+// Create a tracker that assumes full access until it is refreshed.
+func newAccessTracker(fetch BucketAccessFunc) (t *accessTracker) {
+	t = &accessTracker{
+		fetch: fetch,
+		access: BucketAccess{
+			Read:  true,
+			List:  true,
+			Write: true,
+		},
+	}
+
+	return
+}
+
+// Fetch the current access, keeping the last known one on failure.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *accessTracker) refresh(ctx context.Context) {
+	a, err := t.fetch(ctx)
+	if err != nil {
+		log.Printf("Checking bucket access: %v", err)
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if a != t.access {
+		log.Printf("Bucket access is now %+v", a)
+	}
+
+	t.access = a
+}
+
+// Refresh the access every interval, until the context is cancelled.
+func (t *accessTracker) refreshPeriodically(
+	ctx context.Context,
+	interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			t.refresh(ctx)
+		}
+	}
+}
+
+// Clear the permission bits of the supplied attributes that the current
+// access doesn't back up. Files need Read to be readable or executable and
+// directories need List to be readable; both need Write to be writable.
+// Symlinks are left alone.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *accessTracker) mask(attr *fuseops.InodeAttributes) {
+	t.mu.Lock()
+	a := t.access
+	t.mu.Unlock()
+
+	var bits os.FileMode
+	switch {
+	case attr.Mode&os.ModeSymlink != 0:
+		return
+
+	case attr.Mode.IsDir():
+		if !a.List {
+			bits |= 0444
+		}
+
+	default:
+		// A file that can't be read can't be executed either.
+		if !a.Read {
+			bits |= 0555
+		}
+	}
+
+	if !a.Write {
+		bits |= 0222
+	}
+
+	attr.Mode &^= bits
+}
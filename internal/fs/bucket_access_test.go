@@ -0,0 +1,156 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"errors"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A test mounting with a fixed result for the bucket access check, and a file
+// and a directory in the bucket.
+type bucketAccessTest struct {
+	fsTest
+
+	access fs.BucketAccess
+	err    error
+}
+
+func (t *bucketAccessTest) SetUp(ti *TestInfo) {
+	t.serverCfg.BucketAccess = func(
+		ctx context.Context) (a fs.BucketAccess, err error) {
+		a, err = t.access, t.err
+		return
+	}
+
+	t.serverCfg.BucketAccessInterval = time.Hour
+	t.fsTest.SetUp(ti)
+
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "dir/", []byte{})
+	AssertEq(nil, err)
+}
+
+// Return the permission bits of the named file or directory.
+func (t *bucketAccessTest) perms(name string) os.FileMode {
+	fi, err := os.Stat(path.Join(t.Dir, name))
+	AssertEq(nil, err)
+
+	return fi.Mode().Perm()
+}
+
+////////////////////////////////////////////////////////////////////////
+// Full access
+////////////////////////////////////////////////////////////////////////
+
+type FullBucketAccessTest struct {
+	bucketAccessTest
+}
+
+func init() { RegisterTestSuite(&FullBucketAccessTest{}) }
+
+func (t *FullBucketAccessTest) SetUp(ti *TestInfo) {
+	t.access = fs.BucketAccess{Read: true, List: true, Write: true}
+	t.bucketAccessTest.SetUp(ti)
+}
+
+func (t *FullBucketAccessTest) PermsUnchanged() {
+	ExpectEq(filePerms, t.perms("foo"))
+	ExpectEq(dirPerms, t.perms("dir"))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Read-only access
+////////////////////////////////////////////////////////////////////////
+
+type ReadOnlyBucketAccessTest struct {
+	bucketAccessTest
+}
+
+func init() { RegisterTestSuite(&ReadOnlyBucketAccessTest{}) }
+
+func (t *ReadOnlyBucketAccessTest) SetUp(ti *TestInfo) {
+	t.access = fs.BucketAccess{Read: true, List: true}
+	t.bucketAccessTest.SetUp(ti)
+}
+
+func (t *ReadOnlyBucketAccessTest) WriteBitsCleared() {
+	ExpectEq(0540, t.perms("foo"))
+	ExpectEq(0554, t.perms("dir"))
+}
+
+func (t *ReadOnlyBucketAccessTest) Access() {
+	ExpectEq(nil, syscall.Access(path.Join(t.Dir, "foo"), 4)) // R_OK
+
+	// The superuser may write regardless of permission bits.
+	if os.Getuid() != 0 {
+		ExpectEq(syscall.EACCES, syscall.Access(path.Join(t.Dir, "foo"), 2)) // W_OK
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// List-only access
+////////////////////////////////////////////////////////////////////////
+
+type ListOnlyBucketAccessTest struct {
+	bucketAccessTest
+}
+
+func init() { RegisterTestSuite(&ListOnlyBucketAccessTest{}) }
+
+func (t *ListOnlyBucketAccessTest) SetUp(ti *TestInfo) {
+	t.access = fs.BucketAccess{List: true}
+	t.bucketAccessTest.SetUp(ti)
+}
+
+func (t *ListOnlyBucketAccessTest) FilesUnreadable() {
+	ExpectEq(0000, t.perms("foo"))
+	ExpectEq(0554, t.perms("dir"))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Failed check
+////////////////////////////////////////////////////////////////////////
+
+type FailedBucketAccessTest struct {
+	bucketAccessTest
+}
+
+func init() { RegisterTestSuite(&FailedBucketAccessTest{}) }
+
+func (t *FailedBucketAccessTest) SetUp(ti *TestInfo) {
+	t.err = errors.New("taco")
+	t.bucketAccessTest.SetUp(ti)
+}
+
+func (t *FailedBucketAccessTest) PermsUnchanged() {
+	// Nothing is known, so nothing is taken away.
+	ExpectEq(filePerms, t.perms("foo"))
+	ExpectEq(dirPerms, t.perms("dir"))
+}
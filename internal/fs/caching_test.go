@@ -20,12 +20,12 @@ import (
 	"path"
 	"time"
 
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fusetesting"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcscaching"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
 	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
-	"github.com/jacobsa/fuse/fusetesting"
-	"github.com/jacobsa/gcloud/gcs"
-	"github.com/jacobsa/gcloud/gcs/gcscaching"
-	"github.com/jacobsa/gcloud/gcs/gcsfake"
-	"github.com/jacobsa/gcloud/gcs/gcsutil"
 	. "github.com/jacobsa/oglematchers"
 	. "github.com/jacobsa/ogletest"
 	"github.com/jacobsa/timeutil"
@@ -162,6 +162,76 @@ func (t *CachingTest) FileChangedRemotely() {
 	ExpectEq("burrito", string(b))
 }
 
+func (t *CachingTest) ReadYourWrites_AcrossHandles() {
+	const name = "foo"
+	var err error
+
+	// Create a file via the file system, and stat and list it so that its
+	// original generation is in every cache.
+	err = ioutil.WriteFile(path.Join(t.Dir, name), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	_, err = os.Stat(path.Join(t.Dir, name))
+	AssertEq(nil, err)
+
+	_, err = fusetesting.ReadDirPicky(t.Dir)
+	AssertEq(nil, err)
+
+	// Overwrite it via one handle.
+	f, err := os.OpenFile(path.Join(t.Dir, name), os.O_WRONLY|os.O_TRUNC, 0)
+	AssertEq(nil, err)
+
+	_, err = f.Write([]byte("burrito"))
+	AssertEq(nil, err)
+
+	err = f.Close()
+	AssertEq(nil, err)
+
+	// Without the TTL having elapsed, a new handle should see the new contents,
+	// as should stat and a listing.
+	b, err := ioutil.ReadFile(path.Join(t.Dir, name))
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(b))
+
+	fi, err := os.Stat(path.Join(t.Dir, name))
+	AssertEq(nil, err)
+	ExpectEq(len("burrito"), fi.Size())
+
+	entries, err := fusetesting.ReadDirPicky(t.Dir)
+	AssertEq(nil, err)
+	AssertEq(1, len(entries))
+	ExpectEq(len("burrito"), entries[0].Size())
+}
+
+func (t *CachingTest) ReadYourWrites_Append() {
+	const name = "foo"
+	var err error
+
+	// Create a file via the file system.
+	err = ioutil.WriteFile(path.Join(t.Dir, name), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	// Append to it via one handle.
+	f, err := os.OpenFile(path.Join(t.Dir, name), os.O_WRONLY|os.O_APPEND, 0)
+	AssertEq(nil, err)
+
+	_, err = f.Write([]byte("burrito"))
+	AssertEq(nil, err)
+
+	err = f.Close()
+	AssertEq(nil, err)
+
+	// A new handle should see the new contents.
+	b, err := ioutil.ReadFile(path.Join(t.Dir, name))
+	AssertEq(nil, err)
+	ExpectEq("tacoburrito", string(b))
+
+	// So should the bucket, without going through the cache.
+	b, err = gcsutil.ReadObject(t.ctx, t.uncachedBucket, name)
+	AssertEq(nil, err)
+	ExpectEq("tacoburrito", string(b))
+}
+
 func (t *CachingTest) DirectoryRemovedRemotely() {
 	const name = "foo"
 	var fi os.FileInfo
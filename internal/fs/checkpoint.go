@@ -0,0 +1,158 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseops"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"golang.org/x/net/context"
+)
+
+// CheckpointConfig configures the file system for the checkpoints written by
+// machine learning frameworks: a directory of large files, each written once,
+// followed by a small marker file whose presence says that the checkpoint is
+// complete.
+//
+// With a checkpoint configuration, syncs also fail if the checksums of the
+// uploaded contents don't match those GCS reports for the new object, so that
+// a successful fsync means that the data is in GCS intact.
+type CheckpointConfig struct {
+	// The names, without directories, of the files that mark a checkpoint
+	// complete, e.g. "commit_success.txt". Before a marker is created, renamed
+	// into place, or synced, every other file beneath its directory with
+	// unsynced data is synced, concurrently, so that whoever sees the marker
+	// sees the whole checkpoint. Markers are synced as soon as they are
+	// flushed, regardless of ServerConfig.SyncDelay.
+	Markers []string
+
+	// If UploadParts is greater than one, files of at least
+	// ParallelUploadThreshold bytes that must be uploaded in full are split
+	// into up to UploadParts parts, which are uploaded in parallel and then
+	// composed. See gcsx.NewParallelSyncer.
+	ParallelUploadThreshold int64
+	UploadParts             int
+}
+
+// Return true if the supplied object name is that of a checkpoint marker.
+func (fs *fileSystem) isCheckpointMarker(name string) bool {
+	if fs.checkpoints == nil {
+		return false
+	}
+
+	base := path.Base(name)
+	for _, m := range fs.checkpoints.Markers {
+		if base == m {
+			return true
+		}
+	}
+
+	return false
+}
+
+// If the supplied object name is that of a checkpoint marker, sync every file
+// beneath the marker's directory that has unsynced data, other than the
+// inode with the given ID. Files whose contents are being streamed can't be
+// synced until their writers close them, and are skipped with a warning.
+//
+// LOCKS_EXCLUDED(fs.mu)
+// LOCKS_EXCLUDED(all file inodes beneath the marker's directory)
+func (fs *fileSystem) syncCheckpointBeforeMarker(
+	ctx context.Context,
+	marker string,
+	except fuseops.InodeID) (err error) {
+	if !fs.isCheckpointMarker(marker) {
+		return
+	}
+
+	dir := marker[:strings.LastIndex(marker, "/")+1]
+
+	// Find the dirty files.
+	var files []*inode.FileInode
+	fs.mu.Lock()
+	for _, in := range fs.inodes {
+		f, ok := in.(*inode.FileInode)
+		if !ok || f.ID() == except || !strings.HasPrefix(f.Name(), dir) {
+			continue
+		}
+
+		ls := f.LocalState()
+		if ls.Streaming {
+			log.Printf(
+				"Checkpoint marker %q: %q is still being written",
+				marker,
+				f.Name())
+
+			continue
+		}
+
+		if ls.Dirty {
+			files = append(files, f)
+		}
+	}
+	fs.mu.Unlock()
+
+	// Sync them, keeping the first error.
+	var mu sync.Mutex
+	var syncErr error
+	err = forEachParallel(ctx, len(files), func(ctx context.Context, i int) {
+		f := files[i]
+		f.Lock()
+		err := fs.syncFileAndMaybeRename(ctx, f)
+		f.Unlock()
+
+		if err != nil {
+			mu.Lock()
+			if syncErr == nil {
+				syncErr = fmt.Errorf("syncing %q: %w", f.Name(), err)
+			}
+			mu.Unlock()
+		}
+	})
+
+	if err != nil {
+		return
+	}
+
+	err = syncErr
+	return
+}
+
+// Return an error if the file system is configured for checkpoints and the
+// checksums of the supplied inode's just-synced contents don't match those
+// GCS reports.
+//
+// LOCKS_REQUIRED(f)
+func (fs *fileSystem) checkSyncedChecksums(f *inode.FileInode) (err error) {
+	if fs.checkpoints == nil {
+		return
+	}
+
+	if cs := f.Checksums(); cs != nil && !cs.Matched {
+		err = fmt.Errorf(
+			"checksums of %q don't match GCS's after upload: %v",
+			f.Name(),
+			cs)
+
+		return
+	}
+
+	return
+}
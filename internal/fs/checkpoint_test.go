@@ -0,0 +1,110 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	. "github.com/jacobsa/ogletest"
+)
+
+type CheckpointTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&CheckpointTest{}) }
+
+func (t *CheckpointTest) SetUp(ti *TestInfo) {
+	t.serverCfg.Checkpoints = &fs.CheckpointConfig{
+		Markers: []string{"commit_success.txt"},
+	}
+
+	// Long enough that only markers can cause the syncs the tests see.
+	t.serverCfg.SyncDelay = time.Hour
+	t.fsTest.SetUp(ti)
+
+	err := os.MkdirAll(path.Join(t.Dir, "ckpt", "shards"), 0700)
+	AssertEq(nil, err)
+}
+
+func (t *CheckpointTest) objectContents(name string) string {
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, name)
+	if err != nil {
+		return ""
+	}
+
+	return string(contents)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *CheckpointTest) FilesWaitForSyncDelay() {
+	err := ioutil.WriteFile(path.Join(t.Dir, "ckpt", "a"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	ExpectEq("", t.objectContents("ckpt/a"))
+}
+
+func (t *CheckpointTest) MarkerCreatedAfterCheckpoint() {
+	err := ioutil.WriteFile(path.Join(t.Dir, "ckpt", "a"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = ioutil.WriteFile(
+		path.Join(t.Dir, "ckpt", "shards", "b"),
+		[]byte("burrito"),
+		0600)
+
+	AssertEq(nil, err)
+
+	err = ioutil.WriteFile(path.Join(t.Dir, "other"), []byte("queso"), 0600)
+	AssertEq(nil, err)
+
+	// Writing the marker syncs everything beneath its directory first, and
+	// the marker itself despite the delay.
+	err = ioutil.WriteFile(
+		path.Join(t.Dir, "ckpt", "commit_success.txt"),
+		[]byte("done"),
+		0600)
+
+	AssertEq(nil, err)
+
+	ExpectEq("taco", t.objectContents("ckpt/a"))
+	ExpectEq("burrito", t.objectContents("ckpt/shards/b"))
+	ExpectEq("done", t.objectContents("ckpt/commit_success.txt"))
+	ExpectEq("", t.objectContents("other"))
+}
+
+func (t *CheckpointTest) MarkerRenamedIntoPlace() {
+	err := ioutil.WriteFile(path.Join(t.Dir, "ckpt", "a"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "ckpt/marker.tmp", []byte{})
+	AssertEq(nil, err)
+
+	err = os.Rename(
+		path.Join(t.Dir, "ckpt", "marker.tmp"),
+		path.Join(t.Dir, "ckpt", "commit_success.txt"))
+
+	AssertEq(nil, err)
+
+	ExpectEq("taco", t.objectContents("ckpt/a"))
+}
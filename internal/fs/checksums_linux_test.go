@@ -0,0 +1,96 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Tests for reporting checksums through extended attributes. These use
+// syscall.Getxattr, which is available only on Linux.
+
+package fs_test
+
+import (
+	"io/ioutil"
+	"path"
+	"syscall"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const checksumsXattr = "user.gcs.verified"
+
+type ChecksumsTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&ChecksumsTest{}) }
+
+// Return the value of the checksums xattr for the named file.
+func (t *ChecksumsTest) getXattr(name string) (v string, err error) {
+	p := path.Join(t.mfs.Dir(), name)
+
+	buf := make([]byte, 256)
+	n, err := syscall.Getxattr(p, checksumsXattr, buf)
+	if err != nil {
+		return
+	}
+
+	v = string(buf[:n])
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ChecksumsTest) NotReadYet() {
+	AssertEq(nil, t.createWithContents("foo", "taco"))
+
+	_, err := t.getXattr("foo")
+	ExpectEq(syscall.ENODATA, err)
+}
+
+func (t *ChecksumsTest) AfterReading() {
+	AssertEq(nil, t.createWithContents("foo", "taco"))
+
+	contents, err := ioutil.ReadFile(path.Join(t.mfs.Dir(), "foo"))
+	AssertEq(nil, err)
+	AssertEq("taco", string(contents))
+
+	v, err := t.getXattr("foo")
+	AssertEq(nil, err)
+	ExpectThat(v, HasSubstr("crc32c="))
+	ExpectThat(v, HasSubstr("matched=true"))
+}
+
+func (t *ChecksumsTest) AfterWriting() {
+	// Overwrite an existing object, so that the sync rewrites it in full rather
+	// than appending to it.
+	AssertEq(nil, t.createWithContents("foo", "taco"))
+
+	p := path.Join(t.mfs.Dir(), "foo")
+	err := ioutil.WriteFile(p, []byte("burrito"), 0600)
+	AssertEq(nil, err)
+
+	v, err := t.getXattr("foo")
+	AssertEq(nil, err)
+	ExpectThat(v, HasSubstr("matched=true"))
+}
+
+func (t *ChecksumsTest) Directory() {
+	_, err := t.getXattr("")
+	ExpectEq(syscall.ENODATA, err)
+}
@@ -0,0 +1,32 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import "time"
+
+// AfterFunc arranges for f to be called in its own goroutine once d has
+// passed, like time.AfterFunc, and returns a function that cancels the call
+// if it hasn't happened yet, reporting whether it did so.
+//
+// The file system uses one to schedule work for later, such as delayed syncs.
+// Tests can supply one driven by a simulated clock, so that they decide when
+// the work happens rather than waiting for it.
+type AfterFunc func(d time.Duration, f func()) (stop func() bool)
+
+// An AfterFunc using the wall clock.
+func realAfterFunc(d time.Duration, f func()) (stop func() bool) {
+	stop = time.AfterFunc(d, f).Stop
+	return
+}
@@ -0,0 +1,130 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A call scheduled with SimulatedTimeTest.afterFunc.
+type scheduledCall struct {
+	d       time.Duration
+	f       func()
+	stopped bool
+}
+
+type SimulatedTimeTest struct {
+	fsTest
+	simulatedClock timeutil.SimulatedClock
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	scheduled []*scheduledCall
+}
+
+func init() { RegisterTestSuite(&SimulatedTimeTest{}) }
+
+func (t *SimulatedTimeTest) SetUp(ti *TestInfo) {
+	t.simulatedClock.SetTime(time.Date(2012, 8, 15, 22, 56, 0, 0, time.Local))
+	t.serverCfg.MtimeClock = &t.simulatedClock
+	t.serverCfg.AfterFunc = t.afterFunc
+	t.serverCfg.SyncDelay = time.Hour
+	t.fsTest.SetUp(ti)
+}
+
+// Record the call rather than scheduling it, for the test to make.
+func (t *SimulatedTimeTest) afterFunc(
+	d time.Duration,
+	f func()) (stop func() bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c := &scheduledCall{d: d, f: f}
+	t.scheduled = append(t.scheduled, c)
+
+	stop = func() bool {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		wasPending := !c.stopped
+		c.stopped = true
+		return wasPending
+	}
+
+	return
+}
+
+// Make each scheduled call that hasn't been stopped, as if its time had come.
+func (t *SimulatedTimeTest) fireAll() {
+	t.mu.Lock()
+	var pending []*scheduledCall
+	for _, c := range t.scheduled {
+		if !c.stopped {
+			c.stopped = true
+			pending = append(pending, c)
+		}
+	}
+
+	t.mu.Unlock()
+
+	for _, c := range pending {
+		c.f()
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *SimulatedTimeTest) RootTimesFromClock() {
+	fi, err := os.Stat(t.Dir)
+	AssertEq(nil, err)
+	ExpectThat(fi.ModTime(), timeutil.TimeEq(t.simulatedClock.Now()))
+}
+
+func (t *SimulatedTimeTest) DelayedSyncScheduled() {
+	err := ioutil.WriteFile(path.Join(t.Dir, "foo"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	t.mu.Lock()
+	AssertThat(len(t.scheduled), GreaterThan(0))
+	ExpectEq(time.Hour, t.scheduled[len(t.scheduled)-1].d)
+	t.mu.Unlock()
+
+	// Nothing is synced until the test says the delay has passed.
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("", string(contents))
+
+	t.fireAll()
+
+	contents, err = gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
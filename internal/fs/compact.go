@@ -0,0 +1,168 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/syncutil"
+)
+
+// Objects updated more recently than this are assumed to be in active use,
+// e.g. still being appended to, and are left alone by the compactor.
+const compactionQuietPeriod = 10 * time.Minute
+
+// Rewrite each object in the bucket with at least threshold components that
+// has been left alone for the quiet period as a single-component object.
+// Failures for individual objects are logged and skipped.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) compactOnce(
+	ctx context.Context,
+	threshold int64) (objectsCompacted uint64, err error) {
+	b := syncutil.NewBundle(ctx)
+
+	// List all objects.
+	objects := make(chan *gcs.Object, 100)
+	b.Add(func(ctx context.Context) (err error) {
+		defer close(objects)
+		err = gcsutil.ListPrefix(ctx, fs.bucket, "", objects)
+		if err != nil {
+			err = fmt.Errorf("ListPrefix: %v", err)
+			return
+		}
+
+		return
+	})
+
+	// Compact those that qualify.
+	now := time.Now()
+	b.Add(func(ctx context.Context) (err error) {
+		for o := range objects {
+			if o.ComponentCount < threshold ||
+				now.Sub(o.Updated) < compactionQuietPeriod {
+				continue
+			}
+
+			compacted, compactErr := fs.compactObject(ctx, o)
+			if compactErr != nil {
+				log.Printf("Compacting %q: %v", o.Name, compactErr)
+				continue
+			}
+
+			if compacted {
+				objectsCompacted++
+			}
+		}
+
+		return
+	})
+
+	err = b.Join()
+	return
+}
+
+// Compact the supplied generation of an object, unless it has since changed
+// or is open in this file system. If there is an inode for it, go through the
+// inode so that it knows about the new generation.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) compactObject(
+	ctx context.Context,
+	o *gcs.Object) (compacted bool, err error) {
+	fs.mu.Lock()
+	in, _ := fs.generationBackedInodes[o.Name].(*inode.FileInode)
+	busy := in != nil && fs.hasFileHandles(in.ID())
+	fs.mu.Unlock()
+
+	if busy {
+		return
+	}
+
+	var newObj *gcs.Object
+	if in != nil {
+		in.Lock()
+		compacted, err = in.Compact(ctx, o.Generation)
+		if compacted {
+			newObj = in.Source()
+		}
+		in.Unlock()
+	} else {
+		newObj, err = gcsx.CompactObject(ctx, fs.bucket, o)
+		compacted = err == nil
+	}
+
+	// Special case: the object changed under us, so is no longer idle.
+	if _, ok := err.(*gcs.PreconditionError); ok {
+		err = nil
+		return
+	}
+
+	if err != nil {
+		return
+	}
+
+	if compacted {
+		fs.recordUpload(newObj)
+	}
+
+	return
+}
+
+// Periodically compact heavily composed objects until the context is
+// cancelled. The first pass happens one period after mounting.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) compactPeriodically(
+	ctx context.Context,
+	threshold int64) {
+	const period = 10 * time.Minute
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+		}
+
+		startTime := time.Now()
+		objectsCompacted, err := fs.compactOnce(ctx, threshold)
+
+		if err != nil {
+			log.Printf(
+				"Compaction failed after compacting %d objects in %v, "+
+					"with error: %v",
+				objectsCompacted,
+				time.Since(startTime),
+				err)
+		} else if objectsCompacted > 0 {
+			log.Printf(
+				"Compacted %d objects in %v.",
+				objectsCompacted,
+				time.Since(startTime))
+		}
+	}
+}
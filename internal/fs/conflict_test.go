@@ -0,0 +1,130 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"os"
+	"path"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A test with a file foo open for writing and dirty, whose object has since
+// been replaced by another writer.
+type conflictTest struct {
+	fsTest
+
+	// The generation the local modifications are based on.
+	original *gcs.Object
+}
+
+func (t *conflictTest) SetUp(ti *TestInfo) {
+	var err error
+
+	// Make sure that our write reaches the file system before the object is
+	// replaced.
+	t.disableWritebackCaching()
+
+	t.fsTest.SetUp(ti)
+
+	t.original, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	t.f1, err = os.OpenFile(path.Join(t.Dir, "foo"), os.O_RDWR, 0)
+	AssertEq(nil, err)
+
+	_, err = t.f1.WriteAt([]byte("p"), 0)
+	AssertEq(nil, err)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("burrito"))
+	AssertEq(nil, err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Fail
+////////////////////////////////////////////////////////////////////////
+
+type FailOnConflictTest struct {
+	conflictTest
+}
+
+func init() { RegisterTestSuite(&FailOnConflictTest{}) }
+
+func (t *FailOnConflictTest) SetUp(ti *TestInfo) {
+	t.serverCfg.ConflictPolicy = inode.FailOnConflict
+	t.conflictTest.SetUp(ti)
+}
+
+func (t *FailOnConflictTest) SyncFails() {
+	err := t.f1.Sync()
+	ExpectThat(err, Error(HasSubstr("stale")))
+
+	// The other writer's contents are intact.
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+
+	// Ours can still be read back.
+	buf := make([]byte, 4)
+	_, err = t.f1.ReadAt(buf, 0)
+	AssertEq(nil, err)
+	ExpectEq("paco", string(buf))
+
+	// Closing fails the same way.
+	err = t.f1.Close()
+	t.f1 = nil
+	ExpectThat(err, Error(HasSubstr("stale")))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Copy
+////////////////////////////////////////////////////////////////////////
+
+type CopyOnConflictTest struct {
+	conflictTest
+}
+
+func init() { RegisterTestSuite(&CopyOnConflictTest{}) }
+
+func (t *CopyOnConflictTest) SetUp(ti *TestInfo) {
+	t.serverCfg.ConflictPolicy = inode.CopyOnConflict
+	t.conflictTest.SetUp(ti)
+}
+
+func (t *CopyOnConflictTest) CloseWritesCopy() {
+	err := t.f1.Close()
+	t.f1 = nil
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+
+	contents, err = gcsutil.ReadObject(
+		t.ctx,
+		t.bucket,
+		inode.ConflictCopyName("foo", t.original.Generation))
+
+	AssertEq(nil, err)
+	ExpectEq("paco", string(contents))
+}
@@ -0,0 +1,133 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type CreateOnlyTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&CreateOnlyTest{}) }
+
+func (t *CreateOnlyTest) SetUp(ti *TestInfo) {
+	t.serverCfg.CreateOnly = true
+	t.fsTest.SetUp(ti)
+
+	// Create an existing object in the bucket.
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+}
+
+// Check that the existing object is untouched.
+func (t *CreateOnlyTest) expectUnmodified() {
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *CreateOnlyTest) ReadExistingFile() {
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "foo"))
+
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *CreateOnlyTest) CreateNewFile() {
+	err := ioutil.WriteFile(path.Join(t.Dir, "bar"), []byte("burrito"), 0600)
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "bar")
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+}
+
+func (t *CreateOnlyTest) ModifyNewFileAfterClosing() {
+	p := path.Join(t.Dir, "bar")
+	err := ioutil.WriteFile(p, []byte("burrito"), 0600)
+	AssertEq(nil, err)
+
+	// Once closed, the new file is immutable like any other.
+	err = ioutil.WriteFile(p, []byte("enchilada"), 0600)
+	ExpectThat(err, Error(HasSubstr("not permitted")))
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "bar")
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+}
+
+func (t *CreateOnlyTest) WriteExistingFile() {
+	_, err := os.OpenFile(path.Join(t.Dir, "foo"), os.O_WRONLY, 0)
+	ExpectThat(err, Error(HasSubstr("not permitted")))
+
+	_, err = os.OpenFile(path.Join(t.Dir, "foo"), os.O_RDWR, 0)
+	ExpectThat(err, Error(HasSubstr("not permitted")))
+
+	t.expectUnmodified()
+}
+
+func (t *CreateOnlyTest) TruncateExistingFile() {
+	err := os.Truncate(path.Join(t.Dir, "foo"), 0)
+	ExpectThat(err, Error(HasSubstr("not permitted")))
+
+	t.expectUnmodified()
+}
+
+func (t *CreateOnlyTest) ChangeMtimeOfExistingFile() {
+	mtime := time.Now().Add(-time.Hour)
+	err := os.Chtimes(path.Join(t.Dir, "foo"), mtime, mtime)
+	ExpectThat(err, Error(HasSubstr("not permitted")))
+}
+
+func (t *CreateOnlyTest) DeleteExistingFile() {
+	err := os.Remove(path.Join(t.Dir, "foo"))
+	ExpectThat(err, Error(HasSubstr("not permitted")))
+
+	t.expectUnmodified()
+}
+
+func (t *CreateOnlyTest) RenameExistingFile() {
+	err := os.Rename(path.Join(t.Dir, "foo"), path.Join(t.Dir, "bar"))
+	ExpectThat(err, Error(HasSubstr("not permitted")))
+
+	t.expectUnmodified()
+}
+
+func (t *CreateOnlyTest) CreateAndRemoveDirectory() {
+	p := path.Join(t.Dir, "dir")
+	err := os.Mkdir(p, 0700)
+	AssertEq(nil, err)
+
+	err = os.Remove(p)
+	ExpectThat(err, Error(HasSubstr("not permitted")))
+}
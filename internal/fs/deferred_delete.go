@@ -0,0 +1,43 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"log"
+	"time"
+)
+
+// With deferred deletes, unlink and rmdir succeed as soon as the object has
+// a tombstone hiding it, and the delete itself is left to the workers of a
+// gcsx.DeferredDeleteBucket, so that removing many files isn't bound by the
+// round trip latency of each. fsync on any directory waits for every delete
+// made so far, failing with EIO if any gave up, and anything pending is
+// deleted when the file system is unmounted. Pending deletes are counted in
+// the status, and a drain isn't finished until there are none.
+
+// How long to wait before retrying a failed deferred delete the first time.
+const deferredDeleteBackoff = time.Second
+
+// Wait for pending deferred deletes, logging any that fail since there's
+// nobody to return the error to.
+func (fs *fileSystem) flushDeferredDeletes() {
+	if fs.deferredDeletes == nil {
+		return
+	}
+
+	if err := fs.deferredDeletes.Flush(fs.backgroundCtx); err != nil {
+		log.Printf("Deferred deletes: %v", err)
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseops"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"golang.org/x/net/context"
+)
+
+// The prefix of the extended attributes through which directories report the
+// entries added and removed since a cursor, e.g. "user.gcsfuse.changes.17"
+// for the changes after cursor 17. See changeFeed.report for the format.
+const changesXattrPrefix = "user.gcsfuse.changes."
+
+// The most bytes of changes reported at once, comfortably within the limit
+// that Linux puts on the size of extended attribute values.
+const maxChangesSize = 60 << 10
+
+// The number of changes beyond the number of entries in the directory that a
+// change feed keeps before compacting its log.
+const changeLogSlack = 1024
+
+// An entry added to or removed from a directory.
+type dirChange struct {
+	seq   uint64
+	name  string
+	added bool
+}
+
+// The changes to the entries of a directory seen by successive listings of
+// it, numbered so that pollers can ask for those after the last they saw.
+//
+// Entries are named as in the directory, with a slash appended for
+// subdirectories.
+type changeFeed struct {
+	// The entries as of the latest listing.
+	names map[string]struct{}
+
+	// The changes that, applied in order to an empty directory, produce names,
+	// numbered consecutively from base+1 to seq. When the log grows too long it
+	// is replaced by an addition of each entry, numbered after the changes it
+	// replaces, and base is moved past them.
+	//
+	// INVARIANT: For each i, log[i].seq == base+1+i
+	// INVARIANT: seq == base+len(log)
+	base uint64
+	seq  uint64
+	log  []dirChange
+}
+
+// Create an empty change feed whose cursors start after the supplied one.
+// Starting each feed somewhere new, e.g. at the current time, stops cursors
+// from an earlier feed for the directory being mistaken for this one's.
+func newChangeFeed(start uint64) (cf *changeFeed) {
+	cf = &changeFeed{
+		names: make(map[string]struct{}),
+		base:  start,
+		seq:   start,
+	}
+
+	return
+}
+
+func (cf *changeFeed) append(name string, added bool) {
+	cf.seq++
+	cf.log = append(cf.log, dirChange{seq: cf.seq, name: name, added: added})
+}
+
+// Record the differences between the latest listing and the supplied one.
+// Removals are recorded before additions, each in the order of the entries.
+func (cf *changeFeed) update(names []string) {
+	current := make(map[string]struct{}, len(names))
+	for _, n := range names {
+		current[n] = struct{}{}
+	}
+
+	var removed []string
+	for n := range cf.names {
+		if _, ok := current[n]; !ok {
+			removed = append(removed, n)
+		}
+	}
+
+	sort.Strings(removed)
+	for _, n := range removed {
+		cf.append(n, false)
+	}
+
+	for _, n := range names {
+		if _, ok := cf.names[n]; !ok {
+			cf.append(n, true)
+		}
+	}
+
+	cf.names = current
+	if len(cf.log) > len(cf.names)+changeLogSlack {
+		cf.compact()
+	}
+}
+
+// Replace the log by an addition of each current entry.
+func (cf *changeFeed) compact() {
+	var sorted []string
+	for n := range cf.names {
+		sorted = append(sorted, n)
+	}
+
+	sort.Strings(sorted)
+
+	cf.base = cf.seq
+	cf.log = nil
+	for _, n := range sorted {
+		cf.append(n, true)
+	}
+}
+
+// Report the changes after the supplied cursor. The first line is "cursor N",
+// where N is the cursor to ask with next time, followed by a line for each
+// change: "+" or "-" followed by the name of the entry added or removed.
+//
+// Special case: if the feed no longer has the changes after the cursor, or
+// never had them, the first line is instead "reset N" and the changes that
+// follow are an addition of each entry in the directory. The caller should
+// forget what it knew about the directory's entries.
+//
+// If there are too many changes to report at once, N is the cursor of the
+// last change reported, and asking again with it gives the rest.
+func (cf *changeFeed) report(cursor uint64) string {
+	header := "cursor"
+	if cursor < cf.base || cursor > cf.seq {
+		header = "reset"
+		cursor = cf.base
+	}
+
+	var body strings.Builder
+	last := cursor
+	for _, c := range cf.log[cursor-cf.base:] {
+		sign := "-"
+		if c.added {
+			sign = "+"
+		}
+
+		line := sign + c.name + "\n"
+		if body.Len()+len(line) > maxChangesSize {
+			break
+		}
+
+		body.WriteString(line)
+		last = c.seq
+	}
+
+	return fmt.Sprintf("%s %d\n", header, last) + body.String()
+}
+
+// Return the value of the extended attribute reporting the changes to the
+// supplied directory after the cursor given by the attribute's name, listing
+// the directory to bring its change feed up to date. ok is false if the inode
+// isn't a directory or the cursor isn't a number.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) changesXattrValue(
+	ctx context.Context,
+	id fuseops.InodeID,
+	name string) (v string, ok bool, err error) {
+	cursor, parseErr := strconv.ParseUint(
+		strings.TrimPrefix(name, changesXattrPrefix),
+		10,
+		64)
+
+	if parseErr != nil {
+		return
+	}
+
+	fs.mu.Lock()
+	in, isDir := fs.inodeOrDie(id).(inode.DirInode)
+	fs.mu.Unlock()
+
+	if !isDir {
+		return
+	}
+
+	// List the directory, subject to the usual listing cache.
+	in.Lock()
+	entries, err := readAllEntries(ctx, in, false)
+	in.Unlock()
+
+	if err != nil {
+		err = fmt.Errorf("readAllEntries: %w", err)
+		return
+	}
+
+	// Special case: names with newlines, including those given a suffix by
+	// fixConflictingNames, can't be reported one per line.
+	var names []string
+	for _, e := range entries {
+		if strings.Contains(e.Name, "\n") {
+			continue
+		}
+
+		n := e.Name
+		if e.Type == fuseutil.DT_Directory {
+			n += "/"
+		}
+
+		names = append(names, n)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	cf, exists := fs.changeFeeds[id]
+	if !exists {
+		cf = newChangeFeed(uint64(fs.mtimeClock.Now().UnixNano()))
+		fs.changeFeeds[id] = cf
+	}
+
+	cf.update(names)
+	v = cf.report(cursor)
+	ok = true
+
+	return
+}
@@ -0,0 +1,110 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"strings"
+
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const changeFeedStart = 1000
+
+type ChangeFeedTest struct {
+	cf *changeFeed
+}
+
+var _ SetUpInterface = &ChangeFeedTest{}
+
+func init() { RegisterTestSuite(&ChangeFeedTest{}) }
+
+func (t *ChangeFeedTest) SetUp(ti *TestInfo) {
+	t.cf = newChangeFeed(changeFeedStart)
+	t.cf.update([]string{"bar", "dir/", "foo"})
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ChangeFeedTest) FirstReportResets() {
+	ExpectEq("reset 1003\n+bar\n+dir/\n+foo\n", t.cf.report(0))
+}
+
+func (t *ChangeFeedTest) ChangesSinceCursor() {
+	t.cf.update([]string{"baz", "dir/", "foo", "qux"})
+
+	ExpectEq("cursor 1006\n-bar\n+baz\n+qux\n", t.cf.report(1003))
+	ExpectEq("cursor 1006\n+qux\n", t.cf.report(1005))
+}
+
+func (t *ChangeFeedTest) NoChanges() {
+	t.cf.update([]string{"bar", "dir/", "foo"})
+	ExpectEq("cursor 1003\n", t.cf.report(1003))
+}
+
+func (t *ChangeFeedTest) FutureCursorResets() {
+	ExpectEq("reset 1003\n+bar\n+dir/\n+foo\n", t.cf.report(2000))
+}
+
+func (t *ChangeFeedTest) CompactedCursorResets() {
+	// Churn the directory until the log is compacted.
+	for i := 0; i <= changeLogSlack; i++ {
+		t.cf.update([]string{"bar", "dir/", "foo", fmt.Sprintf("tmp%d", i)})
+	}
+
+	AssertGt(t.cf.base, uint64(changeFeedStart))
+
+	report := t.cf.report(1003)
+	AssertTrue(strings.HasPrefix(report, "reset "), "report: %q", report)
+
+	lines := strings.Split(strings.TrimSuffix(report, "\n"), "\n")
+	ExpectEq(fmt.Sprintf("reset %d", t.cf.seq), lines[0])
+}
+
+func (t *ChangeFeedTest) LongReportsContinue() {
+	var names []string
+	for i := 0; i < 10000; i++ {
+		names = append(names, fmt.Sprintf("some_long_file_name_%05d", i))
+	}
+
+	t.cf.update(names)
+
+	cursor := uint64(1003)
+	var changes int
+	for {
+		report := t.cf.report(cursor)
+		AssertLe(len(report), maxChangesSize+64)
+
+		lines := strings.Split(strings.TrimSuffix(report, "\n"), "\n")
+		_, err := fmt.Sscanf(lines[0], "cursor %d", &cursor)
+		AssertEq(nil, err)
+
+		if len(lines) == 1 {
+			break
+		}
+
+		changes += len(lines) - 1
+	}
+
+	// An addition of each name, and a removal of each original entry.
+	ExpectEq(len(names)+3, changes)
+	ExpectEq(t.cf.seq, cursor)
+}
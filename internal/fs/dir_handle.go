@@ -16,12 +16,13 @@ package fs
 
 import (
 	"fmt"
+	"log"
 	"sort"
 
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseops"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseutil"
 	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
-	"github.com/jacobsa/fuse"
-	"github.com/jacobsa/fuse/fuseops"
-	"github.com/jacobsa/fuse/fuseutil"
 	"github.com/jacobsa/syncutil"
 	"golang.org/x/net/context"
 )
@@ -35,6 +36,10 @@ type dirHandle struct {
 	in           inode.DirInode
 	implicitDirs bool
 
+	// If set, a listing that fails after its first batch is completed from the
+	// inode's last complete listing rather than failing the read.
+	staleFallback bool
+
 	/////////////////////////
 	// Mutable state
 	/////////////////////////
@@ -59,11 +64,13 @@ type dirHandle struct {
 // Create a directory handle that obtains listings from the supplied inode.
 func newDirHandle(
 	in inode.DirInode,
-	implicitDirs bool) (dh *dirHandle) {
+	implicitDirs bool,
+	staleFallback bool) (dh *dirHandle) {
 	// Set up the basic struct.
 	dh = &dirHandle{
-		in:           in,
-		implicitDirs: implicitDirs,
+		in:            in,
+		implicitDirs:  implicitDirs,
+		staleFallback: staleFallback,
 	}
 
 	// Set up invariant checking.
@@ -154,22 +161,96 @@ func fixConflictingNames(entries []fuseutil.Dirent) (err error) {
 	return
 }
 
+// Remove adjacent directory entries with the same name.
+//
+// Input must be sorted by name.
+func removeDuplicateDirs(in []fuseutil.Dirent) (out []fuseutil.Dirent) {
+	for i, e := range in {
+		if i > 0 &&
+			e.Type == fuseutil.DT_Directory &&
+			out[len(out)-1].Type == fuseutil.DT_Directory &&
+			out[len(out)-1].Name == e.Name {
+			continue
+		}
+
+		out = append(out, e)
+	}
+
+	return
+}
+
+// The name of the object or prefix that a listing reports as the supplied
+// entry, relative to the directory. Listings return these in sorted order.
+func listingKey(e fuseutil.Dirent) (key string) {
+	key = e.Name
+	if e.Type == fuseutil.DT_Directory {
+		key += "/"
+	}
+
+	return
+}
+
+// Complete a listing that failed part way through using an earlier complete
+// listing. Entries up to the last one read are taken from the fresh listing,
+// and the remainder from the stale one.
+func appendStaleEntries(
+	fresh []fuseutil.Dirent,
+	stale []fuseutil.Dirent) (entries []fuseutil.Dirent) {
+	var last string
+	for _, e := range fresh {
+		if k := listingKey(e); k > last {
+			last = k
+		}
+	}
+
+	entries = fresh
+	for _, e := range stale {
+		if listingKey(e) > last {
+			entries = append(entries, e)
+		}
+	}
+
+	return
+}
+
 // Read all entries for the directory, fix up conflicting names, and fill in
 // offset fields.
 //
+// If staleFallback is set, a successful listing is recorded with the inode,
+// and if reading a batch other than the first fails the remaining entries
+// are taken from the last recorded listing, when there is one.
+//
 // LOCKS_REQUIRED(in)
 func readAllEntries(
 	ctx context.Context,
-	in inode.DirInode) (entries []fuseutil.Dirent, err error) {
+	in inode.DirInode,
+	staleFallback bool) (entries []fuseutil.Dirent, err error) {
 	// Read one batch at a time.
 	var tok string
+	var stale bool
 	for {
 		// Read a batch.
 		var batch []fuseutil.Dirent
+		var newTok string
+
+		batch, newTok, err = in.ReadEntries(ctx, tok)
+
+		// Special case: fall back to the last complete listing for the rest of
+		// the directory if we've been asked to and have one.
+		if err != nil && staleFallback && tok != "" && in.LastListing() != nil {
+			log.Printf(
+				"Serving the rest of %q from a stale listing: %v",
+				in.Name(),
+				err)
+
+			err = nil
+			entries = appendStaleEntries(entries, in.LastListing())
+			stale = true
+			break
+		}
 
-		batch, tok, err = in.ReadEntries(ctx, tok)
 		if err != nil {
-			err = fmt.Errorf("ReadEntries: %v", err)
+			err = fmt.Errorf("ReadEntries: %w", err)
 			return
 		}
 
@@ -177,6 +258,7 @@ func readAllEntries(
 		entries = append(entries, batch...)
 
 		// Are we done?
+		tok = newTok
 		if tok == "" {
 			break
 		}
@@ -186,6 +268,16 @@ func readAllEntries(
 	// below.
 	sort.Sort(sortedDirents(entries))
 
+	// Directories created without placeholders may be listed twice, once
+	// because they exist in GCS and once because the inode remembers them.
+	entries = removeDuplicateDirs(entries)
+
+	// Remember a complete listing for use by later failed ones, before
+	// fixConflictingNames modifies it.
+	if staleFallback && !stale {
+		in.RecordListing(append([]fuseutil.Dirent(nil), entries...))
+	}
+
 	// Fix name conflicts.
 	err = fixConflictingNames(entries)
 	if err != nil {
@@ -226,9 +318,9 @@ func (dh *dirHandle) ensureEntries(ctx context.Context) (err error) {
 
 	// Read entries.
 	var entries []fuseutil.Dirent
-	entries, err = readAllEntries(ctx, dh.in)
+	entries, err = readAllEntries(ctx, dh.in, dh.staleFallback)
 	if err != nil {
-		err = fmt.Errorf("readAllEntries: %v", err)
+		err = fmt.Errorf("readAllEntries: %w", err)
 		return
 	}
 
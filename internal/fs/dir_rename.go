@@ -0,0 +1,252 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseops"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"golang.org/x/net/context"
+)
+
+// List the objects whose names begin with the supplied prefix, or return
+// tooMany if there are more than limit of them.
+func listObjectsUnder(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	prefix string,
+	limit int) (objects []*gcs.Object, tooMany bool, err error) {
+	req := &gcs.ListObjectsRequest{
+		Prefix: prefix,
+	}
+
+	for {
+		var listing *gcs.Listing
+		listing, err = bucket.ListObjects(ctx, req)
+		if err != nil {
+			err = fmt.Errorf("ListObjects: %w", err)
+			return
+		}
+
+		objects = append(objects, listing.Objects...)
+		if len(objects) > limit {
+			tooMany = true
+			return
+		}
+
+		if listing.ContinuationToken == "" {
+			return
+		}
+
+		req.ContinuationToken = listing.ContinuationToken
+	}
+}
+
+// Return EBUSY if any file inode under the supplied prefix holds local
+// modifications, which would be written back under its old name if the
+// directory were renamed.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) checkNoDirtyFilesUnder(prefix string) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, in := range fs.inodes {
+		file, ok := in.(*inode.FileInode)
+		if !ok || !strings.HasPrefix(file.Name(), prefix) {
+			continue
+		}
+
+		if ls := file.LocalState(); ls.Dirty || ls.Streaming {
+			err = syscall.EBUSY
+			return
+		}
+	}
+
+	return
+}
+
+// Rename the directory with the supplied full name, found by looking up
+// op.OldName in oldParent, by moving each object beneath it. Fails with
+// ENOTSUP if there are more than fs.renameDirLimit objects to move.
+//
+// LOCKS_EXCLUDED(fs.mu)
+// LOCKS_EXCLUDED(oldParent)
+// LOCKS_EXCLUDED(newParent)
+func (fs *fileSystem) renameDir(
+	ctx context.Context,
+	op *fuseops.RenameOp,
+	oldParent inode.DirInode,
+	newParent inode.DirInode,
+	srcPrefix string) (err error) {
+	dstPrefix := newParent.Name() + op.NewName + "/"
+
+	// Find everything we would have to move.
+	srcObjects, tooMany, err := listObjectsUnder(
+		ctx,
+		fs.bucket,
+		srcPrefix,
+		fs.renameDirLimit)
+
+	if err != nil {
+		return
+	}
+
+	if tooMany {
+		err = syscall.ENOTSUP
+		return
+	}
+
+	err = fs.checkRenamedNameLengths(srcObjects, srcPrefix, dstPrefix)
+	if err != nil {
+		return
+	}
+
+	// As with rmdir, we may not be allowed to delete the placeholder.
+	var placeholder *gcs.Object
+	var others []*gcs.Object
+	for _, o := range srcObjects {
+		if o.Name == srcPrefix {
+			placeholder = o
+		} else {
+			others = append(others, o)
+		}
+	}
+
+	if placeholder != nil && fs.keepDirPlaceholders {
+		err = syscall.EPERM
+		return
+	}
+
+	// The destination may only be an empty directory.
+	newParent.Lock()
+	lr, err := newParent.LookUpChild(ctx, op.NewName)
+	newParent.Unlock()
+
+	if err != nil {
+		err = fmt.Errorf("LookUpChild: %w", err)
+		return
+	}
+
+	if lr.Exists() {
+		if !inode.IsDirName(lr.FullName) {
+			err = fuse.ENOTDIR
+			return
+		}
+
+		var dstObjects []*gcs.Object
+		dstObjects, _, err = listObjectsUnder(ctx, fs.bucket, dstPrefix, 1)
+		if err != nil {
+			return
+		}
+
+		for _, o := range dstObjects {
+			if o.Name != dstPrefix {
+				err = fuse.ENOTEMPTY
+				return
+			}
+		}
+	}
+
+	err = fs.checkNoDirtyFilesUnder(srcPrefix)
+	if err != nil {
+		return
+	}
+
+	// Record the renames in a journal, so that if we crash part way through
+	// the sources already copied can be deleted later.
+	var entries []journalEntry
+	for _, o := range srcObjects {
+		entries = append(entries, journalEntry{
+			Src:               o.Name,
+			SrcGeneration:     o.Generation,
+			SrcMetaGeneration: o.MetaGeneration,
+			Dst:               dstPrefix + strings.TrimPrefix(o.Name, srcPrefix),
+		})
+	}
+
+	journal, err := writeJournal(ctx, fs.bucket, fs.journalPrefix, entries)
+	if err != nil {
+		err = fmt.Errorf("writeJournal: %w", err)
+		return
+	}
+
+	defer clearJournal(ctx, fs.bucket, journal)
+
+	// Move everything but the placeholder, which goes last so that the source
+	// directory doesn't vanish if we fail part way through. Keep the first
+	// error.
+	var mu sync.Mutex
+	var moveErr error
+	err = forEachParallel(ctx, len(others), func(ctx context.Context, i int) {
+		o := others[i]
+		err := moveObject(
+			ctx,
+			fs.bucket,
+			o,
+			dstPrefix+strings.TrimPrefix(o.Name, srcPrefix))
+
+		if err != nil {
+			mu.Lock()
+			if moveErr == nil {
+				moveErr = err
+			}
+			mu.Unlock()
+		}
+	})
+
+	if err == nil {
+		err = moveErr
+	}
+
+	if err == nil && placeholder != nil {
+		err = moveObject(ctx, fs.bucket, placeholder, dstPrefix)
+	}
+
+	// Whatever happened, the parents' idea of their children may now be wrong.
+	oldParent.Lock()
+	oldParent.ForgetChild(op.OldName)
+	oldParent.Unlock()
+
+	newParent.Lock()
+	newParent.ForgetChild(op.NewName)
+	newParent.Unlock()
+
+	if err != nil {
+		err = fmt.Errorf("moveObject: %w", err)
+		return
+	}
+
+	// Special case: a directory that exists only locally has no objects to
+	// move, so create it again under the new name.
+	if len(srcObjects) == 0 {
+		newParent.Lock()
+		_, err = newParent.CreateChildDir(ctx, op.NewName)
+		newParent.Unlock()
+
+		if err != nil {
+			err = fmt.Errorf("CreateChildDir: %w", err)
+			return
+		}
+	}
+
+	return
+}
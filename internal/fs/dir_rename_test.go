@@ -0,0 +1,162 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type DirRenameTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&DirRenameTest{}) }
+
+func (t *DirRenameTest) SetUp(ti *TestInfo) {
+	t.serverCfg.RenameDirLimit = 4
+
+	t.disableWritebackCaching()
+
+	t.fsTest.SetUp(ti)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *DirRenameTest) MovesEverything() {
+	AssertEq(
+		nil,
+		t.createObjects(map[string]string{
+			"foo/":      "",
+			"foo/a":     "taco",
+			"foo/sub/":  "",
+			"foo/sub/b": "burrito",
+			"unrelated": "",
+		}))
+
+	err := os.Rename(path.Join(t.Dir, "foo"), path.Join(t.Dir, "bar"))
+	AssertEq(nil, err)
+
+	// The bucket has the objects under their new names only.
+	listing, _, err := gcsutil.ListAll(t.ctx, t.bucket, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+
+	var names []string
+	for _, o := range listing {
+		names = append(names, o.Name)
+	}
+
+	ExpectThat(names, ElementsAre("bar/", "bar/a", "bar/sub/", "bar/sub/b", "unrelated"))
+
+	// And the file system agrees.
+	_, err = os.Stat(path.Join(t.Dir, "foo"))
+	ExpectTrue(os.IsNotExist(err))
+
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "bar/sub/b"))
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+}
+
+func (t *DirRenameTest) ReplacesEmptyDirectory() {
+	AssertEq(
+		nil,
+		t.createObjects(map[string]string{
+			"foo/":  "",
+			"foo/a": "taco",
+			"bar/":  "",
+		}))
+
+	// os.Rename refuses to replace directories, so go straight to the syscall.
+	err := syscall.Rename(path.Join(t.Dir, "foo"), path.Join(t.Dir, "bar"))
+	AssertEq(nil, err)
+
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "bar/a"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *DirRenameTest) DestinationNotEmpty() {
+	AssertEq(
+		nil,
+		t.createObjects(map[string]string{
+			"foo/":  "",
+			"foo/a": "taco",
+			"bar/":  "",
+			"bar/b": "burrito",
+		}))
+
+	err := syscall.Rename(path.Join(t.Dir, "foo"), path.Join(t.Dir, "bar"))
+	ExpectEq(syscall.ENOTEMPTY, err)
+
+	// Nothing moved.
+	_, err = gcsutil.ReadObject(t.ctx, t.bucket, "foo/a")
+	ExpectEq(nil, err)
+}
+
+func (t *DirRenameTest) TooManyObjects() {
+	AssertEq(
+		nil,
+		t.createObjects(map[string]string{
+			"foo/":  "",
+			"foo/a": "",
+			"foo/b": "",
+			"foo/c": "",
+			"foo/d": "",
+		}))
+
+	err := os.Rename(path.Join(t.Dir, "foo"), path.Join(t.Dir, "bar"))
+	ExpectThat(err, Error(HasSubstr("not supported")))
+
+	// Nothing moved.
+	_, err = gcsutil.ReadObject(t.ctx, t.bucket, "foo/d")
+	ExpectEq(nil, err)
+}
+
+func (t *DirRenameTest) DirtyFileInside() {
+	var err error
+	AssertEq(nil, os.Mkdir(path.Join(t.Dir, "foo"), 0700))
+
+	t.f1, err = os.Create(path.Join(t.Dir, "foo/a"))
+	AssertEq(nil, err)
+
+	_, err = t.f1.Write([]byte("taco"))
+	AssertEq(nil, err)
+
+	// The write would be lost, so the rename is refused until it is flushed.
+	err = os.Rename(path.Join(t.Dir, "foo"), path.Join(t.Dir, "bar"))
+	ExpectThat(err, Error(HasSubstr("busy")))
+
+	AssertEq(nil, t.f1.Sync())
+
+	err = os.Rename(path.Join(t.Dir, "foo"), path.Join(t.Dir, "bar"))
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "bar/a")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
@@ -0,0 +1,94 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"os"
+	"path"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type DirectIOTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&DirectIOTest{}) }
+
+func (t *DirectIOTest) SetUp(ti *TestInfo) {
+	t.serverCfg.DirectIOPatterns = []string{"*.status", "logs/current"}
+	t.serverCfg.ReadLatestGeneration = true
+	t.fsTest.SetUp(ti)
+}
+
+// Open the named file, read it, overwrite the object behind the mount's back
+// with contents of the same length, and return what a second read from the
+// same handle sees.
+func (t *DirectIOTest) readTwice(name string) (first, second string) {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, name, []byte("taco"))
+	AssertEq(nil, err)
+
+	f, err := os.Open(path.Join(t.Dir, name))
+	AssertEq(nil, err)
+	defer f.Close()
+
+	buf := make([]byte, 4)
+	n, err := f.ReadAt(buf, 0)
+	AssertEq(nil, err)
+	first = string(buf[:n])
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, name, []byte("burr"))
+	AssertEq(nil, err)
+
+	n, err = f.ReadAt(buf, 0)
+	AssertEq(nil, err)
+	second = string(buf[:n])
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *DirectIOTest) MatchingBaseName() {
+	first, second := t.readTwice("foo.status")
+
+	ExpectEq("taco", first)
+	ExpectEq("burr", second)
+}
+
+func (t *DirectIOTest) MatchingPath() {
+	AssertEq(nil, os.Mkdir(path.Join(t.Dir, "logs"), 0700))
+	first, second := t.readTwice("logs/current")
+
+	ExpectEq("taco", first)
+	ExpectEq("burr", second)
+}
+
+func (t *DirectIOTest) BadPattern() {
+	cfg := t.serverCfg
+	cfg.DirectIOPatterns = []string{"["}
+
+	_, err := fs.NewServer(&cfg)
+	ExpectThat(err, Error(HasSubstr("Direct I/O pattern")))
+}
@@ -0,0 +1,123 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"syscall"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseops"
+	"golang.org/x/net/context"
+)
+
+// With a dirty limit, the file system counts the bytes written to each file
+// since it was last synced. Once the total goes over the limit, writes wait
+// until syncs bring it back down to the low-water mark, so that writers
+// faster than the network don't fill the temporary directory. Pending
+// delayed syncs are started straight away to help.
+//
+// The limit is soft: a write waits only while some sync is running or
+// pending that could bring the total down. Otherwise, e.g. when the bytes
+// belong to files still open for writing, waiting could only deadlock, so
+// the write goes ahead, unless the limit is hard, in which case it fails
+// with EDQUOT.
+
+// The fraction of the dirty limit that the total must drop to before waiting
+// writes continue.
+const dirtyLowWaterFraction = 0.75
+
+// Count the supplied number of bytes written to the inode with the given ID.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) addDirtyBytes(id fuseops.InodeID, n int64) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.dirtyBytes[id] += n
+	fs.dirtyTotal += n
+
+	if fs.dirtyTotal > fs.dirtyLimit {
+		fs.dirtyThrottled = true
+	}
+}
+
+// Forget the bytes counted for the inode with the given ID, which has been
+// synced or destroyed, waking writers if that ends throttling.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) releaseDirtyBytes(id fuseops.InodeID) {
+	n, ok := fs.dirtyBytes[id]
+	if !ok {
+		return
+	}
+
+	delete(fs.dirtyBytes, id)
+	fs.dirtyTotal -= n
+
+	if fs.dirtyThrottled &&
+		float64(fs.dirtyTotal) <= dirtyLowWaterFraction*float64(fs.dirtyLimit) {
+		fs.dirtyThrottled = false
+	}
+
+	fs.wakeDirtyWaiters()
+}
+
+// Wake writers waiting in waitForDirtyBytes to look again.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) wakeDirtyWaiters() {
+	close(fs.dirtyChanged)
+	fs.dirtyChanged = make(chan struct{})
+}
+
+// Wait until writes may continue under the dirty limit, or the context is
+// cancelled. With a hard limit, return EDQUOT if the total is over the limit
+// and waiting wouldn't help.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) waitForDirtyBytes(ctx context.Context) (err error) {
+	startedSyncs := false
+	for {
+		fs.mu.Lock()
+		wait := fs.dirtyThrottled &&
+			(fs.syncsInProgress > 0 || len(fs.delayedSyncs) > 0)
+
+		changed := fs.dirtyChanged
+		pending := len(fs.delayedSyncs) > 0
+		refuse := fs.dirtyThrottled && fs.dirtyLimitHard
+		fs.mu.Unlock()
+
+		if !wait {
+			if refuse {
+				err = syscall.EDQUOT
+			}
+
+			return
+		}
+
+		// Don't leave delayed syncs waiting out their delay while writers wait
+		// for them.
+		if pending && !startedSyncs {
+			go fs.flushDelayedSyncs()
+			startedSyncs = true
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+)
+
+type DirtyLimitTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&DirtyLimitTest{}) }
+
+func (t *DirtyLimitTest) SetUp(ti *TestInfo) {
+	t.serverCfg.DirtyLimit = 8
+
+	// Long enough that only the limit can cause the syncs the tests see.
+	t.serverCfg.SyncDelay = time.Hour
+	t.fsTest.SetUp(ti)
+}
+
+func (t *DirtyLimitTest) objectContents(name string) string {
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, name)
+	if err != nil {
+		return ""
+	}
+
+	return string(contents)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *DirtyLimitTest) WritesUnderLimitDontSync() {
+	err := ioutil.WriteFile(path.Join(t.Dir, "foo"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = ioutil.WriteFile(path.Join(t.Dir, "bar"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	ExpectEq("", t.objectContents("foo"))
+	ExpectEq("", t.objectContents("bar"))
+}
+
+func (t *DirtyLimitTest) WritesOverLimitWaitForPendingSyncs() {
+	err := ioutil.WriteFile(path.Join(t.Dir, "foo"), []byte("enchilada"), 0600)
+	AssertEq(nil, err)
+
+	// The next write waits for foo's pending sync, which starts straight away
+	// rather than after the delay.
+	err = ioutil.WriteFile(path.Join(t.Dir, "bar"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	ExpectEq("enchilada", t.objectContents("foo"))
+	ExpectEq("", t.objectContents("bar"))
+}
+
+func (t *DirtyLimitTest) WriterAloneOverLimitIsntBlocked() {
+	f, err := os.Create(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	defer f.Close()
+
+	_, err = f.Write([]byte("enchilada"))
+	AssertEq(nil, err)
+
+	// Nothing could bring the total down while the file is open, so further
+	// writes go ahead.
+	_, err = f.Write([]byte("burrito"))
+	AssertEq(nil, err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Hard limit
+////////////////////////////////////////////////////////////////////////
+
+type DirtyLimitHardTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&DirtyLimitHardTest{}) }
+
+func (t *DirtyLimitHardTest) SetUp(ti *TestInfo) {
+	t.serverCfg.DirtyLimit = 8
+	t.serverCfg.DirtyLimitHard = true
+	t.serverCfg.SyncDelay = time.Hour
+
+	t.fsTest.SetUp(ti)
+}
+
+func (t *DirtyLimitHardTest) WriterAloneOverLimitIsRefused() {
+	f, err := os.Create(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	defer f.Close()
+
+	_, err = f.Write([]byte("enchilada"))
+	AssertEq(nil, err)
+
+	// Nothing could bring the total down while the file is open.
+	_, err = f.Write([]byte("burrito"))
+
+	pathErr, ok := err.(*os.PathError)
+	AssertTrue(ok, "err: %v", err)
+	ExpectEq(syscall.EDQUOT, pathErr.Err)
+
+	// Syncing the file frees the space.
+	err = f.Sync()
+	AssertEq(nil, err)
+
+	_, err = f.Write([]byte("burrito"))
+	ExpectEq(nil, err)
+}
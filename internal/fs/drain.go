@@ -0,0 +1,327 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"log"
+	"syscall"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseops"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/handle"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"golang.org/x/net/context"
+)
+
+// Draining prepares a mount for the machine it is on going away, e.g. a
+// preemptible VM being shut down. Once it starts, modifications that would
+// create new dirty data fail with EROFS, and dirty files are synced to GCS
+// over and over until the file system is unmounted, so that anything that
+// does become dirty is soon written out. Writes through handles opened before
+// the drain started are still accepted, since with writeback caching the
+// kernel may send data that was written before then at any time. Progress is
+// reported in the status (see status.go).
+
+// The extended attribute that starts a drain when set on the root directory,
+// to any value.
+const DrainXattr = "user.gcsfuse.drain"
+
+// How long to wait between passes over the dirty files while draining.
+const drainPassInterval = time.Second
+
+// Start draining, unless already doing so.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) startDrain() {
+	fs.mu.Lock()
+	started := fs.draining
+	fs.draining = true
+	fs.mu.Unlock()
+
+	if started {
+		return
+	}
+
+	log.Println("Draining: refusing new modifications and syncing dirty files.")
+	go fs.drain(fs.backgroundCtx)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) isDraining() bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.draining
+}
+
+// Sync dirty files until the context is cancelled, logging progress.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) drain(ctx context.Context) {
+	drained := false
+	for {
+		synced, bytes, failed := fs.syncAll(ctx, "Draining")
+		if synced > 0 || failed > 0 {
+			log.Printf(
+				"Draining: synced %d files (%d bytes), %d failed.",
+				synced,
+				bytes,
+				failed)
+
+			drained = false
+		} else if !drained {
+			log.Println("Drained: nothing is left to sync.")
+			drained = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-time.After(drainPassInterval):
+		}
+	}
+}
+
+// Apply the isolated writes of each open file handle, then sync each dirty
+// file once. Failures are logged, prefixed with the supplied description of
+// what is going on.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) syncAll(
+	ctx context.Context,
+	what string) (synced int, bytes int64, failed int) {
+	// Reconcile handles, which dirties their inodes.
+	if fs.writeIsolation != handle.SharedWrites {
+		var handles []*handle.FileHandle
+		fs.mu.Lock()
+		for _, h := range fs.handles {
+			if fh, ok := h.(*handle.FileHandle); ok {
+				handles = append(handles, fh)
+			}
+		}
+		fs.mu.Unlock()
+
+		for _, fh := range handles {
+			fh.Lock()
+			in := fh.Inode()
+			in.Lock()
+			err := fh.Reconcile(ctx)
+			in.Unlock()
+			fh.Unlock()
+
+			if err != nil {
+				log.Printf("%s: reconciling %q: %v", what, in.Name(), err)
+				failed++
+			}
+		}
+	}
+
+	// Find the dirty files.
+	var files []*inode.FileInode
+	fs.mu.Lock()
+	for _, in := range fs.inodes {
+		if f, ok := in.(*inode.FileInode); ok && f.LocalState().Dirty {
+			files = append(files, f)
+		}
+	}
+	fs.mu.Unlock()
+
+	// Sync them.
+	for _, f := range files {
+		f.Lock()
+		ls := f.LocalState()
+		err := fs.syncFileAndMaybeRename(ctx, f)
+		f.Unlock()
+
+		if err != nil {
+			log.Printf("%s: syncing %q: %v", what, f.Name(), err)
+			failed++
+			continue
+		}
+
+		synced++
+		bytes += ls.DirtyBytes
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// drainCheckingFileSystem
+////////////////////////////////////////////////////////////////////////
+
+// A file system that refuses ops that would create new dirty data or modify
+// the namespace with EROFS once the wrapped file system has started draining.
+// Writes are not checked, since files can't be opened for writing while
+// draining and earlier writes must not be lost.
+type drainCheckingFileSystem struct {
+	fuseutil.FileSystem
+	fs *fileSystem
+}
+
+// Return EROFS if the file system is draining.
+func (fs *drainCheckingFileSystem) check() (err error) {
+	if fs.fs.isDraining() {
+		err = syscall.EROFS
+	}
+
+	return
+}
+
+func (fs *drainCheckingFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) (err error) {
+	// Special case: the kernel sets mtimes when flushing files written with
+	// writeback caching, so allow anything but truncation.
+	if op.Size != nil {
+		if err = fs.check(); err != nil {
+			return
+		}
+	}
+
+	err = fs.FileSystem.SetInodeAttributes(ctx, op)
+	return
+}
+
+func (fs *drainCheckingFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) (err error) {
+	if err = fs.check(); err != nil {
+		return
+	}
+
+	err = fs.FileSystem.MkDir(ctx, op)
+	return
+}
+
+func (fs *drainCheckingFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) (err error) {
+	if err = fs.check(); err != nil {
+		return
+	}
+
+	err = fs.FileSystem.MkNode(ctx, op)
+	return
+}
+
+func (fs *drainCheckingFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) (err error) {
+	if err = fs.check(); err != nil {
+		return
+	}
+
+	err = fs.FileSystem.CreateFile(ctx, op)
+	return
+}
+
+func (fs *drainCheckingFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) (err error) {
+	if err = fs.check(); err != nil {
+		return
+	}
+
+	err = fs.FileSystem.CreateSymlink(ctx, op)
+	return
+}
+
+func (fs *drainCheckingFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) (err error) {
+	if err = fs.check(); err != nil {
+		return
+	}
+
+	err = fs.FileSystem.Rename(ctx, op)
+	return
+}
+
+func (fs *drainCheckingFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) (err error) {
+	if err = fs.check(); err != nil {
+		return
+	}
+
+	err = fs.FileSystem.RmDir(ctx, op)
+	return
+}
+
+func (fs *drainCheckingFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) (err error) {
+	if err = fs.check(); err != nil {
+		return
+	}
+
+	err = fs.FileSystem.Unlink(ctx, op)
+	return
+}
+
+func (fs *drainCheckingFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) (err error) {
+	// Opening for reading alone is fine.
+	if op.Flags&syscall.O_ACCMODE != syscall.O_RDONLY ||
+		op.Flags&syscall.O_TRUNC != 0 {
+		if err = fs.check(); err != nil {
+			return
+		}
+	}
+
+	err = fs.FileSystem.OpenFile(ctx, op)
+	return
+}
+
+func (fs *drainCheckingFileSystem) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) (err error) {
+	if err = fs.check(); err != nil {
+		return
+	}
+
+	err = fs.FileSystem.CopyFileRange(ctx, op)
+	return
+}
+
+func (fs *drainCheckingFileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) (err error) {
+	// Special case: setting the drain attribute again is harmless, so only
+	// check attributes backed by object metadata.
+	if isObjectXattr(op.Name) {
+		if err = fs.check(); err != nil {
+			return
+		}
+	}
+
+	err = fs.FileSystem.SetXattr(ctx, op)
+	return
+}
+
+func (fs *drainCheckingFileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) (err error) {
+	if err = fs.check(); err != nil {
+		return
+	}
+
+	err = fs.FileSystem.RemoveXattr(ctx, op)
+	return
+}
@@ -0,0 +1,173 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Tests for draining, which is started through an extended attribute on the
+// root directory. These use syscall.Setxattr, which is available only on
+// Linux.
+
+package fs_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+type DrainTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&DrainTest{}) }
+
+func (t *DrainTest) SetUp(ti *TestInfo) {
+	t.disableWritebackCaching()
+
+	t.fsTest.SetUp(ti)
+}
+
+func (t *DrainTest) startDrain() {
+	err := syscall.Setxattr(t.mfs.Dir(), fs.DrainXattr, []byte("1"), 0)
+	AssertEq(nil, err)
+}
+
+func (t *DrainTest) getStatus() (s fs.Status) {
+	buf := make([]byte, 4096)
+	n, err := syscall.Getxattr(t.mfs.Dir(), fs.StatusXattr, buf)
+	AssertEq(nil, err)
+
+	err = json.Unmarshal(buf[:n], &s)
+	AssertEq(nil, err)
+
+	return
+}
+
+// Wait for the status to report that the drain is finished, giving up after
+// a while.
+func (t *DrainTest) waitForDrained() (s fs.Status) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		s = t.getStatus()
+		if s.Drained || time.Now().After(deadline) {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *DrainTest) NotStarted() {
+	s := t.getStatus()
+	ExpectFalse(s.Draining)
+	ExpectFalse(s.Drained)
+}
+
+func (t *DrainTest) NothingToSync() {
+	t.startDrain()
+
+	s := t.waitForDrained()
+	ExpectTrue(s.Draining)
+	ExpectTrue(s.Drained)
+
+	// Starting again is harmless.
+	t.startDrain()
+	ExpectTrue(t.getStatus().Drained)
+}
+
+func (t *DrainTest) RefusesModifications() {
+	AssertEq(nil, t.createWithContents("foo", "taco"))
+	t.startDrain()
+
+	var err error
+
+	_, err = os.Create(path.Join(t.mfs.Dir(), "bar"))
+	ExpectThat(err, Error(HasSubstr("read-only")))
+
+	err = os.Mkdir(path.Join(t.mfs.Dir(), "dir"), 0700)
+	ExpectThat(err, Error(HasSubstr("read-only")))
+
+	err = os.Remove(path.Join(t.mfs.Dir(), "foo"))
+	ExpectThat(err, Error(HasSubstr("read-only")))
+
+	err = os.Rename(
+		path.Join(t.mfs.Dir(), "foo"),
+		path.Join(t.mfs.Dir(), "baz"))
+	ExpectThat(err, Error(HasSubstr("read-only")))
+
+	_, err = os.OpenFile(path.Join(t.mfs.Dir(), "foo"), os.O_WRONLY, 0)
+	ExpectThat(err, Error(HasSubstr("read-only")))
+
+	err = os.Truncate(path.Join(t.mfs.Dir(), "foo"), 0)
+	ExpectThat(err, Error(HasSubstr("read-only")))
+}
+
+func (t *DrainTest) ReadsAllowed() {
+	AssertEq(nil, t.createWithContents("foo", "taco"))
+	t.startDrain()
+
+	contents, err := ioutil.ReadFile(path.Join(t.mfs.Dir(), "foo"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	entries, err := ioutil.ReadDir(t.mfs.Dir())
+	AssertEq(nil, err)
+	ExpectEq(1, len(entries))
+}
+
+func (t *DrainTest) SyncsDirtyFiles() {
+	var err error
+
+	// Write to a file without closing it.
+	t.f1, err = os.Create(path.Join(t.mfs.Dir(), "foo"))
+	AssertEq(nil, err)
+
+	_, err = t.f1.Write([]byte("taco"))
+	AssertEq(nil, err)
+
+	// Draining writes it out.
+	t.startDrain()
+
+	s := t.waitForDrained()
+	ExpectTrue(s.Drained)
+	ExpectEq(0, s.PendingUploads)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	// Writing through the handle opened earlier still works, and is written
+	// out in turn.
+	_, err = t.f1.Write([]byte("burrito"))
+	AssertEq(nil, err)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for string(contents) != "tacoburrito" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		contents, err = gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+		AssertEq(nil, err)
+	}
+
+	ExpectEq("tacoburrito", string(contents))
+}
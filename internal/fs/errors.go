@@ -0,0 +1,383 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"syscall"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseops"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+// Reasons GCS gives for 403 and 429 errors caused by exceeding a quota rather
+// than by a lack of permission or a transient rate limit.
+var quotaReasons = map[string]bool{
+	"quotaExceeded":        true,
+	"storageQuotaExceeded": true,
+	"dailyLimitExceeded":   true,
+}
+
+// Map an error returned by a file system op to the error the kernel should
+// see. The fuse package reports any error that is not a syscall.Errno as
+// EIO, so errors whose causes applications could sensibly react to (found by
+// unwrapping) are translated according to the table below; others are
+// returned unchanged.
+//
+// Errors are logged when translated, since the kernel sees only the errno.
+func errno(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	// Errnos chosen by the file system itself, e.g. ENOENT from LookUpInode.
+	var e syscall.Errno
+	if errors.As(err, &e) {
+		return e
+	}
+
+	mapped := causeErrno(err)
+	if mapped == 0 {
+		return err
+	}
+
+	log.Printf("Returning %v for error: %v", mapped, err)
+	return mapped
+}
+
+// Return the errno for the underlying cause of err, or zero if there is none
+// more specific than EIO.
+func causeErrno(err error) syscall.Errno {
+	var notFound *gcs.NotFoundError
+	if errors.As(err, &notFound) {
+		return syscall.ENOENT
+	}
+
+	var precondition *gcs.PreconditionError
+	if errors.As(err, &precondition) {
+		return syscall.ESTALE
+	}
+
+	var policy *gcsx.PolicyViolationError
+	if errors.As(err, &policy) {
+		return syscall.EPERM
+	}
+
+	if errors.Is(err, gcsx.ErrSnapshotReadOnly) {
+		return syscall.EROFS
+	}
+
+	if errors.Is(err, gcsx.ErrQueryReadOnly) {
+		return syscall.EROFS
+	}
+
+	var query *gcsx.QueryError
+	if errors.As(err, &query) {
+		return syscall.EINVAL
+	}
+
+	if errors.Is(err, gcsx.ErrWriteBudgetExceeded) {
+		return syscall.EDQUOT
+	}
+
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return 0
+	}
+
+	for _, item := range apiErr.Errors {
+		if quotaReasons[item.Reason] {
+			return syscall.EDQUOT
+		}
+	}
+
+	switch apiErr.Code {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return syscall.EACCES
+
+	case http.StatusNotFound:
+		return syscall.ENOENT
+
+	case http.StatusPreconditionFailed:
+		return syscall.ESTALE
+
+	case http.StatusTooManyRequests:
+		return syscall.EAGAIN
+	}
+
+	return 0
+}
+
+////////////////////////////////////////////////////////////////////////
+// errnoFileSystem
+////////////////////////////////////////////////////////////////////////
+
+// Names for the errnos that errno translates errors to, as reported in the
+// file system's status.
+var errnoNames = map[syscall.Errno]string{
+	syscall.EACCES: "EACCES",
+	syscall.EAGAIN: "EAGAIN",
+	syscall.EDQUOT: "EDQUOT",
+	syscall.EIO:    "EIO",
+	syscall.ENOENT: "ENOENT",
+	syscall.EPERM:  "EPERM",
+	syscall.EROFS:  "EROFS",
+	syscall.ESTALE: "ESTALE",
+}
+
+// Counts of the errors returned to the kernel that aren't errnos, i.e. those
+// caused by failed requests to the bucket rather than chosen by the file
+// system, keyed by errno name. Safe for concurrent access.
+type errorCounts struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	counts map[string]uint64
+}
+
+// Count the supplied errno.
+func (ec *errorCounts) record(e syscall.Errno) {
+	name, ok := errnoNames[e]
+	if !ok {
+		name = fmt.Sprintf("errno %d", int(e))
+	}
+
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	if ec.counts == nil {
+		ec.counts = make(map[string]uint64)
+	}
+
+	ec.counts[name]++
+}
+
+// Return a copy of the counts so far.
+func (ec *errorCounts) snapshot() (counts map[string]uint64) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	counts = make(map[string]uint64)
+	for name, n := range ec.counts {
+		counts[name] = n
+	}
+
+	return
+}
+
+// A file system that applies errno to the errors returned by every op of the
+// wrapped file system, counting those that it translates.
+type errnoFileSystem struct {
+	wrapped fuseutil.FileSystem
+	errors  *errorCounts
+}
+
+// Apply errno to the supplied error, counting it unless it is already an
+// errno. Errors that errno leaves alone are seen by the kernel as EIO, and are
+// counted as such.
+func (fs *errnoFileSystem) errno(err error) error {
+	var e syscall.Errno
+	if err == nil || errors.As(err, &e) {
+		return errno(err)
+	}
+
+	mapped := errno(err)
+	if !errors.As(mapped, &e) {
+		e = syscall.EIO
+	}
+
+	fs.errors.record(e)
+	return mapped
+}
+
+func (fs *errnoFileSystem) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	return fs.errno(fs.wrapped.StatFS(ctx, op))
+}
+
+func (fs *errnoFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	return fs.errno(fs.wrapped.LookUpInode(ctx, op))
+}
+
+func (fs *errnoFileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	return fs.errno(fs.wrapped.GetInodeAttributes(ctx, op))
+}
+
+func (fs *errnoFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	return fs.errno(fs.wrapped.SetInodeAttributes(ctx, op))
+}
+
+func (fs *errnoFileSystem) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	return fs.errno(fs.wrapped.ForgetInode(ctx, op))
+}
+
+func (fs *errnoFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	return fs.errno(fs.wrapped.MkDir(ctx, op))
+}
+
+func (fs *errnoFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	return fs.errno(fs.wrapped.MkNode(ctx, op))
+}
+
+func (fs *errnoFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	return fs.errno(fs.wrapped.CreateFile(ctx, op))
+}
+
+func (fs *errnoFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	return fs.errno(fs.wrapped.CreateSymlink(ctx, op))
+}
+
+func (fs *errnoFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	return fs.errno(fs.wrapped.Rename(ctx, op))
+}
+
+func (fs *errnoFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	return fs.errno(fs.wrapped.RmDir(ctx, op))
+}
+
+func (fs *errnoFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	return fs.errno(fs.wrapped.Unlink(ctx, op))
+}
+
+func (fs *errnoFileSystem) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	return fs.errno(fs.wrapped.OpenDir(ctx, op))
+}
+
+func (fs *errnoFileSystem) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	return fs.errno(fs.wrapped.ReadDir(ctx, op))
+}
+
+func (fs *errnoFileSystem) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	return fs.errno(fs.wrapped.ReleaseDirHandle(ctx, op))
+}
+
+func (fs *errnoFileSystem) SyncDir(
+	ctx context.Context,
+	op *fuseops.SyncDirOp) error {
+	return fs.errno(fs.wrapped.SyncDir(ctx, op))
+}
+
+func (fs *errnoFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	return fs.errno(fs.wrapped.OpenFile(ctx, op))
+}
+
+func (fs *errnoFileSystem) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	return fs.errno(fs.wrapped.ReadFile(ctx, op))
+}
+
+func (fs *errnoFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	return fs.errno(fs.wrapped.WriteFile(ctx, op))
+}
+
+func (fs *errnoFileSystem) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) error {
+	return fs.errno(fs.wrapped.CopyFileRange(ctx, op))
+}
+
+func (fs *errnoFileSystem) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	return fs.errno(fs.wrapped.SyncFile(ctx, op))
+}
+
+func (fs *errnoFileSystem) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	return fs.errno(fs.wrapped.FlushFile(ctx, op))
+}
+
+func (fs *errnoFileSystem) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	return fs.errno(fs.wrapped.ReleaseFileHandle(ctx, op))
+}
+
+func (fs *errnoFileSystem) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	return fs.errno(fs.wrapped.ReadSymlink(ctx, op))
+}
+
+func (fs *errnoFileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	return fs.errno(fs.wrapped.RemoveXattr(ctx, op))
+}
+
+func (fs *errnoFileSystem) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	return fs.errno(fs.wrapped.GetXattr(ctx, op))
+}
+
+func (fs *errnoFileSystem) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	return fs.errno(fs.wrapped.ListXattr(ctx, op))
+}
+
+func (fs *errnoFileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	return fs.errno(fs.wrapped.SetXattr(ctx, op))
+}
+
+func (fs *errnoFileSystem) Destroy() {
+	fs.wrapped.Destroy()
+}
@@ -0,0 +1,128 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"google.golang.org/api/googleapi"
+)
+
+func TestErrno(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ErrnoTest struct {
+}
+
+func init() { RegisterTestSuite(&ErrnoTest{}) }
+
+// Wrap the error a couple of times, the way the file system does on its way
+// to the op boundary.
+func wrap(err error) error {
+	return fmt.Errorf("LookUpInode: %w", fmt.Errorf("StatObject: %w", err))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ErrnoTest) Nil() {
+	ExpectEq(nil, errno(nil))
+}
+
+func (t *ErrnoTest) Errnos() {
+	ExpectEq(syscall.ENOTEMPTY, errno(syscall.ENOTEMPTY))
+	ExpectEq(syscall.EFBIG, errno(wrap(syscall.EFBIG)))
+}
+
+func (t *ErrnoTest) Table() {
+	testCases := []struct {
+		err      error
+		expected syscall.Errno
+	}{
+		{&gcs.NotFoundError{}, syscall.ENOENT},
+		{&gcs.PreconditionError{}, syscall.ESTALE},
+		{&gcsx.PolicyViolationError{}, syscall.EPERM},
+		{gcsx.ErrSnapshotReadOnly, syscall.EROFS},
+		{gcsx.ErrQueryReadOnly, syscall.EROFS},
+		{&gcsx.QueryError{Err: errors.New("taco")}, syscall.EINVAL},
+		{gcsx.ErrWriteBudgetExceeded, syscall.EDQUOT},
+		{&googleapi.Error{Code: 401}, syscall.EACCES},
+		{&googleapi.Error{Code: 403}, syscall.EACCES},
+		{&googleapi.Error{Code: 404}, syscall.ENOENT},
+		{&googleapi.Error{Code: 412}, syscall.ESTALE},
+		{&googleapi.Error{Code: 429}, syscall.EAGAIN},
+		{
+			&googleapi.Error{
+				Code:   403,
+				Errors: []googleapi.ErrorItem{{Reason: "storageQuotaExceeded"}},
+			},
+			syscall.EDQUOT,
+		},
+		{
+			&googleapi.Error{
+				Code:   429,
+				Errors: []googleapi.ErrorItem{{Reason: "quotaExceeded"}},
+			},
+			syscall.EDQUOT,
+		},
+	}
+
+	for i, tc := range testCases {
+		ExpectEq(tc.expected, errno(wrap(tc.err)), "Test case %d: %v", i, tc.err)
+	}
+}
+
+func (t *ErrnoTest) OthersAreUnchanged() {
+	testCases := []error{
+		errors.New("taco"),
+		&googleapi.Error{Code: 500},
+		&googleapi.Error{Code: 503},
+	}
+
+	for i, err := range testCases {
+		err = wrap(err)
+		ExpectEq(err, errno(err), "Test case %d", i)
+	}
+}
+
+func (t *ErrnoTest) Counted() {
+	fs := &errnoFileSystem{errors: new(errorCounts)}
+
+	fs.errno(nil)
+	fs.errno(wrap(syscall.ENOTEMPTY))
+	fs.errno(wrap(&gcs.NotFoundError{}))
+	fs.errno(wrap(&gcs.NotFoundError{}))
+	fs.errno(wrap(&googleapi.Error{Code: 429}))
+	fs.errno(wrap(errors.New("taco")))
+
+	// Errnos chosen by the file system aren't counted, and errors that aren't
+	// translated are counted as EIO.
+	ExpectThat(fs.errors.snapshot(), DeepEquals(map[string]uint64{
+		"ENOENT": 2,
+		"EAGAIN": 1,
+		"EIO":    1,
+	}))
+}
@@ -31,10 +31,10 @@ import (
 
 	"golang.org/x/net/context"
 
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fusetesting"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
 	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
-	"github.com/jacobsa/fuse/fusetesting"
-	"github.com/jacobsa/gcloud/gcs"
-	"github.com/jacobsa/gcloud/gcs/gcsutil"
 	. "github.com/jacobsa/oglematchers"
 	. "github.com/jacobsa/ogletest"
 	"github.com/jacobsa/timeutil"
@@ -156,6 +156,49 @@ func (t *ForeignModsTest) ReadDir_ContentsInRoot() {
 	ExpectEq(currentGid(), e.Sys().(*syscall.Stat_t).Gid)
 }
 
+func (t *ForeignModsTest) ReadDir_EntryTypes() {
+	// Set up a file, a directory, and a symlink.
+	AssertEq(
+		nil,
+		t.createObjects(
+			map[string]string{
+				"foo":  "taco",
+				"bar/": "",
+			}))
+
+	_, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:     "baz",
+			Contents: strings.NewReader(""),
+			Metadata: map[string]string{
+				inode.SymlinkMetadataKey: "foo",
+			},
+		})
+
+	AssertEq(nil, err)
+
+	// Read the directory without statting its entries. The types should be
+	// filled in from the listing, so that tools like find don't need to stat
+	// each entry.
+	f, err := os.Open(t.mfs.Dir())
+	AssertEq(nil, err)
+	defer f.Close()
+
+	entries, err := f.ReadDir(-1)
+	AssertEq(nil, err)
+
+	types := make(map[string]os.FileMode)
+	for _, e := range entries {
+		types[e.Name()] = e.Type()
+	}
+
+	ExpectEq(3, len(types), "Types: %v", types)
+	ExpectEq(0, types["foo"])
+	ExpectEq(os.ModeDir, types["bar"])
+	ExpectEq(os.ModeSymlink, types["baz"])
+}
+
 func (t *ForeignModsTest) ReadDir_EmptySubDirectory() {
 	// Set up an empty directory placeholder called 'bar'.
 	AssertEq(nil, t.createEmptyObjects([]string{"bar/"}))
@@ -651,6 +694,26 @@ func (t *ForeignModsTest) ObjectIsOverwritten_File() {
 	ExpectEq("burrito", string(contents))
 }
 
+func (t *ForeignModsTest) ObjectIsOverwritten_NotYetRead() {
+	// Create an object.
+	AssertEq(nil, t.createWithContents("foo", "taco"))
+
+	// Open the corresponding file for reading, without reading anything so that
+	// nothing is in the kernel's page cache.
+	f, err := os.OpenFile(path.Join(t.mfs.Dir(), "foo"), os.O_RDONLY, 0)
+	AssertEq(nil, err)
+	defer func() {
+		ExpectEq(nil, f.Close())
+	}()
+
+	// Overwrite the object.
+	AssertEq(nil, t.createWithContents("foo", "burrito"))
+
+	// Reading should fail rather than returning data from the new generation.
+	_, err = f.ReadAt(make([]byte, 4), 0)
+	ExpectThat(err, Error(HasSubstr("stale")))
+}
+
 func (t *ForeignModsTest) ObjectIsOverwritten_Directory() {
 	var err error
 
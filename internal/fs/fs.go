@@ -15,21 +15,30 @@
 package fs
 
 import (
+	"container/list"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/googlecloudplatform/gcsfuse/internal/filecache"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseops"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
 	"github.com/googlecloudplatform/gcsfuse/internal/fs/handle"
 	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
 	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
-	"github.com/jacobsa/fuse"
-	"github.com/jacobsa/fuse/fuseops"
-	"github.com/jacobsa/fuse/fuseutil"
-	"github.com/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/lifecycle"
+	"github.com/googlecloudplatform/gcsfuse/internal/readtrace"
 	"github.com/jacobsa/syncutil"
 	"github.com/jacobsa/timeutil"
 	"golang.org/x/net/context"
@@ -37,9 +46,16 @@ import (
 
 type ServerConfig struct {
 	// A clock used for cache expiration. It is *not* used for inode times, for
-	// which we use the wall clock.
+	// which MtimeClock is used. If nil, the wall clock is used.
 	CacheClock timeutil.Clock
 
+	// A clock used for the times of inodes created by the file system, and a
+	// function used to schedule work for later, such as delayed syncs. If nil,
+	// the wall clock and time.AfterFunc are used. Tests embedding the file
+	// system can supply simulated ones to control time deterministically.
+	MtimeClock timeutil.Clock
+	AfterFunc  AfterFunc
+
 	// The bucket that the file system is to export.
 	Bucket gcs.Bucket
 
@@ -59,6 +75,13 @@ type ServerConfig struct {
 	// See docs/semantics.md for more info.
 	ImplicitDirectories bool
 
+	// If set, a directory listing that fails after its first page is completed
+	// from the last complete listing of the directory, when there is one,
+	// rather than failing. Entries up to the point of failure come from the
+	// new listing. Each directory remembers its latest complete listing for as
+	// long as its inode exists.
+	StaleListingFallback bool
+
 	// How long to allow the kernel to cache inode attributes.
 	//
 	// Any given object generation in GCS is immutable, and a new generation
@@ -79,6 +102,20 @@ type ServerConfig struct {
 	// before the expiration, we may fail to find it.
 	DirTypeCacheTTL time.Duration
 
+	// If non-zero, each directory will serve a complete listing again from
+	// memory for this long, rather than listing the bucket each time it is
+	// read. Creating, renaming, and deleting children through the file system
+	// discards the cached listing, but changes made by other means are not seen
+	// until it expires.
+	DirListCacheTTL time.Duration
+
+	// If non-zero, the kernel is allowed to cache the entries of directories
+	// it lists (on Linux 4.20 and later), and to keep serving them from that
+	// cache for this long after it last listed a directory, without asking the
+	// file system. As with DirListCacheTTL, creating, renaming, and deleting
+	// children through the file system discards them.
+	KernelListCacheTTL time.Duration
+
 	// The UID and GID that owns all inodes in the file system.
 	Uid uint32
 	Gid uint32
@@ -101,11 +138,263 @@ type ServerConfig struct {
 	//
 	// 3. Delete the temporary object.
 	//
-	// Note that if the process fails or is interrupted the temporary object will
-	// not be cleaned up, so the user must ensure that TmpObjectPrefix is
-	// periodically garbage collected.
+	// Each mount places its temporary objects under a randomly chosen
+	// subdirectory of TmpObjectPrefix, so that concurrent mounts of the same
+	// bucket never collide. If the process fails or is interrupted the temporary
+	// object will not be cleaned up immediately; instead each mount periodically
+	// deletes stale objects under TmpObjectPrefix, starting when it is mounted.
+	//
+	// Journals recording directory and batch renames in progress are also kept
+	// under TmpObjectPrefix, and recovered by the same process. See journal.go. So
+	// are the parts of parallel uploads, which are collected only once they
+	// are much older than other temporary objects.
 	AppendThreshold int64
 	TmpObjectPrefix string
+
+	// By default, if an object is overwritten or deleted by another actor while
+	// a file handle is reading an earlier generation, further reads from the
+	// handle that must go to GCS fail with ESTALE. Setting this bool to true
+	// instead causes such reads to silently switch to the latest generation.
+	ReadLatestGeneration bool
+
+	// If non-zero, reads through a file handle check for a newer generation of
+	// the backing object at most this often, and continue with it if there is
+	// one, so that files held open for a long time see updates. Implies
+	// ReadLatestGeneration.
+	WatchInterval time.Duration
+
+	// How to fetch data ahead of sequential reads through file handles that go
+	// to GCS. The zero value disables read-ahead.
+	ReadAhead gcsx.ReadAhead
+
+	// If non-nil, called once in the background after mounting to find a
+	// better read-ahead configuration than ReadAhead for this bucket. On
+	// success the result is used for file handles opened afterward. See
+	// read_ahead_tuning.go.
+	TuneReadAhead ReadAheadTuner
+
+	// If non-nil, a cache on local disk of the contents of objects read in full
+	// through file handles, from which later reads of the same generations are
+	// served.
+	FileCache *filecache.Cache
+
+	// If positive, lookups of files in the order in which a directory listed
+	// them, as by grep -r and find -exec, cause the next this many files to be
+	// fetched in the background: statted, and read into FileCache if it is set
+	// and they are small. See traversal_lookahead.go.
+	TraversalLookahead int
+
+	// Patterns, in the syntax of path.Match, naming files that should be opened
+	// with direct I/O, so that the kernel's page cache is bypassed and every
+	// read and write reaches the file system. A pattern containing a slash is
+	// matched against the file's full path within the file system; one without
+	// is matched against its base name.
+	DirectIOPatterns []string
+
+	// Options controlling the empty placeholder objects (e.g. "foo/") that
+	// explicitly define directories. By default mkdir creates them, rmdir
+	// deletes them, and a placeholder alone is enough for a directory to exist.
+	//
+	// If SkipDirPlaceholderCreation is set, mkdir instead creates a directory
+	// that exists only in memory until it gains contents in GCS or is removed.
+	// If HideDirPlaceholders is set, placeholders are ignored entirely. Both
+	// require ImplicitDirectories. If KeepDirPlaceholders is set, rmdir fails
+	// with EPERM for a directory backed by a placeholder rather than deleting
+	// it.
+	SkipDirPlaceholderCreation bool
+	HideDirPlaceholders        bool
+	KeepDirPlaceholders        bool
+
+	// If non-nil, a policy that file contents and names must satisfy before
+	// being written to the bucket. Violations are reported to the user as
+	// EPERM, either when creating or renaming a file with a disallowed name or
+	// when flushing disallowed contents.
+	UploadPolicy *gcsx.UploadPolicy
+
+	// If set, files and directories may be created but existing ones may not be
+	// modified, renamed, or deleted; attempts fail with EPERM. A file created
+	// through the file system may be written until the handle that created it
+	// is released, after which it too is immutable.
+	CreateOnly bool
+
+	// If set, ops that read or write the contents of files, including opening
+	// them, fail with EACCES, so that serving lookups, listings, and stats is
+	// all the file system does with the bucket. See metadata_only.go.
+	MetadataOnly bool
+
+	// If set, ops that would modify the file system, such as creating,
+	// writing, truncating, renaming, or deleting files and directories, fail
+	// with EROFS before anything is done, even if the kernel hasn't been told
+	// that the file system is mounted read-only. See read_only.go.
+	ReadOnly bool
+
+	// If non-empty, the name of a file relative to the root of the file system
+	// that acts as a manifest for renaming objects in bulk. Each time a new
+	// version of the file is flushed, the renames it lists are carried out as
+	// concurrent server-side copies, and a summary is written to a file of the
+	// same name with ".result" appended. See docs/semantics.md for the format.
+	BatchRenameManifest string
+
+	// The largest number of objects that renaming a directory may move,
+	// including its placeholder. Renaming a directory with more fails with
+	// ENOTSUP, so zero permits renaming only directories that exist solely in
+	// memory. See dir_rename.go.
+	RenameDirLimit int
+
+	// If non-nil, files are written as suits the checkpoints written by
+	// machine learning frameworks. See checkpoint.go.
+	Checkpoints *CheckpointConfig
+
+	// The longest object name, in bytes, that creating or renaming a file or
+	// directory may produce. Longer names fail with ENAMETOOLONG. If zero,
+	// MaxObjectNameLength is used. Callers whose bucket adds a prefix to object
+	// names should subtract its length. See name_length.go.
+	MaxNameLength int
+
+	// If non-nil, a JSON record is written here for each generation of a file
+	// that the file system writes to the bucket: when the file is created, each
+	// time it is synced with new contents, and when it is renamed. The record
+	// gives the object's name, generation, size, CRC32C, and update time.
+	UploadLog io.Writer
+
+	// If non-nil, each read that reaches the file system is recorded here, as
+	// a trace that can be replayed to tune caching. See package readtrace.
+	ReadTrace io.Writer
+
+	// If positive, the number of bytes that may be written to the bucket
+	// through the file system. A flush that would go past the budget fails with
+	// EDQUOT, as do creating and writing files once it has been used up.
+	WriteBudget int64
+
+	// If positive, the number of bytes written to files but not yet synced
+	// above which writes wait for syncs to catch up. See dirty_limit.go.
+	DirtyLimit int64
+
+	// If set, writes that would otherwise go ahead regardless of DirtyLimit
+	// because no sync could bring the total down fail with EDQUOT instead.
+	DirtyLimitHard bool
+
+	// If positive, the number of bytes that must stay free on the device
+	// holding TempDir. While there are fewer, writes fail with ENOSPC. See
+	// temp_space.go.
+	TempDirMinFree int64
+
+	// If set, data written strictly sequentially to an empty file is streamed
+	// to GCS as it arrives, rather than staged in a temporary file until the
+	// file is flushed, and the upload is finalized on flush. Ignored if
+	// UploadPolicy or WriteBudget is set, since they must see the contents
+	// before anything is written to the bucket.
+	StreamWrites bool
+
+	// With StreamWrites, the number of bytes of streamed data to collect in
+	// memory before sending them to GCS. If zero, gcsx.DefaultStreamChunkSize
+	// is used.
+	StreamChunkSize int
+
+	// How to download the contents of large objects when they are first read
+	// or modified locally. See gcsx.DownloadTempFile.
+	Download gcsx.ParallelDownload
+
+	// How to upload the contents of large new files. See
+	// gcsx.NewParallelSyncer.
+	Upload gcsx.ParallelUpload
+
+	// If positive, flushing a file (e.g. on close) doesn't sync it to GCS
+	// straight away, but once it has gone this long without being flushed
+	// again, so that a file rewritten several times in quick succession is
+	// uploaded once. fsync still syncs immediately. See sync_delay.go.
+	SyncDelay time.Duration
+
+	// What to do when syncing a file finds that its object has been replaced
+	// or deleted by another writer since the local modifications were made.
+	// The zero value discards the modifications, as though the file had been
+	// unlinked.
+	ConflictPolicy inode.ConflictPolicy
+
+	// If set, file inodes switch to a newer generation of their object that is
+	// at least as large when it is found by a read at the end of the file or
+	// by a stat, so that files that grow remotely can be followed as with
+	// `tail -f`. See inode.FileInode.Follow.
+	TailFollow bool
+
+	// How writes made through different handles for the same file interact.
+	// With anything other than the default of handle.SharedWrites, each handle
+	// writes to a private copy of the file that is reconciled with the file's
+	// contents when the handle is flushed or synced, and files are opened with
+	// direct I/O so that the kernel sends each write with the handle through
+	// which it was made.
+	WriteIsolation handle.WriteIsolation
+
+	// Read-only extended attributes reported for the root directory, by name.
+	// Used to describe the bucket.
+	RootXattrs map[string]string
+
+	// If non-nil, the bucket's lifecycle configuration, used to report what it
+	// will do to files and to what is written under directories.
+	Lifecycle *lifecycle.Config
+
+	// If non-nil, a policy restricting which processes may modify the file
+	// system, identified by the process ID the kernel reports for each op.
+	// Creating, writing, truncating, renaming, and deleting files and
+	// directories, and changing their attributes, fail with EACCES for other
+	// processes.
+	WriterPolicy *WriterPolicy
+
+	// If positive, objects composed of at least this many components (e.g. by
+	// repeated appends) are periodically rewritten in the background as single
+	// objects, once they have gone unmodified for a while and provided they
+	// aren't open in the file system. See compact.go.
+	CompactionThreshold int64
+
+	// If positive, the number of inodes above which the kernel is asked to
+	// forget the least recently looked up inodes that aren't open, keeping
+	// memory use flat during walks of large trees. See inode_limit.go.
+	InodeLimit int
+
+	// If non-nil, called every BucketAccessInterval to find out what the
+	// credentials may do in the bucket. Permission bits that they don't back
+	// up are cleared from the attributes of files and directories, so that
+	// access(2) and the like give truthful answers. See bucket_access.go.
+	BucketAccess         BucketAccessFunc
+	BucketAccessInterval time.Duration
+
+	// If positive, a request denied with HTTP 403 causes further requests for
+	// objects in the same directory to fail with EACCES for this long without
+	// being sent, as suits credentials limited to certain prefixes by IAM
+	// conditions. The directories are reported in the file system's status.
+	// See gcsx.AccessDenialBucket.
+	AccessDenialTTL time.Duration
+
+	// If positive, unconditional deletes, as for unlink and rmdir, succeed
+	// straight away and are carried out in the background by this many
+	// workers, with tombstones hiding the objects until then. fsync on a
+	// directory waits for them. See gcsx.DeferredDeleteBucket.
+	DeferredDeleteWorkers int
+
+	// An opaque identifier for the configuration with which the file system
+	// was mounted, reported in its status so that mounts with different
+	// configurations can be told apart. See status.go.
+	ConfigHash string
+
+	// If set, attached to the new file system so that the caller can manage
+	// it. See admin.go.
+	Admin *Admin
+}
+
+// Return whether the file system must be mounted with the kernel's writeback
+// caching disabled (see fuse.MountConfig.DisableWritebackCaching).
+//
+// With writeback caching, write(2) returns once the data is in the page cache,
+// and the kernel sends it on to us later, when there is nobody left to tell
+// that it was refused. So it must be disabled if writes may be refused for
+// lack of budget, temporary space, or room under a hard dirty limit. It must
+// also be disabled to follow files, since the kernel then trusts its own idea
+// of their sizes, and growth we found would never show in stat(2).
+func (cfg *ServerConfig) DisableWritebackCaching() bool {
+	return cfg.TailFollow ||
+		cfg.WriteBudget > 0 ||
+		cfg.TempDirMinFree > 0 ||
+		(cfg.DirtyLimit > 0 && cfg.DirtyLimitHard)
 }
 
 // Create a fuse file system server according to the supplied configuration.
@@ -117,12 +406,78 @@ func NewServer(cfg *ServerConfig) (server fuse.Server, err error) {
 	}
 
 	if cfg.DirPerms&^os.ModePerm != 0 {
-		err = fmt.Errorf("Illegal dir perms: %v", cfg.FilePerms)
+		err = fmt.Errorf("Illegal dir perms: %v", cfg.DirPerms)
+		return
+	}
+
+	if (cfg.SkipDirPlaceholderCreation || cfg.HideDirPlaceholders) &&
+		!cfg.ImplicitDirectories {
+		err = errors.New(
+			"Skipping or hiding directory placeholders requires implicit directories.")
+		return
+	}
+
+	if cfg.WriterPolicy != nil {
+		err = cfg.WriterPolicy.validate()
+		if err != nil {
+			return
+		}
+	}
+
+	for _, p := range cfg.DirectIOPatterns {
+		if _, err = path.Match(p, ""); err != nil {
+			err = fmt.Errorf("Direct I/O pattern %q: %v", p, err)
+			return
+		}
+	}
+
+	if cfg.CreateOnly && cfg.BatchRenameManifest != "" {
+		err = errors.New("Batch renames are incompatible with create-only mode.")
 		return
 	}
 
+	// Fill in the clocks.
+	cacheClock := cfg.CacheClock
+	if cacheClock == nil {
+		cacheClock = timeutil.RealClock()
+	}
+
+	mtimeClock := cfg.MtimeClock
+	if mtimeClock == nil {
+		mtimeClock = timeutil.RealClock()
+	}
+
+	afterFunc := cfg.AfterFunc
+	if afterFunc == nil {
+		afterFunc = realAfterFunc
+	}
+
+	// Remember denied prefixes, if requested.
+	bucket := cfg.Bucket
+
+	var accessDenials *gcsx.AccessDenialBucket
+	if cfg.AccessDenialTTL > 0 {
+		accessDenials = gcsx.NewAccessDenialBucket(
+			cfg.AccessDenialTTL,
+			cacheClock,
+			bucket)
+
+		bucket = accessDenials
+	}
+
 	// Set up a bucket that infers content types when creating files.
-	bucket := gcsx.NewContentTypeBucket(cfg.Bucket)
+	bucket = gcsx.NewContentTypeBucket(bucket)
+
+	// Put off deletes, if requested.
+	var deferredDeletes *gcsx.DeferredDeleteBucket
+	if cfg.DeferredDeleteWorkers > 0 {
+		deferredDeletes = gcsx.NewDeferredDeleteBucket(
+			cfg.DeferredDeleteWorkers,
+			deferredDeleteBackoff,
+			bucket)
+
+		bucket = deferredDeletes
+	}
 
 	// Create the object syncer.
 	if cfg.TmpObjectPrefix == "" {
@@ -130,21 +485,130 @@ func NewServer(cfg *ServerConfig) (server fuse.Server, err error) {
 		return
 	}
 
+	mountTmpObjectPrefix, err := chooseMountTmpObjectPrefix(cfg.TmpObjectPrefix)
+	if err != nil {
+		err = fmt.Errorf("chooseMountTmpObjectPrefix: %v", err)
+		return
+	}
+
+	uploadPartPrefix, err := chooseMountTmpObjectPrefix(
+		cfg.TmpObjectPrefix + uploadPartDir)
+	if err != nil {
+		err = fmt.Errorf("chooseMountTmpObjectPrefix: %v", err)
+		return
+	}
+
+	operationIDPrefix, err := randomHexString()
+	if err != nil {
+		err = fmt.Errorf("randomHexString: %v", err)
+		return
+	}
+
 	syncer := gcsx.NewSyncer(
 		cfg.AppendThreshold,
-		cfg.TmpObjectPrefix,
+		mountTmpObjectPrefix,
 		bucket)
 
+	if cfg.Upload.Streams > 1 {
+		syncer = gcsx.NewParallelSyncer(
+			cfg.AppendThreshold,
+			cfg.Upload,
+			mountTmpObjectPrefix,
+			uploadPartPrefix,
+			bucket)
+	}
+
+	// Checkpoint mode uploads every large file in parallel, not just new ones.
+	if cfg.Checkpoints != nil && cfg.Checkpoints.UploadParts > 1 {
+		syncer = gcsx.NewParallelSyncer(
+			cfg.AppendThreshold,
+			gcsx.ParallelUpload{
+				Streams:         cfg.Checkpoints.UploadParts,
+				Threshold:       cfg.Checkpoints.ParallelUploadThreshold,
+				RewriteExisting: true,
+			},
+			mountTmpObjectPrefix,
+			uploadPartPrefix,
+			bucket)
+	}
+
+	// Check the upload policy before charging the budget, so that rejected
+	// contents cost nothing.
+	var writeBudget *gcsx.WriteBudget
+	if cfg.WriteBudget > 0 {
+		writeBudget = gcsx.NewWriteBudget(cfg.WriteBudget)
+		syncer = gcsx.NewBudgetedSyncer(writeBudget, syncer)
+	}
+
+	if cfg.UploadPolicy != nil {
+		syncer = gcsx.NewValidatingSyncer(cfg.UploadPolicy, syncer)
+	}
+
+	// Streaming would send contents to the bucket before the policy or the
+	// budget could see them.
+	var streamChunkSize int
+	if cfg.StreamWrites && cfg.UploadPolicy == nil && cfg.WriteBudget <= 0 {
+		streamChunkSize = cfg.StreamChunkSize
+		if streamChunkSize <= 0 {
+			streamChunkSize = gcsx.DefaultStreamChunkSize
+		}
+	}
+
+	maxNameLength := cfg.MaxNameLength
+	if maxNameLength == 0 {
+		maxNameLength = MaxObjectNameLength
+	}
+
 	// Set up the basic struct.
 	fs := &fileSystem{
-		mtimeClock:             timeutil.RealClock(),
-		cacheClock:             cfg.CacheClock,
-		bucket:                 bucket,
-		syncer:                 syncer,
-		tempDir:                cfg.TempDir,
-		implicitDirs:           cfg.ImplicitDirectories,
+		mtimeClock:           mtimeClock,
+		cacheClock:           cacheClock,
+		afterFunc:            afterFunc,
+		bucket:               bucket,
+		syncer:               syncer,
+		tempDir:              cfg.TempDir,
+		implicitDirs:         cfg.ImplicitDirectories,
+		staleListingFallback: cfg.StaleListingFallback,
+		dirPlaceholders: inode.PlaceholderPolicy{
+			SkipCreate: cfg.SkipDirPlaceholderCreation,
+			Hide:       cfg.HideDirPlaceholders,
+		},
+		keepDirPlaceholders:    cfg.KeepDirPlaceholders,
 		inodeAttributeCacheTTL: cfg.InodeAttributeCacheTTL,
 		dirTypeCacheTTL:        cfg.DirTypeCacheTTL,
+		dirListCacheTTL:        cfg.DirListCacheTTL,
+		kernelListCacheTTL:     cfg.KernelListCacheTTL,
+		readLatestGeneration:   cfg.ReadLatestGeneration,
+		watchInterval:          cfg.WatchInterval,
+		readAhead:              cfg.ReadAhead,
+		fileCache:              cfg.FileCache,
+		traversalLookahead:     cfg.TraversalLookahead,
+		lookaheadSem:           make(chan struct{}, cfg.TraversalLookahead),
+		directIOPatterns:       cfg.DirectIOPatterns,
+		uploadPolicy:           cfg.UploadPolicy,
+		writeBudget:            writeBudget,
+		streamChunkSize:        streamChunkSize,
+		download:               cfg.Download,
+		dirtyLimit:             cfg.DirtyLimit,
+		dirtyLimitHard:         cfg.DirtyLimitHard,
+		tempDirMinFree:         cfg.TempDirMinFree,
+		syncDelay:              cfg.SyncDelay,
+		conflicts:              cfg.ConflictPolicy,
+		tailFollow:             cfg.TailFollow,
+		writeIsolation:         cfg.WriteIsolation,
+		rootXattrs:             cfg.RootXattrs,
+		lifecycle:              cfg.Lifecycle,
+		configHash:             cfg.ConfigHash,
+		operationIDPrefix:      operationIDPrefix,
+		accessDenials:          accessDenials,
+		deferredDeletes:        deferredDeletes,
+		errors:                 new(errorCounts),
+		createOnly:             cfg.CreateOnly,
+		batchRenameManifest:    cfg.BatchRenameManifest,
+		renameDirLimit:         cfg.RenameDirLimit,
+		maxNameLength:          maxNameLength,
+		checkpoints:            cfg.Checkpoints,
+		journalPrefix:          cfg.TmpObjectPrefix + journalDir,
 		uid:                    cfg.Uid,
 		gid:                    cfg.Gid,
 		fileMode:               cfg.FilePerms,
@@ -154,6 +618,24 @@ func NewServer(cfg *ServerConfig) (server fuse.Server, err error) {
 		generationBackedInodes: make(map[string]inode.GenerationBackedInode),
 		implicitDirInodes:      make(map[string]inode.DirInode),
 		handles:                make(map[fuseops.HandleID]interface{}),
+		newFiles:               make(map[fuseops.InodeID]fuseops.HandleID),
+		failedFiles:            make(map[fuseops.InodeID]struct{}),
+		delayedSyncs:           make(map[fuseops.InodeID]*delayedSync),
+		inodeLimit:             cfg.InodeLimit,
+		inodeLimitExceeded:     make(chan struct{}, 1),
+		inodeLRUElems:          make(map[fuseops.InodeID]*list.Element),
+		traversals:             make(map[fuseops.InodeID]*traversal),
+		dirtyBytes:             make(map[fuseops.InodeID]int64),
+		dirtyChanged:           make(chan struct{}),
+		changeFeeds:            make(map[fuseops.InodeID]*changeFeed),
+	}
+
+	if cfg.UploadLog != nil {
+		fs.uploadLog = newUploadLog(cfg.UploadLog)
+	}
+
+	if cfg.ReadTrace != nil {
+		fs.readTrace = readtrace.NewWriter(cfg.ReadTrace)
 	}
 
 	// Set up the root inode.
@@ -171,7 +653,9 @@ func NewServer(cfg *ServerConfig) (server fuse.Server, err error) {
 			Mtime: fs.mtimeClock.Now(),
 		},
 		fs.implicitDirs,
+		fs.dirPlaceholders,
 		fs.dirTypeCacheTTL,
+		fs.dirListCacheTTL,
 		fs.bucket,
 		fs.mtimeClock,
 		fs.cacheClock)
@@ -185,12 +669,77 @@ func NewServer(cfg *ServerConfig) (server fuse.Server, err error) {
 	// Set up invariant checking.
 	fs.mu = syncutil.NewInvariantMutex(fs.checkInvariants)
 
-	// Periodically garbage collect temporary objects.
+	// Periodically garbage collect temporary objects, unless we mustn't modify
+	// the bucket, and compact objects if requested.
 	var gcCtx context.Context
 	gcCtx, fs.stopGarbageCollecting = context.WithCancel(context.Background())
-	go garbageCollect(gcCtx, cfg.TmpObjectPrefix, fs.bucket)
+	fs.backgroundCtx = gcCtx
+	if !cfg.ReadOnly {
+		go garbageCollect(gcCtx, cfg.TmpObjectPrefix, fs.bucket)
+	}
+
+	if cfg.CompactionThreshold > 0 {
+		go fs.compactPeriodically(gcCtx, cfg.CompactionThreshold)
+	}
+
+	if cfg.InodeLimit > 0 {
+		go fs.enforceInodeLimit(gcCtx)
+	}
+
+	if cfg.BucketAccess != nil {
+		// Start out with the real access, so that the first attributes handed
+		// to the kernel are already truthful.
+		fs.access = newAccessTracker(cfg.BucketAccess)
+		fs.access.refresh(gcCtx)
+		go fs.access.refreshPeriodically(gcCtx, cfg.BucketAccessInterval)
+	}
+
+	if cfg.TuneReadAhead != nil {
+		go fs.tuneReadAhead(gcCtx, cfg.TuneReadAhead)
+	}
+
+	if cfg.TempDirMinFree > 0 {
+		fs.refreshTempSpace()
+		go fs.watchTempSpace(gcCtx)
+	}
+
+	var wrapped fuseutil.FileSystem = fs
+	if cfg.WriterPolicy != nil {
+		wrapped = &writerCheckingFileSystem{
+			FileSystem: wrapped,
+			policy:     cfg.WriterPolicy,
+		}
+	}
+
+	if cfg.MetadataOnly {
+		wrapped = &metadataOnlyFileSystem{
+			FileSystem: wrapped,
+		}
+	}
+
+	if cfg.ReadOnly {
+		wrapped = &readOnlyFileSystem{
+			FileSystem: wrapped,
+		}
+	}
+
+	wrapped = &drainCheckingFileSystem{
+		FileSystem: wrapped,
+		fs:         fs,
+	}
+
+	server = &connectionRecordingServer{
+		Server: fuseutil.NewFileSystemServer(&errnoFileSystem{
+			wrapped: wrapped,
+			errors:  fs.errors,
+		}),
+		fs: fs,
+	}
+
+	if cfg.Admin != nil {
+		cfg.Admin.attach(fs)
+	}
 
-	server = fuseutil.NewFileSystemServer(fs)
 	return
 }
 
@@ -229,6 +778,7 @@ type fileSystem struct {
 
 	mtimeClock timeutil.Clock
 	cacheClock timeutil.Clock
+	afterFunc  AfterFunc
 	bucket     gcs.Bucket
 	syncer     gcsx.Syncer
 
@@ -238,8 +788,62 @@ type fileSystem struct {
 
 	tempDir                string
 	implicitDirs           bool
+	staleListingFallback   bool
+	dirPlaceholders        inode.PlaceholderPolicy
+	keepDirPlaceholders    bool
 	inodeAttributeCacheTTL time.Duration
 	dirTypeCacheTTL        time.Duration
+	dirListCacheTTL        time.Duration
+	kernelListCacheTTL     time.Duration
+	readLatestGeneration   bool
+	watchInterval          time.Duration
+	fileCache              *filecache.Cache
+	traversalLookahead     int
+	directIOPatterns       []string
+	uploadPolicy           *gcsx.UploadPolicy
+	writeBudget            *gcsx.WriteBudget
+	streamChunkSize        int
+	download               gcsx.ParallelDownload
+	dirtyLimit             int64
+	dirtyLimitHard         bool
+	tempDirMinFree         int64
+	syncDelay              time.Duration
+	conflicts              inode.ConflictPolicy
+	tailFollow             bool
+	writeIsolation         handle.WriteIsolation
+	rootXattrs             map[string]string
+	lifecycle              *lifecycle.Config
+	configHash             string
+	operationIDPrefix      string
+	createOnly             bool
+	batchRenameManifest    string
+	renameDirLimit         int
+	maxNameLength          int
+	checkpoints            *CheckpointConfig
+
+	// The prefix under which journals of in-progress renames are written. See
+	// journal.go.
+	journalPrefix string
+
+	// The log to which objects written are recorded, or nil if none.
+	uploadLog *uploadLog
+
+	// Holds a token for each object being fetched ahead of a traversal, with
+	// room for traversalLookahead. See traversal_lookahead.go.
+	lookaheadSem chan struct{}
+
+	// The trace to which reads are recorded, or nil if none.
+	readTrace *readtrace.Writer
+
+	// Counts of the errors returned to the kernel, shared with the
+	// errnoFileSystem wrapping this one.
+	errors *errorCounts
+
+	// The layer of the bucket remembering denied prefixes, or nil if none.
+	accessDenials *gcsx.AccessDenialBucket
+
+	// The layer of the bucket putting off deletes, or nil if none.
+	deferredDeletes *gcsx.DeferredDeleteBucket
 
 	// The user and group owning everything in the file system.
 	uid uint32
@@ -249,8 +853,22 @@ type fileSystem struct {
 	fileMode os.FileMode
 	dirMode  os.FileMode
 
-	// A function that shuts down the garbage collector.
+	// A function that shuts down the garbage collector, compactor, inode limit
+	// enforcer, access tracker, read-ahead tuning, and any drain, and the
+	// context it cancels to do so.
 	stopGarbageCollecting func()
+	backgroundCtx         context.Context
+
+	// If positive, the number of inodes above which we ask the kernel to forget
+	// some. See inode_limit.go.
+	inodeLimit int
+
+	// Signalled when the number of inodes goes over inodeLimit.
+	inodeLimitExceeded chan struct{}
+
+	// Tracks what the credentials may do in the bucket, or nil if not
+	// enabled. See bucket_access.go.
+	access *accessTracker
 
 	/////////////////////////
 	// Mutable state
@@ -260,6 +878,12 @@ type fileSystem struct {
 	// from per-inode locks). Make sure to see the notes on lock ordering above.
 	mu syncutil.InvariantMutex
 
+	// How to fetch data ahead of sequential reads through new file handles.
+	// May be replaced by the result of tuning.
+	//
+	// GUARDED_BY(mu)
+	readAhead gcsx.ReadAhead
+
 	// The next inode ID to hand out. We assume that this will never overflow,
 	// since even if we were handing out inode IDs at 4 GHz, it would still take
 	// over a century to do so.
@@ -337,6 +961,119 @@ type fileSystem struct {
 	//
 	// GUARDED_BY(mu)
 	nextHandleID fuseops.HandleID
+
+	// In create-only mode, the file inodes that may still be modified because
+	// they were created by this file system, mapped to the handles that created
+	// them. Entries are removed when those handles are released.
+	//
+	// INVARIANT: For each k/v, handles[v] is a *handle.FileHandle for inode k
+	//
+	// GUARDED_BY(mu)
+	newFiles map[fuseops.InodeID]fuseops.HandleID
+
+	// File inodes whose contents may not be what applications wrote, because a
+	// write to them failed or was refused, or the last attempt to sync them
+	// failed. They aren't synced when their last handle is released, since
+	// nobody would hear about the partial contents that would be uploaded.
+	// Entries are removed when the inode is synced successfully.
+	//
+	// INVARIANT: For each k, inodes[k] is a *inode.FileInode
+	//
+	// GUARDED_BY(mu)
+	failedFiles map[fuseops.InodeID]struct{}
+
+	// Syncs waiting for their files to go quiet, keyed by inode ID. Each holds
+	// a lookup count on its inode. See sync_delay.go.
+	//
+	// INVARIANT: For each k/v, v.in.ID() == k
+	//
+	// GUARDED_BY(mu)
+	delayedSyncs map[fuseops.InodeID]*delayedSync
+
+	// The connection being served, or nil if serving hasn't started.
+	//
+	// GUARDED_BY(mu)
+	conn *fuse.Connection
+
+	// If inodeLimit is positive, the IDs of inodes other than the root ordered
+	// from least to most recently looked up, and the element for each.
+	//
+	// INVARIANT: For each k/v in inodeLRUElems, v.Value == k
+	// INVARIANT: For each k in inodeLRUElems, inodes[k] exists
+	// INVARIANT: inodeLRU.Len() == len(inodeLRUElems)
+	//
+	// GUARDED_BY(mu)
+	inodeLRU      list.List
+	inodeLRUElems map[fuseops.InodeID]*list.Element
+
+	// The number of kernel entries invalidated to enforce inodeLimit.
+	//
+	// GUARDED_BY(mu)
+	entriesInvalidated uint64
+
+	// The number of file inodes currently being synced.
+	//
+	// GUARDED_BY(mu)
+	syncsInProgress int
+
+	// The number of batch renames that have been started but have yet to
+	// write their results. See batch_rename.go.
+	//
+	// GUARDED_BY(mu)
+	batchRenamesInProgress int
+
+	// Held while carrying out a batch rename, so that batches started by
+	// flushing the manifest in quick succession run one at a time.
+	batchRenameMu sync.Mutex
+
+	// Set once a drain has started. See drain.go.
+	//
+	// GUARDED_BY(mu)
+	draining bool
+
+	// If traversalLookahead is positive, the files of each directory inode as
+	// of its last listing, for noticing lookups that traverse them. See
+	// traversal_lookahead.go.
+	//
+	// INVARIANT: For each k, inodes[k] exists
+	//
+	// GUARDED_BY(mu)
+	traversals map[fuseops.InodeID]*traversal
+
+	// If dirtyLimit is positive, the bytes written to each file inode since it
+	// was last synced, and their total. See dirty_limit.go.
+	//
+	// INVARIANT: dirtyTotal is the sum of the values of dirtyBytes
+	//
+	// GUARDED_BY(mu)
+	dirtyBytes map[fuseops.InodeID]int64
+	dirtyTotal int64
+
+	// Set when dirtyTotal goes over dirtyLimit, and cleared when it drops to
+	// the low-water mark.
+	//
+	// GUARDED_BY(mu)
+	dirtyThrottled bool
+
+	// Closed and replaced whenever writers waiting for dirtyTotal to drop
+	// should look again.
+	//
+	// GUARDED_BY(mu)
+	dirtyChanged chan struct{}
+
+	// If tempDirMinFree is positive, set while the temporary directory has
+	// less than that many bytes free. See temp_space.go.
+	//
+	// GUARDED_BY(mu)
+	tempSpaceLow bool
+
+	// The change feeds of directories whose changes have been asked for, keyed
+	// by inode ID. See dir_changes.go.
+	//
+	// INVARIANT: For each k, inodes[k] exists
+	//
+	// GUARDED_BY(mu)
+	changeFeeds map[fuseops.InodeID]*changeFeed
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -463,6 +1200,68 @@ func (fs *fileSystem) checkInvariants() {
 		}
 	}
 
+	//////////////////////////////////
+	// inodeLRU
+	//////////////////////////////////
+
+	// INVARIANT: For each k/v in inodeLRUElems, v.Value == k
+	// INVARIANT: For each k in inodeLRUElems, inodes[k] exists
+	for k, v := range fs.inodeLRUElems {
+		if v.Value.(fuseops.InodeID) != k {
+			panic(fmt.Sprintf("LRU element mismatch: %v vs. %v", v.Value, k))
+		}
+
+		if _, ok := fs.inodes[k]; !ok {
+			panic(fmt.Sprintf("Unknown inode in LRU: %v", k))
+		}
+	}
+
+	// INVARIANT: inodeLRU.Len() == len(inodeLRUElems)
+	if fs.inodeLRU.Len() != len(fs.inodeLRUElems) {
+		panic(fmt.Sprintf(
+			"LRU length mismatch: %v vs. %v",
+			fs.inodeLRU.Len(),
+			len(fs.inodeLRUElems)))
+	}
+
+	//////////////////////////////////
+	// traversals
+	//////////////////////////////////
+
+	// INVARIANT: For each k, inodes[k] exists
+	for k, _ := range fs.traversals {
+		if _, ok := fs.inodes[k]; !ok {
+			panic(fmt.Sprintf("Unknown inode in traversals: %v", k))
+		}
+	}
+
+	//////////////////////////////////
+	// changeFeeds
+	//////////////////////////////////
+
+	// INVARIANT: For each k, inodes[k] exists
+	for k, _ := range fs.changeFeeds {
+		if _, ok := fs.inodes[k]; !ok {
+			panic(fmt.Sprintf("Unknown inode in changeFeeds: %v", k))
+		}
+	}
+
+	//////////////////////////////////
+	// dirtyBytes
+	//////////////////////////////////
+
+	// INVARIANT: dirtyTotal is the sum of the values of dirtyBytes
+	{
+		var sum int64
+		for _, n := range fs.dirtyBytes {
+			sum += n
+		}
+
+		if sum != fs.dirtyTotal {
+			panic(fmt.Sprintf("Dirty total mismatch: %v vs. %v", sum, fs.dirtyTotal))
+		}
+	}
+
 	//////////////////////////////////
 	// handles
 	//////////////////////////////////
@@ -487,6 +1286,40 @@ func (fs *fileSystem) checkInvariants() {
 			panic(fmt.Sprintf("Illegal handle ID: %v", k))
 		}
 	}
+
+	//////////////////////////////////
+	// newFiles
+	//////////////////////////////////
+
+	// INVARIANT: For each k/v, handles[v] is a *handle.FileHandle for inode k
+	for k, v := range fs.newFiles {
+		fh, ok := fs.handles[v].(*handle.FileHandle)
+		if !ok || fh.Inode().ID() != k {
+			panic(fmt.Sprintf("Unexpected new file handle for inode %v: %v", k, v))
+		}
+	}
+
+	//////////////////////////////////
+	// failedFiles
+	//////////////////////////////////
+
+	// INVARIANT: For each k, inodes[k] is a *inode.FileInode
+	for k := range fs.failedFiles {
+		if _, ok := fs.inodes[k].(*inode.FileInode); !ok {
+			panic(fmt.Sprintf("Unexpected failed file inode: %v", k))
+		}
+	}
+
+	//////////////////////////////////
+	// delayedSyncs
+	//////////////////////////////////
+
+	// INVARIANT: For each k/v, v.in.ID() == k
+	for k, v := range fs.delayedSyncs {
+		if v.in.ID() != k {
+			panic(fmt.Sprintf("Delayed sync for inode %v under ID %v", v.in.ID(), k))
+		}
+	}
 }
 
 // Implementation detail of lookUpOrCreateInodeIfNotStale; do not use outside
@@ -516,7 +1349,9 @@ func (fs *fileSystem) mintInode(name string, o *gcs.Object) (in inode.Inode) {
 				Mtime: fs.mtimeClock.Now(),
 			},
 			fs.implicitDirs,
+			fs.dirPlaceholders,
 			fs.dirTypeCacheTTL,
+			fs.dirListCacheTTL,
 			fs.bucket,
 			fs.mtimeClock,
 			fs.cacheClock)
@@ -537,7 +1372,9 @@ func (fs *fileSystem) mintInode(name string, o *gcs.Object) (in inode.Inode) {
 				Mtime: fs.mtimeClock.Now(),
 			},
 			fs.implicitDirs,
+			fs.dirPlaceholders,
 			fs.dirTypeCacheTTL,
+			fs.dirListCacheTTL,
 			fs.bucket,
 			fs.mtimeClock,
 			fs.cacheClock)
@@ -564,6 +1401,10 @@ func (fs *fileSystem) mintInode(name string, o *gcs.Object) (in inode.Inode) {
 			fs.bucket,
 			fs.syncer,
 			fs.tempDir,
+			fs.streamChunkSize,
+			fs.download,
+			fs.tailFollow,
+			fs.conflicts,
 			fs.mtimeClock)
 	}
 
@@ -599,6 +1440,7 @@ func (fs *fileSystem) lookUpOrCreateInodeIfNotStale(
 	defer func() {
 		if in != nil {
 			in.IncrementLookupCount()
+			fs.touchInode(in.ID())
 		}
 
 		fs.mu.Unlock()
@@ -709,7 +1551,7 @@ func (fs *fileSystem) lookUpOrCreateChildInode(
 
 		r, err = parent.LookUpChild(ctx, childName)
 		if err != nil {
-			err = fmt.Errorf("LookUpChild: %v", err)
+			err = fmt.Errorf("LookUpChild: %w", err)
 			return
 		}
 
@@ -752,13 +1594,46 @@ func (fs *fileSystem) lookUpOrCreateChildInode(
 func (fs *fileSystem) syncFile(
 	ctx context.Context,
 	f *inode.FileInode) (err error) {
+	oldGen := f.SourceGeneration()
+
+	fs.mu.Lock()
+	fs.syncsInProgress++
+	fs.mu.Unlock()
+
 	// Sync the inode.
 	err = f.Sync(ctx)
+
+	fs.mu.Lock()
+	fs.syncsInProgress--
+	if err == nil {
+		delete(fs.failedFiles, f.ID())
+		fs.releaseDirtyBytes(f.ID())
+	} else {
+		fs.failedFiles[f.ID()] = struct{}{}
+
+		// Writers waiting for this sync may have nothing left to wait for.
+		if fs.dirtyLimit > 0 {
+			fs.wakeDirtyWaiters()
+		}
+	}
+
+	fs.mu.Unlock()
+
 	if err != nil {
-		err = fmt.Errorf("FileInode.Sync: %v", err)
+		err = fmt.Errorf("FileInode.Sync: %w", err)
 		return
 	}
 
+	// Syncing a clean file writes nothing.
+	if f.SourceGeneration() != oldGen {
+		fs.recordUpload(f.Source())
+
+		err = fs.checkSyncedChecksums(f)
+		if err != nil {
+			return
+		}
+	}
+
 	// We need not update fileIndex:
 	//
 	// We've held the inode lock the whole time, so there's no way that this
@@ -772,6 +1647,40 @@ func (fs *fileSystem) syncFile(
 	return
 }
 
+// Apply the writes made through the supplied handle to its inode, then sync
+// the inode, or arrange to later if delay is set.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) reconcileAndSync(
+	ctx context.Context,
+	h fuseops.HandleID,
+	delay bool) (err error) {
+	fs.mu.Lock()
+	fh := fs.handles[h].(*handle.FileHandle)
+	fs.mu.Unlock()
+
+	fh.Lock()
+	defer fh.Unlock()
+
+	in := fh.Inode()
+	in.Lock()
+	defer in.Unlock()
+
+	err = fh.Reconcile(ctx)
+	if err != nil {
+		err = fmt.Errorf("Reconcile: %w", err)
+		return
+	}
+
+	if delay {
+		fs.syncLater(in)
+		return
+	}
+
+	err = fs.syncFileAndMaybeRename(ctx, in)
+	return
+}
+
 // Decrement the supplied inode's lookup count, destroying it if the inode says
 // that it has hit zero.
 //
@@ -792,6 +1701,11 @@ func (fs *fileSystem) unlockAndDecrementLookupCount(
 	// below.
 	if shouldDestroy {
 		delete(fs.inodes, in.ID())
+		delete(fs.traversals, in.ID())
+		delete(fs.changeFeeds, in.ID())
+		delete(fs.failedFiles, in.ID())
+		fs.releaseDirtyBytes(in.ID())
+		fs.untrackInode(in.ID())
 
 		// Update indexes if necessary.
 		if fs.generationBackedInodes[name] == in {
@@ -869,6 +1783,10 @@ func (fs *fileSystem) getAttributes(
 		return
 	}
 
+	if fs.access != nil {
+		fs.access.mask(&attr)
+	}
+
 	// Set up the expiration time.
 	if fs.inodeAttributeCacheTTL > 0 {
 		expiration = time.Now().Add(fs.inodeAttributeCacheTTL)
@@ -918,6 +1836,17 @@ func (fs *fileSystem) fileInodeOrDie(id fuseops.InodeID) (in *inode.FileInode) {
 	return
 }
 
+// Return a context for serving an operation on the supplied file handle,
+// carrying an ID that is sent with the requests to GCS made for it so that
+// they can be found in GCS's audit logs. See gcsx.WithOperationID.
+func (fs *fileSystem) handleContext(
+	ctx context.Context,
+	h fuseops.HandleID) context.Context {
+	return gcsx.WithOperationID(
+		ctx,
+		fmt.Sprintf("%s-%d", fs.operationIDPrefix, h))
+}
+
 // symlinkInodeOrDie returns the symlink inode with the given ID, panicking
 // with a helpful error message if it doesn't exist or is the wrong type.
 //
@@ -938,6 +1867,9 @@ func (fs *fileSystem) symlinkInodeOrDie(
 ////////////////////////////////////////////////////////////////////////
 
 func (fs *fileSystem) Destroy() {
+	// Pending syncs need the background context, so go before stopping it.
+	fs.flushDelayedSyncs()
+	fs.flushDeferredDeletes()
 	fs.stopGarbageCollecting()
 }
 
@@ -960,6 +1892,10 @@ func (fs *fileSystem) StatFS(
 	// faithfully pass on, according to fuseops/ops.go.
 	op.IoSize = 1 << 20
 
+	// Report the longest name that a child of the root may have, which bounds
+	// the names of all other files too.
+	op.NameLen = uint32(fs.maxNameLength)
+
 	return
 }
 
@@ -989,6 +1925,10 @@ func (fs *fileSystem) LookUpInode(
 		return
 	}
 
+	if fs.traversalLookahead > 0 {
+		fs.noteLookUp(op.Parent, op.Name)
+	}
+
 	return
 }
 
@@ -1020,17 +1960,27 @@ func (fs *fileSystem) SetInodeAttributes(
 	// Find the inode.
 	fs.mu.Lock()
 	in := fs.inodeOrDie(op.Inode)
+	file, isFile := in.(*inode.FileInode)
+
+	// Changing mtime or size modifies the backing object.
+	if isFile && (op.Mtime != nil || op.Size != nil) {
+		err = fs.checkModifiable(op.Inode)
+	}
+
 	fs.mu.Unlock()
 
+	if err != nil {
+		return
+	}
+
 	in.Lock()
 	defer in.Unlock()
-	file, isFile := in.(*inode.FileInode)
 
 	// Set file mtimes.
 	if isFile && op.Mtime != nil {
 		err = file.SetMtime(ctx, *op.Mtime)
 		if err != nil {
-			err = fmt.Errorf("SetMtime: %v", err)
+			err = fmt.Errorf("SetMtime: %w", err)
 			return
 		}
 	}
@@ -1038,8 +1988,14 @@ func (fs *fileSystem) SetInodeAttributes(
 	// Truncate files.
 	if isFile && op.Size != nil {
 		err = file.Truncate(ctx, int64(*op.Size))
+
+		// Special case: don't mangle EFBIG.
+		if err == syscall.EFBIG {
+			return
+		}
+
 		if err != nil {
-			err = fmt.Errorf("Truncate: %v", err)
+			err = fmt.Errorf("Truncate: %w", err)
 			return
 		}
 	}
@@ -1049,7 +2005,7 @@ func (fs *fileSystem) SetInodeAttributes(
 	// Fill in the response.
 	op.Attributes, op.AttributesExpiration, err = fs.getAttributes(ctx, in)
 	if err != nil {
-		err = fmt.Errorf("getAttributes: %v", err)
+		err = fmt.Errorf("getAttributes: %w", err)
 		return
 	}
 
@@ -1084,6 +2040,11 @@ func (fs *fileSystem) MkDir(
 	parent := fs.dirInodeOrDie(op.Parent)
 	fs.mu.Unlock()
 
+	err = fs.checkNameLength(parent, op.Name, true)
+	if err != nil {
+		return
+	}
+
 	// Create an empty backing object for the child, failing if it already
 	// exists.
 	parent.Lock()
@@ -1098,15 +2059,21 @@ func (fs *fileSystem) MkDir(
 
 	// Propagate other errors.
 	if err != nil {
-		err = fmt.Errorf("CreateChildDir: %v", err)
+		err = fmt.Errorf("CreateChildDir: %w", err)
 		return
 	}
 
-	// Attempt to create a child inode using the object we created. If we fail to
-	// do so, it means someone beat us to the punch with a newer generation
+	// Attempt to create a child inode using the object we created, or an
+	// implicit directory inode if no placeholder was created. If we fail to do
+	// so, it means someone beat us to the punch with a newer generation
 	// (unlikely, so we're probably okay with failing here).
+	name := path.Join(parent.Name(), op.Name) + "/"
+	if o != nil {
+		name = o.Name
+	}
+
 	fs.mu.Lock()
-	child := fs.lookUpOrCreateInodeIfNotStale(o.Name, o)
+	child := fs.lookUpOrCreateInodeIfNotStale(name, o)
 	if child == nil {
 		err = fmt.Errorf("Newly-created record is already stale")
 		return
@@ -1120,7 +2087,7 @@ func (fs *fileSystem) MkDir(
 	e.Attributes, e.AttributesExpiration, err = fs.getAttributes(ctx, child)
 
 	if err != nil {
-		err = fmt.Errorf("getAttributes: %v", err)
+		err = fmt.Errorf("getAttributes: %w", err)
 		return
 	}
 
@@ -1145,7 +2112,89 @@ func (fs *fileSystem) MkNode(
 	e.Attributes, e.AttributesExpiration, err = fs.getAttributes(ctx, child)
 
 	if err != nil {
-		err = fmt.Errorf("getAttributes: %v", err)
+		err = fmt.Errorf("getAttributes: %w", err)
+		return
+	}
+
+	return
+}
+
+// Record a newly written object in the upload log, if there is one.
+func (fs *fileSystem) recordUpload(o *gcs.Object) {
+	if fs.uploadLog != nil {
+		fs.uploadLog.Record(o)
+	}
+}
+
+// Return EPERM if the upload policy forbids files with the given name.
+func (fs *fileSystem) checkUploadName(name string) (err error) {
+	if fs.uploadPolicy == nil {
+		return
+	}
+
+	err = fs.uploadPolicy.CheckName(name)
+	if err != nil {
+		log.Println(err)
+		err = syscall.EPERM
+		return
+	}
+
+	return
+}
+
+// Return true if there are any file handles open for the inode with the given
+// ID.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) hasFileHandles(id fuseops.InodeID) bool {
+	for _, h := range fs.handles {
+		if fh, ok := h.(*handle.FileHandle); ok && fh.Inode().ID() == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Return true if the file inode with the given name should be opened with
+// direct I/O, according to the configured patterns.
+func (fs *fileSystem) useDirectIO(name string) bool {
+	for _, p := range fs.directIOPatterns {
+		target := name
+		if !strings.Contains(p, "/") {
+			target = path.Base(name)
+		}
+
+		// Patterns were validated by NewServer.
+		if matched, _ := path.Match(p, target); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Return EDQUOT if the write budget has been used up.
+func (fs *fileSystem) checkWriteBudget() (err error) {
+	if fs.writeBudget != nil && fs.writeBudget.Exhausted() {
+		err = syscall.EDQUOT
+		return
+	}
+
+	return
+}
+
+// Return EPERM if the file system is in create-only mode and the file inode
+// with the given ID may not be modified.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) checkModifiable(id fuseops.InodeID) (err error) {
+	if !fs.createOnly {
+		return
+	}
+
+	if _, ok := fs.newFiles[id]; !ok {
+		err = syscall.EPERM
 		return
 	}
 
@@ -1162,11 +2211,34 @@ func (fs *fileSystem) createFile(
 	parentID fuseops.InodeID,
 	name string,
 	mode os.FileMode) (child inode.Inode, err error) {
+	// Refuse names that could never be uploaded.
+	err = fs.checkUploadName(name)
+	if err != nil {
+		return
+	}
+
+	err = fs.checkWriteBudget()
+	if err != nil {
+		return
+	}
+
 	// Find the parent.
 	fs.mu.Lock()
 	parent := fs.dirInodeOrDie(parentID)
 	fs.mu.Unlock()
 
+	err = fs.checkNameLength(parent, name, false)
+	if err != nil {
+		return
+	}
+
+	// Make the rest of a checkpoint durable before its marker appears.
+	err = fs.syncCheckpointBeforeMarker(ctx, parent.Name()+name, 0)
+	if err != nil {
+		err = fmt.Errorf("syncCheckpointBeforeMarker: %w", err)
+		return
+	}
+
 	// Create an empty backing object for the child, failing if it already
 	// exists.
 	parent.Lock()
@@ -1181,7 +2253,7 @@ func (fs *fileSystem) createFile(
 
 	// Propagate other errors.
 	if err != nil {
-		err = fmt.Errorf("CreateChildFile: %v", err)
+		err = fmt.Errorf("CreateChildFile: %w", err)
 		return
 	}
 
@@ -1195,6 +2267,10 @@ func (fs *fileSystem) createFile(
 		return
 	}
 
+	// Record the empty object now, since a file that is never written (e.g. a
+	// marker announcing that a job has finished) is never synced.
+	fs.recordUpload(o)
+
 	return
 }
 
@@ -1218,9 +2294,25 @@ func (fs *fileSystem) CreateFile(
 
 	fs.handles[handleID] = handle.NewFileHandle(
 		child.(*inode.FileInode),
-		fs.bucket)
+		fs.bucket,
+		fs.readLatestGeneration,
+		fs.watchInterval,
+		fs.writeIsolation,
+		fs.readAhead,
+		fs.fileCache,
+		fs.cacheClock)
 	op.Handle = handleID
 
+	// See notes in OpenFile.
+	if fs.writeIsolation != handle.SharedWrites {
+		op.UseDirectIO = true
+	}
+
+	// In create-only mode, the new file may be written through this handle.
+	if fs.createOnly {
+		fs.newFiles[child.ID()] = handleID
+	}
+
 	fs.mu.Unlock()
 
 	// Fill out the response.
@@ -1229,7 +2321,7 @@ func (fs *fileSystem) CreateFile(
 	e.Attributes, e.AttributesExpiration, err = fs.getAttributes(ctx, child)
 
 	if err != nil {
-		err = fmt.Errorf("getAttributes: %v", err)
+		err = fmt.Errorf("getAttributes: %w", err)
 		return
 	}
 
@@ -1245,6 +2337,11 @@ func (fs *fileSystem) CreateSymlink(
 	parent := fs.dirInodeOrDie(op.Parent)
 	fs.mu.Unlock()
 
+	err = fs.checkNameLength(parent, op.Name, false)
+	if err != nil {
+		return
+	}
+
 	// Create the object in GCS, failing if it already exists.
 	parent.Lock()
 	o, err := parent.CreateChildSymlink(ctx, op.Name, op.Target)
@@ -1258,7 +2355,7 @@ func (fs *fileSystem) CreateSymlink(
 
 	// Propagate other errors.
 	if err != nil {
-		err = fmt.Errorf("CreateChildSymlink: %v", err)
+		err = fmt.Errorf("CreateChildSymlink: %w", err)
 		return
 	}
 
@@ -1280,7 +2377,7 @@ func (fs *fileSystem) CreateSymlink(
 	e.Attributes, e.AttributesExpiration, err = fs.getAttributes(ctx, child)
 
 	if err != nil {
-		err = fmt.Errorf("getAttributes: %v", err)
+		err = fmt.Errorf("getAttributes: %w", err)
 		return
 	}
 
@@ -1291,6 +2388,11 @@ func (fs *fileSystem) CreateSymlink(
 func (fs *fileSystem) RmDir(
 	ctx context.Context,
 	op *fuseops.RmDirOp) (err error) {
+	if fs.createOnly {
+		err = syscall.EPERM
+		return
+	}
+
 	// Find the parent.
 	fs.mu.Lock()
 	parent := fs.dirInodeOrDie(op.Parent)
@@ -1324,6 +2426,12 @@ func (fs *fileSystem) RmDir(
 		return
 	}
 
+	// Are we allowed to delete its placeholder, if any?
+	if _, ok := child.(inode.ExplicitDirInode); ok && fs.keepDirPlaceholders {
+		err = syscall.EPERM
+		return
+	}
+
 	// Ensure that the child directory is empty.
 	//
 	// Yes, this is not atomic with the delete below. See here for discussion:
@@ -1336,7 +2444,7 @@ func (fs *fileSystem) RmDir(
 		var entries []fuseutil.Dirent
 		entries, tok, err = childDir.ReadEntries(ctx, tok)
 		if err != nil {
-			err = fmt.Errorf("ReadEntries: %v", err)
+			err = fmt.Errorf("ReadEntries: %w", err)
 			return
 		}
 
@@ -1361,7 +2469,7 @@ func (fs *fileSystem) RmDir(
 	parent.Unlock()
 
 	if err != nil {
-		err = fmt.Errorf("DeleteChildDir: %v", err)
+		err = fmt.Errorf("DeleteChildDir: %w", err)
 		return
 	}
 
@@ -1372,6 +2480,11 @@ func (fs *fileSystem) RmDir(
 func (fs *fileSystem) Rename(
 	ctx context.Context,
 	op *fuseops.RenameOp) (err error) {
+	if fs.createOnly {
+		err = syscall.EPERM
+		return
+	}
+
 	// Find the old and new parents.
 	fs.mu.Lock()
 	oldParent := fs.dirInodeOrDie(op.OldParent)
@@ -1384,7 +2497,7 @@ func (fs *fileSystem) Rename(
 	oldParent.Unlock()
 
 	if err != nil {
-		err = fmt.Errorf("LookUpChild: %v", err)
+		err = fmt.Errorf("LookUpChild: %w", err)
 		return
 	}
 
@@ -1393,25 +2506,44 @@ func (fs *fileSystem) Rename(
 		return
 	}
 
-	// We don't support renaming directories.
+	// Directories are renamed object by object.
 	if inode.IsDirName(lr.FullName) {
-		err = fuse.ENOSYS
+		err = fs.renameDir(ctx, op, oldParent, newParent, lr.FullName)
+		return
+	}
+
+	// Refuse to sidestep the upload policy by renaming.
+	err = fs.checkUploadName(op.NewName)
+	if err != nil {
+		return
+	}
+
+	err = fs.checkNameLength(newParent, op.NewName, false)
+	if err != nil {
+		return
+	}
+
+	err = fs.syncCheckpointBeforeMarker(ctx, newParent.Name()+op.NewName, 0)
+	if err != nil {
+		err = fmt.Errorf("syncCheckpointBeforeMarker: %w", err)
 		return
 	}
 
 	// Clone into the new location.
 	newParent.Lock()
-	_, err = newParent.CloneToChildFile(
+	o, err := newParent.CloneToChildFile(
 		ctx,
 		op.NewName,
 		lr.Object)
 	newParent.Unlock()
 
 	if err != nil {
-		err = fmt.Errorf("CloneToChildFile: %v", err)
+		err = fmt.Errorf("CloneToChildFile: %w", err)
 		return
 	}
 
+	fs.recordUpload(o)
+
 	// Delete behind. Make sure to delete exactly the generation we cloned, in
 	// case the referent of the name has changed in the meantime.
 	oldParent.Lock()
@@ -1423,7 +2555,7 @@ func (fs *fileSystem) Rename(
 	oldParent.Unlock()
 
 	if err != nil {
-		err = fmt.Errorf("DeleteChildFile: %v", err)
+		err = fmt.Errorf("DeleteChildFile: %w", err)
 		return
 	}
 
@@ -1434,6 +2566,11 @@ func (fs *fileSystem) Rename(
 func (fs *fileSystem) Unlink(
 	ctx context.Context,
 	op *fuseops.UnlinkOp) (err error) {
+	if fs.createOnly {
+		err = syscall.EPERM
+		return
+	}
+
 	// Find the parent.
 	fs.mu.Lock()
 	parent := fs.dirInodeOrDie(op.Parent)
@@ -1450,7 +2587,7 @@ func (fs *fileSystem) Unlink(
 		nil) // No meta-generation precondition
 
 	if err != nil {
-		err = fmt.Errorf("DeleteChildFile: %v", err)
+		err = fmt.Errorf("DeleteChildFile: %w", err)
 		return
 	}
 
@@ -1462,7 +2599,6 @@ func (fs *fileSystem) OpenDir(
 	ctx context.Context,
 	op *fuseops.OpenDirOp) (err error) {
 	fs.mu.Lock()
-	defer fs.mu.Unlock()
 
 	// Make sure the inode still exists and is a directory. If not, something has
 	// screwed up because the VFS layer shouldn't have let us forget the inode
@@ -1473,9 +2609,22 @@ func (fs *fileSystem) OpenDir(
 	handleID := fs.nextHandleID
 	fs.nextHandleID++
 
-	fs.handles[handleID] = newDirHandle(in, fs.implicitDirs)
+	fs.handles[handleID] = newDirHandle(
+		in,
+		fs.implicitDirs,
+		fs.staleListingFallback)
 	op.Handle = handleID
 
+	fs.mu.Unlock()
+
+	// Let the kernel cache the entries, if configured to.
+	if fs.kernelListCacheTTL > 0 {
+		in.Lock()
+		op.CacheDir = true
+		op.KeepCache = in.KeepKernelListing(fs.kernelListCacheTTL)
+		in.Unlock()
+	}
+
 	return
 }
 
@@ -1493,6 +2642,14 @@ func (fs *fileSystem) ReadDir(
 
 	// Serve the request.
 	err = dh.ReadDir(ctx, op)
+	if err != nil {
+		return
+	}
+
+	// Listings start from offset zero.
+	if fs.traversalLookahead > 0 && op.Offset == 0 {
+		fs.recordListing(dh)
+	}
 
 	return
 }
@@ -1513,12 +2670,40 @@ func (fs *fileSystem) ReleaseDirHandle(
 	return
 }
 
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) SyncDir(
+	ctx context.Context,
+	op *fuseops.SyncDirOp) (err error) {
+	// Special case: deletes are the only changes to directories that are ever
+	// left for later.
+	if fs.deferredDeletes == nil {
+		return
+	}
+
+	err = fs.deferredDeletes.Flush(ctx)
+	if err != nil {
+		err = fmt.Errorf("Flush: %w", err)
+		return
+	}
+
+	return
+}
+
 // LOCKS_EXCLUDED(fs.mu)
 func (fs *fileSystem) OpenFile(
 	ctx context.Context,
 	op *fuseops.OpenFileOp) (err error) {
 	fs.mu.Lock()
-	defer fs.mu.Unlock()
+
+	// Refuse to open unmodifiable files for writing up front, since with
+	// writeback caching the writes themselves would appear to succeed.
+	if op.Flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		err = fs.checkModifiable(op.Inode)
+		if err != nil {
+			fs.mu.Unlock()
+			return
+		}
+	}
 
 	// Find the inode.
 	in := fs.fileInodeOrDie(op.Inode)
@@ -1527,14 +2712,43 @@ func (fs *fileSystem) OpenFile(
 	handleID := fs.nextHandleID
 	fs.nextHandleID++
 
-	fs.handles[handleID] = handle.NewFileHandle(in, fs.bucket)
+	fs.handles[handleID] = handle.NewFileHandle(
+		in,
+		fs.bucket,
+		fs.readLatestGeneration,
+		fs.watchInterval,
+		fs.writeIsolation,
+		fs.readAhead,
+		fs.fileCache,
+		fs.cacheClock)
 	op.Handle = handleID
 
-	// When we observe object generations that we didn't create, we assign them
-	// new inode IDs. So for a given inode, all modifications go through the
-	// kernel. Therefore it's safe to tell the kernel to keep the page cache from
-	// open to open for a given inode.
-	op.KeepPageCache = true
+	fs.mu.Unlock()
+
+	// Special case: with isolated writes, each handle has its own view of the
+	// file, which the page cache shared between them would defeat. Writes
+	// through it would also be sent with whichever handle the kernel chose
+	// when writing back, rather than the one through which they were made.
+	if fs.writeIsolation != handle.SharedWrites {
+		op.UseDirectIO = true
+		return
+	}
+
+	// Special case: files configured to bypass the page cache.
+	if fs.useDirectIO(in.Name()) {
+		op.UseDirectIO = true
+		return
+	}
+
+	// When we observe object generations that we didn't create, we usually
+	// assign them new inode IDs, so that for a given inode all modifications go
+	// through the kernel and it's safe to tell the kernel to keep the page
+	// cache from open to open. But an inode following a growing object moves
+	// to new generations in place, so check that the generation the pages
+	// were read from is still current.
+	in.Lock()
+	op.KeepPageCache = in.KeepPageCache()
+	in.Unlock()
 
 	return
 }
@@ -1543,6 +2757,8 @@ func (fs *fileSystem) OpenFile(
 func (fs *fileSystem) ReadFile(
 	ctx context.Context,
 	op *fuseops.ReadFileOp) (err error) {
+	ctx = fs.handleContext(ctx, op.Handle)
+
 	// Find the handle and lock it.
 	fs.mu.Lock()
 	fh := fs.handles[op.Handle].(*handle.FileHandle)
@@ -1551,6 +2767,21 @@ func (fs *fileSystem) ReadFile(
 	fh.Lock()
 	defer fh.Unlock()
 
+	// Record the read, if asked to.
+	if fs.readTrace != nil {
+		in := fh.Inode()
+		in.Lock()
+		size := in.Source().Size
+		in.Unlock()
+
+		fs.readTrace.Record(
+			uint64(op.Handle),
+			in.Name(),
+			size,
+			op.Offset,
+			len(op.Dst))
+	}
+
 	// Serve the read.
 	op.BytesRead, err = fh.Read(ctx, op.Dst, op.Offset)
 
@@ -1584,11 +2815,64 @@ func (fs *fileSystem) ReadSymlink(
 func (fs *fileSystem) WriteFile(
 	ctx context.Context,
 	op *fuseops.WriteFileOp) (err error) {
+	ctx = fs.handleContext(ctx, op.Handle)
+
+	// Whatever the reason, a write that doesn't happen leaves the file without
+	// the contents the application meant it to have.
+	defer func() {
+		if err != nil {
+			fs.mu.Lock()
+			fs.failedFiles[op.Inode] = struct{}{}
+			fs.mu.Unlock()
+		}
+	}()
+
 	// Find the inode.
 	fs.mu.Lock()
 	in := fs.fileInodeOrDie(op.Inode)
+	err = fs.checkModifiable(op.Inode)
+	if err == nil {
+		err = fs.checkTempSpace()
+	}
 	fs.mu.Unlock()
 
+	if err != nil {
+		return
+	}
+
+	// Stop writers early once there's no budget left to flush what they write.
+	err = fs.checkWriteBudget()
+	if err != nil {
+		return
+	}
+
+	// Hold writers back while syncs catch up, if there's a dirty limit.
+	if fs.dirtyLimit > 0 {
+		err = fs.waitForDirtyBytes(ctx)
+		if err != nil {
+			return
+		}
+
+		defer func() {
+			if err == nil {
+				fs.addDirtyBytes(op.Inode, int64(len(op.Data)))
+			}
+		}()
+	}
+
+	// Special case: write to the handle's private copy of the file.
+	if fs.writeIsolation != handle.SharedWrites {
+		fs.mu.Lock()
+		fh := fs.handles[op.Handle].(*handle.FileHandle)
+		fs.mu.Unlock()
+
+		fh.Lock()
+		defer fh.Unlock()
+
+		err = fh.Write(ctx, op.Data, op.Offset)
+		return
+	}
+
 	in.Lock()
 	defer in.Unlock()
 
@@ -1598,20 +2882,98 @@ func (fs *fileSystem) WriteFile(
 	return
 }
 
+// Copies of whole files, as made by cp, are served by composing the source
+// object over the destination within GCS. We return EOPNOTSUPP for any other
+// copy, telling the kernel to fall back to reading and writing the data.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) (err error) {
+	// Find the inodes.
+	fs.mu.Lock()
+	src := fs.fileInodeOrDie(op.InputInode)
+	dst := fs.fileInodeOrDie(op.OutputInode)
+	err = fs.checkModifiable(op.OutputInode)
+	fs.mu.Unlock()
+
+	if err != nil {
+		return
+	}
+
+	// The upload policy and write budget inspect data as it's synced, which a
+	// copy within GCS would bypass.
+	if fs.uploadPolicy != nil ||
+		fs.writeBudget != nil ||
+		src == dst ||
+		op.InputOffset != 0 ||
+		op.OutputOffset != 0 {
+		err = syscall.EOPNOTSUPP
+		return
+	}
+
+	// Find the generation to copy, which must hold the whole of the source's
+	// contents. We may not hold both inode locks at once, but the generation
+	// can be copied later regardless of what happens to the source meanwhile.
+	var o *gcs.Object
+	src.Lock()
+	if src.SourceGenerationIsAuthoritative() {
+		o = src.Source()
+	}
+	src.Unlock()
+
+	if o == nil || o.Size > op.Length {
+		err = syscall.EOPNOTSUPP
+		return
+	}
+
+	// Copy it.
+	dst.Lock()
+	defer dst.Unlock()
+
+	oldGen := dst.SourceGeneration()
+	err = dst.CopyFrom(ctx, o)
+	if err != nil {
+		return
+	}
+
+	if dst.SourceGeneration() != oldGen {
+		fs.recordUpload(dst.Source())
+		op.BytesCopied = o.Size
+	}
+
+	return
+}
+
 // LOCKS_EXCLUDED(fs.mu)
 func (fs *fileSystem) SyncFile(
 	ctx context.Context,
 	op *fuseops.SyncFileOp) (err error) {
+	ctx = fs.handleContext(ctx, op.Handle)
+
 	// Find the inode.
 	fs.mu.Lock()
 	in := fs.fileInodeOrDie(op.Inode)
 	fs.mu.Unlock()
 
+	// Special case: sync the rest of a checkpoint before its marker.
+	err = fs.syncCheckpointBeforeMarker(ctx, in.Name(), in.ID())
+	if err != nil {
+		err = fmt.Errorf("syncCheckpointBeforeMarker: %w", err)
+		return
+	}
+
+	// Special case: apply the handle's isolated writes first.
+	if fs.writeIsolation != handle.SharedWrites {
+		err = fs.reconcileAndSync(ctx, op.Handle, false)
+		return
+	}
+
 	in.Lock()
 	defer in.Unlock()
 
 	// Sync it.
-	err = fs.syncFile(ctx, in)
+	err = fs.syncFileAndMaybeRename(ctx, in)
 
 	return
 }
@@ -1620,16 +2982,41 @@ func (fs *fileSystem) SyncFile(
 func (fs *fileSystem) FlushFile(
 	ctx context.Context,
 	op *fuseops.FlushFileOp) (err error) {
+	ctx = fs.handleContext(ctx, op.Handle)
+
 	// Find the inode.
 	fs.mu.Lock()
 	in := fs.fileInodeOrDie(op.Inode)
 	fs.mu.Unlock()
 
+	// Special case: a checkpoint marker is synced straight away, after the
+	// rest of its checkpoint.
+	delay := fs.syncDelay > 0
+	if fs.isCheckpointMarker(in.Name()) {
+		delay = false
+		err = fs.syncCheckpointBeforeMarker(ctx, in.Name(), in.ID())
+		if err != nil {
+			err = fmt.Errorf("syncCheckpointBeforeMarker: %w", err)
+			return
+		}
+	}
+
+	// Special case: apply the handle's isolated writes first.
+	if fs.writeIsolation != handle.SharedWrites {
+		err = fs.reconcileAndSync(ctx, op.Handle, delay)
+		return
+	}
+
 	in.Lock()
 	defer in.Unlock()
 
-	// Sync it.
-	err = fs.syncFile(ctx, in)
+	// Sync it, or arrange to once it has been left alone for a while.
+	if delay {
+		fs.syncLater(in)
+		return
+	}
+
+	err = fs.syncFileAndMaybeRename(ctx, in)
 
 	return
 }
@@ -1638,14 +3025,324 @@ func (fs *fileSystem) FlushFile(
 func (fs *fileSystem) ReleaseFileHandle(
 	ctx context.Context,
 	op *fuseops.ReleaseFileHandleOp) (err error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+	ctx = fs.handleContext(ctx, op.Handle)
 
-	// Destroy the handle.
-	fs.handles[op.Handle].(*handle.FileHandle).Destroy()
+	fs.mu.Lock()
 
-	// Update the map.
+	// Update the maps.
+	fh := fs.handles[op.Handle].(*handle.FileHandle)
 	delete(fs.handles, op.Handle)
 
+	in := fh.Inode()
+	if h, ok := fs.newFiles[in.ID()]; ok && h == op.Handle {
+		delete(fs.newFiles, in.ID())
+	}
+
+	last := !fs.hasFileHandles(in.ID())
+	fs.mu.Unlock()
+
+	// Destroy the handle. A drain may be using it concurrently.
+	fh.Lock()
+	fh.Destroy()
+	fh.Unlock()
+
+	if fs.readTrace != nil {
+		fs.readTrace.Forget(uint64(op.Handle))
+	}
+
+	// Modifications made through a shared memory mapping can reach us after the
+	// file descriptor used to create it has been closed and flushed, when the
+	// kernel writes back dirty pages as the mapping is torn down. No flush
+	// follows those, so sync them now. There's nobody left to report errors to,
+	// so log them instead.
+	//
+	// With a sync delay, they are left to the delayed sync instead.
+	//
+	// If an earlier write or sync failed, the contents may be incomplete and
+	// whoever wrote them has been told so. Don't upload them behind their back.
+	if last {
+		fs.mu.Lock()
+		_, failed := fs.failedFiles[in.ID()]
+		fs.mu.Unlock()
+
+		if failed {
+			log.Printf(
+				"Not syncing %q on release, since an earlier write or sync failed.",
+				in.Name())
+
+			return
+		}
+	}
+
+	if last && fs.syncDelay > 0 {
+		in.Lock()
+		fs.syncLater(in)
+		in.Unlock()
+	} else if last {
+		in.Lock()
+		syncErr := fs.syncFileAndMaybeRename(ctx, in)
+		in.Unlock()
+
+		if syncErr != nil {
+			log.Printf("Syncing %q on release: %v", in.Name(), syncErr)
+		}
+	}
+
+	return
+}
+
+// The extended attribute through which file inodes report the checksums that
+// gcsfuse computed when the current generation was last read or written in
+// full, and whether they matched those reported by GCS. See gcsx.Checksums for
+// the format.
+const checksumsXattr = "user.gcs.verified"
+
+// Return the value of checksumsXattr for the supplied inode, if it has one.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) checksumsXattrValue(id fuseops.InodeID) (v string, ok bool) {
+	fs.mu.Lock()
+	in := fs.inodeOrDie(id)
+	fs.mu.Unlock()
+
+	file, isFile := in.(*inode.FileInode)
+	if !isFile {
+		return
+	}
+
+	file.Lock()
+	defer file.Unlock()
+
+	if c := file.Checksums(); c != nil {
+		v = c.String()
+		ok = true
+	}
+
+	return
+}
+
+// The extended attribute through which files and directories report what the
+// bucket's lifecycle rules and retention policy will do to the object backing
+// a file, or to objects written under a directory now. See lifecycle.Fate for
+// the format.
+const lifecycleXattr = "user.gcsfuse.lifecycle"
+
+// Return the value of lifecycleXattr for the supplied inode, if it has one.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) lifecycleXattrValue(id fuseops.InodeID) (v string, ok bool) {
+	if fs.lifecycle == nil {
+		return
+	}
+
+	fs.mu.Lock()
+	in := fs.inodeOrDie(id)
+	fs.mu.Unlock()
+
+	in.Lock()
+	defer in.Unlock()
+
+	s := lifecycle.Subject{
+		Name:    in.Name(),
+		Created: fs.mtimeClock.Now(),
+	}
+
+	switch in := in.(type) {
+	case *inode.FileInode:
+		// Dirty contents will be written to a new generation, created with the
+		// bucket's default storage class, when they are flushed.
+		if in.SourceGenerationIsAuthoritative() {
+			s.StorageClass = in.Source().StorageClass
+			s.Created = in.Source().Created
+			s.CustomTime = in.Source().CustomTime
+			s.TemporaryHold = in.Source().TemporaryHold
+		}
+
+	case inode.DirInode:
+		s.Prefix = true
+
+	default:
+		return
+	}
+
+	v = lifecycle.FormatFates(fs.lifecycle.Advise(s))
+	ok = true
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) (err error) {
+	// Special case: the kernel asks about other attributes often (e.g.
+	// security.capability before each write), so answer those without locking
+	// anything.
+	var v string
+	var ok bool
+	switch {
+	case op.Inode == fuseops.RootInodeID && op.Name == inodesXattr:
+		v, ok = fs.inodesXattrValue(), true
+
+	case op.Inode == fuseops.RootInodeID && op.Name == StatusXattr:
+		v, err = fs.statusXattrValue()
+		if err != nil {
+			err = fmt.Errorf("statusXattrValue: %v", err)
+			return
+		}
+
+		ok = true
+
+	case op.Name == lifecycleXattr:
+		v, ok = fs.lifecycleXattrValue(op.Inode)
+
+	case op.Name == listFilterXattr:
+		v, ok = fs.listFilterXattrValue(op.Inode)
+
+	case strings.HasPrefix(op.Name, changesXattrPrefix):
+		v, ok, err = fs.changesXattrValue(ctx, op.Inode, op.Name)
+		if err != nil {
+			err = fmt.Errorf("changesXattrValue: %w", err)
+			return
+		}
+
+	case isObjectXattr(op.Name):
+		var xattrs map[string]string
+		xattrs, err = fs.objectXattrs(op.Inode)
+		if err != nil {
+			err = fmt.Errorf("objectXattrs: %w", err)
+			return
+		}
+
+		v, ok = xattrs[op.Name]
+
+	case op.Inode == fuseops.RootInodeID:
+		v, ok = fs.rootXattrs[op.Name]
+
+	case op.Name == checksumsXattr:
+		v, ok = fs.checksumsXattrValue(op.Inode)
+	}
+
+	if !ok {
+		err = fuse.ENOATTR
+		return
+	}
+
+	// Asking with too small a buffer (including an empty one) is how the size
+	// is queried.
+	op.BytesRead = len(v)
+	if len(op.Dst) < len(v) {
+		err = syscall.ERANGE
+		return
+	}
+
+	copy(op.Dst, v)
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) (err error) {
+	var sorted []string
+	if op.Inode == fuseops.RootInodeID {
+		sorted = append(sorted, inodesXattr, StatusXattr)
+		for name := range fs.rootXattrs {
+			sorted = append(sorted, name)
+		}
+	} else {
+		if _, ok := fs.checksumsXattrValue(op.Inode); ok {
+			sorted = append(sorted, checksumsXattr)
+		}
+
+		var xattrs map[string]string
+		xattrs, err = fs.objectXattrs(op.Inode)
+		if err != nil {
+			err = fmt.Errorf("objectXattrs: %w", err)
+			return
+		}
+
+		for name := range xattrs {
+			sorted = append(sorted, name)
+		}
+	}
+
+	if _, ok := fs.lifecycleXattrValue(op.Inode); ok {
+		sorted = append(sorted, lifecycleXattr)
+	}
+
+	if _, ok := fs.listFilterXattrValue(op.Inode); ok {
+		sorted = append(sorted, listFilterXattr)
+	}
+
+	sort.Strings(sorted)
+
+	var names string
+	for _, name := range sorted {
+		names += name + "\x00"
+	}
+
+	op.BytesRead = len(names)
+	if len(op.Dst) < len(names) {
+		err = syscall.ERANGE
+		return
+	}
+
+	copy(op.Dst, names)
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) (err error) {
+	if op.Name == listFilterXattr {
+		v := string(op.Value)
+		err = fs.setListFilterXattr(op.Inode, &v, op.Flags)
+		return
+	}
+
+	if isPropertyXattr(op.Name) {
+		v := string(op.Value)
+		err = fs.setPropertyXattr(ctx, op.Inode, op.Name, &v, op.Flags)
+		return
+	}
+
+	if isObjectXattr(op.Name) {
+		v := string(op.Value)
+		err = fs.setMetadataXattr(ctx, op.Inode, op.Name, &v, op.Flags)
+		return
+	}
+
+	// The only other attribute that can be set is the one that starts a drain.
+	if op.Inode != fuseops.RootInodeID || op.Name != DrainXattr {
+		err = syscall.ENOTSUP
+		return
+	}
+
+	fs.startDrain()
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) (err error) {
+	if op.Name == listFilterXattr {
+		err = fs.setListFilterXattr(op.Inode, nil, 0)
+		return
+	}
+
+	// Otherwise only attributes backed by the object can be removed.
+	if !isObjectXattr(op.Name) {
+		err = syscall.ENOTSUP
+		return
+	}
+
+	if isPropertyXattr(op.Name) {
+		err = fs.setPropertyXattr(ctx, op.Inode, op.Name, nil, 0)
+		return
+	}
+
+	err = fs.setMetadataXattr(ctx, op.Inode, op.Name, nil, 0)
 	return
 }
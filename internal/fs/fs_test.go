@@ -29,12 +29,12 @@ import (
 	"testing"
 	"time"
 
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
 	"github.com/googlecloudplatform/gcsfuse/internal/fs"
 	"github.com/googlecloudplatform/gcsfuse/internal/perms"
-	"github.com/jacobsa/fuse"
-	"github.com/jacobsa/gcloud/gcs"
-	"github.com/jacobsa/gcloud/gcs/gcsfake"
-	"github.com/jacobsa/gcloud/gcs/gcsutil"
 	. "github.com/jacobsa/ogletest"
 	"github.com/jacobsa/timeutil"
 	"golang.org/x/net/context"
@@ -133,6 +133,11 @@ func (t *fsTest) SetUp(ti *TestInfo) {
 	mountCfg := t.mountCfg
 	mountCfg.OpContext = t.ctx
 
+	// Mount the way gcsfuse would with this configuration.
+	if t.serverCfg.DisableWritebackCaching() {
+		mountCfg.DisableWritebackCaching = true
+	}
+
 	const loggingFlags = log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile
 	if mountCfg.ErrorLogger == nil {
 		mountCfg.ErrorLogger = log.New(os.Stderr, "fuse_errors: ", loggingFlags)
@@ -146,6 +151,13 @@ func (t *fsTest) SetUp(ti *TestInfo) {
 	AssertEq(nil, err)
 }
 
+// Make sure that writes reach the file system before write(2) returns, rather
+// than sitting in the kernel's page cache until the file is flushed, for tests
+// that look at files while they are open and dirty. Call before SetUp.
+func (t *fsTest) disableWritebackCaching() {
+	t.mountCfg.DisableWritebackCaching = true
+}
+
 func (t *fsTest) TearDown() {
 	var err error
 
@@ -15,23 +15,39 @@
 package fs
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
+	"strings"
 	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/context"
 
-	"github.com/jacobsa/gcloud/gcs"
-	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
 	"github.com/jacobsa/syncutil"
 )
 
+// Temporary objects and journals older than this are assumed to have been
+// abandoned by a mount that crashed or was interrupted.
+const stalenessThreshold = 30 * time.Minute
+
+// Parts of parallel uploads are stored under this name within the temporary
+// object prefix. A large upload can take hours, all the while relying on the
+// parts uploaded first, so parts are left alone until they are older than
+// uploadPartStalenessThreshold, which is far longer than any upload could
+// take.
+const uploadPartDir = "parts/"
+
+const uploadPartStalenessThreshold = 7 * 24 * time.Hour
+
 func garbageCollectOnce(
 	ctx context.Context,
 	tmpObjectPrefix string,
 	bucket gcs.Bucket) (objectsDeleted uint64, err error) {
-	const stalenessThreshold = 30 * time.Minute
 	b := syncutil.NewBundle(ctx)
 
 	// List all objects with the temporary prefix.
@@ -53,7 +69,17 @@ func garbageCollectOnce(
 	b.Add(func(ctx context.Context) (err error) {
 		defer close(staleNames)
 		for o := range objects {
-			if now.Sub(o.Updated) < stalenessThreshold {
+			threshold := stalenessThreshold
+			if isUploadPart(tmpObjectPrefix, o.Name) {
+				threshold = uploadPartStalenessThreshold
+			}
+
+			if now.Sub(o.Updated) < threshold {
+				continue
+			}
+
+			// Journals are cleaned up by recoverJournals.
+			if isJournal(tmpObjectPrefix, o.Name) {
 				continue
 			}
 
@@ -93,8 +119,50 @@ func garbageCollectOnce(
 	return
 }
 
-// Periodically delete stale temporary objects from the supplied bucket until
-// the context is cancelled.
+// Choose a prefix for this mount's temporary objects, nested within the
+// supplied prefix, that is very unlikely to be in use by any other mount. This
+// ensures that concurrent writers never see each other's in-progress temporary
+// objects, while a single garbage collection pass over the outer prefix still
+// finds the junk left behind by mounts that crashed.
+func chooseMountTmpObjectPrefix(
+	tmpObjectPrefix string) (mountPrefix string, err error) {
+	s, err := randomHexString()
+	if err != nil {
+		err = fmt.Errorf("randomHexString: %v", err)
+		return
+	}
+
+	mountPrefix = tmpObjectPrefix + s + "/"
+	return
+}
+
+// Is the named object within the upload part directory under the supplied
+// temporary object prefix?
+func isUploadPart(tmpObjectPrefix string, name string) bool {
+	return strings.HasPrefix(name, tmpObjectPrefix+uploadPartDir)
+}
+
+// Return a random string suitable for use in object names that should not
+// collide with those chosen by any other process.
+func randomHexString() (s string, err error) {
+	var buf [8]byte
+	_, err = io.ReadFull(rand.Reader, buf[:])
+	if err != nil {
+		err = fmt.Errorf("ReadFull: %v", err)
+		return
+	}
+
+	s = hex.EncodeToString(buf[:])
+	return
+}
+
+// Delete stale temporary objects from the supplied bucket, once immediately
+// (to clean up after any previous mount that crashed) and then periodically
+// until the context is cancelled.
+//
+// Before each pass, recover any stale journals left behind by interrupted
+// renames. Younger journals may belong to renames still in progress in
+// another mount, so are left alone.
 func garbageCollect(
 	ctx context.Context,
 	tmpObjectPrefix string,
@@ -103,12 +171,25 @@ func garbageCollect(
 	ticker := time.NewTicker(period)
 	defer ticker.Stop()
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
+	for first := true; ; first = false {
+		if !first {
+			select {
+			case <-ctx.Done():
+				return
+
+			case <-ticker.C:
+			}
+		}
 
-		case <-ticker.C:
+		journalsRecovered, err := recoverJournals(
+			ctx,
+			tmpObjectPrefix+journalDir,
+			bucket)
+
+		if err != nil {
+			log.Printf("Journal recovery failed: %v", err)
+		} else if journalsRecovered > 0 {
+			log.Printf("Recovered %d journals.", journalsRecovered)
 		}
 
 		log.Println("Starting a garbage collection run.")
@@ -0,0 +1,130 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Tests for garbage collection of temporary objects.
+
+package fs_test
+
+import (
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const (
+	staleTmpObjectName = ".gcsfuse_tmp/0123456789abcdef/taco"
+	uploadPartName     = ".gcsfuse_tmp/parts/0123456789abcdef/burrito"
+)
+
+type GarbageCollectionTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&GarbageCollectionTest{}) }
+
+func (t *GarbageCollectionTest) SetUp(ti *TestInfo) {
+	t.bucket = newBucketWithStaleTmpObjects(ti.Ctx)
+
+	// Mounting should cause garbage collection.
+	t.fsTest.SetUp(ti)
+}
+
+// Create a bucket containing a temporary object and an upload part an hour
+// old, as if left behind by another mount.
+func newBucketWithStaleTmpObjects(ctx context.Context) (bucket gcs.Bucket) {
+	var clock timeutil.SimulatedClock
+	clock.SetTime(time.Now().Add(-time.Hour))
+	bucket = gcsfake.NewFakeBucket(&clock, "some_bucket")
+
+	for _, name := range []string{staleTmpObjectName, uploadPartName} {
+		_, err := gcsutil.CreateObject(ctx, bucket, name, []byte("taco"))
+		AssertEq(nil, err)
+	}
+
+	return
+}
+
+// Wait for the stale temporary object to be deleted by the garbage collector,
+// which runs in the background.
+func (t *GarbageCollectionTest) waitForCollection() {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := t.bucket.StatObject(
+			t.ctx,
+			&gcs.StatObjectRequest{Name: staleTmpObjectName})
+
+		if _, ok := err.(*gcs.NotFoundError); ok {
+			return
+		}
+
+		AssertEq(nil, err)
+		if time.Now().After(deadline) {
+			AddFailure("Temporary object was not collected.")
+			AbortTest()
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *GarbageCollectionTest) UploadPartsOutliveStalenessThreshold() {
+	t.waitForCollection()
+
+	// A parallel upload may still be relying on the part.
+	_, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: uploadPartName})
+
+	ExpectEq(nil, err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Read-only
+////////////////////////////////////////////////////////////////////////
+
+type ReadOnlyGarbageCollectionTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&ReadOnlyGarbageCollectionTest{}) }
+
+func (t *ReadOnlyGarbageCollectionTest) SetUp(ti *TestInfo) {
+	t.bucket = newBucketWithStaleTmpObjects(ti.Ctx)
+	t.serverCfg.ReadOnly = true
+	t.fsTest.SetUp(ti)
+}
+
+func (t *ReadOnlyGarbageCollectionTest) NothingIsCollected() {
+	// Give a garbage collector the chance to run, if one was started.
+	time.Sleep(100 * time.Millisecond)
+
+	_, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: staleTmpObjectName})
+
+	ExpectEq(nil, err)
+}
@@ -17,11 +17,15 @@ package handle
 import (
 	"fmt"
 	"io"
+	"syscall"
+	"time"
 
+	"github.com/googlecloudplatform/gcsfuse/internal/filecache"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
 	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
 	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
-	"github.com/jacobsa/gcloud/gcs"
 	"github.com/jacobsa/syncutil"
+	"github.com/jacobsa/timeutil"
 	"golang.org/x/net/context"
 )
 
@@ -29,8 +33,33 @@ type FileHandle struct {
 	inode  *inode.FileInode
 	bucket gcs.Bucket
 
+	// If set, when the generation being read is overwritten by another actor,
+	// switch to reading the latest generation rather than failing with ESTALE.
+	readLatest bool
+
+	// If non-zero, the minimum interval between checks for a newer generation
+	// made while reading. See NewFileHandle.
+	watchInterval time.Duration
+	clock         timeutil.Clock
+
+	// How to fetch data ahead of sequential reads.
+	readAhead gcsx.ReadAhead
+
+	// If non-nil, a cache of object contents from which to serve reads, and to
+	// which to add objects read in full. See NewFileHandle.
+	cache *filecache.Cache
+
+	// How writes through this handle interact with those through others for
+	// the same inode. See NewFileHandle.
+	isolation WriteIsolation
+
 	mu syncutil.InvariantMutex
 
+	// The time at which we last checked for a newer generation.
+	//
+	// GUARDED_BY(mu)
+	lastWatch time.Time
+
 	// A random reader configured to some (potentially previous) generation of
 	// the object backing the inode, or nil.
 	//
@@ -38,14 +67,68 @@ type FileHandle struct {
 	//
 	// GUARDED_BY(mu)
 	reader gcsx.RandomReader
+
+	// The checksums most recently reported to the inode, used to avoid
+	// reporting the same ones repeatedly.
+	//
+	// GUARDED_BY(mu)
+	reportedChecksums *gcsx.Checksums
+
+	// With isolated writes, a private copy of the inode's contents made at the
+	// first write through this handle since it was last reconciled, to which
+	// that and later writes go. Otherwise nil.
+	//
+	// INVARIANT: If isolation == SharedWrites, shadow == nil
+	//
+	// GUARDED_BY(mu)
+	shadow gcsx.TempFile
+
+	// The byte ranges of shadow written through this handle, sorted, disjoint,
+	// and non-adjacent.
+	//
+	// INVARIANT: If shadow == nil, len(written) == 0
+	//
+	// GUARDED_BY(mu)
+	written []byteRange
 }
 
+// NewFileHandle creates a handle for the supplied inode. If readLatest is set,
+// reads continue with the latest generation of the backing object when the
+// generation being read is overwritten by another actor. Otherwise they fail
+// with ESTALE, so that callers never see a mix of contents from different
+// generations.
+//
+// If watchInterval is non-zero, reads also stat the backing object at most
+// once per interval, and switch to a newer generation as soon as one is
+// found rather than when the one being read disappears. This implies
+// readLatest.
+//
+// Unless isolation is SharedWrites, writes must be made through the handle
+// with Write, which keeps them in a private copy of the file until Reconcile
+// applies them to the inode according to the policy.
+//
+// Reads that go to GCS and are sequential have data fetched ahead of them as
+// configured by readAhead. If cache is non-nil, reads of a generation it holds
+// are served from it instead, and generations read in full are added to it.
 func NewFileHandle(
 	inode *inode.FileInode,
-	bucket gcs.Bucket) (fh *FileHandle) {
+	bucket gcs.Bucket,
+	readLatest bool,
+	watchInterval time.Duration,
+	isolation WriteIsolation,
+	readAhead gcsx.ReadAhead,
+	cache *filecache.Cache,
+	clock timeutil.Clock) (fh *FileHandle) {
 	fh = &FileHandle{
-		inode:  inode,
-		bucket: bucket,
+		inode:         inode,
+		bucket:        bucket,
+		readLatest:    readLatest || watchInterval != 0,
+		watchInterval: watchInterval,
+		isolation:     isolation,
+		readAhead:     readAhead,
+		cache:         cache,
+		clock:         clock,
+		lastWatch:     clock.Now(),
 	}
 
 	fh.mu = syncutil.NewInvariantMutex(fh.checkInvariants)
@@ -59,6 +142,8 @@ func (fh *FileHandle) Destroy() {
 	if fh.reader != nil {
 		fh.reader.Destroy()
 	}
+
+	fh.discardShadow()
 }
 
 // Inode returns the inode backing this handle.
@@ -75,7 +160,8 @@ func (fh *FileHandle) Unlock() {
 }
 
 // Equivalent to locking fh.Inode() and calling fh.Inode().Read, but may be
-// more efficient.
+// more efficient. If the handle has writes not yet reconciled with the inode,
+// reads are served from its private copy instead.
 //
 // LOCKS_REQUIRED(fh)
 // LOCKS_EXCLUDED(fh.inode)
@@ -83,6 +169,16 @@ func (fh *FileHandle) Read(
 	ctx context.Context,
 	dst []byte,
 	offset int64) (n int, err error) {
+	// Special case: read our own writes.
+	if fh.shadow != nil {
+		n, err = fh.shadow.ReadAt(dst, offset)
+		if err != nil && err != io.EOF {
+			err = fmt.Errorf("shadow.ReadAt: %v", err)
+		}
+
+		return
+	}
+
 	// Lock the inode and attempt to ensure that we have a reader for its current
 	// state, or clear fh.reader if it's not possible to create one (probably
 	// because the inode is dirty).
@@ -90,7 +186,7 @@ func (fh *FileHandle) Read(
 	err = fh.tryEnsureReader()
 	if err != nil {
 		fh.inode.Unlock()
-		err = fmt.Errorf("tryEnsureReader: %v", err)
+		err = fmt.Errorf("tryEnsureReader: %w", err)
 		return
 	}
 
@@ -101,13 +197,58 @@ func (fh *FileHandle) Read(
 	if fh.reader != nil {
 		fh.inode.Unlock()
 
+		err = fh.maybeWatch(ctx)
+		if err != nil {
+			err = fmt.Errorf("maybeWatch: %w", err)
+			return
+		}
+
 		n, err = fh.reader.ReadAt(ctx, dst, offset)
+
+		// Special case: the generation we were reading has been clobbered.
+		if _, ok := err.(*gcs.NotFoundError); ok {
+			n, err = fh.handleClobbered(ctx, dst, offset)
+		}
+
+		// If the reader has now seen the whole object, report the result of
+		// verifying it to the inode, once.
+		if c := fh.reader.Checksums(); c != nil && c != fh.reportedChecksums {
+			fh.inode.Lock()
+			fh.inode.RecordChecksums(c)
+			fh.inode.Unlock()
+			fh.reportedChecksums = c
+		}
+
+		// Special case: the file may have grown since the generation we were
+		// reading, in which case read on from the new one.
+		if err == io.EOF {
+			var followed bool
+			fh.inode.Lock()
+			followed, err = fh.inode.Follow(ctx)
+			fh.inode.Unlock()
+
+			if err != nil {
+				err = fmt.Errorf("Follow: %w", err)
+				return
+			}
+
+			if !followed {
+				err = io.EOF
+				return
+			}
+
+			var m int
+			m, err = fh.Read(ctx, dst[n:], offset+int64(n))
+			n += m
+			return
+		}
+
 		switch {
-		case err == io.EOF:
+		case err == syscall.ESTALE:
 			return
 
 		case err != nil:
-			err = fmt.Errorf("fh.reader.ReadAt: %v", err)
+			err = fmt.Errorf("fh.reader.ReadAt: %w", err)
 			return
 		}
 
@@ -121,16 +262,173 @@ func (fh *FileHandle) Read(
 	return
 }
 
+// Write serves a write made through this handle, which must have been
+// created with isolated writes, by applying it to the handle's private copy of
+// the file. The copy is made from the inode's current contents at the first
+// write since the handle was last reconciled.
+//
+// LOCKS_REQUIRED(fh)
+// LOCKS_EXCLUDED(fh.inode)
+func (fh *FileHandle) Write(
+	ctx context.Context,
+	data []byte,
+	offset int64) (err error) {
+	if fh.isolation == SharedWrites {
+		panic("Write called for a handle with shared writes")
+	}
+
+	// Refuse to grow beyond what GCS can store, as the inode would.
+	if offset+int64(len(data)) > gcsx.MaxObjectSize {
+		err = syscall.EFBIG
+		return
+	}
+
+	// Make our copy if necessary.
+	if fh.shadow == nil {
+		fh.inode.Lock()
+		fh.shadow, err = fh.inode.CloneContent(ctx)
+		fh.inode.Unlock()
+
+		if err != nil {
+			err = fmt.Errorf("CloneContent: %w", err)
+			return
+		}
+	}
+
+	// Write to it. Note that io.WriterAt guarantees it returns an error for
+	// short writes.
+	_, err = fh.shadow.WriteAt(data, offset)
+	if err != nil {
+		err = fmt.Errorf("shadow.WriteAt: %v", err)
+		return
+	}
+
+	fh.written = addRange(
+		fh.written,
+		byteRange{offset, offset + int64(len(data))})
+
+	return
+}
+
+// Reconcile applies the writes made through this handle since it was last
+// reconciled to the inode, according to the handle's policy, and discards its
+// private copy of the file. The caller is responsible for then syncing the
+// inode. If an error is returned, the writes remain to be reconciled again
+// later.
+//
+// LOCKS_REQUIRED(fh)
+// LOCKS_REQUIRED(fh.inode)
+func (fh *FileHandle) Reconcile(ctx context.Context) (err error) {
+	if fh.shadow == nil {
+		return
+	}
+
+	// Decide what to copy.
+	var ranges []byteRange
+	switch fh.isolation {
+	case LastCloseWins:
+		var sr gcsx.StatResult
+		sr, err = fh.shadow.Stat()
+		if err != nil {
+			err = fmt.Errorf("shadow.Stat: %v", err)
+			return
+		}
+
+		err = fh.inode.Truncate(ctx, sr.Size)
+		if err != nil {
+			err = fmt.Errorf("Truncate: %w", err)
+			return
+		}
+
+		ranges = []byteRange{{0, sr.Size}}
+
+	case MergeWrites:
+		ranges = fh.written
+
+	default:
+		panic(fmt.Sprintf("Unexpected isolation: %v", fh.isolation))
+	}
+
+	// Copy it.
+	buf := make([]byte, reconcileBufferSize)
+	for _, r := range ranges {
+		for off := r.start; off < r.limit; {
+			n := int64(len(buf))
+			if r.limit-off < n {
+				n = r.limit - off
+			}
+
+			_, err = fh.shadow.ReadAt(buf[:n], off)
+			if err != nil {
+				err = fmt.Errorf("shadow.ReadAt: %v", err)
+				return
+			}
+
+			err = fh.inode.Write(ctx, buf[:n], off)
+			if err != nil {
+				err = fmt.Errorf("Write: %w", err)
+				return
+			}
+
+			off += n
+		}
+	}
+
+	fh.discardShadow()
+	return
+}
+
 ////////////////////////////////////////////////////////////////////////
 // Helpers
 ////////////////////////////////////////////////////////////////////////
 
+// The size of the chunks in which Reconcile copies data to the inode.
+const reconcileBufferSize = 1 << 20
+
 // LOCKS_REQUIRED(fh.mu)
 func (fh *FileHandle) checkInvariants() {
 	// INVARIANT: If reader != nil, reader.CheckInvariants() doesn't panic.
 	if fh.reader != nil {
 		fh.reader.CheckInvariants()
 	}
+
+	// INVARIANT: If isolation == SharedWrites, shadow == nil
+	if fh.isolation == SharedWrites && fh.shadow != nil {
+		panic("Shadow copy for a handle with shared writes")
+	}
+
+	// INVARIANT: If shadow == nil, len(written) == 0
+	if fh.shadow == nil && len(fh.written) != 0 {
+		panic(fmt.Sprintf("Written ranges without a shadow copy: %v", fh.written))
+	}
+}
+
+// Throw away the private copy of the file, if any.
+//
+// LOCKS_REQUIRED(fh)
+func (fh *FileHandle) discardShadow() {
+	if fh.shadow != nil {
+		fh.shadow.Destroy()
+		fh.shadow = nil
+	}
+
+	fh.written = nil
+}
+
+// Create a random reader for the supplied generation, reading through the
+// file cache if there is one.
+func (fh *FileHandle) newReader(o *gcs.Object) (rr gcsx.RandomReader, err error) {
+	rr, err = gcsx.NewRandomReader(o, fh.bucket, fh.readAhead)
+	if err != nil {
+		err = fmt.Errorf("NewRandomReader: %v", err)
+		return
+	}
+
+	if fh.cache != nil {
+		rr = gcsx.NewCachingRandomReader(rr, fh.cache, fh.bucket.Name())
+	}
+
+	return
 }
 
 // If possible, ensure that fh.reader is set to an appropriate random reader
@@ -151,9 +449,12 @@ func (fh *FileHandle) tryEnsureReader() (err error) {
 	}
 
 	// If we already have a reader, and it's at the appropriate generation, we
-	// can use it. Otherwise we must throw it away.
+	// can use it. Otherwise we must throw it away. A reader for a newer
+	// generation than the inode's can only have come from handleClobbered.
 	if fh.reader != nil {
-		if fh.reader.Object().Generation == fh.inode.SourceGeneration().Object {
+		readerGen := fh.reader.Object().Generation
+		srcGen := fh.inode.SourceGeneration().Object
+		if readerGen == srcGen || (fh.readLatest && readerGen > srcGen) {
 			return
 		}
 
@@ -162,12 +463,122 @@ func (fh *FileHandle) tryEnsureReader() (err error) {
 	}
 
 	// Attempt to create an appropriate reader.
-	rr, err := gcsx.NewRandomReader(fh.inode.Source(), fh.bucket)
+	rr, err := fh.newReader(fh.inode.Source())
 	if err != nil {
-		err = fmt.Errorf("NewRandomReader: %v", err)
+		err = fmt.Errorf("newReader: %w", err)
 		return
 	}
 
 	fh.reader = rr
 	return
 }
+
+// If watching and a watch interval has passed since the last check, stat the
+// object and switch fh.reader to a newer generation if there is one.
+//
+// LOCKS_REQUIRED(fh)
+// LOCKS_EXCLUDED(fh.inode)
+func (fh *FileHandle) maybeWatch(ctx context.Context) (err error) {
+	if fh.watchInterval == 0 {
+		return
+	}
+
+	now := fh.clock.Now()
+	if now.Sub(fh.lastWatch) < fh.watchInterval {
+		return
+	}
+
+	fh.lastWatch = now
+
+	o, err := fh.bucket.StatObject(
+		ctx,
+		&gcs.StatObjectRequest{Name: fh.reader.Object().Name})
+
+	// If the object is gone, leave it to the read to discover that.
+	if _, ok := err.(*gcs.NotFoundError); ok {
+		err = nil
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("StatObject: %w", err)
+		return
+	}
+
+	if o.Generation <= fh.reader.Object().Generation {
+		return
+	}
+
+	rr, err := fh.newReader(o)
+	if err != nil {
+		err = fmt.Errorf("newReader: %w", err)
+		return
+	}
+
+	fh.reader.Destroy()
+	fh.reader = rr
+
+	return
+}
+
+// Deal with the generation being read by fh.reader having been overwritten or
+// deleted. If the inode follows the object to a larger generation, retry the
+// read from there. Otherwise either return ESTALE or, if configured to do so,
+// switch fh.reader to the latest generation and retry the read.
+//
+// LOCKS_REQUIRED(fh)
+// LOCKS_EXCLUDED(fh.inode)
+func (fh *FileHandle) handleClobbered(
+	ctx context.Context,
+	dst []byte,
+	offset int64) (n int, err error) {
+	fh.inode.Lock()
+	followed, err := fh.inode.Follow(ctx)
+	fh.inode.Unlock()
+
+	if err != nil {
+		err = fmt.Errorf("Follow: %w", err)
+		return
+	}
+
+	if followed {
+		n, err = fh.Read(ctx, dst, offset)
+		return
+	}
+
+	if !fh.readLatest {
+		err = syscall.ESTALE
+		return
+	}
+
+	o, err := fh.bucket.StatObject(
+		ctx,
+		&gcs.StatObjectRequest{Name: fh.reader.Object().Name})
+
+	// If the object is gone entirely, there is nothing to read.
+	if _, ok := err.(*gcs.NotFoundError); ok {
+		err = syscall.ESTALE
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("StatObject: %w", err)
+		return
+	}
+
+	rr, err := fh.newReader(o)
+	if err != nil {
+		err = fmt.Errorf("newReader: %w", err)
+		return
+	}
+
+	fh.reader.Destroy()
+	fh.reader = rr
+
+	n, err = fh.reader.ReadAt(ctx, dst, offset)
+	if _, ok := err.(*gcs.NotFoundError); ok {
+		err = syscall.ESTALE
+	}
+
+	return
+}
@@ -0,0 +1,127 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handle
+
+import (
+	"fmt"
+)
+
+// WriteIsolation says how writes made through different handles for the same
+// file interact.
+type WriteIsolation int
+
+const (
+	// All handles write to the inode's contents directly, so each sees the
+	// others' writes as soon as they are made.
+	SharedWrites WriteIsolation = iota
+
+	// Each handle writes to a private copy of the file, made at its first
+	// write. When the handle is flushed, its copy replaces the file's contents
+	// wholesale, discarding anything written through other handles meanwhile.
+	LastCloseWins
+
+	// Each handle writes to a private copy of the file as for LastCloseWins,
+	// but when it is flushed only the byte ranges written through it are
+	// applied to the file's contents, on top of whatever other handles have
+	// flushed meanwhile.
+	MergeWrites
+)
+
+// ParseWriteIsolation parses a policy in the form accepted by
+// --write-isolation: "shared", "last-close-wins", or "merge".
+func ParseWriteIsolation(s string) (wi WriteIsolation, err error) {
+	switch s {
+	case "shared":
+		wi = SharedWrites
+
+	case "last-close-wins":
+		wi = LastCloseWins
+
+	case "merge":
+		wi = MergeWrites
+
+	default:
+		err = fmt.Errorf(
+			"Unknown write isolation policy %q; must be shared, "+
+				"last-close-wins, or merge",
+			s)
+	}
+
+	return
+}
+
+func (wi WriteIsolation) String() string {
+	switch wi {
+	case SharedWrites:
+		return "shared"
+
+	case LastCloseWins:
+		return "last-close-wins"
+
+	case MergeWrites:
+		return "merge"
+	}
+
+	return fmt.Sprintf("WriteIsolation(%d)", int(wi))
+}
+
+// A half-open range of byte offsets [start, limit).
+type byteRange struct {
+	start int64
+	limit int64
+}
+
+// Add the range r to the supplied sorted list of disjoint, non-adjacent
+// ranges, coalescing it with any that it overlaps or abuts.
+func addRange(rs []byteRange, r byteRange) (result []byteRange) {
+	if r.start >= r.limit {
+		result = rs
+		return
+	}
+
+	added := false
+	for _, x := range rs {
+		switch {
+		// x lies wholly before r.
+		case x.limit < r.start:
+			result = append(result, x)
+
+		// x lies wholly after r, which must be emitted first.
+		case x.start > r.limit:
+			if !added {
+				result = append(result, r)
+				added = true
+			}
+
+			result = append(result, x)
+
+		// x overlaps or abuts r, so absorb it.
+		default:
+			if x.start < r.start {
+				r.start = x.start
+			}
+
+			if x.limit > r.limit {
+				r.limit = x.limit
+			}
+		}
+	}
+
+	if !added {
+		result = append(result, r)
+	}
+
+	return
+}
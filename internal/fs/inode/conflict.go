@@ -0,0 +1,85 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inode
+
+import (
+	"fmt"
+)
+
+// ConflictPolicy says what a file inode does when a sync finds that another
+// writer has replaced or deleted the generation its local modifications are
+// based on. The sync is made with preconditions on that generation, so in no
+// case are the other writer's changes overwritten.
+type ConflictPolicy int
+
+const (
+	// Treat the file as though it had been unlinked: the sync succeeds, and the
+	// local modifications are never written to GCS.
+	DiscardOnConflict ConflictPolicy = iota
+
+	// Fail the sync with a *gcs.PreconditionError (seen by the kernel as
+	// ESTALE). The local modifications remain readable through the inode, and
+	// later syncs fail in the same way.
+	FailOnConflict
+
+	// Write the local contents to a conflict copy beside the object, named by
+	// ConflictCopyName, then treat the file as for DiscardOnConflict. Later
+	// syncs overwrite the copy with the latest local contents.
+	CopyOnConflict
+)
+
+// ParseConflictPolicy parses a policy in the form accepted by --on-conflict:
+// "discard", "fail", or "copy".
+func ParseConflictPolicy(s string) (p ConflictPolicy, err error) {
+	switch s {
+	case "discard":
+		p = DiscardOnConflict
+
+	case "fail":
+		p = FailOnConflict
+
+	case "copy":
+		p = CopyOnConflict
+
+	default:
+		err = fmt.Errorf(
+			"Unknown conflict policy %q; must be discard, fail, or copy",
+			s)
+	}
+
+	return
+}
+
+func (p ConflictPolicy) String() string {
+	switch p {
+	case DiscardOnConflict:
+		return "discard"
+
+	case FailOnConflict:
+		return "fail"
+
+	case CopyOnConflict:
+		return "copy"
+	}
+
+	return fmt.Sprintf("ConflictPolicy(%d)", int(p))
+}
+
+// ConflictCopyName returns the name of the object to which CopyOnConflict
+// writes the local contents of the named object, whose modifications were
+// based on the supplied generation.
+func ConflictCopyName(name string, generation int64) string {
+	return fmt.Sprintf("%s.conflict-%d", name, generation)
+}
@@ -21,9 +21,9 @@ import (
 	"sync"
 	"time"
 
-	"github.com/jacobsa/fuse/fuseops"
-	"github.com/jacobsa/fuse/fuseutil"
-	"github.com/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseops"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
 	"github.com/jacobsa/syncutil"
 	"github.com/jacobsa/timeutil"
 	"golang.org/x/net/context"
@@ -61,6 +61,22 @@ func (lr *LookUpResult) Exists() bool {
 	return lr.Object != nil || lr.ImplicitDir
 }
 
+// PlaceholderPolicy controls how a directory inode treats the empty
+// placeholder objects (e.g. "foo/") that explicitly define child directories.
+// The zero value creates and honors placeholders. Both options require
+// implicit directories to be enabled, since otherwise directories could only
+// be defined by placeholders.
+type PlaceholderPolicy struct {
+	// If set, CreateChildDir doesn't create a placeholder object. Instead the
+	// inode remembers the new child directory in memory, treating it as an
+	// implicit directory until it is deleted with DeleteChildDir.
+	SkipCreate bool
+
+	// If set, placeholder objects are ignored, so that a directory exists only
+	// if it is implicitly defined by other objects.
+	Hide bool
+}
+
 // An inode representing a directory, with facilities for listing entries,
 // looking up children, and creating and deleting children. Must be locked for
 // any method additional to the Inode interface.
@@ -102,6 +118,28 @@ type DirInode interface {
 		ctx context.Context,
 		tok string) (entries []fuseutil.Dirent, newTok string, err error)
 
+	// Remember the supplied entries, read with ReadEntries from start to end,
+	// as the latest complete listing of the directory.
+	RecordListing(entries []fuseutil.Dirent)
+
+	// Return the entries most recently supplied to RecordListing, or nil if
+	// there have been none. The caller must not modify the result.
+	LastListing() (entries []fuseutil.Dirent)
+
+	// Return the pattern, relative to the directory, to which ReadEntries limits
+	// the names of the objects it lists, or "" if it lists them all.
+	ListFilter() (pattern string)
+
+	// Set the pattern returned by ListFilter, with the syntax of gcs.ParseGlob,
+	// forgetting any listings read with the previous one.
+	SetListFilter(pattern string)
+
+	// Return true if the kernel may go on using the entries it cached when the
+	// directory was last opened, because that was less than ttl ago and no
+	// child has since been changed through the inode. Otherwise return false,
+	// and record that the kernel is about to list the directory afresh.
+	KeepKernelListing(ttl time.Duration) (keep bool)
+
 	// Create an empty child file with the supplied (relative) name, failing with
 	// *gcs.PreconditionError if a backing object already exists in GCS.
 	CreateChildFile(
@@ -126,6 +164,10 @@ type DirInode interface {
 	// Create a backing object for a child directory with the supplied (relative)
 	// name, failing with *gcs.PreconditionError if a backing object already
 	// exists in GCS.
+	//
+	// If the inode's placeholder policy says not to create placeholders, return
+	// a nil object and a nil error instead; the child is then an implicit
+	// directory.
 	CreateChildDir(
 		ctx context.Context,
 		name string) (o *gcs.Object, err error)
@@ -143,10 +185,15 @@ type DirInode interface {
 		metaGeneration *int64) (err error)
 
 	// Delete the backing object for the child directory with the given
-	// (relative) name.
+	// (relative) name, and forget the child if it was created without one.
 	DeleteChildDir(
 		ctx context.Context,
 		name string) (err error)
+
+	// Forget what is cached about the child with the given (relative) name,
+	// after its backing objects have been changed by other means, e.g. by
+	// renaming a directory object by object.
+	ForgetChild(name string)
 }
 
 type dirInode struct {
@@ -164,12 +211,17 @@ type dirInode struct {
 
 	id           fuseops.InodeID
 	implicitDirs bool
+	placeholders PlaceholderPolicy
 
 	// INVARIANT: name == "" || name[len(name)-1] == '/'
 	name string
 
 	attrs fuseops.InodeAttributes
 
+	// How long a complete listing read with ReadEntries may be served again
+	// from memory, or zero if listings aren't cached.
+	listCacheTTL time.Duration
+
 	/////////////////////////
 	// Mutable state
 	/////////////////////////
@@ -185,6 +237,54 @@ type dirInode struct {
 	//
 	// GUARDED_BY(mu)
 	cache typeCache
+
+	// The latest time at which we've observed a child (or the backing object)
+	// being created or modified in a listing, or a child being created or
+	// deleted by our own hand. Zero if we've observed no such thing.
+	//
+	// GUARDED_BY(mu)
+	childMtime time.Time
+
+	// Child directories created with CreateChildDir under a placeholder policy
+	// with SkipCreate set, which have not since been deleted. They are reported
+	// to exist regardless of what is in the bucket.
+	//
+	// GUARDED_BY(mu)
+	localDirs map[string]struct{}
+
+	// The entries of the latest complete listing recorded with RecordListing,
+	// or nil if none.
+	//
+	// GUARDED_BY(mu)
+	lastListing []fuseutil.Dirent
+
+	// The entries of the latest complete listing read with ReadEntries, and
+	// the time until which they may be returned for a listing from the start.
+	// Nil if there is none, or it was forgotten because we changed the children.
+	//
+	// GUARDED_BY(mu)
+	cachedListing           []fuseutil.Dirent
+	cachedListingExpiration time.Time
+
+	// The pattern set with SetListFilter, or "" if none.
+	//
+	// GUARDED_BY(mu)
+	listFilter string
+
+	// The time until which the kernel may keep the entries it cached when the
+	// directory was opened, or zero if it must list the directory afresh. See
+	// KeepKernelListing.
+	//
+	// GUARDED_BY(mu)
+	kernelListingExpiration time.Time
+
+	// While a listing is being read from the start, the entries read so far and
+	// the continuation token that the next call must supply to continue it.
+	// Nil if no such listing is in progress.
+	//
+	// GUARDED_BY(mu)
+	pendingListing    []fuseutil.Dirent
+	pendingListingTok string
 }
 
 var _ DirInode = &dirInode{}
@@ -198,6 +298,9 @@ var _ DirInode = &dirInode{}
 // descendents. For example, if there is an object named "foo/bar/baz" and this
 // is the directory "foo", a child directory named "bar" will be implied.
 //
+// The placeholder policy controls whether placeholder objects for child
+// directories are created and honored; see PlaceholderPolicy.
+//
 // If typeCacheTTL is non-zero, a cache from child name to information about
 // whether that name exists as a file/symlink and/or directory will be
 // maintained. This may speed up calls to LookUpChild, especially when combined
@@ -205,6 +308,11 @@ var _ DirInode = &dirInode{}
 // child is removed and recreated with a different type before the expiration,
 // we may fail to find it.
 //
+// If listCacheTTL is non-zero, a complete listing read with ReadEntries is
+// returned again by ReadEntries calls from the start within that time, unless
+// the children are changed through the inode in the meantime. Changes made by
+// other means go unseen until it expires.
+//
 // The initial lookup count is zero.
 //
 // REQUIRES: IsDirName(name)
@@ -213,7 +321,9 @@ func NewDirInode(
 	name string,
 	attrs fuseops.InodeAttributes,
 	implicitDirs bool,
+	placeholders PlaceholderPolicy,
 	typeCacheTTL time.Duration,
+	listCacheTTL time.Duration,
 	bucket gcs.Bucket,
 	mtimeClock timeutil.Clock,
 	cacheClock timeutil.Clock) (d DirInode) {
@@ -229,9 +339,12 @@ func NewDirInode(
 		cacheClock:   cacheClock,
 		id:           id,
 		implicitDirs: implicitDirs,
+		placeholders: placeholders,
 		name:         name,
 		attrs:        attrs,
+		listCacheTTL: listCacheTTL,
 		cache:        newTypeCache(typeCacheCapacity/2, typeCacheTTL),
+		localDirs:    make(map[string]struct{}),
 	}
 
 	typed.lc.Init(id)
@@ -247,6 +360,57 @@ func NewDirInode(
 // Helpers
 ////////////////////////////////////////////////////////////////////////
 
+// Record that a child changed at the given time.
+//
+// LOCKS_REQUIRED(d)
+func (d *dirInode) noteChildChange(t time.Time) {
+	if t.After(d.childMtime) {
+		d.childMtime = t
+	}
+}
+
+// Forget any cached listing, since we've changed the children.
+//
+// LOCKS_REQUIRED(d)
+func (d *dirInode) forgetListing() {
+	d.cachedListing = nil
+	d.pendingListing = nil
+	d.kernelListingExpiration = time.Time{}
+}
+
+// Record a batch of entries read by ReadEntries from the given continuation
+// token, caching the listing once it is complete if it was read in order from
+// the start.
+//
+// LOCKS_REQUIRED(d)
+func (d *dirInode) noteListedEntries(
+	tok string,
+	entries []fuseutil.Dirent,
+	newTok string) {
+	switch {
+	case tok == "":
+		// Non-nil even if empty, marking the listing as in progress.
+		d.pendingListing = make([]fuseutil.Dirent, 0, len(entries))
+		d.pendingListing = append(d.pendingListing, entries...)
+
+	case d.pendingListing != nil && tok == d.pendingListingTok:
+		d.pendingListing = append(d.pendingListing, entries...)
+
+	default:
+		d.pendingListing = nil
+		return
+	}
+
+	if newTok != "" {
+		d.pendingListingTok = newTok
+		return
+	}
+
+	d.cachedListing = d.pendingListing
+	d.cachedListingExpiration = d.cacheClock.Now().Add(d.listCacheTTL)
+	d.pendingListing = nil
+}
+
 func (d *dirInode) checkInvariants() {
 	// INVARIANT: name == "" || name[len(name)-1] == '/'
 	if !(d.name == "" || d.name[len(d.name)-1] == '/') {
@@ -263,7 +427,7 @@ func (d *dirInode) lookUpChildFile(
 	result.FullName = d.Name() + name
 	result.Object, err = statObjectMayNotExist(ctx, d.bucket, result.FullName)
 	if err != nil {
-		err = fmt.Errorf("statObjectMayNotExist: %v", err)
+		err = fmt.Errorf("statObjectMayNotExist: %w", err)
 		return
 	}
 
@@ -274,18 +438,20 @@ func (d *dirInode) lookUpChildDir(
 	ctx context.Context,
 	name string) (result LookUpResult, err error) {
 	b := syncutil.NewBundle(ctx)
+	result.FullName = d.Name() + name + "/"
 
-	// Stat the placeholder object.
-	b.Add(func(ctx context.Context) (err error) {
-		result.FullName = d.Name() + name + "/"
-		result.Object, err = statObjectMayNotExist(ctx, d.bucket, result.FullName)
-		if err != nil {
-			err = fmt.Errorf("statObjectMayNotExist: %v", err)
-			return
-		}
+	// Stat the placeholder object, unless we've been told to ignore them.
+	if !d.placeholders.Hide {
+		b.Add(func(ctx context.Context) (err error) {
+			result.Object, err = statObjectMayNotExist(ctx, d.bucket, result.FullName)
+			if err != nil {
+				err = fmt.Errorf("statObjectMayNotExist: %w", err)
+				return
+			}
 
-		return
-	})
+			return
+		})
+	}
 
 	// If implicit directories are enabled, find out whether the child name is
 	// implicitly defined.
@@ -294,10 +460,11 @@ func (d *dirInode) lookUpChildDir(
 			result.ImplicitDir, err = objectNamePrefixNonEmpty(
 				ctx,
 				d.bucket,
-				d.Name()+name+"/")
+				result.FullName,
+				d.placeholders.Hide)
 
 			if err != nil {
-				err = fmt.Errorf("objectNamePrefixNonEmpty: %v", err)
+				err = fmt.Errorf("objectNamePrefixNonEmpty: %w", err)
 				return
 			}
 
@@ -311,6 +478,11 @@ func (d *dirInode) lookUpChildDir(
 		return
 	}
 
+	// Directories we created without a placeholder exist until deleted.
+	if _, ok := d.localDirs[name]; ok && !result.Exists() {
+		result.ImplicitDir = true
+	}
+
 	return
 }
 
@@ -329,7 +501,7 @@ func (d *dirInode) lookUpConflicting(
 	var dirResult LookUpResult
 	dirResult, err = d.lookUpChildDir(ctx, strippedName)
 	if err != nil {
-		err = fmt.Errorf("lookUpChildDir for stripped name: %v", err)
+		err = fmt.Errorf("lookUpChildDir for stripped name: %w", err)
 		return
 	}
 
@@ -340,7 +512,7 @@ func (d *dirInode) lookUpConflicting(
 	// The directory name exists. Find the conflicting file.
 	result, err = d.lookUpChildFile(ctx, strippedName)
 	if err != nil {
-		err = fmt.Errorf("lookUpChildFile for stripped name: %v", err)
+		err = fmt.Errorf("lookUpChildFile for stripped name: %w", err)
 		return
 	}
 
@@ -348,22 +520,37 @@ func (d *dirInode) lookUpConflicting(
 }
 
 // List the supplied object name prefix to find out whether it is non-empty.
+// If ignorePlaceholder is set, an object named exactly the prefix doesn't
+// count.
 func objectNamePrefixNonEmpty(
 	ctx context.Context,
 	bucket gcs.Bucket,
-	prefix string) (nonEmpty bool, err error) {
+	prefix string,
+	ignorePlaceholder bool) (nonEmpty bool, err error) {
+	// The placeholder sorts before everything else with the prefix, so if it
+	// exists we need to see one more object.
 	req := &gcs.ListObjectsRequest{
 		Prefix:     prefix,
 		MaxResults: 1,
 	}
 
+	if ignorePlaceholder {
+		req.MaxResults = 2
+	}
+
 	listing, err := bucket.ListObjects(ctx, req)
 	if err != nil {
-		err = fmt.Errorf("ListObjects: %v", err)
+		err = fmt.Errorf("ListObjects: %w", err)
 		return
 	}
 
-	nonEmpty = len(listing.Objects) != 0
+	for _, o := range listing.Objects {
+		if !(ignorePlaceholder && o.Name == prefix) {
+			nonEmpty = true
+			break
+		}
+	}
+
 	return
 }
 
@@ -387,7 +574,7 @@ func statObjectMayNotExist(
 
 	// Annotate others.
 	if err != nil {
-		err = fmt.Errorf("StatObject: %v", err)
+		err = fmt.Errorf("StatObject: %w", err)
 		return
 	}
 
@@ -430,7 +617,7 @@ func filterMissingChildDirNames(
 		// Stat the placeholder.
 		o, err = statObjectMayNotExist(ctx, bucket, dirName+name+"/")
 		if err != nil {
-			err = fmt.Errorf("statObjectMayNotExist: %v", err)
+			err = fmt.Errorf("statObjectMayNotExist: %w", err)
 			return
 		}
 
@@ -550,6 +737,70 @@ func (d *dirInode) filterMissingChildDirs(
 	return
 }
 
+// Given a list of child names that appear to be directories according to
+// d.bucket.ListObjects, filter out the ones that are defined only by a
+// placeholder object, for use when placeholders are hidden.
+//
+// LOCKS_REQUIRED(d)
+func (d *dirInode) filterPlaceholderOnlyChildDirs(
+	ctx context.Context,
+	in []string) (out []string, err error) {
+	b := syncutil.NewBundle(ctx)
+
+	// Feed indices into a channel.
+	indices := make(chan int, 100)
+	b.Add(func(ctx context.Context) (err error) {
+		defer close(indices)
+
+		for i := range in {
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+				return
+
+			case indices <- i:
+			}
+		}
+
+		return
+	})
+
+	// List each prefix, recording which are non-empty. Use some parallelism.
+	const listWorkers = 32
+	keep := make([]bool, len(in))
+	for i := 0; i < listWorkers; i++ {
+		b.Add(func(ctx context.Context) (err error) {
+			for i := range indices {
+				keep[i], err = objectNamePrefixNonEmpty(
+					ctx,
+					d.bucket,
+					d.Name()+in[i]+"/",
+					true)
+
+				if err != nil {
+					err = fmt.Errorf("objectNamePrefixNonEmpty: %w", err)
+					return
+				}
+			}
+
+			return
+		})
+	}
+
+	err = b.Join()
+	if err != nil {
+		return
+	}
+
+	for i, name := range in {
+		if keep[i] {
+			out = append(out, name)
+		}
+	}
+
+	return
+}
+
 ////////////////////////////////////////////////////////////////////////
 // Public interface
 ////////////////////////////////////////////////////////////////////////
@@ -594,6 +845,14 @@ func (d *dirInode) Attributes(
 	attrs = d.attrs
 	attrs.Nlink = 1
 
+	// GCS doesn't record times for directories, so synthesize them from the
+	// changes to children that we've seen, if any. This makes tools that
+	// compare directory mtimes behave sensibly.
+	if !d.childMtime.IsZero() {
+		attrs.Mtime = d.childMtime
+		attrs.Ctime = d.childMtime
+	}
+
 	return
 }
 
@@ -672,6 +931,37 @@ func (d *dirInode) LookUpChild(
 
 // LOCKS_REQUIRED(d)
 func (d *dirInode) ReadEntries(
+	ctx context.Context,
+	tok string) (entries []fuseutil.Dirent, newTok string, err error) {
+	if d.listCacheTTL == 0 {
+		entries, newTok, err = d.readEntries(ctx, tok)
+		return
+	}
+
+	// Serve a listing from the start from the cache, if we can.
+	if tok == "" && d.cachedListing != nil {
+		if d.cacheClock.Now().Before(d.cachedListingExpiration) {
+			entries = append(entries, d.cachedListing...)
+			return
+		}
+
+		d.cachedListing = nil
+	}
+
+	entries, newTok, err = d.readEntries(ctx, tok)
+	if err != nil {
+		d.pendingListing = nil
+		return
+	}
+
+	d.noteListedEntries(tok, entries, newTok)
+	return
+}
+
+// Read a batch of entries from GCS, as described for ReadEntries.
+//
+// LOCKS_REQUIRED(d)
+func (d *dirInode) readEntries(
 	ctx context.Context,
 	tok string) (entries []fuseutil.Dirent, newTok string, err error) {
 	// Ask the bucket to list some objects.
@@ -681,14 +971,20 @@ func (d *dirInode) ReadEntries(
 		ContinuationToken: tok,
 	}
 
+	if d.listFilter != "" {
+		req.MatchGlob = gcs.QuoteGlob(d.Name()) + d.listFilter
+	}
+
 	listing, err := d.bucket.ListObjects(ctx, req)
 	if err != nil {
-		err = fmt.Errorf("ListObjects: %v", err)
+		err = fmt.Errorf("ListObjects: %w", err)
 		return
 	}
 
 	// Convert objects to entries for files or symlinks.
 	for _, o := range listing.Objects {
+		d.noteChildChange(o.Updated)
+
 		// Skip the entry for the backing object itself, which of course has its
 		// own name as a prefix but which we don't wan to appear to contain itself.
 		if o.Name == d.Name() {
@@ -713,13 +1009,30 @@ func (d *dirInode) ReadEntries(
 		dirNames = append(dirNames, path.Base(p))
 	}
 
-	// Filter the directory names according to our implicit directory settings.
+	// Filter the directory names according to our implicit directory and
+	// placeholder settings.
 	dirNames, err = d.filterMissingChildDirs(ctx, dirNames)
 	if err != nil {
-		err = fmt.Errorf("filterMissingChildDirs: %v", err)
+		err = fmt.Errorf("filterMissingChildDirs: %w", err)
 		return
 	}
 
+	if d.placeholders.Hide {
+		dirNames, err = d.filterPlaceholderOnlyChildDirs(ctx, dirNames)
+		if err != nil {
+			err = fmt.Errorf("filterPlaceholderOnlyChildDirs: %w", err)
+			return
+		}
+	}
+
+	// Add directories we created without placeholders once we reach the end.
+	// They may duplicate names listed above; callers must cope with that.
+	if listing.ContinuationToken == "" {
+		for name := range d.localDirs {
+			dirNames = append(dirNames, name)
+		}
+	}
+
 	// Return entries for directories.
 	for _, name := range dirNames {
 		e := fuseutil.Dirent{
@@ -748,10 +1061,48 @@ func (d *dirInode) ReadEntries(
 	return
 }
 
+// LOCKS_REQUIRED(d)
+func (d *dirInode) RecordListing(entries []fuseutil.Dirent) {
+	d.lastListing = entries
+}
+
+// LOCKS_REQUIRED(d)
+func (d *dirInode) LastListing() (entries []fuseutil.Dirent) {
+	entries = d.lastListing
+	return
+}
+
+// LOCKS_REQUIRED(d)
+func (d *dirInode) ListFilter() (pattern string) {
+	pattern = d.listFilter
+	return
+}
+
+// LOCKS_REQUIRED(d)
+func (d *dirInode) SetListFilter(pattern string) {
+	d.listFilter = pattern
+	d.forgetListing()
+	d.lastListing = nil
+}
+
+// LOCKS_REQUIRED(d)
+func (d *dirInode) KeepKernelListing(ttl time.Duration) (keep bool) {
+	now := d.cacheClock.Now()
+	if now.Before(d.kernelListingExpiration) {
+		keep = true
+		return
+	}
+
+	d.kernelListingExpiration = now.Add(ttl)
+	return
+}
+
 // LOCKS_REQUIRED(d)
 func (d *dirInode) CreateChildFile(
 	ctx context.Context,
 	name string) (o *gcs.Object, err error) {
+	d.forgetListing()
+
 	metadata := map[string]string{
 		FileMtimeMetadataKey: d.mtimeClock.Now().UTC().Format(time.RFC3339Nano),
 	}
@@ -762,6 +1113,7 @@ func (d *dirInode) CreateChildFile(
 	}
 
 	d.cache.NoteFile(d.cacheClock.Now(), name)
+	d.noteChildChange(d.mtimeClock.Now())
 
 	return
 }
@@ -771,6 +1123,8 @@ func (d *dirInode) CloneToChildFile(
 	ctx context.Context,
 	name string,
 	src *gcs.Object) (o *gcs.Object, err error) {
+	d.forgetListing()
+
 	// Erase any existing type information for this name.
 	d.cache.Erase(name)
 
@@ -790,6 +1144,7 @@ func (d *dirInode) CloneToChildFile(
 
 	// Update the type cache.
 	d.cache.NoteFile(d.cacheClock.Now(), name)
+	d.noteChildChange(d.mtimeClock.Now())
 
 	return
 }
@@ -799,6 +1154,8 @@ func (d *dirInode) CreateChildSymlink(
 	ctx context.Context,
 	name string,
 	target string) (o *gcs.Object, err error) {
+	d.forgetListing()
+
 	metadata := map[string]string{
 		SymlinkMetadataKey: target,
 	}
@@ -809,6 +1166,7 @@ func (d *dirInode) CreateChildSymlink(
 	}
 
 	d.cache.NoteFile(d.cacheClock.Now(), name)
+	d.noteChildChange(d.mtimeClock.Now())
 
 	return
 }
@@ -817,12 +1175,19 @@ func (d *dirInode) CreateChildSymlink(
 func (d *dirInode) CreateChildDir(
 	ctx context.Context,
 	name string) (o *gcs.Object, err error) {
-	o, err = d.createNewObject(ctx, path.Join(d.Name(), name)+"/", nil)
-	if err != nil {
-		return
+	d.forgetListing()
+
+	if d.placeholders.SkipCreate {
+		d.localDirs[name] = struct{}{}
+	} else {
+		o, err = d.createNewObject(ctx, path.Join(d.Name(), name)+"/", nil)
+		if err != nil {
+			return
+		}
 	}
 
 	d.cache.NoteDir(d.cacheClock.Now(), name)
+	d.noteChildChange(d.mtimeClock.Now())
 
 	return
 }
@@ -833,6 +1198,7 @@ func (d *dirInode) DeleteChildFile(
 	name string,
 	generation int64,
 	metaGeneration *int64) (err error) {
+	d.forgetListing()
 	d.cache.Erase(name)
 
 	err = d.bucket.DeleteObject(
@@ -844,21 +1210,33 @@ func (d *dirInode) DeleteChildFile(
 		})
 
 	if err != nil {
-		err = fmt.Errorf("DeleteObject: %v", err)
+		err = fmt.Errorf("DeleteObject: %w", err)
 		return
 	}
 
+	d.noteChildChange(d.mtimeClock.Now())
+
 	return
 }
 
+// LOCKS_REQUIRED(d)
+func (d *dirInode) ForgetChild(name string) {
+	d.forgetListing()
+	d.cache.Erase(name)
+	delete(d.localDirs, name)
+	d.noteChildChange(d.mtimeClock.Now())
+}
+
 // LOCKS_REQUIRED(d)
 func (d *dirInode) DeleteChildDir(
 	ctx context.Context,
 	name string) (err error) {
+	d.forgetListing()
 	d.cache.Erase(name)
+	delete(d.localDirs, name)
 
-	// Delete the backing object. Unfortunately we have no way to precondition
-	// this on the directory being empty.
+	// Delete the backing object, if any. Unfortunately we have no way to
+	// precondition this on the directory being empty.
 	err = d.bucket.DeleteObject(
 		ctx,
 		&gcs.DeleteObjectRequest{
@@ -866,9 +1244,11 @@ func (d *dirInode) DeleteChildDir(
 		})
 
 	if err != nil {
-		err = fmt.Errorf("DeleteObject: %v", err)
+		err = fmt.Errorf("DeleteObject: %w", err)
 		return
 	}
 
+	d.noteChildChange(d.mtimeClock.Now())
+
 	return
 }
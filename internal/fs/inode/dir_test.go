@@ -23,12 +23,12 @@ import (
 
 	"golang.org/x/net/context"
 
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseops"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
 	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
-	"github.com/jacobsa/fuse/fuseops"
-	"github.com/jacobsa/fuse/fuseutil"
-	"github.com/jacobsa/gcloud/gcs"
-	"github.com/jacobsa/gcloud/gcs/gcsfake"
-	"github.com/jacobsa/gcloud/gcs/gcsutil"
 	. "github.com/jacobsa/oglematchers"
 	. "github.com/jacobsa/ogletest"
 	"github.com/jacobsa/timeutil"
@@ -50,6 +50,10 @@ type DirTest struct {
 	bucket gcs.Bucket
 	clock  timeutil.SimulatedClock
 
+	// The placeholder policy and listing cache TTL used by resetInode.
+	placeholders inode.PlaceholderPolicy
+	listCacheTTL time.Duration
+
 	in inode.DirInode
 }
 
@@ -95,7 +99,9 @@ func (t *DirTest) resetInode(implicitDirs bool) {
 			Mode: dirMode,
 		},
 		implicitDirs,
+		t.placeholders,
 		typeCacheTTL,
+		t.listCacheTTL,
 		t.bucket,
 		&t.clock,
 		&t.clock)
@@ -169,6 +175,62 @@ func (t *DirTest) Attributes() {
 	ExpectEq(dirMode|os.ModeDir, attrs.Mode)
 }
 
+func (t *DirTest) Attributes_MtimeFromListing() {
+	var err error
+
+	// Create two children at different times.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, dirInodeName+"foo", []byte{})
+	AssertEq(nil, err)
+
+	t.clock.AdvanceTime(time.Hour)
+	expected := t.clock.Now()
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, dirInodeName+"bar/", []byte{})
+	AssertEq(nil, err)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, dirInodeName+"baz", []byte{})
+	AssertEq(nil, err)
+
+	t.clock.AdvanceTime(time.Hour)
+
+	// Once we've listed, the latest child's time should be reflected.
+	_, err = t.readAllEntries()
+	AssertEq(nil, err)
+
+	attrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectThat(attrs.Mtime, timeutil.TimeEq(expected))
+	ExpectThat(attrs.Ctime, timeutil.TimeEq(expected))
+}
+
+func (t *DirTest) Attributes_MtimeFromLocalMutations() {
+	var attrs fuseops.InodeAttributes
+	var err error
+
+	// Create a child.
+	t.clock.AdvanceTime(time.Hour)
+	createTime := t.clock.Now()
+
+	o, err := t.in.CreateChildFile(t.ctx, "foo")
+	AssertEq(nil, err)
+
+	attrs, err = t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectThat(attrs.Mtime, timeutil.TimeEq(createTime))
+
+	// Delete it.
+	t.clock.AdvanceTime(time.Hour)
+	deleteTime := t.clock.Now()
+
+	err = t.in.DeleteChildFile(t.ctx, "foo", o.Generation, nil)
+	AssertEq(nil, err)
+
+	attrs, err = t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectThat(attrs.Mtime, timeutil.TimeEq(deleteTime))
+	ExpectThat(attrs.Ctime, timeutil.TimeEq(deleteTime))
+}
+
 func (t *DirTest) LookUpChild_NonExistent() {
 	result, err := t.in.LookUpChild(t.ctx, "qux")
 
@@ -650,6 +712,162 @@ func (t *DirTest) ReadEntries_TypeCaching() {
 	ExpectEq(dirObjName, o.Name)
 }
 
+func (t *DirTest) ReadEntries_ListCaching() {
+	const listCacheTTL = time.Minute
+	t.listCacheTTL = listCacheTTL
+	t.resetInode(false)
+
+	_, err := gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		path.Join(dirInodeName, "foo"),
+		[]byte("taco"))
+
+	AssertEq(nil, err)
+
+	// Read the directory, filling the cache.
+	entries, err := t.readAllEntries()
+	AssertEq(nil, err)
+	AssertEq(1, len(entries))
+
+	// Create another object behind the inode's back. Listings still come from
+	// the cache.
+	_, err = gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		path.Join(dirInodeName, "bar"),
+		[]byte("burrito"))
+
+	AssertEq(nil, err)
+
+	entries, err = t.readAllEntries()
+	AssertEq(nil, err)
+	AssertEq(1, len(entries))
+	ExpectEq("foo", entries[0].Name)
+
+	// But not after the TTL expires.
+	t.clock.AdvanceTime(listCacheTTL + time.Millisecond)
+
+	entries, err = t.readAllEntries()
+	AssertEq(nil, err)
+	AssertEq(2, len(entries))
+	ExpectEq("bar", entries[0].Name)
+	ExpectEq("foo", entries[1].Name)
+}
+
+func (t *DirTest) ReadEntries_ListCachingForgottenOnChanges() {
+	t.listCacheTTL = time.Minute
+	t.resetInode(false)
+
+	var entries []fuseutil.Dirent
+	var err error
+
+	// Creating a file through the inode shows up at once.
+	_, err = t.readAllEntries()
+	AssertEq(nil, err)
+
+	_, err = t.in.CreateChildFile(t.ctx, "foo")
+	AssertEq(nil, err)
+
+	entries, err = t.readAllEntries()
+	AssertEq(nil, err)
+	AssertEq(1, len(entries))
+	ExpectEq("foo", entries[0].Name)
+
+	// So does creating a directory.
+	_, err = t.in.CreateChildDir(t.ctx, "bar")
+	AssertEq(nil, err)
+
+	entries, err = t.readAllEntries()
+	AssertEq(nil, err)
+	AssertEq(2, len(entries))
+	ExpectEq("bar", entries[0].Name)
+	ExpectEq("foo", entries[1].Name)
+
+	// And deleting them.
+	err = t.in.DeleteChildFile(t.ctx, "foo", 0, nil)
+	AssertEq(nil, err)
+
+	err = t.in.DeleteChildDir(t.ctx, "bar")
+	AssertEq(nil, err)
+
+	entries, err = t.readAllEntries()
+	AssertEq(nil, err)
+	ExpectEq(0, len(entries))
+}
+
+func (t *DirTest) ReadEntries_ListFilter() {
+	t.listCacheTTL = time.Minute
+	t.resetInode(false)
+
+	objs := []string{
+		dirInodeName + "a.parquet",
+		dirInodeName + "b.csv",
+		dirInodeName + "dir/c.parquet",
+		dirInodeName + "dir/",
+		dirInodeName + "other/d.csv",
+		dirInodeName + "other/",
+	}
+
+	err := gcsutil.CreateEmptyObjects(t.ctx, t.bucket, objs)
+	AssertEq(nil, err)
+
+	// Fill the cache, which the filter must not be served from.
+	entries, err := t.readAllEntries()
+	AssertEq(nil, err)
+	AssertEq(4, len(entries))
+
+	// Only matching objects are listed, and subdirectories only if they
+	// contain some.
+	t.in.SetListFilter("*.parquet")
+	ExpectEq("*.parquet", t.in.ListFilter())
+
+	entries, err = t.readAllEntries()
+	AssertEq(nil, err)
+	AssertEq(1, len(entries))
+	ExpectEq("a.parquet", entries[0].Name)
+
+	t.in.SetListFilter("**.parquet")
+
+	entries, err = t.readAllEntries()
+	AssertEq(nil, err)
+	AssertEq(2, len(entries))
+	ExpectEq("a.parquet", entries[0].Name)
+	ExpectEq("dir", entries[1].Name)
+	ExpectEq(fuseutil.DT_Directory, entries[1].Type)
+
+	// Clearing the filter lists everything again.
+	t.in.SetListFilter("")
+
+	entries, err = t.readAllEntries()
+	AssertEq(nil, err)
+	ExpectEq(4, len(entries))
+}
+
+func (t *DirTest) KeepKernelListing() {
+	const ttl = time.Minute
+
+	// The first open lists the directory afresh; later ones within the TTL may
+	// keep what the kernel cached.
+	ExpectFalse(t.in.KeepKernelListing(ttl))
+	ExpectTrue(t.in.KeepKernelListing(ttl))
+
+	t.clock.AdvanceTime(ttl - time.Millisecond)
+	ExpectTrue(t.in.KeepKernelListing(ttl))
+
+	// But not after it expires.
+	t.clock.AdvanceTime(time.Millisecond)
+	ExpectFalse(t.in.KeepKernelListing(ttl))
+	ExpectTrue(t.in.KeepKernelListing(ttl))
+
+	// Nor after a child is changed through the inode.
+	_, err := t.in.CreateChildFile(t.ctx, "foo")
+	AssertEq(nil, err)
+
+	ExpectFalse(t.in.KeepKernelListing(ttl))
+	ExpectTrue(t.in.KeepKernelListing(ttl))
+}
+
 func (t *DirTest) CreateChildFile_DoesntExist() {
 	const name = "qux"
 	objName := path.Join(dirInodeName, name)
@@ -1100,3 +1318,82 @@ func (t *DirTest) DeleteChildDir_Exists() {
 	_, err = gcsutil.ReadObject(t.ctx, t.bucket, objName)
 	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
 }
+
+func (t *DirTest) CreateChildDir_SkipPlaceholder() {
+	const name = "qux"
+	objName := path.Join(dirInodeName, name) + "/"
+
+	var o *gcs.Object
+	var err error
+
+	t.placeholders.SkipCreate = true
+	t.resetInode(true)
+
+	// Call the inode. No object should be created.
+	o, err = t.in.CreateChildDir(t.ctx, name)
+	AssertEq(nil, err)
+	ExpectEq(nil, o)
+
+	_, err = gcsutil.ReadObject(t.ctx, t.bucket, objName)
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	// But the directory should exist as far as the inode is concerned.
+	result, err := t.in.LookUpChild(t.ctx, name)
+	AssertEq(nil, err)
+	ExpectTrue(result.ImplicitDir)
+	ExpectEq(objName, result.FullName)
+
+	entries, err := t.readAllEntries()
+	AssertEq(nil, err)
+	AssertEq(1, len(entries))
+	ExpectEq(name, entries[0].Name)
+	ExpectEq(fuseutil.DT_Directory, entries[0].Type)
+
+	// Until it is deleted.
+	err = t.in.DeleteChildDir(t.ctx, name)
+	AssertEq(nil, err)
+
+	result, err = t.in.LookUpChild(t.ctx, name)
+	AssertEq(nil, err)
+	ExpectFalse(result.Exists())
+
+	entries, err = t.readAllEntries()
+	AssertEq(nil, err)
+	ExpectEq(0, len(entries))
+}
+
+func (t *DirTest) HidePlaceholders() {
+	var result inode.LookUpResult
+	var err error
+
+	t.placeholders.Hide = true
+	t.resetInode(true)
+
+	// Set up a directory defined only by a placeholder, and one defined by
+	// both a placeholder and contents.
+	err = gcsutil.CreateEmptyObjects(t.ctx, t.bucket, []string{
+		path.Join(dirInodeName, "empty") + "/",
+		path.Join(dirInodeName, "full") + "/",
+		path.Join(dirInodeName, "full", "baz"),
+	})
+
+	AssertEq(nil, err)
+
+	// The placeholder-only directory shouldn't exist.
+	result, err = t.in.LookUpChild(t.ctx, "empty")
+	AssertEq(nil, err)
+	ExpectFalse(result.Exists())
+
+	// The other should, but only implicitly.
+	result, err = t.in.LookUpChild(t.ctx, "full")
+	AssertEq(nil, err)
+	ExpectTrue(result.ImplicitDir)
+	ExpectEq(nil, result.Object)
+
+	// Listing should agree.
+	entries, err := t.readAllEntries()
+	AssertEq(nil, err)
+	AssertEq(1, len(entries))
+	ExpectEq("full", entries[0].Name)
+	ExpectEq(fuseutil.DT_Directory, entries[0].Type)
+}
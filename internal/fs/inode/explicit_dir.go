@@ -17,8 +17,8 @@ package inode
 import (
 	"time"
 
-	"github.com/jacobsa/fuse/fuseops"
-	"github.com/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseops"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
 	"github.com/jacobsa/timeutil"
 )
 
@@ -36,7 +36,9 @@ func NewExplicitDirInode(
 	o *gcs.Object,
 	attrs fuseops.InodeAttributes,
 	implicitDirs bool,
+	placeholders PlaceholderPolicy,
 	typeCacheTTL time.Duration,
+	listCacheTTL time.Duration,
 	bucket gcs.Bucket,
 	mtimeClock timeutil.Clock,
 	cacheClock timeutil.Clock) (d ExplicitDirInode) {
@@ -45,7 +47,9 @@ func NewExplicitDirInode(
 		o.Name,
 		attrs,
 		implicitDirs,
+		placeholders,
 		typeCacheTTL,
+		listCacheTTL,
 		bucket,
 		mtimeClock,
 		cacheClock)
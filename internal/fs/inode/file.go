@@ -18,11 +18,13 @@ import (
 	"fmt"
 	"io"
 	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseops"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
 	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
-	"github.com/jacobsa/fuse/fuseops"
-	"github.com/jacobsa/gcloud/gcs"
 	"github.com/jacobsa/syncutil"
 	"github.com/jacobsa/timeutil"
 	"golang.org/x/net/context"
@@ -50,6 +52,21 @@ type FileInode struct {
 	attrs   fuseops.InodeAttributes
 	tempDir string
 
+	// If positive, sequential writes to an empty object are streamed straight
+	// to GCS in chunks of this size. See NewFileInode.
+	streamChunkSize int
+
+	// How to download large objects. See NewFileInode.
+	download gcsx.ParallelDownload
+
+	// Whether to switch to newer generations that are at least as large. See
+	// NewFileInode.
+	tailFollow bool
+
+	// What to do when a sync finds that the source generation has been
+	// replaced.
+	conflicts ConflictPolicy
+
 	/////////////////////////
 	// Mutable state
 	/////////////////////////
@@ -72,17 +89,82 @@ type FileInode struct {
 	// authoritative.
 	content gcsx.TempFile
 
+	// An upload in progress of the content written to this inode, in place of
+	// local content, or nil if none. The time of the last write is also
+	// recorded, as the file's mtime until the upload is finished.
+	//
+	// INVARIANT: stream == nil || content == nil
+	//
+	// GUARDED_BY(mu)
+	stream      *gcsx.StreamingUpload
+	streamMtime time.Time
+
+	// Checksums most recently computed over the full contents of some
+	// generation of the object, whether by reading or by syncing, or nil if
+	// none. Only meaningful if they are for the generation of src.
+	//
+	// GUARDED_BY(mu)
+	checksums *gcsx.Checksums
+
+	// The generation of the source object whose contents the kernel's page
+	// cache for the inode reflects: the source generation as of the last call
+	// to KeepPageCache, or one since created by syncing writes that went
+	// through the kernel.
+	//
+	// GUARDED_BY(mu)
+	pageCacheGeneration int64
+
 	// Has Destroy been called?
 	//
 	// GUARDED_BY(mu)
 	destroyed bool
+
+	// A summary of the local contents as of when mu was last unlocked, which
+	// can be consulted without waiting for mu, since it may be held for the
+	// duration of an upload or download.
+	//
+	// GUARDED_BY(localStateMu)
+	localStateMu sync.Mutex
+	localState   LocalState
 }
 
 var _ Inode = &FileInode{}
 
+// LocalState summarizes what a file inode holds locally.
+type LocalState struct {
+	// The size of the local copy of the file's contents, or zero if there is
+	// none.
+	CachedBytes int64
+
+	// Whether the contents differ from the source object, and if so how many
+	// bytes have yet to be written to GCS: those appended if the object has
+	// only been appended to, and otherwise the whole contents.
+	Dirty      bool
+	DirtyBytes int64
+
+	// Whether the contents are being uploaded as they are written.
+	Streaming bool
+}
+
 // Create a file inode for the given object in GCS. The initial lookup count is
 // zero.
 //
+// If streamChunkSize is positive, writes to an empty object that start at
+// offset zero and continue strictly sequentially are uploaded as they arrive,
+// collected in memory until streamChunkSize bytes have accumulated, and the
+// upload is finalized when the file is synced, rather than staging them in a
+// temporary file. Anything else, including a read, finalizes the upload
+// early and continues with the uploaded object as if it had been synced.
+//
+// download says how the contents are fetched when a read or write first needs
+// them locally: see gcsx.DownloadTempFile.
+//
+// If tailFollow is set, the inode follows an object that grows by being
+// uploaded again with more data: see Follow.
+//
+// conflicts says what Sync does about local modifications to a generation
+// that has since been replaced by another writer.
+//
 // REQUIRES: o != nil
 // REQUIRES: o.Generation > 0
 // REQUIRES: o.MetaGeneration > 0
@@ -95,19 +177,28 @@ func NewFileInode(
 	bucket gcs.Bucket,
 	syncer gcsx.Syncer,
 	tempDir string,
+	streamChunkSize int,
+	download gcsx.ParallelDownload,
+	tailFollow bool,
+	conflicts ConflictPolicy,
 	mtimeClock timeutil.Clock) (f *FileInode) {
 	// Set up the basic struct.
 	f = &FileInode{
-		bucket:     bucket,
-		syncer:     syncer,
-		mtimeClock: mtimeClock,
-		id:         id,
-		name:       o.Name,
-		attrs:      attrs,
-		tempDir:    tempDir,
-		src:        *o,
+		bucket:          bucket,
+		syncer:          syncer,
+		mtimeClock:      mtimeClock,
+		id:              id,
+		name:            o.Name,
+		attrs:           attrs,
+		tempDir:         tempDir,
+		streamChunkSize: streamChunkSize,
+		download:        download,
+		tailFollow:      tailFollow,
+		conflicts:       conflicts,
+		src:             *o,
 	}
 
+	f.pageCacheGeneration = o.Generation
 	f.lc.Init(id)
 
 	// Set up invariant checking.
@@ -141,6 +232,11 @@ func (f *FileInode) checkInvariants() {
 	if f.content != nil {
 		f.content.CheckInvariants()
 	}
+
+	// INVARIANT: stream == nil || content == nil
+	if f.stream != nil && f.content != nil {
+		panic("Have both a stream and local content")
+	}
 }
 
 // LOCKS_REQUIRED(f.mu)
@@ -158,7 +254,7 @@ func (f *FileInode) clobbered(ctx context.Context) (b bool, err error) {
 
 	// Propagate other errors.
 	if err != nil {
-		err = fmt.Errorf("StatObject: %v", err)
+		err = fmt.Errorf("StatObject: %w", err)
 		return
 	}
 
@@ -169,6 +265,45 @@ func (f *FileInode) clobbered(ctx context.Context) (b bool, err error) {
 	return
 }
 
+// Summarize the local state for LocalState. This mirrors the tests for
+// dirtiness made when syncing.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) computeLocalState() (ls LocalState) {
+	if f.stream != nil {
+		ls.Dirty = true
+		ls.DirtyBytes = f.stream.Size()
+		ls.Streaming = true
+		return
+	}
+
+	if f.content == nil {
+		return
+	}
+
+	sr, err := f.content.Stat()
+	if err != nil {
+		return
+	}
+
+	ls.CachedBytes = sr.Size
+
+	srcSize := int64(f.src.Size)
+	switch {
+	case sr.Size == srcSize && sr.DirtyThreshold == srcSize:
+
+	case sr.DirtyThreshold == srcSize:
+		ls.Dirty = true
+		ls.DirtyBytes = sr.Size - srcSize
+
+	default:
+		ls.Dirty = true
+		ls.DirtyBytes = sr.Size
+	}
+
+	return
+}
+
 // Ensure that f.content != nil
 //
 // LOCKS_REQUIRED(f.mu)
@@ -178,30 +313,65 @@ func (f *FileInode) ensureContent(ctx context.Context) (err error) {
 		return
 	}
 
-	// Open a reader for the generation we care about.
-	rc, err := f.bucket.NewReader(
-		ctx,
-		&gcs.ReadObjectRequest{
-			Name:       f.src.Name,
-			Generation: f.src.Generation,
-		})
-
+	// Anything written so far must be uploaded before we can read it back.
+	err = f.finishStream(ctx)
 	if err != nil {
-		err = fmt.Errorf("NewReader: %v", err)
+		err = fmt.Errorf("finishStream: %w", err)
 		return
 	}
 
-	defer rc.Close()
+	// Download the generation we care about into a temporary file, making sure
+	// that what arrived is what GCS has.
+	tf, checksums, err := gcsx.DownloadTempFile(
+		ctx,
+		f.bucket,
+		&f.src,
+		f.tempDir,
+		f.download,
+		f.mtimeClock)
 
-	// Create a temporary file with its contents.
-	tf, err := gcsx.NewTempFile(rc, f.tempDir, f.mtimeClock)
 	if err != nil {
-		err = fmt.Errorf("NewTempFile: %v", err)
+		err = fmt.Errorf("DownloadTempFile: %w", err)
 		return
 	}
 
 	// Update state.
 	f.content = tf
+	f.checksums = checksums
+
+	return
+}
+
+// If there is an upload in progress, finalize it and make the new generation
+// the source object. If the upload fails, what was written is lost and the
+// source object is unchanged.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) finishStream(ctx context.Context) (err error) {
+	if f.stream == nil {
+		return
+	}
+
+	o, checksums, err := f.stream.Finish(ctx, f.streamMtime)
+	f.stream = nil
+
+	// The new generation exists even if its checksums don't match what we
+	// wrote or its mtime couldn't be updated, so record it along with them.
+	if o != nil {
+		f.src = *o
+		f.checksums = checksums
+		f.pageCacheGeneration = o.Generation
+	}
+
+	// Don't mangle precondition errors.
+	if _, ok := err.(*gcs.PreconditionError); ok {
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("Finish: %w", err)
+		return
+	}
 
 	return
 }
@@ -215,6 +385,12 @@ func (f *FileInode) Lock() {
 }
 
 func (f *FileInode) Unlock() {
+	ls := f.computeLocalState()
+
+	f.localStateMu.Lock()
+	f.localState = ls
+	f.localStateMu.Unlock()
+
 	f.mu.Unlock()
 }
 
@@ -243,7 +419,18 @@ func (f *FileInode) Source() *gcs.Object {
 //
 // LOCKS_REQUIRED(f.mu)
 func (f *FileInode) SourceGenerationIsAuthoritative() bool {
-	return f.content == nil
+	return f.content == nil && f.stream == nil
+}
+
+// LocalState returns a summary of what the inode holds locally, as of the last
+// time it was unlocked. It may be called without holding the inode lock.
+//
+// LOCKS_EXCLUDED(f.mu)
+func (f *FileInode) LocalState() LocalState {
+	f.localStateMu.Lock()
+	defer f.localStateMu.Unlock()
+
+	return f.localState
 }
 
 // Equivalent to the generation returned by f.Source().
@@ -255,6 +442,48 @@ func (f *FileInode) SourceGeneration() (g Generation) {
 	return
 }
 
+// Return checksums computed by gcsfuse over the full contents of the source
+// generation, compared against those reported by GCS, or nil if the source
+// generation has not been read or written in full through this inode. Also
+// return nil while there are local modifications, since the checksums then
+// don't describe the file's contents.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) Checksums() *gcsx.Checksums {
+	if f.content != nil ||
+		f.stream != nil ||
+		f.checksums == nil ||
+		f.checksums.Generation != f.src.Generation {
+		return nil
+	}
+
+	return f.checksums
+}
+
+// Record checksums computed by a file handle that read some generation of the
+// object in full. They are ignored if that is no longer the source
+// generation.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) RecordChecksums(c *gcsx.Checksums) {
+	if c.Generation == f.src.Generation {
+		f.checksums = c
+	}
+}
+
+// Return true if the pages that the kernel cached for the inode while it was
+// open before may be kept when it is opened again, because the source
+// generation hasn't since been replaced other than by syncing writes made
+// through the kernel. Either way, record that the kernel's pages will reflect
+// the current source generation from now on.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) KeepPageCache() (keep bool) {
+	keep = f.pageCacheGeneration == f.src.Generation
+	f.pageCacheGeneration = f.src.Generation
+	return
+}
+
 // LOCKS_REQUIRED(f.mu)
 func (f *FileInode) IncrementLookupCount() {
 	f.lc.Inc()
@@ -270,8 +499,14 @@ func (f *FileInode) DecrementLookupCount(n uint64) (destroy bool) {
 func (f *FileInode) Destroy() (err error) {
 	f.destroyed = true
 
+	if f.stream != nil {
+		f.stream.Abort()
+		f.stream = nil
+	}
+
 	if f.content != nil {
 		f.content.Destroy()
+		f.content = nil
 	}
 
 	return
@@ -280,6 +515,13 @@ func (f *FileInode) Destroy() (err error) {
 // LOCKS_REQUIRED(f.mu)
 func (f *FileInode) Attributes(
 	ctx context.Context) (attrs fuseops.InodeAttributes, err error) {
+	// Pick up growth, so that programs watching the size see it.
+	_, err = f.Follow(ctx)
+	if err != nil {
+		err = fmt.Errorf("Follow: %w", err)
+		return
+	}
+
 	attrs = f.attrs
 
 	// Obtain default information from the source object.
@@ -323,11 +565,17 @@ func (f *FileInode) Attributes(
 		}
 	}
 
+	// Similarly for an upload in progress.
+	if f.stream != nil {
+		attrs.Size = uint64(f.stream.Size())
+		attrs.Mtime = f.streamMtime
+	}
+
 	// If the object has been clobbered, we reflect that as the inode being
 	// unlinked.
 	clobbered, err := f.clobbered(ctx)
 	if err != nil {
-		err = fmt.Errorf("clobbered: %v", err)
+		err = fmt.Errorf("clobbered: %w", err)
 		return
 	}
 
@@ -351,7 +599,7 @@ func (f *FileInode) Read(
 	// Make sure f.content != nil.
 	err = f.ensureContent(ctx)
 	if err != nil {
-		err = fmt.Errorf("ensureContent: %v", err)
+		err = fmt.Errorf("ensureContent: %w", err)
 		return
 	}
 
@@ -369,6 +617,38 @@ func (f *FileInode) Read(
 	return
 }
 
+// Return a new temporary file holding a copy of the inode's current contents,
+// which the caller must eventually destroy.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) CloneContent(
+	ctx context.Context) (tf gcsx.TempFile, err error) {
+	// Make sure f.content != nil.
+	err = f.ensureContent(ctx)
+	if err != nil {
+		err = fmt.Errorf("ensureContent: %w", err)
+		return
+	}
+
+	sr, err := f.content.Stat()
+	if err != nil {
+		err = fmt.Errorf("Stat: %v", err)
+		return
+	}
+
+	tf, err = gcsx.NewTempFile(
+		io.NewSectionReader(f.content, 0, sr.Size),
+		f.tempDir,
+		f.mtimeClock)
+
+	if err != nil {
+		err = fmt.Errorf("NewTempFile: %v", err)
+		return
+	}
+
+	return
+}
+
 // Serve a write for this file with semantics matching fuseops.WriteFileOp.
 //
 // LOCKS_REQUIRED(f.mu)
@@ -376,10 +656,42 @@ func (f *FileInode) Write(
 	ctx context.Context,
 	data []byte,
 	offset int64) (err error) {
+	// Refuse to grow beyond what GCS can store.
+	if offset+int64(len(data)) > gcsx.MaxObjectSize {
+		err = syscall.EFBIG
+		return
+	}
+
+	// Special case: continue or start streaming, if this write allows it.
+	if f.stream == nil &&
+		f.streamChunkSize > 0 &&
+		f.content == nil &&
+		f.src.Size == 0 &&
+		offset == 0 {
+		f.stream = gcsx.NewStreamingUpload(
+			f.bucket,
+			&f.src,
+			f.mtimeClock.Now(),
+			f.streamChunkSize)
+	}
+
+	if f.stream != nil && offset == f.stream.Size() {
+		f.streamMtime = f.mtimeClock.Now()
+		err = f.stream.Write(data)
+		if err != nil {
+			// Find out why the upload failed.
+			err = f.finishStream(ctx)
+			err = fmt.Errorf("streaming upload failed: %w", err)
+			return
+		}
+
+		return
+	}
+
 	// Make sure f.content != nil.
 	err = f.ensureContent(ctx)
 	if err != nil {
-		err = fmt.Errorf("ensureContent: %v", err)
+		err = fmt.Errorf("ensureContent: %w", err)
 		return
 	}
 
@@ -396,6 +708,13 @@ func (f *FileInode) Write(
 func (f *FileInode) SetMtime(
 	ctx context.Context,
 	mtime time.Time) (err error) {
+	// Finish any upload in progress, so that we can update the result.
+	err = f.finishStream(ctx)
+	if err != nil {
+		err = fmt.Errorf("finishStream: %w", err)
+		return
+	}
+
 	// If we have a local temp file, stat it.
 	var sr gcsx.StatResult
 	if f.content != nil {
@@ -449,14 +768,93 @@ func (f *FileInode) SetMtime(
 		return
 
 	default:
-		err = fmt.Errorf("UpdateObject: %v", err)
+		err = fmt.Errorf("UpdateObject: %w", err)
+		return
+	}
+}
+
+// Set the custom metadata key on the backing object to the supplied value, or
+// remove it if the value is nil. Dirty contents are written out first, so that
+// the change applies to them. Involves a round trip to GCS.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) SetMetadata(
+	ctx context.Context,
+	key string,
+	value *string) (err error) {
+	err = f.updateSource(
+		ctx,
+		&gcs.UpdateObjectRequest{
+			Metadata: map[string]*string{
+				key: value,
+			},
+		})
+
+	return
+}
+
+// Set the custom time of the backing object, which lifecycle rules can act
+// on, as for SetMetadata. GCS refuses to move it earlier.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) SetCustomTime(
+	ctx context.Context,
+	t time.Time) (err error) {
+	err = f.updateSource(ctx, &gcs.UpdateObjectRequest{CustomTime: &t})
+	return
+}
+
+// Place a temporary hold on the backing object or release it, as for
+// SetMetadata. While it is held, GCS refuses to delete or replace it.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) SetTemporaryHold(
+	ctx context.Context,
+	held bool) (err error) {
+	err = f.updateSource(ctx, &gcs.UpdateObjectRequest{TemporaryHold: &held})
+	return
+}
+
+// Write out any dirty contents, then apply the supplied update to the
+// generation of the backing object that results, filling in the request's
+// name, generation, and meta-generation precondition.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) updateSource(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (err error) {
+	err = f.Sync(ctx)
+	if err != nil {
+		err = fmt.Errorf("Sync: %w", err)
+		return
+	}
+
+	srcGen := f.SourceGeneration()
+	req.Name = f.src.Name
+	req.Generation = srcGen.Object
+	req.MetaGenerationPrecondition = &srcGen.Metadata
+
+	o, err := f.bucket.UpdateObject(ctx, req)
+	switch err.(type) {
+	case nil:
+		f.src = *o
+		return
+
+	case *gcs.NotFoundError, *gcs.PreconditionError:
+		// Special case: as in SetMtime, take these to mean the file has been
+		// unlinked, and silently ignore them.
+		err = nil
+		return
+
+	default:
+		err = fmt.Errorf("UpdateObject: %w", err)
 		return
 	}
 }
 
 // Sync writes out contents to GCS. If this fails due to the generation having been
-// clobbered, treat it as a non-error (simulating the inode having been
-// unlinked).
+// clobbered, act according to the inode's ConflictPolicy: by default, treat it
+// as a non-error (simulating the inode having been unlinked).
 //
 // After this method succeeds, SourceGeneration will return the new generation
 // by which this inode should be known (which may be the same as before). If it
@@ -464,23 +862,43 @@ func (f *FileInode) SetMtime(
 //
 // LOCKS_REQUIRED(f.mu)
 func (f *FileInode) Sync(ctx context.Context) (err error) {
+	// Special case: finish any upload in progress.
+	if f.stream != nil {
+		err = f.finishStream(ctx)
+
+		// A precondition error means we were clobbered, as below. The streamed
+		// data is gone with the upload, so there is nothing to copy.
+		_, precondition := err.(*gcs.PreconditionError)
+		if precondition && f.conflicts != FailOnConflict {
+			err = nil
+		}
+
+		return
+	}
+
 	// If we have not been dirtied, there is nothing to do.
 	if f.content == nil {
 		return
 	}
 
 	// Write out the contents if they are dirty.
-	newObj, err := f.syncer.SyncObject(ctx, &f.src, f.content)
+	newObj, checksums, err := f.syncer.SyncObject(ctx, &f.src, f.content)
 
-	// Special case: a precondition error means we were clobbered, which we treat
-	// as being unlinked. There's no reason to return an error in that case.
+	// Special case: a precondition error means we were clobbered, which is
+	// dealt with according to the conflict policy.
 	if _, ok := err.(*gcs.PreconditionError); ok {
-		err = nil
+		err = f.handleConflict(ctx, err)
+		return
+	}
+
+	// Don't mangle policy violations, so that they can be reported as EPERM.
+	if _, ok := err.(*gcsx.PolicyViolationError); ok {
+		return
 	}
 
 	// Propagate other errors.
 	if err != nil {
-		err = fmt.Errorf("SyncObject: %v", err)
+		err = fmt.Errorf("SyncObject: %w", err)
 		return
 	}
 
@@ -488,6 +906,68 @@ func (f *FileInode) Sync(ctx context.Context) (err error) {
 	if newObj != nil {
 		f.src = *newObj
 		f.content = nil
+		f.checksums = checksums
+		f.pageCacheGeneration = newObj.Generation
+	}
+
+	return
+}
+
+// Deal with the supplied precondition error from syncing the local contents,
+// which means the source generation has been replaced, according to
+// f.conflicts. Return the error for Sync to return.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) handleConflict(
+	ctx context.Context,
+	precondition error) (err error) {
+	switch f.conflicts {
+	case FailOnConflict:
+		err = fmt.Errorf("SyncObject: %w", precondition)
+		return
+
+	case CopyOnConflict:
+		err = f.writeConflictCopy(ctx)
+		return
+	}
+
+	// Treat it as being unlinked. There's no reason to return an error in that
+	// case.
+	return
+}
+
+// Write the local contents to the object named by ConflictCopyName,
+// replacing any copy written by an earlier sync.
+//
+// LOCKS_REQUIRED(f.mu)
+// REQUIRES: f.content != nil
+func (f *FileInode) writeConflictCopy(ctx context.Context) (err error) {
+	sr, err := f.content.Stat()
+	if err != nil {
+		err = fmt.Errorf("Stat: %v", err)
+		return
+	}
+
+	mtime := f.mtimeClock.Now()
+	if sr.Mtime != nil {
+		mtime = *sr.Mtime
+	}
+
+	name := ConflictCopyName(f.name, f.src.Generation)
+	_, err = f.bucket.CreateObject(
+		ctx,
+		&gcs.CreateObjectRequest{
+			Name:        name,
+			ContentType: f.src.ContentType,
+			Contents:    io.NewSectionReader(f.content, 0, sr.Size),
+			Metadata: map[string]string{
+				FileMtimeMetadataKey: mtime.UTC().Format(time.RFC3339Nano),
+			},
+		})
+
+	if err != nil {
+		err = fmt.Errorf("CreateObject(%q): %w", name, err)
+		return
 	}
 
 	return
@@ -499,10 +979,22 @@ func (f *FileInode) Sync(ctx context.Context) (err error) {
 func (f *FileInode) Truncate(
 	ctx context.Context,
 	size int64) (err error) {
+	// Refuse to grow beyond what GCS can store.
+	if size > gcsx.MaxObjectSize {
+		err = syscall.EFBIG
+		return
+	}
+
+	// Special case: truncating an upload in progress to its current size, as
+	// some writers do before starting, changes nothing.
+	if f.stream != nil && size == f.stream.Size() {
+		return
+	}
+
 	// Make sure f.content != nil.
 	err = f.ensureContent(ctx)
 	if err != nil {
-		err = fmt.Errorf("ensureContent: %v", err)
+		err = fmt.Errorf("ensureContent: %w", err)
 		return
 	}
 
@@ -511,3 +1003,161 @@ func (f *FileInode) Truncate(
 
 	return
 }
+
+// Replace the contents of the file with the supplied generation of another
+// object by composing it within GCS, rather than reading and writing the
+// data. Any local modifications are discarded, so EOPNOTSUPP is returned if
+// the file is larger than that object, since copying over its start would
+// then leave the remainder in place. EOPNOTSUPP is also returned if the file
+// has been clobbered, so that the data is written and synced the usual way,
+// and the clobbering dealt with according to the conflict policy.
+//
+// After this method succeeds, SourceGeneration will return the new generation
+// by which this inode should be known.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) CopyFrom(
+	ctx context.Context,
+	src *gcs.Object) (err error) {
+	// Don't throw away an upload in progress.
+	if f.stream != nil {
+		err = syscall.EOPNOTSUPP
+		return
+	}
+
+	// Find the current size.
+	size := int64(f.src.Size)
+	if f.content != nil {
+		var sr gcsx.StatResult
+		sr, err = f.content.Stat()
+		if err != nil {
+			err = fmt.Errorf("Stat: %v", err)
+			return
+		}
+
+		size = sr.Size
+	}
+
+	if size > int64(src.Size) {
+		err = syscall.EOPNOTSUPP
+		return
+	}
+
+	// Compose the source over the generation we derive from.
+	srcGen := f.SourceGeneration()
+	mtime := f.mtimeClock.Now().UTC().Format(time.RFC3339Nano)
+	o, err := f.bucket.ComposeObjects(
+		ctx,
+		&gcs.ComposeObjectsRequest{
+			DstName:                       f.name,
+			DstGenerationPrecondition:     &srcGen.Object,
+			DstMetaGenerationPrecondition: &srcGen.Metadata,
+			Sources: []gcs.ComposeSource{
+				gcs.ComposeSource{
+					Name:       src.Name,
+					Generation: src.Generation,
+				},
+			},
+			Metadata: map[string]string{
+				FileMtimeMetadataKey: mtime,
+			},
+		})
+
+	// Special case: a precondition error means we were clobbered, in which case
+	// nothing was copied.
+	if _, ok := err.(*gcs.PreconditionError); ok {
+		err = syscall.EOPNOTSUPP
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("ComposeObjects: %w", err)
+		return
+	}
+
+	// Update our state.
+	if f.content != nil {
+		f.content.Destroy()
+		f.content = nil
+	}
+
+	f.src = *o
+	f.checksums = nil
+
+	return
+}
+
+// If the inode was created with tailFollow set, has no local modifications,
+// and the object in GCS has been replaced by a newer generation at least as
+// large as the source object, e.g. because a log was uploaded again with more
+// data, make that generation the source object and return true. Otherwise do
+// nothing, leaving a smaller generation to be treated as a clobbering.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) Follow(ctx context.Context) (followed bool, err error) {
+	if !f.tailFollow || f.destroyed || !f.SourceGenerationIsAuthoritative() {
+		return
+	}
+
+	o, err := f.bucket.StatObject(ctx, &gcs.StatObjectRequest{Name: f.name})
+
+	// Special case: there is nothing to follow if the object is gone.
+	if _, ok := err.(*gcs.NotFoundError); ok {
+		err = nil
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("StatObject: %w", err)
+		return
+	}
+
+	if o.Generation <= f.src.Generation || o.Size < f.src.Size {
+		return
+	}
+
+	f.src = *o
+	followed = true
+
+	return
+}
+
+// Rewrite the source object as an ordinary object with a single component
+// (see gcsx.CompactObject), provided it is still the supplied generation and
+// there are no local modifications, updating the inode to the new generation.
+// Otherwise, or if the object has been clobbered, do nothing and return false.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) Compact(
+	ctx context.Context,
+	generation int64) (compacted bool, err error) {
+	if f.destroyed ||
+		f.content != nil ||
+		f.stream != nil ||
+		f.src.Generation != generation {
+		return
+	}
+
+	o, err := gcsx.CompactObject(ctx, f.bucket, &f.src)
+
+	// Special case: a precondition error means we were clobbered.
+	if _, ok := err.(*gcs.PreconditionError); ok {
+		err = nil
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("CompactObject: %w", err)
+		return
+	}
+
+	// The contents are unchanged.
+	if f.pageCacheGeneration == generation {
+		f.pageCacheGeneration = o.Generation
+	}
+
+	f.src = *o
+	compacted = true
+
+	return
+}
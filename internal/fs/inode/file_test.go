@@ -15,21 +15,24 @@
 package inode_test
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"strconv"
+	"syscall"
 	"testing"
 	"time"
 
 	"golang.org/x/net/context"
 
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseops"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
 	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
 	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
-	"github.com/jacobsa/fuse/fuseops"
-	"github.com/jacobsa/gcloud/gcs"
-	"github.com/jacobsa/gcloud/gcs/gcsfake"
-	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
 	. "github.com/jacobsa/ogletest"
 	"github.com/jacobsa/timeutil"
 )
@@ -54,6 +57,7 @@ type FileTest struct {
 
 	initialContents string
 	backingObj      *gcs.Object
+	conflicts       inode.ConflictPolicy
 
 	in *inode.FileInode
 }
@@ -107,6 +111,10 @@ func (t *FileTest) createInode() {
 			".gcsfuse_tmp/",
 			t.bucket),
 		"",
+		0, // Stream chunk size
+		gcsx.ParallelDownload{},
+		false, // Tail follow
+		t.conflicts,
 		&t.clock)
 
 	t.in.Lock()
@@ -322,6 +330,28 @@ func (t *FileTest) Truncate() {
 	ExpectThat(attrs.Mtime, timeutil.TimeEq(truncateTime))
 }
 
+func (t *FileTest) WriteBeyondMaxObjectSize() {
+	err := t.in.Write(t.ctx, []byte("burrito"), gcsx.MaxObjectSize-1)
+	ExpectEq(syscall.EFBIG, err)
+
+	// The contents should be unchanged.
+	attrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(len("taco"), attrs.Size)
+}
+
+func (t *FileTest) TruncateBeyondMaxObjectSize() {
+	var err error
+
+	// Exactly the limit is fine.
+	err = t.in.Truncate(t.ctx, gcsx.MaxObjectSize)
+	AssertEq(nil, err)
+
+	// One more is not.
+	err = t.in.Truncate(t.ctx, gcsx.MaxObjectSize+1)
+	ExpectEq(syscall.EFBIG, err)
+}
+
 func (t *FileTest) WriteThenSync() {
 	var attrs fuseops.InodeAttributes
 	var err error
@@ -532,6 +562,86 @@ func (t *FileTest) Sync_Clobbered() {
 	ExpectEq(newObj.Size, o.Size)
 }
 
+func (t *FileTest) Sync_Clobbered_Fail() {
+	var err error
+
+	t.conflicts = inode.FailOnConflict
+	t.createInode()
+
+	err = t.in.Write(t.ctx, []byte("p"), 0)
+	AssertEq(nil, err)
+
+	// Clobber the backing object.
+	_, err = gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		t.in.Name(),
+		[]byte("burrito"))
+
+	AssertEq(nil, err)
+
+	// Sync. The conflict should be reported, and the contents kept.
+	err = t.in.Sync(t.ctx)
+
+	var precondition *gcs.PreconditionError
+	ExpectTrue(errors.As(err, &precondition), "err: %v", err)
+	ExpectEq(t.backingObj.Generation, t.in.SourceGeneration().Object)
+
+	buf := make([]byte, 8)
+	n, err := t.in.Read(t.ctx, buf, 0)
+	AssertEq(io.EOF, err)
+	ExpectEq("paco", string(buf[:n]))
+
+	// The object in the bucket should not have been changed.
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, t.in.Name())
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+}
+
+func (t *FileTest) Sync_Clobbered_Copy() {
+	var err error
+
+	t.conflicts = inode.CopyOnConflict
+	t.createInode()
+
+	err = t.in.Write(t.ctx, []byte("p"), 0)
+	AssertEq(nil, err)
+
+	// Clobber the backing object.
+	_, err = gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		t.in.Name(),
+		[]byte("burrito"))
+
+	AssertEq(nil, err)
+
+	// Sync. The call should succeed, leaving the other writer's contents in
+	// place and ours beside them.
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, t.in.Name())
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+
+	copyName := inode.ConflictCopyName(t.in.Name(), t.backingObj.Generation)
+	contents, err = gcsutil.ReadObject(t.ctx, t.bucket, copyName)
+	AssertEq(nil, err)
+	ExpectEq("paco", string(contents))
+
+	// Later syncs replace the copy.
+	err = t.in.Write(t.ctx, []byte("t"), 0)
+	AssertEq(nil, err)
+
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+
+	contents, err = gcsutil.ReadObject(t.ctx, t.bucket, copyName)
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
 func (t *FileTest) SetMtime_ContentNotFaultedIn() {
 	var err error
 	var attrs fuseops.InodeAttributes
@@ -675,3 +785,450 @@ func (t *FileTest) SetMtime_SourceObjectMetaGenerationChanged() {
 	ExpectEq(newObj.Generation, o.Generation)
 	ExpectEq(newObj.MetaGeneration, o.MetaGeneration)
 }
+
+func (t *FileTest) CopyFrom() {
+	var err error
+
+	// Dirty the file, then copy a longer object over it.
+	err = t.in.Write(t.ctx, []byte("p"), 0)
+	AssertEq(nil, err)
+
+	src, err := gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		"baz",
+		[]byte("burrito"))
+
+	AssertEq(nil, err)
+
+	err = t.in.CopyFrom(t.ctx, src)
+	AssertEq(nil, err)
+
+	// The inode should now be backed by a new generation with the source's
+	// contents.
+	ExpectTrue(t.in.SourceGenerationIsAuthoritative())
+	ExpectNe(t.backingObj.Generation, t.in.SourceGeneration().Object)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, t.in.Name())
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+
+	attrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(len("burrito"), attrs.Size)
+	ExpectThat(attrs.Mtime, timeutil.TimeEq(t.clock.Now().UTC()))
+}
+
+func (t *FileTest) CopyFrom_SourceShorter() {
+	src, err := gcsutil.CreateObject(t.ctx, t.bucket, "baz", []byte("tac"))
+	AssertEq(nil, err)
+
+	err = t.in.CopyFrom(t.ctx, src)
+	ExpectEq(syscall.EOPNOTSUPP, err)
+
+	// Nothing should have changed.
+	ExpectEq(t.backingObj.Generation, t.in.SourceGeneration().Object)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, t.in.Name())
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *FileTest) CopyFrom_Clobbered() {
+	var err error
+
+	// Dirty the file.
+	err = t.in.Write(t.ctx, []byte("p"), 0)
+	AssertEq(nil, err)
+
+	src, err := gcsutil.CreateObject(t.ctx, t.bucket, "baz", []byte("burrito"))
+	AssertEq(nil, err)
+
+	// Clobber the backing object.
+	newObj, err := gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		t.in.Name(),
+		[]byte("enchilada"))
+
+	AssertEq(nil, err)
+
+	// Copy. The kernel should be told to fall back to writing the data, and
+	// nothing should change.
+	err = t.in.CopyFrom(t.ctx, src)
+	ExpectEq(syscall.EOPNOTSUPP, err)
+	ExpectEq(t.backingObj.Generation, t.in.SourceGeneration().Object)
+
+	o, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: t.in.Name()})
+
+	AssertEq(nil, err)
+	ExpectEq(newObj.Generation, o.Generation)
+
+	// The local modifications should be intact.
+	buf := make([]byte, 4)
+	n, err := t.in.Read(t.ctx, buf, 0)
+	AssertEq(nil, err)
+	ExpectEq("paco", string(buf[:n]))
+}
+
+func (t *FileTest) KeepPageCache() {
+	var err error
+
+	// Nothing has changed since the inode was created.
+	ExpectTrue(t.in.KeepPageCache())
+
+	// Writes go through the kernel, so writing them out leaves its pages valid.
+	err = t.in.Write(t.ctx, []byte("burrito"), 0)
+	AssertEq(nil, err)
+
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+	AssertNe(t.backingObj.Generation, t.in.SourceGeneration().Object)
+
+	ExpectTrue(t.in.KeepPageCache())
+
+	// Copying in another object doesn't, but only until the next open.
+	src, err := gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		"baz",
+		[]byte("enchilada"))
+
+	AssertEq(nil, err)
+
+	err = t.in.CopyFrom(t.ctx, src)
+	AssertEq(nil, err)
+
+	ExpectFalse(t.in.KeepPageCache())
+	ExpectTrue(t.in.KeepPageCache())
+}
+
+func (t *FileTest) Compact() {
+	var err error
+
+	// Make the backing object a composite.
+	t.backingObj, err = t.bucket.ComposeObjects(
+		t.ctx,
+		&gcs.ComposeObjectsRequest{
+			DstName: fileInodeName,
+			Sources: []gcs.ComposeSource{
+				gcs.ComposeSource{Name: fileInodeName},
+				gcs.ComposeSource{Name: fileInodeName},
+			},
+		})
+
+	AssertEq(nil, err)
+	t.createInode()
+
+	// Compact it.
+	compacted, err := t.in.Compact(t.ctx, t.backingObj.Generation)
+	AssertEq(nil, err)
+	ExpectTrue(compacted)
+
+	ExpectNe(t.backingObj.Generation, t.in.SourceGeneration().Object)
+	ExpectEq(1, t.in.Source().ComponentCount)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, t.in.Name())
+	AssertEq(nil, err)
+	ExpectEq("tacotaco", string(contents))
+
+	// Compacting the old generation again should do nothing.
+	compacted, err = t.in.Compact(t.ctx, t.backingObj.Generation)
+	AssertEq(nil, err)
+	ExpectFalse(compacted)
+}
+
+func (t *FileTest) Compact_Dirty() {
+	err := t.in.Write(t.ctx, []byte("p"), 0)
+	AssertEq(nil, err)
+
+	compacted, err := t.in.Compact(t.ctx, t.backingObj.Generation)
+	AssertEq(nil, err)
+	ExpectFalse(compacted)
+	ExpectEq(t.backingObj.Generation, t.in.SourceGeneration().Object)
+}
+
+func (t *FileTest) Compact_Clobbered() {
+	newObj, err := gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		t.in.Name(),
+		[]byte("burrito"))
+
+	AssertEq(nil, err)
+
+	compacted, err := t.in.Compact(t.ctx, t.backingObj.Generation)
+	AssertEq(nil, err)
+	ExpectFalse(compacted)
+	ExpectEq(t.backingObj.Generation, t.in.SourceGeneration().Object)
+
+	o, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: t.in.Name()})
+
+	AssertEq(nil, err)
+	ExpectEq(newObj.Generation, o.Generation)
+}
+
+func (t *FileTest) LocalState() {
+	var err error
+
+	// The state is published when the inode is unlocked.
+	relock := func() inode.LocalState {
+		t.in.Unlock()
+		defer t.in.Lock()
+		return t.in.LocalState()
+	}
+
+	// Nothing is held locally at first.
+	ExpectThat(relock(), DeepEquals(inode.LocalState{}))
+
+	// Reading faults in clean contents.
+	_, err = t.in.Read(t.ctx, make([]byte, 4), 0)
+	AssertEq(nil, err)
+	ExpectThat(relock(), DeepEquals(inode.LocalState{CachedBytes: 4}))
+
+	// Appending dirties only the new bytes.
+	err = t.in.Write(t.ctx, []byte("s"), 4)
+	AssertEq(nil, err)
+	ExpectThat(
+		relock(),
+		DeepEquals(inode.LocalState{
+			CachedBytes: 5,
+			Dirty:       true,
+			DirtyBytes:  1,
+		}))
+
+	// Overwriting dirties everything.
+	err = t.in.Write(t.ctx, []byte("p"), 0)
+	AssertEq(nil, err)
+	ExpectThat(
+		relock(),
+		DeepEquals(inode.LocalState{
+			CachedBytes: 5,
+			Dirty:       true,
+			DirtyBytes:  5,
+		}))
+
+	// Syncing discards the local contents.
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+	ExpectThat(relock(), DeepEquals(inode.LocalState{}))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Streaming writes
+////////////////////////////////////////////////////////////////////////
+
+// Tests for an inode created with a positive streamChunkSize.
+
+type StreamingFileTest struct {
+	ctx    context.Context
+	bucket gcs.Bucket
+	clock  timeutil.SimulatedClock
+
+	backingObj *gcs.Object
+	in         *inode.FileInode
+}
+
+var _ SetUpInterface = &StreamingFileTest{}
+var _ TearDownInterface = &StreamingFileTest{}
+
+func init() { RegisterTestSuite(&StreamingFileTest{}) }
+
+func (t *StreamingFileTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2012, 8, 15, 22, 56, 0, 0, time.Local))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	// Start with an empty object, as if it had just been created.
+	var err error
+	t.backingObj, err = gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		fileInodeName,
+		[]byte{})
+
+	AssertEq(nil, err)
+
+	// Create the inode.
+	t.in = inode.NewFileInode(
+		fileInodeID,
+		t.backingObj,
+		fuseops.InodeAttributes{
+			Uid:  uid,
+			Gid:  gid,
+			Mode: fileMode,
+		},
+		t.bucket,
+		gcsx.NewSyncer(
+			1, // Append threshold
+			".gcsfuse_tmp/",
+			t.bucket),
+		"",
+		gcsx.DefaultStreamChunkSize,
+		gcsx.ParallelDownload{},
+		false, // Tail follow
+		inode.DiscardOnConflict,
+		&t.clock)
+
+	t.in.Lock()
+}
+
+func (t *StreamingFileTest) TearDown() {
+	t.in.Unlock()
+}
+
+func (t *StreamingFileTest) SequentialWritesThenSync() {
+	var err error
+
+	err = t.in.Write(t.ctx, []byte("taco"), 0)
+	AssertEq(nil, err)
+
+	err = t.in.Write(t.ctx, []byte("burrito"), 4)
+	AssertEq(nil, err)
+
+	// Nothing is visible in the bucket yet, but the inode knows what it holds.
+	ExpectFalse(t.in.SourceGenerationIsAuthoritative())
+	ExpectEq(nil, t.in.Checksums())
+
+	attrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(len("tacoburrito"), attrs.Size)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, t.in.Name())
+	AssertEq(nil, err)
+	ExpectEq("", string(contents))
+
+	// Sync.
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+
+	ExpectTrue(t.in.SourceGenerationIsAuthoritative())
+	ExpectLt(t.backingObj.Generation, t.in.SourceGeneration().Object)
+	ExpectEq(len("tacoburrito"), t.in.Source().Size)
+
+	checksums := t.in.Checksums()
+	AssertNe(nil, checksums)
+	ExpectTrue(checksums.Matched)
+
+	contents, err = gcsutil.ReadObject(t.ctx, t.bucket, t.in.Name())
+	AssertEq(nil, err)
+	ExpectEq("tacoburrito", string(contents))
+}
+
+func (t *StreamingFileTest) MtimeIsThatOfLastWrite() {
+	var err error
+
+	err = t.in.Write(t.ctx, []byte("taco"), 0)
+	AssertEq(nil, err)
+
+	t.clock.AdvanceTime(time.Second)
+	mtime := t.clock.Now()
+
+	err = t.in.Write(t.ctx, []byte("burrito"), 4)
+	AssertEq(nil, err)
+
+	t.clock.AdvanceTime(time.Second)
+
+	// Sync. The object should record the mtime of the last write.
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+
+	o, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: t.in.Name()})
+
+	AssertEq(nil, err)
+	ExpectEq(
+		mtime.UTC().Format(time.RFC3339Nano),
+		o.Metadata[inode.FileMtimeMetadataKey])
+
+	// So should the inode, without a jump when the upload finished.
+	attrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectThat(attrs.Mtime, timeutil.TimeEq(mtime.UTC()))
+}
+
+func (t *StreamingFileTest) NonSequentialWrite() {
+	var err error
+
+	err = t.in.Write(t.ctx, []byte("taco"), 0)
+	AssertEq(nil, err)
+
+	// Overwrite a byte. This should finish the upload and continue locally.
+	err = t.in.Write(t.ctx, []byte("p"), 0)
+	AssertEq(nil, err)
+
+	ExpectLt(t.backingObj.Generation, t.in.SourceGeneration().Object)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, t.in.Name())
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	// Sync.
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+
+	contents, err = gcsutil.ReadObject(t.ctx, t.bucket, t.in.Name())
+	AssertEq(nil, err)
+	ExpectEq("paco", string(contents))
+}
+
+func (t *StreamingFileTest) ReadWhileStreaming() {
+	var err error
+
+	err = t.in.Write(t.ctx, []byte("taco"), 0)
+	AssertEq(nil, err)
+
+	buf := make([]byte, 4)
+	n, err := t.in.Read(t.ctx, buf, 0)
+	if err == io.EOF {
+		err = nil
+	}
+
+	AssertEq(nil, err)
+	ExpectEq("taco", string(buf[:n]))
+
+	// Further writes go to local content.
+	err = t.in.Write(t.ctx, []byte("s"), 4)
+	AssertEq(nil, err)
+
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, t.in.Name())
+	AssertEq(nil, err)
+	ExpectEq("tacos", string(contents))
+}
+
+func (t *StreamingFileTest) Sync_Clobbered() {
+	var err error
+
+	err = t.in.Write(t.ctx, []byte("taco"), 0)
+	AssertEq(nil, err)
+
+	// Clobber the backing object.
+	newObj, err := gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		t.in.Name(),
+		[]byte("burrito"))
+
+	AssertEq(nil, err)
+
+	// Sync. The call should succeed, but nothing should change.
+	err = t.in.Sync(t.ctx)
+
+	AssertEq(nil, err)
+	ExpectEq(t.backingObj.Generation, t.in.SourceGeneration().Object)
+
+	o, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: t.in.Name()})
+
+	AssertEq(nil, err)
+	ExpectEq(newObj.Generation, o.Generation)
+}
@@ -17,7 +17,7 @@ package inode
 import (
 	"sync"
 
-	"github.com/jacobsa/fuse/fuseops"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseops"
 	"golang.org/x/net/context"
 )
 
@@ -17,7 +17,7 @@ package inode
 import (
 	"fmt"
 
-	"github.com/jacobsa/fuse/fuseops"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseops"
 )
 
 // A helper struct for implementing lookup counts. The only value added is some
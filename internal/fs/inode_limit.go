@@ -0,0 +1,268 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"syscall"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseops"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/handle"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"golang.org/x/net/context"
+)
+
+// Inodes live for as long as the kernel refers to them, which for a walk of a
+// large tree (e.g. by find or du) can be a very long time: the kernel keeps
+// entries for everything it has looked up until it comes under memory
+// pressure itself. So when there are more inodes than the configured limit, we
+// ask the kernel to drop its entries for the least recently looked up inodes
+// that aren't open. It then forgets them in the usual way, and we destroy
+// them once their lookup counts reach zero.
+
+// The extended attribute on the root directory through which the file system
+// reports its inode population.
+const inodesXattr = "user.gcsfuse.inodes"
+
+// A fuse.Server that tells the file system about the connection it serves, so
+// that it can send notifications to the kernel.
+type connectionRecordingServer struct {
+	fuse.Server
+	fs *fileSystem
+}
+
+func (s *connectionRecordingServer) ServeOps(c *fuse.Connection) {
+	s.fs.mu.Lock()
+	s.fs.conn = c
+	s.fs.mu.Unlock()
+
+	s.Server.ServeOps(c)
+}
+
+// Record that the supplied inode has just been looked up, waking up the
+// enforcer if there are now too many inodes.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) touchInode(id fuseops.InodeID) {
+	if fs.inodeLimit <= 0 || id == fuseops.RootInodeID {
+		return
+	}
+
+	if e, ok := fs.inodeLRUElems[id]; ok {
+		fs.inodeLRU.MoveToBack(e)
+	} else {
+		fs.inodeLRUElems[id] = fs.inodeLRU.PushBack(id)
+	}
+
+	if len(fs.inodes) > fs.inodeLimit {
+		select {
+		case fs.inodeLimitExceeded <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Stop tracking the supplied inode, which has been destroyed.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) untrackInode(id fuseops.InodeID) {
+	if e, ok := fs.inodeLRUElems[id]; ok {
+		fs.inodeLRU.Remove(e)
+		delete(fs.inodeLRUElems, id)
+	}
+}
+
+// Return the inode of the directory containing the file or directory with
+// the supplied name, or nil if it has none, along with the name relative to
+// it.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) parentDirInode(
+	name string) (parent inode.DirInode, childName string) {
+	name = strings.TrimSuffix(name, "/")
+	i := strings.LastIndex(name, "/")
+	parentName := name[:i+1]
+	childName = name[i+1:]
+
+	switch {
+	case parentName == "":
+		parent = fs.inodes[fuseops.RootInodeID].(inode.DirInode)
+
+	case fs.implicitDirInodes[parentName] != nil:
+		parent = fs.implicitDirInodes[parentName]
+
+	default:
+		parent, _ = fs.generationBackedInodes[parentName].(inode.DirInode)
+	}
+
+	return
+}
+
+// An entry in the kernel's directory entry cache.
+type kernelEntry struct {
+	parent fuseops.InodeID
+	name   string
+}
+
+// Find the kernel's directory entry for the supplied inode, if its parent
+// directory still has an inode.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) kernelEntry(in inode.Inode) (e kernelEntry, ok bool) {
+	var parent inode.DirInode
+	parent, e.name = fs.parentDirInode(in.Name())
+	if parent == nil {
+		return
+	}
+
+	e.parent = parent.ID()
+	ok = true
+	return
+}
+
+// Choose the kernel entries to invalidate to bring the number of inodes back
+// down to 90% of the limit, so that we aren't woken up again by the next
+// lookup. Inodes chosen are moved to the back of the queue, so that another
+// pass made before the kernel forgets them chooses others.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) chooseEntriesToInvalidate() (entries []kernelEntry) {
+	target := fs.inodeLimit - fs.inodeLimit/10
+	excess := len(fs.inodes) - target
+	if excess <= 0 {
+		return
+	}
+
+	// Open inodes can't be forgotten.
+	open := make(map[fuseops.InodeID]bool)
+	for _, h := range fs.handles {
+		switch h := h.(type) {
+		case *handle.FileHandle:
+			open[h.Inode().ID()] = true
+
+		case *dirHandle:
+			open[h.in.ID()] = true
+		}
+	}
+
+	var chosen []fuseops.InodeID
+	for e := fs.inodeLRU.Front(); e != nil && len(chosen) < excess; e = e.Next() {
+		id := e.Value.(fuseops.InodeID)
+		if open[id] {
+			continue
+		}
+
+		entry, ok := fs.kernelEntry(fs.inodes[id])
+		if !ok {
+			continue
+		}
+
+		entries = append(entries, entry)
+		chosen = append(chosen, id)
+	}
+
+	for _, id := range chosen {
+		fs.inodeLRU.MoveToBack(fs.inodeLRUElems[id])
+	}
+
+	return
+}
+
+// Ask the kernel to forget enough of the least recently looked up inodes to
+// bring the number of inodes back under the limit.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) invalidateLeastRecentlyUsed() {
+	fs.mu.Lock()
+	conn := fs.conn
+	entries := fs.chooseEntriesToInvalidate()
+	fs.mu.Unlock()
+
+	if conn == nil {
+		return
+	}
+
+	var invalidated uint64
+	for _, e := range entries {
+		err := conn.InvalidateEntry(e.parent, e.name)
+
+		// Special case: the kernel has already dropped the entry.
+		if err == syscall.ENOENT {
+			continue
+		}
+
+		if err != nil {
+			log.Printf("InvalidateEntry(%v, %q): %v", e.parent, e.name, err)
+			continue
+		}
+
+		invalidated++
+	}
+
+	fs.mu.Lock()
+	fs.entriesInvalidated += invalidated
+	fs.mu.Unlock()
+}
+
+// Keep the number of inodes under the limit until the context is cancelled.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) enforceInodeLimit(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-fs.inodeLimitExceeded:
+		}
+
+		fs.invalidateLeastRecentlyUsed()
+	}
+}
+
+// Return the value of inodesXattr, e.g.
+// "total=1200 files=1000 dirs=199 symlinks=1 limit=1000 invalidated=340".
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) inodesXattrValue() string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var files, dirs, symlinks int
+	for _, in := range fs.inodes {
+		switch in.(type) {
+		case *inode.FileInode:
+			files++
+
+		case inode.DirInode:
+			dirs++
+
+		case *inode.SymlinkInode:
+			symlinks++
+		}
+	}
+
+	return fmt.Sprintf(
+		"total=%d files=%d dirs=%d symlinks=%d limit=%d invalidated=%d",
+		len(fs.inodes),
+		files,
+		dirs,
+		symlinks,
+		fs.inodeLimit,
+		fs.entriesInvalidated)
+}
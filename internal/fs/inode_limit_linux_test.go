@@ -0,0 +1,101 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Tests for the inode limit. These read the inode population through
+// syscall.Getxattr, which is available only on Linux.
+
+package fs_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	. "github.com/jacobsa/ogletest"
+)
+
+type InodeLimitTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&InodeLimitTest{}) }
+
+func (t *InodeLimitTest) SetUp(ti *TestInfo) {
+	t.serverCfg.InodeLimit = 20
+	t.fsTest.SetUp(ti)
+}
+
+// Return the number of inodes the file system reports having.
+func (t *InodeLimitTest) inodeCount() (total int) {
+	buf := make([]byte, 256)
+	n, err := syscall.Getxattr(t.mfs.Dir(), "user.gcsfuse.inodes", buf)
+	AssertEq(nil, err)
+
+	_, err = fmt.Sscanf(string(buf[:n]), "total=%d", &total)
+	AssertEq(nil, err)
+
+	return
+}
+
+func (t *InodeLimitTest) StaysNearLimit() {
+	// Create and stat many more files than the limit.
+	contents := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		contents[fmt.Sprintf("foo%d", i)] = "taco"
+	}
+
+	AssertEq(nil, t.createObjects(contents))
+
+	for name := range contents {
+		_, err := os.Stat(path.Join(t.Dir, name))
+		AssertEq(nil, err)
+	}
+
+	// The kernel forgets inodes asynchronously, so wait for it to catch up.
+	deadline := time.Now().Add(5 * time.Second)
+	for t.inodeCount() > 20 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ExpectLe(t.inodeCount(), 20)
+}
+
+func (t *InodeLimitTest) OpenFilesKept() {
+	AssertEq(nil, t.createWithContents("foo", "taco"))
+
+	f, err := os.Open(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	defer f.Close()
+
+	// Stat many more files than the limit.
+	contents := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		contents[fmt.Sprintf("bar%d", i)] = "burrito"
+	}
+
+	AssertEq(nil, t.createObjects(contents))
+
+	for name := range contents {
+		_, err := os.Stat(path.Join(t.Dir, name))
+		AssertEq(nil, err)
+	}
+
+	// The open file is still usable.
+	b, err := ioutil.ReadAll(f)
+	AssertEq(nil, err)
+	ExpectEq("taco", string(b))
+}
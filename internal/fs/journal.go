@@ -0,0 +1,290 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	"github.com/jacobsa/syncutil"
+)
+
+// Renames are emulated by copying an object and then deleting the source, so
+// a crash between the two steps leaves both in place. To allow cleaning up
+// after such a crash, operations that rename many objects (directory and
+// batch renames) first record them in a journal object stored under this name
+// within the temporary object prefix, which is deleted once the operation
+// finishes. Journals left behind are recovered by the garbage collector once
+// they are stale.
+const journalDir = "journal/"
+
+// A rename recorded in a journal: the particular generation of the source
+// object that is being moved, and its destination.
+type journalEntry struct {
+	Src               string `json:"src"`
+	SrcGeneration     int64  `json:"src_generation"`
+	SrcMetaGeneration int64  `json:"src_meta_generation"`
+	Dst               string `json:"dst"`
+}
+
+// Write a journal recording the supplied renames, returning its name.
+func writeJournal(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	journalPrefix string,
+	entries []journalEntry) (name string, err error) {
+	contents, err := json.Marshal(entries)
+	if err != nil {
+		err = fmt.Errorf("Marshal: %v", err)
+		return
+	}
+
+	suffix, err := randomHexString()
+	if err != nil {
+		err = fmt.Errorf("randomHexString: %v", err)
+		return
+	}
+
+	name = journalPrefix + suffix
+	_, err = bucket.CreateObject(
+		ctx,
+		&gcs.CreateObjectRequest{
+			Name:     name,
+			Contents: bytes.NewReader(contents),
+		})
+
+	if err != nil {
+		err = fmt.Errorf("CreateObject: %w", err)
+		return
+	}
+
+	return
+}
+
+// Delete a journal once the operation it records has finished. Failure is not
+// fatal, since the journal will later be recovered harmlessly, so it is only
+// logged.
+func clearJournal(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	name string) {
+	err := bucket.DeleteObject(ctx, &gcs.DeleteObjectRequest{Name: name})
+	if err != nil {
+		log.Printf("Deleting journal %q: %v", name, err)
+	}
+}
+
+// Finish or abandon a rename that may have been interrupted. If the
+// destination holds a copy of the journalled source generation, the rename is
+// rolled forward by deleting the source. Otherwise the copy never happened (or
+// the destination has since been overwritten), so the source is left alone.
+//
+// This must not be called while the rename may still be in progress, since
+// the process carrying it out may yet fail to finish the copy and go on using
+// the source.
+func recoverJournalEntry(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	e journalEntry) (err error) {
+	// Is the source still as it was?
+	src, err := bucket.StatObject(ctx, &gcs.StatObjectRequest{Name: e.Src})
+	if _, ok := err.(*gcs.NotFoundError); ok {
+		err = nil
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("StatObject(%q): %v", e.Src, err)
+		return
+	}
+
+	if src.Generation != e.SrcGeneration ||
+		src.MetaGeneration != e.SrcMetaGeneration {
+		return
+	}
+
+	// Does the destination hold a copy of it?
+	dst, err := bucket.StatObject(ctx, &gcs.StatObjectRequest{Name: e.Dst})
+	if _, ok := err.(*gcs.NotFoundError); ok {
+		err = nil
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("StatObject(%q): %v", e.Dst, err)
+		return
+	}
+
+	if !sameContents(src, dst) {
+		return
+	}
+
+	// Roll forward.
+	err = bucket.DeleteObject(
+		ctx,
+		&gcs.DeleteObjectRequest{
+			Name:                       e.Src,
+			Generation:                 e.SrcGeneration,
+			MetaGenerationPrecondition: &e.SrcMetaGeneration,
+		})
+
+	// Special case: the source may have changed since we looked.
+	if _, ok := err.(*gcs.PreconditionError); ok {
+		err = nil
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("DeleteObject(%q): %v", e.Src, err)
+		return
+	}
+
+	return
+}
+
+// Do the records for the two objects indicate that they have the same
+// contents, as they will if one was copied from the other?
+func sameContents(a *gcs.Object, b *gcs.Object) bool {
+	if a.Size != b.Size || a.CRC32C != b.CRC32C {
+		return false
+	}
+
+	if (a.MD5 == nil) != (b.MD5 == nil) {
+		return false
+	}
+
+	return a.MD5 == nil || *a.MD5 == *b.MD5
+}
+
+// Recover the entries of the supplied journal, then delete it.
+func recoverJournal(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	journal *gcs.Object) (err error) {
+	// Read the generation we listed, so that wrappers needn't stat the journal
+	// to find out which one is current.
+	rc, err := bucket.NewReader(
+		ctx,
+		&gcs.ReadObjectRequest{
+			Name:       journal.Name,
+			Generation: journal.Generation,
+		})
+
+	if err != nil {
+		err = fmt.Errorf("NewReader: %v", err)
+		return
+	}
+
+	contents, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		err = fmt.Errorf("ReadAll: %v", err)
+		return
+	}
+
+	var entries []journalEntry
+	err = json.Unmarshal(contents, &entries)
+	if err != nil {
+		err = fmt.Errorf("Unmarshal: %v", err)
+		return
+	}
+
+	// A journal may record a large batch, so use some parallelism.
+	var firstErr atomic.Value
+	err = forEachParallel(ctx, len(entries), func(ctx context.Context, i int) {
+		if err := recoverJournalEntry(ctx, bucket, entries[i]); err != nil {
+			firstErr.Store(err)
+		}
+	})
+
+	if err != nil {
+		return
+	}
+
+	if v := firstErr.Load(); v != nil {
+		err = v.(error)
+		return
+	}
+
+	// We're done with the journal.
+	err = bucket.DeleteObject(ctx, &gcs.DeleteObjectRequest{Name: journal.Name})
+	if err != nil {
+		err = fmt.Errorf("DeleteObject: %v", err)
+		return
+	}
+
+	return
+}
+
+// Recover each stale journal under the supplied prefix. Journals that can't be
+// recovered are logged and left for next time.
+func recoverJournals(
+	ctx context.Context,
+	journalPrefix string,
+	bucket gcs.Bucket) (journalsRecovered uint64, err error) {
+	b := syncutil.NewBundle(ctx)
+
+	// List all journals.
+	objects := make(chan *gcs.Object, 100)
+	b.Add(func(ctx context.Context) (err error) {
+		defer close(objects)
+		err = gcsutil.ListPrefix(ctx, bucket, journalPrefix, objects)
+		if err != nil {
+			err = fmt.Errorf("ListPrefix: %v", err)
+			return
+		}
+
+		return
+	})
+
+	// Recover those that are stale.
+	now := time.Now()
+	b.Add(func(ctx context.Context) (err error) {
+		for o := range objects {
+			if now.Sub(o.Updated) < stalenessThreshold {
+				continue
+			}
+
+			err := recoverJournal(ctx, bucket, o)
+			if err != nil {
+				log.Printf("Recovering journal %q: %v", o.Name, err)
+				continue
+			}
+
+			journalsRecovered++
+		}
+
+		return
+	})
+
+	err = b.Join()
+	return
+}
+
+// Is the named object within the journal directory under the supplied
+// temporary object prefix?
+func isJournal(tmpObjectPrefix string, name string) bool {
+	return strings.HasPrefix(name, tmpObjectPrefix+journalDir)
+}
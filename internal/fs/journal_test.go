@@ -0,0 +1,214 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Tests for recovery of renames interrupted by a crash.
+
+package fs_test
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const (
+	journalName      = ".gcsfuse_tmp/journal/0123456789abcdef"
+	freshJournalName = ".gcsfuse_tmp/journal/fedcba9876543210"
+)
+
+type JournalTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&JournalTest{}) }
+
+func (t *JournalTest) SetUp(ti *TestInfo) {
+	ctx := ti.Ctx
+	t.serverCfg.RenameDirLimit = 4
+
+	// Create everything an hour ago, as if left behind by another mount.
+	var clock timeutil.SimulatedClock
+	clock.SetTime(time.Now().Add(-time.Hour))
+	t.bucket = gcsfake.NewFakeBucket(&clock, "some_bucket")
+
+	// Simulate a crash in the middle of renaming "foo" to "bar", after the copy
+	// but before the delete, and in the middle of renaming "baz" to "qux",
+	// before the copy.
+	foo, err := gcsutil.CreateObject(ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	_, err = t.bucket.CopyObject(
+		ctx,
+		&gcs.CopyObjectRequest{SrcName: "foo", DstName: "bar"})
+	AssertEq(nil, err)
+
+	baz, err := gcsutil.CreateObject(ctx, t.bucket, "baz", []byte("burrito"))
+	AssertEq(nil, err)
+
+	// Write a journal recording both.
+	journal := fmt.Sprintf(
+		`[
+			{"src": "foo", "src_generation": %d, "src_meta_generation": %d, "dst": "bar"},
+			{"src": "baz", "src_generation": %d, "src_meta_generation": %d, "dst": "qux"}
+		]`,
+		foo.Generation,
+		foo.MetaGeneration,
+		baz.Generation,
+		baz.MetaGeneration)
+
+	_, err = gcsutil.CreateObject(ctx, t.bucket, journalName, []byte(journal))
+	AssertEq(nil, err)
+
+	// Simulate another mount that has just copied "taco" to "queso", and is
+	// about to delete the source.
+	clock.SetTime(time.Now())
+	taco, err := gcsutil.CreateObject(ctx, t.bucket, "taco", []byte("enchilada"))
+	AssertEq(nil, err)
+
+	_, err = t.bucket.CopyObject(
+		ctx,
+		&gcs.CopyObjectRequest{SrcName: "taco", DstName: "queso"})
+	AssertEq(nil, err)
+
+	journal = fmt.Sprintf(
+		`[{"src": "taco", "src_generation": %d, "src_meta_generation": %d, "dst": "queso"}]`,
+		taco.Generation,
+		taco.MetaGeneration)
+
+	_, err = gcsutil.CreateObject(
+		ctx,
+		t.bucket,
+		freshJournalName,
+		[]byte(journal))
+	AssertEq(nil, err)
+
+	// Mounting should cause the stale journal to be recovered.
+	t.fsTest.SetUp(ti)
+}
+
+// Wait for the journal to be recovered by the garbage collector, which runs
+// in the background.
+func (t *JournalTest) waitForRecovery() {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := t.bucket.StatObject(
+			t.ctx,
+			&gcs.StatObjectRequest{Name: journalName})
+
+		if _, ok := err.(*gcs.NotFoundError); ok {
+			return
+		}
+
+		AssertEq(nil, err)
+		if time.Now().After(deadline) {
+			AddFailure("Journal was not recovered.")
+			AbortTest()
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (t *JournalTest) read(name string) (contents string, err error) {
+	b, err := gcsutil.ReadObject(t.ctx, t.bucket, name)
+	contents = string(b)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *JournalTest) CopiedRenameIsRolledForward() {
+	t.waitForRecovery()
+
+	_, err := t.read("foo")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	contents, err := t.read("bar")
+	AssertEq(nil, err)
+	ExpectEq("taco", contents)
+}
+
+func (t *JournalTest) UncopiedRenameIsAbandoned() {
+	t.waitForRecovery()
+
+	contents, err := t.read("baz")
+	AssertEq(nil, err)
+	ExpectEq("burrito", contents)
+
+	_, err = t.read("qux")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *JournalTest) FreshJournalIsLeftAlone() {
+	t.waitForRecovery()
+
+	contents, err := t.read("taco")
+	AssertEq(nil, err)
+	ExpectEq("enchilada", contents)
+
+	_, err = t.read(freshJournalName)
+	ExpectEq(nil, err)
+}
+
+func (t *JournalTest) CompletedRenamesLeaveNoJournal() {
+	t.waitForRecovery()
+
+	// Rename a file and a directory through the file system.
+	err := gcsutil.CreateObjects(
+		t.ctx,
+		t.bucket,
+		map[string][]byte{
+			"salsa":      []byte("verde"),
+			"dir/":       []byte(""),
+			"dir/nachos": []byte("queso"),
+		})
+
+	AssertEq(nil, err)
+
+	err = os.Rename(
+		path.Join(t.mfs.Dir(), "salsa"),
+		path.Join(t.mfs.Dir(), "burrito"))
+
+	AssertEq(nil, err)
+
+	err = os.Rename(
+		path.Join(t.mfs.Dir(), "dir"),
+		path.Join(t.mfs.Dir(), "other"))
+
+	AssertEq(nil, err)
+
+	// No journal should be left behind but the other mount's.
+	objects, _, err := gcsutil.ListAll(
+		t.ctx,
+		t.bucket,
+		&gcs.ListObjectsRequest{Prefix: ".gcsfuse_tmp/journal/"})
+
+	AssertEq(nil, err)
+	AssertEq(1, len(objects))
+	ExpectEq(freshJournalName, objects[0].Name)
+}
@@ -0,0 +1,109 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Tests for the extended attribute reporting lifecycle advice. These use
+// syscall.Getxattr and syscall.Listxattr, which are available only on Linux.
+
+package fs_test
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/googlecloudplatform/gcsfuse/internal/lifecycle"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+type LifecycleXattrTest struct {
+	fsTest
+	bucketClock timeutil.SimulatedClock
+}
+
+func init() { RegisterTestSuite(&LifecycleXattrTest{}) }
+
+func (t *LifecycleXattrTest) SetUp(ti *TestInfo) {
+	// Objects are created at a known time.
+	t.bucketClock.SetTime(time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC))
+	t.bucket = gcsfake.NewFakeBucket(&t.bucketClock, "some_bucket")
+
+	lc := &lifecycle.Config{DefaultStorageClass: "STANDARD"}
+	err := json.Unmarshal(
+		[]byte(`[{
+			"action": {"type": "Delete"},
+			"condition": {"age": 7, "matchesPrefix": ["logs/"]}
+		}]`),
+		&lc.Rules)
+
+	AssertEq(nil, err)
+	t.serverCfg.Lifecycle = lc
+
+	t.fsTest.SetUp(ti)
+}
+
+func (t *LifecycleXattrTest) getLifecycle(p string) string {
+	buf := make([]byte, 1024)
+	n, err := syscall.Getxattr(p, "user.gcsfuse.lifecycle", buf)
+	AssertEq(nil, err)
+
+	return string(buf[:n])
+}
+
+func (t *LifecycleXattrTest) File() {
+	AssertEq(
+		nil,
+		t.createObjects(map[string]string{
+			"logs/":    "",
+			"logs/foo": "taco",
+			"bar":      "burrito",
+		}))
+
+	ExpectEq(
+		"rule=0 action=Delete after=2017-06-08T12:00:00Z",
+		t.getLifecycle(path.Join(t.Dir, "logs/foo")))
+
+	ExpectEq("none", t.getLifecycle(path.Join(t.Dir, "bar")))
+}
+
+func (t *LifecycleXattrTest) Directories() {
+	AssertEq(nil, os.Mkdir(path.Join(t.Dir, "logs"), 0700))
+	AssertEq(nil, os.Mkdir(path.Join(t.Dir, "data"), 0700))
+
+	// Objects written now under logs/ will be deleted in a week.
+	ExpectThat(
+		t.getLifecycle(path.Join(t.Dir, "logs")),
+		HasSubstr("rule=0 action=Delete after="))
+
+	ExpectEq("none", t.getLifecycle(path.Join(t.Dir, "data")))
+
+	// Some objects in the bucket are affected.
+	ExpectThat(t.getLifecycle(t.Dir), HasSubstr("scope=some"))
+}
+
+func (t *LifecycleXattrTest) Listed() {
+	AssertEq(nil, t.createWithContents("foo", "taco"))
+
+	buf := make([]byte, 256)
+	n, err := syscall.Listxattr(path.Join(t.Dir, "foo"), buf)
+	AssertEq(nil, err)
+
+	names := strings.Split(strings.TrimSuffix(string(buf[:n]), "\x00"), "\x00")
+	ExpectThat(names, Contains("user.gcsfuse.lifecycle"))
+}
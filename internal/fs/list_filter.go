@@ -0,0 +1,102 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"syscall"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseops"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+)
+
+// The extended attribute through which a directory's listings can be limited
+// to the objects whose names, relative to the directory, match a glob pattern
+// (e.g. "*.parquet"). The pattern is passed to GCS, so that the objects that
+// don't match are never transferred.
+const listFilterXattr = "user.gcsfuse.list_filter"
+
+// Return the value of listFilterXattr for the supplied inode, if it has one.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) listFilterXattrValue(id fuseops.InodeID) (v string, ok bool) {
+	fs.mu.Lock()
+	in, isDir := fs.inodeOrDie(id).(inode.DirInode)
+	fs.mu.Unlock()
+
+	if !isDir {
+		return
+	}
+
+	in.Lock()
+	v = in.ListFilter()
+	in.Unlock()
+
+	ok = v != ""
+	return
+}
+
+// Set the pattern to which listings of the supplied directory are limited, or
+// remove it if value is nil. flags are as for SetXattrOp. Malformed patterns
+// are rejected with EINVAL.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) setListFilterXattr(
+	id fuseops.InodeID,
+	value *string,
+	flags uint32) (err error) {
+	if value != nil {
+		if _, parseErr := gcs.ParseGlob(*value); parseErr != nil || *value == "" {
+			err = syscall.EINVAL
+			return
+		}
+	}
+
+	fs.mu.Lock()
+	in, isDir := fs.inodeOrDie(id).(inode.DirInode)
+	fs.mu.Unlock()
+
+	if !isDir {
+		err = syscall.ENOTSUP
+		return
+	}
+
+	in.Lock()
+	defer in.Unlock()
+
+	exists := in.ListFilter() != ""
+	switch {
+	case value == nil && !exists:
+		err = fuse.ENOATTR
+		return
+
+	case flags&xattrCreate != 0 && exists:
+		err = syscall.EEXIST
+		return
+
+	case flags&xattrReplace != 0 && !exists:
+		err = fuse.ENOATTR
+		return
+	}
+
+	pattern := ""
+	if value != nil {
+		pattern = *value
+	}
+
+	in.SetListFilter(pattern)
+	return
+}
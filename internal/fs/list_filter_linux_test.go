@@ -0,0 +1,131 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Tests for the extended attribute limiting directory listings to a pattern.
+// These use the xattr syscalls, which are available only on Linux.
+
+package fs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+type ListFilterTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&ListFilterTest{}) }
+
+func (t *ListFilterTest) SetUp(ti *TestInfo) {
+	t.fsTest.SetUp(ti)
+
+	AssertEq(
+		nil,
+		t.createObjects(map[string]string{
+			"data/":          "",
+			"data/a.parquet": "taco",
+			"data/b.csv":     "burrito",
+			"data/sub/":      "",
+			"data/sub/c.csv": "enchilada",
+		}))
+}
+
+// Return the names of the entries in the directory data.
+func (t *ListFilterTest) list() (names []string) {
+	entries, err := ioutil.ReadDir(path.Join(t.Dir, "data"))
+	AssertEq(nil, err)
+
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+
+	return
+}
+
+func (t *ListFilterTest) setFilter(pattern string) error {
+	return syscall.Setxattr(
+		path.Join(t.Dir, "data"),
+		"user.gcsfuse.list_filter",
+		[]byte(pattern),
+		0)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ListFilterTest) ListsMatchingNames() {
+	AssertEq(nil, t.setFilter("*.parquet"))
+	ExpectThat(t.list(), ElementsAre("a.parquet"))
+
+	buf := make([]byte, 256)
+	n, err := syscall.Getxattr(
+		path.Join(t.Dir, "data"),
+		"user.gcsfuse.list_filter",
+		buf)
+
+	AssertEq(nil, err)
+	ExpectEq("*.parquet", string(buf[:n]))
+
+	// Names that don't match can still be looked up.
+	_, err = os.Stat(path.Join(t.Dir, "data/b.csv"))
+	ExpectEq(nil, err)
+
+	// Subdirectories are listed if they contain matching objects.
+	AssertEq(nil, t.setFilter("**.csv"))
+	ExpectThat(t.list(), ElementsAre("b.csv", "sub"))
+}
+
+func (t *ListFilterTest) Removed() {
+	AssertEq(nil, t.setFilter("*.parquet"))
+	ExpectThat(t.list(), ElementsAre("a.parquet"))
+
+	err := syscall.Removexattr(
+		path.Join(t.Dir, "data"),
+		"user.gcsfuse.list_filter")
+
+	AssertEq(nil, err)
+	ExpectThat(t.list(), ElementsAre("a.parquet", "b.csv", "sub"))
+
+	// There is nothing left to remove.
+	err = syscall.Removexattr(
+		path.Join(t.Dir, "data"),
+		"user.gcsfuse.list_filter")
+
+	ExpectEq(syscall.ENODATA, err)
+}
+
+func (t *ListFilterTest) InvalidPatterns() {
+	ExpectEq(syscall.EINVAL, t.setFilter("{a,b"))
+	ExpectEq(syscall.EINVAL, t.setFilter("[a-"))
+	ExpectEq(syscall.EINVAL, t.setFilter(""))
+
+	ExpectThat(t.list(), ElementsAre("a.parquet", "b.csv", "sub"))
+}
+
+func (t *ListFilterTest) Files() {
+	err := syscall.Setxattr(
+		path.Join(t.Dir, "data/b.csv"),
+		"user.gcsfuse.list_filter",
+		[]byte("*"),
+		0)
+
+	ExpectEq(syscall.ENOTSUP, err)
+}
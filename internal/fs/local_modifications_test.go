@@ -32,9 +32,9 @@ import (
 	"unicode"
 	"unicode/utf8"
 
-	"github.com/jacobsa/fuse/fusetesting"
-	"github.com/jacobsa/gcloud/gcs"
-	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fusetesting"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
 	. "github.com/jacobsa/oglematchers"
 	. "github.com/jacobsa/ogletest"
 	"github.com/jacobsa/timeutil"
@@ -1677,6 +1677,23 @@ func (t *FileTest) StatUnopenedFile() {
 	ExpectEq(currentGid(), fi.Sys().(*syscall.Stat_t).Gid)
 }
 
+func (t *FileTest) BlockCount() {
+	var err error
+
+	// Create a file whose size is not a multiple of the block size.
+	err = ioutil.WriteFile(
+		path.Join(t.mfs.Dir(), "foo"),
+		[]byte(strings.Repeat("a", 1025)),
+		0700)
+
+	AssertEq(nil, err)
+
+	// du and friends should see three 512-byte blocks.
+	fi, err := os.Stat(path.Join(t.mfs.Dir(), "foo"))
+	AssertEq(nil, err)
+	ExpectEq(3, fi.Sys().(*syscall.Stat_t).Blocks)
+}
+
 func (t *FileTest) LstatUnopenedFile() {
 	var err error
 
@@ -2042,9 +2059,11 @@ func (t *FileTest) Sync_Clobbered() {
 	// decided to hold back the writes from above until now (in which case the
 	// inode will fail to load the source object), or it may fail silently.
 	// Either way, this should not result in a new generation being created.
+	//
+	// The source generation no longer exists, so such an error is ENOENT.
 	err = t.f1.Sync()
 	if err != nil {
-		ExpectThat(err, Error(HasSubstr("input/output error")))
+		ExpectThat(err, Error(HasSubstr("no such file or directory")))
 	}
 
 	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
@@ -2325,11 +2344,11 @@ func (t *RenameTest) Directory() {
 	err = os.Mkdir(oldPath, 0700)
 	AssertEq(nil, err)
 
-	// Attempt to rename it.
+	// Attempt to rename it. Directory renames are disabled by default.
 	newPath := path.Join(t.Dir, "bar")
 
 	err = os.Rename(oldPath, newPath)
-	ExpectThat(err, Error(HasSubstr("not implemented")))
+	ExpectThat(err, Error(HasSubstr("not supported")))
 }
 
 func (t *RenameTest) WithinDir() {
@@ -0,0 +1,79 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"syscall"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseops"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseutil"
+	"golang.org/x/net/context"
+)
+
+// A file system that refuses with EACCES every op that reads or writes the
+// contents of files, leaving lookups, listings, stats, and changes to the
+// namespace alone. Since files can't be opened, the ops on handles are only
+// checked in case the kernel sends them anyway.
+type metadataOnlyFileSystem struct {
+	fuseutil.FileSystem
+}
+
+func (fs *metadataOnlyFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) (err error) {
+	// Truncation writes contents; other changes don't.
+	if op.Size != nil {
+		err = syscall.EACCES
+		return
+	}
+
+	err = fs.FileSystem.SetInodeAttributes(ctx, op)
+	return
+}
+
+func (fs *metadataOnlyFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) (err error) {
+	err = syscall.EACCES
+	return
+}
+
+func (fs *metadataOnlyFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) (err error) {
+	err = syscall.EACCES
+	return
+}
+
+func (fs *metadataOnlyFileSystem) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) (err error) {
+	err = syscall.EACCES
+	return
+}
+
+func (fs *metadataOnlyFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) (err error) {
+	err = syscall.EACCES
+	return
+}
+
+func (fs *metadataOnlyFileSystem) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) (err error) {
+	err = syscall.EACCES
+	return
+}
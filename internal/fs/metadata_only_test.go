@@ -0,0 +1,98 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type MetadataOnlyTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&MetadataOnlyTest{}) }
+
+func (t *MetadataOnlyTest) SetUp(ti *TestInfo) {
+	t.serverCfg.MetadataOnly = true
+	t.fsTest.SetUp(ti)
+
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *MetadataOnlyTest) Stat() {
+	fi, err := os.Stat(path.Join(t.Dir, "foo"))
+
+	AssertEq(nil, err)
+	ExpectEq(len("taco"), fi.Size())
+}
+
+func (t *MetadataOnlyTest) ReadDir() {
+	entries, err := ioutil.ReadDir(t.Dir)
+
+	AssertEq(nil, err)
+	AssertEq(1, len(entries))
+	ExpectEq("foo", entries[0].Name())
+}
+
+func (t *MetadataOnlyTest) OpenForReading() {
+	_, err := os.Open(path.Join(t.Dir, "foo"))
+	ExpectThat(err, Error(HasSubstr("permission denied")))
+}
+
+func (t *MetadataOnlyTest) OpenForWriting() {
+	_, err := os.OpenFile(path.Join(t.Dir, "foo"), os.O_WRONLY, 0)
+	ExpectThat(err, Error(HasSubstr("permission denied")))
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *MetadataOnlyTest) CreateFile() {
+	err := ioutil.WriteFile(path.Join(t.Dir, "bar"), []byte("burrito"), 0600)
+	ExpectThat(err, Error(HasSubstr("permission denied")))
+}
+
+func (t *MetadataOnlyTest) Truncate() {
+	err := os.Truncate(path.Join(t.Dir, "foo"), 2)
+	ExpectThat(err, Error(HasSubstr("permission denied")))
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *MetadataOnlyTest) Mkdir() {
+	err := os.Mkdir(path.Join(t.Dir, "bar"), 0700)
+	AssertEq(nil, err)
+
+	_, err = gcsutil.ReadObject(t.ctx, t.bucket, "bar/")
+	ExpectEq(nil, err)
+}
@@ -0,0 +1,299 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseops"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"golang.org/x/net/context"
+)
+
+// The prefix of the read-only extended attributes through which file inodes
+// report properties of their backing objects, such as the generation.
+const objectXattrPrefix = "user.gcs.object."
+
+// The extended attribute through which file inodes report all of the custom
+// metadata of their backing objects, as a JSON object.
+const metadataXattr = "user.gcs.metadata"
+
+// The prefix of the extended attributes through which file inodes expose each
+// custom metadata key of their backing objects, for reading and writing.
+const metadataXattrPrefix = metadataXattr + "."
+
+// The extended attributes through which file inodes expose the properties of
+// their backing objects that drive lifecycle rules, for reading and writing:
+// the custom time, in RFC 3339 format, and whether there is a temporary hold,
+// as "true" or "false".
+const (
+	customTimeXattr    = "user.gcs.custom_time"
+	temporaryHoldXattr = "user.gcs.temporary_hold"
+)
+
+// Values of SetXattrOp.Flags; see setxattr(2).
+const (
+	xattrCreate  = 0x1
+	xattrReplace = 0x2
+)
+
+// Is the supplied extended attribute one describing a file's backing object?
+func isObjectXattr(name string) bool {
+	return name == metadataXattr ||
+		name == customTimeXattr ||
+		name == temporaryHoldXattr ||
+		strings.HasPrefix(name, metadataXattrPrefix) ||
+		strings.HasPrefix(name, objectXattrPrefix)
+}
+
+// Is the supplied extended attribute one of those for the custom time and
+// temporary hold?
+func isPropertyXattr(name string) bool {
+	return name == customTimeXattr || name == temporaryHoldXattr
+}
+
+// Return the extended attributes describing the object backing the supplied
+// inode, by name, or nil if it isn't a file. Properties that the object lacks
+// are omitted.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) objectXattrs(
+	id fuseops.InodeID) (xattrs map[string]string, err error) {
+	fs.mu.Lock()
+	in := fs.inodeOrDie(id)
+	fs.mu.Unlock()
+
+	file, isFile := in.(*inode.FileInode)
+	if !isFile {
+		return
+	}
+
+	file.Lock()
+	defer file.Unlock()
+
+	o := file.Source()
+
+	xattrs = make(map[string]string)
+	set := func(name string, v string) {
+		if v != "" {
+			xattrs[name] = v
+		}
+	}
+
+	set(objectXattrPrefix+"content_type", o.ContentType)
+	set(objectXattrPrefix+"content_encoding", o.ContentEncoding)
+	set(objectXattrPrefix+"crc32c", fmt.Sprintf("%08x", o.CRC32C))
+	set(objectXattrPrefix+"generation", strconv.FormatInt(o.Generation, 10))
+	set(
+		objectXattrPrefix+"metageneration",
+		strconv.FormatInt(o.MetaGeneration, 10))
+	set(objectXattrPrefix+"storage_class", o.StorageClass)
+
+	if o.MD5 != nil {
+		set(objectXattrPrefix+"md5", fmt.Sprintf("%x", *o.MD5))
+	}
+
+	if !o.CustomTime.IsZero() {
+		set(customTimeXattr, o.CustomTime.UTC().Format(time.RFC3339Nano))
+	}
+
+	if o.TemporaryHold {
+		set(temporaryHoldXattr, "true")
+	}
+
+	for k, v := range o.Metadata {
+		xattrs[metadataXattrPrefix+k] = v
+	}
+
+	// Report no metadata as an empty object rather than null.
+	metadata := o.Metadata
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+
+	b, err := json.Marshal(metadata)
+	if err != nil {
+		err = fmt.Errorf("Marshal: %v", err)
+		return
+	}
+
+	xattrs[metadataXattr] = string(b)
+	return
+}
+
+// Set the metadata key named by the supplied extended attribute on the object
+// backing the inode, or remove it if value is nil. flags are as for
+// SetXattrOp.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) setMetadataXattr(
+	ctx context.Context,
+	id fuseops.InodeID,
+	name string,
+	value *string,
+	flags uint32) (err error) {
+	key := strings.TrimPrefix(name, metadataXattrPrefix)
+
+	// Object properties and the aggregate are read-only, and gcsfuse's own
+	// keys are managed by it.
+	if !strings.HasPrefix(name, metadataXattrPrefix) ||
+		key == "" ||
+		key == inode.FileMtimeMetadataKey ||
+		key == inode.SymlinkMetadataKey {
+		err = syscall.EPERM
+		return
+	}
+
+	file, err := fs.modifiableFile(id)
+	if err != nil {
+		return
+	}
+
+	file.Lock()
+	defer file.Unlock()
+
+	_, exists := file.Source().Metadata[key]
+	switch {
+	case value == nil && !exists:
+		err = fuse.ENOATTR
+		return
+
+	case flags&xattrCreate != 0 && exists:
+		err = syscall.EEXIST
+		return
+
+	case flags&xattrReplace != 0 && !exists:
+		err = fuse.ENOATTR
+		return
+	}
+
+	err = file.SetMetadata(ctx, key, value)
+	if err != nil {
+		err = fmt.Errorf("SetMetadata: %w", err)
+		return
+	}
+
+	return
+}
+
+// Set the property named by the supplied extended attribute on the
+// object backing the inode, or remove it if value is nil. flags are as for
+// SetXattrOp. A custom time can't be removed or moved earlier, so attempts to
+// do so fail with EPERM and EINVAL respectively; removing a temporary hold
+// releases it.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) setPropertyXattr(
+	ctx context.Context,
+	id fuseops.InodeID,
+	name string,
+	value *string,
+	flags uint32) (err error) {
+	if name == customTimeXattr && value == nil {
+		err = syscall.EPERM
+		return
+	}
+
+	file, err := fs.modifiableFile(id)
+	if err != nil {
+		return
+	}
+
+	file.Lock()
+	defer file.Unlock()
+
+	o := file.Source()
+	exists := o.TemporaryHold
+	if name == customTimeXattr {
+		exists = !o.CustomTime.IsZero()
+	}
+
+	switch {
+	case value == nil && !exists:
+		err = fuse.ENOATTR
+		return
+
+	case flags&xattrCreate != 0 && exists:
+		err = syscall.EEXIST
+		return
+
+	case flags&xattrReplace != 0 && !exists:
+		err = fuse.ENOATTR
+		return
+	}
+
+	switch name {
+	case customTimeXattr:
+		var t time.Time
+		t, err = time.Parse(time.RFC3339Nano, *value)
+		if err != nil || t.Before(o.CustomTime) {
+			err = syscall.EINVAL
+			return
+		}
+
+		err = file.SetCustomTime(ctx, t)
+		if err != nil {
+			err = fmt.Errorf("SetCustomTime: %w", err)
+			return
+		}
+
+	case temporaryHoldXattr:
+		held := false
+		if value != nil {
+			held, err = strconv.ParseBool(*value)
+			if err != nil {
+				err = syscall.EINVAL
+				return
+			}
+		}
+
+		err = file.SetTemporaryHold(ctx, held)
+		if err != nil {
+			err = fmt.Errorf("SetTemporaryHold: %w", err)
+			return
+		}
+	}
+
+	return
+}
+
+// Return the file inode with the supplied ID, if it may be modified. Returns
+// ENOTSUP if the inode isn't a file.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) modifiableFile(
+	id fuseops.InodeID) (file *inode.FileInode, err error) {
+	fs.mu.Lock()
+	in := fs.inodeOrDie(id)
+	file, isFile := in.(*inode.FileInode)
+	if isFile {
+		err = fs.checkModifiable(id)
+	}
+
+	fs.mu.Unlock()
+
+	if !isFile {
+		err = syscall.ENOTSUP
+		return
+	}
+
+	return
+}
@@ -0,0 +1,273 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Tests for exposing object properties and metadata through extended
+// attributes. These use the xattr syscalls, which are available only on Linux.
+
+package fs_test
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type MetadataXattrsTest struct {
+	fsTest
+
+	// The object backing foo.
+	object *gcs.Object
+}
+
+func init() { RegisterTestSuite(&MetadataXattrsTest{}) }
+
+func (t *MetadataXattrsTest) SetUp(ti *TestInfo) {
+	t.fsTest.SetUp(ti)
+
+	var err error
+	t.object, err = t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:        "foo",
+			ContentType: "text/plain",
+			Contents:    strings.NewReader("taco"),
+			Metadata: map[string]string{
+				"color": "red",
+			},
+		})
+
+	AssertEq(nil, err)
+}
+
+// Return the value of the named extended attribute of foo.
+func (t *MetadataXattrsTest) getXattr(name string) (v string, err error) {
+	buf := make([]byte, 256)
+	n, err := syscall.Getxattr(path.Join(t.mfs.Dir(), "foo"), name, buf)
+	if err != nil {
+		return
+	}
+
+	v = string(buf[:n])
+	return
+}
+
+// Return the custom metadata of the object foo.
+func (t *MetadataXattrsTest) objectMetadata() map[string]string {
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	return o.Metadata
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *MetadataXattrsTest) GetKey() {
+	v, err := t.getXattr("user.gcs.metadata.color")
+	AssertEq(nil, err)
+	ExpectEq("red", v)
+
+	_, err = t.getXattr("user.gcs.metadata.size")
+	ExpectEq(syscall.ENODATA, err)
+}
+
+func (t *MetadataXattrsTest) GetAggregate() {
+	v, err := t.getXattr("user.gcs.metadata")
+	AssertEq(nil, err)
+	ExpectEq(`{"color":"red"}`, v)
+}
+
+func (t *MetadataXattrsTest) List() {
+	buf := make([]byte, 1024)
+	n, err := syscall.Listxattr(path.Join(t.mfs.Dir(), "foo"), buf)
+	AssertEq(nil, err)
+
+	names := strings.Split(strings.TrimSuffix(string(buf[:n]), "\x00"), "\x00")
+	ExpectThat(names, Contains("user.gcs.metadata"))
+	ExpectThat(names, Contains("user.gcs.metadata.color"))
+	ExpectThat(names, Contains("user.gcs.object.generation"))
+}
+
+func (t *MetadataXattrsTest) ObjectProperties() {
+	v, err := t.getXattr("user.gcs.object.content_type")
+	AssertEq(nil, err)
+	ExpectEq("text/plain", v)
+
+	v, err = t.getXattr("user.gcs.object.generation")
+	AssertEq(nil, err)
+	ExpectEq(fmt.Sprint(t.object.Generation), v)
+
+	v, err = t.getXattr("user.gcs.object.crc32c")
+	AssertEq(nil, err)
+	ExpectEq(fmt.Sprintf("%08x", t.object.CRC32C), v)
+}
+
+func (t *MetadataXattrsTest) ObjectPropertiesReadOnly() {
+	p := path.Join(t.mfs.Dir(), "foo")
+
+	err := syscall.Setxattr(p, "user.gcs.object.content_type", []byte("x"), 0)
+	ExpectEq(syscall.EPERM, err)
+
+	err = syscall.Removexattr(p, "user.gcs.object.content_type")
+	ExpectEq(syscall.EPERM, err)
+}
+
+func (t *MetadataXattrsTest) SetKey() {
+	p := path.Join(t.mfs.Dir(), "foo")
+	err := syscall.Setxattr(p, "user.gcs.metadata.size", []byte("large"), 0)
+	AssertEq(nil, err)
+
+	v, err := t.getXattr("user.gcs.metadata.size")
+	AssertEq(nil, err)
+	ExpectEq("large", v)
+
+	m := t.objectMetadata()
+	ExpectEq("large", m["size"])
+	ExpectEq("red", m["color"])
+}
+
+func (t *MetadataXattrsTest) SetKeyWithFlags() {
+	p := path.Join(t.mfs.Dir(), "foo")
+
+	// XATTR_CREATE
+	err := syscall.Setxattr(p, "user.gcs.metadata.color", []byte("blue"), 0x1)
+	ExpectEq(syscall.EEXIST, err)
+
+	// XATTR_REPLACE
+	err = syscall.Setxattr(p, "user.gcs.metadata.size", []byte("large"), 0x2)
+	ExpectEq(syscall.ENODATA, err)
+
+	ExpectEq("red", t.objectMetadata()["color"])
+}
+
+func (t *MetadataXattrsTest) RemoveKey() {
+	p := path.Join(t.mfs.Dir(), "foo")
+	err := syscall.Removexattr(p, "user.gcs.metadata.color")
+	AssertEq(nil, err)
+
+	_, err = t.getXattr("user.gcs.metadata.color")
+	ExpectEq(syscall.ENODATA, err)
+
+	_, ok := t.objectMetadata()["color"]
+	ExpectFalse(ok)
+
+	err = syscall.Removexattr(p, "user.gcs.metadata.color")
+	ExpectEq(syscall.ENODATA, err)
+}
+
+func (t *MetadataXattrsTest) ReservedKeysAndAggregateReadOnly() {
+	p := path.Join(t.mfs.Dir(), "foo")
+
+	err := syscall.Setxattr(p, "user.gcs.metadata", []byte("{}"), 0)
+	ExpectEq(syscall.EPERM, err)
+
+	err = syscall.Setxattr(p, "user.gcs.metadata.gcsfuse_mtime", []byte("x"), 0)
+	ExpectEq(syscall.EPERM, err)
+}
+
+func (t *MetadataXattrsTest) Directory() {
+	err := syscall.Mkdir(path.Join(t.mfs.Dir(), "dir"), 0700)
+	AssertEq(nil, err)
+
+	buf := make([]byte, 256)
+	_, err = syscall.Getxattr(
+		path.Join(t.mfs.Dir(), "dir"),
+		"user.gcs.metadata",
+		buf)
+
+	ExpectEq(syscall.ENODATA, err)
+}
+
+func (t *MetadataXattrsTest) CustomTime() {
+	p := path.Join(t.mfs.Dir(), "foo")
+
+	// Initially there is none, and it can't be removed.
+	_, err := t.getXattr("user.gcs.custom_time")
+	ExpectEq(syscall.ENODATA, err)
+
+	err = syscall.Setxattr(
+		p, "user.gcs.custom_time", []byte("2017-06-01T12:00:00Z"), 0)
+	AssertEq(nil, err)
+
+	v, err := t.getXattr("user.gcs.custom_time")
+	AssertEq(nil, err)
+	ExpectEq("2017-06-01T12:00:00Z", v)
+
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	ExpectTrue(
+		o.CustomTime.Equal(time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)),
+		"%v", o.CustomTime)
+
+	// It can't be moved earlier or removed, and must be a valid time.
+	err = syscall.Setxattr(
+		p, "user.gcs.custom_time", []byte("2017-05-01T12:00:00Z"), 0)
+	ExpectEq(syscall.EINVAL, err)
+
+	err = syscall.Setxattr(p, "user.gcs.custom_time", []byte("tomorrow"), 0)
+	ExpectEq(syscall.EINVAL, err)
+
+	err = syscall.Removexattr(p, "user.gcs.custom_time")
+	ExpectEq(syscall.EPERM, err)
+
+	v, err = t.getXattr("user.gcs.custom_time")
+	AssertEq(nil, err)
+	ExpectEq("2017-06-01T12:00:00Z", v)
+}
+
+func (t *MetadataXattrsTest) TemporaryHold() {
+	p := path.Join(t.mfs.Dir(), "foo")
+
+	_, err := t.getXattr("user.gcs.temporary_hold")
+	ExpectEq(syscall.ENODATA, err)
+
+	err = syscall.Setxattr(p, "user.gcs.temporary_hold", []byte("true"), 0)
+	AssertEq(nil, err)
+
+	v, err := t.getXattr("user.gcs.temporary_hold")
+	AssertEq(nil, err)
+	ExpectEq("true", v)
+
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	ExpectTrue(o.TemporaryHold)
+
+	err = syscall.Setxattr(p, "user.gcs.temporary_hold", []byte("maybe"), 0)
+	ExpectEq(syscall.EINVAL, err)
+
+	// Removing the attribute releases the hold.
+	err = syscall.Removexattr(p, "user.gcs.temporary_hold")
+	AssertEq(nil, err)
+
+	_, err = t.getXattr("user.gcs.temporary_hold")
+	ExpectEq(syscall.ENODATA, err)
+
+	o, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	ExpectFalse(o.TemporaryHold)
+
+	err = syscall.Removexattr(p, "user.gcs.temporary_hold")
+	ExpectEq(syscall.ENODATA, err)
+}
@@ -0,0 +1,141 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Tests for shared writable memory mappings. These use msync(2) through
+// syscall.Syscall, with constants available only on Linux.
+
+package fs_test
+
+import (
+	"os"
+	"path"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type MmapTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&MmapTest{}) }
+
+func (t *MmapTest) SetUp(ti *TestInfo) {
+	t.fsTest.SetUp(ti)
+
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+}
+
+// Map the contents of the supplied file, shared and writable.
+func (t *MmapTest) mmap(f *os.File) (data []byte) {
+	fi, err := f.Stat()
+	AssertEq(nil, err)
+
+	data, err = syscall.Mmap(
+		int(f.Fd()),
+		0,
+		int(fi.Size()),
+		syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_SHARED)
+
+	AssertEq(nil, err)
+	return
+}
+
+func msync(data []byte) (err error) {
+	_, _, errno := syscall.Syscall(
+		syscall.SYS_MSYNC,
+		uintptr(unsafe.Pointer(&data[0])),
+		uintptr(len(data)),
+		syscall.MS_SYNC)
+
+	if errno != 0 {
+		err = errno
+	}
+
+	return
+}
+
+// Wait up to a few seconds for the named object to have the given contents,
+// returning the last contents seen.
+func (t *MmapTest) waitForContents(name string, expected string) string {
+	var contents []byte
+	deadline := time.Now().Add(5 * time.Second)
+
+	for time.Now().Before(deadline) {
+		var err error
+		contents, err = gcsutil.ReadObject(t.ctx, t.bucket, name)
+		AssertEq(nil, err)
+
+		if string(contents) == expected {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return string(contents)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *MmapTest) MsyncSyncsObject() {
+	f, err := os.OpenFile(path.Join(t.Dir, "foo"), os.O_RDWR, 0)
+	AssertEq(nil, err)
+	defer f.Close()
+
+	data := t.mmap(f)
+	defer syscall.Munmap(data)
+
+	copy(data, "burr")
+
+	// msync should make the change durable without closing the file.
+	err = msync(data)
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("burr", string(contents))
+}
+
+func (t *MmapTest) WritesAfterClose() {
+	f, err := os.OpenFile(path.Join(t.Dir, "foo"), os.O_RDWR, 0)
+	AssertEq(nil, err)
+
+	data := t.mmap(f)
+
+	// Close the file descriptor before modifying the mapping, as some programs
+	// do, and don't bother with msync.
+	err = f.Close()
+	AssertEq(nil, err)
+
+	copy(data, "burr")
+
+	err = syscall.Munmap(data)
+	AssertEq(nil, err)
+
+	// The kernel releases the file asynchronously once the mapping is gone, at
+	// which point the contents should be synced.
+	ExpectEq("burr", t.waitForContents("foo", "burr"))
+}
@@ -0,0 +1,70 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"strings"
+	"syscall"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+)
+
+// The longest object name, in bytes of UTF-8, that GCS accepts.
+const MaxObjectNameLength = 1024
+
+// GCS measures object names in bytes of UTF-8, so a name that fits in 1024
+// characters may still be refused; the check below measures names the same
+// way. Refusing names that are too long when files and directories are
+// created or renamed gives callers ENAMETOOLONG straight away, rather than an
+// EIO from the first sync after data has been written.
+
+// Return ENAMETOOLONG if the object backing the child of the supplied
+// directory with the given name, which is a directory if isDir, would have a
+// name longer than the file system allows.
+func (fs *fileSystem) checkNameLength(
+	parent inode.DirInode,
+	name string,
+	isDir bool) (err error) {
+	n := len(parent.Name()) + len(name)
+	if isDir {
+		n++
+	}
+
+	if n > fs.maxNameLength {
+		err = syscall.ENAMETOOLONG
+		return
+	}
+
+	return
+}
+
+// Return ENAMETOOLONG if moving the supplied objects from beneath srcPrefix
+// to beneath dstPrefix would give any of them a name longer than the file
+// system allows.
+func (fs *fileSystem) checkRenamedNameLengths(
+	objects []*gcs.Object,
+	srcPrefix string,
+	dstPrefix string) (err error) {
+	for _, o := range objects {
+		if len(dstPrefix)+len(strings.TrimPrefix(o.Name, srcPrefix)) >
+			fs.maxNameLength {
+			err = syscall.ENAMETOOLONG
+			return
+		}
+	}
+
+	return
+}
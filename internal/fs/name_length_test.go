@@ -0,0 +1,124 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const nameLengthLimit = 16
+
+type NameLengthTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&NameLengthTest{}) }
+
+func (t *NameLengthTest) SetUp(ti *TestInfo) {
+	t.serverCfg.MaxNameLength = nameLengthLimit
+	t.serverCfg.RenameDirLimit = 10
+	t.fsTest.SetUp(ti)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *NameLengthTest) StatFS() {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(t.Dir, &stat)
+
+	AssertEq(nil, err)
+	ExpectEq(nameLengthLimit, stat.Namelen)
+}
+
+func (t *NameLengthTest) CreateFileAtLimit() {
+	err := ioutil.WriteFile(path.Join(t.Dir, "0123456789abcdef"), nil, 0600)
+	ExpectEq(nil, err)
+}
+
+func (t *NameLengthTest) CreateFileOverLimit() {
+	err := ioutil.WriteFile(path.Join(t.Dir, "0123456789abcdefg"), nil, 0600)
+	ExpectThat(err, Error(HasSubstr("file name too long")))
+}
+
+func (t *NameLengthTest) MultiByteCharacters() {
+	// Eight characters, but sixteen bytes.
+	err := ioutil.WriteFile(path.Join(t.Dir, "éééééééé"), nil, 0600)
+	AssertEq(nil, err)
+
+	// Nine characters are over the limit.
+	err = ioutil.WriteFile(path.Join(t.Dir, "ééééééééé"), nil, 0600)
+	ExpectThat(err, Error(HasSubstr("file name too long")))
+}
+
+func (t *NameLengthTest) MkDirCountsSlash() {
+	err := os.Mkdir(path.Join(t.Dir, "0123456789abcde"), 0700)
+	AssertEq(nil, err)
+
+	err = os.Mkdir(path.Join(t.Dir, "0123456789abcdef"), 0700)
+	ExpectThat(err, Error(HasSubstr("file name too long")))
+}
+
+func (t *NameLengthTest) CreateFileInDirCountsParent() {
+	err := os.Mkdir(path.Join(t.Dir, "dir"), 0700)
+	AssertEq(nil, err)
+
+	err = ioutil.WriteFile(path.Join(t.Dir, "dir", "0123456789ab"), nil, 0600)
+	AssertEq(nil, err)
+
+	err = ioutil.WriteFile(path.Join(t.Dir, "dir", "0123456789abc"), nil, 0600)
+	ExpectThat(err, Error(HasSubstr("file name too long")))
+}
+
+func (t *NameLengthTest) RenameFile() {
+	err := ioutil.WriteFile(path.Join(t.Dir, "foo"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = os.Rename(path.Join(t.Dir, "foo"), path.Join(t.Dir, "0123456789abcdefg"))
+	ExpectThat(err, Error(HasSubstr("file name too long")))
+
+	// The source should be untouched.
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *NameLengthTest) RenameDirCountsDescendants() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "a/", []byte{})
+	AssertEq(nil, err)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "a/0123456789ab", []byte{})
+	AssertEq(nil, err)
+
+	// The directory's own name would fit, but its child's wouldn't.
+	err = os.Rename(path.Join(t.Dir, "a"), path.Join(t.Dir, "abcd"))
+	ExpectThat(err, Error(HasSubstr("file name too long")))
+
+	_, err = gcsutil.ReadObject(t.ctx, t.bucket, "abcd/")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
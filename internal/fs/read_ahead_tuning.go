@@ -0,0 +1,47 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"log"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"golang.org/x/net/context"
+)
+
+// ReadAheadTuner finds the read-ahead configuration that works best for the
+// bucket, e.g. by timing reads with gcsx.TuneReadAhead.
+type ReadAheadTuner func(ctx context.Context) (ra gcsx.ReadAhead, err error)
+
+// Run the supplied tuner and, if it succeeds, use its result for file handles
+// opened from now on. Handles already open keep the configuration they have.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) tuneReadAhead(ctx context.Context, tune ReadAheadTuner) {
+	ra, err := tune(ctx)
+	if err != nil {
+		log.Printf("Tuning read-ahead: %v", err)
+		return
+	}
+
+	log.Printf(
+		"Reading ahead %d chunks of %d bytes after tuning",
+		ra.Depth,
+		ra.ChunkSize)
+
+	fs.mu.Lock()
+	fs.readAhead = ra
+	fs.mu.Unlock()
+}
@@ -0,0 +1,139 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"syscall"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseops"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseutil"
+	"golang.org/x/net/context"
+)
+
+// A file system that refuses with EROFS every op that would modify the
+// wrapped file system, before it touches any inode. In particular files are
+// never given local contents to write to, and nothing is sent to the bucket.
+//
+// The kernel refuses the same ops itself for file systems mounted read-only,
+// but this doesn't rely on it, e.g. for embedders that mount without the "ro"
+// option or servers that are handed ops by other means.
+type readOnlyFileSystem struct {
+	fuseutil.FileSystem
+}
+
+func (fs *readOnlyFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) (err error) {
+	err = syscall.EROFS
+	return
+}
+
+func (fs *readOnlyFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) (err error) {
+	err = syscall.EROFS
+	return
+}
+
+func (fs *readOnlyFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) (err error) {
+	err = syscall.EROFS
+	return
+}
+
+func (fs *readOnlyFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) (err error) {
+	err = syscall.EROFS
+	return
+}
+
+func (fs *readOnlyFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) (err error) {
+	err = syscall.EROFS
+	return
+}
+
+func (fs *readOnlyFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) (err error) {
+	err = syscall.EROFS
+	return
+}
+
+func (fs *readOnlyFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) (err error) {
+	err = syscall.EROFS
+	return
+}
+
+func (fs *readOnlyFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) (err error) {
+	err = syscall.EROFS
+	return
+}
+
+func (fs *readOnlyFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) (err error) {
+	// Special case: opening for reading is fine.
+	if op.Flags&syscall.O_ACCMODE != syscall.O_RDONLY ||
+		op.Flags&syscall.O_TRUNC != 0 {
+		err = syscall.EROFS
+		return
+	}
+
+	err = fs.FileSystem.OpenFile(ctx, op)
+	return
+}
+
+func (fs *readOnlyFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) (err error) {
+	err = syscall.EROFS
+	return
+}
+
+func (fs *readOnlyFileSystem) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) (err error) {
+	err = syscall.EROFS
+	return
+}
+
+func (fs *readOnlyFileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) (err error) {
+	// Special case: only attributes backed by object metadata modify anything
+	// in the bucket. The others control the file system itself.
+	if isObjectXattr(op.Name) {
+		err = syscall.EROFS
+		return
+	}
+
+	err = fs.FileSystem.SetXattr(ctx, op)
+	return
+}
+
+func (fs *readOnlyFileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) (err error) {
+	err = syscall.EROFS
+	return
+}
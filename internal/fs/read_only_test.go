@@ -19,7 +19,8 @@ import (
 	"os"
 	"path"
 
-	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
 	. "github.com/jacobsa/oglematchers"
 	. "github.com/jacobsa/ogletest"
 )
@@ -75,3 +76,69 @@ func (t *ReadOnlyTest) DeleteFile() {
 	AssertEq(nil, err)
 	ExpectEq("taco", string(contents))
 }
+
+////////////////////////////////////////////////////////////////////////
+// Enforced by the server
+////////////////////////////////////////////////////////////////////////
+
+// The kernel isn't told that the file system is read-only, so it's up to the
+// server to refuse modifications.
+type ServerReadOnlyTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&ServerReadOnlyTest{}) }
+
+func (t *ServerReadOnlyTest) SetUp(ti *TestInfo) {
+	t.serverCfg.ReadOnly = true
+	t.fsTest.SetUp(ti)
+
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+}
+
+func (t *ServerReadOnlyTest) ReadFile() {
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "foo"))
+
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *ServerReadOnlyTest) CreateFile() {
+	err := ioutil.WriteFile(path.Join(t.Dir, "bar"), []byte("burrito"), 0600)
+	ExpectThat(err, Error(HasSubstr("read-only")))
+
+	_, err = gcsutil.ReadObject(t.ctx, t.bucket, "bar")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *ServerReadOnlyTest) OpenForWriting() {
+	f, err := os.OpenFile(path.Join(t.Dir, "foo"), os.O_WRONLY, 0)
+	f.Close()
+
+	ExpectThat(err, Error(HasSubstr("read-only")))
+}
+
+func (t *ServerReadOnlyTest) Truncate() {
+	err := os.Truncate(path.Join(t.Dir, "foo"), 0)
+	ExpectThat(err, Error(HasSubstr("read-only")))
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *ServerReadOnlyTest) MkdirRenameAndRemove() {
+	err := os.Mkdir(path.Join(t.Dir, "dir"), 0700)
+	ExpectThat(err, Error(HasSubstr("read-only")))
+
+	err = os.Rename(path.Join(t.Dir, "foo"), path.Join(t.Dir, "bar"))
+	ExpectThat(err, Error(HasSubstr("read-only")))
+
+	err = os.Remove(path.Join(t.Dir, "foo"))
+	ExpectThat(err, Error(HasSubstr("read-only")))
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
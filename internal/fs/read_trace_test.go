@@ -0,0 +1,74 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/readtrace"
+	. "github.com/jacobsa/ogletest"
+)
+
+type ReadTraceTest struct {
+	fsTest
+	trace syncBuffer
+}
+
+func init() { RegisterTestSuite(&ReadTraceTest{}) }
+
+func (t *ReadTraceTest) SetUp(ti *TestInfo) {
+	t.serverCfg.ReadTrace = &t.trace
+	t.fsTest.SetUp(ti)
+}
+
+// Parse the reads recorded so far.
+func (t *ReadTraceTest) reads() (reads []readtrace.Read) {
+	tr := readtrace.NewReader(bytes.NewReader(t.trace.Bytes()))
+	for {
+		r, err := tr.Next()
+		if err == io.EOF {
+			return
+		}
+
+		AssertEq(nil, err)
+		reads = append(reads, r)
+	}
+}
+
+func (t *ReadTraceTest) ReadFile() {
+	AssertEq(nil, t.createObjects(map[string]string{"foo": "taco"}))
+
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	AssertEq("taco", string(contents))
+
+	reads := t.reads()
+	AssertGt(len(reads), 0)
+
+	ExpectEq("foo", reads[0].Name)
+	ExpectEq(len("taco"), reads[0].Size)
+	ExpectEq(0, reads[0].Offset)
+	ExpectGe(reads[0].Length, len("taco"))
+}
+
+func (t *ReadTraceTest) WritesNotRecorded() {
+	err := ioutil.WriteFile(path.Join(t.Dir, "foo"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	ExpectEq(0, len(t.reads()))
+}
@@ -0,0 +1,124 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Tests for what happens when the last handle for a file is released.
+
+package fs_test
+
+import (
+	"errors"
+	"os"
+	"path"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// A bucket that fails to create objects while failCreates is non-zero,
+// counting the attempts.
+type failingCreateBucket struct {
+	gcs.Bucket
+	failCreates int32
+	creates     int32
+}
+
+func (b *failingCreateBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	atomic.AddInt32(&b.creates, 1)
+	if atomic.LoadInt32(&b.failCreates) != 0 {
+		err = errors.New("taco")
+		return
+	}
+
+	o, err = b.Bucket.CreateObject(ctx, req)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ReleaseTest struct {
+	fsTest
+	failingBucket *failingCreateBucket
+}
+
+func init() { RegisterTestSuite(&ReleaseTest{}) }
+
+func (t *ReleaseTest) SetUp(ti *TestInfo) {
+	t.failingBucket = &failingCreateBucket{
+		Bucket: gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket"),
+	}
+
+	t.bucket = t.failingBucket
+
+	// A hard dirty limit, so that writes can be refused.
+	t.serverCfg.DirtyLimit = 8
+	t.serverCfg.DirtyLimitHard = true
+
+	t.fsTest.SetUp(ti)
+
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ReleaseTest) SyncsNothingAfterRefusedWriteAndFailedFlush() {
+	f, err := os.OpenFile(path.Join(t.Dir, "foo"), os.O_RDWR, 0)
+	AssertEq(nil, err)
+
+	_, err = f.Write([]byte("enchilada"))
+	AssertEq(nil, err)
+
+	// The second write goes over the limit, leaving the file with only part of
+	// what was written.
+	_, err = f.Write([]byte("burrito"))
+
+	pathErr, ok := err.(*os.PathError)
+	AssertTrue(ok, "err: %v", err)
+	ExpectEq(syscall.EDQUOT, pathErr.Err)
+
+	// Closing the file fails to flush it.
+	atomic.StoreInt32(&t.failingBucket.failCreates, 1)
+	creates := atomic.LoadInt32(&t.failingBucket.creates)
+
+	err = f.Close()
+	ExpectNe(nil, err)
+
+	// Give the release that follows the close time to arrive. It shouldn't try
+	// again to write out the partial contents.
+	atomic.StoreInt32(&t.failingBucket.failCreates, 0)
+	time.Sleep(250 * time.Millisecond)
+
+	ExpectEq(creates+1, atomic.LoadInt32(&t.failingBucket.creates))
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
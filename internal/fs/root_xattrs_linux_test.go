@@ -0,0 +1,112 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Tests for extended attributes on the root directory. These use
+// syscall.Getxattr and syscall.Listxattr, which are available only on Linux.
+
+package fs_test
+
+import (
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type RootXattrsTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&RootXattrsTest{}) }
+
+func (t *RootXattrsTest) SetUp(ti *TestInfo) {
+	t.serverCfg.RootXattrs = map[string]string{
+		"user.gcs.bucket.location":      "US-EAST1",
+		"user.gcs.bucket.storage_class": "NEARLINE",
+	}
+
+	t.fsTest.SetUp(ti)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *RootXattrsTest) Get() {
+	buf := make([]byte, 256)
+	n, err := syscall.Getxattr(t.mfs.Dir(), "user.gcs.bucket.location", buf)
+
+	AssertEq(nil, err)
+	ExpectEq("US-EAST1", string(buf[:n]))
+}
+
+func (t *RootXattrsTest) GetSize() {
+	n, err := syscall.Getxattr(t.mfs.Dir(), "user.gcs.bucket.location", nil)
+
+	AssertEq(nil, err)
+	ExpectEq(len("US-EAST1"), n)
+}
+
+func (t *RootXattrsTest) GetUnknown() {
+	buf := make([]byte, 256)
+	_, err := syscall.Getxattr(t.mfs.Dir(), "user.gcs.bucket.taco", buf)
+
+	ExpectEq(syscall.ENODATA, err)
+}
+
+func (t *RootXattrsTest) List() {
+	buf := make([]byte, 256)
+	n, err := syscall.Listxattr(t.mfs.Dir(), buf)
+	AssertEq(nil, err)
+
+	names := strings.Split(strings.TrimSuffix(string(buf[:n]), "\x00"), "\x00")
+	ExpectThat(
+		names,
+		ElementsAre(
+			"user.gcs.bucket.location",
+			"user.gcs.bucket.storage_class",
+			"user.gcsfuse.inodes",
+			"user.gcsfuse.status"))
+}
+
+func (t *RootXattrsTest) Inodes() {
+	AssertEq(nil, os.Mkdir(path.Join(t.mfs.Dir(), "dir"), 0700))
+
+	buf := make([]byte, 256)
+	n, err := syscall.Getxattr(t.mfs.Dir(), "user.gcsfuse.inodes", buf)
+
+	AssertEq(nil, err)
+	ExpectThat(string(buf[:n]), HasSubstr("total=2 files=0 dirs=2 symlinks=0"))
+	ExpectThat(string(buf[:n]), HasSubstr("limit=0"))
+}
+
+func (t *RootXattrsTest) NotOnOtherDirectories() {
+	p := path.Join(t.mfs.Dir(), "dir")
+	AssertEq(nil, os.Mkdir(p, 0700))
+
+	buf := make([]byte, 256)
+	_, err := syscall.Getxattr(p, "user.gcs.bucket.location", buf)
+	ExpectEq(syscall.ENODATA, err)
+
+	n, err := syscall.Listxattr(p, buf)
+	AssertEq(nil, err)
+	ExpectEq(0, n)
+}
@@ -0,0 +1,159 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"sync/atomic"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// A bucket that lists two objects per page, and that fails requests for the
+// first page while failFirst is non-zero and for later pages while failLater
+// is non-zero.
+type pagingBucket struct {
+	gcs.Bucket
+	failFirst int32
+	failLater int32
+}
+
+func (b *pagingBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	fail := &b.failFirst
+	if req.ContinuationToken != "" {
+		fail = &b.failLater
+	}
+
+	if atomic.LoadInt32(fail) != 0 {
+		err = errors.New("taco")
+		return
+	}
+
+	reqCopy := *req
+	reqCopy.MaxResults = 2
+
+	listing, err = b.Bucket.ListObjects(ctx, &reqCopy)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type StaleListingTest struct {
+	fsTest
+	pagingBucket *pagingBucket
+}
+
+func init() { RegisterTestSuite(&StaleListingTest{}) }
+
+func (t *StaleListingTest) SetUp(ti *TestInfo) {
+	t.pagingBucket = &pagingBucket{
+		Bucket: gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket"),
+	}
+
+	t.bucket = t.pagingBucket
+	t.serverCfg.StaleListingFallback = true
+	t.fsTest.SetUp(ti)
+
+	// Create some objects.
+	for _, name := range []string{"a", "b", "c", "d"} {
+		_, err := gcsutil.CreateObject(t.ctx, t.bucket, name, []byte(""))
+		AssertEq(nil, err)
+	}
+}
+
+// Return the names within the root directory. They aren't statted, since
+// names from a stale listing may no longer exist.
+func (t *StaleListingTest) readRoot() (names []string, err error) {
+	f, err := os.Open(t.Dir)
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	names, err = f.Readdirnames(-1)
+	sort.Strings(names)
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *StaleListingTest) NoPreviousListing() {
+	atomic.StoreInt32(&t.pagingBucket.failLater, 1)
+
+	_, err := t.readRoot()
+	ExpectNe(nil, err)
+}
+
+func (t *StaleListingTest) FailureOnFirstPage() {
+	// Read the directory once, so that there's a listing to fall back on.
+	names, err := t.readRoot()
+	AssertEq(nil, err)
+	AssertThat(names, ElementsAre("a", "b", "c", "d"))
+
+	// Errors for the first page are still reported.
+	atomic.StoreInt32(&t.pagingBucket.failFirst, 1)
+
+	_, err = t.readRoot()
+	ExpectNe(nil, err)
+}
+
+func (t *StaleListingTest) FailureOnLaterPage() {
+	// Read the directory once, so that there's a listing to fall back on.
+	names, err := t.readRoot()
+	AssertEq(nil, err)
+	AssertThat(names, ElementsAre("a", "b", "c", "d"))
+
+	// Change the bucket, then make requests for later pages fail.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "aa", []byte(""))
+	AssertEq(nil, err)
+
+	err = t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "d"})
+	AssertEq(nil, err)
+
+	atomic.StoreInt32(&t.pagingBucket.failLater, 1)
+
+	// The first page should come from the new listing, and the rest from the
+	// old one.
+	names, err = t.readRoot()
+	AssertEq(nil, err)
+	ExpectThat(names, ElementsAre("a", "aa", "b", "c", "d"))
+
+	// Once listing works again, the results are up to date.
+	atomic.StoreInt32(&t.pagingBucket.failLater, 0)
+
+	names, err = t.readRoot()
+	AssertEq(nil, err)
+	ExpectThat(names, ElementsAre("a", "aa", "b", "c"))
+}
@@ -0,0 +1,153 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+)
+
+// The extended attribute on the root directory through which the file system
+// reports its state as JSON, for tools that decide when a mount may be
+// drained or torn down. The value has the form of Status.
+const StatusXattr = "user.gcsfuse.status"
+
+// Status is the state of a mounted file system.
+type Status struct {
+	// The identifier given by ServerConfig.ConfigHash.
+	ConfigHash string `json:"config_hash"`
+
+	// The prefix of the operation IDs sent to GCS with requests made for
+	// operations on file handles, which are of the form "<prefix>-<handle>".
+	// See gcsx.OperationIDHeader.
+	OperationIDPrefix string `json:"operation_id_prefix"`
+
+	// The number of inodes the file system knows about.
+	Inodes int `json:"inodes"`
+
+	// The number of files with local modifications that have yet to be
+	// written to GCS, and the number of bytes that writing them will upload.
+	PendingUploads int   `json:"pending_uploads"`
+	DirtyBytes     int64 `json:"dirty_bytes"`
+
+	// The number of deletes that have yet to be carried out. See
+	// ServerConfig.DeferredDeleteWorkers.
+	PendingDeletes int `json:"pending_deletes"`
+
+	// The number of files being synced to GCS right now, and the number whose
+	// contents are being uploaded as they are written.
+	SyncsInProgress  int `json:"syncs_in_progress"`
+	StreamingUploads int `json:"streaming_uploads"`
+
+	// The number of batch renames that are still being carried out. See
+	// ServerConfig.BatchRenameManifest.
+	BatchRenames int `json:"batch_renames"`
+
+	// The number of files whose contents are held in temporary files, and
+	// their total size.
+	CacheFiles int   `json:"cache_files"`
+	CacheBytes int64 `json:"cache_bytes"`
+
+	// Counts of errors returned to applications because requests to the
+	// bucket failed, keyed by errno name (e.g. "EIO").
+	Errors map[string]uint64 `json:"errors"`
+
+	// Prefixes for which reading or writing objects was recently denied, and
+	// is being refused without asking GCS. See ServerConfig.AccessDenialTTL.
+	UnreadablePrefixes []string `json:"unreadable_prefixes,omitempty"`
+	UnwritablePrefixes []string `json:"unwritable_prefixes,omitempty"`
+
+	// Whether a drain has started (see DrainXattr), and if so whether it has
+	// finished, i.e. there is nothing left to write out.
+	Draining bool `json:"draining"`
+	Drained  bool `json:"drained"`
+}
+
+// Return the current status of the file system. The state of each file is
+// as of the last time its inode was unlocked, so that this doesn't wait for
+// uploads or downloads in progress.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) status() (s Status) {
+	s.ConfigHash = fs.configHash
+	s.OperationIDPrefix = fs.operationIDPrefix
+	s.Errors = fs.errors.snapshot()
+	if fs.deferredDeletes != nil {
+		s.PendingDeletes = fs.deferredDeletes.Pending()
+	}
+
+	if fs.accessDenials != nil {
+		read, write := fs.accessDenials.DeniedPrefixes()
+		s.UnreadablePrefixes = read
+		s.UnwritablePrefixes = write
+	}
+
+	// Find the file inodes.
+	fs.mu.Lock()
+	s.Inodes = len(fs.inodes)
+	s.SyncsInProgress = fs.syncsInProgress
+	s.BatchRenames = fs.batchRenamesInProgress
+	s.Draining = fs.draining
+
+	var files []*inode.FileInode
+	for _, in := range fs.inodes {
+		if f, ok := in.(*inode.FileInode); ok {
+			files = append(files, f)
+		}
+	}
+	fs.mu.Unlock()
+
+	// Tally their local state.
+	for _, f := range files {
+		ls := f.LocalState()
+		if ls.Dirty {
+			s.PendingUploads++
+			s.DirtyBytes += ls.DirtyBytes
+		}
+
+		if ls.Streaming {
+			s.StreamingUploads++
+		}
+
+		if ls.CachedBytes > 0 {
+			s.CacheFiles++
+			s.CacheBytes += ls.CachedBytes
+		}
+	}
+
+	s.Drained = s.Draining &&
+		s.PendingUploads == 0 &&
+		s.PendingDeletes == 0 &&
+		s.SyncsInProgress == 0 &&
+		s.BatchRenames == 0
+
+	return
+}
+
+// Return the value of StatusXattr.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) statusXattrValue() (v string, err error) {
+	b, err := json.Marshal(fs.status())
+	if err != nil {
+		err = fmt.Errorf("Marshal: %v", err)
+		return
+	}
+
+	v = string(b)
+	return
+}
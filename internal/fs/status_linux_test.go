@@ -0,0 +1,108 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Tests for the status reported through an extended attribute on the root
+// directory. These use syscall.Getxattr, which is available only on Linux.
+
+package fs_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	. "github.com/jacobsa/ogletest"
+)
+
+type StatusTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&StatusTest{}) }
+
+func (t *StatusTest) SetUp(ti *TestInfo) {
+	t.serverCfg.ConfigHash = "deadbeef"
+
+	t.disableWritebackCaching()
+
+	t.fsTest.SetUp(ti)
+}
+
+func (t *StatusTest) getStatus() (s fs.Status) {
+	buf := make([]byte, 4096)
+	n, err := syscall.Getxattr(t.mfs.Dir(), fs.StatusXattr, buf)
+	AssertEq(nil, err)
+
+	err = json.Unmarshal(buf[:n], &s)
+	AssertEq(nil, err)
+
+	return
+}
+
+func (t *StatusTest) Idle() {
+	s := t.getStatus()
+
+	ExpectEq("deadbeef", s.ConfigHash)
+	ExpectEq(1, s.Inodes)
+	ExpectEq(0, s.PendingUploads)
+	ExpectEq(0, s.DirtyBytes)
+	ExpectEq(0, s.SyncsInProgress)
+	ExpectEq(0, s.StreamingUploads)
+	ExpectEq(0, s.BatchRenames)
+	ExpectEq(0, s.CacheFiles)
+	ExpectEq(0, s.CacheBytes)
+	ExpectEq(0, len(s.Errors))
+}
+
+func (t *StatusTest) DirtyFile() {
+	var err error
+
+	// Create a file and write to it without closing it.
+	t.f1, err = os.Create(path.Join(t.mfs.Dir(), "foo"))
+	AssertEq(nil, err)
+
+	_, err = t.f1.Write([]byte("taco"))
+	AssertEq(nil, err)
+
+	s := t.getStatus()
+	ExpectEq(1, s.PendingUploads)
+	ExpectEq(4, s.DirtyBytes)
+	ExpectEq(1, s.CacheFiles)
+	ExpectEq(4, s.CacheBytes)
+
+	// Closing it writes it out, discarding the temporary file.
+	err = t.f1.Close()
+	t.f1 = nil
+	AssertEq(nil, err)
+
+	s = t.getStatus()
+	ExpectEq(0, s.PendingUploads)
+	ExpectEq(0, s.DirtyBytes)
+	ExpectEq(0, s.CacheFiles)
+	ExpectEq(0, s.CacheBytes)
+}
+
+func (t *StatusTest) CleanFileRead() {
+	AssertEq(nil, t.createWithContents("foo", "burrito"))
+
+	_, err := ioutil.ReadFile(path.Join(t.mfs.Dir(), "foo"))
+	AssertEq(nil, err)
+
+	s := t.getStatus()
+	ExpectEq(0, s.PendingUploads)
+	ExpectEq(0, s.DirtyBytes)
+}
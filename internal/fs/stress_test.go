@@ -26,7 +26,7 @@ import (
 
 	"golang.org/x/net/context"
 
-	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fusetesting"
 	. "github.com/jacobsa/ogletest"
 	"github.com/jacobsa/syncutil"
 )
@@ -0,0 +1,116 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"log"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+)
+
+// With a sync delay, flushing a file (e.g. closing it) doesn't sync it
+// straight away. Instead the sync happens once the file has gone the delay
+// without being flushed again, so that an editor that truncates and rewrites
+// a file several times in quick succession causes a single upload. fsync
+// still syncs immediately, and anything pending is synced when the file
+// system is unmounted.
+//
+// While a sync is pending, the file system holds a lookup count on the inode
+// so that the kernel forgetting it doesn't throw away its contents.
+
+// A sync waiting for its file to go quiet.
+type delayedSync struct {
+	in   *inode.FileInode
+	stop func() bool
+}
+
+// Arrange for the supplied inode to be synced once fs.syncDelay has passed
+// without another call to this method for it, replacing any sync already
+// pending.
+//
+// LOCKS_EXCLUDED(fs.mu)
+// LOCKS_REQUIRED(in)
+func (fs *fileSystem) syncLater(in *inode.FileInode) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// Hold a lookup count for as long as any sync is pending, taking it only
+	// for the first.
+	if old, ok := fs.delayedSyncs[in.ID()]; ok {
+		old.stop()
+	} else {
+		in.IncrementLookupCount()
+	}
+
+	ds := &delayedSync{in: in}
+	ds.stop = fs.afterFunc(fs.syncDelay, func() { fs.runDelayedSync(ds) })
+	fs.delayedSyncs[in.ID()] = ds
+}
+
+// Sync the inode of the supplied delayed sync if it is still the one pending
+// for it, then release the lookup count held on its behalf.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) runDelayedSync(ds *delayedSync) {
+	fs.mu.Lock()
+	current := fs.delayedSyncs[ds.in.ID()] == ds
+	if current {
+		delete(fs.delayedSyncs, ds.in.ID())
+	}
+
+	fs.mu.Unlock()
+
+	// A later flush or an unmount has taken over.
+	if !current {
+		return
+	}
+
+	fs.syncAndRelease(ds.in)
+}
+
+// Sync every inode with a pending delayed sync now.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) flushDelayedSyncs() {
+	fs.mu.Lock()
+	var pending []*inode.FileInode
+	for id, ds := range fs.delayedSyncs {
+		ds.stop()
+		pending = append(pending, ds.in)
+		delete(fs.delayedSyncs, id)
+	}
+
+	fs.mu.Unlock()
+
+	for _, in := range pending {
+		fs.syncAndRelease(in)
+	}
+}
+
+// Sync the supplied inode, logging any error since there's nobody to return
+// it to, then decrement the lookup count taken by syncLater.
+//
+// LOCKS_EXCLUDED(fs.mu)
+// LOCKS_EXCLUDED(in)
+func (fs *fileSystem) syncAndRelease(in *inode.FileInode) {
+	in.Lock()
+	err := fs.syncFileAndMaybeRename(fs.backgroundCtx, in)
+	if err != nil {
+		log.Printf("Delayed sync of %q: %v", in.Name(), err)
+	}
+
+	fs.mu.Lock()
+	fs.unlockAndDecrementLookupCount(in, 1)
+}
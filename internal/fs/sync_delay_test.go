@@ -0,0 +1,113 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const syncDelay = time.Second
+
+type SyncDelayTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&SyncDelayTest{}) }
+
+func (t *SyncDelayTest) SetUp(ti *TestInfo) {
+	t.serverCfg.SyncDelay = syncDelay
+	t.fsTest.SetUp(ti)
+}
+
+// Return the contents of the named object, or the empty string if it can't be
+// read.
+func (t *SyncDelayTest) objectContents(name string) string {
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, name)
+	if err != nil {
+		return ""
+	}
+
+	return string(contents)
+}
+
+// Wait for the named object to have the supplied contents, giving up well
+// after the sync delay.
+func (t *SyncDelayTest) waitForContents(name string, expected string) {
+	deadline := time.Now().Add(5 * syncDelay)
+	for time.Now().Before(deadline) {
+		if t.objectContents(name) == expected {
+			return
+		}
+
+		time.Sleep(syncDelay / 10)
+	}
+
+	AddFailure("Object %q never had contents %q", name, expected)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *SyncDelayTest) CloseSyncsLater() {
+	p := path.Join(t.Dir, "foo")
+	err := ioutil.WriteFile(p, []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	// Only the empty object created by open(2) is there at first, though the
+	// contents are visible locally.
+	ExpectEq("", t.objectContents("foo"))
+
+	contents, err := ioutil.ReadFile(p)
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	t.waitForContents("foo", "taco")
+}
+
+func (t *SyncDelayTest) RewritesCoalesced() {
+	p := path.Join(t.Dir, "foo")
+	for _, s := range []string{"taco", "burrito", "enchilada"} {
+		err := ioutil.WriteFile(p, []byte(s), 0600)
+		AssertEq(nil, err)
+	}
+
+	ExpectEq("", t.objectContents("foo"))
+	t.waitForContents("foo", "enchilada")
+}
+
+func (t *SyncDelayTest) FsyncSyncsImmediately() {
+	var err error
+	t.f1, err = os.Create(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+
+	_, err = t.f1.Write([]byte("taco"))
+	AssertEq(nil, err)
+
+	err = t.f1.Sync()
+	AssertEq(nil, err)
+
+	ExpectEq("taco", t.objectContents("foo"))
+}
@@ -0,0 +1,126 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"os"
+	"path"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type TailFollowTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&TailFollowTest{}) }
+
+func (t *TailFollowTest) SetUp(ti *TestInfo) {
+	t.serverCfg.TailFollow = true
+
+	// Make sure reads reach the file system rather than the page cache, and
+	// aren't cut off at the size the kernel knows about.
+	t.serverCfg.DirectIOPatterns = []string{"*"}
+
+	t.fsTest.SetUp(ti)
+
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *TailFollowTest) ReadAtEnd() {
+	var err error
+
+	t.f1, err = os.Open(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+
+	s, err := readFrom(t.f1, 0)
+	AssertEq(nil, err)
+	ExpectEq("taco", s)
+
+	// Upload a longer version behind the mount's back. Reading at the old end
+	// of the file should find it.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("tacoburrito"))
+	AssertEq(nil, err)
+
+	s, err = readFrom(t.f1, 4)
+	AssertEq(nil, err)
+	ExpectEq("burrito", s)
+
+	// And then there is nothing more.
+	s, err = readFrom(t.f1, 11)
+	AssertEq(nil, err)
+	ExpectEq("", s)
+}
+
+func (t *TailFollowTest) ReadSpanningOldEnd() {
+	var err error
+
+	t.f1, err = os.Open(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+
+	s, err := readFrom(t.f1, 0)
+	AssertEq(nil, err)
+	ExpectEq("taco", s)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("tacoburrito"))
+	AssertEq(nil, err)
+
+	s, err = readFrom(t.f1, 2)
+	AssertEq(nil, err)
+	ExpectEq("coburrito", s)
+}
+
+func (t *TailFollowTest) StatSeesGrowth() {
+	var err error
+
+	t.f1, err = os.Open(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("tacoburrito"))
+	AssertEq(nil, err)
+
+	fi, err := t.f1.Stat()
+	AssertEq(nil, err)
+	ExpectEq(len("tacoburrito"), fi.Size())
+}
+
+func (t *TailFollowTest) ShrunkFileNotFollowed() {
+	var err error
+
+	t.f1, err = os.Open(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+
+	s, err := readFrom(t.f1, 0)
+	AssertEq(nil, err)
+	ExpectEq("taco", s)
+
+	// A smaller generation is a replacement rather than growth, so reads that
+	// go to GCS fail as they would without following.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("ta"))
+	AssertEq(nil, err)
+
+	_, err = readFrom(t.f1, 0)
+	ExpectNe(nil, err)
+}
@@ -0,0 +1,119 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"log"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Data written to files is staged in the temporary directory until it is
+// uploaded. If the device holding the directory fills up, a write to a staged
+// file can fail part way through, and whatever else shares the device starts
+// failing too. So with a minimum amount of free space configured, a watchdog
+// checks the space available on the device periodically, and while it is
+// below the minimum, writes are refused with ENOSPC before they reach the
+// staged file. Uploads in progress are unaffected, and free the space of
+// files that are synced and closed.
+
+// How often the watchdog checks the space available.
+const tempSpaceCheckPeriod = time.Second
+
+// Return the number of bytes available to unprivileged users on the device
+// holding the supplied directory, or the system default for the empty string.
+func availableBytes(dir string) (n int64, err error) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+
+	var st syscall.Statfs_t
+	err = syscall.Statfs(dir, &st)
+	if err != nil {
+		return
+	}
+
+	n = int64(st.Bavail) * int64(st.Bsize)
+	return
+}
+
+// Check the space available in the temporary directory, recording whether it
+// is below the minimum and logging when that changes.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) refreshTempSpace() {
+	n, err := availableBytes(fs.tempDir)
+	if err != nil {
+		log.Printf("Checking free space in the temporary directory: %v", err)
+		return
+	}
+
+	low := n < fs.tempDirMinFree
+
+	fs.mu.Lock()
+	changed := low != fs.tempSpaceLow
+	fs.tempSpaceLow = low
+	fs.mu.Unlock()
+
+	switch {
+	case changed && low:
+		log.Printf(
+			"Only %d MiB free in the temporary directory, below the minimum of "+
+				"%d MiB. Refusing writes with ENOSPC until space is freed.",
+			n>>20,
+			fs.tempDirMinFree>>20)
+
+	case changed:
+		log.Printf(
+			"%d MiB free in the temporary directory again. Accepting writes.",
+			n>>20)
+	}
+}
+
+// Check the space available in the temporary directory every
+// tempSpaceCheckPeriod until the context is cancelled.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) watchTempSpace(ctx context.Context) {
+	ticker := time.NewTicker(tempSpaceCheckPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+		}
+
+		fs.refreshTempSpace()
+	}
+}
+
+// Return ENOSPC if the temporary directory was short of space when last
+// checked.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) checkTempSpace() (err error) {
+	if fs.tempSpaceLow {
+		err = syscall.ENOSPC
+		return
+	}
+
+	return
+}
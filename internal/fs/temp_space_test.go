@@ -0,0 +1,88 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Enough space
+////////////////////////////////////////////////////////////////////////
+
+type TempSpaceTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&TempSpaceTest{}) }
+
+func (t *TempSpaceTest) SetUp(ti *TestInfo) {
+	t.serverCfg.TempDirMinFree = 1
+	t.fsTest.SetUp(ti)
+}
+
+func (t *TempSpaceTest) WritesAllowed() {
+	err := ioutil.WriteFile(path.Join(t.Dir, "foo"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Too little space
+////////////////////////////////////////////////////////////////////////
+
+type TempSpaceLowTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&TempSpaceLowTest{}) }
+
+func (t *TempSpaceLowTest) SetUp(ti *TestInfo) {
+	// More than any device has.
+	t.serverCfg.TempDirMinFree = 1 << 62
+
+	t.fsTest.SetUp(ti)
+}
+
+func (t *TempSpaceLowTest) WritesRefused() {
+	f, err := os.Create(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	defer f.Close()
+
+	_, err = f.Write([]byte("taco"))
+	ExpectThat(err, Error(HasSubstr("no space")))
+
+	pathErr, ok := err.(*os.PathError)
+	AssertTrue(ok)
+	ExpectEq(syscall.ENOSPC, pathErr.Err)
+}
+
+func (t *TempSpaceLowTest) ReadsAllowed() {
+	err := t.createWithContents("foo", "taco")
+	AssertEq(nil, err)
+
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
@@ -0,0 +1,209 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/filecache"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseops"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"golang.org/x/net/context"
+)
+
+// The largest objects whose contents are fetched ahead of a traversal. Tools
+// like grep -r and find -exec spend most of their time on small files, and
+// fetching large ones that may never be read would waste more than it saves.
+const lookaheadMaxSize = 1 << 20
+
+// The number of lookups in a row that must follow the order of a directory's
+// listing before we take it to be traversed.
+const lookaheadMinRun = 2
+
+// The files of a directory as of its last listing, in the order they were
+// returned to the kernel, and how far lookups have followed that order.
+type traversal struct {
+	// The name of the directory's inode, e.g. "foo/", and the names of the
+	// files within it.
+	dir   string
+	names []string
+
+	// The index within names of each name.
+	//
+	// INVARIANT: For each k/v, names[v] == k
+	index map[string]int
+
+	// The index of the file most recently looked up, or -1 if none, and the
+	// number of lookups in a row, ending with it, that were of each file in
+	// turn.
+	last int
+	run  int
+
+	// Files with indices below this have already been fetched, or were passed
+	// by lookups before we noticed the traversal.
+	next int
+}
+
+// Remember the files that the supplied handle has just listed, so that
+// lookups of them in order can be noticed.
+//
+// LOCKS_REQUIRED(dh.Mu)
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) recordListing(dh *dirHandle) {
+	t := &traversal{
+		dir:   dh.in.Name(),
+		index: make(map[string]int),
+		last:  -1,
+	}
+
+	for _, e := range dh.entries {
+		// Special case: names given a suffix by fixConflictingNames don't name
+		// the objects themselves.
+		if e.Type != fuseutil.DT_File ||
+			strings.HasSuffix(e.Name, inode.ConflictingFileNameSuffix) {
+			continue
+		}
+
+		t.index[e.Name] = len(t.names)
+		t.names = append(t.names, e.Name)
+	}
+
+	fs.mu.Lock()
+	fs.traversals[dh.in.ID()] = t
+	fs.mu.Unlock()
+}
+
+// Note a successful lookup of the supplied name within the supplied directory.
+// If it continues a run of lookups in listing order, start fetching the files
+// that come next.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) noteLookUp(parent fuseops.InodeID, name string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	t, ok := fs.traversals[parent]
+	if !ok {
+		return
+	}
+
+	i, ok := t.index[name]
+	if !ok {
+		return
+	}
+
+	if i == t.last+1 {
+		t.run++
+	} else {
+		t.run = 1
+	}
+
+	t.last = i
+
+	// Special case: once the last file has been looked up there is nothing
+	// left to fetch.
+	if i == len(t.names)-1 {
+		delete(fs.traversals, parent)
+		return
+	}
+
+	if t.run < lookaheadMinRun {
+		return
+	}
+
+	if t.next < i+1 {
+		t.next = i + 1
+	}
+
+	end := i + 1 + fs.traversalLookahead
+	if end > len(t.names) {
+		end = len(t.names)
+	}
+
+	for ; t.next < end; t.next++ {
+		go fs.fetchAhead(t.dir + t.names[t.next])
+	}
+}
+
+// Fetch ahead of a traversal the object with the supplied name: stat it,
+// filling the stat cache, and read it into the file cache if there is one and
+// the object is small enough.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) fetchAhead(name string) {
+	ctx := fs.backgroundCtx
+
+	// Limit the number of objects being fetched at once.
+	select {
+	case fs.lookaheadSem <- struct{}{}:
+	case <-ctx.Done():
+		return
+	}
+
+	defer func() { <-fs.lookaheadSem }()
+
+	// Errors here are the lookup's to report, if it comes.
+	o, err := fs.bucket.StatObject(ctx, &gcs.StatObjectRequest{Name: name})
+	if err != nil {
+		return
+	}
+
+	if fs.fileCache == nil || o.Size == 0 || o.Size > lookaheadMaxSize {
+		return
+	}
+
+	key := filecache.Key{
+		Bucket:     fs.bucket.Name(),
+		Name:       o.Name,
+		Generation: o.Generation,
+	}
+
+	if f := fs.fileCache.Open(key); f != nil {
+		f.Close()
+		return
+	}
+
+	err = fs.fetchIntoFileCache(ctx, o)
+	if err != nil {
+		log.Printf("Fetching %q ahead of a traversal: %v", name, err)
+	}
+}
+
+// Read the supplied object in full through the file cache, adding it.
+func (fs *fileSystem) fetchIntoFileCache(
+	ctx context.Context,
+	o *gcs.Object) (err error) {
+	rr, err := gcsx.NewRandomReader(o, fs.bucket, gcsx.ReadAhead{})
+	if err != nil {
+		err = fmt.Errorf("NewRandomReader: %v", err)
+		return
+	}
+
+	rr = gcsx.NewCachingRandomReader(rr, fs.fileCache, fs.bucket.Name())
+	defer rr.Destroy()
+
+	_, err = rr.ReadAt(ctx, make([]byte, o.Size), 0)
+	if err == io.EOF {
+		err = nil
+	}
+
+	return
+}
@@ -0,0 +1,155 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/filecache"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+type TraversalLookaheadTest struct {
+	fsTest
+	cacheDir string
+}
+
+func init() { RegisterTestSuite(&TraversalLookaheadTest{}) }
+
+func (t *TraversalLookaheadTest) SetUp(ti *TestInfo) {
+	var err error
+	t.cacheDir, err = ioutil.TempDir("", "traversal_lookahead_test")
+	AssertEq(nil, err)
+
+	t.serverCfg.FileCache, err = filecache.New(
+		t.cacheDir,
+		"",
+		filecache.Limits{MaxSize: 1 << 20},
+		timeutil.RealClock())
+
+	AssertEq(nil, err)
+
+	t.serverCfg.TraversalLookahead = 2
+	t.fsTest.SetUp(ti)
+
+	AssertEq(
+		nil,
+		t.createObjects(
+			map[string]string{
+				"dir/":  "",
+				"dir/a": "taco",
+				"dir/b": "burrito",
+				"dir/c": "enchilada",
+				"dir/d": "queso",
+				"dir/e": "carnitas",
+			}))
+}
+
+func (t *TraversalLookaheadTest) TearDown() {
+	t.fsTest.TearDown()
+	os.RemoveAll(t.cacheDir)
+}
+
+// Is the current generation of the supplied object in the file cache?
+func (t *TraversalLookaheadTest) cached(name string) bool {
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: name})
+	AssertEq(nil, err)
+
+	f := t.serverCfg.FileCache.Open(filecache.Key{
+		Bucket:     t.bucket.Name(),
+		Name:       o.Name,
+		Generation: o.Generation,
+	})
+
+	if f == nil {
+		return false
+	}
+
+	f.Close()
+	return true
+}
+
+// Wait a while for the supplied object to be cached.
+func (t *TraversalLookaheadTest) waitForCached(name string) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if t.cached(name) {
+			return true
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return false
+}
+
+// List the directory and stat the supplied files within it, in order.
+func (t *TraversalLookaheadTest) traverse(names ...string) {
+	d, err := os.Open(path.Join(t.Dir, "dir"))
+	AssertEq(nil, err)
+
+	_, err = d.Readdirnames(-1)
+	d.Close()
+	AssertEq(nil, err)
+
+	t.lookUp(names...)
+}
+
+// Stat the supplied files within the directory, in order, without listing it
+// again.
+func (t *TraversalLookaheadTest) lookUp(names ...string) {
+	for _, n := range names {
+		_, err := os.Lstat(path.Join(t.Dir, "dir", n))
+		AssertEq(nil, err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *TraversalLookaheadTest) InOrderLookupsFetchNextFiles() {
+	t.traverse("a", "b")
+
+	ExpectTrue(t.waitForCached("dir/c"))
+	ExpectTrue(t.waitForCached("dir/d"))
+	ExpectFalse(t.cached("dir/e"))
+
+	// Continuing the traversal fetches further.
+	t.lookUp("c")
+	ExpectTrue(t.waitForCached("dir/e"))
+}
+
+func (t *TraversalLookaheadTest) OutOfOrderLookupsFetchNothing() {
+	t.traverse("a", "c", "b", "e")
+
+	time.Sleep(100 * time.Millisecond)
+	ExpectFalse(t.cached("dir/d"))
+}
+
+func (t *TraversalLookaheadTest) LookupsWithoutListingFetchNothing() {
+	for _, n := range []string{"a", "b"} {
+		_, err := os.Lstat(path.Join(t.Dir, "dir", n))
+		AssertEq(nil, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	ExpectFalse(t.cached("dir/c"))
+}
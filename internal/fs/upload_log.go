@@ -0,0 +1,81 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+)
+
+// A line in the upload log, describing a generation of an object written
+// through the file system.
+type uploadRecord struct {
+	Name       string    `json:"name"`
+	Generation int64     `json:"generation"`
+	Size       uint64    `json:"size"`
+	CRC32C     uint32    `json:"crc32c"`
+	Updated    time.Time `json:"updated"`
+}
+
+// An append-only log of the objects written through the file system, one JSON
+// record per line. Safe for concurrent access.
+type uploadLog struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	w io.Writer
+}
+
+func newUploadLog(w io.Writer) (l *uploadLog) {
+	l = &uploadLog{w: w}
+	return
+}
+
+// Append a record for the supplied object. Each record is written with a
+// single call to Write, so a log opened with O_APPEND never contains
+// interleaved lines. Failures are logged rather than returned, since the
+// object has already been written by the time we get here.
+//
+// LOCKS_EXCLUDED(l.mu)
+func (l *uploadLog) Record(o *gcs.Object) {
+	b, err := json.Marshal(uploadRecord{
+		Name:       o.Name,
+		Generation: o.Generation,
+		Size:       o.Size,
+		CRC32C:     o.CRC32C,
+		Updated:    o.Updated,
+	})
+
+	if err != nil {
+		log.Printf("Upload log: json.Marshal: %v", err)
+		return
+	}
+
+	b = append(b, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, err = l.w.Write(b)
+	if err != nil {
+		log.Printf("Upload log: recording %q: %v", o.Name, err)
+		return
+	}
+}
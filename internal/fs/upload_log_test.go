@@ -0,0 +1,171 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// A bytes.Buffer that is safe for concurrent access.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (n int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n, err = b.buf.Write(p)
+	return
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+// The fields of an upload log record that we check.
+type uploadRecord struct {
+	Name       string `json:"name"`
+	Generation int64  `json:"generation"`
+	Size       uint64 `json:"size"`
+	CRC32C     uint32 `json:"crc32c"`
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type UploadLogTest struct {
+	fsTest
+	log syncBuffer
+}
+
+func init() { RegisterTestSuite(&UploadLogTest{}) }
+
+func (t *UploadLogTest) SetUp(ti *TestInfo) {
+	t.serverCfg.UploadLog = &t.log
+	t.fsTest.SetUp(ti)
+}
+
+// Parse the records written to the log so far.
+func (t *UploadLogTest) records() (records []uploadRecord) {
+	scanner := bufio.NewScanner(bytes.NewReader(t.log.Bytes()))
+	for scanner.Scan() {
+		var r uploadRecord
+		AssertEq(nil, json.Unmarshal(scanner.Bytes(), &r))
+		records = append(records, r)
+	}
+
+	AssertEq(nil, scanner.Err())
+	return
+}
+
+// Stat the named object in the bucket.
+func (t *UploadLogTest) stat(name string) (o *gcs.Object) {
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: name})
+	AssertEq(nil, err)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *UploadLogTest) EmptyFile() {
+	f, err := os.Create(path.Join(t.Dir, "_SUCCESS"))
+	AssertEq(nil, err)
+	AssertEq(nil, f.Close())
+
+	o := t.stat("_SUCCESS")
+	records := t.records()
+
+	AssertEq(1, len(records))
+	ExpectEq("_SUCCESS", records[0].Name)
+	ExpectEq(o.Generation, records[0].Generation)
+	ExpectEq(0, records[0].Size)
+}
+
+func (t *UploadLogTest) WrittenFile() {
+	err := ioutil.WriteFile(path.Join(t.Dir, "foo"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	o := t.stat("foo")
+	records := t.records()
+
+	// The empty object created first is recorded too.
+	AssertEq(2, len(records))
+	ExpectEq("foo", records[0].Name)
+	ExpectEq(0, records[0].Size)
+
+	ExpectEq("foo", records[1].Name)
+	ExpectEq(o.Generation, records[1].Generation)
+	ExpectEq(len("taco"), records[1].Size)
+	ExpectEq(o.CRC32C, records[1].CRC32C)
+}
+
+func (t *UploadLogTest) SyncWithoutChanges() {
+	err := ioutil.WriteFile(path.Join(t.Dir, "foo"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	// Opening and closing the file again writes nothing.
+	f, err := os.OpenFile(path.Join(t.Dir, "foo"), os.O_RDWR, 0)
+	AssertEq(nil, err)
+	AssertEq(nil, f.Sync())
+	AssertEq(nil, f.Close())
+
+	ExpectEq(2, len(t.records()))
+}
+
+func (t *UploadLogTest) Rename() {
+	err := ioutil.WriteFile(path.Join(t.Dir, "foo.tmp"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = os.Rename(path.Join(t.Dir, "foo.tmp"), path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+
+	o := t.stat("foo")
+	records := t.records()
+
+	AssertEq(3, len(records))
+	ExpectEq("foo", records[2].Name)
+	ExpectEq(o.Generation, records[2].Generation)
+	ExpectEq(len("taco"), records[2].Size)
+}
+
+func (t *UploadLogTest) ExistingObjectsNotRecorded() {
+	AssertEq(nil, t.createObjects(map[string]string{"foo": "taco"}))
+
+	_, err := ioutil.ReadFile(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+
+	ExpectEq(0, len(t.records()))
+}
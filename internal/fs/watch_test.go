@@ -0,0 +1,116 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const watchInterval = time.Minute
+
+type WatchTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&WatchTest{}) }
+
+func (t *WatchTest) SetUp(ti *TestInfo) {
+	t.serverCfg.WatchInterval = watchInterval
+
+	// Make sure reads reach the file system rather than the page cache, and
+	// aren't cut off at the size the kernel knows about.
+	t.serverCfg.DirectIOPatterns = []string{"*"}
+
+	t.fsTest.SetUp(ti)
+
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+}
+
+// Read from the given offset to EOF.
+func readFrom(f *os.File, offset int64) (s string, err error) {
+	buf := make([]byte, 1024)
+	n, err := f.ReadAt(buf, offset)
+	if err == io.EOF {
+		err = nil
+	}
+
+	s = string(buf[:n])
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *WatchTest) GrowingFile() {
+	var err error
+
+	// Open the file and read it.
+	t.f1, err = os.Open(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+
+	s, err := readFrom(t.f1, 0)
+	AssertEq(nil, err)
+	ExpectEq("taco", s)
+
+	// Append to the object behind the mount's back. Reads beyond the end of the
+	// old generation don't need to go to GCS, so they won't notice by
+	// themselves.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("tacoburrito"))
+	AssertEq(nil, err)
+
+	// Once the watch interval has passed, reads should see the new contents.
+	t.cacheClock.AdvanceTime(watchInterval)
+
+	s, err = readFrom(t.f1, 4)
+	AssertEq(nil, err)
+	ExpectEq("burrito", s)
+}
+
+func (t *WatchTest) DeletedFile() {
+	var err error
+
+	t.f1, err = os.Open(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+
+	s, err := readFrom(t.f1, 0)
+	AssertEq(nil, err)
+	ExpectEq("taco", s)
+
+	// Delete the object. Reads that must go to GCS should fail as they would
+	// without watching.
+	err = t.bucket.DeleteObject(
+		t.ctx,
+		&gcs.DeleteObjectRequest{Name: "foo"})
+
+	AssertEq(nil, err)
+
+	t.cacheClock.AdvanceTime(watchInterval)
+
+	_, err = readFrom(t.f1, 0)
+	ExpectNe(nil, err)
+}
@@ -0,0 +1,85 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type WriteBudgetTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&WriteBudgetTest{}) }
+
+func (t *WriteBudgetTest) SetUp(ti *TestInfo) {
+	t.serverCfg.WriteBudget = 10
+
+	t.fsTest.SetUp(ti)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *WriteBudgetTest) WithinBudget() {
+	err := ioutil.WriteFile(path.Join(t.Dir, "foo"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *WriteBudgetTest) FlushOverBudget() {
+	err := ioutil.WriteFile(
+		path.Join(t.Dir, "foo"),
+		[]byte("enchilada burrito"),
+		0600)
+
+	ExpectThat(err, Error(HasSubstr("quota")))
+
+	// Only the empty object created by open(2) made it to the bucket.
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("", string(contents))
+}
+
+func (t *WriteBudgetTest) BudgetUsedUp() {
+	p := path.Join(t.Dir, "foo")
+	err := ioutil.WriteFile(p, []byte("0123456789"), 0600)
+	AssertEq(nil, err)
+
+	// New files can't be created.
+	_, err = os.Create(path.Join(t.Dir, "bar"))
+	ExpectThat(err, Error(HasSubstr("quota")))
+
+	// Nor can existing ones be written.
+	t.f1, err = os.OpenFile(p, os.O_WRONLY, 0)
+	AssertEq(nil, err)
+
+	_, err = t.f1.Write([]byte("taco"))
+	ExpectThat(err, Error(HasSubstr("quota")))
+}
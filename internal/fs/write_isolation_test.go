@@ -0,0 +1,203 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"os"
+	"path"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/handle"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Last close wins
+////////////////////////////////////////////////////////////////////////
+
+type LastCloseWinsTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&LastCloseWinsTest{}) }
+
+func (t *LastCloseWinsTest) SetUp(ti *TestInfo) {
+	t.serverCfg.WriteIsolation = handle.LastCloseWins
+	t.fsTest.SetUp(ti)
+}
+
+func (t *LastCloseWinsTest) WritesNotVisibleToOtherHandles() {
+	var err error
+	AssertEq(nil, t.createWithContents("foo", "taco"))
+
+	t.f1, err = os.OpenFile(path.Join(t.Dir, "foo"), os.O_RDWR, 0)
+	AssertEq(nil, err)
+
+	t.f2, err = os.OpenFile(path.Join(t.Dir, "foo"), os.O_RDWR, 0)
+	AssertEq(nil, err)
+
+	_, err = t.f1.WriteAt([]byte("p"), 0)
+	AssertEq(nil, err)
+
+	// The writer sees its write, but the other handle doesn't.
+	buf := make([]byte, 4)
+	_, err = t.f1.ReadAt(buf, 0)
+	AssertEq(nil, err)
+	ExpectEq("paco", string(buf))
+
+	_, err = t.f2.ReadAt(buf, 0)
+	AssertEq(nil, err)
+	ExpectEq("taco", string(buf))
+}
+
+func (t *LastCloseWinsTest) LastCloseWins() {
+	var err error
+	AssertEq(nil, t.createWithContents("foo", "taco"))
+
+	t.f1, err = os.OpenFile(path.Join(t.Dir, "foo"), os.O_RDWR, 0)
+	AssertEq(nil, err)
+
+	t.f2, err = os.OpenFile(path.Join(t.Dir, "foo"), os.O_RDWR, 0)
+	AssertEq(nil, err)
+
+	_, err = t.f1.WriteAt([]byte("p"), 0)
+	AssertEq(nil, err)
+
+	_, err = t.f2.WriteAt([]byte("s"), 4)
+	AssertEq(nil, err)
+
+	// Close the first handle, then the second.
+	err = t.f1.Close()
+	t.f1 = nil
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("paco", string(contents))
+
+	err = t.f2.Close()
+	t.f2 = nil
+	AssertEq(nil, err)
+
+	// The second handle's view replaces the first's.
+	contents, err = gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("tacos", string(contents))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Merge
+////////////////////////////////////////////////////////////////////////
+
+type MergeWritesTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&MergeWritesTest{}) }
+
+func (t *MergeWritesTest) SetUp(ti *TestInfo) {
+	t.serverCfg.WriteIsolation = handle.MergeWrites
+	t.fsTest.SetUp(ti)
+}
+
+func (t *MergeWritesTest) DisjointWritesMerged() {
+	var err error
+	AssertEq(nil, t.createWithContents("foo", "taco"))
+
+	t.f1, err = os.OpenFile(path.Join(t.Dir, "foo"), os.O_RDWR, 0)
+	AssertEq(nil, err)
+
+	t.f2, err = os.OpenFile(path.Join(t.Dir, "foo"), os.O_RDWR, 0)
+	AssertEq(nil, err)
+
+	_, err = t.f1.WriteAt([]byte("p"), 0)
+	AssertEq(nil, err)
+
+	_, err = t.f2.WriteAt([]byte("s"), 4)
+	AssertEq(nil, err)
+
+	err = t.f1.Close()
+	t.f1 = nil
+	AssertEq(nil, err)
+
+	err = t.f2.Close()
+	t.f2 = nil
+	AssertEq(nil, err)
+
+	// Both writes survive.
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("pacos", string(contents))
+}
+
+func (t *MergeWritesTest) OverlappingWritesLastCloseWins() {
+	var err error
+	AssertEq(nil, t.createWithContents("foo", "taco"))
+
+	t.f1, err = os.OpenFile(path.Join(t.Dir, "foo"), os.O_RDWR, 0)
+	AssertEq(nil, err)
+
+	t.f2, err = os.OpenFile(path.Join(t.Dir, "foo"), os.O_RDWR, 0)
+	AssertEq(nil, err)
+
+	_, err = t.f1.WriteAt([]byte("pi"), 0)
+	AssertEq(nil, err)
+
+	_, err = t.f2.WriteAt([]byte("ro"), 1)
+	AssertEq(nil, err)
+
+	err = t.f2.Close()
+	t.f2 = nil
+	AssertEq(nil, err)
+
+	err = t.f1.Close()
+	t.f1 = nil
+	AssertEq(nil, err)
+
+	// Where the writes overlap, the handle closed last wins.
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("pioo", string(contents))
+}
+
+func (t *MergeWritesTest) Fsync() {
+	var err error
+	AssertEq(nil, t.createWithContents("foo", "taco"))
+
+	t.f1, err = os.OpenFile(path.Join(t.Dir, "foo"), os.O_RDWR, 0)
+	AssertEq(nil, err)
+
+	_, err = t.f1.WriteAt([]byte("p"), 0)
+	AssertEq(nil, err)
+
+	err = t.f1.Sync()
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("paco", string(contents))
+
+	// Later writes through the handle start from the reconciled contents.
+	_, err = t.f1.WriteAt([]byte("s"), 4)
+	AssertEq(nil, err)
+
+	err = t.f1.Close()
+	t.f1 = nil
+	AssertEq(nil, err)
+
+	contents, err = gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("pacos", string(contents))
+}
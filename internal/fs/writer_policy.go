@@ -0,0 +1,314 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseops"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fuseutil"
+	"golang.org/x/net/context"
+)
+
+// The prefix marking a WriterPolicy entry as a cgroup rather than an
+// executable.
+const cgroupEntryPrefix = "cgroup:"
+
+// WriterPolicy restricts which processes may modify the file system. Each
+// entry is either the absolute path of an executable, which matches processes
+// running it, or "cgroup:" followed by the absolute path of a cgroup, which
+// matches processes in that cgroup or one beneath it (in any hierarchy).
+//
+// A process may modify the file system if it matches no entry in Deny, and
+// either Allow is empty or it matches an entry there. Processes that can't be
+// identified (e.g. because they have already exited) may not.
+type WriterPolicy struct {
+	Allow []string
+	Deny  []string
+}
+
+// Check that every entry has one of the forms described above.
+func (p *WriterPolicy) validate() (err error) {
+	for _, e := range append(append([]string(nil), p.Allow...), p.Deny...) {
+		if !path.IsAbs(strings.TrimPrefix(e, cgroupEntryPrefix)) {
+			err = fmt.Errorf("Writer policy entry %q is not an absolute path", e)
+			return
+		}
+	}
+
+	return
+}
+
+// A description of a process for matching against a WriterPolicy.
+type processIdentity struct {
+	exe     string
+	cgroups []string
+}
+
+// Identify the process with the given ID using /proc.
+func identifyProcess(pid uint32) (id processIdentity, err error) {
+	dir := fmt.Sprintf("/proc/%d", pid)
+
+	id.exe, err = os.Readlink(path.Join(dir, "exe"))
+	if err != nil {
+		return
+	}
+
+	f, err := os.Open(path.Join(dir, "cgroup"))
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	// Each line is of the form "hierarchy-ID:controller-list:cgroup-path".
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) == 3 {
+			id.cgroups = append(id.cgroups, fields[2])
+		}
+	}
+
+	err = scanner.Err()
+	return
+}
+
+// Does the process match the supplied entry?
+func (id *processIdentity) matches(entry string) bool {
+	if !strings.HasPrefix(entry, cgroupEntryPrefix) {
+		return id.exe == entry
+	}
+
+	want := path.Clean(strings.TrimPrefix(entry, cgroupEntryPrefix))
+	for _, cg := range id.cgroups {
+		if want == "/" || cg == want || strings.HasPrefix(cg, want+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Does the policy permit the process to modify the file system?
+func (p *WriterPolicy) permits(id *processIdentity) bool {
+	for _, e := range p.Deny {
+		if id.matches(e) {
+			return false
+		}
+	}
+
+	if len(p.Allow) == 0 {
+		return true
+	}
+
+	for _, e := range p.Allow {
+		if id.matches(e) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Return EACCES unless the process that caused the op with the supplied
+// context may modify the file system.
+func (p *WriterPolicy) check(ctx context.Context) (err error) {
+	pid, ok := fuse.CallerPid(ctx)
+	if !ok {
+		err = syscall.EACCES
+		return
+	}
+
+	id, err := identifyProcess(pid)
+	if err != nil {
+		log.Printf(
+			"Refusing modification by unidentifiable process %d: %v",
+			pid,
+			err)
+
+		err = syscall.EACCES
+		return
+	}
+
+	if !p.permits(&id) {
+		err = syscall.EACCES
+		return
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// writerCheckingFileSystem
+////////////////////////////////////////////////////////////////////////
+
+// A file system that refuses ops that modify the wrapped file system unless
+// the policy permits the calling process. Files may be opened for writing
+// only by permitted processes, after which writes through the handle, as well
+// as flushing, syncing, and releasing it, are not checked.
+type writerCheckingFileSystem struct {
+	fuseutil.FileSystem
+	policy *WriterPolicy
+}
+
+func (fs *writerCheckingFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) (err error) {
+	if err = fs.policy.check(ctx); err != nil {
+		return
+	}
+
+	err = fs.FileSystem.SetInodeAttributes(ctx, op)
+	return
+}
+
+func (fs *writerCheckingFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) (err error) {
+	if err = fs.policy.check(ctx); err != nil {
+		return
+	}
+
+	err = fs.FileSystem.MkDir(ctx, op)
+	return
+}
+
+func (fs *writerCheckingFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) (err error) {
+	if err = fs.policy.check(ctx); err != nil {
+		return
+	}
+
+	err = fs.FileSystem.MkNode(ctx, op)
+	return
+}
+
+func (fs *writerCheckingFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) (err error) {
+	if err = fs.policy.check(ctx); err != nil {
+		return
+	}
+
+	err = fs.FileSystem.CreateFile(ctx, op)
+	return
+}
+
+func (fs *writerCheckingFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) (err error) {
+	if err = fs.policy.check(ctx); err != nil {
+		return
+	}
+
+	err = fs.FileSystem.CreateSymlink(ctx, op)
+	return
+}
+
+func (fs *writerCheckingFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) (err error) {
+	if err = fs.policy.check(ctx); err != nil {
+		return
+	}
+
+	err = fs.FileSystem.Rename(ctx, op)
+	return
+}
+
+func (fs *writerCheckingFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) (err error) {
+	if err = fs.policy.check(ctx); err != nil {
+		return
+	}
+
+	err = fs.FileSystem.RmDir(ctx, op)
+	return
+}
+
+func (fs *writerCheckingFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) (err error) {
+	if err = fs.policy.check(ctx); err != nil {
+		return
+	}
+
+	err = fs.FileSystem.Unlink(ctx, op)
+	return
+}
+
+func (fs *writerCheckingFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) (err error) {
+	// Writes are checked here rather than as they arrive, since with writeback
+	// caching the kernel sends them on its own behalf. Opening for reading
+	// alone is fine.
+	if op.Flags&syscall.O_ACCMODE != syscall.O_RDONLY ||
+		op.Flags&syscall.O_TRUNC != 0 {
+		if err = fs.policy.check(ctx); err != nil {
+			return
+		}
+	}
+
+	err = fs.FileSystem.OpenFile(ctx, op)
+	return
+}
+
+func (fs *writerCheckingFileSystem) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) (err error) {
+	if err = fs.policy.check(ctx); err != nil {
+		return
+	}
+
+	err = fs.FileSystem.CopyFileRange(ctx, op)
+	return
+}
+
+func (fs *writerCheckingFileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) (err error) {
+	// Special case: only attributes backed by object metadata modify anything
+	// in the bucket.
+	if isObjectXattr(op.Name) {
+		if err = fs.policy.check(ctx); err != nil {
+			return
+		}
+	}
+
+	err = fs.FileSystem.SetXattr(ctx, op)
+	return
+}
+
+func (fs *writerCheckingFileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) (err error) {
+	if err = fs.policy.check(ctx); err != nil {
+		return
+	}
+
+	err = fs.FileSystem.RemoveXattr(ctx, op)
+	return
+}
@@ -0,0 +1,137 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Tests for identifying processes, which uses /proc and so works only on
+// Linux.
+
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestWriterPolicy(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type WriterPolicyTest struct {
+	id processIdentity
+}
+
+var _ SetUpInterface = &WriterPolicyTest{}
+
+func init() { RegisterTestSuite(&WriterPolicyTest{}) }
+
+func (t *WriterPolicyTest) SetUp(ti *TestInfo) {
+	t.id = processIdentity{
+		exe: "/usr/bin/python3",
+		cgroups: []string{
+			"/system.slice/train.service",
+			"/user.slice/user-1000.slice",
+		},
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *WriterPolicyTest) IdentifySelf() {
+	id, err := identifyProcess(uint32(os.Getpid()))
+	AssertEq(nil, err)
+
+	exe, err := os.Executable()
+	AssertEq(nil, err)
+
+	exe, err = filepath.EvalSymlinks(exe)
+	AssertEq(nil, err)
+
+	ExpectEq(exe, id.exe)
+	ExpectNe(0, len(id.cgroups))
+}
+
+func (t *WriterPolicyTest) IdentifyMissingProcess() {
+	// Larger than the kernel's maximum PID.
+	_, err := identifyProcess(1 << 30)
+	ExpectNe(nil, err)
+}
+
+func (t *WriterPolicyTest) Matches() {
+	testCases := []struct {
+		entry    string
+		expected bool
+	}{
+		{"/usr/bin/python3", true},
+		{"/usr/bin/python", false},
+		{"/usr/bin", false},
+		{"cgroup:/system.slice/train.service", true},
+		{"cgroup:/system.slice", true},
+		{"cgroup:/system.slice/", true},
+		{"cgroup:/", true},
+		{"cgroup:/system.slice/train", false},
+		{"cgroup:/system.slice/train.service/child", false},
+		{"cgroup:/usr/bin/python3", false},
+	}
+
+	for _, tc := range testCases {
+		ExpectEq(tc.expected, t.id.matches(tc.entry), "Entry: %q", tc.entry)
+	}
+}
+
+func (t *WriterPolicyTest) Permits() {
+	testCases := []struct {
+		policy   WriterPolicy
+		expected bool
+	}{
+		{WriterPolicy{}, true},
+		{WriterPolicy{Allow: []string{"/usr/bin/python3"}}, true},
+		{WriterPolicy{Allow: []string{"/bin/cp", "cgroup:/system.slice"}}, true},
+		{WriterPolicy{Allow: []string{"/bin/cp"}}, false},
+		{WriterPolicy{Deny: []string{"/bin/rm"}}, true},
+		{WriterPolicy{Deny: []string{"cgroup:/user.slice"}}, false},
+		{
+			WriterPolicy{
+				Allow: []string{"/usr/bin/python3"},
+				Deny:  []string{"cgroup:/user.slice"},
+			},
+			false,
+		},
+	}
+
+	for i, tc := range testCases {
+		ExpectEq(tc.expected, tc.policy.permits(&t.id), "Test case %d", i)
+	}
+}
+
+func (t *WriterPolicyTest) Validate() {
+	p := WriterPolicy{
+		Allow: []string{"/usr/bin/python3", "cgroup:/system.slice"},
+		Deny:  []string{"/bin/rm"},
+	}
+
+	ExpectEq(nil, p.validate())
+
+	p.Deny = append(p.Deny, "rm")
+	ExpectThat(p.validate(), Error(HasSubstr(`"rm"`)))
+
+	p.Deny = []string{"cgroup:system.slice"}
+	ExpectThat(p.validate(), Error(HasSubstr("cgroup:system.slice")))
+}
@@ -0,0 +1,148 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Return the resolved path of the test binary, which is the executable of the
+// processes making requests to the file system in these tests.
+func testExecutable() string {
+	exe, err := os.Executable()
+	AssertEq(nil, err)
+
+	exe, err = filepath.EvalSymlinks(exe)
+	AssertEq(nil, err)
+
+	return exe
+}
+
+////////////////////////////////////////////////////////////////////////
+// Allowed
+////////////////////////////////////////////////////////////////////////
+
+type AllowedWriterTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&AllowedWriterTest{}) }
+
+func (t *AllowedWriterTest) SetUp(ti *TestInfo) {
+	t.serverCfg.WriterPolicy = &fs.WriterPolicy{
+		Allow: []string{"/bin/false", testExecutable()},
+	}
+
+	t.fsTest.SetUp(ti)
+}
+
+func (t *AllowedWriterTest) WriteFile() {
+	err := ioutil.WriteFile(path.Join(t.Dir, "foo"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *AllowedWriterTest) Mkdir() {
+	err := os.Mkdir(path.Join(t.Dir, "dir"), 0700)
+	ExpectEq(nil, err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Not allowed
+////////////////////////////////////////////////////////////////////////
+
+type DeniedWriterTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&DeniedWriterTest{}) }
+
+func (t *DeniedWriterTest) SetUp(ti *TestInfo) {
+	t.serverCfg.WriterPolicy = &fs.WriterPolicy{
+		Allow: []string{"/bin/false"},
+	}
+
+	t.fsTest.SetUp(ti)
+
+	// Create an existing object in the bucket.
+	AssertEq(nil, t.createWithContents("foo", "taco"))
+}
+
+func (t *DeniedWriterTest) ReadFile() {
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "foo"))
+
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *DeniedWriterTest) CreateFile() {
+	err := ioutil.WriteFile(path.Join(t.Dir, "bar"), []byte("burrito"), 0600)
+	ExpectThat(err, Error(HasSubstr("permission denied")))
+
+	_, err = gcsutil.ReadObject(t.ctx, t.bucket, "bar")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *DeniedWriterTest) WriteExistingFile() {
+	_, err := os.OpenFile(path.Join(t.Dir, "foo"), os.O_WRONLY, 0)
+	ExpectThat(err, Error(HasSubstr("permission denied")))
+
+	_, err = os.OpenFile(path.Join(t.Dir, "foo"), os.O_RDWR, 0)
+	ExpectThat(err, Error(HasSubstr("permission denied")))
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *DeniedWriterTest) Truncate() {
+	err := os.Truncate(path.Join(t.Dir, "foo"), 0)
+	ExpectThat(err, Error(HasSubstr("permission denied")))
+}
+
+func (t *DeniedWriterTest) Rename() {
+	err := os.Rename(path.Join(t.Dir, "foo"), path.Join(t.Dir, "bar"))
+	ExpectThat(err, Error(HasSubstr("permission denied")))
+}
+
+func (t *DeniedWriterTest) Unlink() {
+	err := os.Remove(path.Join(t.Dir, "foo"))
+	ExpectThat(err, Error(HasSubstr("permission denied")))
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *DeniedWriterTest) Mkdir() {
+	err := os.Mkdir(path.Join(t.Dir, "dir"), 0700)
+	ExpectThat(err, Error(HasSubstr("permission denied")))
+}
@@ -0,0 +1,344 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+// Reasons GCS gives for 403 errors caused by quotas or rate limits, which
+// say nothing about what the credentials may access.
+var nonPermissionReasons = map[string]bool{
+	"quotaExceeded":         true,
+	"storageQuotaExceeded":  true,
+	"dailyLimitExceeded":    true,
+	"rateLimitExceeded":     true,
+	"userRateLimitExceeded": true,
+}
+
+// Does the supplied error say that the credentials lack permission for the
+// request?
+func isPermissionDenied(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusForbidden {
+		return false
+	}
+
+	for _, item := range apiErr.Errors {
+		if nonPermissionReasons[item.Reason] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Return the prefix of the supplied object name or listing prefix that
+// access is denied for: everything up to and including its last slash.
+func denialPrefix(name string) string {
+	return name[:strings.LastIndex(name, "/")+1]
+}
+
+// AccessDeniedError is returned by a bucket created with
+// NewAccessDenialBucket for requests that weren't sent because an earlier
+// request for the same prefix was denied.
+type AccessDeniedError struct {
+	// The prefix, and whether it was writing to it that was denied.
+	Prefix string
+	Write  bool
+
+	// The error returned by the earlier request.
+	Err error
+}
+
+func (e *AccessDeniedError) Error() string {
+	verb := "reading"
+	if e.Write {
+		verb = "writing"
+	}
+
+	return fmt.Sprintf(
+		"%s objects in %q was recently denied, perhaps because the credentials "+
+			"are limited to other prefixes by IAM conditions: %v",
+		verb,
+		e.Prefix,
+		e.Err)
+}
+
+func (e *AccessDeniedError) Unwrap() error {
+	return e.Err
+}
+
+// A prefix to which access was denied, for reading or for writing.
+type denialKey struct {
+	prefix string
+	write  bool
+}
+
+// A denial of access to a prefix, and when we will next let a request for it
+// through.
+type denial struct {
+	err        error
+	expiration time.Time
+}
+
+// AccessDenialBucket is a bucket that remembers which prefixes requests have
+// been denied for with HTTP 403, and fails further requests for the same
+// prefixes straight away for a while rather than sending them. This suits
+// credentials limited to certain prefixes by IAM conditions, for which every
+// request outside those prefixes is denied.
+//
+// The prefix of an object is its name up to and including the last slash,
+// i.e. its directory, and a listing's is that of its prefix. Only requests
+// with exactly the same prefix are failed, so a denial for "a/" says nothing
+// about "a/b/", which the credentials may still be allowed to access. Reads
+// (including stats and listings) and writes are remembered separately, since
+// the credentials may allow one and not the other.
+type AccessDenialBucket struct {
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	ttl     time.Duration
+	clock   timeutil.Clock
+	wrapped gcs.Bucket
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// Prefixes for which requests have recently been denied. Expired entries
+	// are removed when next looked at.
+	//
+	// GUARDED_BY(mu)
+	denials map[denialKey]denial
+}
+
+var _ gcs.Bucket = &AccessDenialBucket{}
+
+// NewAccessDenialBucket creates a bucket that fails requests for prefixes
+// for which a request has been denied within the last ttl.
+func NewAccessDenialBucket(
+	ttl time.Duration,
+	clock timeutil.Clock,
+	wrapped gcs.Bucket) (b *AccessDenialBucket) {
+	b = &AccessDenialBucket{
+		ttl:     ttl,
+		clock:   clock,
+		wrapped: wrapped,
+		denials: make(map[denialKey]denial),
+	}
+
+	return
+}
+
+// DeniedPrefixes returns the prefixes for which reading and writing
+// respectively have recently been denied, in sorted order.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *AccessDenialBucket) DeniedPrefixes() (read, write []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.clock.Now()
+	for k, d := range b.denials {
+		if !now.Before(d.expiration) {
+			continue
+		}
+
+		if k.write {
+			write = append(write, k.prefix)
+		} else {
+			read = append(read, k.prefix)
+		}
+	}
+
+	sort.Strings(read)
+	sort.Strings(write)
+	return
+}
+
+// Return an error if requests for the supplied name have recently been
+// denied.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *AccessDenialBucket) check(name string, write bool) (err error) {
+	k := denialKey{prefix: denialPrefix(name), write: write}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	d, ok := b.denials[k]
+	if !ok {
+		return
+	}
+
+	if !b.clock.Now().Before(d.expiration) {
+		delete(b.denials, k)
+		return
+	}
+
+	err = &AccessDeniedError{
+		Prefix: k.prefix,
+		Write:  k.write,
+		Err:    d.err,
+	}
+
+	return
+}
+
+// Remember the supplied error if it is a denial of a request for the
+// supplied name.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *AccessDenialBucket) observe(name string, write bool, err error) {
+	if !isPermissionDenied(err) {
+		return
+	}
+
+	k := denialKey{prefix: denialPrefix(name), write: write}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.denials[k] = denial{
+		err:        err,
+		expiration: b.clock.Now().Add(b.ttl),
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// gcs.Bucket
+////////////////////////////////////////////////////////////////////////
+
+func (b *AccessDenialBucket) Name() string {
+	return b.wrapped.Name()
+}
+
+func (b *AccessDenialBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	if err = b.check(req.Name, false); err != nil {
+		return
+	}
+
+	rc, err = b.wrapped.NewReader(ctx, req)
+	b.observe(req.Name, false, err)
+	return
+}
+
+func (b *AccessDenialBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	if err = b.check(req.Name, true); err != nil {
+		return
+	}
+
+	o, err = b.wrapped.CreateObject(ctx, req)
+	b.observe(req.Name, true, err)
+	return
+}
+
+// Special case: a denied copy may be for want of permission to read the
+// source or to write the destination, and we can't tell which, so it is
+// remembered against neither.
+func (b *AccessDenialBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	if err = b.check(req.SrcName, false); err != nil {
+		return
+	}
+
+	if err = b.check(req.DstName, true); err != nil {
+		return
+	}
+
+	o, err = b.wrapped.CopyObject(ctx, req)
+	return
+}
+
+// Special case: likewise for compositions, whose sources must be read.
+func (b *AccessDenialBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	if err = b.check(req.DstName, true); err != nil {
+		return
+	}
+
+	o, err = b.wrapped.ComposeObjects(ctx, req)
+	return
+}
+
+func (b *AccessDenialBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	if err = b.check(req.Name, false); err != nil {
+		return
+	}
+
+	o, err = b.wrapped.StatObject(ctx, req)
+	b.observe(req.Name, false, err)
+	return
+}
+
+func (b *AccessDenialBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (l *gcs.Listing, err error) {
+	if err = b.check(req.Prefix, false); err != nil {
+		return
+	}
+
+	l, err = b.wrapped.ListObjects(ctx, req)
+	b.observe(req.Prefix, false, err)
+	return
+}
+
+func (b *AccessDenialBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	if err = b.check(req.Name, true); err != nil {
+		return
+	}
+
+	o, err = b.wrapped.UpdateObject(ctx, req)
+	b.observe(req.Name, true, err)
+	return
+}
+
+func (b *AccessDenialBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	if err = b.check(req.Name, true); err != nil {
+		return
+	}
+
+	err = b.wrapped.DeleteObject(ctx, req)
+	b.observe(req.Name, true, err)
+	return
+}
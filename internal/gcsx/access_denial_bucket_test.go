@@ -0,0 +1,238 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestAccessDenialBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// scopedBucket
+////////////////////////////////////////////////////////////////////////
+
+// A bucket that denies stats and creations outside of a prefix, as GCS does
+// for credentials limited by an IAM condition, and counts the stats that
+// reach it.
+type scopedBucket struct {
+	gcs.Bucket
+	prefix string
+	stats  int
+}
+
+func (b *scopedBucket) denied(name string) (err error) {
+	if !strings.HasPrefix(name, b.prefix) {
+		err = &googleapi.Error{
+			Code: http.StatusForbidden,
+			Errors: []googleapi.ErrorItem{
+				{Reason: "forbidden"},
+			},
+		}
+	}
+
+	return
+}
+
+func (b *scopedBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	b.stats++
+	if err = b.denied(req.Name); err != nil {
+		return
+	}
+
+	o, err = b.Bucket.StatObject(ctx, req)
+	return
+}
+
+func (b *scopedBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	if err = b.denied(req.Name); err != nil {
+		return
+	}
+
+	o, err = b.Bucket.CreateObject(ctx, req)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const accessDenialTTL = time.Minute
+
+type AccessDenialBucketTest struct {
+	ctx     context.Context
+	clock   timeutil.SimulatedClock
+	wrapped scopedBucket
+	bucket  *gcsx.AccessDenialBucket
+}
+
+var _ SetUpInterface = &AccessDenialBucketTest{}
+
+func init() { RegisterTestSuite(&AccessDenialBucketTest{}) }
+
+func (t *AccessDenialBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.wrapped.Bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.wrapped.prefix = "team/a/"
+	t.bucket = gcsx.NewAccessDenialBucket(accessDenialTTL, &t.clock, &t.wrapped)
+
+	_, err := gcsutil.CreateObject(t.ctx, t.wrapped.Bucket, "team/a/foo", []byte("taco"))
+	AssertEq(nil, err)
+}
+
+func (t *AccessDenialBucketTest) stat(name string) (err error) {
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: name})
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *AccessDenialBucketTest) AllowedPrefix() {
+	for i := 0; i < 3; i++ {
+		err := t.stat("team/a/foo")
+		AssertEq(nil, err)
+	}
+
+	ExpectEq(3, t.wrapped.stats)
+
+	read, write := t.bucket.DeniedPrefixes()
+	ExpectEq(0, len(read))
+	ExpectEq(0, len(write))
+}
+
+func (t *AccessDenialBucketTest) DeniedPrefixCached() {
+	err := t.stat("team/b/foo")
+	ExpectThat(err, Error(HasSubstr("403")))
+	ExpectEq(1, t.wrapped.stats)
+
+	// Further stats in the same prefix fail without reaching the bucket, with
+	// an error that still unwraps to the original.
+	err = t.stat("team/b/bar")
+
+	var denied *gcsx.AccessDeniedError
+	AssertTrue(errors.As(err, &denied), "err: %v", err)
+	ExpectEq("team/b/", denied.Prefix)
+	ExpectFalse(denied.Write)
+	ExpectThat(err, Error(HasSubstr("IAM conditions")))
+
+	var apiErr *googleapi.Error
+	AssertTrue(errors.As(err, &apiErr))
+	ExpectEq(http.StatusForbidden, apiErr.Code)
+
+	ExpectEq(1, t.wrapped.stats)
+
+	read, write := t.bucket.DeniedPrefixes()
+	ExpectThat(read, ElementsAre("team/b/"))
+	ExpectEq(0, len(write))
+}
+
+func (t *AccessDenialBucketTest) OtherPrefixesUnaffected() {
+	err := t.stat("team/foo")
+	ExpectThat(err, Error(HasSubstr("403")))
+
+	// "team/a/" is beneath the denied "team/", but may still be allowed.
+	err = t.stat("team/a/foo")
+	ExpectEq(nil, err)
+	ExpectEq(2, t.wrapped.stats)
+}
+
+func (t *AccessDenialBucketTest) DenialExpires() {
+	err := t.stat("team/b/foo")
+	ExpectThat(err, Error(HasSubstr("403")))
+
+	t.clock.AdvanceTime(accessDenialTTL)
+
+	err = t.stat("team/b/foo")
+	ExpectThat(err, Error(HasSubstr("403")))
+	ExpectEq(2, t.wrapped.stats)
+}
+
+func (t *AccessDenialBucketTest) ReadsAndWritesSeparate() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "team/b/foo", []byte(""))
+	ExpectThat(err, Error(HasSubstr("403")))
+
+	read, write := t.bucket.DeniedPrefixes()
+	ExpectEq(0, len(read))
+	ExpectThat(write, ElementsAre("team/b/"))
+
+	// Stats are still sent.
+	err = t.stat("team/b/foo")
+	ExpectThat(err, Error(HasSubstr("403")))
+	ExpectEq(1, t.wrapped.stats)
+
+	// Creations aren't.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "team/b/bar", []byte(""))
+
+	var denied *gcsx.AccessDeniedError
+	AssertTrue(errors.As(err, &denied), "err: %v", err)
+	ExpectTrue(denied.Write)
+}
+
+func (t *AccessDenialBucketTest) QuotaErrorsNotCached() {
+	t.wrapped.prefix = ""
+
+	b := gcsx.NewAccessDenialBucket(
+		accessDenialTTL,
+		&t.clock,
+		&quotaBucket{t.wrapped.Bucket})
+
+	for i := 0; i < 2; i++ {
+		_, err := b.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "team/a/foo"})
+		ExpectThat(err, Error(HasSubstr("403")))
+
+		var denied *gcsx.AccessDeniedError
+		ExpectFalse(errors.As(err, &denied))
+	}
+}
+
+// A bucket whose stats fail with a 403 caused by a quota.
+type quotaBucket struct {
+	gcs.Bucket
+}
+
+func (b *quotaBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	err = &googleapi.Error{
+		Code: http.StatusForbidden,
+		Errors: []googleapi.ErrorItem{
+			{Reason: "quotaExceeded"},
+		},
+	}
+
+	return
+}
@@ -20,7 +20,7 @@ import (
 	"io"
 	"time"
 
-	"github.com/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
 	"golang.org/x/net/context"
 )
 
@@ -54,6 +54,13 @@ type appendObjectCreator struct {
 }
 
 func (oc *appendObjectCreator) chooseName() (name string, err error) {
+	name, err = chooseTmpObjectName(oc.prefix)
+	return
+}
+
+// Choose a random name for a temporary object, beginning with the supplied
+// prefix.
+func chooseTmpObjectName(prefix string) (name string, err error) {
 	// Generate a good 64-bit random number.
 	var buf [8]byte
 	_, err = io.ReadFull(rand.Reader, buf[:])
@@ -72,7 +79,7 @@ func (oc *appendObjectCreator) chooseName() (name string, err error) {
 		uint64(buf[7])<<56
 
 	// Turn it into a name.
-	name = fmt.Sprintf("%s%016x", oc.prefix, x)
+	name = fmt.Sprintf("%s%016x", prefix, x)
 
 	return
 }
@@ -110,7 +117,7 @@ func (oc *appendObjectCreator) Create(
 		return
 
 	default:
-		err = fmt.Errorf("CreateObject: %v", err)
+		err = fmt.Errorf("CreateObject: %w", err)
 		return
 	}
 
@@ -171,7 +178,7 @@ func (oc *appendObjectCreator) Create(
 		return
 
 	default:
-		err = fmt.Errorf("ComposeObjects: %v", err)
+		err = fmt.Errorf("ComposeObjects: %w", err)
 		return
 	}
 
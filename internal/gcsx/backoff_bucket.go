@@ -0,0 +1,298 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+// ThrottleBackoff is a penalty shared by all requests made through a set of
+// buckets, imposed when GCS signals that we are being throttled. Each
+// throttling signal doubles the penalty (up to a maximum) and delays all
+// requests until it has elapsed. Once a full penalty period passes without
+// further throttling, the penalty halves, and so on until it drops below the
+// minimum and disappears.
+//
+// Sharing the penalty across all of a mount's requests, rather than backing
+// off only the request that was throttled, stops the mount from continuing to
+// hammer GCS from other goroutines and so lets it recover more quickly.
+type ThrottleBackoff struct {
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	clock      timeutil.Clock
+	minPenalty time.Duration
+	maxPenalty time.Duration
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// The penalty imposed by the most recent throttling signal, and the time at
+	// which it was received. penalty is zero if we have never been throttled.
+	//
+	// GUARDED_BY(mu)
+	penalty       time.Duration
+	lastThrottled time.Time
+}
+
+// NewThrottleBackoff creates a backoff whose penalty ranges between the
+// supplied minimum and maximum.
+func NewThrottleBackoff(
+	minPenalty time.Duration,
+	maxPenalty time.Duration,
+	clock timeutil.Clock) (tb *ThrottleBackoff) {
+	tb = &ThrottleBackoff{
+		clock:      clock,
+		minPenalty: minPenalty,
+		maxPenalty: maxPenalty,
+	}
+
+	return
+}
+
+// Return the penalty as decayed to the given time.
+//
+// LOCKS_REQUIRED(tb.mu)
+func (tb *ThrottleBackoff) decayedPenalty(now time.Time) (p time.Duration) {
+	p = tb.penalty
+	elapsed := now.Sub(tb.lastThrottled)
+	for p >= tb.minPenalty && elapsed >= p {
+		elapsed -= p
+		p /= 2
+	}
+
+	if p < tb.minPenalty {
+		p = 0
+	}
+
+	return
+}
+
+// NoteThrottled records that a request was throttled, increasing the penalty.
+func (tb *ThrottleBackoff) NoteThrottled() {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	now := tb.clock.Now()
+	p := 2 * tb.decayedPenalty(now)
+	if p < tb.minPenalty {
+		p = tb.minPenalty
+	}
+
+	if p > tb.maxPenalty {
+		p = tb.maxPenalty
+	}
+
+	tb.penalty = p
+	tb.lastThrottled = now
+}
+
+// Delay returns the amount of time for which requests should currently be
+// delayed.
+func (tb *ThrottleBackoff) Delay() (d time.Duration) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	d = tb.lastThrottled.Add(tb.penalty).Sub(tb.clock.Now())
+	if d < 0 {
+		d = 0
+	}
+
+	return
+}
+
+// Wait blocks until the current delay has elapsed or the context is
+// cancelled.
+func (tb *ThrottleBackoff) Wait(ctx context.Context) (err error) {
+	d := tb.Delay()
+	if d == 0 {
+		return
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	return
+}
+
+// Does the supplied error indicate that GCS is throttling us? S3-compatible
+// stores use 503 Slow Down for the same purpose.
+func isThrottlingError(err error) bool {
+	typed, ok := err.(*googleapi.Error)
+	if !ok {
+		return false
+	}
+
+	switch typed.Code {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	}
+
+	for _, item := range typed.Errors {
+		switch item.Reason {
+		case "rateLimitExceeded", "userRateLimitExceeded":
+			return true
+		}
+	}
+
+	return false
+}
+
+// NewBackoffBucket creates a bucket that delays each call to the wrapped
+// bucket according to the supplied backoff, and feeds throttling errors
+// returned by the wrapped bucket back into it.
+func NewBackoffBucket(
+	tb *ThrottleBackoff,
+	wrapped gcs.Bucket) (b gcs.Bucket) {
+	b = &backoffBucket{
+		backoff: tb,
+		wrapped: wrapped,
+	}
+
+	return
+}
+
+type backoffBucket struct {
+	backoff *ThrottleBackoff
+	wrapped gcs.Bucket
+}
+
+func (b *backoffBucket) observe(err error) {
+	if isThrottlingError(err) {
+		b.backoff.NoteThrottled()
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// gcs.Bucket
+////////////////////////////////////////////////////////////////////////
+
+func (b *backoffBucket) Name() string {
+	return b.wrapped.Name()
+}
+
+func (b *backoffBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	if err = b.backoff.Wait(ctx); err != nil {
+		return
+	}
+
+	rc, err = b.wrapped.NewReader(ctx, req)
+	b.observe(err)
+	return
+}
+
+func (b *backoffBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	if err = b.backoff.Wait(ctx); err != nil {
+		return
+	}
+
+	o, err = b.wrapped.CreateObject(ctx, req)
+	b.observe(err)
+	return
+}
+
+func (b *backoffBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	if err = b.backoff.Wait(ctx); err != nil {
+		return
+	}
+
+	o, err = b.wrapped.CopyObject(ctx, req)
+	b.observe(err)
+	return
+}
+
+func (b *backoffBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	if err = b.backoff.Wait(ctx); err != nil {
+		return
+	}
+
+	o, err = b.wrapped.ComposeObjects(ctx, req)
+	b.observe(err)
+	return
+}
+
+func (b *backoffBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	if err = b.backoff.Wait(ctx); err != nil {
+		return
+	}
+
+	o, err = b.wrapped.StatObject(ctx, req)
+	b.observe(err)
+	return
+}
+
+func (b *backoffBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (l *gcs.Listing, err error) {
+	if err = b.backoff.Wait(ctx); err != nil {
+		return
+	}
+
+	l, err = b.wrapped.ListObjects(ctx, req)
+	b.observe(err)
+	return
+}
+
+func (b *backoffBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	if err = b.backoff.Wait(ctx); err != nil {
+		return
+	}
+
+	o, err = b.wrapped.UpdateObject(ctx, req)
+	b.observe(err)
+	return
+}
+
+func (b *backoffBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	if err = b.backoff.Wait(ctx); err != nil {
+		return
+	}
+
+	err = b.wrapped.DeleteObject(ctx, req)
+	b.observe(err)
+	return
+}
@@ -0,0 +1,180 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestBackoffBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const (
+	minPenalty = time.Second
+	maxPenalty = 8 * time.Second
+)
+
+type BackoffBucketTest struct {
+	ctx     context.Context
+	clock   timeutil.SimulatedClock
+	backoff *gcsx.ThrottleBackoff
+	wrapped gcs.Bucket
+}
+
+var _ SetUpInterface = &BackoffBucketTest{}
+
+func init() { RegisterTestSuite(&BackoffBucketTest{}) }
+
+func (t *BackoffBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.backoff = gcsx.NewThrottleBackoff(minPenalty, maxPenalty, &t.clock)
+	t.wrapped = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	_, err := gcsutil.CreateObject(t.ctx, t.wrapped, "foo", []byte("taco"))
+	AssertEq(nil, err)
+}
+
+// Create a backoff bucket wrapping a bucket that fails requests for names
+// with the given prefix with the given HTTP status code.
+func (t *BackoffBucketTest) makeBucket(
+	prefix string,
+	code int) (b gcs.Bucket) {
+	scenario := fmt.Sprintf(
+		`{"rules": [{"op": "*", "name_prefix": %q, "error_code": %d}]}`,
+		prefix,
+		code)
+
+	s, err := gcsx.ParseFaultScenario(strings.NewReader(scenario))
+	AssertEq(nil, err)
+
+	b = gcsx.NewBackoffBucket(t.backoff, gcsx.NewFaultInjectingBucket(s, t.wrapped))
+	return
+}
+
+func (t *BackoffBucketTest) stat(b gcs.Bucket, name string) (err error) {
+	_, err = b.StatObject(t.ctx, &gcs.StatObjectRequest{Name: name})
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *BackoffBucketTest) NoPenaltyInitially() {
+	ExpectEq(0, t.backoff.Delay())
+	ExpectEq(nil, t.backoff.Wait(t.ctx))
+}
+
+func (t *BackoffBucketTest) PenaltyDoublesUpToMaximum() {
+	t.backoff.NoteThrottled()
+	ExpectEq(minPenalty, t.backoff.Delay())
+
+	t.backoff.NoteThrottled()
+	ExpectEq(2*minPenalty, t.backoff.Delay())
+
+	t.backoff.NoteThrottled()
+	t.backoff.NoteThrottled()
+	t.backoff.NoteThrottled()
+	ExpectEq(maxPenalty, t.backoff.Delay())
+
+	// The delay counts down as time passes.
+	t.clock.AdvanceTime(3 * time.Second)
+	ExpectEq(maxPenalty-3*time.Second, t.backoff.Delay())
+}
+
+func (t *BackoffBucketTest) PenaltyDecays() {
+	// Build up a penalty of 4s.
+	t.backoff.NoteThrottled()
+	t.backoff.NoteThrottled()
+	t.backoff.NoteThrottled()
+	AssertEq(4*time.Second, t.backoff.Delay())
+
+	// After the penalty elapses and half as long again, the penalty has decayed
+	// to 1s, so a new signal brings it back to only 2s.
+	t.clock.AdvanceTime(4*time.Second + 2*time.Second)
+	AssertEq(0, t.backoff.Delay())
+
+	t.backoff.NoteThrottled()
+	ExpectEq(2*time.Second, t.backoff.Delay())
+
+	// After a long quiet period it disappears entirely.
+	t.clock.AdvanceTime(time.Hour)
+	t.backoff.NoteThrottled()
+	ExpectEq(minPenalty, t.backoff.Delay())
+}
+
+func (t *BackoffBucketTest) ThrottlingErrorsImposePenalty() {
+	b := t.makeBucket("slow", 429)
+
+	err := t.stat(b, "slow")
+	ExpectNe(nil, err)
+	ExpectEq(minPenalty, t.backoff.Delay())
+}
+
+func (t *BackoffBucketTest) ServiceUnavailableImposesPenalty() {
+	b := t.makeBucket("slow", 503)
+
+	err := t.stat(b, "slow")
+	ExpectNe(nil, err)
+	ExpectEq(minPenalty, t.backoff.Delay())
+}
+
+func (t *BackoffBucketTest) OtherErrorsDoNotImposePenalty() {
+	b := t.makeBucket("bad", 500)
+
+	err := t.stat(b, "bad")
+	ExpectNe(nil, err)
+
+	err = t.stat(b, "missing")
+	_, ok := err.(*gcs.NotFoundError)
+	ExpectTrue(ok, "err: %v", err)
+
+	ExpectEq(0, t.backoff.Delay())
+}
+
+func (t *BackoffBucketTest) PenaltyAppliesToOtherRequests() {
+	b := t.makeBucket("slow", 429)
+
+	err := t.stat(b, "slow")
+	AssertNe(nil, err)
+
+	// A request for an unrelated object is held up by the penalty, and gives up
+	// when its context is cancelled.
+	ctx, cancel := context.WithTimeout(t.ctx, 10*time.Millisecond)
+	defer cancel()
+
+	_, err = b.StatObject(ctx, &gcs.StatObjectRequest{Name: "foo"})
+	ExpectTrue(err == context.DeadlineExceeded, "err: %v", err)
+
+	// Once the penalty has elapsed, it proceeds.
+	t.clock.AdvanceTime(minPenalty)
+	ExpectEq(nil, t.stat(b, "foo"))
+}
@@ -0,0 +1,234 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"errors"
+	"io"
+	"log"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/filecache"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// NewCachingRandomReader wraps a random reader so that it serves reads from
+// the supplied file cache if the generation it reads is there, and otherwise
+// adds the generation to the cache once it has been read in full, in order
+// from the start, with matching checksums. Reads out of order give up on
+// adding it, so that the cache costs nothing extra from GCS.
+//
+// Blocks of a cached generation that turn out to be corrupt are fetched from
+// GCS again and repaired in the cache, so that a local disk error doesn't
+// fail reads while GCS still has the generation.
+//
+// bucketName is the name of the bucket from which wrapped reads.
+func NewCachingRandomReader(
+	wrapped RandomReader,
+	cache *filecache.Cache,
+	bucketName string) (rr RandomReader) {
+	o := wrapped.Object()
+	r := &cachingRandomReader{
+		wrapped: wrapped,
+		cache:   cache,
+		key: filecache.Key{
+			Bucket:     bucketName,
+			Name:       o.Name,
+			Generation: o.Generation,
+		},
+		filling: true,
+	}
+
+	r.cached = cache.Open(r.key)
+
+	rr = r
+	return
+}
+
+type cachingRandomReader struct {
+	wrapped RandomReader
+	cache   *filecache.Cache
+	key     filecache.Key
+
+	// The contents from the cache, if it had them when the reader was created
+	// and they haven't since turned out to be beyond repair.
+	cached *filecache.Entry
+
+	// While the object is being read in order from the start, a writer for a
+	// new cache entry holding the bytes in [0, filled), created at the first
+	// read. filling is false once that has been given up on or finished.
+	//
+	// INVARIANT: fill == nil || filling
+	filling bool
+	fill    *filecache.Writer
+	filled  int64
+}
+
+func (rr *cachingRandomReader) CheckInvariants() {
+	rr.wrapped.CheckInvariants()
+
+	// INVARIANT: fill == nil || filling
+	if rr.fill != nil && !rr.filling {
+		panic("Unexpected cache writer after filling finished")
+	}
+}
+
+func (rr *cachingRandomReader) ReadAt(
+	ctx context.Context,
+	p []byte,
+	offset int64) (n int, err error) {
+	for rr.cached != nil {
+		n, err = rr.cached.ReadAt(p, offset)
+
+		var cbe *filecache.CorruptBlockError
+		if !errors.As(err, &cbe) {
+			return
+		}
+
+		// Repair the block and try again. Each block is repaired at most once,
+		// as it's checked only once it's been read successfully.
+		log.Printf(
+			"File cache: %q (generation %d): %v. Fetching it again.",
+			rr.key.Name,
+			rr.key.Generation,
+			cbe)
+
+		err = rr.repair(ctx, cbe)
+		if err != nil {
+			return
+		}
+	}
+
+	n, err = rr.wrapped.ReadAt(ctx, p, offset)
+	rr.observe(offset, p[:n])
+
+	return
+}
+
+func (rr *cachingRandomReader) Object() *gcs.Object {
+	return rr.wrapped.Object()
+}
+
+func (rr *cachingRandomReader) Checksums() *Checksums {
+	return rr.wrapped.Checksums()
+}
+
+func (rr *cachingRandomReader) Destroy() {
+	if rr.cached != nil {
+		rr.cached.Close()
+	}
+
+	rr.stopFilling()
+	rr.wrapped.Destroy()
+}
+
+// Fetch the supplied corrupt block of the cached contents from GCS and
+// repair it in the cache. If it can't be repaired, drop the entry and read
+// from GCS from now on.
+func (rr *cachingRandomReader) repair(
+	ctx context.Context,
+	cbe *filecache.CorruptBlockError) (err error) {
+	b := make([]byte, cbe.Length)
+	n, err := rr.wrapped.ReadAt(ctx, b, cbe.Offset)
+	if err == io.EOF && n == len(b) {
+		err = nil
+	}
+
+	if err != nil {
+		return
+	}
+
+	err = rr.cached.Repair(cbe.Offset, b)
+	if err != nil {
+		log.Printf("File cache: dropping %q: %v", rr.key.Name, err)
+		err = nil
+
+		rr.cache.Remove(rr.key)
+		rr.cached.Close()
+		rr.cached = nil
+	}
+
+	return
+}
+
+// Give up on adding to the cache.
+func (rr *cachingRandomReader) stopFilling() {
+	if rr.fill != nil {
+		rr.fill.Abort()
+		rr.fill = nil
+	}
+
+	rr.filling = false
+}
+
+// Write the supplied bytes, read from the given offset, to the new cache
+// entry if they continue the in-order read of the object, or give up on it if
+// they leave a gap. Commit the entry once the whole object has been read.
+func (rr *cachingRandomReader) observe(offset int64, p []byte) {
+	if !rr.filling {
+		return
+	}
+
+	switch {
+	// Re-reads of data we've already seen don't matter.
+	case offset+int64(len(p)) <= rr.filled:
+		return
+
+	case offset > rr.filled:
+		rr.stopFilling()
+		return
+	}
+
+	// Start the entry, if this is the first read.
+	size := int64(rr.Object().Size)
+	if rr.fill == nil {
+		var err error
+		rr.fill, err = rr.cache.NewWriter(rr.key, size)
+		if err != nil {
+			log.Printf("File cache: %v", err)
+		}
+
+		// The object may be too large for the cache.
+		if rr.fill == nil {
+			rr.stopFilling()
+			return
+		}
+	}
+
+	if _, err := rr.fill.Write(p[rr.filled-offset:]); err != nil {
+		log.Printf("File cache: %v", err)
+		rr.stopFilling()
+		return
+	}
+
+	rr.filled = offset + int64(len(p))
+	if rr.filled < size {
+		return
+	}
+
+	// Add the entry only if what we read is what GCS has.
+	cs := rr.wrapped.Checksums()
+	if cs == nil || !cs.Matched {
+		rr.stopFilling()
+		return
+	}
+
+	if err := rr.fill.Commit(); err != nil {
+		log.Printf("File cache: Commit: %v", err)
+	}
+
+	rr.fill = nil
+	rr.filling = false
+}
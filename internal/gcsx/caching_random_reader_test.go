@@ -0,0 +1,224 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/filecache"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestCachingRandomReader(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const cachingReaderContents = "tacoburritoenchilada"
+
+type CachingRandomReaderTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket gcs.Bucket
+	dir    string
+	cache  *filecache.Cache
+
+	object *gcs.Object
+}
+
+var _ SetUpInterface = &CachingRandomReaderTest{}
+var _ TearDownInterface = &CachingRandomReaderTest{}
+
+func init() { RegisterTestSuite(&CachingRandomReaderTest{}) }
+
+func (t *CachingRandomReaderTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	t.dir, err = ioutil.TempDir("", "caching_random_reader_test")
+	AssertEq(nil, err)
+
+	t.cache, err = filecache.New(
+		t.dir,
+		"",
+		filecache.Limits{MaxSize: 1 << 20},
+		&t.clock)
+
+	AssertEq(nil, err)
+
+	t.object, err = gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		"foo",
+		[]byte(cachingReaderContents))
+
+	AssertEq(nil, err)
+}
+
+func (t *CachingRandomReaderTest) TearDown() {
+	err := os.RemoveAll(t.dir)
+	AssertEq(nil, err)
+}
+
+func (t *CachingRandomReaderTest) newReader() RandomReader {
+	rr, err := NewRandomReader(t.object, t.bucket, ReadAhead{})
+	AssertEq(nil, err)
+
+	return NewCachingRandomReader(rr, t.cache, t.bucket.Name())
+}
+
+// Read the supplied range through the reader.
+func (t *CachingRandomReaderTest) read(
+	rr RandomReader,
+	offset int64,
+	size int) string {
+	buf := make([]byte, size)
+	n, err := rr.ReadAt(t.ctx, buf, offset)
+	AssertEq(nil, err)
+
+	rr.CheckInvariants()
+	return string(buf[:n])
+}
+
+// Delete the object from the bucket, so that only the cache can serve it.
+func (t *CachingRandomReaderTest) deleteObject() {
+	err := t.bucket.DeleteObject(
+		t.ctx,
+		&gcs.DeleteObjectRequest{Name: t.object.Name})
+
+	AssertEq(nil, err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *CachingRandomReaderTest) FullReadFillsCache() {
+	rr := t.newReader()
+	ExpectEq("tacoburrito", t.read(rr, 0, 11))
+	ExpectEq(0, t.cache.Size())
+
+	ExpectEq("enchilada", t.read(rr, 11, 9))
+	rr.Destroy()
+
+	ExpectEq(len(cachingReaderContents), t.cache.Size())
+
+	// A new reader is served from the cache.
+	t.deleteObject()
+
+	rr = t.newReader()
+	defer rr.Destroy()
+
+	ExpectEq("burrito", t.read(rr, 4, 7))
+	ExpectEq(cachingReaderContents, t.read(rr, 0, len(cachingReaderContents)))
+}
+
+func (t *CachingRandomReaderTest) RereadsDontMatter() {
+	rr := t.newReader()
+	ExpectEq("tacoburrito", t.read(rr, 0, 11))
+	ExpectEq("burrito", t.read(rr, 4, 7))
+	ExpectEq("enchilada", t.read(rr, 11, 9))
+	rr.Destroy()
+
+	ExpectEq(len(cachingReaderContents), t.cache.Size())
+}
+
+func (t *CachingRandomReaderTest) PartialReadDoesntFillCache() {
+	rr := t.newReader()
+	ExpectEq("tacoburrito", t.read(rr, 0, 11))
+	rr.Destroy()
+
+	ExpectEq(0, t.cache.Size())
+
+	// Nothing is left behind.
+	entries, err := ioutil.ReadDir(t.dir)
+	AssertEq(nil, err)
+	ExpectEq(0, len(entries))
+}
+
+func (t *CachingRandomReaderTest) OutOfOrderReadDoesntFillCache() {
+	rr := t.newReader()
+	ExpectEq("burrito", t.read(rr, 4, 7))
+	ExpectEq("taco", t.read(rr, 0, 4))
+	ExpectEq("enchilada", t.read(rr, 11, 9))
+	rr.Destroy()
+
+	ExpectEq(0, t.cache.Size())
+}
+
+func (t *CachingRandomReaderTest) OtherGenerationNotServed() {
+	rr := t.newReader()
+	t.read(rr, 0, len(cachingReaderContents))
+	rr.Destroy()
+
+	// Overwrite the object. The new generation must come from GCS.
+	var err error
+	t.object, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("queso"))
+	AssertEq(nil, err)
+
+	rr = t.newReader()
+	defer rr.Destroy()
+
+	ExpectEq("queso", t.read(rr, 0, 5))
+}
+
+func (t *CachingRandomReaderTest) CorruptEntryRepaired() {
+	rr := t.newReader()
+	t.read(rr, 0, len(cachingReaderContents))
+	rr.Destroy()
+
+	// Corrupt the entry on disk.
+	matches, err := filepath.Glob(path.Join(t.dir, "*"))
+	AssertEq(nil, err)
+
+	corrupted := 0
+	for _, m := range matches {
+		if filepath.Ext(m) == "" {
+			err = ioutil.WriteFile(m, []byte("TACOBURRITOENCHILADA"), 0600)
+			AssertEq(nil, err)
+			corrupted++
+		}
+	}
+
+	AssertEq(1, corrupted)
+
+	// The block is fetched from GCS again and repaired.
+	rr = t.newReader()
+	ExpectEq("burrito", t.read(rr, 4, 7))
+	rr.Destroy()
+
+	ExpectEq(len(cachingReaderContents), t.cache.Size())
+
+	t.deleteObject()
+
+	rr = t.newReader()
+	defer rr.Destroy()
+
+	ExpectEq(cachingReaderContents, t.read(rr, 0, len(cachingReaderContents)))
+}
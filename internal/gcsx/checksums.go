@@ -0,0 +1,84 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"crypto/md5"
+	"fmt"
+	"hash"
+	"hash/crc32"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+)
+
+// Checksums records the checksums of an object's contents as computed by
+// gcsfuse while reading or writing them in full, and whether they matched the
+// checksums reported by GCS for the object.
+type Checksums struct {
+	// The generation of the object to which the checksums apply.
+	Generation int64
+
+	CRC32C uint32
+	MD5    [md5.Size]byte
+
+	// True if CRC32C matches the object's, and so does MD5 if GCS reports one
+	// (it doesn't for composite objects).
+	Matched bool
+}
+
+// String returns the format in which checksums are exposed to the user, e.g.
+// "crc32c=e3069283 md5=9e107d9d372bb6826bd81d3542a419d6 matched=true".
+func (c *Checksums) String() string {
+	return fmt.Sprintf(
+		"crc32c=%08x md5=%x matched=%v",
+		c.CRC32C,
+		c.MD5,
+		c.Matched)
+}
+
+// An io.Writer that accumulates checksums of the data written to it.
+type checksummer struct {
+	crc32c hash.Hash32
+	md5    hash.Hash
+}
+
+func newChecksummer() *checksummer {
+	return &checksummer{
+		crc32c: crc32.New(crc32.MakeTable(crc32.Castagnoli)),
+		md5:    md5.New(),
+	}
+}
+
+func (c *checksummer) Write(p []byte) (n int, err error) {
+	c.crc32c.Write(p)
+	c.md5.Write(p)
+
+	n = len(p)
+	return
+}
+
+// Return the checksums accumulated so far, compared against those of the
+// supplied object.
+func (c *checksummer) verify(o *gcs.Object) (cs *Checksums) {
+	cs = &Checksums{
+		Generation: o.Generation,
+		CRC32C:     c.crc32c.Sum32(),
+	}
+
+	copy(cs.MD5[:], c.md5.Sum(nil))
+
+	cs.Matched = cs.CRC32C == o.CRC32C && (o.MD5 == nil || cs.MD5 == *o.MD5)
+	return
+}
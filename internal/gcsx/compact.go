@@ -0,0 +1,107 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// CompactObject rewrites the supplied generation of a composite object as an
+// ordinary object with a single component and the same contents and
+// metadata, by reading it and uploading it again. This resets its component
+// count, so that later appends can be composed onto it, and lets GCS compute
+// an MD5 for it.
+//
+// The new generation is created only if the supplied one is still current, so
+// a *gcs.PreconditionError is returned if it has been overwritten, and only
+// if the contents read have the supplied generation's CRC32C. If the object
+// has no mtime in its metadata, its update time is recorded as one, so that
+// file systems don't see its mtime change.
+func CompactObject(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	o *gcs.Object) (newObj *gcs.Object, err error) {
+	// Read the generation we were given.
+	rc, err := bucket.NewReader(
+		ctx,
+		&gcs.ReadObjectRequest{
+			Name:       o.Name,
+			Generation: o.Generation,
+		})
+
+	// A not found error means the generation has been overwritten or deleted.
+	switch err.(type) {
+	case nil:
+
+	case *gcs.NotFoundError:
+		err = &gcs.PreconditionError{
+			Err: fmt.Errorf(
+				"Synthesized precondition error for NewReader. Original: %v",
+				err),
+		}
+		return
+
+	default:
+		err = fmt.Errorf("NewReader: %w", err)
+		return
+	}
+
+	defer rc.Close()
+
+	// Preserve the metadata, including the mtime that file systems see.
+	metadata := make(map[string]string)
+	for k, v := range o.Metadata {
+		metadata[k] = v
+	}
+
+	_, hasMtime := metadata[MtimeMetadataKey]
+	_, hasGsutilMtime := metadata["goog-reserved-file-mtime"]
+	if !hasMtime && !hasGsutilMtime {
+		metadata[MtimeMetadataKey] = o.Updated.UTC().Format(time.RFC3339Nano)
+	}
+
+	// Upload it again over itself.
+	crc32c := o.CRC32C
+	newObj, err = bucket.CreateObject(
+		ctx,
+		&gcs.CreateObjectRequest{
+			Name:                       o.Name,
+			ContentType:                o.ContentType,
+			ContentLanguage:            o.ContentLanguage,
+			ContentEncoding:            o.ContentEncoding,
+			CacheControl:               o.CacheControl,
+			Metadata:                   metadata,
+			Contents:                   rc,
+			CRC32C:                     &crc32c,
+			GenerationPrecondition:     &o.Generation,
+			MetaGenerationPrecondition: &o.MetaGeneration,
+		})
+
+	// Don't mangle precondition errors.
+	if _, ok := err.(*gcs.PreconditionError); ok {
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("CreateObject: %w", err)
+		return
+	}
+
+	return
+}
@@ -0,0 +1,144 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestCompact(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type CompactTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket gcs.Bucket
+
+	// A composite object with three components.
+	composite *gcs.Object
+}
+
+var _ SetUpInterface = &CompactTest{}
+
+func init() { RegisterTestSuite(&CompactTest{}) }
+
+func (t *CompactTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.UTC))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	err = gcsutil.CreateObjects(
+		t.ctx,
+		t.bucket,
+		map[string][]byte{
+			"a": []byte("taco"),
+			"b": []byte("burrito"),
+		})
+
+	AssertEq(nil, err)
+
+	t.composite, err = t.bucket.ComposeObjects(
+		t.ctx,
+		&gcs.ComposeObjectsRequest{
+			DstName: "foo",
+			Sources: []gcs.ComposeSource{
+				gcs.ComposeSource{Name: "a"},
+				gcs.ComposeSource{Name: "b"},
+				gcs.ComposeSource{Name: "a"},
+			},
+			ContentType: "text/plain",
+			Metadata: map[string]string{
+				"owner": "enchilada",
+			},
+		})
+
+	AssertEq(nil, err)
+	AssertEq(3, t.composite.ComponentCount)
+
+	t.clock.AdvanceTime(time.Hour)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *CompactTest) RewritesAsSingleComponent() {
+	o, err := CompactObject(t.ctx, t.bucket, t.composite)
+	AssertEq(nil, err)
+
+	ExpectEq("foo", o.Name)
+	ExpectEq(1, o.ComponentCount)
+	ExpectGt(o.Generation, t.composite.Generation)
+	ExpectEq(t.composite.CRC32C, o.CRC32C)
+	ExpectEq("text/plain", o.ContentType)
+	ExpectEq("enchilada", o.Metadata["owner"])
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("tacoburritotaco", string(contents))
+}
+
+func (t *CompactTest) RecordsUpdateTimeAsMtime() {
+	o, err := CompactObject(t.ctx, t.bucket, t.composite)
+	AssertEq(nil, err)
+
+	ExpectEq(
+		t.composite.Updated.Format(time.RFC3339Nano),
+		o.Metadata[MtimeMetadataKey])
+}
+
+func (t *CompactTest) PreservesExistingMtime() {
+	mtime := "2012-08-15T22:56:00Z"
+	o, err := t.bucket.UpdateObject(
+		t.ctx,
+		&gcs.UpdateObjectRequest{
+			Name:     "foo",
+			Metadata: map[string]*string{MtimeMetadataKey: &mtime},
+		})
+
+	AssertEq(nil, err)
+
+	o, err = CompactObject(t.ctx, t.bucket, o)
+	AssertEq(nil, err)
+	ExpectEq(mtime, o.Metadata[MtimeMetadataKey])
+}
+
+func (t *CompactTest) Clobbered() {
+	// Overwrite the object.
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("queso"))
+	AssertEq(nil, err)
+
+	// Compacting the old generation should fail without touching the new one.
+	_, err = CompactObject(t.ctx, t.bucket, t.composite)
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("queso", string(contents))
+}
@@ -0,0 +1,628 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fsutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/util/lrucache"
+	"golang.org/x/net/context"
+)
+
+// The metadata keys under which a compressing bucket records the size and
+// checksums of an object's contents before compression.
+const (
+	UncompressedSizeMetadataKey   = "gcsfuse_uncompressed_size"
+	UncompressedCRC32CMetadataKey = "gcsfuse_uncompressed_crc32c"
+	UncompressedMD5MetadataKey    = "gcsfuse_uncompressed_md5"
+)
+
+// The only compression algorithm supported, as it's the only content encoding
+// that GCS understands. See docs/semantics.md.
+const gzipAlgorithm = "gzip"
+
+// The number of object generations whose compression a compressing bucket
+// remembers.
+const compressionCacheCapacity = 10000
+
+// CompressionRule says that objects whose names end with Suffix are to be
+// compressed with Algorithm.
+type CompressionRule struct {
+	Suffix    string
+	Algorithm string
+}
+
+// ParseCompressionRules parses a comma-separated list of rules of the form
+// SUFFIX or SUFFIX=ALGORITHM, e.g. ".log,.csv=gzip". The algorithm defaults
+// to gzip, which is the only one supported.
+func ParseCompressionRules(s string) (rules []CompressionRule, err error) {
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		r := CompressionRule{
+			Suffix:    entry,
+			Algorithm: gzipAlgorithm,
+		}
+
+		if i := strings.Index(entry, "="); i >= 0 {
+			r.Suffix = entry[:i]
+			r.Algorithm = entry[i+1:]
+		}
+
+		if r.Suffix == "" {
+			err = fmt.Errorf("Empty suffix in compression rule %q", entry)
+			return
+		}
+
+		if r.Algorithm != gzipAlgorithm {
+			err = fmt.Errorf(
+				"Unsupported compression algorithm %q for suffix %q; only gzip is "+
+					"available",
+				r.Algorithm,
+				r.Suffix)
+			return
+		}
+
+		rules = append(rules, r)
+	}
+
+	return
+}
+
+// NewCompressingBucket creates a bucket that compresses the contents of new
+// objects whose names match one of the supplied rules, and transparently
+// decompresses them again when they are read. Compressed objects are stored
+// with a Content-Encoding of gzip, and with "no-transform" cache control so
+// that GCS serves their bytes as stored rather than decompressing them
+// itself.
+//
+// Records for compressed objects returned by the bucket report the size and
+// checksums of the uncompressed contents, so that callers needn't know about
+// the compression at all. Compressed objects are recognized by their
+// metadata rather than their names, so they stay readable when renamed.
+//
+// Contents are compressed into an anonymous file in tempDir (or the system
+// default temporary directory if empty) before being uploaded, since the
+// uncompressed checksums must be known up front. Reading any range of a
+// compressed object downloads and decompresses it from the start. Composing
+// onto a compressed object, as the file system does when appending to large
+// files, is done by streaming its contents back through the bucket.
+func NewCompressingBucket(
+	rules []CompressionRule,
+	tempDir string,
+	wrapped gcs.Bucket) (b gcs.Bucket) {
+	b = &compressingBucket{
+		rules:      rules,
+		tempDir:    tempDir,
+		wrapped:    wrapped,
+		compressed: lrucache.New(compressionCacheCapacity),
+	}
+
+	return
+}
+
+type compressingBucket struct {
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	rules   []CompressionRule
+	tempDir string
+	wrapped gcs.Bucket
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// Whether each recently seen object generation is compressed, keyed by
+	// compressionCacheKey. Generations are immutable, so entries never go
+	// stale. This is how NewReader usually knows whether to decompress
+	// without statting the object first.
+	//
+	// GUARDED_BY(mu)
+	compressed lrucache.Cache
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Return true if new objects with the given name should be compressed.
+func (b *compressingBucket) shouldCompress(name string) bool {
+	for _, r := range b.rules {
+		if strings.HasSuffix(name, r.Suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func compressionCacheKey(name string, gen int64) string {
+	return fmt.Sprintf("%d/%s", gen, name)
+}
+
+// Record whether the given generation of the named object is compressed.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *compressingBucket) remember(name string, gen int64, compressed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.compressed.Insert(compressionCacheKey(name, gen), compressed)
+}
+
+// Find out whether the given generation of the named object, or its latest
+// generation if gen is zero, is compressed. Generations seen recently through
+// the bucket are answered from the cache; others are statted, falling back to
+// listing all generations of the name if the one requested is no longer
+// live. If the generation can't be found, it's reported uncompressed and
+// left to the wrapped bucket to fail the read.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *compressingBucket) isCompressed(
+	ctx context.Context,
+	name string,
+	gen int64) (actualGen int64, compressed bool, err error) {
+	if gen != 0 {
+		b.mu.Lock()
+		v := b.compressed.LookUp(compressionCacheKey(name, gen))
+		b.mu.Unlock()
+
+		if v != nil {
+			actualGen = gen
+			compressed = v.(bool)
+			return
+		}
+	}
+
+	o, err := b.wrapped.StatObject(ctx, &gcs.StatObjectRequest{Name: name})
+	if err != nil {
+		return
+	}
+
+	if gen == 0 || o.Generation == gen {
+		actualGen = o.Generation
+		compressed = b.uncompressedView(o) != o
+		return
+	}
+
+	actualGen = gen
+	req := &gcs.ListObjectsRequest{
+		Prefix:    name,
+		Versions:  true,
+		MatchGlob: gcs.QuoteGlob(name),
+	}
+
+	for {
+		var listing *gcs.Listing
+		listing, err = b.wrapped.ListObjects(ctx, req)
+		if err != nil {
+			err = fmt.Errorf("ListObjects: %v", err)
+			return
+		}
+
+		for _, o := range listing.Objects {
+			if o.Name == name && o.Generation == gen {
+				compressed = b.uncompressedView(o) != o
+				return
+			}
+		}
+
+		if listing.ContinuationToken == "" {
+			return
+		}
+
+		req.ContinuationToken = listing.ContinuationToken
+	}
+}
+
+// If the supplied object record is for a compressed object, return a copy
+// describing its uncompressed contents. Otherwise return it unmodified.
+// Either way, remember which it was.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *compressingBucket) uncompressedView(o *gcs.Object) *gcs.Object {
+	if o == nil {
+		return o
+	}
+
+	view := uncompressedRecord(o)
+	b.remember(o.Name, o.Generation, view != o)
+	return view
+}
+
+// Return a copy of the supplied record describing the uncompressed contents
+// if it is for an object compressed by a compressing bucket, or the record
+// itself otherwise.
+func uncompressedRecord(o *gcs.Object) *gcs.Object {
+	if o.ContentEncoding != gzipAlgorithm {
+		return o
+	}
+
+	size, err := strconv.ParseUint(o.Metadata[UncompressedSizeMetadataKey], 10, 64)
+	if err != nil {
+		return o
+	}
+
+	crc32c, err := strconv.ParseUint(
+		o.Metadata[UncompressedCRC32CMetadataKey],
+		16,
+		32)
+
+	if err != nil {
+		return o
+	}
+
+	view := *o
+	view.Size = size
+	view.CRC32C = uint32(crc32c)
+	view.MD5 = nil
+
+	sum, err := hex.DecodeString(o.Metadata[UncompressedMD5MetadataKey])
+	if err == nil && len(sum) == md5.Size {
+		view.MD5 = new([md5.Size]byte)
+		copy(view.MD5[:], sum)
+	}
+
+	return &view
+}
+
+// Compress the contents of the supplied request into an anonymous file in
+// the supplied directory, updating the request to create a compressed object
+// from it. The caller must close the file once the request is done with.
+func compressRequest(
+	req *gcs.CreateObjectRequest,
+	tempDir string) (f *os.File, err error) {
+	f, err = fsutil.AnonymousFile(tempDir)
+	if err != nil {
+		err = fmt.Errorf("AnonymousFile: %v", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			f.Close()
+			f = nil
+		}
+	}()
+
+	sum := newChecksummer()
+	zw := gzip.NewWriter(f)
+
+	n, err := io.Copy(io.MultiWriter(zw, sum), req.Contents)
+	if err != nil {
+		err = fmt.Errorf("Copy: %v", err)
+		return
+	}
+
+	err = zw.Close()
+	if err != nil {
+		err = fmt.Errorf("Close: %v", err)
+		return
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		err = fmt.Errorf("Seek: %v", err)
+		return
+	}
+
+	// GCS would check any checksums supplied against the compressed contents,
+	// so check them against the uncompressed contents ourselves.
+	cs := sum.verify(&gcs.Object{})
+	if req.CRC32C != nil && *req.CRC32C != cs.CRC32C {
+		err = fmt.Errorf(
+			"CRC32C mismatch: request has %08x, contents have %08x",
+			*req.CRC32C,
+			cs.CRC32C)
+		return
+	}
+
+	if req.MD5 != nil && *req.MD5 != cs.MD5 {
+		err = fmt.Errorf(
+			"MD5 mismatch: request has %x, contents have %x",
+			*req.MD5,
+			cs.MD5)
+		return
+	}
+
+	metadata := make(map[string]string)
+	for k, v := range req.Metadata {
+		metadata[k] = v
+	}
+
+	metadata[UncompressedSizeMetadataKey] = strconv.FormatInt(n, 10)
+	metadata[UncompressedCRC32CMetadataKey] = fmt.Sprintf("%08x", cs.CRC32C)
+	metadata[UncompressedMD5MetadataKey] = fmt.Sprintf("%x", cs.MD5)
+
+	req.Metadata = metadata
+	req.ContentEncoding = gzipAlgorithm
+	if req.CacheControl == "" {
+		req.CacheControl = "no-transform"
+	}
+
+	req.Contents = f
+	req.CRC32C = nil
+	req.MD5 = nil
+
+	return
+}
+
+// A reader for a range of the decompressed contents of an object.
+type decompressingReader struct {
+	io.Reader
+	zr      *gzip.Reader
+	wrapped io.ReadCloser
+}
+
+func (rc *decompressingReader) Close() (err error) {
+	rc.zr.Close()
+	err = rc.wrapped.Close()
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Bucket interface
+////////////////////////////////////////////////////////////////////////
+
+func (b *compressingBucket) Name() string {
+	return b.wrapped.Name()
+}
+
+func (b *compressingBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	// Callers normally name the generation they got from a record returned
+	// by this bucket, in which case we already know the answer. Reading the
+	// latest generation requires a stat.
+	gen, compressed, err := b.isCompressed(ctx, req.Name, req.Generation)
+	if err != nil {
+		return
+	}
+
+	if !compressed {
+		rc, err = b.wrapped.NewReader(ctx, req)
+		return
+	}
+
+	// Always ask for a range, even though we want the whole object, so that
+	// the HTTP transport doesn't decompress the contents for us.
+	wrapped, err := b.wrapped.NewReader(
+		ctx,
+		&gcs.ReadObjectRequest{
+			Name:       req.Name,
+			Generation: gen,
+			Range:      &gcs.ByteRange{Start: 0, Limit: math.MaxUint64},
+		})
+
+	if err != nil {
+		return
+	}
+
+	zr, err := gzip.NewReader(wrapped)
+	if err != nil {
+		wrapped.Close()
+		err = fmt.Errorf("gzip.NewReader: %v", err)
+		return
+	}
+
+	var r io.Reader = zr
+	if req.Range != nil {
+		if req.Range.Limit <= req.Range.Start {
+			r = bytes.NewReader(nil)
+		} else {
+			_, err = io.CopyN(ioutil.Discard, zr, int64(req.Range.Start))
+			if err == io.EOF {
+				err = nil
+			}
+
+			if err != nil {
+				zr.Close()
+				wrapped.Close()
+				err = fmt.Errorf("Skipping to %d: %v", req.Range.Start, err)
+				return
+			}
+
+			if req.Range.Limit-req.Range.Start < math.MaxInt64 {
+				r = io.LimitReader(zr, int64(req.Range.Limit-req.Range.Start))
+			}
+		}
+	}
+
+	rc = &decompressingReader{
+		Reader:  r,
+		zr:      zr,
+		wrapped: wrapped,
+	}
+
+	return
+}
+
+func (b *compressingBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	// Leave alone objects already encoded by the caller.
+	if b.shouldCompress(req.Name) && req.ContentEncoding == "" {
+		reqCopy := *req
+		req = &reqCopy
+
+		var f *os.File
+		f, err = compressRequest(req, b.tempDir)
+		if err != nil {
+			err = fmt.Errorf("Compressing %q: %v", req.Name, err)
+			return
+		}
+
+		defer f.Close()
+	}
+
+	o, err = b.wrapped.CreateObject(ctx, req)
+	o = b.uncompressedView(o)
+	return
+}
+
+func (b *compressingBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.CopyObject(ctx, req)
+	o = b.uncompressedView(o)
+	return
+}
+
+func (b *compressingBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	// GCS can only concatenate the stored bytes, so unless no compression is
+	// involved, do the composition ourselves.
+	//
+	// Errors about the sources are returned unwrapped, as they would be from
+	// GCS, so that callers can recognize e.g. a source that has gone away.
+	rewrite := b.shouldCompress(req.DstName)
+	for _, src := range req.Sources {
+		var compressed bool
+		_, compressed, err = b.isCompressed(ctx, src.Name, src.Generation)
+		if err != nil {
+			return
+		}
+
+		if compressed {
+			rewrite = true
+		}
+	}
+
+	if !rewrite {
+		o, err = b.wrapped.ComposeObjects(ctx, req)
+		o = b.uncompressedView(o)
+		return
+	}
+
+	// Stream the sources into the new object.
+	pr, pw := io.Pipe()
+	copyErr := make(chan error, 1)
+	go func() {
+		err := b.copySources(ctx, req.Sources, pw)
+		pw.CloseWithError(err)
+		copyErr <- err
+	}()
+
+	o, err = b.CreateObject(
+		ctx,
+		&gcs.CreateObjectRequest{
+			Name:                       req.DstName,
+			ContentType:                req.ContentType,
+			Metadata:                   req.Metadata,
+			Contents:                   pr,
+			GenerationPrecondition:     req.DstGenerationPrecondition,
+			MetaGenerationPrecondition: req.DstMetaGenerationPrecondition,
+		})
+
+	// Unblock the copy if the upload gave up early. Then prefer its error, so
+	// that e.g. a missing source is reported as such, unless the copy failed
+	// only because the upload had given up.
+	pr.Close()
+	if srcErr := <-copyErr; srcErr != nil && !errors.Is(srcErr, io.ErrClosedPipe) {
+		o = nil
+		err = srcErr
+	}
+
+	return
+}
+
+// Write the decompressed contents of the supplied sources to w in order.
+func (b *compressingBucket) copySources(
+	ctx context.Context,
+	sources []gcs.ComposeSource,
+	w io.Writer) (err error) {
+	for _, src := range sources {
+		var rc io.ReadCloser
+		rc, err = b.NewReader(
+			ctx,
+			&gcs.ReadObjectRequest{
+				Name:       src.Name,
+				Generation: src.Generation,
+			})
+
+		if err != nil {
+			return
+		}
+
+		_, err = io.Copy(w, rc)
+		rc.Close()
+		if err != nil {
+			err = fmt.Errorf("Reading %q: %w", src.Name, err)
+			return
+		}
+	}
+
+	return
+}
+
+func (b *compressingBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.StatObject(ctx, req)
+	o = b.uncompressedView(o)
+	return
+}
+
+func (b *compressingBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	listing, err = b.wrapped.ListObjects(ctx, req)
+	if err != nil {
+		return
+	}
+
+	for i, o := range listing.Objects {
+		listing.Objects[i] = b.uncompressedView(o)
+	}
+
+	return
+}
+
+func (b *compressingBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.UpdateObject(ctx, req)
+	o = b.uncompressedView(o)
+	return
+}
+
+func (b *compressingBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	err = b.wrapped.DeleteObject(ctx, req)
+	return
+}
@@ -0,0 +1,467 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"hash/crc32"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestCompressingBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Contents that compress well.
+var compressibleContents = strings.Repeat("GET /index.html 200\n", 1000)
+
+// A bucket that counts the stats made through it.
+type statCountingBucket struct {
+	gcs.Bucket
+	stats int
+}
+
+func (b *statCountingBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	b.stats++
+	o, err = b.Bucket.StatObject(ctx, req)
+	return
+}
+
+type CompressingBucketTest struct {
+	ctx      context.Context
+	clock    timeutil.SimulatedClock
+	wrapped  gcs.Bucket
+	counting *statCountingBucket
+	bucket   gcs.Bucket
+}
+
+var _ SetUpInterface = &CompressingBucketTest{}
+
+func init() { RegisterTestSuite(&CompressingBucketTest{}) }
+
+func (t *CompressingBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.wrapped = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	rules, err := gcsx.ParseCompressionRules(".log")
+	AssertEq(nil, err)
+
+	t.counting = &statCountingBucket{Bucket: t.wrapped}
+	t.bucket = gcsx.NewCompressingBucket(rules, "", t.counting)
+}
+
+// Create a compressed object through a different compressing bucket, so that
+// the one under test hasn't seen it.
+func (t *CompressingBucketTest) createElsewhere(
+	name string,
+	contents string) (o *gcs.Object, err error) {
+	rules, err := gcsx.ParseCompressionRules(".log")
+	if err != nil {
+		return
+	}
+
+	o, err = gcsutil.CreateObject(
+		t.ctx,
+		gcsx.NewCompressingBucket(rules, "", t.wrapped),
+		name,
+		[]byte(contents))
+
+	return
+}
+
+func (t *CompressingBucketTest) read(
+	name string,
+	gen int64,
+	br *gcs.ByteRange) (contents string, err error) {
+	rc, err := t.bucket.NewReader(
+		t.ctx,
+		&gcs.ReadObjectRequest{
+			Name:       name,
+			Generation: gen,
+			Range:      br,
+		})
+
+	if err != nil {
+		return
+	}
+
+	defer rc.Close()
+
+	b, err := ioutil.ReadAll(rc)
+	contents = string(b)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *CompressingBucketTest) ParseRules() {
+	rules, err := gcsx.ParseCompressionRules(".log, .csv=gzip")
+	AssertEq(nil, err)
+	ExpectThat(
+		rules,
+		DeepEquals([]gcsx.CompressionRule{
+			{Suffix: ".log", Algorithm: "gzip"},
+			{Suffix: ".csv", Algorithm: "gzip"},
+		}))
+
+	_, err = gcsx.ParseCompressionRules(".log=zstd")
+	ExpectThat(err, Error(HasSubstr("only gzip")))
+
+	_, err = gcsx.ParseCompressionRules("=gzip")
+	ExpectThat(err, Error(HasSubstr("Empty suffix")))
+}
+
+func (t *CompressingBucketTest) CreateStoresCompressed() {
+	o, err := gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		"foo.log",
+		[]byte(compressibleContents))
+
+	AssertEq(nil, err)
+
+	// The caller sees the uncompressed contents.
+	ExpectEq(len(compressibleContents), o.Size)
+	ExpectEq(
+		crc32.Checksum(
+			[]byte(compressibleContents),
+			crc32.MakeTable(crc32.Castagnoli)),
+		o.CRC32C)
+
+	// GCS has the compressed contents.
+	raw, err := t.wrapped.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "foo.log"})
+
+	AssertEq(nil, err)
+	ExpectEq("gzip", raw.ContentEncoding)
+	ExpectEq("no-transform", raw.CacheControl)
+	ExpectLt(raw.Size, len(compressibleContents))
+
+	stored, err := gcsutil.ReadObject(t.ctx, t.wrapped, "foo.log")
+	AssertEq(nil, err)
+
+	zr, err := gzip.NewReader(bytes.NewReader(stored))
+	AssertEq(nil, err)
+
+	decompressed, err := ioutil.ReadAll(zr)
+	AssertEq(nil, err)
+	ExpectEq(compressibleContents, string(decompressed))
+}
+
+func (t *CompressingBucketTest) OtherNamesNotCompressed() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo.txt", []byte("taco"))
+	AssertEq(nil, err)
+
+	raw, err := t.wrapped.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "foo.txt"})
+
+	AssertEq(nil, err)
+	ExpectEq("", raw.ContentEncoding)
+	ExpectEq(4, raw.Size)
+}
+
+func (t *CompressingBucketTest) StatAndListReportUncompressedSize() {
+	_, err := gcsutil.CreateObject(
+		t.ctx,
+		t.wrapped,
+		"unused",
+		[]byte(""))
+
+	AssertEq(nil, err)
+
+	// Create through a different bucket, so that this one learns about the
+	// object only through stats and listings.
+	_, err = t.createElsewhere("foo.log", compressibleContents)
+	AssertEq(nil, err)
+
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo.log"})
+	AssertEq(nil, err)
+	ExpectEq(len(compressibleContents), o.Size)
+
+	listing, err := t.bucket.ListObjects(t.ctx, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+	AssertEq(2, len(listing.Objects))
+	ExpectEq("foo.log", listing.Objects[0].Name)
+	ExpectEq(len(compressibleContents), listing.Objects[0].Size)
+}
+
+func (t *CompressingBucketTest) ReadWholeObject() {
+	o, err := gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		"foo.log",
+		[]byte(compressibleContents))
+
+	AssertEq(nil, err)
+
+	contents, err := t.read("foo.log", o.Generation, nil)
+	AssertEq(nil, err)
+	ExpectEq(compressibleContents, contents)
+
+	// The latest generation too.
+	contents, err = t.read("foo.log", 0, nil)
+	AssertEq(nil, err)
+	ExpectEq(compressibleContents, contents)
+}
+
+func (t *CompressingBucketTest) ReadRanges() {
+	o, err := gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		"foo.log",
+		[]byte(compressibleContents))
+
+	AssertEq(nil, err)
+
+	n := uint64(len(compressibleContents))
+	testCases := []gcs.ByteRange{
+		{Start: 0, Limit: 10},
+		{Start: 25, Limit: 1017},
+		{Start: n - 5, Limit: n + 100},
+		{Start: n + 1, Limit: n + 100},
+		{Start: 17, Limit: 17},
+	}
+
+	for _, br := range testCases {
+		expected := ""
+		if br.Start < n && br.Limit > br.Start {
+			limit := br.Limit
+			if limit > n {
+				limit = n
+			}
+
+			expected = compressibleContents[br.Start:limit]
+		}
+
+		contents, err := t.read("foo.log", o.Generation, &br)
+		AssertEq(nil, err, "Range: %v", br)
+		ExpectEq(expected, contents, "Range: %v", br)
+	}
+}
+
+func (t *CompressingBucketTest) RenamedObjectStillDecompressed() {
+	o, err := gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		"foo.log",
+		[]byte(compressibleContents))
+
+	AssertEq(nil, err)
+
+	o, err = t.bucket.CopyObject(
+		t.ctx,
+		&gcs.CopyObjectRequest{
+			SrcName:       "foo.log",
+			SrcGeneration: o.Generation,
+			DstName:       "bar.txt",
+		})
+
+	AssertEq(nil, err)
+	ExpectEq(len(compressibleContents), o.Size)
+
+	contents, err := t.read("bar.txt", o.Generation, nil)
+	AssertEq(nil, err)
+	ExpectEq(compressibleContents, contents)
+}
+
+func (t *CompressingBucketTest) ComposeOntoCompressedObject() {
+	src, err := gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		"foo.log",
+		[]byte(compressibleContents))
+
+	AssertEq(nil, err)
+
+	tmp, err := gcsutil.CreateObject(t.ctx, t.bucket, "tmp", []byte("taco"))
+	AssertEq(nil, err)
+
+	o, err := t.bucket.ComposeObjects(
+		t.ctx,
+		&gcs.ComposeObjectsRequest{
+			DstName:                   "foo.log",
+			DstGenerationPrecondition: &src.Generation,
+			Sources: []gcs.ComposeSource{
+				{Name: "foo.log", Generation: src.Generation},
+				{Name: "tmp", Generation: tmp.Generation},
+			},
+		})
+
+	AssertEq(nil, err)
+	ExpectEq(len(compressibleContents)+4, o.Size)
+
+	contents, err := t.read("foo.log", o.Generation, nil)
+	AssertEq(nil, err)
+	ExpectEq(compressibleContents+"taco", contents)
+
+	raw, err := t.wrapped.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "foo.log"})
+
+	AssertEq(nil, err)
+	ExpectEq("gzip", raw.ContentEncoding)
+}
+
+func (t *CompressingBucketTest) CreateChecksumsCheckedBeforeCompression() {
+	crc32c := crc32.Checksum(
+		[]byte(compressibleContents),
+		crc32.MakeTable(crc32.Castagnoli))
+
+	_, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:     "foo.log",
+			Contents: strings.NewReader(compressibleContents),
+			CRC32C:   &crc32c,
+		})
+
+	AssertEq(nil, err)
+
+	crc32c++
+	_, err = t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:     "bar.log",
+			Contents: strings.NewReader(compressibleContents),
+			CRC32C:   &crc32c,
+		})
+
+	ExpectThat(err, Error(HasSubstr("CRC32C mismatch")))
+}
+
+func (t *CompressingBucketTest) KnownGenerationsReadWithoutStatting() {
+	compressed, err := gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		"foo.log",
+		[]byte(compressibleContents))
+
+	AssertEq(nil, err)
+
+	plain, err := gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		"foo.txt",
+		[]byte("taco"))
+
+	AssertEq(nil, err)
+
+	contents, err := t.read("foo.log", compressed.Generation, nil)
+	AssertEq(nil, err)
+	ExpectEq(compressibleContents, contents)
+
+	contents, err = t.read("foo.txt", plain.Generation, nil)
+	AssertEq(nil, err)
+	ExpectEq("taco", contents)
+
+	ExpectEq(0, t.counting.stats)
+}
+
+func (t *CompressingBucketTest) UnseenGenerationStattedOnce() {
+	o, err := t.createElsewhere("foo.log", compressibleContents)
+	AssertEq(nil, err)
+
+	for i := 0; i < 2; i++ {
+		contents, err := t.read("foo.log", o.Generation, nil)
+		AssertEq(nil, err)
+		ExpectEq(compressibleContents, contents)
+	}
+
+	ExpectEq(1, t.counting.stats)
+}
+
+func (t *CompressingBucketTest) ComposeUnseenCompressedSource() {
+	src, err := t.createElsewhere("foo.log", compressibleContents)
+	AssertEq(nil, err)
+
+	tmp, err := gcsutil.CreateObject(t.ctx, t.wrapped, "tmp", []byte("taco"))
+	AssertEq(nil, err)
+
+	// The source must be decompressed even though this bucket hasn't seen it,
+	// and the destination isn't compressed.
+	o, err := t.bucket.ComposeObjects(
+		t.ctx,
+		&gcs.ComposeObjectsRequest{
+			DstName: "bar.txt",
+			Sources: []gcs.ComposeSource{
+				{Name: "foo.log", Generation: src.Generation},
+				{Name: "tmp", Generation: tmp.Generation},
+			},
+		})
+
+	AssertEq(nil, err)
+	ExpectEq(len(compressibleContents)+4, o.Size)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.wrapped, "bar.txt")
+	AssertEq(nil, err)
+	ExpectEq(compressibleContents+"taco", string(contents))
+}
+
+func (t *CompressingBucketTest) ComposeMissingSource() {
+	src, err := gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		"foo.log",
+		[]byte(compressibleContents))
+
+	AssertEq(nil, err)
+
+	tmp, err := gcsutil.CreateObject(t.ctx, t.bucket, "tmp", []byte("taco"))
+	AssertEq(nil, err)
+
+	err = t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "tmp"})
+	AssertEq(nil, err)
+
+	_, err = t.bucket.ComposeObjects(
+		t.ctx,
+		&gcs.ComposeObjectsRequest{
+			DstName:                   "foo.log",
+			DstGenerationPrecondition: &src.Generation,
+			Sources: []gcs.ComposeSource{
+				{Name: "foo.log", Generation: src.Generation},
+				{Name: "tmp", Generation: tmp.Generation},
+			},
+		})
+
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	// The destination is untouched.
+	contents, err := t.read("foo.log", 0, nil)
+	AssertEq(nil, err)
+	ExpectEq(compressibleContents, contents)
+}
@@ -0,0 +1,509 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// The number of times a DeferredDeleteBucket tries to delete an object before
+// giving up.
+const deferredDeleteAttempts = 5
+
+// The most deletes a DeferredDeleteBucket queues before DeleteObject waits
+// for the workers to catch up.
+const maxQueuedDeletes = 10000
+
+// DeferredDeleteBucket is a bucket whose unconditional deletes return
+// straight away, leaving behind a tombstone for the object, and are carried
+// out in the background by a fixed number of workers, each retried a few
+// times with exponential backoff. This keeps e.g. `rm -rf` from being bound
+// by the round trip latency of every delete.
+//
+// While an object has a tombstone, stats and reads of its latest generation
+// fail with *gcs.NotFoundError and listings leave it out, so that it appears
+// to be gone already. A tombstone for a name ending in a slash also hides the
+// collapsed run of the same name, and is kept until the deletes of everything
+// beneath it have finished, since GCS lists the run until then. Writes to a
+// name with a tombstone first wait for its delete to finish, and then drop
+// the tombstone.
+//
+// Deletes that fail every attempt are logged and their tombstones dropped, so
+// that the objects reappear, and reported by the next call to Flush.
+type DeferredDeleteBucket struct {
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	backoff time.Duration
+	wrapped gcs.Bucket
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// Signalled when deletes are queued or taken off the queue.
+	queueChanged sync.Cond
+
+	// Deletes waiting for a worker, in order.
+	//
+	// GUARDED_BY(mu)
+	queue []deferredDelete
+
+	// The tombstones of objects whose deletes haven't finished, or (for names
+	// ending in a slash) whose deletes have but of which something beneath
+	// still has a tombstone.
+	//
+	// GUARDED_BY(mu)
+	tombstones map[string]*tombstone
+
+	// For each prefix ending in a slash, the number of tombstones for names
+	// beneath it.
+	//
+	// INVARIANT: All values are positive
+	//
+	// GUARDED_BY(mu)
+	tombstonesBelow map[string]int
+
+	// The number of deletes queued or in progress, and a channel closed when
+	// it falls to zero.
+	//
+	// GUARDED_BY(mu)
+	outstanding int
+	idle        chan struct{}
+
+	// Deletes that have failed since the last call to Flush.
+	//
+	// GUARDED_BY(mu)
+	failures []error
+}
+
+var _ gcs.Bucket = &DeferredDeleteBucket{}
+
+// A delete waiting for a worker, with the context to make it with.
+type deferredDelete struct {
+	ctx  context.Context
+	name string
+}
+
+type tombstone struct {
+	// Closed once the delete has finished, successfully or not.
+	deleted chan struct{}
+
+	// Whether deleted has been closed.
+	//
+	// GUARDED_BY(DeferredDeleteBucket.mu)
+	finished bool
+}
+
+// NewDeferredDeleteBucket creates a bucket that carries out deletes with the
+// supplied number of workers, waiting backoff before the first retry of each
+// and twice as long before each further one.
+func NewDeferredDeleteBucket(
+	workers int,
+	backoff time.Duration,
+	wrapped gcs.Bucket) (b *DeferredDeleteBucket) {
+	b = &DeferredDeleteBucket{
+		backoff:         backoff,
+		wrapped:         wrapped,
+		tombstones:      make(map[string]*tombstone),
+		tombstonesBelow: make(map[string]int),
+		idle:            make(chan struct{}),
+	}
+
+	b.queueChanged.L = &b.mu
+	close(b.idle)
+
+	for i := 0; i < workers; i++ {
+		go b.work()
+	}
+
+	return
+}
+
+// Pending returns the number of deletes that have yet to finish.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *DeferredDeleteBucket) Pending() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.outstanding
+}
+
+// Flush waits until every delete made so far has finished, and returns an
+// error if any have failed since the last call.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *DeferredDeleteBucket) Flush(ctx context.Context) (err error) {
+	b.mu.Lock()
+	idle := b.idle
+	b.mu.Unlock()
+
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		err = ctx.Err()
+		return
+	}
+
+	b.mu.Lock()
+	failures := b.failures
+	b.failures = nil
+	b.mu.Unlock()
+
+	if len(failures) > 0 {
+		err = fmt.Errorf(
+			"%d deferred deletes failed, the first with: %v",
+			len(failures),
+			failures[0])
+		return
+	}
+
+	return
+}
+
+// Return the prefixes ending in a slash of the supplied name, shortest
+// first, not counting the name itself.
+func parentPrefixes(name string) (prefixes []string) {
+	for i := 0; i < len(name)-1; i++ {
+		if name[i] == '/' {
+			prefixes = append(prefixes, name[:i+1])
+		}
+	}
+
+	return
+}
+
+// LOCKS_REQUIRED(b.mu)
+func (b *DeferredDeleteBucket) hidden(name string) bool {
+	_, ok := b.tombstones[name]
+	return ok
+}
+
+// LOCKS_REQUIRED(b.mu)
+func (b *DeferredDeleteBucket) addTombstone(name string) {
+	b.tombstones[name] = &tombstone{deleted: make(chan struct{})}
+	for _, p := range parentPrefixes(name) {
+		b.tombstonesBelow[p]++
+	}
+}
+
+// Drop the tombstone for the supplied name, along with those of prefixes
+// above it that were kept only for its sake.
+//
+// LOCKS_REQUIRED(b.mu)
+func (b *DeferredDeleteBucket) dropTombstone(name string) {
+	delete(b.tombstones, name)
+
+	prefixes := parentPrefixes(name)
+	for i := len(prefixes) - 1; i >= 0; i-- {
+		p := prefixes[i]
+		b.tombstonesBelow[p]--
+		if b.tombstonesBelow[p] > 0 {
+			continue
+		}
+
+		delete(b.tombstonesBelow, p)
+		if t, ok := b.tombstones[p]; ok && t.finished {
+			b.dropTombstone(p)
+		}
+	}
+}
+
+// Record the outcome of the delete of the supplied name.
+//
+// LOCKS_REQUIRED(b.mu)
+func (b *DeferredDeleteBucket) finish(name string, err error) {
+	t := b.tombstones[name]
+	t.finished = true
+	close(t.deleted)
+
+	if err != nil {
+		b.failures = append(b.failures, err)
+	}
+
+	if err != nil || b.tombstonesBelow[name] == 0 {
+		b.dropTombstone(name)
+	}
+
+	b.outstanding--
+	if b.outstanding == 0 {
+		close(b.idle)
+	}
+}
+
+// Carry out queued deletes, forever.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *DeferredDeleteBucket) work() {
+	for {
+		b.mu.Lock()
+		for len(b.queue) == 0 {
+			b.queueChanged.Wait()
+		}
+
+		d := b.queue[0]
+		b.queue = b.queue[1:]
+		b.queueChanged.Broadcast()
+		b.mu.Unlock()
+
+		err := b.delete(d.ctx, d.name)
+
+		b.mu.Lock()
+		b.finish(d.name, err)
+		b.mu.Unlock()
+	}
+}
+
+// Delete the named object, retrying with backoff.
+func (b *DeferredDeleteBucket) delete(
+	ctx context.Context,
+	name string) (err error) {
+	delay := b.backoff
+	for i := 0; ; i++ {
+		err = b.wrapped.DeleteObject(ctx, &gcs.DeleteObjectRequest{Name: name})
+
+		// Special case: someone got there first.
+		if _, ok := err.(*gcs.NotFoundError); ok {
+			err = nil
+		}
+
+		if err == nil || i+1 == deferredDeleteAttempts {
+			break
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+
+	if err != nil {
+		log.Printf("Giving up deleting %q: %v", name, err)
+		err = fmt.Errorf("DeleteObject(%q): %v", name, err)
+		return
+	}
+
+	return
+}
+
+// If the supplied name has a tombstone, wait for its delete to finish and
+// drop the tombstone, so that an object written under the name is visible.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *DeferredDeleteBucket) clear(
+	ctx context.Context,
+	name string) (err error) {
+	b.mu.Lock()
+	t, ok := b.tombstones[name]
+	b.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	select {
+	case <-t.deleted:
+	case <-ctx.Done():
+		err = ctx.Err()
+		return
+	}
+
+	b.mu.Lock()
+	if b.tombstones[name] == t {
+		b.dropTombstone(name)
+	}
+	b.mu.Unlock()
+
+	return
+}
+
+// Return a *gcs.NotFoundError if the supplied name has a tombstone.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *DeferredDeleteBucket) check(name string) (err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.hidden(name) {
+		err = &gcs.NotFoundError{
+			Err: fmt.Errorf("%q is being deleted", name),
+		}
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// gcs.Bucket
+////////////////////////////////////////////////////////////////////////
+
+func (b *DeferredDeleteBucket) Name() string {
+	return b.wrapped.Name()
+}
+
+func (b *DeferredDeleteBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	// Specific generations can still be read until they are gone.
+	if req.Generation == 0 {
+		if err = b.check(req.Name); err != nil {
+			return
+		}
+	}
+
+	rc, err = b.wrapped.NewReader(ctx, req)
+	return
+}
+
+func (b *DeferredDeleteBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	if err = b.clear(ctx, req.Name); err != nil {
+		return
+	}
+
+	o, err = b.wrapped.CreateObject(ctx, req)
+	return
+}
+
+func (b *DeferredDeleteBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	if err = b.check(req.SrcName); err != nil {
+		return
+	}
+
+	if err = b.clear(ctx, req.DstName); err != nil {
+		return
+	}
+
+	o, err = b.wrapped.CopyObject(ctx, req)
+	return
+}
+
+func (b *DeferredDeleteBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	if err = b.clear(ctx, req.DstName); err != nil {
+		return
+	}
+
+	o, err = b.wrapped.ComposeObjects(ctx, req)
+	return
+}
+
+func (b *DeferredDeleteBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	if err = b.check(req.Name); err != nil {
+		return
+	}
+
+	o, err = b.wrapped.StatObject(ctx, req)
+	return
+}
+
+func (b *DeferredDeleteBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (l *gcs.Listing, err error) {
+	l, err = b.wrapped.ListObjects(ctx, req)
+	if err != nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Special case: nothing to hide.
+	if len(b.tombstones) == 0 {
+		return
+	}
+
+	objects := l.Objects[:0]
+	for _, o := range l.Objects {
+		if !b.hidden(o.Name) {
+			objects = append(objects, o)
+		}
+	}
+
+	runs := l.CollapsedRuns[:0]
+	for _, r := range l.CollapsedRuns {
+		if !b.hidden(r) {
+			runs = append(runs, r)
+		}
+	}
+
+	l.Objects = objects
+	l.CollapsedRuns = runs
+	return
+}
+
+func (b *DeferredDeleteBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	if err = b.check(req.Name); err != nil {
+		return
+	}
+
+	o, err = b.wrapped.UpdateObject(ctx, req)
+	return
+}
+
+// Special case: deletes of particular generations or with preconditions are
+// made straight away, since the caller cares whether they succeed.
+func (b *DeferredDeleteBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	if req.Generation != 0 || req.MetaGenerationPrecondition != nil {
+		err = b.wrapped.DeleteObject(ctx, req)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for len(b.queue) >= maxQueuedDeletes {
+		b.queueChanged.Wait()
+	}
+
+	// Special case: the object already has a tombstone, so it has been or is
+	// about to be deleted.
+	if b.hidden(req.Name) {
+		return
+	}
+
+	b.addTombstone(req.Name)
+	b.queue = append(b.queue, deferredDelete{
+		ctx:  detachedContext(ctx),
+		name: req.Name,
+	})
+
+	b.outstanding++
+	if b.outstanding == 1 {
+		b.idle = make(chan struct{})
+	}
+
+	b.queueChanged.Broadcast()
+	return
+}
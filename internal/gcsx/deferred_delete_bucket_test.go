@@ -0,0 +1,283 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestDeferredDeleteBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// gatedDeleteBucket
+////////////////////////////////////////////////////////////////////////
+
+// A bucket whose deletes of chosen names wait until released, and which
+// fails a chosen number of deletes.
+type gatedDeleteBucket struct {
+	gcs.Bucket
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	gates    map[string]chan struct{}
+	failures int
+}
+
+// Make deletes of the supplied name wait until release is called.
+func (b *gatedDeleteBucket) hold(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.gates[name] = make(chan struct{})
+}
+
+func (b *gatedDeleteBucket) release(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	close(b.gates[name])
+	delete(b.gates, name)
+}
+
+func (b *gatedDeleteBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	b.mu.Lock()
+	gate := b.gates[req.Name]
+	fail := b.failures > 0
+	if fail {
+		b.failures--
+	}
+	b.mu.Unlock()
+
+	if gate != nil {
+		<-gate
+	}
+
+	if fail {
+		err = errors.New("taco")
+		return
+	}
+
+	err = b.Bucket.DeleteObject(ctx, req)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type DeferredDeleteBucketTest struct {
+	ctx     context.Context
+	clock   timeutil.SimulatedClock
+	wrapped gatedDeleteBucket
+	bucket  *gcsx.DeferredDeleteBucket
+}
+
+var _ SetUpInterface = &DeferredDeleteBucketTest{}
+
+func init() { RegisterTestSuite(&DeferredDeleteBucketTest{}) }
+
+func (t *DeferredDeleteBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.wrapped.Bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.wrapped.gates = make(map[string]chan struct{})
+	t.bucket = gcsx.NewDeferredDeleteBucket(4, time.Millisecond, &t.wrapped)
+
+	for _, name := range []string{"foo", "a/b/", "a/b/c", "a/b/d"} {
+		_, err := gcsutil.CreateObject(t.ctx, t.wrapped.Bucket, name, []byte("taco"))
+		AssertEq(nil, err)
+	}
+}
+
+func (t *DeferredDeleteBucketTest) delete(name string) {
+	err := t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: name})
+	AssertEq(nil, err)
+}
+
+// Stat the named object through the supplied bucket.
+func (t *DeferredDeleteBucketTest) stat(
+	b gcs.Bucket,
+	name string) (o *gcs.Object, err error) {
+	o, err = b.StatObject(t.ctx, &gcs.StatObjectRequest{Name: name})
+	return
+}
+
+// List the supplied prefix with a delimiter, returning the names of the
+// objects and the collapsed runs.
+func (t *DeferredDeleteBucketTest) list(prefix string) (names []string) {
+	l, err := t.bucket.ListObjects(
+		t.ctx,
+		&gcs.ListObjectsRequest{Prefix: prefix, Delimiter: "/"})
+
+	AssertEq(nil, err)
+
+	for _, o := range l.Objects {
+		names = append(names, o.Name)
+	}
+
+	names = append(names, l.CollapsedRuns...)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *DeferredDeleteBucketTest) DeleteHidesObjectStraightAway() {
+	t.wrapped.hold("foo")
+	t.delete("foo")
+
+	// The object is still there, but can't be seen.
+	_, err := t.stat(&t.wrapped, "foo")
+	AssertEq(nil, err)
+
+	_, err = t.stat(t.bucket, "foo")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	_, err = t.bucket.NewReader(t.ctx, &gcs.ReadObjectRequest{Name: "foo"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	ExpectThat(t.list(""), ElementsAre("a/"))
+	ExpectEq(1, t.bucket.Pending())
+
+	// Once released, the delete goes through.
+	t.wrapped.release("foo")
+	AssertEq(nil, t.bucket.Flush(t.ctx))
+	ExpectEq(0, t.bucket.Pending())
+
+	_, err = t.stat(&t.wrapped, "foo")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *DeferredDeleteBucketTest) DirectoryHiddenUntilContentsDeleted() {
+	// Delete directories' contents and then their placeholders, as rm -rf
+	// does, holding up the delete of one file. "a/" has no placeholder.
+	t.wrapped.hold("a/b/c")
+	t.delete("a/b/c")
+	t.delete("a/b/d")
+	t.delete("a/b/")
+	t.delete("a/")
+
+	_, err := t.stat(&t.wrapped, "a/b/c")
+	AssertEq(nil, err)
+
+	// GCS still lists the directory, but we don't.
+	ExpectEq(0, len(t.list("a/")))
+	ExpectEq(0, len(t.list("a/b/")))
+	ExpectThat(t.list(""), ElementsAre("foo"))
+
+	t.wrapped.release("a/b/c")
+	AssertEq(nil, t.bucket.Flush(t.ctx))
+
+	ExpectThat(t.list(""), ElementsAre("foo"))
+}
+
+func (t *DeferredDeleteBucketTest) CreateWaitsForDelete() {
+	t.wrapped.hold("foo")
+	t.delete("foo")
+
+	done := make(chan error)
+	go func() {
+		_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("burrito"))
+		done <- err
+	}()
+
+	t.wrapped.release("foo")
+	AssertEq(nil, <-done)
+	AssertEq(nil, t.bucket.Flush(t.ctx))
+
+	// The new object survives.
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+}
+
+func (t *DeferredDeleteBucketTest) RecreatedDirectoryVisible() {
+	t.wrapped.hold("a/b/c")
+	t.delete("a/b/c")
+	t.delete("a/b/d")
+	t.delete("a/b/")
+
+	// Recreate the directory while its contents are still being deleted.
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "a/b/", []byte{})
+	AssertEq(nil, err)
+
+	_, err = t.stat(t.bucket, "a/b/")
+	ExpectEq(nil, err)
+
+	ExpectThat(t.list("a/"), ElementsAre("a/b/"))
+	ExpectThat(t.list("a/b/"), ElementsAre("a/b/"))
+
+	t.wrapped.release("a/b/c")
+	AssertEq(nil, t.bucket.Flush(t.ctx))
+
+	ExpectThat(t.list("a/b/"), ElementsAre("a/b/"))
+}
+
+func (t *DeferredDeleteBucketTest) TransientFailuresRetried() {
+	t.wrapped.failures = 2
+	t.delete("foo")
+
+	AssertEq(nil, t.bucket.Flush(t.ctx))
+
+	_, err := t.stat(&t.wrapped, "foo")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *DeferredDeleteBucketTest) PersistentFailuresReported() {
+	t.wrapped.failures = 100
+	t.delete("foo")
+
+	err := t.bucket.Flush(t.ctx)
+	ExpectThat(err, Error(HasSubstr("taco")))
+	ExpectThat(err, Error(HasSubstr("foo")))
+
+	// The object reappears, and the failure is reported only once.
+	_, err = t.stat(t.bucket, "foo")
+	ExpectEq(nil, err)
+
+	ExpectEq(nil, t.bucket.Flush(t.ctx))
+}
+
+func (t *DeferredDeleteBucketTest) ConditionalDeletesMadeStraightAway() {
+	o, err := t.stat(&t.wrapped, "foo")
+	AssertEq(nil, err)
+
+	err = t.bucket.DeleteObject(
+		t.ctx,
+		&gcs.DeleteObjectRequest{Name: "foo", Generation: o.Generation})
+
+	AssertEq(nil, err)
+	ExpectEq(0, t.bucket.Pending())
+
+	_, err = t.stat(&t.wrapped, "foo")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
@@ -0,0 +1,248 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fsutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/syncutil"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+// The number of times DownloadTempFile downloads an object whose contents
+// don't match its checksums before giving up.
+const downloadAttempts = 3
+
+// ErrChecksumMismatch is wrapped by errors from DownloadTempFile when every
+// attempt to download an object produced contents that don't match its
+// checksums.
+var ErrChecksumMismatch = errors.New("contents don't match checksums")
+
+// ParallelDownload says how DownloadTempFile splits up large objects. The zero
+// value downloads every object with a single request.
+type ParallelDownload struct {
+	// The maximum number of range requests to have in flight at once. Values
+	// less than two disable parallel downloads.
+	Streams int
+
+	// The size of each range. Objects no larger than this are downloaded with
+	// a single request.
+	ChunkSize int64
+}
+
+// Return true if the supplied object should be downloaded in ranges.
+func (pd ParallelDownload) split(o *gcs.Object) bool {
+	return pd.Streams > 1 && pd.ChunkSize > 0 && o.Size > uint64(pd.ChunkSize)
+}
+
+// DownloadTempFile creates a temp file, as with NewTempFile, holding the
+// contents of the supplied generation of an object, and returns the checksums
+// of those contents. Contents that don't match the checksums GCS reports for
+// the object are downloaded again, a few times, before an error wrapping
+// ErrChecksumMismatch is returned.
+//
+// Objects larger than pd.ChunkSize are fetched as ranges of that size, up to
+// pd.Streams of them at once, each written to its place in the temp file.
+func DownloadTempFile(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	o *gcs.Object,
+	dir string,
+	pd ParallelDownload,
+	clock timeutil.Clock) (tf TempFile, checksums *Checksums, err error) {
+	for i := 0; i < downloadAttempts; i++ {
+		if pd.split(o) {
+			tf, checksums, err = downloadRanges(ctx, bucket, o, dir, pd, clock)
+		} else {
+			tf, checksums, err = downloadOnce(ctx, bucket, o, dir, clock)
+		}
+
+		if err != nil || checksums.Matched {
+			return
+		}
+
+		log.Printf(
+			"Download of %q (generation %d) doesn't match GCS: %v",
+			o.Name,
+			o.Generation,
+			checksums)
+
+		tf.Destroy()
+		tf = nil
+		checksums = nil
+	}
+
+	err = fmt.Errorf(
+		"%q (generation %d) after %d attempts: %w",
+		o.Name,
+		o.Generation,
+		downloadAttempts,
+		ErrChecksumMismatch)
+
+	return
+}
+
+// Download the object into a temp file once, checksumming what arrives.
+func downloadOnce(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	o *gcs.Object,
+	dir string,
+	clock timeutil.Clock) (tf TempFile, checksums *Checksums, err error) {
+	rc, err := bucket.NewReader(
+		ctx,
+		&gcs.ReadObjectRequest{
+			Name:       o.Name,
+			Generation: o.Generation,
+		})
+
+	if err != nil {
+		err = fmt.Errorf("NewReader: %w", err)
+		return
+	}
+
+	defer rc.Close()
+
+	sum := newChecksummer()
+	tf, err = NewTempFile(io.TeeReader(rc, sum), dir, clock)
+	if err != nil {
+		err = fmt.Errorf("NewTempFile: %v", err)
+		return
+	}
+
+	checksums = sum.verify(o)
+	return
+}
+
+// Download the object into a temp file once, as ranges fetched in parallel,
+// then checksum the result.
+func downloadRanges(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	o *gcs.Object,
+	dir string,
+	pd ParallelDownload,
+	clock timeutil.Clock) (tf TempFile, checksums *Checksums, err error) {
+	f, err := fsutil.AnonymousFile(dir)
+	if err != nil {
+		err = fmt.Errorf("AnonymousFile: %v", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			f.Close()
+		}
+	}()
+
+	// Hand out the ranges to a fixed number of workers.
+	b := syncutil.NewBundle(ctx)
+
+	ranges := make(chan gcs.ByteRange)
+	b.Add(func(ctx context.Context) (err error) {
+		defer close(ranges)
+		for start := uint64(0); start < o.Size; start += uint64(pd.ChunkSize) {
+			r := gcs.ByteRange{Start: start, Limit: start + uint64(pd.ChunkSize)}
+			if r.Limit > o.Size {
+				r.Limit = o.Size
+			}
+
+			select {
+			case ranges <- r:
+			case <-ctx.Done():
+				err = ctx.Err()
+				return
+			}
+		}
+
+		return
+	})
+
+	for i := 0; i < pd.Streams; i++ {
+		b.Add(func(ctx context.Context) (err error) {
+			for r := range ranges {
+				if err = downloadRange(ctx, bucket, o, r, f); err != nil {
+					return
+				}
+			}
+
+			return
+		})
+	}
+
+	err = b.Join()
+	if err != nil {
+		return
+	}
+
+	// Checksum what arrived.
+	sum := newChecksummer()
+	_, err = io.Copy(sum, io.NewSectionReader(f, 0, int64(o.Size)))
+	if err != nil {
+		err = fmt.Errorf("checksum: %v", err)
+		return
+	}
+
+	tf = newTempFile(f, int64(o.Size), clock)
+	checksums = sum.verify(o)
+	return
+}
+
+// Copy the supplied range of the object to the same offset in f.
+func downloadRange(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	o *gcs.Object,
+	r gcs.ByteRange,
+	f io.WriterAt) (err error) {
+	rc, err := bucket.NewReader(
+		ctx,
+		&gcs.ReadObjectRequest{
+			Name:       o.Name,
+			Generation: o.Generation,
+			Range:      &r,
+		})
+
+	if err != nil {
+		err = fmt.Errorf("NewReader: %w", err)
+		return
+	}
+
+	defer rc.Close()
+
+	w := io.NewOffsetWriter(f, int64(r.Start))
+	n, err := io.Copy(w, rc)
+	if err != nil {
+		err = fmt.Errorf("range [%d, %d): %w", r.Start, r.Limit, err)
+		return
+	}
+
+	if uint64(n) != r.Limit-r.Start {
+		err = fmt.Errorf(
+			"range [%d, %d): got %d bytes",
+			r.Start,
+			r.Limit,
+			n)
+		return
+	}
+
+	return
+}
@@ -0,0 +1,268 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestDownload(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// corruptingBucket
+////////////////////////////////////////////////////////////////////////
+
+// A bucket whose first few readers yield contents with the first byte
+// flipped.
+type corruptingBucket struct {
+	gcs.Bucket
+
+	mu sync.Mutex
+
+	// The number of readers still to corrupt, and the number created.
+	//
+	// GUARDED_BY(mu)
+	corrupt int
+	readers int
+}
+
+func (b *corruptingBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.readers++
+
+	rc, err = b.Bucket.NewReader(ctx, req)
+	if err != nil || b.corrupt == 0 {
+		return
+	}
+
+	b.corrupt--
+
+	contents, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return
+	}
+
+	contents[0] ^= 0xff
+	rc = ioutil.NopCloser(bytes.NewReader(contents))
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type DownloadTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket corruptingBucket
+	object *gcs.Object
+}
+
+var _ SetUpInterface = &DownloadTest{}
+
+func init() { RegisterTestSuite(&DownloadTest{}) }
+
+func (t *DownloadTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket.Bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	t.object, err = gcsutil.CreateObject(
+		t.ctx,
+		t.bucket.Bucket,
+		"foo",
+		[]byte("taco"))
+
+	AssertEq(nil, err)
+}
+
+// Return the contents of the supplied temp file.
+func readTempFile(tf TempFile) (contents string) {
+	_, err := tf.Seek(0, 0)
+	AssertEq(nil, err)
+
+	b, err := ioutil.ReadAll(tf)
+	AssertEq(nil, err)
+
+	contents = string(b)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *DownloadTest) Intact() {
+	tf, checksums, err := DownloadTempFile(
+		t.ctx,
+		&t.bucket,
+		t.object,
+		"",
+		ParallelDownload{},
+		&t.clock)
+
+	AssertEq(nil, err)
+	defer tf.Destroy()
+
+	ExpectEq("taco", readTempFile(tf))
+	ExpectEq(t.object.Generation, checksums.Generation)
+	ExpectTrue(checksums.Matched)
+	ExpectEq(1, t.bucket.readers)
+}
+
+func (t *DownloadTest) CorruptedThenIntact() {
+	t.bucket.corrupt = downloadAttempts - 1
+
+	tf, checksums, err := DownloadTempFile(
+		t.ctx,
+		&t.bucket,
+		t.object,
+		"",
+		ParallelDownload{},
+		&t.clock)
+
+	AssertEq(nil, err)
+	defer tf.Destroy()
+
+	ExpectEq("taco", readTempFile(tf))
+	ExpectTrue(checksums.Matched)
+	ExpectEq(downloadAttempts, t.bucket.readers)
+}
+
+func (t *DownloadTest) AlwaysCorrupted() {
+	t.bucket.corrupt = downloadAttempts
+
+	tf, checksums, err := DownloadTempFile(
+		t.ctx,
+		&t.bucket,
+		t.object,
+		"",
+		ParallelDownload{},
+		&t.clock)
+
+	ExpectTrue(errors.Is(err, ErrChecksumMismatch), "err: %v", err)
+	ExpectEq(nil, tf)
+	ExpectEq(nil, checksums)
+	ExpectEq(downloadAttempts, t.bucket.readers)
+}
+
+func (t *DownloadTest) ObjectMissing() {
+	t.object.Name = "bar"
+
+	_, _, err := DownloadTempFile(
+		t.ctx,
+		&t.bucket,
+		t.object,
+		"",
+		ParallelDownload{},
+		&t.clock)
+
+	ExpectThat(err, Error(HasSubstr("NewReader")))
+	ExpectEq(1, t.bucket.readers)
+}
+
+func (t *DownloadTest) ParallelRanges() {
+	o, err := gcsutil.CreateObject(
+		t.ctx,
+		t.bucket.Bucket,
+		"bar",
+		[]byte("enchilada"))
+
+	AssertEq(nil, err)
+
+	tf, checksums, err := DownloadTempFile(
+		t.ctx,
+		&t.bucket,
+		o,
+		"",
+		ParallelDownload{Streams: 2, ChunkSize: 4},
+		&t.clock)
+
+	AssertEq(nil, err)
+	defer tf.Destroy()
+
+	ExpectEq("enchilada", readTempFile(tf))
+	ExpectTrue(checksums.Matched)
+	ExpectEq(3, t.bucket.readers)
+
+	sr, err := tf.Stat()
+	AssertEq(nil, err)
+	ExpectEq(len("enchilada"), sr.Size)
+	ExpectEq(len("enchilada"), sr.DirtyThreshold)
+}
+
+func (t *DownloadTest) ParallelRangeCorruptedThenIntact() {
+	o, err := gcsutil.CreateObject(
+		t.ctx,
+		t.bucket.Bucket,
+		"bar",
+		[]byte("enchilada"))
+
+	AssertEq(nil, err)
+	t.bucket.corrupt = 1
+
+	tf, checksums, err := DownloadTempFile(
+		t.ctx,
+		&t.bucket,
+		o,
+		"",
+		ParallelDownload{Streams: 2, ChunkSize: 4},
+		&t.clock)
+
+	AssertEq(nil, err)
+	defer tf.Destroy()
+
+	ExpectEq("enchilada", readTempFile(tf))
+	ExpectTrue(checksums.Matched)
+	ExpectEq(6, t.bucket.readers)
+}
+
+func (t *DownloadTest) SmallObjectsNotSplit() {
+	tf, checksums, err := DownloadTempFile(
+		t.ctx,
+		&t.bucket,
+		t.object,
+		"",
+		ParallelDownload{Streams: 2, ChunkSize: 4},
+		&t.clock)
+
+	AssertEq(nil, err)
+	defer tf.Destroy()
+
+	ExpectEq("taco", readTempFile(tf))
+	ExpectTrue(checksums.Matched)
+	ExpectEq(1, t.bucket.readers)
+}
@@ -0,0 +1,288 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// NewFailoverBucket creates a bucket that serves reads from primary, but
+// fails them over to secondary, a mirror of primary, once threshold reads in
+// a row have failed with errors other than the object not being found or a
+// precondition not holding. While failed over, primary is checked every
+// checkInterval with a small listing of checkPrefix, and reads fail back to it
+// as soon as one succeeds. checkPrefix should be one the credentials may list,
+// e.g. that of --only-dir; the empty string lists the whole bucket.
+//
+// Reads are NewReader, StatObject, and ListObjects; everything else always
+// goes to primary. Generation numbers differ between buckets, so readers of
+// objects statted in one bucket get *gcs.NotFoundError from the other, and a
+// listing can't be continued in the other bucket.
+//
+// Health checks continue until the supplied context is cancelled.
+func NewFailoverBucket(
+	ctx context.Context,
+	threshold int,
+	checkInterval time.Duration,
+	checkPrefix string,
+	primary gcs.Bucket,
+	secondary gcs.Bucket) (b gcs.Bucket) {
+	typed := newFailoverBucket(threshold, checkPrefix, primary, secondary)
+	go typed.checkPeriodically(ctx, checkInterval)
+
+	b = typed
+	return
+}
+
+type failoverBucket struct {
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	threshold   int
+	checkPrefix string
+	primary     gcs.Bucket
+	secondary   gcs.Bucket
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// The number of reads from primary in a row that have failed.
+	//
+	// INVARIANT: failures < threshold || failedOver
+	//
+	// GUARDED_BY(mu)
+	failures int
+
+	// Are reads currently being served by secondary?
+	//
+	// GUARDED_BY(mu)
+	failedOver bool
+}
+
+func newFailoverBucket(
+	threshold int,
+	checkPrefix string,
+	primary gcs.Bucket,
+	secondary gcs.Bucket) (b *failoverBucket) {
+	b = &failoverBucket{
+		threshold:   threshold,
+		checkPrefix: checkPrefix,
+		primary:     primary,
+		secondary:   secondary,
+	}
+
+	return
+}
+
+// Return the bucket that should serve reads, and whether it is primary.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *failoverBucket) reader() (rb gcs.Bucket, isPrimary bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failedOver {
+		rb = b.secondary
+		return
+	}
+
+	rb = b.primary
+	isPrimary = true
+	return
+}
+
+// Record the result of a read from primary, failing over if it is one failure
+// too many. Return true if the read should be retried on secondary.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *failoverBucket) noteResult(
+	ctx context.Context,
+	err error) (retry bool) {
+	switch err.(type) {
+	case nil, *gcs.NotFoundError, *gcs.PreconditionError:
+		b.mu.Lock()
+		b.failures = 0
+		b.mu.Unlock()
+		return
+	}
+
+	// Failures caused by the caller giving up say nothing about primary.
+	if ctx.Err() != nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.failures < b.threshold {
+		return
+	}
+
+	if !b.failedOver {
+		log.Printf(
+			"Failing reads over to bucket %q after %d failures in a row from %q. "+
+				"Latest: %v",
+			b.secondary.Name(),
+			b.failures,
+			b.primary.Name(),
+			err)
+
+		b.failedOver = true
+	}
+
+	retry = true
+	return
+}
+
+func (b *failoverBucket) checkPeriodically(
+	ctx context.Context,
+	interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			b.check(ctx)
+		}
+	}
+}
+
+// If reads have failed over, check whether primary is working again and fail
+// back to it if so.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *failoverBucket) check(ctx context.Context) {
+	b.mu.Lock()
+	failedOver := b.failedOver
+	b.mu.Unlock()
+
+	if !failedOver {
+		return
+	}
+
+	_, err := b.primary.ListObjects(
+		ctx,
+		&gcs.ListObjectsRequest{
+			Prefix:     b.checkPrefix,
+			MaxResults: 1,
+		})
+
+	if err != nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	log.Printf("Bucket %q is working again; failing reads back to it.",
+		b.primary.Name())
+
+	b.failedOver = false
+	b.failures = 0
+}
+
+////////////////////////////////////////////////////////////////////////
+// gcs.Bucket interface
+////////////////////////////////////////////////////////////////////////
+
+func (b *failoverBucket) Name() string {
+	return b.primary.Name()
+}
+
+func (b *failoverBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	rb, isPrimary := b.reader()
+	rc, err = rb.NewReader(ctx, req)
+	if isPrimary && b.noteResult(ctx, err) {
+		rc, err = b.secondary.NewReader(ctx, req)
+	}
+
+	return
+}
+
+func (b *failoverBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.primary.CreateObject(ctx, req)
+	return
+}
+
+func (b *failoverBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.primary.CopyObject(ctx, req)
+	return
+}
+
+func (b *failoverBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	o, err = b.primary.ComposeObjects(ctx, req)
+	return
+}
+
+func (b *failoverBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	rb, isPrimary := b.reader()
+	o, err = rb.StatObject(ctx, req)
+	if isPrimary && b.noteResult(ctx, err) {
+		o, err = b.secondary.StatObject(ctx, req)
+	}
+
+	return
+}
+
+func (b *failoverBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	rb, isPrimary := b.reader()
+	listing, err = rb.ListObjects(ctx, req)
+	if isPrimary && b.noteResult(ctx, err) {
+		listing, err = b.secondary.ListObjects(ctx, req)
+	}
+
+	return
+}
+
+func (b *failoverBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.primary.UpdateObject(ctx, req)
+	return
+}
+
+func (b *failoverBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	err = b.primary.DeleteObject(ctx, req)
+	return
+}
@@ -0,0 +1,246 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+func TestFailoverBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// brokenBucket
+////////////////////////////////////////////////////////////////////////
+
+// A bucket whose reads fail with err when it is non-nil, and which counts the
+// reads that reach it and the prefix of the last listing.
+type brokenBucket struct {
+	gcs.Bucket
+	err        error
+	reads      int
+	listPrefix string
+}
+
+func (b *brokenBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	b.reads++
+	if b.err != nil {
+		err = b.err
+		return
+	}
+
+	rc, err = b.Bucket.NewReader(ctx, req)
+	return
+}
+
+func (b *brokenBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	b.reads++
+	if b.err != nil {
+		err = b.err
+		return
+	}
+
+	o, err = b.Bucket.StatObject(ctx, req)
+	return
+}
+
+func (b *brokenBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	b.reads++
+	b.listPrefix = req.Prefix
+	if b.err != nil {
+		err = b.err
+		return
+	}
+
+	listing, err = b.Bucket.ListObjects(ctx, req)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const failoverThreshold = 3
+
+const failoverCheckPrefix = "some/dir/"
+
+type FailoverBucketTest struct {
+	ctx       context.Context
+	clock     timeutil.SimulatedClock
+	primary   brokenBucket
+	secondary gcs.Bucket
+	bucket    *failoverBucket
+}
+
+var _ SetUpInterface = &FailoverBucketTest{}
+
+func init() { RegisterTestSuite(&FailoverBucketTest{}) }
+
+func (t *FailoverBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.primary.Bucket = gcsfake.NewFakeBucket(&t.clock, "primary")
+	t.secondary = gcsfake.NewFakeBucket(&t.clock, "secondary")
+	t.bucket = newFailoverBucket(
+		failoverThreshold,
+		failoverCheckPrefix,
+		&t.primary,
+		t.secondary)
+
+	// Give the buckets different contents for the same name, so that we can
+	// tell which one served a read.
+	_, err := gcsutil.CreateObject(t.ctx, t.primary.Bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.secondary, "foo", []byte("burrito"))
+	AssertEq(nil, err)
+}
+
+func (t *FailoverBucketTest) breakPrimary() {
+	t.primary.err = &googleapi.Error{Code: http.StatusServiceUnavailable}
+}
+
+// Return the contents of foo, as read through the bucket.
+func (t *FailoverBucketTest) readFoo() (s string, err error) {
+	b, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	s = string(b)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *FailoverBucketTest) ReadsFromPrimary() {
+	s, err := t.readFoo()
+	AssertEq(nil, err)
+	ExpectEq("taco", s)
+
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	ExpectEq(len("taco"), o.Size)
+}
+
+func (t *FailoverBucketTest) FailsOverAfterThreshold() {
+	t.breakPrimary()
+
+	// Until the threshold, errors are returned.
+	for i := 0; i < failoverThreshold-1; i++ {
+		_, err := t.readFoo()
+		ExpectThat(err, Error(HasSubstr("503")))
+	}
+
+	// The read that reaches it is served by the secondary.
+	s, err := t.readFoo()
+	AssertEq(nil, err)
+	ExpectEq("burrito", s)
+
+	// As are later reads, without trying the primary.
+	t.primary.reads = 0
+
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	ExpectEq(len("burrito"), o.Size)
+
+	listing, err := t.bucket.ListObjects(t.ctx, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+	ExpectEq(1, len(listing.Objects))
+
+	ExpectEq(0, t.primary.reads)
+}
+
+func (t *FailoverBucketTest) SuccessResetsCount() {
+	t.breakPrimary()
+	for i := 0; i < failoverThreshold-1; i++ {
+		t.readFoo()
+	}
+
+	t.primary.err = nil
+	_, err := t.readFoo()
+	AssertEq(nil, err)
+
+	// The count starts again.
+	t.breakPrimary()
+	_, err = t.readFoo()
+	ExpectNe(nil, err)
+}
+
+func (t *FailoverBucketTest) NotFoundDoesntCount() {
+	for i := 0; i < failoverThreshold; i++ {
+		_, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "bar"})
+		ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+	}
+
+	s, err := t.readFoo()
+	AssertEq(nil, err)
+	ExpectEq("taco", s)
+}
+
+func (t *FailoverBucketTest) WritesGoToPrimary() {
+	t.breakPrimary()
+	for i := 0; i < failoverThreshold; i++ {
+		t.readFoo()
+	}
+
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "bar", []byte("enchilada"))
+	AssertEq(nil, err)
+
+	_, err = gcsutil.ReadObject(t.ctx, t.primary.Bucket, "bar")
+	ExpectEq(nil, err)
+
+	_, err = gcsutil.ReadObject(t.ctx, t.secondary, "bar")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *FailoverBucketTest) FailsBackOnceHealthy() {
+	t.breakPrimary()
+	for i := 0; i < failoverThreshold; i++ {
+		t.readFoo()
+	}
+
+	// A check while the primary is still broken changes nothing.
+	t.bucket.check(t.ctx)
+
+	s, err := t.readFoo()
+	AssertEq(nil, err)
+	ExpectEq("burrito", s)
+
+	// Once it works, a check fails back to it. Checks list only the prefix
+	// they were given.
+	t.primary.err = nil
+	t.bucket.check(t.ctx)
+	ExpectEq(failoverCheckPrefix, t.primary.listPrefix)
+
+	s, err = t.readFoo()
+	AssertEq(nil, err)
+	ExpectEq("taco", s)
+}
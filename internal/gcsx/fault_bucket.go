@@ -0,0 +1,335 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+// FaultScenario describes faults to be injected into bucket operations by a
+// bucket created with NewFaultInjectingBucket. It is intended for testing the
+// resilience of applications running on top of gcsfuse, and should never be
+// used in production.
+//
+// Scenarios are usually loaded from a JSON file using ParseFaultScenario, for
+// example:
+//
+//     {
+//       "rules": [
+//         {"op": "NewReader", "probability": 0.1, "partial_read_bytes": 4096},
+//         {"op": "*", "probability": 0.01, "error_code": 503},
+//         {"op": "StatObject", "name_prefix": "slow/", "latency": "2s"}
+//       ]
+//     }
+//
+type FaultScenario struct {
+	Rules []FaultRule `json:"rules"`
+}
+
+// FaultRule describes a single kind of fault. For each operation, every rule
+// that matches is considered in order, and each one fires independently with
+// its probability.
+type FaultRule struct {
+	// The name of the gcs.Bucket method to which the rule applies (e.g.
+	// "StatObject"), or "*" for all methods.
+	Op string `json:"op"`
+
+	// If non-empty, the rule applies only to requests for object names (or
+	// listing prefixes) that begin with this string.
+	NamePrefix string `json:"name_prefix"`
+
+	// The probability in [0, 1] that the rule fires for a matching operation.
+	// If unset, the rule fires every time.
+	Probability *float64 `json:"probability"`
+
+	// If non-empty, a duration in the format accepted by time.ParseDuration for
+	// which to delay the operation before calling through.
+	Latency string `json:"latency"`
+
+	// If non-zero, fail the operation with an error corresponding to this HTTP
+	// status code instead of calling through. 404 and 412 are translated into
+	// *gcs.NotFoundError and *gcs.PreconditionError; other codes are returned
+	// as *googleapi.Error, just like the real GCS client does.
+	ErrorCode int `json:"error_code"`
+
+	// If positive and the operation is NewReader, the returned reader yields at
+	// most this many bytes before failing with io.ErrUnexpectedEOF.
+	PartialReadBytes int64 `json:"partial_read_bytes"`
+
+	// The parsed form of Latency.
+	latency time.Duration
+}
+
+// ParseFaultScenario parses and validates a JSON-encoded scenario.
+func ParseFaultScenario(r io.Reader) (s *FaultScenario, err error) {
+	s = new(FaultScenario)
+	err = json.NewDecoder(r).Decode(s)
+	if err != nil {
+		err = fmt.Errorf("Decode: %v", err)
+		return
+	}
+
+	for i := range s.Rules {
+		rule := &s.Rules[i]
+
+		if rule.Op == "" {
+			err = fmt.Errorf("Rule %d: missing op", i)
+			return
+		}
+
+		if p := rule.Probability; p != nil && (*p < 0 || *p > 1) {
+			err = fmt.Errorf("Rule %d: illegal probability %v", i, *p)
+			return
+		}
+
+		if rule.Latency != "" {
+			rule.latency, err = time.ParseDuration(rule.Latency)
+			if err != nil {
+				err = fmt.Errorf("Rule %d: ParseDuration: %v", i, err)
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// NewFaultInjectingBucket creates a bucket that injects the faults described
+// by the supplied scenario into calls to the wrapped bucket.
+func NewFaultInjectingBucket(
+	s *FaultScenario,
+	wrapped gcs.Bucket) (b gcs.Bucket) {
+	b = &faultBucket{
+		rules:   s.Rules,
+		wrapped: wrapped,
+	}
+
+	return
+}
+
+type faultBucket struct {
+	rules   []FaultRule
+	wrapped gcs.Bucket
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+func faultError(code int) (err error) {
+	msg := fmt.Sprintf("injected fault: HTTP %d", code)
+	switch code {
+	case http.StatusNotFound:
+		err = &gcs.NotFoundError{Err: errors.New(msg)}
+
+	case http.StatusPreconditionFailed:
+		err = &gcs.PreconditionError{Err: errors.New(msg)}
+
+	default:
+		err = &googleapi.Error{Code: code, Message: msg}
+	}
+
+	return
+}
+
+// Apply the rules that fire for the given operation, sleeping as necessary.
+// Return a non-nil error if the operation should fail, and a positive limit
+// if a reader should be truncated.
+func (b *faultBucket) inject(
+	ctx context.Context,
+	op string,
+	name string) (partialReadBytes int64, err error) {
+	for _, rule := range b.rules {
+		// Does the rule apply?
+		if rule.Op != "*" && rule.Op != op {
+			continue
+		}
+
+		if !strings.HasPrefix(name, rule.NamePrefix) {
+			continue
+		}
+
+		if rule.Probability != nil && rand.Float64() >= *rule.Probability {
+			continue
+		}
+
+		// Inject latency, honoring cancellation.
+		if rule.latency > 0 {
+			select {
+			case <-time.After(rule.latency):
+			case <-ctx.Done():
+				err = ctx.Err()
+				return
+			}
+		}
+
+		// Inject errors.
+		if rule.ErrorCode != 0 {
+			err = faultError(rule.ErrorCode)
+			return
+		}
+
+		if rule.PartialReadBytes > 0 {
+			partialReadBytes = rule.PartialReadBytes
+		}
+	}
+
+	return
+}
+
+// A reader that fails with io.ErrUnexpectedEOF after a fixed number of bytes.
+type partialReader struct {
+	wrapped   io.ReadCloser
+	remaining int64
+}
+
+func (pr *partialReader) Read(p []byte) (n int, err error) {
+	if pr.remaining <= 0 {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+
+	if int64(len(p)) > pr.remaining {
+		p = p[:pr.remaining]
+	}
+
+	n, err = pr.wrapped.Read(p)
+	pr.remaining -= int64(n)
+
+	return
+}
+
+func (pr *partialReader) Close() error {
+	return pr.wrapped.Close()
+}
+
+////////////////////////////////////////////////////////////////////////
+// gcs.Bucket
+////////////////////////////////////////////////////////////////////////
+
+func (b *faultBucket) Name() string {
+	return b.wrapped.Name()
+}
+
+func (b *faultBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	limit, err := b.inject(ctx, "NewReader", req.Name)
+	if err != nil {
+		return
+	}
+
+	rc, err = b.wrapped.NewReader(ctx, req)
+	if err != nil {
+		return
+	}
+
+	if limit > 0 {
+		rc = &partialReader{
+			wrapped:   rc,
+			remaining: limit,
+		}
+	}
+
+	return
+}
+
+func (b *faultBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	if _, err = b.inject(ctx, "CreateObject", req.Name); err != nil {
+		return
+	}
+
+	o, err = b.wrapped.CreateObject(ctx, req)
+	return
+}
+
+func (b *faultBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	if _, err = b.inject(ctx, "CopyObject", req.DstName); err != nil {
+		return
+	}
+
+	o, err = b.wrapped.CopyObject(ctx, req)
+	return
+}
+
+func (b *faultBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	if _, err = b.inject(ctx, "ComposeObjects", req.DstName); err != nil {
+		return
+	}
+
+	o, err = b.wrapped.ComposeObjects(ctx, req)
+	return
+}
+
+func (b *faultBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	if _, err = b.inject(ctx, "StatObject", req.Name); err != nil {
+		return
+	}
+
+	o, err = b.wrapped.StatObject(ctx, req)
+	return
+}
+
+func (b *faultBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (l *gcs.Listing, err error) {
+	if _, err = b.inject(ctx, "ListObjects", req.Prefix); err != nil {
+		return
+	}
+
+	l, err = b.wrapped.ListObjects(ctx, req)
+	return
+}
+
+func (b *faultBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	if _, err = b.inject(ctx, "UpdateObject", req.Name); err != nil {
+		return
+	}
+
+	o, err = b.wrapped.UpdateObject(ctx, req)
+	return
+}
+
+func (b *faultBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	if _, err = b.inject(ctx, "DeleteObject", req.Name); err != nil {
+		return
+	}
+
+	err = b.wrapped.DeleteObject(ctx, req)
+	return
+}
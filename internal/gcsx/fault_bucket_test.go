@@ -0,0 +1,164 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestFaultBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type FaultBucketTest struct {
+	ctx     context.Context
+	wrapped gcs.Bucket
+}
+
+var _ SetUpInterface = &FaultBucketTest{}
+
+func init() { RegisterTestSuite(&FaultBucketTest{}) }
+
+func (t *FaultBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.wrapped = gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket")
+
+	_, err := gcsutil.CreateObject(t.ctx, t.wrapped, "foo", []byte("taco"))
+	AssertEq(nil, err)
+}
+
+func (t *FaultBucketTest) makeBucket(scenario string) (b gcs.Bucket) {
+	s, err := gcsx.ParseFaultScenario(strings.NewReader(scenario))
+	AssertEq(nil, err)
+
+	b = gcsx.NewFaultInjectingBucket(s, t.wrapped)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *FaultBucketTest) InvalidScenarios() {
+	var err error
+
+	_, err = gcsx.ParseFaultScenario(strings.NewReader(`{"rules": [{}]}`))
+	ExpectThat(err, Error(HasSubstr("missing op")))
+
+	_, err = gcsx.ParseFaultScenario(
+		strings.NewReader(`{"rules": [{"op": "*", "probability": 2}]}`))
+	ExpectThat(err, Error(HasSubstr("illegal probability")))
+
+	_, err = gcsx.ParseFaultScenario(
+		strings.NewReader(`{"rules": [{"op": "*", "latency": "soon"}]}`))
+	ExpectThat(err, Error(HasSubstr("ParseDuration")))
+}
+
+func (t *FaultBucketTest) NoMatchingRules() {
+	b := t.makeBucket(`{"rules": [{"op": "DeleteObject", "error_code": 503}]}`)
+
+	o, err := b.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	ExpectEq(4, o.Size)
+}
+
+func (t *FaultBucketTest) HTTPError() {
+	b := t.makeBucket(`{"rules": [{"op": "*", "error_code": 503}]}`)
+
+	_, err := b.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertNe(nil, err)
+
+	typed, ok := err.(*googleapi.Error)
+	AssertTrue(ok, "%T", err)
+	ExpectEq(503, typed.Code)
+}
+
+func (t *FaultBucketTest) NotFoundAndPreconditionErrors() {
+	b := t.makeBucket(`{"rules": [
+		{"op": "StatObject", "error_code": 404},
+		{"op": "DeleteObject", "error_code": 412}
+	]}`)
+
+	_, err := b.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	err = b.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "foo"})
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+}
+
+func (t *FaultBucketTest) Probability() {
+	b := t.makeBucket(`{"rules": [
+		{"op": "StatObject", "probability": 0, "error_code": 503},
+		{"op": "DeleteObject", "probability": 1, "error_code": 503}
+	]}`)
+
+	for i := 0; i < 100; i++ {
+		_, err := b.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+		AssertEq(nil, err)
+
+		err = b.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "foo"})
+		AssertNe(nil, err)
+	}
+}
+
+func (t *FaultBucketTest) NamePrefix() {
+	b := t.makeBucket(
+		`{"rules": [{"op": "*", "name_prefix": "bar", "error_code": 500}]}`)
+
+	_, err := b.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	ExpectEq(nil, err)
+
+	_, err = b.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "bar"})
+	ExpectNe(nil, err)
+}
+
+func (t *FaultBucketTest) Latency() {
+	b := t.makeBucket(`{"rules": [{"op": "StatObject", "latency": "50ms"}]}`)
+
+	start := time.Now()
+	_, err := b.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	ExpectGe(time.Since(start), 50*time.Millisecond)
+}
+
+func (t *FaultBucketTest) PartialRead() {
+	b := t.makeBucket(
+		`{"rules": [{"op": "NewReader", "partial_read_bytes": 3}]}`)
+
+	rc, err := b.NewReader(t.ctx, &gcs.ReadObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	defer rc.Close()
+
+	contents, err := ioutil.ReadAll(rc)
+	ExpectEq(io.ErrUnexpectedEOF, err)
+	ExpectEq("tac", string(contents))
+}
@@ -0,0 +1,434 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+// The prefix of the continuation tokens of listings served from an inventory
+// report, distinguishing them from those of GCS.
+const inventoryTokenPrefix = "inventory:"
+
+// NewInventoryBucket reads the supplied inventory reports, CSV files such as
+// those produced by GCS Storage Insights, and returns a bucket that serves
+// stats and listings from them for the supplied time, rather than from the
+// wrapped bucket, so that a mount of an enormous bucket starts with complete
+// metadata without listing it. Rows for other buckets are skipped.
+//
+// Each report must start with a header row naming its columns. The columns
+// "name", "size", and "generation" are required; "metageneration",
+// "contentType", "contentEncoding", "storageClass", "crc32c" and "md5Hash"
+// (base64, as in the JSON API), "timeCreated" and "updated" (RFC 3339),
+// "componentCount", and "metadata" (a JSON object) are used if present.
+//
+// Names modified through the bucket are served by the wrapped bucket from
+// then on, as are listings that would include them. Changes made by others
+// since the reports were produced aren't visible until they expire.
+//
+// If spoolThreshold is positive and the reports hold more objects than that,
+// they are kept in temporary files in tempDir (or the system default if
+// empty) rather than in memory, in which case the rows must be sorted by
+// name, across reports in the order given.
+func NewInventoryBucket(
+	paths []string,
+	ttl time.Duration,
+	clock timeutil.Clock,
+	spoolThreshold int,
+	tempDir string,
+	wrapped gcs.Bucket) (b gcs.Bucket, err error) {
+	sb := newSnapshotBuilder(spoolThreshold, tempDir)
+	defer func() {
+		if err != nil {
+			sb.Abandon()
+		}
+	}()
+
+	for _, p := range paths {
+		err = loadInventoryReport(p, wrapped.Name(), sb)
+		if err != nil {
+			err = fmt.Errorf("%s: %v", p, err)
+			return
+		}
+	}
+
+	report, err := sb.finishSnapshot(wrapped)
+	if err != nil {
+		return
+	}
+
+	log.Printf(
+		"Serving stats and listings of %d objects from inventory reports for %v.",
+		report.objects.Len(),
+		ttl)
+
+	b = &inventoryBucket{
+		wrapped:    wrapped,
+		clock:      clock,
+		expiration: clock.Now().Add(ttl),
+		report:     report,
+		modified:   make(map[string]struct{}),
+	}
+
+	return
+}
+
+// Add the objects in the supplied report belonging to the named bucket to the
+// builder.
+func loadInventoryReport(
+	p string,
+	bucketName string,
+	sb *snapshotBuilder) (err error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	header, err := r.Read()
+	if err != nil {
+		err = fmt.Errorf("Reading header: %v", err)
+		return
+	}
+
+	columns := make(map[string]int)
+	for i, c := range header {
+		columns[c] = i
+	}
+
+	for _, c := range []string{"name", "size", "generation"} {
+		if _, ok := columns[c]; !ok {
+			err = fmt.Errorf("No %q column", c)
+			return
+		}
+	}
+
+	for row := 2; ; row++ {
+		var record []string
+		record, err = r.Read()
+		if err == io.EOF {
+			err = nil
+			return
+		}
+
+		if err != nil {
+			err = fmt.Errorf("Read: %v", err)
+			return
+		}
+
+		field := func(c string) string {
+			if i, ok := columns[c]; ok {
+				return record[i]
+			}
+
+			return ""
+		}
+
+		if b := field("bucket"); b != "" && b != bucketName {
+			continue
+		}
+
+		var o *gcs.Object
+		o, err = parseInventoryRow(field)
+		if err != nil {
+			err = fmt.Errorf("Row %d: %v", row, err)
+			return
+		}
+
+		if err = sb.Add(o); err != nil {
+			err = fmt.Errorf("Row %d: %v", row, err)
+			return
+		}
+	}
+}
+
+// Return the object described by a row of an inventory report, whose fields
+// are given by column name.
+func parseInventoryRow(field func(string) string) (o *gcs.Object, err error) {
+	o = &gcs.Object{
+		Name:            field("name"),
+		ContentType:     field("contentType"),
+		ContentEncoding: field("contentEncoding"),
+		StorageClass:    field("storageClass"),
+		MetaGeneration:  1,
+		ComponentCount:  1,
+	}
+
+	if o.Name == "" {
+		err = fmt.Errorf("Empty name")
+		return
+	}
+
+	if o.Size, err = strconv.ParseUint(field("size"), 10, 64); err != nil {
+		err = fmt.Errorf("size: %v", err)
+		return
+	}
+
+	if o.Generation, err = strconv.ParseInt(field("generation"), 10, 64); err != nil {
+		err = fmt.Errorf("generation: %v", err)
+		return
+	}
+
+	if s := field("metageneration"); s != "" {
+		if o.MetaGeneration, err = strconv.ParseInt(s, 10, 64); err != nil {
+			err = fmt.Errorf("metageneration: %v", err)
+			return
+		}
+	}
+
+	if s := field("componentCount"); s != "" {
+		if o.ComponentCount, err = strconv.ParseInt(s, 10, 64); err != nil {
+			err = fmt.Errorf("componentCount: %v", err)
+			return
+		}
+	}
+
+	if s := field("timeCreated"); s != "" {
+		if o.Created, err = time.Parse(time.RFC3339, s); err != nil {
+			err = fmt.Errorf("timeCreated: %v", err)
+			return
+		}
+	}
+
+	if s := field("updated"); s != "" {
+		if o.Updated, err = time.Parse(time.RFC3339, s); err != nil {
+			err = fmt.Errorf("updated: %v", err)
+			return
+		}
+	}
+
+	if s := field("crc32c"); s != "" {
+		var b []byte
+		b, err = base64.StdEncoding.DecodeString(s)
+		if err == nil && len(b) != 4 {
+			err = fmt.Errorf("%d bytes", len(b))
+		}
+
+		if err != nil {
+			err = fmt.Errorf("crc32c: %v", err)
+			return
+		}
+
+		o.CRC32C = binary.BigEndian.Uint32(b)
+	}
+
+	if s := field("md5Hash"); s != "" {
+		var b []byte
+		b, err = base64.StdEncoding.DecodeString(s)
+		if err == nil && len(b) != md5.Size {
+			err = fmt.Errorf("%d bytes", len(b))
+		}
+
+		if err != nil {
+			err = fmt.Errorf("md5Hash: %v", err)
+			return
+		}
+
+		o.MD5 = new([md5.Size]byte)
+		copy(o.MD5[:], b)
+	}
+
+	if s := field("metadata"); s != "" {
+		if err = json.Unmarshal([]byte(s), &o.Metadata); err != nil {
+			err = fmt.Errorf("metadata: %v", err)
+			return
+		}
+	}
+
+	return
+}
+
+type inventoryBucket struct {
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	wrapped gcs.Bucket
+	clock   timeutil.Clock
+
+	// The time after which the report is no longer used, and the report
+	// itself, which is kept so that listings begun from it can be finished.
+	expiration time.Time
+	report     *snapshotBucket
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// The names of the objects modified through the bucket, whose records in
+	// the report may be out of date.
+	//
+	// GUARDED_BY(mu)
+	modified map[string]struct{}
+}
+
+// Record that the named object may no longer match the report.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *inventoryBucket) modify(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.modified[name] = struct{}{}
+}
+
+// Return true if the report may be used for objects with the supplied
+// prefix, or for the object with that name if exact is set.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *inventoryBucket) useReport(prefix string, exact bool) bool {
+	if !b.clock.Now().Before(b.expiration) {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if exact {
+		_, ok := b.modified[prefix]
+		return !ok
+	}
+
+	for name := range b.modified {
+		if strings.HasPrefix(name, prefix) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (b *inventoryBucket) Name() string {
+	return b.wrapped.Name()
+}
+
+func (b *inventoryBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	rc, err = b.wrapped.NewReader(ctx, req)
+	return
+}
+
+func (b *inventoryBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	b.modify(req.Name)
+	o, err = b.wrapped.CreateObject(ctx, req)
+	return
+}
+
+func (b *inventoryBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	b.modify(req.DstName)
+	o, err = b.wrapped.CopyObject(ctx, req)
+	return
+}
+
+func (b *inventoryBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	b.modify(req.DstName)
+	o, err = b.wrapped.ComposeObjects(ctx, req)
+	return
+}
+
+func (b *inventoryBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	if !b.useReport(req.Name, true) {
+		o, err = b.wrapped.StatObject(ctx, req)
+		return
+	}
+
+	o, err = b.report.StatObject(ctx, req)
+	return
+}
+
+func (b *inventoryBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	// Special case: finish listings begun from the report there, even once
+	// it has expired, as their continuation tokens mean nothing to GCS.
+	if strings.HasPrefix(req.ContinuationToken, inventoryTokenPrefix) {
+		listing, err = b.listReport(ctx, req)
+		return
+	}
+
+	if req.Versions || req.ContinuationToken != "" || !b.useReport(req.Prefix, false) {
+		listing, err = b.wrapped.ListObjects(ctx, req)
+		return
+	}
+
+	listing, err = b.listReport(ctx, req)
+	return
+}
+
+// Serve a listing from the report.
+func (b *inventoryBucket) listReport(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	reportReq := *req
+	reportReq.ContinuationToken = strings.TrimPrefix(
+		req.ContinuationToken,
+		inventoryTokenPrefix)
+
+	listing, err = b.report.ListObjects(ctx, &reportReq)
+	if err != nil {
+		return
+	}
+
+	if listing.ContinuationToken != "" {
+		listing.ContinuationToken = inventoryTokenPrefix + listing.ContinuationToken
+	}
+
+	return
+}
+
+func (b *inventoryBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	b.modify(req.Name)
+	o, err = b.wrapped.UpdateObject(ctx, req)
+	return
+}
+
+func (b *inventoryBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	b.modify(req.Name)
+	err = b.wrapped.DeleteObject(ctx, req)
+	return
+}
@@ -0,0 +1,260 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestInventoryBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const inventoryTTL = time.Hour
+
+type InventoryBucketTest struct {
+	ctx     context.Context
+	clock   timeutil.SimulatedClock
+	dir     string
+	wrapped gcs.Bucket
+	bucket  gcs.Bucket
+
+	// The generation of "a" in the wrapped bucket.
+	generation int64
+
+	// Passed to NewInventoryBucket.
+	spoolThreshold int
+}
+
+var _ SetUpInterface = &InventoryBucketTest{}
+var _ TearDownInterface = &InventoryBucketTest{}
+
+func init() { RegisterTestSuite(&InventoryBucketTest{}) }
+
+// The same tests, with the report kept on disk.
+type SpooledInventoryBucketTest struct {
+	InventoryBucketTest
+}
+
+func init() { RegisterTestSuite(&SpooledInventoryBucketTest{}) }
+
+func (t *SpooledInventoryBucketTest) SetUp(ti *TestInfo) {
+	t.spoolThreshold = 1
+	t.InventoryBucketTest.SetUp(ti)
+}
+
+func (t *InventoryBucketTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC))
+	t.wrapped = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	t.dir, err = ioutil.TempDir("", "inventory_bucket_test")
+	AssertEq(nil, err)
+
+	// Only "a" exists in GCS. The report claims "b/c" and "b/d" do too.
+	o, err := gcsutil.CreateObject(t.ctx, t.wrapped, "a", []byte("taco"))
+	AssertEq(nil, err)
+	t.generation = o.Generation
+
+	report := t.writeReport("report.csv", fmt.Sprintf(
+		"bucket,name,size,generation,updated,crc32c,md5Hash,metadata\n"+
+			"some_bucket,a,4,%d,2017-05-01T00:00:00Z,,,\n"+
+			"some_bucket,b/c,8,17,2017-05-02T00:00:00Z,AAAAKg==,"+
+			"1B2M2Y8AsgTpgAmY7PhCfg==,\"{\"\"k\"\": \"\"v\"\"}\"\n"+
+			"some_bucket,b/d,0,19,,,,\n"+
+			"other_bucket,b/e,0,23,,,,\n",
+		t.generation))
+
+	t.bucket, err = gcsx.NewInventoryBucket(
+		[]string{report},
+		inventoryTTL,
+		&t.clock,
+		t.spoolThreshold,
+		t.dir,
+		t.wrapped)
+
+	AssertEq(nil, err)
+}
+
+func (t *InventoryBucketTest) TearDown() {
+	err := os.RemoveAll(t.dir)
+	AssertEq(nil, err)
+}
+
+// Write a report with the supplied contents, returning its path.
+func (t *InventoryBucketTest) writeReport(name, contents string) string {
+	p := path.Join(t.dir, name)
+	err := ioutil.WriteFile(p, []byte(contents), 0600)
+	AssertEq(nil, err)
+
+	return p
+}
+
+func (t *InventoryBucketTest) load(contents string) (err error) {
+	_, err = gcsx.NewInventoryBucket(
+		[]string{t.writeReport("bad.csv", contents)},
+		inventoryTTL,
+		&t.clock,
+		t.spoolThreshold,
+		t.dir,
+		t.wrapped)
+
+	return
+}
+
+func (t *InventoryBucketTest) list(prefix string) (names []string) {
+	objects, runs, err := gcsutil.ListAll(
+		t.ctx,
+		t.bucket,
+		&gcs.ListObjectsRequest{Prefix: prefix, Delimiter: "/"})
+
+	AssertEq(nil, err)
+
+	for _, o := range objects {
+		names = append(names, o.Name)
+	}
+
+	names = append(names, runs...)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *InventoryBucketTest) StatsServedFromReport() {
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "b/c"})
+	AssertEq(nil, err)
+
+	ExpectEq("b/c", o.Name)
+	ExpectEq(8, o.Size)
+	ExpectEq(17, o.Generation)
+	ExpectEq(1, o.MetaGeneration)
+	ExpectEq(1, o.ComponentCount)
+	ExpectEq(0x2a, o.CRC32C)
+	ExpectNe(nil, o.MD5)
+	ExpectEq("v", o.Metadata["k"])
+	ExpectTrue(
+		o.Updated.Equal(time.Date(2017, 5, 2, 0, 0, 0, 0, time.UTC)),
+		"%v", o.Updated)
+
+	// Objects missing from the report are missing, whatever GCS says.
+	_, err = gcsutil.CreateObject(t.ctx, t.wrapped, "f", []byte(""))
+	AssertEq(nil, err)
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "f"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "b/e"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *InventoryBucketTest) ListingsServedFromReport() {
+	ExpectThat(t.list(""), ElementsAre("a", "b/"))
+	ExpectThat(t.list("b/"), ElementsAre("b/c", "b/d"))
+}
+
+func (t *InventoryBucketTest) ReadsGoToGCS() {
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "a")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *InventoryBucketTest) ModifiedNamesGoToGCS() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "b/c", []byte("burrito"))
+	AssertEq(nil, err)
+
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "b/c"})
+	AssertEq(nil, err)
+	ExpectEq(len("burrito"), o.Size)
+
+	// Listings that would include it go to GCS, others don't.
+	ExpectThat(t.list("b/"), ElementsAre("b/c"))
+	ExpectThat(t.list(""), ElementsAre("a", "b/"))
+	ExpectThat(t.list("a"), ElementsAre("a"))
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "b/d"})
+	ExpectEq(nil, err)
+}
+
+func (t *InventoryBucketTest) ReportExpires() {
+	t.clock.AdvanceTime(inventoryTTL)
+
+	_, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "b/c"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	ExpectThat(t.list(""), ElementsAre("a"))
+}
+
+func (t *InventoryBucketTest) ListingsBegunFromReportFinishThere() {
+	req := &gcs.ListObjectsRequest{Prefix: "b/", MaxResults: 1}
+	l, err := t.bucket.ListObjects(t.ctx, req)
+	AssertEq(nil, err)
+	AssertEq(1, len(l.Objects))
+	ExpectEq("b/c", l.Objects[0].Name)
+	AssertNe("", l.ContinuationToken)
+
+	t.clock.AdvanceTime(inventoryTTL)
+
+	req.ContinuationToken = l.ContinuationToken
+	l, err = t.bucket.ListObjects(t.ctx, req)
+	AssertEq(nil, err)
+	AssertEq(1, len(l.Objects))
+	ExpectEq("b/d", l.Objects[0].Name)
+	ExpectEq("", l.ContinuationToken)
+}
+
+func (t *InventoryBucketTest) BadReports() {
+	testCases := []struct {
+		contents string
+		expected string
+	}{
+		{"name,size\na,4\n", "generation"},
+		{"name,size,generation\na,four,1\n", "Row 2: size"},
+		{"name,size,generation,crc32c\na,4,1,AAAA\n", "Row 2: crc32c"},
+		{"name,size,generation,updated\na,4,1,yesterday\n", "Row 2: updated"},
+		{"name,size,generation\n,4,1\n", "Row 2: Empty name"},
+		{"name,size,generation\na,4\n", "line 2"},
+	}
+
+	for _, tc := range testCases {
+		err := t.load(tc.contents)
+		ExpectThat(err, Error(HasSubstr(tc.expected)), "%q", tc.contents)
+	}
+}
+
+func (t *SpooledInventoryBucketTest) UnsortedReport() {
+	err := t.load("name,size,generation\nb,4,1\nc,4,1\na,4,1\n")
+	ExpectThat(err, Error(HasSubstr("sorted")))
+}
@@ -0,0 +1,551 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// NameMapper translates between the names of objects as seen through a bucket
+// created with NewNameMappingBucket ("local" names) and their names in the
+// wrapped bucket.
+type NameMapper interface {
+	// Return the name in the wrapped bucket of the object with the given local
+	// name.
+	ObjectName(local string) string
+
+	// List objects in the wrapped bucket, with the request and the resulting
+	// listing expressed in terms of local names. Because different layouts may
+	// need quite different listing strategies, this is left to the mapper.
+	ListObjects(
+		ctx context.Context,
+		wrapped gcs.Bucket,
+		req *gcs.ListObjectsRequest) (l *gcs.Listing, err error)
+}
+
+// NameMapping describes a NameMapper made up of a set of rules, each of which
+// applies to the local names beginning with a particular prefix. Local names
+// to which no rule applies are passed through unmodified.
+//
+// Mappings are usually loaded from a JSON file using ParseNameMapping, for
+// example:
+//
+//     {
+//       "rules": [
+//         {"local_prefix": "logs/", "object_prefix": "prod/2017/logs/"},
+//         {"local_prefix": "blobs/", "object_prefix": "blobs/",
+//          "shard_levels": 2, "shard_width": 2}
+//       ]
+//     }
+//
+// With this mapping "logs/foo" is stored as "prod/2017/logs/foo", and
+// "blobs/abcdef/bar" is stored as "blobs/ab/cd/abcdef/bar".
+type NameMapping struct {
+	Rules []NameMappingRule `json:"rules"`
+}
+
+// NameMappingRule describes how to map local names beginning with a prefix.
+type NameMappingRule struct {
+	// The local names to which the rule applies, and the prefix with which it
+	// is replaced in object names. Both must be non-empty and end with a slash.
+	// Where the local prefixes of several rules match, the longest wins.
+	LocalPrefix  string `json:"local_prefix"`
+	ObjectPrefix string `json:"object_prefix"`
+
+	// If positive, the first path component after the prefix is stored beneath
+	// this many levels of shard directories, each named after the next
+	// ShardWidth characters of the component. Components shorter than
+	// ShardLevels*ShardWidth are stored without sharding.
+	//
+	// Listing the rule's local prefix itself must list every object beneath
+	// ObjectPrefix, since the shard directories are hidden.
+	ShardLevels int `json:"shard_levels"`
+	ShardWidth  int `json:"shard_width"`
+}
+
+// ParseNameMapping parses and validates a JSON-encoded name mapping, returning
+// a mapper that implements it.
+func ParseNameMapping(r io.Reader) (m NameMapper, err error) {
+	var nm NameMapping
+	err = json.NewDecoder(r).Decode(&nm)
+	if err != nil {
+		err = fmt.Errorf("Decode: %v", err)
+		return
+	}
+
+	m, err = NewRuleNameMapper(nm.Rules)
+	return
+}
+
+// NewRuleNameMapper creates a mapper that implements the supplied rules. See
+// NameMapping for details.
+func NewRuleNameMapper(rules []NameMappingRule) (m NameMapper, err error) {
+	seen := make(map[string]bool)
+	for i, r := range rules {
+		if !strings.HasSuffix(r.LocalPrefix, "/") ||
+			!strings.HasSuffix(r.ObjectPrefix, "/") {
+			err = fmt.Errorf("Rule %d: prefixes must be non-empty and end with '/'", i)
+			return
+		}
+
+		if seen[r.LocalPrefix] {
+			err = fmt.Errorf("Rule %d: duplicate local prefix %q", i, r.LocalPrefix)
+			return
+		}
+
+		seen[r.LocalPrefix] = true
+
+		if r.ShardLevels < 0 || (r.ShardLevels > 0 && r.ShardWidth <= 0) {
+			err = fmt.Errorf(
+				"Rule %d: illegal sharding %d x %d",
+				i,
+				r.ShardLevels,
+				r.ShardWidth)
+			return
+		}
+	}
+
+	// Sort longest local prefix first, so that the first match wins.
+	sorted := make([]NameMappingRule, len(rules))
+	copy(sorted, rules)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return len(sorted[i].LocalPrefix) > len(sorted[j].LocalPrefix)
+	})
+
+	m = &ruleNameMapper{rules: sorted}
+	return
+}
+
+type ruleNameMapper struct {
+	// INVARIANT: Sorted by decreasing length of LocalPrefix.
+	rules []NameMappingRule
+}
+
+// Return the rule applying to the given local name, or nil if none.
+func (m *ruleNameMapper) ruleFor(local string) *NameMappingRule {
+	for i := range m.rules {
+		if strings.HasPrefix(local, m.rules[i].LocalPrefix) {
+			return &m.rules[i]
+		}
+	}
+
+	return nil
+}
+
+// Return the shard directories for the supplied path component, e.g.
+// "ab/cd/" for "abcdef" with two levels of width two.
+func (r *NameMappingRule) shardDirs(component string) string {
+	n := r.ShardLevels * r.ShardWidth
+	if r.ShardLevels == 0 || len(component) < n {
+		return ""
+	}
+
+	var dirs []string
+	for i := 0; i < n; i += r.ShardWidth {
+		dirs = append(dirs, component[i:i+r.ShardWidth]+"/")
+	}
+
+	return strings.Join(dirs, "")
+}
+
+// Split the portion of an object name after the rule's object prefix into
+// the shard directories and the remainder, checking that they are consistent.
+// Return false if the name is not laid out as the rule dictates.
+func (r *NameMappingRule) unshard(rest string) (local string, ok bool) {
+	if r.ShardLevels == 0 {
+		local = rest
+		ok = true
+		return
+	}
+
+	// Find the first component after the shard directories, assuming that they
+	// are present.
+	parts := strings.SplitN(rest, "/", r.ShardLevels+1)
+	if len(parts) == r.ShardLevels+1 {
+		component := parts[r.ShardLevels]
+		if i := strings.Index(component, "/"); i >= 0 {
+			component = component[:i]
+		}
+
+		dirs := r.shardDirs(component)
+		if dirs != "" && strings.HasPrefix(rest, dirs) {
+			local = strings.TrimPrefix(rest, dirs)
+			ok = true
+			return
+		}
+	}
+
+	// Otherwise this may be a component too short to be sharded. This also
+	// catches objects within shard directories that don't match their contents,
+	// which are thereby shown under their raw names, consistent with
+	// ObjectName.
+	component := rest
+	if i := strings.Index(component, "/"); i >= 0 {
+		component = component[:i]
+	}
+
+	if r.shardDirs(component) == "" {
+		local = rest
+		ok = true
+		return
+	}
+
+	return
+}
+
+func (m *ruleNameMapper) ObjectName(local string) string {
+	r := m.ruleFor(local)
+	if r == nil {
+		return local
+	}
+
+	rest := strings.TrimPrefix(local, r.LocalPrefix)
+	component := rest
+	if i := strings.Index(component, "/"); i >= 0 {
+		component = component[:i]
+	}
+
+	return r.ObjectPrefix + r.shardDirs(component) + rest
+}
+
+func (m *ruleNameMapper) ListObjects(
+	ctx context.Context,
+	wrapped gcs.Bucket,
+	req *gcs.ListObjectsRequest) (l *gcs.Listing, err error) {
+	r := m.ruleFor(req.Prefix)
+
+	switch {
+	// Names outside of all rules are passed through, but rules whose local
+	// prefixes lie directly within the prefix being listed must show up as
+	// directories.
+	case r == nil:
+		l, err = wrapped.ListObjects(ctx, req)
+		if err != nil {
+			return
+		}
+
+		if l.ContinuationToken == "" && req.Delimiter == "/" {
+			m.addRuleDirs(req.Prefix, l)
+		}
+
+	// Within the first path component of a sharded rule, we must walk the
+	// shard directories.
+	case r.ShardLevels > 0 &&
+		!strings.Contains(strings.TrimPrefix(req.Prefix, r.LocalPrefix), "/"):
+		l, err = m.listShards(ctx, wrapped, r, req)
+
+	// Otherwise the prefix maps directly to an object prefix.
+	default:
+		mReq := new(gcs.ListObjectsRequest)
+		*mReq = *req
+		mReq.Prefix = m.ObjectName(req.Prefix)
+
+		// The pattern is for local names. Those under the prefix map directly
+		// to object names, so a pattern beginning with the prefix can be
+		// rewritten. Otherwise we filter the objects ourselves.
+		var glob *gcs.Glob
+		if req.MatchGlob != "" {
+			quoted := gcs.QuoteGlob(req.Prefix)
+			if strings.HasPrefix(req.MatchGlob, quoted) {
+				mReq.MatchGlob =
+					gcs.QuoteGlob(mReq.Prefix) + strings.TrimPrefix(req.MatchGlob, quoted)
+			} else {
+				mReq.MatchGlob = ""
+				glob, err = gcs.ParseGlob(req.MatchGlob)
+				if err != nil {
+					err = fmt.Errorf("ParseGlob: %v", err)
+					return
+				}
+			}
+		}
+
+		l, err = wrapped.ListObjects(ctx, mReq)
+		if err != nil {
+			return
+		}
+
+		objects := l.Objects[:0]
+		for _, o := range l.Objects {
+			o.Name = req.Prefix + strings.TrimPrefix(o.Name, mReq.Prefix)
+			if glob == nil || glob.Match(o.Name) {
+				objects = append(objects, o)
+			}
+		}
+
+		l.Objects = objects
+
+		for i, n := range l.CollapsedRuns {
+			l.CollapsedRuns[i] = req.Prefix + strings.TrimPrefix(n, mReq.Prefix)
+		}
+	}
+
+	return
+}
+
+// Add collapsed runs for the local prefixes of rules that lie directly within
+// the supplied prefix, if they aren't already present.
+func (m *ruleNameMapper) addRuleDirs(prefix string, l *gcs.Listing) {
+	present := make(map[string]bool)
+	for _, n := range l.CollapsedRuns {
+		present[n] = true
+	}
+
+	for _, r := range m.rules {
+		rest := strings.TrimPrefix(r.LocalPrefix, prefix)
+		if !strings.HasPrefix(r.LocalPrefix, prefix) ||
+			strings.Index(rest, "/") != len(rest)-1 ||
+			present[r.LocalPrefix] {
+			continue
+		}
+
+		l.CollapsedRuns = append(l.CollapsedRuns, r.LocalPrefix)
+		present[r.LocalPrefix] = true
+	}
+
+	sort.Strings(l.CollapsedRuns)
+}
+
+// List beneath a sharded rule's object prefix without a delimiter, hiding the
+// shard directories and matching and collapsing runs ourselves. Continuation tokens are
+// those of the wrapped bucket. Each page is sorted, but the listing as a
+// whole is ordered by shard, and a collapsed run may appear in more than one
+// page.
+func (m *ruleNameMapper) listShards(
+	ctx context.Context,
+	wrapped gcs.Bucket,
+	r *NameMappingRule,
+	req *gcs.ListObjectsRequest) (l *gcs.Listing, err error) {
+	var glob *gcs.Glob
+	if req.MatchGlob != "" {
+		glob, err = gcs.ParseGlob(req.MatchGlob)
+		if err != nil {
+			err = fmt.Errorf("ParseGlob: %v", err)
+			return
+		}
+	}
+
+	wl, err := wrapped.ListObjects(
+		ctx,
+		&gcs.ListObjectsRequest{
+			Prefix:            r.ObjectPrefix,
+			ContinuationToken: req.ContinuationToken,
+			MaxResults:        req.MaxResults,
+		})
+
+	if err != nil {
+		return
+	}
+
+	l = &gcs.Listing{
+		ContinuationToken: wl.ContinuationToken,
+	}
+
+	runs := make(map[string]bool)
+	for _, o := range wl.Objects {
+		rest, ok := r.unshard(strings.TrimPrefix(o.Name, r.ObjectPrefix))
+		if !ok {
+			continue
+		}
+
+		local := r.LocalPrefix + rest
+		if !strings.HasPrefix(local, req.Prefix) ||
+			(glob != nil && !glob.Match(local)) {
+			continue
+		}
+
+		// Collapse runs, if requested.
+		if req.Delimiter != "" {
+			after := strings.TrimPrefix(local, req.Prefix)
+			if i := strings.Index(after, req.Delimiter); i >= 0 {
+				run := req.Prefix + after[:i+len(req.Delimiter)]
+				if !runs[run] {
+					runs[run] = true
+					l.CollapsedRuns = append(l.CollapsedRuns, run)
+				}
+
+				continue
+			}
+		}
+
+		o.Name = local
+		l.Objects = append(l.Objects, o)
+	}
+
+	sort.Slice(l.Objects, func(i, j int) bool {
+		return l.Objects[i].Name < l.Objects[j].Name
+	})
+
+	sort.Strings(l.CollapsedRuns)
+	return
+}
+
+// NewNameMappingBucket creates a view on the wrapped bucket in which objects
+// are named according to the supplied mapper. This allows buckets with
+// layouts that are awkward to browse, such as hash-sharded prefixes, to be
+// presented as logical trees.
+func NewNameMappingBucket(
+	m NameMapper,
+	wrapped gcs.Bucket) (b gcs.Bucket) {
+	b = &nameMappingBucket{
+		mapper:  m,
+		wrapped: wrapped,
+	}
+
+	return
+}
+
+type nameMappingBucket struct {
+	mapper  NameMapper
+	wrapped gcs.Bucket
+}
+
+func (b *nameMappingBucket) Name() string {
+	return b.wrapped.Name()
+}
+
+func (b *nameMappingBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	// Modify the request and call through.
+	mReq := new(gcs.ReadObjectRequest)
+	*mReq = *req
+	mReq.Name = b.mapper.ObjectName(req.Name)
+
+	rc, err = b.wrapped.NewReader(ctx, mReq)
+	return
+}
+
+func (b *nameMappingBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	// Modify the request and call through.
+	mReq := new(gcs.CreateObjectRequest)
+	*mReq = *req
+	mReq.Name = b.mapper.ObjectName(req.Name)
+
+	o, err = b.wrapped.CreateObject(ctx, mReq)
+
+	// Modify the returned object.
+	if o != nil {
+		o.Name = req.Name
+	}
+
+	return
+}
+
+func (b *nameMappingBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	// Modify the request and call through.
+	mReq := new(gcs.CopyObjectRequest)
+	*mReq = *req
+	mReq.SrcName = b.mapper.ObjectName(req.SrcName)
+	mReq.DstName = b.mapper.ObjectName(req.DstName)
+
+	o, err = b.wrapped.CopyObject(ctx, mReq)
+
+	// Modify the returned object.
+	if o != nil {
+		o.Name = req.DstName
+	}
+
+	return
+}
+
+func (b *nameMappingBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	// Modify the request and call through.
+	mReq := new(gcs.ComposeObjectsRequest)
+	*mReq = *req
+	mReq.DstName = b.mapper.ObjectName(req.DstName)
+
+	mReq.Sources = nil
+	for _, s := range req.Sources {
+		s.Name = b.mapper.ObjectName(s.Name)
+		mReq.Sources = append(mReq.Sources, s)
+	}
+
+	o, err = b.wrapped.ComposeObjects(ctx, mReq)
+
+	// Modify the returned object.
+	if o != nil {
+		o.Name = req.DstName
+	}
+
+	return
+}
+
+func (b *nameMappingBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	// Modify the request and call through.
+	mReq := new(gcs.StatObjectRequest)
+	*mReq = *req
+	mReq.Name = b.mapper.ObjectName(req.Name)
+
+	o, err = b.wrapped.StatObject(ctx, mReq)
+
+	// Modify the returned object.
+	if o != nil {
+		o.Name = req.Name
+	}
+
+	return
+}
+
+func (b *nameMappingBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (l *gcs.Listing, err error) {
+	l, err = b.mapper.ListObjects(ctx, b.wrapped, req)
+	return
+}
+
+func (b *nameMappingBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	// Modify the request and call through.
+	mReq := new(gcs.UpdateObjectRequest)
+	*mReq = *req
+	mReq.Name = b.mapper.ObjectName(req.Name)
+
+	o, err = b.wrapped.UpdateObject(ctx, mReq)
+
+	// Modify the returned object.
+	if o != nil {
+		o.Name = req.Name
+	}
+
+	return
+}
+
+func (b *nameMappingBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	// Modify the request and call through.
+	mReq := new(gcs.DeleteObjectRequest)
+	*mReq = *req
+	mReq.Name = b.mapper.ObjectName(req.Name)
+
+	err = b.wrapped.DeleteObject(ctx, mReq)
+	return
+}
@@ -0,0 +1,255 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestNameMapping(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const nameMappingSpec = `
+{
+	"rules": [
+		{"local_prefix": "logs/", "object_prefix": "prod/logs/"},
+		{"local_prefix": "blobs/", "object_prefix": "blobs/",
+		 "shard_levels": 2, "shard_width": 2}
+	]
+}
+`
+
+type NameMappingTest struct {
+	ctx     context.Context
+	wrapped gcs.Bucket
+	bucket  gcs.Bucket
+}
+
+var _ SetUpInterface = &NameMappingTest{}
+
+func init() { RegisterTestSuite(&NameMappingTest{}) }
+
+func (t *NameMappingTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.wrapped = gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket")
+
+	m, err := gcsx.ParseNameMapping(strings.NewReader(nameMappingSpec))
+	AssertEq(nil, err)
+
+	t.bucket = gcsx.NewNameMappingBucket(m, t.wrapped)
+}
+
+// List the given prefix in the supplied bucket with a slash delimiter,
+// returning object names and collapsed runs.
+func (t *NameMappingTest) list(
+	b gcs.Bucket,
+	prefix string) (names []string, runs []string) {
+	names, runs = t.listMatching(b, prefix, "")
+	return
+}
+
+// Like list, but with the supplied MatchGlob.
+func (t *NameMappingTest) listMatching(
+	b gcs.Bucket,
+	prefix string,
+	glob string) (names []string, runs []string) {
+	l, err := b.ListObjects(
+		t.ctx,
+		&gcs.ListObjectsRequest{
+			Prefix:    prefix,
+			Delimiter: "/",
+			MatchGlob: glob,
+		})
+
+	AssertEq(nil, err)
+	AssertEq("", l.ContinuationToken)
+
+	for _, o := range l.Objects {
+		names = append(names, o.Name)
+	}
+
+	runs = l.CollapsedRuns
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *NameMappingTest) InvalidSpecs() {
+	specs := []string{
+		`{"rules": [{"local_prefix": "foo", "object_prefix": "bar/"}]}`,
+		`{"rules": [{"local_prefix": "foo/", "object_prefix": ""}]}`,
+		`{"rules": [
+			{"local_prefix": "foo/", "object_prefix": "bar/"},
+			{"local_prefix": "foo/", "object_prefix": "baz/"}
+		]}`,
+		`{"rules": [
+			{"local_prefix": "foo/", "object_prefix": "bar/", "shard_levels": 1}
+		]}`,
+		`{"rules": `,
+	}
+
+	for _, s := range specs {
+		_, err := gcsx.ParseNameMapping(strings.NewReader(s))
+		ExpectNe(nil, err, "spec: %s", s)
+	}
+}
+
+func (t *NameMappingTest) PrefixRewrite() {
+	// Create through the mapping bucket.
+	o, err := gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		"logs/2017/taco",
+		[]byte("burrito"))
+
+	AssertEq(nil, err)
+	ExpectEq("logs/2017/taco", o.Name)
+
+	// It should be stored under the mapped name.
+	contents, err := gcsutil.ReadObject(t.ctx, t.wrapped, "prod/logs/2017/taco")
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+
+	// And read back and statted under the local name.
+	contents, err = gcsutil.ReadObject(t.ctx, t.bucket, "logs/2017/taco")
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+
+	o, err = t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "logs/2017/taco"})
+
+	AssertEq(nil, err)
+	ExpectEq("logs/2017/taco", o.Name)
+}
+
+func (t *NameMappingTest) ShardedNames() {
+	_, err := gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		"blobs/abcdef/meta",
+		[]byte("taco"))
+
+	AssertEq(nil, err)
+
+	// Components too short to shard are stored as is.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "blobs/abc", []byte("burrito"))
+	AssertEq(nil, err)
+
+	_, err = gcsutil.ReadObject(t.ctx, t.wrapped, "blobs/ab/cd/abcdef/meta")
+	ExpectEq(nil, err)
+
+	_, err = gcsutil.ReadObject(t.ctx, t.wrapped, "blobs/abc")
+	ExpectEq(nil, err)
+}
+
+func (t *NameMappingTest) ListUnmappedRoot() {
+	_, err := gcsutil.CreateObject(t.ctx, t.wrapped, "foo", []byte(""))
+	AssertEq(nil, err)
+
+	// The local prefixes of rules show up as directories, even with no objects
+	// beneath them.
+	names, runs := t.list(t.bucket, "")
+	ExpectThat(names, ElementsAre("foo"))
+	ExpectThat(runs, ElementsAre("blobs/", "logs/"))
+}
+
+func (t *NameMappingTest) ListWithinPrefixRewrite() {
+	_, err := gcsutil.CreateObject(t.ctx, t.wrapped, "prod/logs/a", []byte(""))
+	AssertEq(nil, err)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.wrapped, "prod/logs/b/c", []byte(""))
+	AssertEq(nil, err)
+
+	names, runs := t.list(t.bucket, "logs/")
+	ExpectThat(names, ElementsAre("logs/a"))
+	ExpectThat(runs, ElementsAre("logs/b/"))
+}
+
+func (t *NameMappingTest) ListShardRoot() {
+	objects := []string{
+		"blobs/ab/cd/abcdef/meta",
+		"blobs/ab/cd/abcdzz",
+		"blobs/12/34/123456/data",
+		"blobs/abc",
+
+		// Not laid out as the rule dictates, so shown under its raw name.
+		"blobs/ab/cd/xxxxxx",
+	}
+
+	for _, name := range objects {
+		_, err := gcsutil.CreateObject(t.ctx, t.wrapped, name, []byte(""))
+		AssertEq(nil, err)
+	}
+
+	names, runs := t.list(t.bucket, "blobs/")
+	ExpectThat(names, ElementsAre("blobs/abc", "blobs/abcdzz"))
+	ExpectThat(runs, ElementsAre("blobs/123456/", "blobs/ab/", "blobs/abcdef/"))
+
+	// Listing within a sharded component maps directly.
+	names, runs = t.list(t.bucket, "blobs/abcdef/")
+	ExpectThat(names, ElementsAre("blobs/abcdef/meta"))
+	ExpectThat(runs, ElementsAre())
+}
+
+func (t *NameMappingTest) ListMatchingGlob() {
+	objects := []string{
+		"prod/logs/a.txt",
+		"prod/logs/b.csv",
+		"prod/logs/c/d.txt",
+		"blobs/ab/cd/abcdef.txt",
+		"blobs/12/34/123456.csv",
+	}
+
+	for _, name := range objects {
+		_, err := gcsutil.CreateObject(t.ctx, t.wrapped, name, []byte(""))
+		AssertEq(nil, err)
+	}
+
+	// Patterns within a rewritten prefix are rewritten with it.
+	names, runs := t.listMatching(t.bucket, "logs/", "logs/*.txt")
+	ExpectThat(names, ElementsAre("logs/a.txt"))
+	ExpectThat(runs, ElementsAre())
+
+	names, runs = t.listMatching(t.bucket, "logs/", "logs/**.txt")
+	ExpectThat(names, ElementsAre("logs/a.txt"))
+	ExpectThat(runs, ElementsAre("logs/c/"))
+
+	// Others are matched against local names.
+	names, runs = t.listMatching(t.bucket, "logs/", "*/a.*")
+	ExpectThat(names, ElementsAre("logs/a.txt"))
+	ExpectThat(runs, ElementsAre("logs/c/"))
+
+	// As are the unsharded names of sharded objects.
+	names, runs = t.listMatching(t.bucket, "blobs/", "blobs/*.txt")
+	ExpectThat(names, ElementsAre("blobs/abcdef.txt"))
+	ExpectThat(runs, ElementsAre())
+}
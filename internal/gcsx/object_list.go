@@ -0,0 +1,275 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fsutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+)
+
+// An immutable sequence of object records, sorted by name. Safe for
+// concurrent use.
+type objectList interface {
+	Len() int
+
+	// Return the name of the i'th object.
+	Name(i int) (name string, err error)
+
+	// Return a copy of the i'th object's record, which the caller may modify.
+	Object(i int) (o *gcs.Object, err error)
+}
+
+// Return the index of the first object in the list whose name is at least the
+// given one, or l.Len() if there is none.
+func searchObjects(l objectList, name string) (i int, err error) {
+	i = sort.Search(l.Len(), func(j int) bool {
+		// Once we've failed, steer the search towards the end.
+		if err != nil {
+			return true
+		}
+
+		var n string
+		n, err = l.Name(j)
+		return n >= name
+	})
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// In memory
+////////////////////////////////////////////////////////////////////////
+
+type memObjectList []*gcs.Object
+
+func (l memObjectList) Len() int {
+	return len(l)
+}
+
+func (l memObjectList) Name(i int) (name string, err error) {
+	name = l[i].Name
+	return
+}
+
+func (l memObjectList) Object(i int) (o *gcs.Object, err error) {
+	o = new(gcs.Object)
+	*o = *l[i]
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// On disk
+////////////////////////////////////////////////////////////////////////
+
+// An objectList kept in anonymous temporary files rather than memory, so that
+// lists of millions of objects don't cost more than a few bytes of memory.
+//
+// The data file holds a record for each object in turn: a 4-byte length and
+// the object's name, followed by a 4-byte length and the JSON encoding of its
+// record. The index file holds the 8-byte offset within the data file of each
+// object's record, so that the i'th object can be found by reading offset
+// 8*i. All integers are big-endian.
+type spooledObjectList struct {
+	data  *os.File
+	index *os.File
+	n     int
+}
+
+// Build a spooledObjectList, in temporary files within the supplied directory
+// (or the system default if empty), by supplying objects in sorted order to
+// Append and then calling Finish.
+type spoolWriter struct {
+	l      *spooledObjectList
+	data   *bufio.Writer
+	index  *bufio.Writer
+	offset int64
+}
+
+func newSpoolWriter(dir string) (w *spoolWriter, err error) {
+	l := &spooledObjectList{}
+
+	l.data, err = fsutil.AnonymousFile(dir)
+	if err != nil {
+		err = fmt.Errorf("AnonymousFile: %v", err)
+		return
+	}
+
+	l.index, err = fsutil.AnonymousFile(dir)
+	if err != nil {
+		l.data.Close()
+		err = fmt.Errorf("AnonymousFile: %v", err)
+		return
+	}
+
+	w = &spoolWriter{
+		l:     l,
+		data:  bufio.NewWriter(l.data),
+		index: bufio.NewWriter(l.index),
+	}
+
+	return
+}
+
+func (w *spoolWriter) writeChunk(p []byte) (err error) {
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(p)))
+
+	if _, err = w.data.Write(header[:]); err != nil {
+		return
+	}
+
+	if _, err = w.data.Write(p); err != nil {
+		return
+	}
+
+	w.offset += int64(len(header) + len(p))
+	return
+}
+
+// Append an object, whose name must sort after that of the previous one.
+func (w *spoolWriter) Append(o *gcs.Object) (err error) {
+	encoded, err := json.Marshal(o)
+	if err != nil {
+		err = fmt.Errorf("Marshal: %v", err)
+		return
+	}
+
+	var offset [8]byte
+	binary.BigEndian.PutUint64(offset[:], uint64(w.offset))
+	if _, err = w.index.Write(offset[:]); err != nil {
+		err = fmt.Errorf("Writing index: %v", err)
+		return
+	}
+
+	if err = w.writeChunk([]byte(o.Name)); err != nil {
+		err = fmt.Errorf("Writing name: %v", err)
+		return
+	}
+
+	if err = w.writeChunk(encoded); err != nil {
+		err = fmt.Errorf("Writing record: %v", err)
+		return
+	}
+
+	w.l.n++
+	return
+}
+
+// Finish writing, returning the list.
+func (w *spoolWriter) Finish() (l objectList, err error) {
+	if err = w.data.Flush(); err != nil {
+		err = fmt.Errorf("Flushing data: %v", err)
+		return
+	}
+
+	if err = w.index.Flush(); err != nil {
+		err = fmt.Errorf("Flushing index: %v", err)
+		return
+	}
+
+	l = w.l
+	return
+}
+
+// Discard the partially written list.
+func (w *spoolWriter) Abandon() {
+	w.l.data.Close()
+	w.l.index.Close()
+}
+
+func (l *spooledObjectList) Len() int {
+	return l.n
+}
+
+// Read the length-prefixed chunk at the given offset in the data file,
+// returning the offset following it.
+func (l *spooledObjectList) readChunk(
+	offset int64) (p []byte, next int64, err error) {
+	var header [4]byte
+	if _, err = l.data.ReadAt(header[:], offset); err != nil {
+		return
+	}
+
+	p = make([]byte, binary.BigEndian.Uint32(header[:]))
+	if _, err = l.data.ReadAt(p, offset+int64(len(header))); err != nil {
+		return
+	}
+
+	next = offset + int64(len(header)+len(p))
+	return
+}
+
+// Return the offset of the i'th object's record in the data file.
+func (l *spooledObjectList) offset(i int) (offset int64, err error) {
+	var buf [8]byte
+	if _, err = l.index.ReadAt(buf[:], int64(i)*int64(len(buf))); err != nil {
+		err = fmt.Errorf("Reading index: %v", err)
+		return
+	}
+
+	offset = int64(binary.BigEndian.Uint64(buf[:]))
+	return
+}
+
+func (l *spooledObjectList) Name(i int) (name string, err error) {
+	offset, err := l.offset(i)
+	if err != nil {
+		return
+	}
+
+	p, _, err := l.readChunk(offset)
+	if err != nil {
+		err = fmt.Errorf("Reading name: %v", err)
+		return
+	}
+
+	name = string(p)
+	return
+}
+
+func (l *spooledObjectList) Object(i int) (o *gcs.Object, err error) {
+	offset, err := l.offset(i)
+	if err != nil {
+		return
+	}
+
+	// Skip the name.
+	_, offset, err = l.readChunk(offset)
+	if err != nil {
+		err = fmt.Errorf("Reading name: %v", err)
+		return
+	}
+
+	p, _, err := l.readChunk(offset)
+	if err != nil {
+		err = fmt.Errorf("Reading record: %v", err)
+		return
+	}
+
+	o = new(gcs.Object)
+	if err = json.Unmarshal(p, o); err != nil {
+		err = fmt.Errorf("Unmarshal: %v", err)
+		return
+	}
+
+	return
+}
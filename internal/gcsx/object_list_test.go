@@ -0,0 +1,119 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestObjectList(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type SpooledObjectListTest struct {
+	l objectList
+}
+
+var _ SetUpInterface = &SpooledObjectListTest{}
+
+func init() { RegisterTestSuite(&SpooledObjectListTest{}) }
+
+func (t *SpooledObjectListTest) SetUp(ti *TestInfo) {
+	w, err := newSpoolWriter("")
+	AssertEq(nil, err)
+
+	md5 := [16]byte{17}
+	objects := []*gcs.Object{
+		&gcs.Object{Name: "bar", Size: 4},
+		&gcs.Object{
+			Name:       "foo",
+			Size:       7,
+			MD5:        &md5,
+			CRC32C:     19,
+			Metadata:   map[string]string{"taco": "burrito"},
+			Generation: 23,
+			Updated:    time.Date(2015, 4, 5, 2, 15, 0, 0, time.UTC),
+		},
+		&gcs.Object{Name: "foo/bar"},
+	}
+
+	for _, o := range objects {
+		AssertEq(nil, w.Append(o))
+	}
+
+	t.l, err = w.Finish()
+	AssertEq(nil, err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *SpooledObjectListTest) Names() {
+	AssertEq(3, t.l.Len())
+
+	var names []string
+	for i := 0; i < t.l.Len(); i++ {
+		name, err := t.l.Name(i)
+		AssertEq(nil, err)
+		names = append(names, name)
+	}
+
+	ExpectThat(names, ElementsAre("bar", "foo", "foo/bar"))
+}
+
+func (t *SpooledObjectListTest) Records() {
+	o, err := t.l.Object(1)
+	AssertEq(nil, err)
+
+	ExpectEq("foo", o.Name)
+	ExpectEq(7, o.Size)
+	AssertNe(nil, o.MD5)
+	ExpectEq(17, o.MD5[0])
+	ExpectEq(19, o.CRC32C)
+	ExpectThat(o.Metadata, DeepEquals(map[string]string{"taco": "burrito"}))
+	ExpectEq(23, o.Generation)
+	ExpectThat(
+		o.Updated,
+		timeutil.TimeEq(time.Date(2015, 4, 5, 2, 15, 0, 0, time.UTC)))
+}
+
+func (t *SpooledObjectListTest) Search() {
+	testCases := []struct {
+		name     string
+		expected int
+	}{
+		{"", 0},
+		{"bar", 0},
+		{"baz", 1},
+		{"foo", 1},
+		{"foo/", 2},
+		{"zzz", 3},
+	}
+
+	for _, tc := range testCases {
+		i, err := searchObjects(t.l, tc.name)
+		AssertEq(nil, err)
+		ExpectEq(tc.expected, i, "Name: %q", tc.name)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"net/http"
+
+	"golang.org/x/net/context"
+)
+
+// OperationIDHeader is the header in which NewOperationIDTransport sends
+// operation IDs. GCS records headers with the X-Goog-Custom-Audit- prefix in
+// its data access audit logs, so requests can be found there by ID.
+const OperationIDHeader = "X-Goog-Custom-Audit-Gcsfuse-Operation"
+
+type operationIDKey struct{}
+
+// WithOperationID returns a context carrying the supplied ID, to be sent with
+// every request to GCS made with it through a transport returned by
+// NewOperationIDTransport.
+func WithOperationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, operationIDKey{}, id)
+}
+
+// OperationID returns the ID carried by the supplied context, or the empty
+// string if it has none.
+func OperationID(ctx context.Context) (id string) {
+	id, _ = ctx.Value(operationIDKey{}).(string)
+	return
+}
+
+// Return a context that is never cancelled, carrying the operation ID of the
+// supplied one, for requests that outlive the operation that made them.
+func detachedContext(ctx context.Context) context.Context {
+	return WithOperationID(context.Background(), OperationID(ctx))
+}
+
+// NewOperationIDTransport returns a transport that sets OperationIDHeader on
+// requests whose contexts carry an operation ID (see WithOperationID), and
+// otherwise passes them to the wrapped transport unmodified.
+func NewOperationIDTransport(wrapped http.RoundTripper) *OperationIDTransport {
+	return &OperationIDTransport{wrapped: wrapped}
+}
+
+// OperationIDTransport is the transport returned by NewOperationIDTransport.
+type OperationIDTransport struct {
+	wrapped http.RoundTripper
+}
+
+func (t *OperationIDTransport) RoundTrip(
+	req *http.Request) (resp *http.Response, err error) {
+	if id := OperationID(req.Context()); id != "" {
+		// A round tripper mustn't modify the request it is given.
+		req = req.Clone(req.Context())
+		req.Header.Set(OperationIDHeader, id)
+	}
+
+	resp, err = t.wrapped.RoundTrip(req)
+	return
+}
+
+// CancelRequest cancels an in-flight request, if the wrapped transport
+// supports it. Requests with operation IDs are cancelled through their
+// contexts instead.
+func (t *OperationIDTransport) CancelRequest(req *http.Request) {
+	if c, ok := t.wrapped.(interface{ CancelRequest(*http.Request) }); ok {
+		c.CancelRequest(req)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/httputil"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+)
+
+func TestOperationID(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A transport that records the requests it is given.
+type recordingTransport struct {
+	reqs []*http.Request
+}
+
+func (t *recordingTransport) RoundTrip(
+	req *http.Request) (resp *http.Response, err error) {
+	t.reqs = append(t.reqs, req)
+	resp = &http.Response{StatusCode: http.StatusOK, Request: req}
+	return
+}
+
+type OperationIDTest struct {
+	ctx       context.Context
+	wrapped   recordingTransport
+	transport http.RoundTripper
+}
+
+var _ SetUpInterface = &OperationIDTest{}
+
+func init() { RegisterTestSuite(&OperationIDTest{}) }
+
+func (t *OperationIDTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.transport = gcsx.NewOperationIDTransport(&t.wrapped)
+}
+
+// Send a request made as the gcs package makes them, with the supplied
+// context.
+func (t *OperationIDTest) send(ctx context.Context) (req *http.Request) {
+	u, err := url.Parse("https://storage.googleapis.com/storage/v1/b/foo")
+	AssertEq(nil, err)
+
+	req, err = httputil.NewRequest(ctx, "GET", u, nil, 0, "gcsfuse")
+	AssertEq(nil, err)
+
+	_, err = t.transport.RoundTrip(req)
+	AssertEq(nil, err)
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *OperationIDTest) NoID() {
+	req := t.send(t.ctx)
+
+	AssertEq(1, len(t.wrapped.reqs))
+	ExpectEq(req, t.wrapped.reqs[0])
+	ExpectEq("", t.wrapped.reqs[0].Header.Get(gcsx.OperationIDHeader))
+}
+
+func (t *OperationIDTest) ID() {
+	ctx := gcsx.WithOperationID(t.ctx, "taco-17")
+	ExpectEq("taco-17", gcsx.OperationID(ctx))
+	ExpectEq("", gcsx.OperationID(t.ctx))
+
+	req := t.send(ctx)
+
+	AssertEq(1, len(t.wrapped.reqs))
+	ExpectEq("taco-17", t.wrapped.reqs[0].Header.Get(gcsx.OperationIDHeader))
+	ExpectEq("gcsfuse", t.wrapped.reqs[0].Header.Get("User-Agent"))
+
+	// The caller's request is left alone.
+	ExpectEq("", req.Header.Get(gcsx.OperationIDHeader))
+}
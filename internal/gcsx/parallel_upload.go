@@ -0,0 +1,348 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/syncutil"
+	"golang.org/x/net/context"
+)
+
+// The smallest part into which a parallel upload splits contents, so that
+// the requests for a part don't cost more than uploading it saves.
+const MinParallelUploadPartSize = 8 * MB
+
+// ParallelUpload says how NewParallelSyncer uploads the contents of large
+// files. The zero value uploads every file with a single request.
+type ParallelUpload struct {
+	// The maximum number of parts to upload at once. Values less than two
+	// disable parallel uploads.
+	Streams int
+
+	// The size of each part. Contents that would need more than
+	// gcs.MaxComponentCount parts are split into larger ones. If zero,
+	// contents are instead split into Streams parts (but at most
+	// gcs.MaxSourcesPerComposeRequest), each at least
+	// MinParallelUploadPartSize.
+	ChunkSize int64
+
+	// Contents smaller than this are uploaded with a single request.
+	Threshold int64
+
+	// Unless this is set, only new files (those whose source objects are
+	// empty) are uploaded in parts, and existing objects are rewritten with a
+	// single request so that they don't lose their MD5 hashes.
+	RewriteExisting bool
+}
+
+// An object creator that splits contents into parts, uploads the parts
+// concurrently as temporary objects, and composes them over the source
+// object. A single upload stream is limited to well below what a machine's
+// network can carry, so this finishes large uploads several times sooner.
+// The resulting object is composite, so GCS reports a CRC32C for it but no
+// MD5.
+//
+// If there are more parts than gcs.MaxSourcesPerComposeRequest, runs of them
+// are first composed into further temporary objects.
+//
+// As with appendObjectCreator, temporary objects are deleted afterwards if
+// possible, and *gcs.PreconditionError is returned if the source object has
+// been clobbered. Unlike for appends the source object isn't itself composed,
+// so a missing source can only be a temporary object that was deleted out
+// from under us (e.g. by an overzealous garbage collector). That's no
+// conflict, so it is reported as an ordinary error, and a later sync will try
+// again.
+type parallelObjectCreator struct {
+	prefix string
+	bucket gcs.Bucket
+
+	// If chunkSize is non-zero, contents are split into parts of that size.
+	// Otherwise they are split into at most parts parts, at most
+	// gcs.MaxSourcesPerComposeRequest.
+	parts     int
+	chunkSize int64
+
+	// The maximum number of parts to upload at once.
+	streams int
+}
+
+func newParallelObjectCreator(
+	prefix string,
+	pu ParallelUpload,
+	bucket gcs.Bucket) (oc *parallelObjectCreator) {
+	if pu.Streams < 1 {
+		pu.Streams = 1
+	}
+
+	oc = &parallelObjectCreator{
+		prefix:    prefix,
+		bucket:    bucket,
+		chunkSize: pu.ChunkSize,
+		streams:   pu.Streams,
+	}
+
+	if oc.chunkSize == 0 {
+		oc.parts = pu.Streams
+		if oc.parts > gcs.MaxSourcesPerComposeRequest {
+			oc.parts = gcs.MaxSourcesPerComposeRequest
+		}
+
+		oc.streams = oc.parts
+	}
+
+	return
+}
+
+// Return the size of each part into which contents of the given size are
+// split; the last may be smaller.
+func (oc *parallelObjectCreator) partSize(size int64) (n int64) {
+	// Special case: fixed-size parts, as long as there aren't more than a
+	// composite object may have.
+	if oc.chunkSize > 0 {
+		n = oc.chunkSize
+		if min := (size + gcs.MaxComponentCount - 1) / gcs.MaxComponentCount; n < min {
+			n = min
+		}
+
+		return
+	}
+
+	n = (size + int64(oc.parts) - 1) / int64(oc.parts)
+	if n < MinParallelUploadPartSize {
+		n = MinParallelUploadPartSize
+	}
+
+	return
+}
+
+func (oc *parallelObjectCreator) Create(
+	ctx context.Context,
+	srcObject *gcs.Object,
+	mtime time.Time,
+	content io.ReaderAt,
+	size int64) (o *gcs.Object, err error) {
+	partSize := oc.partSize(size)
+	n := int((size + partSize - 1) / partSize)
+
+	// Upload the parts, handing them out to a fixed number of workers.
+	tmps := make([]*gcs.Object, n)
+	b := syncutil.NewBundle(ctx)
+
+	indices := make(chan int)
+	b.Add(func(ctx context.Context) (err error) {
+		defer close(indices)
+		for i := 0; i < n; i++ {
+			select {
+			case indices <- i:
+			case <-ctx.Done():
+				err = ctx.Err()
+				return
+			}
+		}
+
+		return
+	})
+
+	for i := 0; i < oc.streams; i++ {
+		b.Add(func(ctx context.Context) (err error) {
+			for i := range indices {
+				tmps[i], err = oc.uploadPart(ctx, content, int64(i)*partSize, partSize)
+				if err != nil {
+					return
+				}
+			}
+
+			return
+		})
+	}
+
+	err = b.Join()
+
+	// Attempt to delete the temporary objects when we're done.
+	defer func() {
+		for _, tmp := range tmps {
+			if tmp == nil {
+				continue
+			}
+
+			deleteErr := oc.bucket.DeleteObject(
+				ctx,
+				&gcs.DeleteObjectRequest{
+					Name: tmp.Name,
+				})
+
+			if err == nil && deleteErr != nil {
+				err = fmt.Errorf("DeleteObject: %v", deleteErr)
+			}
+		}
+	}()
+
+	if err != nil {
+		return
+	}
+
+	// If there are too many parts to compose at once, compose them in runs
+	// first.
+	sources := tmps
+	if len(sources) > gcs.MaxSourcesPerComposeRequest {
+		sources, err = oc.composeRuns(ctx, tmps)
+		tmps = append(tmps, sources...)
+		if err != nil {
+			return
+		}
+	}
+
+	// Compose the parts over the source object.
+	req := &gcs.ComposeObjectsRequest{
+		DstName:                       srcObject.Name,
+		DstGenerationPrecondition:     &srcObject.Generation,
+		DstMetaGenerationPrecondition: &srcObject.MetaGeneration,
+		Metadata: map[string]string{
+			MtimeMetadataKey: mtime.Format(time.RFC3339Nano),
+		},
+	}
+
+	for _, tmp := range sources {
+		req.Sources = append(req.Sources, gcs.ComposeSource{
+			Name:       tmp.Name,
+			Generation: tmp.Generation,
+		})
+	}
+
+	o, err = oc.bucket.ComposeObjects(ctx, req)
+
+	switch typed := err.(type) {
+	case nil:
+
+	case *gcs.PreconditionError:
+		err = &gcs.PreconditionError{
+			Err: fmt.Errorf("ComposeObjects: %v", typed.Err),
+		}
+		return
+
+	// One of our temporary objects has gone missing. Don't wrap the error in a
+	// way that lets callers mistake it for the file's object being missing.
+	case *gcs.NotFoundError:
+		err = fmt.Errorf("ComposeObjects: temporary object missing: %v", err)
+		return
+
+	default:
+		err = fmt.Errorf("ComposeObjects: %w", err)
+		return
+	}
+
+	return
+}
+
+// Upload the given range of the contents as a temporary object.
+func (oc *parallelObjectCreator) uploadPart(
+	ctx context.Context,
+	content io.ReaderAt,
+	offset int64,
+	length int64) (o *gcs.Object, err error) {
+	name, err := chooseTmpObjectName(oc.prefix)
+	if err != nil {
+		err = fmt.Errorf("chooseTmpObjectName: %v", err)
+		return
+	}
+
+	var zero int64
+	o, err = oc.bucket.CreateObject(
+		ctx,
+		&gcs.CreateObjectRequest{
+			Name:                   name,
+			GenerationPrecondition: &zero,
+			Contents:               io.NewSectionReader(content, offset, length),
+		})
+
+	if err != nil {
+		err = fmt.Errorf("CreateObject: %w", err)
+		return
+	}
+
+	return
+}
+
+// Compose each run of up to gcs.MaxSourcesPerComposeRequest of the supplied
+// parts into a temporary object, returning those objects in order. Entries
+// are nil for runs that failed.
+func (oc *parallelObjectCreator) composeRuns(
+	ctx context.Context,
+	parts []*gcs.Object) (runs []*gcs.Object, err error) {
+	const max = gcs.MaxSourcesPerComposeRequest
+	runs = make([]*gcs.Object, (len(parts)+max-1)/max)
+
+	b := syncutil.NewBundle(ctx)
+	for i := range runs {
+		i := i
+		end := (i + 1) * max
+		if end > len(parts) {
+			end = len(parts)
+		}
+
+		b.Add(func(ctx context.Context) (err error) {
+			runs[i], err = oc.composePart(ctx, parts[i*max:end])
+			return
+		})
+	}
+
+	err = b.Join()
+	return
+}
+
+// Compose the supplied parts into a temporary object.
+func (oc *parallelObjectCreator) composePart(
+	ctx context.Context,
+	parts []*gcs.Object) (o *gcs.Object, err error) {
+	name, err := chooseTmpObjectName(oc.prefix)
+	if err != nil {
+		err = fmt.Errorf("chooseTmpObjectName: %v", err)
+		return
+	}
+
+	var zero int64
+	req := &gcs.ComposeObjectsRequest{
+		DstName:                   name,
+		DstGenerationPrecondition: &zero,
+	}
+
+	for _, p := range parts {
+		req.Sources = append(req.Sources, gcs.ComposeSource{
+			Name:       p.Name,
+			Generation: p.Generation,
+		})
+	}
+
+	o, err = oc.bucket.ComposeObjects(ctx, req)
+
+	switch err.(type) {
+	case nil:
+
+	// See the notes on missing temporary objects in Create.
+	case *gcs.NotFoundError:
+		err = fmt.Errorf("ComposeObjects: temporary object missing: %v", err)
+		return
+
+	default:
+		err = fmt.Errorf("ComposeObjects: %w", err)
+		return
+	}
+
+	return
+}
@@ -0,0 +1,308 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const parallelThreshold = 2 * gcsx.MinParallelUploadPartSize
+
+type ParallelUploadTest struct {
+	ctx    context.Context
+	bucket gcs.Bucket
+	clock  timeutil.SimulatedClock
+	syncer gcsx.Syncer
+
+	src *gcs.Object
+	tf  gcsx.TempFile
+}
+
+var _ SetUpInterface = &ParallelUploadTest{}
+var _ TearDownInterface = &ParallelUploadTest{}
+
+func init() { RegisterTestSuite(&ParallelUploadTest{}) }
+
+func (t *ParallelUploadTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.clock.SetTime(time.Date(2012, 8, 15, 22, 56, 0, 0, time.Local))
+
+	t.syncer = gcsx.NewParallelSyncer(
+		1<<60,
+		gcsx.ParallelUpload{
+			Streams:         4,
+			Threshold:       parallelThreshold,
+			RewriteExisting: true,
+		},
+		".gcsfuse_tmp/",
+		".gcsfuse_tmp/parts/",
+		t.bucket)
+
+	// An empty object, as created for a new file.
+	t.src, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte{})
+	AssertEq(nil, err)
+
+	t.tf, err = gcsx.NewTempFile(bytes.NewReader(nil), "", &t.clock)
+	AssertEq(nil, err)
+}
+
+func (t *ParallelUploadTest) TearDown() {
+	if t.tf != nil {
+		t.tf.Destroy()
+	}
+}
+
+// Write the supplied contents to the temp file and sync it.
+func (t *ParallelUploadTest) writeAndSync(
+	contents []byte) (o *gcs.Object, checksums *gcsx.Checksums, err error) {
+	_, err = t.tf.WriteAt(contents, 0)
+	AssertEq(nil, err)
+
+	o, checksums, err = t.syncer.SyncObject(t.ctx, t.src, t.tf)
+	if err == nil && o != nil {
+		t.tf = nil
+	}
+
+	return
+}
+
+// Return the names of all objects in the bucket.
+func (t *ParallelUploadTest) listNames() (names []string) {
+	objects, _, err := gcsutil.ListAll(t.ctx, t.bucket, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+
+	for _, o := range objects {
+		names = append(names, o.Name)
+	}
+
+	return
+}
+
+// A bucket that deletes the first source of each compose request before
+// making it, as an overzealous garbage collector might, recording the names
+// of the objects deleted.
+type partDeletingBucket struct {
+	gcs.Bucket
+	deleted []string
+}
+
+func (b *partDeletingBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	name := req.Sources[0].Name
+	err = b.Bucket.DeleteObject(ctx, &gcs.DeleteObjectRequest{Name: name})
+	if err != nil {
+		return
+	}
+
+	b.deleted = append(b.deleted, name)
+	o, err = b.Bucket.ComposeObjects(ctx, req)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ParallelUploadTest) SmallContentsUploadedWhole() {
+	o, checksums, err := t.writeAndSync([]byte("taco"))
+
+	AssertEq(nil, err)
+	ExpectEq(1, o.ComponentCount)
+	ExpectTrue(checksums.Matched)
+}
+
+func (t *ParallelUploadTest) LargeContentsUploadedInParts() {
+	contents := randBytes(int(parallelThreshold + 4))
+	o, checksums, err := t.writeAndSync(contents)
+
+	AssertEq(nil, err)
+	ExpectEq(3, o.ComponentCount)
+	ExpectEq(len(contents), o.Size)
+	ExpectEq(nil, o.MD5)
+	ExpectTrue(checksums.Matched)
+
+	// The contents should be intact, and the parts cleaned up.
+	actual, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectTrue(bytes.Equal(contents, actual))
+
+	ExpectEq("[foo]", fmt.Sprint(t.listNames()))
+}
+
+func (t *ParallelUploadTest) SourceClobbered() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("burrito"))
+	AssertEq(nil, err)
+
+	_, _, err = t.writeAndSync(randBytes(int(parallelThreshold)))
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+
+	ExpectEq("[foo]", fmt.Sprint(t.listNames()))
+}
+
+func (t *ParallelUploadTest) PartDeletedBeforeCompose() {
+	pu := gcsx.ParallelUpload{
+		Streams:         4,
+		Threshold:       parallelThreshold,
+		RewriteExisting: true,
+	}
+
+	b := &partDeletingBucket{Bucket: t.bucket}
+	t.syncer = gcsx.NewParallelSyncer(
+		1<<60,
+		pu,
+		".gcsfuse_tmp/",
+		".gcsfuse_tmp/parts/",
+		b)
+
+	contents := randBytes(int(parallelThreshold))
+	_, _, err := t.writeAndSync(contents)
+	ExpectThat(err, Error(HasSubstr("temporary object missing")))
+
+	// Parts live under their own prefix.
+	AssertEq(1, len(b.deleted))
+	ExpectTrue(strings.HasPrefix(b.deleted[0], ".gcsfuse_tmp/parts/"), b.deleted[0])
+
+	// This is neither a conflict nor the file's object going missing.
+	var precondition *gcs.PreconditionError
+	ExpectFalse(errors.As(err, &precondition), "err: %v", err)
+
+	var notFound *gcs.NotFoundError
+	ExpectFalse(errors.As(err, &notFound), "err: %v", err)
+
+	ExpectEq("[foo]", fmt.Sprint(t.listNames()))
+
+	// So syncing again works.
+	t.syncer = gcsx.NewParallelSyncer(
+		1<<60,
+		pu,
+		".gcsfuse_tmp/",
+		".gcsfuse_tmp/parts/",
+		t.bucket)
+
+	o, _, err := t.writeAndSync(contents)
+	AssertEq(nil, err)
+	ExpectEq(len(contents), o.Size)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Chunked uploads
+////////////////////////////////////////////////////////////////////////
+
+// Use a chunked syncer with the supplied part size and a threshold of
+// 1 KiB.
+func (t *ParallelUploadTest) useChunkedSyncer(chunkSize int64) {
+	t.syncer = gcsx.NewParallelSyncer(
+		1<<60,
+		gcsx.ParallelUpload{
+			Streams:   4,
+			ChunkSize: chunkSize,
+			Threshold: 1 << 10,
+		},
+		".gcsfuse_tmp/",
+		".gcsfuse_tmp/parts/",
+		t.bucket)
+}
+
+func (t *ParallelUploadTest) Chunked_SmallContentsUploadedWhole() {
+	t.useChunkedSyncer(100)
+
+	o, checksums, err := t.writeAndSync(randBytes(1<<10 - 4))
+
+	AssertEq(nil, err)
+	ExpectEq(1, o.ComponentCount)
+	ExpectTrue(checksums.Matched)
+}
+
+func (t *ParallelUploadTest) Chunked_ComposedInTwoRounds() {
+	t.useChunkedSyncer(100)
+
+	// 41 parts, more than can be composed at once.
+	contents := randBytes(4004)
+	o, checksums, err := t.writeAndSync(contents)
+
+	AssertEq(nil, err)
+	ExpectEq(41, o.ComponentCount)
+	ExpectEq(len(contents), o.Size)
+	ExpectTrue(checksums.Matched)
+
+	actual, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectTrue(bytes.Equal(contents, actual))
+
+	ExpectEq("[foo]", fmt.Sprint(t.listNames()))
+}
+
+func (t *ParallelUploadTest) Chunked_PartsEnlargedToComponentLimit() {
+	t.useChunkedSyncer(1)
+
+	contents := randBytes(2 * gcs.MaxComponentCount)
+	o, _, err := t.writeAndSync(contents)
+
+	AssertEq(nil, err)
+	ExpectEq(gcs.MaxComponentCount, o.ComponentCount)
+
+	actual, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectTrue(bytes.Equal(contents, actual))
+
+	ExpectEq("[foo]", fmt.Sprint(t.listNames()))
+}
+
+func (t *ParallelUploadTest) Chunked_ExistingObjectUploadedWhole() {
+	var err error
+	t.useChunkedSyncer(100)
+
+	t.src, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	o, checksums, err := t.writeAndSync(randBytes(4004))
+
+	AssertEq(nil, err)
+	ExpectEq(1, o.ComponentCount)
+	ExpectTrue(checksums.Matched)
+}
+
+func (t *ParallelUploadTest) Chunked_SourceClobbered() {
+	t.useChunkedSyncer(100)
+
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("burrito"))
+	AssertEq(nil, err)
+
+	_, _, err = t.writeAndSync(randBytes(4004))
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+
+	ExpectEq("[foo]", fmt.Sprint(t.listNames()))
+}
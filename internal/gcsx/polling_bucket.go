@@ -0,0 +1,375 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+// NewPollingBucket creates a bucket that keeps the results of stats of objects
+// in active use fresh by revalidating them in the background, as an
+// alternative to change notifications.
+//
+// The result of each stat is remembered, and further stats of the name are
+// served from it until it is older than interval. Every interval, the
+// remembered results for names that have been statted since the previous poll
+// are revalidated against the wrapped bucket, and the others are forgotten. So
+// an object that is statted often costs one request to the wrapped bucket per
+// interval, and its results are at most one interval out of date. Revalidation
+// that finds the same generation and meta-generation only updates the time of
+// validation. Modifications made through the bucket update the remembered
+// results.
+//
+// Polling continues until the supplied context is cancelled.
+func NewPollingBucket(
+	ctx context.Context,
+	interval time.Duration,
+	clock timeutil.Clock,
+	wrapped gcs.Bucket) (b gcs.Bucket) {
+	typed := newPollingBucket(interval, clock, wrapped)
+	go typed.pollPeriodically(ctx)
+
+	b = typed
+	return
+}
+
+// A remembered stat result: an object record, or nil for not found.
+type pollEntry struct {
+	o         *gcs.Object
+	validated time.Time
+
+	// Has the entry been used since the last poll?
+	used bool
+}
+
+type pollingBucket struct {
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	interval time.Duration
+	clock    timeutil.Clock
+	wrapped  gcs.Bucket
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// Remembered results by name.
+	//
+	// GUARDED_BY(mu)
+	entries map[string]pollEntry
+
+	// The number of revalidations that found a change, and the total number,
+	// since the last log message about them.
+	//
+	// GUARDED_BY(mu)
+	changed   uint64
+	validated uint64
+	lastLog   time.Time
+}
+
+func newPollingBucket(
+	interval time.Duration,
+	clock timeutil.Clock,
+	wrapped gcs.Bucket) (b *pollingBucket) {
+	b = &pollingBucket{
+		interval: interval,
+		clock:    clock,
+		wrapped:  wrapped,
+		entries:  make(map[string]pollEntry),
+		lastLog:  clock.Now(),
+	}
+
+	return
+}
+
+// The minimum interval between log messages about polling.
+const pollLogInterval = time.Hour
+
+// Return a copy of the supplied entry's object, or a not found error.
+func (e pollEntry) result(name string) (o *gcs.Object, err error) {
+	if e.o == nil {
+		err = &gcs.NotFoundError{
+			Err: fmt.Errorf("Polled entry for %q", name),
+		}
+
+		return
+	}
+
+	o = new(gcs.Object)
+	*o = *e.o
+	return
+}
+
+// Stat the named object in the wrapped bucket, returning an entry for the
+// result. ok is false if the result isn't definitive.
+func (b *pollingBucket) statWrapped(
+	ctx context.Context,
+	name string) (e pollEntry, ok bool, err error) {
+	e.validated = b.clock.Now()
+	e.o, err = b.wrapped.StatObject(ctx, &gcs.StatObjectRequest{Name: name})
+
+	switch err.(type) {
+	case nil:
+		ok = true
+
+	case *gcs.NotFoundError:
+		ok = true
+	}
+
+	return
+}
+
+func (b *pollingBucket) pollPeriodically(ctx context.Context) {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			b.poll(ctx)
+		}
+	}
+}
+
+// Revalidate entries that have been used since the last poll, and forget the
+// others.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *pollingBucket) poll(ctx context.Context) {
+	// Find the names to revalidate.
+	var names []string
+
+	b.mu.Lock()
+	for name, e := range b.entries {
+		if !e.used {
+			delete(b.entries, name)
+			continue
+		}
+
+		names = append(names, name)
+	}
+	b.mu.Unlock()
+
+	// Revalidate each.
+	for _, name := range names {
+		e, ok, _ := b.statWrapped(ctx, name)
+		b.revalidated(name, e, ok)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.clock.Now()
+	if b.validated > 0 && now.Sub(b.lastLog) >= pollLogInterval {
+		log.Printf(
+			"Polling: %d of %d revalidations in the last %v found a change.",
+			b.changed,
+			b.validated,
+			now.Sub(b.lastLog))
+
+		b.changed = 0
+		b.validated = 0
+		b.lastLog = now
+	}
+}
+
+// Record the result of revalidating the named entry. If the result isn't
+// definitive, forget the entry so that the next stat goes to the wrapped
+// bucket.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *pollingBucket) revalidated(name string, e pollEntry, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	prev, present := b.entries[name]
+	switch {
+	// Modified or forgotten while we were statting.
+	case !present || prev.validated.After(e.validated):
+		return
+
+	case !ok:
+		delete(b.entries, name)
+		return
+	}
+
+	b.validated++
+
+	// Special case: don't bother replacing an unchanged record.
+	if sameGeneration(prev.o, e.o) {
+		prev.validated = e.validated
+		prev.used = false
+		b.entries[name] = prev
+		return
+	}
+
+	b.changed++
+	b.entries[name] = e
+}
+
+// Do the supplied records (either of which may be nil for not found) refer to
+// the same generation and meta-generation of an object?
+func sameGeneration(a, b *gcs.Object) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return a.Generation == b.Generation && a.MetaGeneration == b.MetaGeneration
+}
+
+// Update the remembered result for the named object, if there is one, to
+// reflect an attempt to modify it through this bucket. If the attempt failed,
+// or doesn't tell us the object's new state, o is nil and the result is
+// simply forgotten.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *pollingBucket) update(name string, o *gcs.Object) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e, ok := b.entries[name]
+	switch {
+	case !ok:
+		return
+
+	case o == nil:
+		delete(b.entries, name)
+
+	default:
+		e.o = new(gcs.Object)
+		*e.o = *o
+		e.validated = b.clock.Now()
+		b.entries[name] = e
+	}
+}
+
+func (b *pollingBucket) Name() string {
+	return b.wrapped.Name()
+}
+
+func (b *pollingBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	rc, err = b.wrapped.NewReader(ctx, req)
+	return
+}
+
+func (b *pollingBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.CreateObject(ctx, req)
+	b.update(req.Name, o)
+
+	return
+}
+
+func (b *pollingBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.CopyObject(ctx, req)
+	b.update(req.DstName, o)
+
+	return
+}
+
+func (b *pollingBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.ComposeObjects(ctx, req)
+	b.update(req.DstName, o)
+
+	return
+}
+
+// LOCKS_EXCLUDED(b.mu)
+func (b *pollingBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	// Serve from a fresh enough entry if we can.
+	b.mu.Lock()
+	e, present := b.entries[req.Name]
+	if present && b.clock.Now().Sub(e.validated) < b.interval {
+		e.used = true
+		b.entries[req.Name] = e
+		b.mu.Unlock()
+
+		o, err = e.result(req.Name)
+		return
+	}
+	b.mu.Unlock()
+
+	// Otherwise go to the wrapped bucket, and remember definitive results.
+	e, ok, err := b.statWrapped(ctx, req.Name)
+	o = e.o
+	if !ok {
+		return
+	}
+
+	if o != nil {
+		e.o = new(gcs.Object)
+		*e.o = *o
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if prev, present := b.entries[req.Name]; !present ||
+		!prev.validated.After(e.validated) {
+		b.entries[req.Name] = e
+	}
+
+	return
+}
+
+func (b *pollingBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (l *gcs.Listing, err error) {
+	l, err = b.wrapped.ListObjects(ctx, req)
+	return
+}
+
+func (b *pollingBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.UpdateObject(ctx, req)
+	b.update(req.Name, o)
+
+	return
+}
+
+func (b *pollingBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	err = b.wrapped.DeleteObject(ctx, req)
+
+	// Another generation may remain, so forget rather than guess.
+	b.update(req.Name, nil)
+	return
+}
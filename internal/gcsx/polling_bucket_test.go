@@ -0,0 +1,189 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestPollingBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// statCountingBucket
+////////////////////////////////////////////////////////////////////////
+
+// A bucket that counts the stats that reach it.
+type statCountingBucket struct {
+	gcs.Bucket
+	stats int
+}
+
+func (b *statCountingBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	b.stats++
+	o, err = b.Bucket.StatObject(ctx, req)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const pollInterval = 10 * time.Second
+
+type PollingBucketTest struct {
+	ctx     context.Context
+	clock   timeutil.SimulatedClock
+	wrapped statCountingBucket
+	bucket  *pollingBucket
+}
+
+var _ SetUpInterface = &PollingBucketTest{}
+
+func init() { RegisterTestSuite(&PollingBucketTest{}) }
+
+func (t *PollingBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.wrapped.Bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.bucket = newPollingBucket(pollInterval, &t.clock, &t.wrapped)
+
+	_, err := gcsutil.CreateObject(t.ctx, t.wrapped.Bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+}
+
+func (t *PollingBucketTest) stat(name string) (o *gcs.Object, err error) {
+	o, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: name})
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *PollingBucketTest) RepeatedStatsAreServedLocally() {
+	for i := 0; i < 100; i++ {
+		o, err := t.stat("foo")
+		AssertEq(nil, err)
+		ExpectEq(4, o.Size)
+	}
+
+	ExpectEq(1, t.wrapped.stats)
+
+	// Not found is remembered too.
+	for i := 0; i < 100; i++ {
+		_, err := t.stat("bar")
+		ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+	}
+
+	ExpectEq(2, t.wrapped.stats)
+}
+
+func (t *PollingBucketTest) PollKeepsUsedEntriesFresh() {
+	_, err := t.stat("foo")
+	AssertEq(nil, err)
+	_, err = t.stat("foo")
+	AssertEq(nil, err)
+
+	// Modify the object behind the bucket's back, then poll.
+	_, err = gcsutil.CreateObject(t.ctx, t.wrapped.Bucket, "foo", []byte("burrito"))
+	AssertEq(nil, err)
+
+	t.clock.AdvanceTime(pollInterval)
+	t.bucket.poll(t.ctx)
+	ExpectEq(2, t.wrapped.stats)
+
+	// Stats now see the new generation without going to the wrapped bucket.
+	o, err := t.stat("foo")
+	AssertEq(nil, err)
+	ExpectEq(7, o.Size)
+	ExpectEq(2, t.wrapped.stats)
+}
+
+func (t *PollingBucketTest) PollRevalidatesUnchangedEntries() {
+	o0, err := t.stat("foo")
+	AssertEq(nil, err)
+
+	for i := 0; i < 3; i++ {
+		_, err = t.stat("foo")
+		AssertEq(nil, err)
+
+		t.clock.AdvanceTime(pollInterval)
+		t.bucket.poll(t.ctx)
+	}
+
+	// Each poll revalidated the entry, so it's still being served.
+	o, err := t.stat("foo")
+	AssertEq(nil, err)
+	ExpectEq(o0.Generation, o.Generation)
+	ExpectEq(4, t.wrapped.stats)
+}
+
+func (t *PollingBucketTest) PollForgetsUnusedEntries() {
+	_, err := t.stat("foo")
+	AssertEq(nil, err)
+
+	// The entry is never used, so the poll forgets it rather than
+	// revalidating it.
+	t.bucket.poll(t.ctx)
+	ExpectEq(1, t.wrapped.stats)
+
+	_, err = t.stat("foo")
+	AssertEq(nil, err)
+	ExpectEq(2, t.wrapped.stats)
+}
+
+func (t *PollingBucketTest) EntriesExpireWithoutPolling() {
+	_, err := t.stat("foo")
+	AssertEq(nil, err)
+
+	t.clock.AdvanceTime(pollInterval)
+
+	_, err = t.stat("foo")
+	AssertEq(nil, err)
+	ExpectEq(2, t.wrapped.stats)
+}
+
+func (t *PollingBucketTest) ModificationsUpdateEntries() {
+	_, err := t.stat("foo")
+	AssertEq(nil, err)
+
+	// Overwrite through the polling bucket.
+	created, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("burrito"))
+	AssertEq(nil, err)
+
+	o, err := t.stat("foo")
+	AssertEq(nil, err)
+	ExpectEq(created.Generation, o.Generation)
+	ExpectEq(1, t.wrapped.stats)
+
+	// Deleting forgets the entry.
+	err = t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	_, err = t.stat("foo")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+	ExpectEq(2, t.wrapped.stats)
+}
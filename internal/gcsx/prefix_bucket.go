@@ -22,7 +22,7 @@ import (
 
 	"golang.org/x/net/context"
 
-	"github.com/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
 )
 
 // NewPrefixBucket creates a view on the wrapped bucket that pretends as if only
@@ -162,6 +162,9 @@ func (b *prefixBucket) ListObjects(
 	mReq := new(gcs.ListObjectsRequest)
 	*mReq = *req
 	mReq.Prefix = b.prefix + mReq.Prefix
+	if mReq.MatchGlob != "" {
+		mReq.MatchGlob = gcs.QuoteGlob(b.prefix) + mReq.MatchGlob
+	}
 
 	l, err = b.wrapped.ListObjects(ctx, mReq)
 
@@ -21,10 +21,10 @@ import (
 
 	"golang.org/x/net/context"
 
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
 	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
-	"github.com/jacobsa/gcloud/gcs"
-	"github.com/jacobsa/gcloud/gcs/gcsfake"
-	"github.com/jacobsa/gcloud/gcs/gcsutil"
 	. "github.com/jacobsa/oglematchers"
 	. "github.com/jacobsa/ogletest"
 	"github.com/jacobsa/timeutil"
@@ -341,6 +341,52 @@ func (t *PrefixBucketTest) ListObjects_PrefixAndDelimeter() {
 	ExpectEq("burrito", l.Objects[0].Name)
 }
 
+func (t *PrefixBucketTest) ListObjects_MatchGlob() {
+	var err error
+
+	// Create a few objects.
+	err = gcsutil.CreateObjects(
+		t.ctx,
+		t.wrapped,
+		map[string][]byte{
+			t.prefix + "burrito.txt":   []byte(""),
+			t.prefix + "taco.csv":      []byte(""),
+			t.prefix + "dir/queso.txt": []byte(""),
+			"enchilada.txt":            []byte(""),
+		})
+
+	AssertEq(nil, err)
+
+	// The pattern applies to names within the prefix.
+	l, err := t.bucket.ListObjects(
+		t.ctx,
+		&gcs.ListObjectsRequest{
+			Delimiter: "/",
+			MatchGlob: "*.txt",
+		})
+
+	AssertEq(nil, err)
+	AssertEq("", l.ContinuationToken)
+	ExpectThat(l.CollapsedRuns, ElementsAre())
+
+	AssertEq(1, len(l.Objects))
+	ExpectEq("burrito.txt", l.Objects[0].Name)
+
+	// Runs are formed from the matching objects.
+	l, err = t.bucket.ListObjects(
+		t.ctx,
+		&gcs.ListObjectsRequest{
+			Delimiter: "/",
+			MatchGlob: "**.txt",
+		})
+
+	AssertEq(nil, err)
+	ExpectThat(l.CollapsedRuns, ElementsAre("dir/"))
+
+	AssertEq(1, len(l.Objects))
+	ExpectEq("burrito.txt", l.Objects[0].Name)
+}
+
 func (t *PrefixBucketTest) UpdateObject() {
 	var err error
 	suffix := "taco"
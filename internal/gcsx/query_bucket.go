@@ -0,0 +1,440 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/util/lrucache"
+	"golang.org/x/net/context"
+)
+
+// The separator between an object's name and a query in the name of a
+// virtual object served by a query bucket, e.g. "logs/2017.csv#select=date".
+const QuerySeparator = "#"
+
+// ErrQueryReadOnly is returned by a query bucket for attempts to modify the
+// virtual objects holding query results.
+var ErrQueryReadOnly = errors.New("Query results are read-only")
+
+// QueryError is returned when a query handler refuses a query, e.g. because
+// it is malformed.
+type QueryError struct {
+	Name string
+	Err  error
+}
+
+func (qe *QueryError) Error() string {
+	return fmt.Sprintf("Query %q failed: %v", qe.Name, qe.Err)
+}
+
+func (qe *QueryError) Unwrap() error {
+	return qe.Err
+}
+
+// A QueryHandler runs queries of one kind over the contents of objects.
+type QueryHandler interface {
+	// Run the query, which is what follows "KIND=" in a virtual object's name,
+	// over the supplied generation of an object, returning the result. The
+	// handler may read as much or as little of the object from the bucket as
+	// it needs. Return *QueryError if the query can't be run over the object.
+	Query(
+		ctx context.Context,
+		bucket gcs.Bucket,
+		o *gcs.Object,
+		query string) (result []byte, err error)
+}
+
+// CommandQueryHandler is a query handler that runs a command with /bin/sh,
+// with the object's contents on stdin, its name in the environment variable
+// GCSFUSE_OBJECT_NAME, and the query in GCSFUSE_QUERY. The result is whatever
+// the command writes to stdout. A non-zero exit status is reported as a
+// *QueryError.
+type CommandQueryHandler struct {
+	Command string
+}
+
+var _ QueryHandler = &CommandQueryHandler{}
+
+func (h *CommandQueryHandler) Query(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	o *gcs.Object,
+	query string) (result []byte, err error) {
+	rc, err := bucket.NewReader(
+		ctx,
+		&gcs.ReadObjectRequest{
+			Name:       o.Name,
+			Generation: o.Generation,
+		})
+
+	if err != nil {
+		err = fmt.Errorf("NewReader: %w", err)
+		return
+	}
+
+	defer rc.Close()
+
+	var stdout bytes.Buffer
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", h.Command)
+	cmd.Stdin = rc
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(
+		os.Environ(),
+		"GCSFUSE_OBJECT_NAME="+o.Name,
+		"GCSFUSE_QUERY="+query)
+
+	err = cmd.Run()
+
+	// Special case: a non-zero exit status is a refusal.
+	if _, ok := err.(*exec.ExitError); ok {
+		err = &QueryError{
+			Name: o.Name + QuerySeparator + query,
+			Err:  err,
+		}
+
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("Run: %v", err)
+		return
+	}
+
+	result = stdout.Bytes()
+	return
+}
+
+// ParseQueryCommands parses specifications of the form KIND=COMMAND, e.g.
+// "select=/usr/local/bin/csv-select", into a CommandQueryHandler for each
+// kind.
+func ParseQueryCommands(
+	specs []string) (handlers map[string]QueryHandler, err error) {
+	handlers = make(map[string]QueryHandler)
+	for _, s := range specs {
+		i := strings.Index(s, "=")
+		if i < 0 {
+			err = fmt.Errorf("Query handler %q is not of the form KIND=COMMAND", s)
+			return
+		}
+
+		kind := s[:i]
+		command := s[i+1:]
+
+		if kind == "" || strings.ContainsAny(kind, "/"+QuerySeparator) {
+			err = fmt.Errorf("Invalid kind of query %q", kind)
+			return
+		}
+
+		if command == "" {
+			err = fmt.Errorf("Empty command for queries of kind %q", kind)
+			return
+		}
+
+		if _, ok := handlers[kind]; ok {
+			err = fmt.Errorf("More than one handler for queries of kind %q", kind)
+			return
+		}
+
+		handlers[kind] = &CommandQueryHandler{Command: command}
+	}
+
+	return
+}
+
+// The number of query results that a query bucket keeps in memory.
+const queryResultCacheCapacity = 64
+
+// NewQueryBucket creates a bucket that serves virtual objects named by an
+// object's name, QuerySeparator, the kind of a query, "=", and the query
+// itself, e.g. "logs/2017.csv#select=date,status". Their contents are the
+// result of the handler for that kind running the query over the object, so
+// that analytics tools can read just the part of an object they need through
+// the file system, computed by code that may push the work down to GCS.
+//
+// Each virtual object has the generation of the object it was computed from,
+// and its result is computed when it is statted and kept in memory while
+// readers need it, so queries should produce results of modest size. Virtual
+// objects don't appear in listings and can't be modified. Real objects whose
+// names have the same form are hidden while there is a handler of the kind
+// named.
+func NewQueryBucket(
+	handlers map[string]QueryHandler,
+	wrapped gcs.Bucket) (b gcs.Bucket) {
+	b = &queryBucket{
+		handlers: handlers,
+		wrapped:  wrapped,
+		results:  lrucache.New(queryResultCacheCapacity),
+	}
+
+	return
+}
+
+type queryBucket struct {
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	handlers map[string]QueryHandler
+	wrapped  gcs.Bucket
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// Recent results, keyed by the name of the virtual object, with values of
+	// type *queryResult.
+	//
+	// GUARDED_BY(mu)
+	results lrucache.Cache
+}
+
+// The result of a query over a particular generation of an object.
+type queryResult struct {
+	generation int64
+	contents   []byte
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// If the supplied name is that of a virtual object, return the name of the
+// object it is computed from, the handler, and the query.
+func (b *queryBucket) parse(
+	name string) (src string, h QueryHandler, query string, ok bool) {
+	i := strings.LastIndex(name, QuerySeparator)
+	if i <= 0 || strings.HasSuffix(name[:i], "/") {
+		return
+	}
+
+	rest := name[i+len(QuerySeparator):]
+	j := strings.Index(rest, "=")
+	if j < 0 || strings.Contains(rest, "/") {
+		return
+	}
+
+	h, ok = b.handlers[rest[:j]]
+	src = name[:i]
+	query = rest[j+1:]
+
+	return
+}
+
+// Return true if the supplied name is that of a virtual object.
+func (b *queryBucket) isVirtual(name string) (virtual bool) {
+	_, _, _, virtual = b.parse(name)
+	return
+}
+
+// Return the result of the query named by the virtual object name, run over
+// the supplied generation of the source object, or zero for the latest, along
+// with a record for the virtual object.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *queryBucket) run(
+	ctx context.Context,
+	name string,
+	generation int64) (o *gcs.Object, contents []byte, err error) {
+	src, h, query, _ := b.parse(name)
+
+	// Find the source object.
+	srcObj, err := b.wrapped.StatObject(ctx, &gcs.StatObjectRequest{Name: src})
+	if err != nil {
+		return
+	}
+
+	// Special case: the generation asked for is gone.
+	if generation != 0 && generation != srcObj.Generation {
+		err = &gcs.NotFoundError{
+			Err: fmt.Errorf("Generation %d of %q is gone", generation, src),
+		}
+
+		return
+	}
+
+	// Use the cached result if it's for this generation, and otherwise run
+	// the query.
+	b.mu.Lock()
+	r, _ := b.results.LookUp(name).(*queryResult)
+	b.mu.Unlock()
+
+	if r == nil || r.generation != srcObj.Generation {
+		r = &queryResult{generation: srcObj.Generation}
+		r.contents, err = h.Query(ctx, b.wrapped, srcObj, query)
+		if err != nil {
+			return
+		}
+
+		b.mu.Lock()
+		b.results.Insert(name, r)
+		b.mu.Unlock()
+	}
+
+	// Describe the result as an object.
+	view := *srcObj
+	view.Name = name
+	view.ContentEncoding = ""
+	view.ComponentCount = 1
+	view.Size = uint64(len(r.contents))
+	view.CRC32C = crc32.Checksum(
+		r.contents,
+		crc32.MakeTable(crc32.Castagnoli))
+	view.MD5 = nil
+
+	o = &view
+	contents = r.contents
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Bucket interface
+////////////////////////////////////////////////////////////////////////
+
+func (b *queryBucket) Name() string {
+	return b.wrapped.Name()
+}
+
+func (b *queryBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	if !b.isVirtual(req.Name) {
+		rc, err = b.wrapped.NewReader(ctx, req)
+		return
+	}
+
+	_, contents, err := b.run(ctx, req.Name, req.Generation)
+	if err != nil {
+		return
+	}
+
+	// Apply the range, if any.
+	if req.Range != nil {
+		start := req.Range.Start
+		limit := req.Range.Limit
+		if limit > uint64(len(contents)) {
+			limit = uint64(len(contents))
+		}
+
+		if start > limit {
+			start = limit
+		}
+
+		contents = contents[start:limit]
+	}
+
+	rc = ioutil.NopCloser(bytes.NewReader(contents))
+	return
+}
+
+func (b *queryBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	if b.isVirtual(req.Name) {
+		err = ErrQueryReadOnly
+		return
+	}
+
+	o, err = b.wrapped.CreateObject(ctx, req)
+	return
+}
+
+func (b *queryBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	if b.isVirtual(req.SrcName) || b.isVirtual(req.DstName) {
+		err = ErrQueryReadOnly
+		return
+	}
+
+	o, err = b.wrapped.CopyObject(ctx, req)
+	return
+}
+
+func (b *queryBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	if b.isVirtual(req.DstName) {
+		err = ErrQueryReadOnly
+		return
+	}
+
+	for _, src := range req.Sources {
+		if b.isVirtual(src.Name) {
+			err = ErrQueryReadOnly
+			return
+		}
+	}
+
+	o, err = b.wrapped.ComposeObjects(ctx, req)
+	return
+}
+
+func (b *queryBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	if !b.isVirtual(req.Name) {
+		o, err = b.wrapped.StatObject(ctx, req)
+		return
+	}
+
+	o, _, err = b.run(ctx, req.Name, 0)
+	return
+}
+
+func (b *queryBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	listing, err = b.wrapped.ListObjects(ctx, req)
+	return
+}
+
+func (b *queryBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	if b.isVirtual(req.Name) {
+		err = ErrQueryReadOnly
+		return
+	}
+
+	o, err = b.wrapped.UpdateObject(ctx, req)
+	return
+}
+
+func (b *queryBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	if b.isVirtual(req.Name) {
+		err = ErrQueryReadOnly
+		return
+	}
+
+	err = b.wrapped.DeleteObject(ctx, req)
+	return
+}
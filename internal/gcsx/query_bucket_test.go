@@ -0,0 +1,304 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestQueryBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const queryCSV = "date,status\n2017-06-01,200\n2017-06-02,404\n"
+
+// A query handler that returns the lines of an object containing the query.
+type grepQueryHandler struct {
+	calls int
+}
+
+func (h *grepQueryHandler) Query(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	o *gcs.Object,
+	query string) (result []byte, err error) {
+	h.calls++
+
+	if query == "" {
+		err = &gcsx.QueryError{Name: o.Name, Err: errors.New("empty query")}
+		return
+	}
+
+	contents, err := gcsutil.ReadObject(ctx, bucket, o.Name)
+	if err != nil {
+		return
+	}
+
+	for _, l := range strings.SplitAfter(string(contents), "\n") {
+		if strings.Contains(l, query) {
+			result = append(result, l...)
+		}
+	}
+
+	return
+}
+
+type QueryBucketTest struct {
+	ctx     context.Context
+	clock   timeutil.SimulatedClock
+	wrapped gcs.Bucket
+	handler grepQueryHandler
+	bucket  gcs.Bucket
+}
+
+var _ SetUpInterface = &QueryBucketTest{}
+
+func init() { RegisterTestSuite(&QueryBucketTest{}) }
+
+func (t *QueryBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.wrapped = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	t.bucket = gcsx.NewQueryBucket(
+		map[string]gcsx.QueryHandler{"grep": &t.handler},
+		t.wrapped)
+
+	_, err := gcsutil.CreateObject(
+		t.ctx,
+		t.wrapped,
+		"logs/a.csv",
+		[]byte(queryCSV))
+
+	AssertEq(nil, err)
+}
+
+func (t *QueryBucketTest) read(
+	name string,
+	br *gcs.ByteRange) (contents string, err error) {
+	rc, err := t.bucket.NewReader(
+		t.ctx,
+		&gcs.ReadObjectRequest{
+			Name:  name,
+			Range: br,
+		})
+
+	if err != nil {
+		return
+	}
+
+	defer rc.Close()
+
+	b, err := ioutil.ReadAll(rc)
+	contents = string(b)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *QueryBucketTest) ParseCommands() {
+	handlers, err := gcsx.ParseQueryCommands(
+		[]string{"select=csv-select", "head=head -n 1"})
+
+	AssertEq(nil, err)
+	ExpectThat(
+		handlers["head"],
+		DeepEquals(&gcsx.CommandQueryHandler{Command: "head -n 1"}))
+	ExpectEq(2, len(handlers))
+
+	_, err = gcsx.ParseQueryCommands([]string{"select"})
+	ExpectThat(err, Error(HasSubstr("KIND=COMMAND")))
+
+	_, err = gcsx.ParseQueryCommands([]string{"a#b=cat"})
+	ExpectThat(err, Error(HasSubstr("Invalid kind")))
+
+	_, err = gcsx.ParseQueryCommands([]string{"select="})
+	ExpectThat(err, Error(HasSubstr("Empty command")))
+
+	_, err = gcsx.ParseQueryCommands([]string{"a=cat", "a=tac"})
+	ExpectThat(err, Error(HasSubstr("More than one")))
+}
+
+func (t *QueryBucketTest) StatDescribesResult() {
+	src, err := t.wrapped.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "logs/a.csv"})
+
+	AssertEq(nil, err)
+
+	o, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "logs/a.csv#grep=404"})
+
+	AssertEq(nil, err)
+
+	const expected = "2017-06-02,404\n"
+	ExpectEq("logs/a.csv#grep=404", o.Name)
+	ExpectEq(len(expected), o.Size)
+	ExpectEq(src.Generation, o.Generation)
+	ExpectEq(
+		crc32.Checksum([]byte(expected), crc32.MakeTable(crc32.Castagnoli)),
+		o.CRC32C)
+	ExpectEq(nil, o.MD5)
+}
+
+func (t *QueryBucketTest) ReadServesResult() {
+	contents, err := t.read("logs/a.csv#grep=2017", nil)
+	AssertEq(nil, err)
+	ExpectEq("2017-06-01,200\n2017-06-02,404\n", contents)
+
+	// Ranges apply to the result.
+	contents, err = t.read("logs/a.csv#grep=2017", &gcs.ByteRange{Start: 15, Limit: 25})
+	AssertEq(nil, err)
+	ExpectEq("2017-06-02", contents)
+
+	contents, err = t.read("logs/a.csv#grep=2017", &gcs.ByteRange{Start: 100, Limit: 200})
+	AssertEq(nil, err)
+	ExpectEq("", contents)
+}
+
+func (t *QueryBucketTest) ResultsKeptPerGeneration() {
+	_, err := t.read("logs/a.csv#grep=404", nil)
+	AssertEq(nil, err)
+
+	_, err = t.read("logs/a.csv#grep=404", nil)
+	AssertEq(nil, err)
+	ExpectEq(1, t.handler.calls)
+
+	// A new generation of the object is queried afresh.
+	_, err = gcsutil.CreateObject(
+		t.ctx,
+		t.wrapped,
+		"logs/a.csv",
+		[]byte("2017-06-03,404\n"))
+
+	AssertEq(nil, err)
+
+	contents, err := t.read("logs/a.csv#grep=404", nil)
+	AssertEq(nil, err)
+	ExpectEq("2017-06-03,404\n", contents)
+	ExpectEq(2, t.handler.calls)
+}
+
+func (t *QueryBucketTest) GenerationGone() {
+	o, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "logs/a.csv#grep=404"})
+
+	AssertEq(nil, err)
+
+	_, err = t.bucket.NewReader(
+		t.ctx,
+		&gcs.ReadObjectRequest{
+			Name:       o.Name,
+			Generation: o.Generation + 1,
+		})
+
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *QueryBucketTest) SourceMissing() {
+	_, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "logs/b.csv#grep=404"})
+
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+	ExpectEq(0, t.handler.calls)
+}
+
+func (t *QueryBucketTest) QueryRefused() {
+	_, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "logs/a.csv#grep="})
+
+	ExpectThat(err, HasSameTypeAs(&gcsx.QueryError{}))
+}
+
+func (t *QueryBucketTest) OtherNamesPassThrough() {
+	names := []string{
+		"logs/a.csv#sed=404",
+		"logs/a.csv#grep",
+		"logs/#grep=404",
+	}
+
+	for _, name := range names {
+		_, err := gcsutil.CreateObject(t.ctx, t.bucket, name, []byte("taco"))
+		AssertEq(nil, err, "%s", name)
+
+		contents, err := t.read(name, nil)
+		AssertEq(nil, err, "%s", name)
+		ExpectEq("taco", contents, "%s", name)
+	}
+
+	ExpectEq(0, t.handler.calls)
+}
+
+func (t *QueryBucketTest) ResultsReadOnly() {
+	const name = "logs/a.csv#grep=404"
+
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, name, []byte("taco"))
+	ExpectEq(gcsx.ErrQueryReadOnly, err)
+
+	err = t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: name})
+	ExpectEq(gcsx.ErrQueryReadOnly, err)
+
+	_, err = t.bucket.CopyObject(
+		t.ctx,
+		&gcs.CopyObjectRequest{SrcName: name, DstName: "logs/b.csv"})
+
+	ExpectEq(gcsx.ErrQueryReadOnly, err)
+
+	// Nothing is listed.
+	listing, err := t.bucket.ListObjects(t.ctx, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+	AssertEq(1, len(listing.Objects))
+	ExpectEq("logs/a.csv", listing.Objects[0].Name)
+}
+
+func (t *QueryBucketTest) CommandHandler() {
+	handlers, err := gcsx.ParseQueryCommands(
+		[]string{`grep=grep -e "$GCSFUSE_QUERY"`})
+
+	AssertEq(nil, err)
+
+	t.bucket = gcsx.NewQueryBucket(handlers, t.wrapped)
+
+	contents, err := t.read("logs/a.csv#grep=200", nil)
+	AssertEq(nil, err)
+	ExpectEq("2017-06-01,200\n", contents)
+
+	// grep exits with a non-zero status when nothing matches.
+	_, err = t.read("logs/a.csv#grep=500", nil)
+	ExpectThat(err, HasSameTypeAs(&gcsx.QueryError{}))
+}
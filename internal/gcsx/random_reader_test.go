@@ -15,8 +15,10 @@
 package gcsx
 
 import (
+	"crypto/md5"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"strings"
@@ -24,7 +26,7 @@ import (
 	"testing/iotest"
 	"time"
 
-	"github.com/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
 	. "github.com/jacobsa/oglematchers"
 	. "github.com/jacobsa/oglemock"
 	. "github.com/jacobsa/ogletest"
@@ -155,7 +157,7 @@ func (t *RandomReaderTest) SetUp(ti *TestInfo) {
 	t.bucket = gcs.NewMockBucket(ti.MockController, "bucket")
 
 	// Set up the reader.
-	rr, err := NewRandomReader(t.object, t.bucket)
+	rr, err := NewRandomReader(t.object, t.bucket, ReadAhead{})
 	AssertEq(nil, err)
 	t.rr.wrapped = rr.(*randomReader)
 }
@@ -228,6 +230,16 @@ func (t *RandomReaderTest) NewReaderReturnsError() {
 	ExpectThat(err, Error(HasSubstr("taco")))
 }
 
+func (t *RandomReaderTest) NewReaderReturnsNotFoundError() {
+	ExpectCall(t.bucket, "NewReader")(Any(), Any()).
+		WillOnce(Return(nil, &gcs.NotFoundError{Err: errors.New("taco")}))
+
+	buf := make([]byte, 1)
+	_, err := t.rr.ReadAt(buf, 0)
+
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
 func (t *RandomReaderTest) ReaderFails() {
 	// Bucket
 	r := iotest.OneByteReader(iotest.TimeoutReader(strings.NewReader("xxx")))
@@ -284,6 +296,127 @@ func (t *RandomReaderTest) ReaderNotExhausted() {
 	ExpectEq(4, t.rr.wrapped.limit)
 }
 
+func (t *RandomReaderTest) ReaderNotExhausted_SkipsForward() {
+	// Set up a reader that has eight bytes left to give, but returns only one
+	// byte per call to Read.
+	rc := &countingCloser{
+		Reader: iotest.OneByteReader(strings.NewReader("abcdefgh")),
+	}
+
+	t.rr.wrapped.reader = rc
+	t.rr.wrapped.cancel = func() {}
+	t.rr.wrapped.start = 1
+	t.rr.wrapped.limit = 9
+
+	// Read two bytes from further on. The existing reader should be used,
+	// without a call to the bucket.
+	buf := make([]byte, 2)
+	n, err := t.rr.ReadAt(buf, 5)
+
+	ExpectEq(2, n)
+	ExpectEq(nil, err)
+	ExpectEq("ef", string(buf[:n]))
+
+	ExpectEq(0, rc.closeCount)
+	ExpectEq(rc, t.rr.wrapped.reader)
+	ExpectEq(7, t.rr.wrapped.start)
+	ExpectEq(9, t.rr.wrapped.limit)
+	ExpectEq(0, t.rr.wrapped.seeks)
+}
+
+func (t *RandomReaderTest) SequentialReadsShareOneRequest() {
+	// The bucket should be asked to read once, to the end of the object.
+	rc := &countingCloser{
+		Reader: iotest.HalfReader(strings.NewReader("abcdefghijklmnopq")),
+	}
+
+	ExpectCall(t.bucket, "NewReader")(
+		Any(),
+		AllOf(rangeStartIs(0), rangeLimitIs(t.object.Size))).
+		WillOnce(Return(rc, nil))
+
+	// Read the whole object in small pieces, skipping a few bytes along the way
+	// as happens when the kernel serves some reads from its page cache.
+	var contents []byte
+	buf := make([]byte, 3)
+	for _, offset := range []int64{0, 3, 6, 11, 14} {
+		n, err := t.rr.ReadAt(buf, offset)
+		AssertEq(nil, err)
+		contents = append(contents, buf[:n]...)
+	}
+
+	ExpectEq("abcdefghilmnopq", string(contents))
+	ExpectEq(1, rc.closeCount)
+	ExpectEq(0, t.rr.wrapped.seeks)
+}
+
+func (t *RandomReaderTest) SequentialReadComputesChecksums() {
+	const contents = "abcdefghijklmnopq"
+	md5Sum := md5.Sum([]byte(contents))
+	t.object.CRC32C = crc32.Checksum(
+		[]byte(contents),
+		crc32.MakeTable(crc32.Castagnoli))
+	t.object.MD5 = &md5Sum
+
+	ExpectCall(t.bucket, "NewReader")(Any(), Any()).
+		WillOnce(Return(ioutil.NopCloser(strings.NewReader(contents)), nil))
+
+	// Read the object in pieces, skipping a few bytes along the way. Skipped
+	// bytes should still be checksummed.
+	buf := make([]byte, 3)
+	for _, offset := range []int64{0, 3, 6, 11} {
+		_, err := t.rr.ReadAt(buf, offset)
+		AssertEq(nil, err)
+		ExpectEq(nil, t.rr.wrapped.Checksums())
+	}
+
+	_, err := t.rr.ReadAt(buf, 14)
+	AssertEq(nil, err)
+
+	c := t.rr.wrapped.Checksums()
+	AssertNe(nil, c)
+	ExpectEq(t.object.Generation, c.Generation)
+	ExpectEq(t.object.CRC32C, c.CRC32C)
+	ExpectEq(md5Sum, c.MD5)
+	ExpectTrue(c.Matched)
+}
+
+func (t *RandomReaderTest) ChecksumMismatch() {
+	t.object.CRC32C = 1234
+
+	ExpectCall(t.bucket, "NewReader")(Any(), Any()).
+		WillOnce(Return(
+			ioutil.NopCloser(strings.NewReader("abcdefghijklmnopq")),
+			nil))
+
+	buf := make([]byte, t.object.Size)
+	_, err := t.rr.ReadAt(buf, 0)
+	AssertEq(nil, err)
+
+	c := t.rr.wrapped.Checksums()
+	AssertNe(nil, c)
+	ExpectFalse(c.Matched)
+}
+
+func (t *RandomReaderTest) OutOfOrderReadHasNoChecksums() {
+	ExpectCall(t.bucket, "NewReader")(Any(), Any()).
+		WillOnce(Return(ioutil.NopCloser(strings.NewReader("nopq")), nil)).
+		WillOnce(Return(
+			ioutil.NopCloser(strings.NewReader("abcdefghijklmnopq")),
+			nil))
+
+	// Read the end, then the whole thing.
+	buf := make([]byte, 4)
+	_, err := t.rr.ReadAt(buf, 13)
+	AssertEq(nil, err)
+
+	buf = make([]byte, t.object.Size)
+	_, err = t.rr.ReadAt(buf, 0)
+	AssertEq(nil, err)
+
+	ExpectEq(nil, t.rr.wrapped.Checksums())
+}
+
 func (t *RandomReaderTest) ReaderExhausted_ReadFinished() {
 	// Set up a reader that has three bytes left to give.
 	rc := &countingCloser{
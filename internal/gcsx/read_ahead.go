@@ -0,0 +1,132 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"io"
+)
+
+// ReadAhead configures fetching data from GCS in the background ahead of
+// sequential reads, so that it is on hand before the kernel asks for it. The
+// zero value disables read-ahead.
+type ReadAhead struct {
+	// The number of bytes fetched at a time.
+	ChunkSize int
+
+	// The number of chunks to fetch ahead of the reader.
+	Depth int
+}
+
+// Enabled reports whether the configuration fetches anything ahead.
+func (ra ReadAhead) Enabled() bool {
+	return ra.ChunkSize > 0 && ra.Depth > 0
+}
+
+// A chunk of data fetched ahead, or the error that ended fetching.
+type readAheadChunk struct {
+	data []byte
+	err  error
+}
+
+// An io.ReadCloser that reads from a wrapped reader in a background goroutine,
+// keeping up to ra.Depth chunks of ra.ChunkSize bytes ready for the caller.
+type readAheadReader struct {
+	wrapped io.ReadCloser
+
+	// Chunks fetched by the goroutine. Holds all but the chunk the goroutine
+	// is filling, so that at most Depth chunks are fetched ahead.
+	chunks chan readAheadChunk
+
+	// Closed to tell the goroutine to stop, and by it when it has.
+	stop chan struct{}
+	done chan struct{}
+
+	// The unread remainder of the chunk being consumed, and the error that
+	// ended fetching, once it has been seen.
+	cur []byte
+	err error
+}
+
+// Start reading ahead from the supplied reader, which must not be used
+// directly afterward.
+//
+// REQUIRES: ra.Enabled()
+func newReadAheadReader(
+	wrapped io.ReadCloser,
+	ra ReadAhead) (r *readAheadReader) {
+	r = &readAheadReader{
+		wrapped: wrapped,
+		chunks:  make(chan readAheadChunk, ra.Depth-1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	go r.fetch(ra.ChunkSize)
+	return
+}
+
+func (r *readAheadReader) fetch(chunkSize int) {
+	defer close(r.done)
+
+	for {
+		buf := make([]byte, chunkSize)
+		n, err := io.ReadFull(r.wrapped, buf)
+
+		// A short chunk means the wrapped reader has run out.
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+
+		c := readAheadChunk{data: buf[:n], err: err}
+		select {
+		case r.chunks <- c:
+		case <-r.stop:
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (r *readAheadReader) Read(p []byte) (n int, err error) {
+	for len(r.cur) == 0 {
+		if r.err != nil {
+			err = r.err
+			return
+		}
+
+		c := <-r.chunks
+		r.cur = c.data
+		r.err = c.err
+	}
+
+	n = copy(p, r.cur)
+	r.cur = r.cur[n:]
+
+	return
+}
+
+// Close stops fetching and closes the wrapped reader.
+func (r *readAheadReader) Close() (err error) {
+	close(r.stop)
+
+	// Closing the wrapped reader may be needed to unblock the goroutine.
+	err = r.wrapped.Close()
+	<-r.done
+
+	return
+}
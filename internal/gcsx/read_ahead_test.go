@@ -0,0 +1,130 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestReadAhead(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ReadAheadTest struct {
+}
+
+func init() { RegisterTestSuite(&ReadAheadTest{}) }
+
+// A reader that yields its contents and then the supplied error.
+type erroringReader struct {
+	io.Reader
+	err error
+}
+
+func (r *erroringReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	if err == io.EOF {
+		err = r.err
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ReadAheadTest) Enabled() {
+	ExpectFalse(ReadAhead{}.Enabled())
+	ExpectFalse(ReadAhead{ChunkSize: 4}.Enabled())
+	ExpectFalse(ReadAhead{Depth: 2}.Enabled())
+	ExpectTrue(ReadAhead{ChunkSize: 4, Depth: 2}.Enabled())
+}
+
+func (t *ReadAheadTest) ReadsEverything() {
+	r := newReadAheadReader(
+		ioutil.NopCloser(strings.NewReader("tacoburritoenchilada")),
+		ReadAhead{ChunkSize: 4, Depth: 2})
+
+	defer r.Close()
+
+	// Read in pieces that don't line up with the chunks.
+	buf := make([]byte, 3)
+	var contents []byte
+	for {
+		n, err := r.Read(buf)
+		contents = append(contents, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+
+		AssertEq(nil, err)
+	}
+
+	ExpectEq("tacoburritoenchilada", string(contents))
+}
+
+func (t *ReadAheadTest) FetchesAheadOfReads() {
+	pr, pw := io.Pipe()
+	r := newReadAheadReader(pr, ReadAhead{ChunkSize: 4, Depth: 2})
+	defer r.Close()
+
+	// Writes to the pipe block until they are consumed, so this returns only
+	// if the reader fetches two chunks without being asked.
+	_, err := pw.Write([]byte("tacoburr"))
+	AssertEq(nil, err)
+
+	pw.Close()
+
+	contents, err := ioutil.ReadAll(r)
+	AssertEq(nil, err)
+	ExpectEq("tacoburr", string(contents))
+}
+
+func (t *ReadAheadTest) ErrorAfterData() {
+	r := newReadAheadReader(
+		ioutil.NopCloser(&erroringReader{
+			Reader: strings.NewReader("taco"),
+			err:    errors.New("taco"),
+		}),
+		ReadAhead{ChunkSize: 3, Depth: 1})
+
+	defer r.Close()
+
+	contents, err := ioutil.ReadAll(r)
+	ExpectThat(err, Error(Equals("taco")))
+	ExpectEq("taco", string(contents))
+}
+
+func (t *ReadAheadTest) CloseWhileFetching() {
+	pr, pw := io.Pipe()
+	r := newReadAheadReader(pr, ReadAhead{ChunkSize: 4, Depth: 1})
+
+	// The goroutine is blocked reading from the pipe. Closing the reader must
+	// unblock it, and writers then see that the pipe is closed.
+	AssertEq(nil, r.Close())
+
+	_, err := pw.Write([]byte("taco"))
+	ExpectEq(io.ErrClosedPipe, err)
+}
@@ -0,0 +1,119 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+// TuneReadAhead measures how quickly the first sampleSize bytes of an object
+// in the bucket can be read sequentially with each of the supplied read-ahead
+// configurations, and returns the fastest. The object sampled is the largest
+// in the first page of a listing of the bucket; if that is smaller than
+// sampleSize, an error is returned.
+//
+// REQUIRES: len(candidates) > 0
+// REQUIRES: candidates[i].Enabled() for all i
+func TuneReadAhead(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	clock timeutil.Clock,
+	candidates []ReadAhead,
+	sampleSize uint64) (best ReadAhead, err error) {
+	// Find something to read.
+	listing, err := bucket.ListObjects(ctx, &gcs.ListObjectsRequest{})
+	if err != nil {
+		err = fmt.Errorf("ListObjects: %v", err)
+		return
+	}
+
+	var sample *gcs.Object
+	for _, o := range listing.Objects {
+		if sample == nil || o.Size > sample.Size {
+			sample = o
+		}
+	}
+
+	if sample == nil || sample.Size < sampleSize {
+		err = errors.New("no object large enough to sample")
+		return
+	}
+
+	// Time each candidate, keeping the fastest.
+	var bestTime time.Duration
+	for i, ra := range candidates {
+		var d time.Duration
+		d, err = timeReadAhead(ctx, bucket, clock, sample, ra, sampleSize)
+		if err != nil {
+			err = fmt.Errorf("timeReadAhead(%+v): %v", ra, err)
+			return
+		}
+
+		if i == 0 || d < bestTime {
+			best = ra
+			bestTime = d
+		}
+	}
+
+	return
+}
+
+// Return how long it takes to read the first n bytes of the supplied object
+// through a read-ahead reader with the given configuration.
+func timeReadAhead(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	clock timeutil.Clock,
+	o *gcs.Object,
+	ra ReadAhead,
+	n uint64) (d time.Duration, err error) {
+	start := clock.Now()
+
+	rc, err := bucket.NewReader(
+		ctx,
+		&gcs.ReadObjectRequest{
+			Name:       o.Name,
+			Generation: o.Generation,
+			Range: &gcs.ByteRange{
+				Start: 0,
+				Limit: n,
+			},
+		})
+
+	if err != nil {
+		err = fmt.Errorf("NewReader: %v", err)
+		return
+	}
+
+	r := newReadAheadReader(rc, ra)
+	defer r.Close()
+
+	_, err = io.Copy(ioutil.Discard, r)
+	if err != nil {
+		err = fmt.Errorf("Copy: %v", err)
+		return
+	}
+
+	d = clock.Now().Sub(start)
+	return
+}
@@ -0,0 +1,158 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestReadAheadTuning(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// latencyBucket
+////////////////////////////////////////////////////////////////////////
+
+// A bucket whose readers advance a simulated clock by a fixed latency for
+// each call to Read, so that fewer, larger reads are faster.
+type latencyBucket struct {
+	gcs.Bucket
+	clock *timeutil.SimulatedClock
+}
+
+func (b *latencyBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	rc, err = b.Bucket.NewReader(ctx, req)
+	if err != nil {
+		return
+	}
+
+	rc = &latencyReader{ReadCloser: rc, clock: b.clock}
+	return
+}
+
+type latencyReader struct {
+	io.ReadCloser
+	clock *timeutil.SimulatedClock
+}
+
+func (r *latencyReader) Read(p []byte) (n int, err error) {
+	r.clock.AdvanceTime(time.Millisecond)
+	n, err = r.ReadCloser.Read(p)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ReadAheadTuningTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket latencyBucket
+}
+
+var _ SetUpInterface = &ReadAheadTuningTest{}
+
+func init() { RegisterTestSuite(&ReadAheadTuningTest{}) }
+
+func (t *ReadAheadTuningTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket.Bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.bucket.clock = &t.clock
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ReadAheadTuningTest) EmptyBucket() {
+	_, err := TuneReadAhead(
+		t.ctx,
+		&t.bucket,
+		&t.clock,
+		[]ReadAhead{{ChunkSize: 4, Depth: 1}},
+		16)
+
+	ExpectThat(err, Error(HasSubstr("large enough")))
+}
+
+func (t *ReadAheadTuningTest) ObjectsTooSmall() {
+	_, err := gcsutil.CreateObject(t.ctx, &t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	_, err = TuneReadAhead(
+		t.ctx,
+		&t.bucket,
+		&t.clock,
+		[]ReadAhead{{ChunkSize: 4, Depth: 1}},
+		16)
+
+	ExpectThat(err, Error(HasSubstr("large enough")))
+}
+
+func (t *ReadAheadTuningTest) PicksFastest() {
+	_, err := gcsutil.CreateObject(t.ctx, &t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	_, err = gcsutil.CreateObject(
+		t.ctx,
+		&t.bucket,
+		"bar",
+		[]byte(strings.Repeat("x", 64)))
+
+	AssertEq(nil, err)
+
+	candidates := []ReadAhead{
+		{ChunkSize: 2, Depth: 1},
+		{ChunkSize: 16, Depth: 2},
+		{ChunkSize: 8, Depth: 4},
+	}
+
+	best, err := TuneReadAhead(t.ctx, &t.bucket, &t.clock, candidates, 32)
+	AssertEq(nil, err)
+	ExpectThat(best, DeepEquals(candidates[1]))
+}
+
+func (t *ReadAheadTuningTest) TiesGoToEarlierCandidates() {
+	_, err := gcsutil.CreateObject(
+		t.ctx,
+		&t.bucket,
+		"foo",
+		[]byte(strings.Repeat("x", 32)))
+
+	AssertEq(nil, err)
+
+	candidates := []ReadAhead{
+		{ChunkSize: 8, Depth: 1},
+		{ChunkSize: 8, Depth: 4},
+	}
+
+	best, err := TuneReadAhead(t.ctx, &t.bucket, &t.clock, candidates, 32)
+	AssertEq(nil, err)
+	ExpectThat(best, DeepEquals(candidates[0]))
+}
@@ -0,0 +1,256 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+// The sleep before the first retry of a failed request, before jitter.
+const initialRetrySleep = 100 * time.Millisecond
+
+// Is the supplied error one that may go away if the request is made again,
+// i.e. a throttling or server error from GCS, or a network failure?
+func isTransientError(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == http.StatusTooManyRequests ||
+			apiErr.Code >= http.StatusInternalServerError
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	return errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// NewRetryBucket creates a bucket that retries requests to the wrapped bucket
+// that fail with transient errors (see isTransientError), as long as making
+// them again can't have effects beyond those of making them once.
+//
+// Retries are made with exponential backoff: the sleep before each retry is
+// multiplier times the previous one, starting from initialRetrySleep, with up
+// to 50% jitter either way so that requests that failed together don't retry
+// together. Once the sleep would exceed maxSleep, the latest error is
+// returned. A maxSleep of zero disables retries.
+//
+// Reads, stats, listings, and deletions are always retried. Creations,
+// compositions, and updates are retried only when they carry a precondition
+// on the object's (meta-)generation, which stops a retry of a request that
+// in fact succeeded from applying it twice; creations additionally need
+// contents that can be rewound. Copies are never retried.
+//
+// Only the call that opens a reader is retried; errors while reading from it
+// are returned to the caller.
+func NewRetryBucket(
+	maxSleep time.Duration,
+	multiplier float64,
+	wrapped gcs.Bucket) (b gcs.Bucket) {
+	b = &retryBucket{
+		maxSleep:   maxSleep,
+		multiplier: multiplier,
+		wrapped:    wrapped,
+		sleep:      sleepWithContext,
+	}
+
+	return
+}
+
+type retryBucket struct {
+	maxSleep   time.Duration
+	multiplier float64
+	wrapped    gcs.Bucket
+
+	// Sleep for the supplied duration, or until the context is cancelled.
+	// Replaced in tests.
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+func sleepWithContext(ctx context.Context, d time.Duration) (err error) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	return
+}
+
+// Call f until it succeeds, fails with an error that isn't transient, or we
+// run out of patience. If before is non-nil, it is called before each retry,
+// and an error from it ends the loop.
+func (b *retryBucket) retry(
+	ctx context.Context,
+	before func() error,
+	f func() error) (err error) {
+	sleep := initialRetrySleep
+	for {
+		err = f()
+		if err == nil || !isTransientError(err) || sleep > b.maxSleep {
+			return
+		}
+
+		jittered := time.Duration(float64(sleep) * (0.5 + rand.Float64()))
+		if b.sleep(ctx, jittered) != nil {
+			return
+		}
+
+		if before != nil {
+			if beforeErr := before(); beforeErr != nil {
+				return
+			}
+		}
+
+		sleep = time.Duration(float64(sleep) * b.multiplier)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// gcs.Bucket
+////////////////////////////////////////////////////////////////////////
+
+func (b *retryBucket) Name() string {
+	return b.wrapped.Name()
+}
+
+func (b *retryBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	err = b.retry(ctx, nil, func() (err error) {
+		rc, err = b.wrapped.NewReader(ctx, req)
+		return
+	})
+
+	return
+}
+
+func (b *retryBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	// Special case: without a precondition a retry may clobber a concurrent
+	// write, and without a seekable reader we can't send the contents again.
+	seeker, ok := req.Contents.(io.Seeker)
+	if req.GenerationPrecondition == nil || !ok {
+		o, err = b.wrapped.CreateObject(ctx, req)
+		return
+	}
+
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		o, err = b.wrapped.CreateObject(ctx, req)
+		return
+	}
+
+	rewind := func() (err error) {
+		_, err = seeker.Seek(start, io.SeekStart)
+		return
+	}
+
+	err = b.retry(ctx, rewind, func() (err error) {
+		o, err = b.wrapped.CreateObject(ctx, req)
+		return
+	})
+
+	return
+}
+
+func (b *retryBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.CopyObject(ctx, req)
+	return
+}
+
+func (b *retryBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	// Special case: without a precondition a retry may clobber a concurrent
+	// write.
+	if req.DstGenerationPrecondition == nil {
+		o, err = b.wrapped.ComposeObjects(ctx, req)
+		return
+	}
+
+	err = b.retry(ctx, nil, func() (err error) {
+		o, err = b.wrapped.ComposeObjects(ctx, req)
+		return
+	})
+
+	return
+}
+
+func (b *retryBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	err = b.retry(ctx, nil, func() (err error) {
+		o, err = b.wrapped.StatObject(ctx, req)
+		return
+	})
+
+	return
+}
+
+func (b *retryBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (l *gcs.Listing, err error) {
+	err = b.retry(ctx, nil, func() (err error) {
+		l, err = b.wrapped.ListObjects(ctx, req)
+		return
+	})
+
+	return
+}
+
+func (b *retryBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	// Special case: without a precondition a retry may clobber a concurrent
+	// update.
+	if req.MetaGenerationPrecondition == nil {
+		o, err = b.wrapped.UpdateObject(ctx, req)
+		return
+	}
+
+	err = b.retry(ctx, nil, func() (err error) {
+		o, err = b.wrapped.UpdateObject(ctx, req)
+		return
+	})
+
+	return
+}
+
+func (b *retryBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	err = b.retry(ctx, nil, func() error {
+		return b.wrapped.DeleteObject(ctx, req)
+	})
+
+	return
+}
@@ -0,0 +1,244 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+func TestRetryBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// flakyBucket
+////////////////////////////////////////////////////////////////////////
+
+// A bucket whose stats and creations fail with err until it has been called
+// failures times.
+type flakyBucket struct {
+	gcs.Bucket
+
+	err      error
+	failures int
+	calls    int
+}
+
+func (b *flakyBucket) fail() (err error) {
+	b.calls++
+	if b.calls <= b.failures {
+		err = b.err
+	}
+
+	return
+}
+
+func (b *flakyBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	if err = b.fail(); err != nil {
+		return
+	}
+
+	o, err = b.Bucket.StatObject(ctx, req)
+	return
+}
+
+func (b *flakyBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	if err = b.fail(); err != nil {
+		// Consume some of the contents, as a failed upload would.
+		io.CopyN(ioutil.Discard, req.Contents, 2)
+		return
+	}
+
+	o, err = b.Bucket.CreateObject(ctx, req)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const retryMaxSleep = time.Second
+
+type RetryBucketTest struct {
+	ctx     context.Context
+	clock   timeutil.SimulatedClock
+	wrapped flakyBucket
+	bucket  *retryBucket
+
+	// The sleeps requested by the bucket.
+	sleeps []time.Duration
+}
+
+var _ SetUpInterface = &RetryBucketTest{}
+
+func init() { RegisterTestSuite(&RetryBucketTest{}) }
+
+func (t *RetryBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.wrapped.Bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.wrapped.err = &googleapi.Error{Code: http.StatusServiceUnavailable}
+
+	t.bucket = NewRetryBucket(retryMaxSleep, 2, &t.wrapped).(*retryBucket)
+	t.bucket.sleep = func(ctx context.Context, d time.Duration) error {
+		t.sleeps = append(t.sleeps, d)
+		return nil
+	}
+
+	_, err := gcsutil.CreateObject(t.ctx, t.wrapped.Bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+}
+
+func (t *RetryBucketTest) stat() (err error) {
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *RetryBucketTest) NoFailures() {
+	err := t.stat()
+	AssertEq(nil, err)
+	ExpectEq(1, t.wrapped.calls)
+	ExpectEq(0, len(t.sleeps))
+}
+
+func (t *RetryBucketTest) TransientFailuresRetried() {
+	t.wrapped.failures = 3
+
+	err := t.stat()
+	AssertEq(nil, err)
+	ExpectEq(4, t.wrapped.calls)
+	AssertEq(3, len(t.sleeps))
+
+	// Each sleep is within 50% of an exponentially growing base.
+	base := initialRetrySleep
+	for _, d := range t.sleeps {
+		ExpectGe(d, base/2)
+		ExpectLe(d, base*3/2)
+		base *= 2
+	}
+}
+
+func (t *RetryBucketTest) GivesUpAfterMaxSleep() {
+	t.wrapped.failures = 1000
+
+	err := t.stat()
+	ExpectThat(err, Error(HasSubstr("503")))
+
+	// 100ms, 200ms, ..., 800ms are within a second; 1.6s is not.
+	ExpectEq(4, len(t.sleeps))
+	ExpectEq(5, t.wrapped.calls)
+}
+
+func (t *RetryBucketTest) ZeroMaxSleepDisablesRetries() {
+	t.bucket.maxSleep = 0
+	t.wrapped.failures = 1
+
+	err := t.stat()
+	ExpectThat(err, Error(HasSubstr("503")))
+	ExpectEq(1, t.wrapped.calls)
+}
+
+func (t *RetryBucketTest) PermanentErrorsNotRetried() {
+	t.wrapped.err = &googleapi.Error{Code: http.StatusForbidden}
+	t.wrapped.failures = 1
+
+	err := t.stat()
+	ExpectThat(err, Error(HasSubstr("403")))
+	ExpectEq(1, t.wrapped.calls)
+}
+
+func (t *RetryBucketTest) ThrottlingRetried() {
+	t.wrapped.err = &googleapi.Error{Code: http.StatusTooManyRequests}
+	t.wrapped.failures = 1
+
+	err := t.stat()
+	AssertEq(nil, err)
+	ExpectEq(2, t.wrapped.calls)
+}
+
+func (t *RetryBucketTest) NetworkErrorsRetried() {
+	t.wrapped.err = io.ErrUnexpectedEOF
+	t.wrapped.failures = 1
+
+	err := t.stat()
+	AssertEq(nil, err)
+	ExpectEq(2, t.wrapped.calls)
+}
+
+func (t *RetryBucketTest) CancellationStopsRetries() {
+	t.wrapped.failures = 1000
+	t.bucket.sleep = func(ctx context.Context, d time.Duration) error {
+		return errors.New("cancelled")
+	}
+
+	err := t.stat()
+	ExpectThat(err, Error(HasSubstr("503")))
+	ExpectEq(1, t.wrapped.calls)
+}
+
+func (t *RetryBucketTest) CreateWithPreconditionRetriedFromStart() {
+	t.wrapped.failures = 2
+
+	var gen int64
+	o, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:                   "bar",
+			Contents:               bytes.NewReader([]byte("burrito")),
+			GenerationPrecondition: &gen,
+		})
+
+	AssertEq(nil, err)
+	ExpectEq(3, t.wrapped.calls)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.wrapped.Bucket, o.Name)
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+}
+
+func (t *RetryBucketTest) CreateWithoutPreconditionNotRetried() {
+	t.wrapped.failures = 1
+
+	_, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:     "bar",
+			Contents: bytes.NewReader([]byte("burrito")),
+		})
+
+	ExpectThat(err, Error(HasSubstr("503")))
+	ExpectEq(1, t.wrapped.calls)
+}
@@ -0,0 +1,467 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// The error returned for any attempt to modify a snapshot bucket.
+var ErrSnapshotReadOnly = errors.New("The bucket is a read-only snapshot")
+
+// The number of results returned by ListObjects on a snapshot bucket when the
+// request doesn't specify a maximum, matching GCS.
+const snapshotListingPageSize = 1000
+
+// NewSnapshotBucket lists every object in the wrapped bucket and returns a
+// read-only view of the bucket as it was at that time. Listings and stats are
+// served from the snapshot without contacting GCS, and reads are pinned to the
+// generations recorded in it.
+//
+// Reading an object that has since been overwritten or deleted succeeds only
+// if the bucket retains old generations, i.e. has object versioning enabled.
+// Otherwise it fails with a *gcs.NotFoundError.
+//
+// If spoolThreshold is positive and the bucket contains more objects than
+// that, the snapshot is kept in temporary files in tempDir (or the system
+// default if empty) rather than in memory. This requires the wrapped bucket
+// to list objects in order of name, as GCS does.
+func NewSnapshotBucket(
+	ctx context.Context,
+	wrapped gcs.Bucket,
+	spoolThreshold int,
+	tempDir string) (b gcs.Bucket, err error) {
+	sb := newSnapshotBuilder(spoolThreshold, tempDir)
+	defer func() {
+		if err != nil {
+			sb.Abandon()
+		}
+	}()
+
+	req := &gcs.ListObjectsRequest{}
+	for {
+		var listing *gcs.Listing
+		listing, err = wrapped.ListObjects(ctx, req)
+		if err != nil {
+			err = fmt.Errorf("ListObjects: %v", err)
+			return
+		}
+
+		for _, o := range listing.Objects {
+			if err = sb.Add(o); err != nil {
+				return
+			}
+		}
+
+		if listing.ContinuationToken == "" {
+			break
+		}
+
+		req.ContinuationToken = listing.ContinuationToken
+	}
+
+	b, err = sb.Finish(wrapped)
+	return
+}
+
+// NewAsOfBucket is like NewSnapshotBucket, but returns a view of the bucket
+// as it was at the supplied time rather than now. Each object is pinned to
+// the newest generation created no later than that time, provided the
+// generation wasn't yet overwritten or deleted then.
+//
+// This relies on the bucket retaining old generations, so is only useful for
+// buckets with object versioning enabled. Soft-deleted objects can't be read
+// without restoring them, so they aren't considered.
+func NewAsOfBucket(
+	ctx context.Context,
+	wrapped gcs.Bucket,
+	asOf time.Time,
+	spoolThreshold int,
+	tempDir string) (b gcs.Bucket, err error) {
+	sb := newSnapshotBuilder(spoolThreshold, tempDir)
+	defer func() {
+		if err != nil {
+			sb.Abandon()
+		}
+	}()
+
+	// The generation chosen so far for the name currently being listed. GCS
+	// lists all generations of an object together.
+	var chosen *gcs.Object
+
+	req := &gcs.ListObjectsRequest{Versions: true}
+	for {
+		var listing *gcs.Listing
+		listing, err = wrapped.ListObjects(ctx, req)
+		if err != nil {
+			err = fmt.Errorf("ListObjects: %v", err)
+			return
+		}
+
+		for _, o := range listing.Objects {
+			if !existedAt(o, asOf) {
+				continue
+			}
+
+			if chosen != nil && chosen.Name != o.Name {
+				if err = sb.Add(chosen); err != nil {
+					return
+				}
+
+				chosen = nil
+			}
+
+			if chosen == nil || o.Generation > chosen.Generation {
+				chosen = o
+			}
+		}
+
+		if listing.ContinuationToken == "" {
+			break
+		}
+
+		req.ContinuationToken = listing.ContinuationToken
+	}
+
+	if chosen != nil {
+		if err = sb.Add(chosen); err != nil {
+			return
+		}
+	}
+
+	b, err = sb.Finish(wrapped)
+	return
+}
+
+// Was the supplied generation the live one at time t?
+func existedAt(o *gcs.Object, t time.Time) bool {
+	if o.Created.After(t) {
+		return false
+	}
+
+	return o.Deleted.IsZero() || o.Deleted.After(t)
+}
+
+// Accumulates the objects for a snapshot, moving them to disk if there are
+// more than the spool threshold.
+type snapshotBuilder struct {
+	spoolThreshold int
+	tempDir        string
+
+	// The objects so far, if they're still in memory.
+	objects memObjectList
+
+	// Non-nil once the objects have been moved to disk, in which case last is
+	// the name of the most recent one.
+	spool *spoolWriter
+	last  string
+}
+
+func newSnapshotBuilder(spoolThreshold int, tempDir string) *snapshotBuilder {
+	return &snapshotBuilder{
+		spoolThreshold: spoolThreshold,
+		tempDir:        tempDir,
+	}
+}
+
+func (sb *snapshotBuilder) Add(o *gcs.Object) (err error) {
+	// Accumulate in memory until we pass the threshold.
+	if sb.spool == nil {
+		sb.objects = append(sb.objects, o)
+		if sb.spoolThreshold <= 0 || len(sb.objects) <= sb.spoolThreshold {
+			return
+		}
+
+		// Move what we have so far to disk.
+		sb.spool, err = newSpoolWriter(sb.tempDir)
+		if err != nil {
+			err = fmt.Errorf("newSpoolWriter: %v", err)
+			return
+		}
+
+		sortObjects(sb.objects)
+		for _, so := range sb.objects {
+			if err = sb.spool.Append(so); err != nil {
+				err = fmt.Errorf("Append: %v", err)
+				return
+			}
+		}
+
+		sb.last = sb.objects[len(sb.objects)-1].Name
+		sb.objects = nil
+		return
+	}
+
+	if o.Name <= sb.last {
+		err = fmt.Errorf("Listing isn't sorted: %q follows %q", o.Name, sb.last)
+		return
+	}
+
+	if err = sb.spool.Append(o); err != nil {
+		err = fmt.Errorf("Append: %v", err)
+		return
+	}
+
+	sb.last = o.Name
+	return
+}
+
+// Return a snapshot bucket wrapping the supplied bucket and serving the
+// objects added so far.
+func (sb *snapshotBuilder) Finish(wrapped gcs.Bucket) (b gcs.Bucket, err error) {
+	snap, err := sb.finishSnapshot(wrapped)
+	if err != nil {
+		return
+	}
+
+	b = snap
+	return
+}
+
+func (sb *snapshotBuilder) finishSnapshot(
+	wrapped gcs.Bucket) (snap *snapshotBucket, err error) {
+	snap = &snapshotBucket{
+		wrapped: wrapped,
+	}
+
+	if sb.spool == nil {
+		sortObjects(sb.objects)
+		snap.objects = sb.objects
+	} else {
+		snap.objects, err = sb.spool.Finish()
+		if err != nil {
+			err = fmt.Errorf("Finish: %v", err)
+			return
+		}
+	}
+
+	return
+}
+
+// Clean up after a failure to build the snapshot.
+func (sb *snapshotBuilder) Abandon() {
+	if sb.spool != nil {
+		sb.spool.Abandon()
+	}
+}
+
+func sortObjects(objects []*gcs.Object) {
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Name < objects[j].Name
+	})
+}
+
+type snapshotBucket struct {
+	wrapped gcs.Bucket
+
+	// The objects in the snapshot. This is never modified after construction.
+	objects objectList
+}
+
+// Return a copy of the snapshot's record for the named object.
+func (b *snapshotBucket) find(name string) (o *gcs.Object, err error) {
+	i, err := searchObjects(b.objects, name)
+	if err != nil {
+		err = fmt.Errorf("searchObjects: %v", err)
+		return
+	}
+
+	var found string
+	if i < b.objects.Len() {
+		found, err = b.objects.Name(i)
+		if err != nil {
+			return
+		}
+	}
+
+	if i == b.objects.Len() || found != name {
+		err = &gcs.NotFoundError{
+			Err: fmt.Errorf("Object %q is not in the snapshot", name),
+		}
+
+		return
+	}
+
+	o, err = b.objects.Object(i)
+	return
+}
+
+func (b *snapshotBucket) Name() string {
+	return b.wrapped.Name()
+}
+
+func (b *snapshotBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	o, err := b.find(req.Name)
+	if err != nil {
+		return
+	}
+
+	// Pin the read to the snapshot's generation, unless the caller already
+	// asked for a particular one.
+	mReq := new(gcs.ReadObjectRequest)
+	*mReq = *req
+	if mReq.Generation == 0 {
+		mReq.Generation = o.Generation
+	}
+
+	rc, err = b.wrapped.NewReader(ctx, mReq)
+	return
+}
+
+func (b *snapshotBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	err = ErrSnapshotReadOnly
+	return
+}
+
+func (b *snapshotBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	err = ErrSnapshotReadOnly
+	return
+}
+
+func (b *snapshotBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	err = ErrSnapshotReadOnly
+	return
+}
+
+func (b *snapshotBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.find(req.Name)
+	return
+}
+
+// Emulate GCS listing semantics over the snapshot. Continuation tokens are
+// indices into the sorted list of objects, which is stable since the snapshot
+// never changes.
+func (b *snapshotBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (l *gcs.Listing, err error) {
+	// Find where to start.
+	var start int
+	if req.ContinuationToken != "" {
+		start, err = strconv.Atoi(req.ContinuationToken)
+		if err != nil || start < 0 || start > b.objects.Len() {
+			err = fmt.Errorf(
+				"Invalid continuation token: %q",
+				req.ContinuationToken)
+			return
+		}
+	} else {
+		start, err = searchObjects(b.objects, req.Prefix)
+		if err != nil {
+			err = fmt.Errorf("searchObjects: %v", err)
+			return
+		}
+	}
+
+	maxResults := req.MaxResults
+	if maxResults <= 0 {
+		maxResults = snapshotListingPageSize
+	}
+
+	var glob *gcs.Glob
+	if req.MatchGlob != "" {
+		glob, err = gcs.ParseGlob(req.MatchGlob)
+		if err != nil {
+			err = fmt.Errorf("ParseGlob: %v", err)
+			return
+		}
+	}
+
+	l = new(gcs.Listing)
+	var lastRun string
+	for i := start; i < b.objects.Len(); i++ {
+		var name string
+		name, err = b.objects.Name(i)
+		if err != nil {
+			return
+		}
+
+		if !strings.HasPrefix(name, req.Prefix) {
+			break
+		}
+
+		if glob != nil && !glob.Match(name) {
+			continue
+		}
+
+		// Collapse runs, if requested.
+		var run string
+		if req.Delimiter != "" {
+			rest := name[len(req.Prefix):]
+			if j := strings.Index(rest, req.Delimiter); j >= 0 {
+				run = req.Prefix + rest[:j+len(req.Delimiter)]
+			}
+		}
+
+		// Special case: further members of a run we've already returned.
+		if run != "" && run == lastRun {
+			continue
+		}
+
+		// Is this page full?
+		if len(l.Objects)+len(l.CollapsedRuns) == maxResults {
+			l.ContinuationToken = strconv.Itoa(i)
+			break
+		}
+
+		if run != "" {
+			l.CollapsedRuns = append(l.CollapsedRuns, run)
+			lastRun = run
+			continue
+		}
+
+		var o *gcs.Object
+		o, err = b.objects.Object(i)
+		if err != nil {
+			return
+		}
+
+		l.Objects = append(l.Objects, o)
+	}
+
+	return
+}
+
+func (b *snapshotBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	err = ErrSnapshotReadOnly
+	return
+}
+
+func (b *snapshotBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	err = ErrSnapshotReadOnly
+	return
+}
@@ -0,0 +1,347 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/oglemock"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestSnapshotBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type SnapshotBucketTest struct {
+	ctx     context.Context
+	wrapped gcs.Bucket
+	bucket  gcs.Bucket
+
+	// Passed to NewSnapshotBucket.
+	spoolThreshold int
+}
+
+var _ SetUpInterface = &SnapshotBucketTest{}
+
+func init() { RegisterTestSuite(&SnapshotBucketTest{}) }
+
+// The same tests, with the snapshot kept on disk.
+type SpooledSnapshotBucketTest struct {
+	SnapshotBucketTest
+}
+
+func init() { RegisterTestSuite(&SpooledSnapshotBucketTest{}) }
+
+func (t *SpooledSnapshotBucketTest) SetUp(ti *TestInfo) {
+	t.spoolThreshold = 2
+	t.SnapshotBucketTest.SetUp(ti)
+}
+
+func (t *SnapshotBucketTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.ctx = ti.Ctx
+	t.wrapped = gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket")
+
+	// Set up some contents, then take the snapshot.
+	err = gcsutil.CreateObjects(
+		t.ctx,
+		t.wrapped,
+		map[string][]byte{
+			"a":     []byte("taco"),
+			"b/c":   []byte(""),
+			"b/d/e": []byte(""),
+			"b/f":   []byte(""),
+			"g":     []byte(""),
+		})
+
+	AssertEq(nil, err)
+
+	t.bucket, err = gcsx.NewSnapshotBucket(
+		t.ctx,
+		t.wrapped,
+		t.spoolThreshold,
+		"")
+	AssertEq(nil, err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *SnapshotBucketTest) LaterChangesAreInvisible() {
+	// Add an object and delete another behind the snapshot's back.
+	_, err := gcsutil.CreateObject(t.ctx, t.wrapped, "h", []byte(""))
+	AssertEq(nil, err)
+
+	err = t.wrapped.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "g"})
+	AssertEq(nil, err)
+
+	// Neither change should show up.
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "h"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "g"})
+	AssertEq(nil, err)
+	ExpectEq("g", o.Name)
+
+	objects, runs, err := gcsutil.ListAll(
+		t.ctx,
+		t.bucket,
+		&gcs.ListObjectsRequest{Delimiter: "/"})
+
+	AssertEq(nil, err)
+	AssertEq(2, len(objects))
+	ExpectEq("a", objects[0].Name)
+	ExpectEq("g", objects[1].Name)
+	ExpectThat(runs, ElementsAre("b/"))
+}
+
+func (t *SnapshotBucketTest) ReadsArePinned() {
+	// Overwrite an object behind the snapshot's back. The fake bucket doesn't
+	// keep old generations, so reading it should fail rather than silently
+	// returning the new contents.
+	_, err := gcsutil.CreateObject(t.ctx, t.wrapped, "a", []byte("burrito"))
+	AssertEq(nil, err)
+
+	_, err = gcsutil.ReadObject(t.ctx, t.bucket, "a")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *SnapshotBucketTest) ReadUnchanged() {
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "a")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *SnapshotBucketTest) ListPrefixInPages() {
+	var objects []string
+	var runs []string
+
+	req := &gcs.ListObjectsRequest{
+		Prefix:     "b/",
+		Delimiter:  "/",
+		MaxResults: 1,
+	}
+
+	for {
+		l, err := t.bucket.ListObjects(t.ctx, req)
+		AssertEq(nil, err)
+		AssertLe(len(l.Objects)+len(l.CollapsedRuns), 1)
+
+		for _, o := range l.Objects {
+			objects = append(objects, o.Name)
+		}
+
+		runs = append(runs, l.CollapsedRuns...)
+		if l.ContinuationToken == "" {
+			break
+		}
+
+		req.ContinuationToken = l.ContinuationToken
+	}
+
+	ExpectThat(objects, ElementsAre("b/c", "b/f"))
+	ExpectThat(runs, ElementsAre("b/d/"))
+}
+
+func (t *SnapshotBucketTest) ModificationsFail() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "h", []byte(""))
+	ExpectEq(gcsx.ErrSnapshotReadOnly, err)
+
+	err = t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "a"})
+	ExpectEq(gcsx.ErrSnapshotReadOnly, err)
+
+	_, err = gcsutil.ReadObject(t.ctx, t.wrapped, "a")
+	ExpectEq(nil, err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// As of a time
+////////////////////////////////////////////////////////////////////////
+
+type AsOfBucketTest struct {
+	ctx     context.Context
+	wrapped gcs.MockBucket
+	asOf    time.Time
+
+	// The listing requests received by the wrapped bucket.
+	listReqs []*gcs.ListObjectsRequest
+}
+
+var _ SetUpInterface = &AsOfBucketTest{}
+
+func init() { RegisterTestSuite(&AsOfBucketTest{}) }
+
+func (t *AsOfBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.wrapped = gcs.NewMockBucket(ti.MockController, "some_bucket")
+	t.asOf = time.Date(2017, 1, 1, 10, 0, 0, 0, time.UTC)
+}
+
+// Return a generation of an object created at the given hour of the day of
+// t.asOf and overwritten or deleted at the other, or still live if that is
+// zero.
+func (t *AsOfBucketTest) version(
+	name string,
+	generation int64,
+	created int,
+	deleted int) (o *gcs.Object) {
+	at := func(hour int) time.Time {
+		return time.Date(2017, 1, 1, hour, 0, 0, 0, time.UTC)
+	}
+
+	o = &gcs.Object{
+		Name:       name,
+		Generation: generation,
+		Created:    at(created),
+	}
+
+	if deleted != 0 {
+		o.Deleted = at(deleted)
+	}
+
+	return
+}
+
+// Expect the bucket to be listed in two pages with the supplied contents.
+func (t *AsOfBucketTest) expectListing(first, second []*gcs.Object) {
+	pages := []*gcs.Listing{
+		&gcs.Listing{Objects: first, ContinuationToken: "p"},
+		&gcs.Listing{Objects: second},
+	}
+
+	list := func(
+		ctx context.Context,
+		req *gcs.ListObjectsRequest) (l *gcs.Listing, err error) {
+		copied := *req
+		t.listReqs = append(t.listReqs, &copied)
+
+		l = pages[0]
+		pages = pages[1:]
+		return
+	}
+
+	ExpectCall(t.wrapped, "ListObjects")(Any(), Any()).
+		Times(2).
+		WillRepeatedly(Invoke(list))
+}
+
+func (t *AsOfBucketTest) newBucket() (b gcs.Bucket) {
+	b, err := gcsx.NewAsOfBucket(t.ctx, t.wrapped, t.asOf, 0, "")
+	AssertEq(nil, err)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *AsOfBucketTest) ListsVersions() {
+	t.expectListing(nil, nil)
+	t.newBucket()
+
+	AssertEq(2, len(t.listReqs))
+	ExpectTrue(t.listReqs[0].Versions)
+	ExpectTrue(t.listReqs[1].Versions)
+	ExpectEq("p", t.listReqs[1].ContinuationToken)
+}
+
+func (t *AsOfBucketTest) ChoosesGenerationLiveAtTime() {
+	t.expectListing(
+		[]*gcs.Object{
+			// Overwritten before the time, then after it.
+			t.version("a", 1, 0, 5),
+			t.version("a", 2, 5, 20),
+		},
+		[]*gcs.Object{
+			t.version("a", 3, 20, 0),
+
+			// Deleted before the time.
+			t.version("b", 4, 1, 2),
+
+			// Created after the time.
+			t.version("c", 5, 12, 0),
+
+			// Unchanged since before the time.
+			t.version("d", 6, 0, 0),
+
+			// Created exactly at the time.
+			t.version("e", 7, 10, 0),
+		})
+
+	b := t.newBucket()
+
+	objects, _, err := gcsutil.ListAll(t.ctx, b, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+	AssertEq(3, len(objects))
+
+	ExpectEq("a", objects[0].Name)
+	ExpectEq(2, objects[0].Generation)
+	ExpectEq("d", objects[1].Name)
+	ExpectEq(6, objects[1].Generation)
+	ExpectEq("e", objects[2].Name)
+	ExpectEq(7, objects[2].Generation)
+
+	_, err = b.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "b"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	_, err = b.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "c"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *AsOfBucketTest) ReadsArePinned() {
+	t.expectListing(
+		[]*gcs.Object{
+			t.version("a", 1, 0, 20),
+			t.version("a", 2, 20, 0),
+		},
+		nil)
+
+	b := t.newBucket()
+
+	var req *gcs.ReadObjectRequest
+	ExpectCall(t.wrapped, "NewReader")(Any(), Any()).
+		WillOnce(DoAll(SaveArg(1, &req), Return(nil, errors.New("taco"))))
+
+	_, err := b.NewReader(t.ctx, &gcs.ReadObjectRequest{Name: "a"})
+	ExpectThat(err, Error(HasSubstr("taco")))
+
+	AssertNe(nil, req)
+	ExpectEq("a", req.Name)
+	ExpectEq(1, req.Generation)
+}
+
+func (t *AsOfBucketTest) ListingFails() {
+	ExpectCall(t.wrapped, "ListObjects")(Any(), Any()).
+		WillOnce(Return(nil, errors.New("taco")))
+
+	_, err := gcsx.NewAsOfBucket(t.ctx, t.wrapped, t.asOf, 0, "")
+	ExpectThat(err, Error(HasSubstr("ListObjects")))
+	ExpectThat(err, Error(HasSubstr("taco")))
+}
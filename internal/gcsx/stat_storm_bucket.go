@@ -0,0 +1,272 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+// The window over which stats of each object are counted to detect a storm,
+// and for which the result of a stat is cached once one has been detected.
+const statStormWindow = time.Second
+
+// The minimum interval between log messages about stat storms.
+const statStormLogInterval = time.Minute
+
+// NewStatStormBucket creates a bucket that protects the wrapped bucket from
+// applications that stat the same object pathologically often, e.g. by
+// calling stat(2) on one path in a tight loop, regardless of any stat cache
+// configuration.
+//
+// When more than threshold stats of a single object name are made within a
+// statStormWindow, the result of the next is cached and served to any others
+// of that name for the following statStormWindow, so that the rate of
+// requests reaching GCS for the name is limited to roughly threshold per
+// window. Modifications made through the bucket update the cached results.
+func NewStatStormBucket(
+	threshold int,
+	clock timeutil.Clock,
+	wrapped gcs.Bucket) (b gcs.Bucket) {
+	b = &statStormBucket{
+		threshold: threshold,
+		clock:     clock,
+		wrapped:   wrapped,
+		counts:    make(map[string]int),
+		cache:     make(map[string]stormEntry),
+	}
+
+	return
+}
+
+// A cached stat result: an object record, or nil for not found.
+type stormEntry struct {
+	o          *gcs.Object
+	expiration time.Time
+}
+
+type statStormBucket struct {
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	threshold int
+	clock     timeutil.Clock
+	wrapped   gcs.Bucket
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// The end of the current window, and the number of stats of each name that
+	// have reached the wrapped bucket within it.
+	//
+	// GUARDED_BY(mu)
+	windowEnd time.Time
+	counts    map[string]int
+
+	// Cached results for names undergoing a storm. Expired entries are removed
+	// at the end of each window.
+	//
+	// GUARDED_BY(mu)
+	cache map[string]stormEntry
+
+	// The total number of stats served from the cache, and the last time we
+	// logged about it.
+	//
+	// GUARDED_BY(mu)
+	served  uint64
+	lastLog time.Time
+}
+
+// Start a new window if the current one has passed.
+//
+// LOCKS_REQUIRED(b.mu)
+func (b *statStormBucket) maybeRollWindow(now time.Time) {
+	if now.Before(b.windowEnd) {
+		return
+	}
+
+	b.windowEnd = now.Add(statStormWindow)
+	b.counts = make(map[string]int)
+	for name, e := range b.cache {
+		if !now.Before(e.expiration) {
+			delete(b.cache, name)
+		}
+	}
+}
+
+// Update the cached result for the named object, if there is one, to reflect
+// an attempt to modify it through this bucket. If the attempt failed, or
+// doesn't tell us the object's new state, o is nil and the cached result is
+// simply forgotten.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *statStormBucket) update(name string, o *gcs.Object) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e, ok := b.cache[name]
+	switch {
+	case !ok:
+		return
+
+	case o == nil:
+		delete(b.cache, name)
+
+	default:
+		e.o = new(gcs.Object)
+		*e.o = *o
+		b.cache[name] = e
+	}
+}
+
+func (b *statStormBucket) Name() string {
+	return b.wrapped.Name()
+}
+
+func (b *statStormBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	rc, err = b.wrapped.NewReader(ctx, req)
+	return
+}
+
+func (b *statStormBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.CreateObject(ctx, req)
+	b.update(req.Name, o)
+
+	return
+}
+
+func (b *statStormBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.CopyObject(ctx, req)
+	b.update(req.DstName, o)
+
+	return
+}
+
+func (b *statStormBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.ComposeObjects(ctx, req)
+	b.update(req.DstName, o)
+
+	return
+}
+
+// LOCKS_EXCLUDED(b.mu)
+func (b *statStormBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	b.mu.Lock()
+	now := b.clock.Now()
+	b.maybeRollWindow(now)
+
+	// Serve from the cache if we can.
+	if e, ok := b.cache[req.Name]; ok && now.Before(e.expiration) {
+		b.served++
+		b.mu.Unlock()
+
+		if e.o == nil {
+			err = &gcs.NotFoundError{
+				Err: fmt.Errorf("Stat storm cache entry for %q", req.Name),
+			}
+
+			return
+		}
+
+		o = new(gcs.Object)
+		*o = *e.o
+		return
+	}
+
+	// Otherwise, count this stat.
+	b.counts[req.Name]++
+	storming := b.counts[req.Name] > b.threshold
+	b.mu.Unlock()
+
+	o, err = b.wrapped.StatObject(ctx, req)
+
+	// Cache definitive results for storming names.
+	_, notFound := err.(*gcs.NotFoundError)
+	if !storming || (err != nil && !notFound) {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e := stormEntry{expiration: now.Add(statStormWindow)}
+	if o != nil {
+		e.o = new(gcs.Object)
+		*e.o = *o
+	}
+
+	b.cache[req.Name] = e
+
+	if now.Sub(b.lastLog) >= statStormLogInterval {
+		b.lastLog = now
+		log.Printf(
+			"Stat storm: %q was statted more than %d times in %v; caching stats "+
+				"of it for %v. %d stats served from this cache so far.",
+			req.Name,
+			b.threshold,
+			statStormWindow,
+			statStormWindow,
+			b.served)
+	}
+
+	return
+}
+
+func (b *statStormBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (l *gcs.Listing, err error) {
+	l, err = b.wrapped.ListObjects(ctx, req)
+	return
+}
+
+func (b *statStormBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.UpdateObject(ctx, req)
+	b.update(req.Name, o)
+
+	return
+}
+
+func (b *statStormBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	err = b.wrapped.DeleteObject(ctx, req)
+
+	// Another generation may remain, so forget rather than guess.
+	b.update(req.Name, nil)
+	return
+}
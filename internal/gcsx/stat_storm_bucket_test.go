@@ -0,0 +1,150 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestStatStormBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// countingBucket
+////////////////////////////////////////////////////////////////////////
+
+// A bucket that counts the stats that reach it.
+type countingBucket struct {
+	gcs.Bucket
+	stats int
+}
+
+func (b *countingBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	b.stats++
+	o, err = b.Bucket.StatObject(ctx, req)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const statStormThreshold = 10
+
+type StatStormBucketTest struct {
+	ctx     context.Context
+	clock   timeutil.SimulatedClock
+	wrapped countingBucket
+	bucket  gcs.Bucket
+}
+
+var _ SetUpInterface = &StatStormBucketTest{}
+
+func init() { RegisterTestSuite(&StatStormBucketTest{}) }
+
+func (t *StatStormBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.wrapped.Bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.bucket = gcsx.NewStatStormBucket(statStormThreshold, &t.clock, &t.wrapped)
+
+	_, err := gcsutil.CreateObject(t.ctx, t.wrapped.Bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+}
+
+// Stat the named object n times through the storm bucket.
+func (t *StatStormBucketTest) stat(name string, n int) (o *gcs.Object, err error) {
+	for i := 0; i < n; i++ {
+		o, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: name})
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *StatStormBucketTest) BelowThreshold() {
+	o, err := t.stat("foo", statStormThreshold)
+
+	AssertEq(nil, err)
+	ExpectEq("foo", o.Name)
+	ExpectEq(statStormThreshold, t.wrapped.stats)
+}
+
+func (t *StatStormBucketTest) StormIsServedFromCache() {
+	o, err := t.stat("foo", 1000)
+
+	AssertEq(nil, err)
+	ExpectEq("foo", o.Name)
+	ExpectEq(statStormThreshold+1, t.wrapped.stats)
+
+	// Other names are unaffected.
+	_, err = t.stat("bar", 1)
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+	ExpectEq(statStormThreshold+2, t.wrapped.stats)
+}
+
+func (t *StatStormBucketTest) NotFoundIsCached() {
+	_, err := t.stat("bar", 1000)
+
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+	ExpectEq(statStormThreshold+1, t.wrapped.stats)
+}
+
+func (t *StatStormBucketTest) CacheExpires() {
+	_, err := t.stat("foo", 1000)
+	AssertEq(nil, err)
+
+	// In the next window, stats reach GCS again, until the threshold.
+	t.clock.AdvanceTime(time.Second)
+
+	_, err = t.stat("foo", 1000)
+	AssertEq(nil, err)
+	ExpectEq(2*(statStormThreshold+1), t.wrapped.stats)
+}
+
+func (t *StatStormBucketTest) ModificationsUpdateCache() {
+	_, err := t.stat("foo", 1000)
+	AssertEq(nil, err)
+
+	// Overwrite the object through the storm bucket.
+	created, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("burrito"))
+	AssertEq(nil, err)
+
+	o, err := t.stat("foo", 1)
+	AssertEq(nil, err)
+	ExpectEq(created.Generation, o.Generation)
+
+	// Deleting it should be noticed too.
+	err = t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	_, err = t.stat("foo", 1)
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
@@ -0,0 +1,250 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// The chunk size used by NewStreamingUpload callers that have no opinion.
+const DefaultStreamChunkSize = 8 << 20
+
+// A StreamingUpload creates a new generation of an object from contents
+// written to it in order, sending them to GCS as they arrive rather than
+// staging them locally first. Data is collected in memory until a chunk of
+// it has accumulated, so that writes don't each wait for the network, and
+// the chunk is then sent before the write that filled it returns. Checksums
+// are computed on the way out and compared with those GCS reports once the
+// upload is finalized.
+//
+// Not safe for concurrent access.
+type StreamingUpload struct {
+	bucket gcs.Bucket
+	pw     *io.PipeWriter
+	cancel func()
+	sum    *checksummer
+	size   int64
+
+	// The mtime recorded in the new generation's metadata when the upload
+	// started.
+	mtime time.Time
+
+	// Data written but not yet sent, which is sent once it reaches chunkSize
+	// bytes.
+	//
+	// INVARIANT: len(buf) < chunkSize
+	chunkSize int
+	buf       []byte
+
+	// Closed when the upload has finished, after setting o and err.
+	done chan struct{}
+	o    *gcs.Object
+	err  error
+}
+
+// NewStreamingUpload starts uploading a new generation of the supplied
+// object, to be created only if src is still the current generation, with
+// whatever contents are written before Finish is called and the supplied
+// mtime. At most chunkSize bytes are held in memory at a time.
+//
+// REQUIRES: chunkSize > 0
+func NewStreamingUpload(
+	bucket gcs.Bucket,
+	src *gcs.Object,
+	mtime time.Time,
+	chunkSize int) (u *StreamingUpload) {
+	pr, pw := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	u = &StreamingUpload{
+		pw:        pw,
+		cancel:    cancel,
+		bucket:    bucket,
+		sum:       newChecksummer(),
+		mtime:     mtime,
+		done:      make(chan struct{}),
+		chunkSize: chunkSize,
+	}
+
+	req := &gcs.CreateObjectRequest{
+		Name:                       src.Name,
+		GenerationPrecondition:     &src.Generation,
+		MetaGenerationPrecondition: &src.MetaGeneration,
+		Contents:                   pr,
+		Metadata: map[string]string{
+			MtimeMetadataKey: mtime.UTC().Format(time.RFC3339Nano),
+		},
+	}
+
+	go func() {
+		defer close(u.done)
+		u.o, u.err = bucket.CreateObject(ctx, req)
+
+		// Make sure that writers don't block forever if the upload finishes
+		// early, e.g. because the precondition failed.
+		if u.err != nil {
+			pr.CloseWithError(u.err)
+		} else {
+			pr.CloseWithError(errors.New("Upload finished early"))
+		}
+	}()
+
+	return
+}
+
+// Size returns the number of bytes written so far.
+func (u *StreamingUpload) Size() int64 {
+	return u.size
+}
+
+// Write appends the supplied data to the contents being uploaded. If that
+// fills a chunk, it blocks until GCS has accepted the chunk. An error means
+// that the upload has failed, and Finish should be called to find out why.
+func (u *StreamingUpload) Write(p []byte) (err error) {
+	for len(p) > 0 && err == nil {
+		// Special case: if the data fills a chunk by itself, don't copy it.
+		if len(u.buf) == 0 && len(p) >= u.chunkSize {
+			var n int
+			n, err = u.pw.Write(p)
+			u.sum.Write(p[:n])
+			u.size += int64(n)
+			return
+		}
+
+		if u.buf == nil {
+			u.buf = make([]byte, 0, u.chunkSize)
+		}
+
+		// Fill the current chunk as far as possible.
+		n := u.chunkSize - len(u.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+
+		u.buf = append(u.buf, p[:n]...)
+		u.sum.Write(p[:n])
+		u.size += int64(n)
+		p = p[n:]
+
+		if len(u.buf) == u.chunkSize {
+			err = u.flush()
+		}
+	}
+
+	return
+}
+
+// Send any data held in memory.
+func (u *StreamingUpload) flush() (err error) {
+	if len(u.buf) == 0 {
+		return
+	}
+
+	_, err = u.pw.Write(u.buf)
+	u.buf = u.buf[:0]
+
+	return
+}
+
+// Finish finalizes the upload, returning the new generation along with the
+// checksums computed over the contents written. If they don't match those
+// GCS reports for the new generation, the generation is returned along with
+// an error. A *gcs.PreconditionError is returned unmangled.
+//
+// The supplied mtime, normally that of the last write, replaces the one the
+// upload was started with, at the cost of a further request if they differ.
+// If that request fails, the generation is likewise returned with an error.
+//
+// If the context is cancelled first, the upload is aborted.
+func (u *StreamingUpload) Finish(
+	ctx context.Context,
+	mtime time.Time) (o *gcs.Object, checksums *Checksums, err error) {
+	// Send the last partial chunk, unless the upload has already failed, in
+	// which case the reason is below.
+	if u.flush() == nil {
+		u.pw.Close()
+	}
+
+	select {
+	case <-u.done:
+
+	case <-ctx.Done():
+		u.Abort()
+		err = ctx.Err()
+		return
+	}
+
+	// Don't mangle precondition errors.
+	if _, ok := u.err.(*gcs.PreconditionError); ok {
+		err = u.err
+		return
+	}
+
+	if u.err != nil {
+		err = fmt.Errorf("CreateObject: %w", u.err)
+		return
+	}
+
+	o = u.o
+	checksums = u.sum.verify(o)
+
+	if !checksums.Matched {
+		err = fmt.Errorf(
+			"Checksum mismatch for %q: uploaded %v, GCS has crc32c=%08x",
+			o.Name,
+			checksums,
+			o.CRC32C)
+		return
+	}
+
+	// Record the final mtime, if it has moved on.
+	if mtime.Equal(u.mtime) {
+		return
+	}
+
+	formatted := mtime.UTC().Format(time.RFC3339Nano)
+	updated, err := u.bucket.UpdateObject(
+		ctx,
+		&gcs.UpdateObjectRequest{
+			Name:                       o.Name,
+			Generation:                 o.Generation,
+			MetaGenerationPrecondition: &o.MetaGeneration,
+			Metadata: map[string]*string{
+				MtimeMetadataKey: &formatted,
+			},
+		})
+
+	if err != nil {
+		err = fmt.Errorf("UpdateObject: %w", err)
+		return
+	}
+
+	o = updated
+	return
+}
+
+// Abort abandons the upload without creating a new generation, and waits for
+// it to finish.
+func (u *StreamingUpload) Abort() {
+	u.cancel()
+	u.pw.CloseWithError(errors.New("Upload aborted"))
+	<-u.done
+}
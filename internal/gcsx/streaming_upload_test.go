@@ -0,0 +1,204 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestStreamingUpload(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type StreamingUploadTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket gcs.Bucket
+
+	// An empty object to be overwritten.
+	src *gcs.Object
+}
+
+var _ SetUpInterface = &StreamingUploadTest{}
+
+func init() { RegisterTestSuite(&StreamingUploadTest{}) }
+
+func (t *StreamingUploadTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.UTC))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	t.src, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte{})
+	AssertEq(nil, err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *StreamingUploadTest) NothingWritten() {
+	u := NewStreamingUpload(
+		t.bucket,
+		t.src,
+		t.clock.Now(),
+		DefaultStreamChunkSize)
+
+	ExpectEq(0, u.Size())
+
+	o, checksums, err := u.Finish(t.ctx, t.clock.Now())
+	AssertEq(nil, err)
+
+	ExpectLt(t.src.Generation, o.Generation)
+	ExpectEq(0, o.Size)
+	ExpectTrue(checksums.Matched)
+}
+
+func (t *StreamingUploadTest) SeveralWrites() {
+	u := NewStreamingUpload(
+		t.bucket,
+		t.src,
+		t.clock.Now(),
+		DefaultStreamChunkSize)
+
+	AssertEq(nil, u.Write([]byte("taco")))
+	AssertEq(nil, u.Write([]byte("burrito")))
+	ExpectEq(len("tacoburrito"), u.Size())
+
+	o, checksums, err := u.Finish(t.ctx, t.clock.Now())
+	AssertEq(nil, err)
+
+	ExpectEq(len("tacoburrito"), o.Size)
+	ExpectTrue(checksums.Matched)
+	ExpectEq(o.CRC32C, checksums.CRC32C)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("tacoburrito", string(contents))
+}
+
+func (t *StreamingUploadTest) Clobbered() {
+	u := NewStreamingUpload(
+		t.bucket,
+		t.src,
+		t.clock.Now(),
+		DefaultStreamChunkSize)
+
+	AssertEq(nil, u.Write([]byte("taco")))
+
+	newObj, err := gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		"foo",
+		[]byte("burrito"))
+
+	AssertEq(nil, err)
+
+	_, _, err = u.Finish(t.ctx, t.clock.Now())
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	ExpectEq(newObj.Generation, o.Generation)
+}
+
+func (t *StreamingUploadTest) Abort() {
+	u := NewStreamingUpload(
+		t.bucket,
+		t.src,
+		t.clock.Now(),
+		DefaultStreamChunkSize)
+
+	AssertEq(nil, u.Write([]byte("taco")))
+
+	u.Abort()
+
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	ExpectEq(t.src.Generation, o.Generation)
+}
+
+func (t *StreamingUploadTest) SeveralChunks() {
+	u := NewStreamingUpload(
+		t.bucket,
+		t.src,
+		t.clock.Now(),
+		4)
+
+	// Writes that fill part of a chunk, span several, and fill one by
+	// themselves.
+	AssertEq(nil, u.Write([]byte("ta")))
+	AssertEq(nil, u.Write([]byte("coburrito")))
+	ExpectEq(len("tacoburrito"), u.Size())
+
+	AssertEq(nil, u.Write([]byte("enchilada")))
+	ExpectEq(len("tacoburritoenchilada"), u.Size())
+
+	o, checksums, err := u.Finish(t.ctx, t.clock.Now())
+	AssertEq(nil, err)
+
+	ExpectEq(len("tacoburritoenchilada"), o.Size)
+	ExpectTrue(checksums.Matched)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("tacoburritoenchilada", string(contents))
+}
+
+func (t *StreamingUploadTest) Mtime() {
+	mtime := t.clock.Now().Add(-time.Hour)
+	u := NewStreamingUpload(t.bucket, t.src, mtime, DefaultStreamChunkSize)
+	AssertEq(nil, u.Write([]byte("taco")))
+
+	o, _, err := u.Finish(t.ctx, mtime)
+	AssertEq(nil, err)
+
+	// The mtime should have been recorded when the object was created.
+	ExpectEq(
+		mtime.UTC().Format(time.RFC3339Nano),
+		o.Metadata[MtimeMetadataKey])
+
+	ExpectEq(1, o.MetaGeneration)
+}
+
+func (t *StreamingUploadTest) MtimeOfLastWrite() {
+	start := t.clock.Now().Add(-time.Hour)
+	u := NewStreamingUpload(t.bucket, t.src, start, DefaultStreamChunkSize)
+	AssertEq(nil, u.Write([]byte("taco")))
+
+	mtime := start.Add(time.Minute)
+	o, _, err := u.Finish(t.ctx, mtime)
+	AssertEq(nil, err)
+
+	// The later mtime should have replaced the first.
+	expected := mtime.UTC().Format(time.RFC3339Nano)
+	ExpectEq(expected, o.Metadata[MtimeMetadataKey])
+
+	o, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	ExpectEq(expected, o.Metadata[MtimeMetadataKey])
+}
@@ -17,9 +17,11 @@ package gcsx
 import (
 	"fmt"
 	"io"
+	"log"
+	"sync"
 	"time"
 
-	"github.com/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
 	"golang.org/x/net/context"
 )
 
@@ -28,6 +30,11 @@ import (
 // by time.RFC3339Nano.
 const MtimeMetadataKey = "gcsfuse_mtime"
 
+// MaxObjectSize is the largest object that GCS will store, 5 TiB. Contents
+// larger than this can never be synced, so callers should refuse to create
+// them in the first place.
+const MaxObjectSize = 5 << 40
+
 // Syncer is safe for concurrent access.
 type Syncer interface {
 	// Given an object record and content that was originally derived from that
@@ -40,10 +47,20 @@ type Syncer interface {
 	//
 	// In the second case, the TempFile is destroyed. Otherwise, including when
 	// this function fails, it is guaranteed to still be valid.
+	//
+	// If the full contents were uploaded (rather than appended to the source
+	// object), checksums computed over them on the way out are also returned,
+	// compared against those GCS reports for the new object.
+	//
+	// If an earlier attempt to upload the full contents for the same source
+	// generation failed in a way that leaves it unknown whether it took effect
+	// (e.g. a timeout after the request was sent), the object is first statted.
+	// If a new generation with the same mtime, size, and checksums as the
+	// content is found, it is returned rather than uploading the content again.
 	SyncObject(
 		ctx context.Context,
 		srcObject *gcs.Object,
-		content TempFile) (o *gcs.Object, err error)
+		content TempFile) (o *gcs.Object, checksums *Checksums, err error)
 }
 
 // NewSyncer creates a syncer that syncs into the supplied bucket.
@@ -69,8 +86,39 @@ func NewSyncer(
 		bucket)
 
 	// And the syncer.
-	os = newSyncer(appendThreshold, fullCreator, appendCreator)
+	os = newSyncer(appendThreshold, fullCreator, appendCreator, bucket)
+
+	return
+}
+
+// NewParallelSyncer is like NewSyncer, except that contents of at least
+// pu.Threshold bytes that must be uploaded in full are split into parts,
+// which are uploaded up to pu.Streams at a time as temporary blobs and then
+// composed. See ParallelUpload.
+//
+// The parts have names beginning with partPrefix. A large upload may take
+// hours, so garbage collection must leave objects under partPrefix alone for
+// much longer than other temporary blobs.
+func NewParallelSyncer(
+	appendThreshold int64,
+	pu ParallelUpload,
+	tmpObjectPrefix string,
+	partPrefix string,
+	bucket gcs.Bucket) (os Syncer) {
+	fullCreator := &fullObjectCreator{
+		bucket: bucket,
+	}
+
+	appendCreator := newAppendObjectCreator(
+		tmpObjectPrefix,
+		bucket)
 
+	s := newSyncer(appendThreshold, fullCreator, appendCreator, bucket).(*syncer)
+	s.parallelThreshold = pu.Threshold
+	s.parallelCreator = newParallelObjectCreator(partPrefix, pu, bucket)
+	s.parallelNewFilesOnly = !pu.RewriteExisting
+
+	os = s
 	return
 }
 
@@ -104,7 +152,7 @@ func (oc *fullObjectCreator) Create(
 			return
 		}
 
-		err = fmt.Errorf("CreateObject: %v", err)
+		err = fmt.Errorf("CreateObject: %w", err)
 		return
 	}
 
@@ -137,29 +185,138 @@ type objectCreator interface {
 // worthwhile to make the append optimization. It should be set to a value on
 // the order of the bandwidth to GCS times three times the round trip latency
 // to GCS (for a small create, a compose, and a delete).
+//
+// bucket is used to check whether a full upload that failed ambiguously
+// actually succeeded, before trying again.
 func newSyncer(
 	appendThreshold int64,
 	fullCreator objectCreator,
-	appendCreator objectCreator) (os Syncer) {
+	appendCreator objectCreator,
+	bucket gcs.Bucket) (os Syncer) {
 	os = &syncer{
 		appendThreshold: appendThreshold,
 		fullCreator:     fullCreator,
 		appendCreator:   appendCreator,
+		bucket:          bucket,
+		ambiguous:       make(map[string]int64),
 	}
 
 	return
 }
 
 type syncer struct {
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
 	appendThreshold int64
 	fullCreator     objectCreator
 	appendCreator   objectCreator
+	bucket          gcs.Bucket
+
+	// If non-nil, used instead of fullCreator for contents of at least
+	// parallelThreshold bytes (and, if parallelNewFilesOnly is set, only when
+	// the source object is empty).
+	parallelThreshold    int64
+	parallelCreator      *parallelObjectCreator
+	parallelNewFilesOnly bool
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// The source generations, by object name, of full uploads that failed with
+	// an error other than a precondition error, and so may in fact have created
+	// a new generation.
+	//
+	// GUARDED_BY(mu)
+	ambiguous map[string]int64
+}
+
+// If the last full upload for srcObject failed ambiguously, check whether it
+// in fact created a generation whose contents match the supplied content. If
+// so, return that generation along with the checksums of the content.
+// Otherwise return a nil object, and the caller should upload the content.
+//
+// LOCKS_EXCLUDED(os.mu)
+func (os *syncer) findAmbiguousUpload(
+	ctx context.Context,
+	srcObject *gcs.Object,
+	content TempFile,
+	size int64,
+	mtime time.Time) (o *gcs.Object, checksums *Checksums, err error) {
+	os.mu.Lock()
+	srcGeneration, ok := os.ambiguous[srcObject.Name]
+	os.mu.Unlock()
+
+	if !ok || srcGeneration != srcObject.Generation {
+		return
+	}
+
+	// Find the current generation of the object, if any.
+	latest, err := os.bucket.StatObject(
+		ctx,
+		&gcs.StatObjectRequest{Name: srcObject.Name})
+
+	if _, ok := err.(*gcs.NotFoundError); ok {
+		err = nil
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("StatObject: %w", err)
+		return
+	}
+
+	// Cheap checks first: the attempt we're looking for created a new
+	// generation with our mtime and size.
+	if latest.Generation == srcObject.Generation ||
+		latest.Metadata[MtimeMetadataKey] != mtime.Format(time.RFC3339Nano) ||
+		int64(latest.Size) != size {
+		return
+	}
+
+	// Then compare checksums of the content with those GCS reports.
+	c, err := checksumContent(content, latest)
+	if err != nil {
+		return
+	}
+
+	if !c.Matched {
+		return
+	}
+
+	log.Printf(
+		"Previous upload of %q succeeded despite failing; not uploading again.",
+		srcObject.Name)
+
+	o = latest
+	checksums = c
+	return
+}
+
+// Record the outcome of a full upload for srcObject.
+//
+// LOCKS_EXCLUDED(os.mu)
+func (os *syncer) recordFullUpload(srcObject *gcs.Object, err error) {
+	os.mu.Lock()
+	defer os.mu.Unlock()
+
+	_, precondition := err.(*gcs.PreconditionError)
+	if err == nil || precondition {
+		delete(os.ambiguous, srcObject.Name)
+		return
+	}
+
+	os.ambiguous[srcObject.Name] = srcObject.Generation
 }
 
 func (os *syncer) SyncObject(
 	ctx context.Context,
 	srcObject *gcs.Object,
-	content TempFile) (o *gcs.Object, err error) {
+	content TempFile) (o *gcs.Object, checksums *Checksums, err error) {
 	// Stat the content.
 	sr, err := content.Stat()
 	if err != nil {
@@ -209,13 +366,65 @@ func (os *syncer) SyncObject(
 
 		o, err = os.appendCreator.Create(ctx, srcObject, mtime, content)
 	} else {
-		_, err = content.Seek(0, 0)
+		// Avoid uploading the content again if a previous attempt actually
+		// succeeded.
+		o, checksums, err = os.findAmbiguousUpload(
+			ctx,
+			srcObject,
+			content,
+			sr.Size,
+			mtime)
+
 		if err != nil {
-			err = fmt.Errorf("Seek: %v", err)
+			err = fmt.Errorf("findAmbiguousUpload: %w", err)
+			return
+		}
+
+		if o != nil {
+			os.recordFullUpload(srcObject, nil)
+			content.Destroy()
 			return
 		}
 
-		o, err = os.fullCreator.Create(ctx, srcObject, mtime, content)
+		// Special case: upload large contents in parallel parts, if configured,
+		// checksumming them afterwards since the parts are read out of order.
+		if os.parallelCreator != nil &&
+			sr.Size >= os.parallelThreshold &&
+			(!os.parallelNewFilesOnly || srcSize == 0) {
+			o, err = os.parallelCreator.Create(
+				ctx,
+				srcObject,
+				mtime,
+				content,
+				sr.Size)
+
+			os.recordFullUpload(srcObject, err)
+			if err == nil {
+				checksums, err = checksumContent(content, o)
+				if err != nil {
+					err = fmt.Errorf("checksumContent: %v", err)
+					return
+				}
+			}
+		} else {
+			_, err = content.Seek(0, 0)
+			if err != nil {
+				err = fmt.Errorf("Seek: %v", err)
+				return
+			}
+
+			sum := newChecksummer()
+			o, err = os.fullCreator.Create(
+				ctx,
+				srcObject,
+				mtime,
+				io.TeeReader(content, sum))
+
+			os.recordFullUpload(srcObject, err)
+			if err == nil {
+				checksums = sum.verify(o)
+			}
+		}
 	}
 
 	// Deal with errors.
@@ -225,7 +434,7 @@ func (os *syncer) SyncObject(
 			return
 		}
 
-		err = fmt.Errorf("Create: %v", err)
+		err = fmt.Errorf("Create: %w", err)
 		return
 	}
 
@@ -234,3 +443,25 @@ func (os *syncer) SyncObject(
 
 	return
 }
+
+// Compute checksums over the whole of the supplied content, compared against
+// those of the supplied object.
+func checksumContent(
+	content TempFile,
+	o *gcs.Object) (checksums *Checksums, err error) {
+	_, err = content.Seek(0, 0)
+	if err != nil {
+		err = fmt.Errorf("Seek: %v", err)
+		return
+	}
+
+	sum := newChecksummer()
+	_, err = io.Copy(sum, content)
+	if err != nil {
+		err = fmt.Errorf("Copy: %v", err)
+		return
+	}
+
+	checksums = sum.verify(o)
+	return
+}
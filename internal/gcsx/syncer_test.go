@@ -16,14 +16,15 @@ package gcsx
 
 import (
 	"errors"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"strings"
 	"testing"
 	"time"
 
-	"github.com/jacobsa/gcloud/gcs"
-	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsfake"
 	. "github.com/jacobsa/oglematchers"
 	. "github.com/jacobsa/ogletest"
 	"github.com/jacobsa/timeutil"
@@ -105,7 +106,8 @@ func (t *SyncerTest) SetUp(ti *TestInfo) {
 	t.syncer = newSyncer(
 		appendThreshold,
 		&t.fullCreator,
-		&t.appendCreator)
+		&t.appendCreator,
+		t.bucket)
 
 	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
 
@@ -133,7 +135,7 @@ func (t *SyncerTest) SetUp(ti *TestInfo) {
 }
 
 func (t *SyncerTest) call() (o *gcs.Object, err error) {
-	o, err = t.syncer.SyncObject(t.ctx, t.srcObject, t.content)
+	o, _, err = t.syncer.SyncObject(t.ctx, t.srcObject, t.content)
 	return
 }
 
@@ -208,7 +210,8 @@ func (t *SyncerTest) SourceTooShortForAppend() {
 	t.syncer = newSyncer(
 		int64(len(srcObjectContents)+1),
 		&t.fullCreator,
-		&t.appendCreator)
+		&t.appendCreator,
+		t.bucket)
 
 	// Extend the length of the content.
 	err = t.content.Truncate(int64(len(srcObjectContents) + 1))
@@ -317,6 +320,165 @@ func (t *SyncerTest) FullCreatorSucceeds() {
 	ExpectEq(t.fullCreator.o, o)
 }
 
+func (t *SyncerTest) FullCreatorSucceeds_Checksums() {
+	var err error
+	crc := crc32.Checksum(
+		[]byte(srcObjectContents[:2]),
+		crc32.MakeTable(crc32.Castagnoli))
+
+	t.fullCreator.o = &gcs.Object{Generation: 17, CRC32C: crc}
+	t.fullCreator.err = nil
+
+	// Truncate downward.
+	err = t.content.Truncate(2)
+	AssertEq(nil, err)
+
+	// Call
+	_, checksums, err := t.syncer.SyncObject(t.ctx, t.srcObject, t.content)
+
+	AssertEq(nil, err)
+	AssertNe(nil, checksums)
+	ExpectEq(17, checksums.Generation)
+	ExpectEq(crc, checksums.CRC32C)
+	ExpectTrue(checksums.Matched)
+}
+
+func (t *SyncerTest) FullCreatorSucceeds_ChecksumMismatch() {
+	var err error
+	t.fullCreator.o = &gcs.Object{CRC32C: 1234}
+	t.fullCreator.err = nil
+
+	// Truncate downward.
+	err = t.content.Truncate(2)
+	AssertEq(nil, err)
+
+	// Call
+	_, checksums, err := t.syncer.SyncObject(t.ctx, t.srcObject, t.content)
+
+	AssertEq(nil, err)
+	AssertNe(nil, checksums)
+	ExpectFalse(checksums.Matched)
+}
+
+// Simulate a full upload that fails ambiguously, leaving the supplied
+// contents (if any) in the bucket as if it had succeeded after all.
+func (t *SyncerTest) failAmbiguously(landed *string) {
+	t.fullCreator.err = errors.New("timeout")
+	_, err := t.call()
+	AssertThat(err, Error(HasSubstr("timeout")))
+
+	if landed != nil {
+		sr, err := t.content.Stat()
+		AssertEq(nil, err)
+
+		_, err = t.bucket.CreateObject(
+			t.ctx,
+			&gcs.CreateObjectRequest{
+				Name:     t.srcObject.Name,
+				Contents: strings.NewReader(*landed),
+				Metadata: map[string]string{
+					MtimeMetadataKey: sr.Mtime.UTC().Format(time.RFC3339Nano),
+				},
+			})
+
+		AssertEq(nil, err)
+	}
+
+	// Prepare for the retry.
+	t.fullCreator = fakeObjectCreator{o: &gcs.Object{}}
+}
+
+func (t *SyncerTest) RetryAfterAmbiguousFailure_Succeeded() {
+	var err error
+
+	// Truncate downward, then fail in a way that actually succeeded.
+	err = t.content.Truncate(2)
+	AssertEq(nil, err)
+
+	landed := srcObjectContents[:2]
+	t.failAmbiguously(&landed)
+
+	// The retry should find the new generation without uploading again.
+	o, checksums, err := t.syncer.SyncObject(t.ctx, t.srcObject, t.content)
+
+	AssertEq(nil, err)
+	AssertNe(nil, o)
+	ExpectEq(t.srcObject.Name, o.Name)
+	ExpectNe(t.srcObject.Generation, o.Generation)
+	ExpectFalse(t.fullCreator.called)
+
+	AssertNe(nil, checksums)
+	ExpectEq(o.Generation, checksums.Generation)
+	ExpectTrue(checksums.Matched)
+}
+
+func (t *SyncerTest) RetryAfterAmbiguousFailure_Failed() {
+	var err error
+
+	// Truncate downward, then fail without anything landing.
+	err = t.content.Truncate(2)
+	AssertEq(nil, err)
+
+	t.failAmbiguously(nil)
+
+	// The retry should upload.
+	o, err := t.call()
+
+	AssertEq(nil, err)
+	ExpectEq(t.fullCreator.o, o)
+	ExpectTrue(t.fullCreator.called)
+}
+
+func (t *SyncerTest) RetryAfterAmbiguousFailure_OtherContentsLanded() {
+	var err error
+
+	// Truncate downward, then fail while somebody else writes contents of the
+	// same length.
+	err = t.content.Truncate(2)
+	AssertEq(nil, err)
+
+	landed := "ab"
+	t.failAmbiguously(&landed)
+
+	// The retry should not mistake those contents for ours.
+	o, err := t.call()
+
+	AssertEq(nil, err)
+	ExpectEq(t.fullCreator.o, o)
+	ExpectTrue(t.fullCreator.called)
+}
+
+func (t *SyncerTest) RetryAfterPreconditionError() {
+	var err error
+
+	// Truncate downward, then fail with a precondition error while our contents
+	// land anyway (as if written by somebody else).
+	err = t.content.Truncate(2)
+	AssertEq(nil, err)
+
+	t.fullCreator.err = &gcs.PreconditionError{}
+	_, err = t.call()
+	AssertNe(nil, err)
+
+	landed := srcObjectContents[:2]
+	_, err = t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:     t.srcObject.Name,
+			Contents: strings.NewReader(landed),
+		})
+
+	AssertEq(nil, err)
+
+	// A precondition error is unambiguous, so the retry should upload.
+	t.fullCreator = fakeObjectCreator{o: &gcs.Object{}}
+	o, err := t.call()
+
+	AssertEq(nil, err)
+	ExpectEq(t.fullCreator.o, o)
+	ExpectTrue(t.fullCreator.called)
+}
+
 func (t *SyncerTest) CallsAppendCreator() {
 	var err error
 
@@ -381,3 +543,19 @@ func (t *SyncerTest) AppendCreatorSucceeds() {
 	AssertEq(nil, err)
 	ExpectEq(t.appendCreator.o, o)
 }
+
+func (t *SyncerTest) AppendCreatorSucceeds_NoChecksums() {
+	var err error
+	t.appendCreator.o = &gcs.Object{}
+	t.appendCreator.err = nil
+
+	// Append some data.
+	_, err = t.content.WriteAt([]byte("burrito"), int64(t.srcObject.Size))
+	AssertEq(nil, err)
+
+	// Only the appended data is uploaded, so there is nothing to verify.
+	_, checksums, err := t.syncer.SyncObject(t.ctx, t.srcObject, t.content)
+
+	AssertEq(nil, err)
+	ExpectEq(nil, checksums)
+}
@@ -20,7 +20,7 @@ import (
 	"os"
 	"time"
 
-	"github.com/jacobsa/fuse/fsutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fsutil"
 	"github.com/jacobsa/timeutil"
 )
 
@@ -92,6 +92,16 @@ func NewTempFile(
 		return
 	}
 
+	tf = newTempFile(f, size, clock)
+	return
+}
+
+// Wrap an anonymous file already holding the supplied number of bytes of
+// initial contents.
+func newTempFile(
+	f *os.File,
+	size int64,
+	clock timeutil.Clock) (tf *tempFile) {
 	tf = &tempFile{
 		clock:          clock,
 		f:              f,
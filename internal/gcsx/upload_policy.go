@@ -0,0 +1,184 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// UploadPolicy restricts the contents that may be written to objects, for
+// mounts that are exposed to semi-trusted users. The zero value permits
+// everything.
+type UploadPolicy struct {
+	// If positive, the maximum size in bytes of an object that may be written.
+	MaxSize int64
+
+	// If non-empty, the file name extensions (e.g. ".txt") that objects may
+	// have. Comparison is case-insensitive, and the leading dot is optional.
+	AllowedExtensions []string
+
+	// If non-empty, a command that is run with /bin/sh before each upload, with
+	// the object's contents on stdin and its name and size in the environment
+	// variables GCSFUSE_OBJECT_NAME and GCSFUSE_OBJECT_SIZE. The upload is
+	// rejected if the command exits with a non-zero status.
+	ScanCommand string
+}
+
+// PolicyViolationError is returned when a write is rejected by an
+// UploadPolicy.
+type PolicyViolationError struct {
+	Name   string
+	Reason string
+}
+
+func (pve *PolicyViolationError) Error() string {
+	return fmt.Sprintf("Upload of %q rejected by policy: %s", pve.Name, pve.Reason)
+}
+
+// CheckName returns a *PolicyViolationError if objects with the given name
+// may not be written under the policy. This allows rejecting a file at
+// creation time, before the user has written anything to it.
+func (p *UploadPolicy) CheckName(name string) (err error) {
+	if len(p.AllowedExtensions) == 0 {
+		return
+	}
+
+	ext := strings.ToLower(path.Ext(name))
+	for _, allowed := range p.AllowedExtensions {
+		allowed = strings.ToLower(allowed)
+		if !strings.HasPrefix(allowed, ".") {
+			allowed = "." + allowed
+		}
+
+		if ext == allowed {
+			return
+		}
+	}
+
+	err = &PolicyViolationError{
+		Name:   name,
+		Reason: fmt.Sprintf("extension %q is not allowed", ext),
+	}
+
+	return
+}
+
+// Check returns a *PolicyViolationError if the supplied contents may not be
+// written to an object with the given name under the policy. Any other error
+// means that the check could not be carried out.
+func (p *UploadPolicy) Check(
+	ctx context.Context,
+	name string,
+	contents io.ReaderAt,
+	size int64) (err error) {
+	// Check the name.
+	err = p.CheckName(name)
+	if err != nil {
+		return
+	}
+
+	// Check the size.
+	if p.MaxSize > 0 && size > p.MaxSize {
+		err = &PolicyViolationError{
+			Name:   name,
+			Reason: fmt.Sprintf("size %d exceeds limit of %d", size, p.MaxSize),
+		}
+
+		return
+	}
+
+	// Run the scan command, if any.
+	if p.ScanCommand == "" {
+		return
+	}
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", p.ScanCommand)
+	cmd.Stdin = io.NewSectionReader(contents, 0, size)
+	cmd.Env = append(
+		os.Environ(),
+		"GCSFUSE_OBJECT_NAME="+name,
+		fmt.Sprintf("GCSFUSE_OBJECT_SIZE=%d", size))
+
+	err = cmd.Run()
+
+	// Special case: a non-zero exit status is a rejection.
+	if _, ok := err.(*exec.ExitError); ok {
+		err = &PolicyViolationError{
+			Name:   name,
+			Reason: fmt.Sprintf("scan command failed: %v", err),
+		}
+
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("Run: %v", err)
+		return
+	}
+
+	return
+}
+
+// NewValidatingSyncer creates a syncer that checks dirty contents against the
+// supplied policy before handing them to the wrapped syncer, so that nothing
+// is written to the bucket if the policy is violated.
+func NewValidatingSyncer(
+	policy *UploadPolicy,
+	wrapped Syncer) (s Syncer) {
+	s = &validatingSyncer{
+		policy:  policy,
+		wrapped: wrapped,
+	}
+
+	return
+}
+
+type validatingSyncer struct {
+	policy  *UploadPolicy
+	wrapped Syncer
+}
+
+func (vs *validatingSyncer) SyncObject(
+	ctx context.Context,
+	srcObject *gcs.Object,
+	content TempFile) (o *gcs.Object, checksums *Checksums, err error) {
+	// Stat the content.
+	sr, err := content.Stat()
+	if err != nil {
+		err = fmt.Errorf("Stat: %v", err)
+		return
+	}
+
+	// Clean contents won't be uploaded, so there is nothing to check. This
+	// mirrors the test in syncer.SyncObject.
+	srcSize := int64(srcObject.Size)
+	if sr.Size != srcSize || sr.DirtyThreshold != srcSize {
+		err = vs.policy.Check(ctx, srcObject.Name, content, sr.Size)
+		if err != nil {
+			return
+		}
+	}
+
+	o, checksums, err = vs.wrapped.SyncObject(ctx, srcObject, content)
+	return
+}
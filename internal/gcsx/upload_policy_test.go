@@ -0,0 +1,175 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestUploadPolicy(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type UploadPolicyTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket gcs.Bucket
+	policy UploadPolicy
+	syncer Syncer
+}
+
+var _ SetUpInterface = &UploadPolicyTest{}
+
+func init() { RegisterTestSuite(&UploadPolicyTest{}) }
+
+func (t *UploadPolicyTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.syncer = NewValidatingSyncer(
+		&t.policy,
+		NewSyncer(1<<20, ".gcsfuse_tmp/", t.bucket))
+}
+
+// Create an object with the given name and empty contents, then attempt to
+// sync the supplied contents to it, returning the result.
+func (t *UploadPolicyTest) sync(
+	name string,
+	contents string) (o *gcs.Object, err error) {
+	src, err := gcsutil.CreateObject(t.ctx, t.bucket, name, []byte{})
+	AssertEq(nil, err)
+
+	tf, err := NewTempFile(strings.NewReader(""), "", &t.clock)
+	AssertEq(nil, err)
+	defer tf.Destroy()
+
+	_, err = tf.WriteAt([]byte(contents), 0)
+	AssertEq(nil, err)
+
+	o, _, err = t.syncer.SyncObject(t.ctx, src, tf)
+	return
+}
+
+// Return the current contents of the named object.
+func (t *UploadPolicyTest) read(name string) string {
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, name)
+	AssertEq(nil, err)
+
+	return string(contents)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *UploadPolicyTest) ZeroValuePermitsEverything() {
+	o, err := t.sync("foo.exe", "taco")
+
+	AssertEq(nil, err)
+	AssertNe(nil, o)
+	ExpectEq("taco", t.read("foo.exe"))
+}
+
+func (t *UploadPolicyTest) CheckName() {
+	t.policy.AllowedExtensions = []string{".txt", "CSV"}
+
+	ExpectEq(nil, t.policy.CheckName("foo.txt"))
+	ExpectEq(nil, t.policy.CheckName("dir/foo.TXT"))
+	ExpectEq(nil, t.policy.CheckName("foo.csv"))
+
+	err := t.policy.CheckName("foo.exe")
+	_, ok := err.(*PolicyViolationError)
+	ExpectTrue(ok, "err: %v", err)
+
+	err = t.policy.CheckName("foo")
+	_, ok = err.(*PolicyViolationError)
+	ExpectTrue(ok, "err: %v", err)
+}
+
+func (t *UploadPolicyTest) DisallowedExtension() {
+	t.policy.AllowedExtensions = []string{".txt"}
+
+	_, err := t.sync("foo.exe", "taco")
+
+	_, ok := err.(*PolicyViolationError)
+	AssertTrue(ok, "err: %v", err)
+	ExpectThat(err, Error(HasSubstr(".exe")))
+	ExpectEq("", t.read("foo.exe"))
+}
+
+func (t *UploadPolicyTest) SizeLimit() {
+	t.policy.MaxSize = 4
+
+	// At the limit.
+	_, err := t.sync("foo", "taco")
+	AssertEq(nil, err)
+	ExpectEq("taco", t.read("foo"))
+
+	// Over the limit.
+	_, err = t.sync("bar", "burrito")
+
+	_, ok := err.(*PolicyViolationError)
+	AssertTrue(ok, "err: %v", err)
+	ExpectThat(err, Error(HasSubstr("exceeds limit")))
+	ExpectEq("", t.read("bar"))
+}
+
+func (t *UploadPolicyTest) ScanCommandAccepts() {
+	t.policy.ScanCommand =
+		`test "$GCSFUSE_OBJECT_NAME" = foo && test "$(cat)" = taco`
+
+	_, err := t.sync("foo", "taco")
+
+	AssertEq(nil, err)
+	ExpectEq("taco", t.read("foo"))
+}
+
+func (t *UploadPolicyTest) ScanCommandRejects() {
+	t.policy.ScanCommand = `! grep -q EICAR`
+
+	_, err := t.sync("foo", "xxEICARxx")
+
+	_, ok := err.(*PolicyViolationError)
+	AssertTrue(ok, "err: %v", err)
+	ExpectThat(err, Error(HasSubstr("scan command")))
+	ExpectEq("", t.read("foo"))
+}
+
+func (t *UploadPolicyTest) CleanContentsAreNotChecked() {
+	src, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo.exe", []byte("taco"))
+	AssertEq(nil, err)
+
+	tf, err := NewTempFile(strings.NewReader("taco"), "", &t.clock)
+	AssertEq(nil, err)
+	defer tf.Destroy()
+
+	t.policy.AllowedExtensions = []string{".txt"}
+	o, _, err := t.syncer.SyncObject(t.ctx, src, tf)
+
+	AssertEq(nil, err)
+	ExpectEq(nil, o)
+}
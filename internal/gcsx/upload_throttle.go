@@ -0,0 +1,73 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"io"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/ratelimit"
+	"golang.org/x/net/context"
+)
+
+// NewUploadThrottledBucket creates a bucket that limits the bandwidth with
+// which the contents of new objects are sent to the wrapped bucket according
+// to the supplied throttle. Sharing the throttle with a
+// ratelimit.NewThrottledBucket, which limits only the bandwidth of reads,
+// puts a single limit on the mount's traffic in both directions.
+func NewUploadThrottledBucket(
+	throttle ratelimit.Throttle,
+	wrapped gcs.Bucket) gcs.Bucket {
+	return &uploadThrottledBucket{
+		Bucket:   wrapped,
+		throttle: throttle,
+	}
+}
+
+type uploadThrottledBucket struct {
+	gcs.Bucket
+	throttle ratelimit.Throttle
+}
+
+// Contents whose reads are throttled. Seeks go straight to the underlying
+// contents, so that layers below can still rewind them to retry an upload.
+type throttledContents struct {
+	io.Reader
+	seeker io.Seeker
+}
+
+func (tc *throttledContents) Seek(
+	offset int64,
+	whence int) (pos int64, err error) {
+	pos, err = tc.seeker.Seek(offset, whence)
+	return
+}
+
+func (b *uploadThrottledBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	reqCopy := *req
+	reqCopy.Contents = ratelimit.ThrottledReader(ctx, req.Contents, b.throttle)
+
+	if seeker, ok := req.Contents.(io.Seeker); ok {
+		reqCopy.Contents = &throttledContents{
+			Reader: reqCopy.Contents,
+			seeker: seeker,
+		}
+	}
+
+	o, err = b.Bucket.CreateObject(ctx, &reqCopy)
+	return
+}
@@ -0,0 +1,126 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestUploadThrottle(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// countingThrottle
+////////////////////////////////////////////////////////////////////////
+
+// A throttle that never waits, but counts the tokens acquired.
+type countingThrottle struct {
+	capacity uint64
+	tokens   uint64
+}
+
+func (t *countingThrottle) Capacity() uint64 {
+	return t.capacity
+}
+
+func (t *countingThrottle) Wait(ctx context.Context, tokens uint64) error {
+	AssertLe(tokens, t.capacity)
+	t.tokens += tokens
+	return nil
+}
+
+// A bucket that records whether the contents it is given can be rewound.
+type seekCheckingBucket struct {
+	gcs.Bucket
+	seekable bool
+}
+
+func (b *seekCheckingBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	_, b.seekable = req.Contents.(io.Seeker)
+	o, err = b.Bucket.CreateObject(ctx, req)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type UploadThrottleTest struct {
+	ctx      context.Context
+	clock    timeutil.SimulatedClock
+	throttle countingThrottle
+	wrapped  seekCheckingBucket
+	bucket   gcs.Bucket
+}
+
+var _ SetUpInterface = &UploadThrottleTest{}
+
+func init() { RegisterTestSuite(&UploadThrottleTest{}) }
+
+func (t *UploadThrottleTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.throttle.capacity = 4
+	t.wrapped.Bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.bucket = gcsx.NewUploadThrottledBucket(&t.throttle, &t.wrapped)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *UploadThrottleTest) ContentsThrottled() {
+	const contents = "enchilada"
+
+	_, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:     "foo",
+			Contents: strings.NewReader(contents),
+		})
+
+	AssertEq(nil, err)
+	ExpectGe(t.throttle.tokens, len(contents))
+	ExpectTrue(t.wrapped.seekable)
+
+	actual, err := gcsutil.ReadObject(t.ctx, t.wrapped.Bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq(contents, string(actual))
+}
+
+func (t *UploadThrottleTest) UnseekableContentsStayUnseekable() {
+	_, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:     "foo",
+			Contents: io.MultiReader(strings.NewReader("taco")),
+		})
+
+	AssertEq(nil, err)
+	ExpectFalse(t.wrapped.seekable)
+}
@@ -0,0 +1,149 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// ErrWriteBudgetExceeded is returned by a syncer created with
+// NewBudgetedSyncer when writing out contents would take the total written
+// past the budget.
+var ErrWriteBudgetExceeded = errors.New("Write budget exceeded")
+
+// WriteBudget tracks the number of bytes written to the bucket against a
+// fixed limit. Safe for concurrent access.
+type WriteBudget struct {
+	limit int64
+
+	mu sync.Mutex
+
+	// The bytes written so far, plus those of uploads in progress.
+	//
+	// INVARIANT: used <= limit
+	//
+	// GUARDED_BY(mu)
+	used int64
+}
+
+// NewWriteBudget creates a budget permitting limit bytes to be written.
+func NewWriteBudget(limit int64) (b *WriteBudget) {
+	b = &WriteBudget{limit: limit}
+	return
+}
+
+// Exhausted returns true if nothing more may be written.
+func (b *WriteBudget) Exhausted() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.used >= b.limit
+}
+
+// Set aside n bytes of the budget, returning ErrWriteBudgetExceeded if there
+// aren't that many left.
+func (b *WriteBudget) reserve(n int64) (err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if n > b.limit-b.used {
+		err = ErrWriteBudgetExceeded
+		return
+	}
+
+	b.used += n
+	if b.used == b.limit {
+		log.Printf("Write budget of %d bytes exhausted.", b.limit)
+	}
+
+	return
+}
+
+// Return n bytes set aside by reserve, for an upload that failed.
+func (b *WriteBudget) release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.used -= n
+}
+
+// NewBudgetedSyncer creates a syncer that charges the bytes of dirty contents
+// to the supplied budget before handing them to the wrapped syncer, failing
+// with ErrWriteBudgetExceeded rather than writing anything if there isn't
+// enough left. Contents that have only been appended to are charged for the
+// appended bytes; otherwise the full size is charged. Failed syncs are
+// refunded.
+func NewBudgetedSyncer(
+	budget *WriteBudget,
+	wrapped Syncer) (s Syncer) {
+	s = &budgetedSyncer{
+		budget:  budget,
+		wrapped: wrapped,
+	}
+
+	return
+}
+
+type budgetedSyncer struct {
+	budget  *WriteBudget
+	wrapped Syncer
+}
+
+func (bs *budgetedSyncer) SyncObject(
+	ctx context.Context,
+	srcObject *gcs.Object,
+	content TempFile) (o *gcs.Object, checksums *Checksums, err error) {
+	// Stat the content.
+	sr, err := content.Stat()
+	if err != nil {
+		err = fmt.Errorf("Stat: %v", err)
+		return
+	}
+
+	// Work out what the new bytes are. Clean contents won't be uploaded, so
+	// they cost nothing. This mirrors the test in syncer.SyncObject.
+	var n int64
+	srcSize := int64(srcObject.Size)
+	switch {
+	case sr.Size == srcSize && sr.DirtyThreshold == srcSize:
+		n = 0
+
+	case sr.DirtyThreshold == srcSize:
+		n = sr.Size - srcSize
+
+	default:
+		n = sr.Size
+	}
+
+	err = bs.budget.reserve(n)
+	if err != nil {
+		err = fmt.Errorf("Writing %d bytes to %q: %w", n, srcObject.Name, err)
+		return
+	}
+
+	o, checksums, err = bs.wrapped.SyncObject(ctx, srcObject, content)
+	if err != nil {
+		bs.budget.release(n)
+		return
+	}
+
+	return
+}
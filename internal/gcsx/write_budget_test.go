@@ -0,0 +1,180 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestWriteBudget(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type WriteBudgetTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket gcs.Bucket
+	budget *WriteBudget
+	syncer Syncer
+}
+
+var _ SetUpInterface = &WriteBudgetTest{}
+
+func init() { RegisterTestSuite(&WriteBudgetTest{}) }
+
+func (t *WriteBudgetTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.setLimit(10)
+}
+
+func (t *WriteBudgetTest) setLimit(limit int64) {
+	t.budget = NewWriteBudget(limit)
+	t.syncer = NewBudgetedSyncer(
+		t.budget,
+		NewSyncer(1<<20, ".gcsfuse_tmp/", t.bucket))
+}
+
+// Create an object with the given name and contents.
+func (t *WriteBudgetTest) create(name string, contents string) *gcs.Object {
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, name, []byte(contents))
+	AssertEq(nil, err)
+	return o
+}
+
+// Attempt to sync the contents of src with the supplied data written at the
+// given offset.
+func (t *WriteBudgetTest) sync(
+	src *gcs.Object,
+	data string,
+	offset int64) (o *gcs.Object, err error) {
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, src.Name)
+	AssertEq(nil, err)
+
+	tf, err := NewTempFile(strings.NewReader(string(contents)), "", &t.clock)
+	AssertEq(nil, err)
+	defer tf.Destroy()
+
+	if data != "" {
+		_, err = tf.WriteAt([]byte(data), offset)
+		AssertEq(nil, err)
+	}
+
+	o, _, err = t.syncer.SyncObject(t.ctx, src, tf)
+	return
+}
+
+// Return the current contents of the named object.
+func (t *WriteBudgetTest) read(name string) string {
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, name)
+	AssertEq(nil, err)
+
+	return string(contents)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *WriteBudgetTest) WithinBudget() {
+	_, err := t.sync(t.create("foo", ""), "taco", 0)
+
+	AssertEq(nil, err)
+	ExpectEq("taco", t.read("foo"))
+	ExpectFalse(t.budget.Exhausted())
+}
+
+func (t *WriteBudgetTest) OverBudget() {
+	_, err := t.sync(t.create("foo", ""), "enchilada", 0)
+	AssertEq(nil, err)
+
+	_, err = t.sync(t.create("bar", ""), "burrito", 0)
+
+	ExpectTrue(errors.Is(err, ErrWriteBudgetExceeded), "err: %v", err)
+	ExpectEq("", t.read("bar"))
+	ExpectFalse(t.budget.Exhausted())
+}
+
+func (t *WriteBudgetTest) ExactlyExhausted() {
+	t.setLimit(4)
+
+	_, err := t.sync(t.create("foo", ""), "taco", 0)
+	AssertEq(nil, err)
+	ExpectTrue(t.budget.Exhausted())
+
+	_, err = t.sync(t.create("bar", ""), "a", 0)
+	ExpectTrue(errors.Is(err, ErrWriteBudgetExceeded), "err: %v", err)
+}
+
+func (t *WriteBudgetTest) AppendsChargedForNewBytes() {
+	src := t.create("foo", "taco")
+
+	// Seven new bytes fit, though the whole object would not.
+	o, err := t.sync(src, "burrito", 4)
+	AssertEq(nil, err)
+	ExpectEq("tacoburrito", t.read("foo"))
+
+	// Four more don't.
+	_, err = t.sync(o, "taco", int64(o.Size))
+	ExpectTrue(errors.Is(err, ErrWriteBudgetExceeded), "err: %v", err)
+}
+
+func (t *WriteBudgetTest) RewritesChargedForWholeObject() {
+	src := t.create("foo", "burrito")
+
+	_, err := t.sync(src, "B", 0)
+	AssertEq(nil, err)
+
+	// Seven bytes were charged, leaving three.
+	_, err = t.sync(t.create("bar", ""), "taco", 0)
+	ExpectTrue(errors.Is(err, ErrWriteBudgetExceeded), "err: %v", err)
+}
+
+func (t *WriteBudgetTest) CleanContentsAreFree() {
+	t.setLimit(0)
+
+	o, err := t.sync(t.create("foo", "taco"), "", 0)
+
+	AssertEq(nil, err)
+	ExpectEq(nil, o)
+}
+
+func (t *WriteBudgetTest) FailedSyncsAreRefunded() {
+	src := t.create("foo", "")
+
+	// Clobber the source, so that the sync fails.
+	t.create("foo", "enchilada")
+
+	_, err := t.sync(src, "burrito", 0)
+	_, ok := err.(*gcs.PreconditionError)
+	AssertTrue(ok, "err: %v", err)
+
+	// The whole budget remains.
+	_, err = t.sync(t.create("bar", ""), "enchilada", 0)
+	ExpectEq(nil, err)
+}
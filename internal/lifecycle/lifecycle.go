@@ -0,0 +1,390 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package lifecycle predicts what a bucket's object lifecycle management rules
+// and retention policy will do to the live generation of an object, without
+// doing it. See https://cloud.google.com/storage/docs/lifecycle for the
+// semantics being modelled.
+package lifecycle
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Action types understood by Advise. Rules with other actions (e.g.
+// AbortIncompleteMultipartUpload) never apply to objects.
+const (
+	Delete          = "Delete"
+	SetStorageClass = "SetStorageClass"
+)
+
+// A Rule is a lifecycle rule, in the form in which the JSON API reports it as
+// part of a bucket resource.
+type Rule struct {
+	Action    Action    `json:"action"`
+	Condition Condition `json:"condition"`
+}
+
+// An Action is what a rule does once its conditions are met.
+type Action struct {
+	Type string `json:"type"`
+
+	// For SetStorageClass, the class to which objects are moved.
+	StorageClass string `json:"storageClass"`
+}
+
+// A Condition is the conjunction of the conditions under which a rule applies
+// to an object. Unset fields are ignored.
+type Condition struct {
+	// The number of days after an object's creation at which it matches.
+	Age *int64 `json:"age"`
+
+	// A date (e.g. "2017-06-01"); objects created before midnight UTC at the
+	// start of it match.
+	CreatedBefore string `json:"createdBefore"`
+
+	// If set, whether the rule applies to live generations (true) or
+	// noncurrent ones (false).
+	IsLive *bool `json:"isLive"`
+
+	MatchesStorageClass []string `json:"matchesStorageClass"`
+	MatchesPrefix       []string `json:"matchesPrefix"`
+	MatchesSuffix       []string `json:"matchesSuffix"`
+
+	// Conditions satisfied only by noncurrent generations.
+	NumNewerVersions        *int64 `json:"numNewerVersions"`
+	DaysSinceNoncurrentTime *int64 `json:"daysSinceNoncurrentTime"`
+	NoncurrentTimeBefore    string `json:"noncurrentTimeBefore"`
+
+	// Conditions satisfied only by objects with a custom time: the number of
+	// days after it at which they match, and a date before which it must lie.
+	DaysSinceCustomTime *int64 `json:"daysSinceCustomTime"`
+	CustomTimeBefore    string `json:"customTimeBefore"`
+}
+
+// Config describes what happens to objects in a bucket over time.
+type Config struct {
+	Rules []Rule
+
+	// The period for which objects can't be deleted after their creation, or
+	// zero if the bucket has no retention policy.
+	RetentionPeriod time.Duration
+
+	// The storage class with which new objects are created.
+	DefaultStorageClass string
+
+	// A prefix to add to the names of subjects to form object names, e.g.
+	// for a mount of a single directory.
+	NamePrefix string
+}
+
+// A Subject is an object whose fate is to be predicted, or a prefix under
+// which objects may be written.
+type Subject struct {
+	// The object's name. If Prefix is set, the prefix under which objects are
+	// to be considered, e.g. "logs/" or "" for the whole bucket.
+	Name   string
+	Prefix bool
+
+	StorageClass string
+	Created      time.Time
+
+	// The object's custom time, or zero if it has none, and whether it is
+	// under a temporary hold, which prevents its deletion.
+	CustomTime    time.Time
+	TemporaryHold bool
+}
+
+// A Fate is something that a rule will do to an object.
+type Fate struct {
+	// The index of the rule within Config.Rules.
+	Rule   int
+	Action Action
+
+	// The time from which GCS may take the action. In practice it does so
+	// asynchronously, typically within a day. For deletions, this takes the
+	// retention policy into account.
+	After time.Time
+
+	// Set if the subject is a prefix and the rule applies to only some of the
+	// objects under it, depending on their names.
+	Partial bool
+}
+
+// String returns the format in which fates are reported to the user, e.g.
+// "rule=1 action=SetStorageClass storage_class=COLDLINE
+// after=2017-07-01T12:00:00Z".
+func (f Fate) String() string {
+	s := fmt.Sprintf("rule=%d action=%s", f.Rule, f.Action.Type)
+	if f.Action.Type == SetStorageClass {
+		s += " storage_class=" + f.Action.StorageClass
+	}
+
+	s += " after=" + f.After.UTC().Format(time.RFC3339)
+	if f.Partial {
+		s += " scope=some"
+	}
+
+	return s
+}
+
+// Advise returns what the rules in the configuration will do to the supplied
+// subject, in the order in which they will do it. The sequence ends with any
+// deletion. Storage class changes are taken into account when evaluating
+// later rules. For a prefix, fates that apply to only some objects under it
+// are reported, and the prediction continues for the others.
+//
+// When several rules become applicable at the same time, a deletion takes
+// precedence, and otherwise the first rule in the configuration wins.
+func (c *Config) Advise(s Subject) (fates []Fate) {
+	s.Name = c.NamePrefix + s.Name
+
+	class := s.StorageClass
+	if class == "" {
+		class = c.DefaultStorageClass
+	}
+
+	// Walk forward through time from the subject's creation, applying the
+	// earliest applicable rule at each step. Each rule applies at most once.
+	t := s.Created
+	used := make(map[int]bool)
+	for {
+		best := -1
+		var bestFate Fate
+		for i, r := range c.Rules {
+			if used[i] {
+				continue
+			}
+
+			f, ok := c.evaluate(i, r, s, class, t)
+			if !ok {
+				continue
+			}
+
+			if best < 0 || precedes(f, bestFate) {
+				best = i
+				bestFate = f
+			}
+		}
+
+		if best < 0 {
+			break
+		}
+
+		fates = append(fates, bestFate)
+		used[best] = true
+
+		if bestFate.Partial {
+			continue
+		}
+
+		if bestFate.Action.Type == Delete {
+			break
+		}
+
+		class = bestFate.Action.StorageClass
+		t = bestFate.After
+	}
+
+	return
+}
+
+// FormatFates returns the supplied fates one per line, or "none".
+func FormatFates(fates []Fate) string {
+	if len(fates) == 0 {
+		return "none"
+	}
+
+	var lines []string
+	for _, f := range fates {
+		lines = append(lines, f.String())
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Return whether fate a should be taken before fate b, both being applicable.
+func precedes(a Fate, b Fate) bool {
+	switch {
+	case a.After.Before(b.After):
+		return true
+
+	case b.After.Before(a.After):
+		return false
+
+	case a.Action.Type == Delete && b.Action.Type != Delete:
+		return true
+
+	case b.Action.Type == Delete && a.Action.Type != Delete:
+		return false
+	}
+
+	return a.Rule < b.Rule
+}
+
+// Work out whether and when the supplied rule applies to the subject, given
+// that it currently has the supplied storage class and that the simulation
+// has reached time t.
+func (c *Config) evaluate(
+	i int,
+	r Rule,
+	s Subject,
+	class string,
+	t time.Time) (f Fate, ok bool) {
+	cond := r.Condition
+
+	// Only deletions and storage class changes apply to objects, and a change
+	// to the current class does nothing.
+	switch r.Action.Type {
+	case Delete:
+		if s.TemporaryHold {
+			return
+		}
+
+	case SetStorageClass:
+		if r.Action.StorageClass == class {
+			return
+		}
+
+	default:
+		return
+	}
+
+	// Conditions that a live generation never satisfies.
+	if (cond.IsLive != nil && !*cond.IsLive) ||
+		(cond.NumNewerVersions != nil && *cond.NumNewerVersions > 0) ||
+		cond.DaysSinceNoncurrentTime != nil ||
+		cond.NoncurrentTimeBefore != "" {
+		return
+	}
+
+	// Conditions that an object without a custom time never satisfies.
+	if (cond.DaysSinceCustomTime != nil || cond.CustomTimeBefore != "") &&
+		s.CustomTime.IsZero() {
+		return
+	}
+
+	// Conditions on the current state.
+	if len(cond.MatchesStorageClass) > 0 &&
+		!containsString(cond.MatchesStorageClass, class) {
+		return
+	}
+
+	if cond.CreatedBefore != "" {
+		before, err := time.Parse("2006-01-02", cond.CreatedBefore)
+		if err != nil || !s.Created.Before(before) {
+			return
+		}
+	}
+
+	if cond.CustomTimeBefore != "" {
+		before, err := time.Parse("2006-01-02", cond.CustomTimeBefore)
+		if err != nil || !s.CustomTime.Before(before) {
+			return
+		}
+	}
+
+	// Conditions on the name.
+	f.Partial, ok = matchesName(cond, s)
+	if !ok {
+		return
+	}
+
+	// When?
+	f.Rule = i
+	f.Action = r.Action
+	f.After = t
+
+	if cond.Age != nil {
+		if at := s.Created.Add(time.Duration(*cond.Age) * 24 * time.Hour); at.After(f.After) {
+			f.After = at
+		}
+	}
+
+	if cond.DaysSinceCustomTime != nil {
+		if at := s.CustomTime.Add(time.Duration(*cond.DaysSinceCustomTime) * 24 * time.Hour); at.After(f.After) {
+			f.After = at
+		}
+	}
+
+	if r.Action.Type == Delete && c.RetentionPeriod > 0 {
+		if at := s.Created.Add(c.RetentionPeriod); at.After(f.After) {
+			f.After = at
+		}
+	}
+
+	return
+}
+
+// Return whether the subject's name satisfies the condition's prefix and
+// suffix constraints, and if it is a prefix, whether only some of the names
+// under it do.
+func matchesName(cond Condition, s Subject) (partial bool, ok bool) {
+	if len(cond.MatchesPrefix) > 0 {
+		var all, some bool
+		for _, p := range cond.MatchesPrefix {
+			switch {
+			case strings.HasPrefix(s.Name, p):
+				all = true
+
+			case s.Prefix && strings.HasPrefix(p, s.Name):
+				some = true
+			}
+		}
+
+		if !all && !some {
+			return
+		}
+
+		partial = !all
+	}
+
+	if len(cond.MatchesSuffix) > 0 {
+		// We can't tell what names will be written under a prefix.
+		if s.Prefix {
+			partial = true
+		} else if !hasAnySuffix(s.Name, cond.MatchesSuffix) {
+			return
+		}
+	}
+
+	ok = true
+	return
+}
+
+func containsString(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasAnySuffix(s string, suffixes []string) bool {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(s, suffix) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,264 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lifecycle_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/lifecycle"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestLifecycle(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type LifecycleTest struct {
+	created time.Time
+	cfg     lifecycle.Config
+}
+
+func init() { RegisterTestSuite(&LifecycleTest{}) }
+
+func (t *LifecycleTest) SetUp(ti *TestInfo) {
+	t.created = time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	t.cfg.DefaultStorageClass = "STANDARD"
+}
+
+// Set the rules from their JSON API representation.
+func (t *LifecycleTest) setRules(j string) {
+	AssertEq(nil, json.Unmarshal([]byte(j), &t.cfg.Rules))
+}
+
+func (t *LifecycleTest) advise(name string) string {
+	return lifecycle.FormatFates(t.cfg.Advise(lifecycle.Subject{
+		Name:    name,
+		Created: t.created,
+	}))
+}
+
+func (t *LifecycleTest) advisePrefix(prefix string) string {
+	return lifecycle.FormatFates(t.cfg.Advise(lifecycle.Subject{
+		Name:    prefix,
+		Prefix:  true,
+		Created: t.created,
+	}))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *LifecycleTest) NoRules() {
+	ExpectEq("none", t.advise("foo"))
+}
+
+func (t *LifecycleTest) Age() {
+	t.setRules(`[
+		{"action": {"type": "Delete"}, "condition": {"age": 30}}
+	]`)
+
+	ExpectEq("rule=0 action=Delete after=2017-07-01T12:00:00Z", t.advise("foo"))
+}
+
+func (t *LifecycleTest) StorageClassTransitionsThenDelete() {
+	t.setRules(`[
+		{"action": {"type": "Delete"}, "condition": {"age": 365}},
+		{
+			"action": {"type": "SetStorageClass", "storageClass": "COLDLINE"},
+			"condition": {"age": 90, "matchesStorageClass": ["NEARLINE"]}
+		},
+		{
+			"action": {"type": "SetStorageClass", "storageClass": "NEARLINE"},
+			"condition": {"age": 30, "matchesStorageClass": ["STANDARD"]}
+		}
+	]`)
+
+	ExpectEq(
+		"rule=2 action=SetStorageClass storage_class=NEARLINE "+
+			"after=2017-07-01T12:00:00Z\n"+
+			"rule=1 action=SetStorageClass storage_class=COLDLINE "+
+			"after=2017-08-30T12:00:00Z\n"+
+			"rule=0 action=Delete after=2018-06-01T12:00:00Z",
+		t.advise("foo"))
+}
+
+func (t *LifecycleTest) StorageClassNotMatched() {
+	t.setRules(`[
+		{
+			"action": {"type": "SetStorageClass", "storageClass": "COLDLINE"},
+			"condition": {"age": 90, "matchesStorageClass": ["NEARLINE"]}
+		}
+	]`)
+
+	ExpectEq("none", t.advise("foo"))
+}
+
+func (t *LifecycleTest) DeleteTakesPrecedence() {
+	t.setRules(`[
+		{
+			"action": {"type": "SetStorageClass", "storageClass": "NEARLINE"},
+			"condition": {"age": 30}
+		},
+		{"action": {"type": "Delete"}, "condition": {"age": 30}}
+	]`)
+
+	ExpectEq("rule=1 action=Delete after=2017-07-01T12:00:00Z", t.advise("foo"))
+}
+
+func (t *LifecycleTest) RetentionDelaysDeletion() {
+	t.cfg.RetentionPeriod = 90 * 24 * time.Hour
+	t.setRules(`[
+		{"action": {"type": "Delete"}, "condition": {"age": 30}}
+	]`)
+
+	ExpectEq("rule=0 action=Delete after=2017-08-30T12:00:00Z", t.advise("foo"))
+}
+
+func (t *LifecycleTest) CreatedBefore() {
+	t.setRules(`[
+		{"action": {"type": "Delete"}, "condition": {"createdBefore": "2017-06-01"}},
+		{"action": {"type": "Delete"}, "condition": {"createdBefore": "2017-06-02"}}
+	]`)
+
+	ExpectEq("rule=1 action=Delete after=2017-06-01T12:00:00Z", t.advise("foo"))
+}
+
+func (t *LifecycleTest) NoncurrentOnlyRulesIgnored() {
+	t.setRules(`[
+		{"action": {"type": "Delete"}, "condition": {"isLive": false}},
+		{"action": {"type": "Delete"}, "condition": {"numNewerVersions": 3}},
+		{"action": {"type": "Delete"}, "condition": {"daysSinceNoncurrentTime": 7}},
+		{"action": {"type": "AbortIncompleteMultipartUpload"}, "condition": {"age": 1}}
+	]`)
+
+	ExpectEq("none", t.advise("foo"))
+}
+
+func (t *LifecycleTest) PrefixAndSuffix() {
+	t.setRules(`[
+		{
+			"action": {"type": "Delete"},
+			"condition": {
+				"age": 7,
+				"matchesPrefix": ["logs/"],
+				"matchesSuffix": [".tmp"]
+			}
+		}
+	]`)
+
+	ExpectEq("none", t.advise("logs/foo.txt"))
+	ExpectEq("none", t.advise("data/foo.tmp"))
+	ExpectEq(
+		"rule=0 action=Delete after=2017-06-08T12:00:00Z",
+		t.advise("logs/foo.tmp"))
+}
+
+func (t *LifecycleTest) Prefixes() {
+	t.setRules(`[
+		{
+			"action": {"type": "SetStorageClass", "storageClass": "ARCHIVE"},
+			"condition": {"age": 30, "matchesPrefix": ["logs/old/"]}
+		},
+		{
+			"action": {"type": "Delete"},
+			"condition": {"age": 7, "matchesPrefix": ["logs/"]}
+		}
+	]`)
+
+	// The whole bucket: both rules apply to only some objects.
+	ExpectEq(
+		"rule=1 action=Delete after=2017-06-08T12:00:00Z scope=some\n"+
+			"rule=0 action=SetStorageClass storage_class=ARCHIVE "+
+			"after=2017-07-01T12:00:00Z scope=some",
+		t.advisePrefix(""))
+
+	// Everything under logs/ is deleted.
+	ExpectEq(
+		"rule=1 action=Delete after=2017-06-08T12:00:00Z",
+		t.advisePrefix("logs/"))
+
+	// Nothing applies elsewhere.
+	ExpectEq("none", t.advisePrefix("data/"))
+}
+
+func (t *LifecycleTest) NamePrefix() {
+	t.cfg.NamePrefix = "logs/"
+	t.setRules(`[
+		{
+			"action": {"type": "Delete"},
+			"condition": {"age": 7, "matchesPrefix": ["logs/"]}
+		}
+	]`)
+
+	ExpectEq(
+		"rule=0 action=Delete after=2017-06-08T12:00:00Z",
+		t.advise("foo"))
+}
+
+func (t *LifecycleTest) CustomTime() {
+	t.setRules(`[
+		{"action": {"type": "Delete"}, "condition": {"daysSinceCustomTime": 7}},
+		{
+			"action": {"type": "SetStorageClass", "storageClass": "NEARLINE"},
+			"condition": {"customTimeBefore": "2017-09-01"}
+		}
+	]`)
+
+	// Without a custom time, neither rule applies.
+	ExpectEq("none", t.advise("foo"))
+
+	ExpectEq(
+		"rule=1 action=SetStorageClass storage_class=NEARLINE "+
+			"after=2017-06-01T12:00:00Z\n"+
+			"rule=0 action=Delete after=2017-08-08T00:00:00Z",
+		lifecycle.FormatFates(t.cfg.Advise(lifecycle.Subject{
+			Name:       "foo",
+			Created:    t.created,
+			CustomTime: time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC),
+		})))
+
+	// A later custom time doesn't satisfy customTimeBefore.
+	ExpectEq(
+		"rule=0 action=Delete after=2017-09-08T00:00:00Z",
+		lifecycle.FormatFates(t.cfg.Advise(lifecycle.Subject{
+			Name:       "foo",
+			Created:    t.created,
+			CustomTime: time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC),
+		})))
+}
+
+func (t *LifecycleTest) TemporaryHoldPreventsDeletion() {
+	t.setRules(`[
+		{"action": {"type": "Delete"}, "condition": {"age": 30}},
+		{
+			"action": {"type": "SetStorageClass", "storageClass": "NEARLINE"},
+			"condition": {"age": 60}
+		}
+	]`)
+
+	ExpectEq(
+		"rule=1 action=SetStorageClass storage_class=NEARLINE "+
+			"after=2017-07-31T12:00:00Z",
+		lifecycle.FormatFates(t.cfg.Advise(lifecycle.Subject{
+			Name:          "foo",
+			Created:       t.created,
+			TemporaryHold: true,
+		})))
+}
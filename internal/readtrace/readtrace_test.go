@@ -0,0 +1,254 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package readtrace_test
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/readtrace"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+)
+
+func TestReadTrace(t *testing.T) { RunTests(t) }
+
+const kib = 1 << 10
+const mib = 1 << 20
+
+////////////////////////////////////////////////////////////////////////
+// Trace format
+////////////////////////////////////////////////////////////////////////
+
+type TraceTest struct {
+	buf bytes.Buffer
+	w   *readtrace.Writer
+}
+
+var _ SetUpInterface = &TraceTest{}
+
+func init() { RegisterTestSuite(&TraceTest{}) }
+
+func (t *TraceTest) SetUp(ti *TestInfo) {
+	t.w = readtrace.NewWriter(&t.buf)
+}
+
+// Parse all of the reads recorded so far.
+func (t *TraceTest) reads() (reads []readtrace.Read) {
+	tr := readtrace.NewReader(bytes.NewReader(t.buf.Bytes()))
+	for {
+		r, err := tr.Next()
+		if err == io.EOF {
+			return
+		}
+
+		AssertEq(nil, err)
+		reads = append(reads, r)
+	}
+}
+
+func (t *TraceTest) Empty() {
+	ExpectEq(0, len(t.reads()))
+}
+
+func (t *TraceTest) RoundTrip() {
+	t.w.Record(1, "foo bar", 1000, 0, 128)
+	t.w.Record(2, "baz", 17, 4, 8)
+	t.w.Record(1, "foo bar", 1000, 128, 256)
+
+	reads := t.reads()
+	AssertEq(3, len(reads))
+
+	ExpectEq(1, reads[0].Handle)
+	ExpectEq("foo bar", reads[0].Name)
+	ExpectEq(1000, reads[0].Size)
+	ExpectEq(0, reads[0].Offset)
+	ExpectEq(128, reads[0].Length)
+
+	ExpectEq(2, reads[1].Handle)
+	ExpectEq("baz", reads[1].Name)
+	ExpectEq(17, reads[1].Size)
+	ExpectEq(4, reads[1].Offset)
+	ExpectEq(8, reads[1].Length)
+
+	ExpectEq(1, reads[2].Handle)
+	ExpectEq("foo bar", reads[2].Name)
+	ExpectEq(128, reads[2].Offset)
+	ExpectEq(256, reads[2].Length)
+}
+
+func (t *TraceTest) NamesFileOnlyWhenItChanges() {
+	t.w.Record(1, "foo", 1000, 0, 128)
+	t.w.Record(1, "foo", 1000, 128, 128)
+	t.w.Record(1, "foo", 2000, 256, 128)
+
+	ExpectEq(
+		"o 1 1000 foo\n"+
+			"r 1 0 128\n"+
+			"r 1 128 128\n"+
+			"o 1 2000 foo\n"+
+			"r 1 256 128\n",
+		t.buf.String())
+
+	reads := t.reads()
+	AssertEq(3, len(reads))
+	ExpectEq(2000, reads[2].Size)
+}
+
+func (t *TraceTest) Forget() {
+	t.w.Record(1, "foo", 1000, 0, 128)
+	t.w.Forget(1)
+	t.w.Record(1, "foo", 1000, 128, 128)
+
+	ExpectEq(2, strings.Count(t.buf.String(), "o 1 1000 foo\n"))
+}
+
+func (t *TraceTest) UnknownHandle() {
+	tr := readtrace.NewReader(strings.NewReader("r 1 0 128\n"))
+
+	_, err := tr.Next()
+	ExpectThat(err, Error(HasSubstr("line 1")))
+	ExpectThat(err, Error(HasSubstr("unknown handle")))
+}
+
+func (t *TraceTest) MalformedLine() {
+	tr := readtrace.NewReader(strings.NewReader("o 1 1000 foo\nr 1 0\n"))
+
+	_, err := tr.Next()
+	ExpectThat(err, Error(HasSubstr("line 2")))
+	ExpectThat(err, Error(HasSubstr("malformed")))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Simulation
+////////////////////////////////////////////////////////////////////////
+
+type SimulateTest struct {
+	ctx context.Context
+	buf bytes.Buffer
+	w   *readtrace.Writer
+}
+
+var _ SetUpInterface = &SimulateTest{}
+
+func init() { RegisterTestSuite(&SimulateTest{}) }
+
+func (t *SimulateTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.w = readtrace.NewWriter(&t.buf)
+}
+
+// Record a sequential read of the whole of a file through the given handle,
+// in reads of the given size.
+func (t *SimulateTest) readSequentially(
+	handle uint64,
+	name string,
+	size int64,
+	readSize int) {
+	for off := int64(0); off < size; off += int64(readSize) {
+		t.w.Record(handle, name, uint64(size), off, readSize)
+	}
+}
+
+func (t *SimulateTest) simulate(cfg readtrace.Config) (s readtrace.Stats) {
+	s, err := readtrace.Simulate(
+		t.ctx,
+		readtrace.NewReader(bytes.NewReader(t.buf.Bytes())),
+		cfg)
+
+	AssertEq(nil, err)
+	return
+}
+
+func (t *SimulateTest) SequentialRead() {
+	t.readSequentially(1, "foo", 10*mib, 128*kib)
+
+	s := t.simulate(readtrace.Config{BlockSize: 4 * kib})
+	ExpectEq(80, s.Reads)
+	ExpectEq(10*mib, s.Bytes)
+	ExpectEq(0, s.CacheHits)
+	ExpectEq(1, s.GCSRequests)
+	ExpectEq(10*mib, s.GCSBytes)
+}
+
+func (t *SimulateTest) ReadsPastEndOfFile() {
+	t.w.Record(1, "foo", 100, 0, 128)
+	t.w.Record(1, "foo", 100, 128, 128)
+
+	s := t.simulate(readtrace.Config{BlockSize: 4 * kib})
+	ExpectEq(2, s.Reads)
+	ExpectEq(100, s.Bytes)
+	ExpectEq(1, s.GCSRequests)
+	ExpectEq(100, s.GCSBytes)
+}
+
+func (t *SimulateTest) RepeatedReadWithoutCache() {
+	t.readSequentially(1, "foo", 10*mib, 128*kib)
+	t.readSequentially(2, "foo", 10*mib, 128*kib)
+
+	s := t.simulate(readtrace.Config{BlockSize: 4 * kib})
+	ExpectEq(0, s.CacheHits)
+	ExpectEq(2, s.GCSRequests)
+	ExpectEq(20*mib, s.GCSBytes)
+}
+
+func (t *SimulateTest) RepeatedReadWithLargeCache() {
+	t.readSequentially(1, "foo", 10*mib, 128*kib)
+	t.readSequentially(2, "foo", 10*mib, 128*kib)
+
+	s := t.simulate(readtrace.Config{
+		CacheSize: 16 * mib,
+		BlockSize: 4 * kib,
+	})
+
+	ExpectEq(80, s.CacheHits)
+	ExpectEq(10*mib, s.CacheHitBytes)
+	ExpectEq(1, s.GCSRequests)
+	ExpectEq(10*mib, s.GCSBytes)
+}
+
+func (t *SimulateTest) RepeatedReadWithSmallCache() {
+	t.readSequentially(1, "foo", 10*mib, 128*kib)
+	t.readSequentially(2, "foo", 10*mib, 128*kib)
+
+	// An LRU cache smaller than the file evicts each block before it is read
+	// again.
+	s := t.simulate(readtrace.Config{
+		CacheSize: 8 * mib,
+		BlockSize: 4 * kib,
+	})
+
+	ExpectEq(0, s.CacheHits)
+	ExpectEq(2, s.GCSRequests)
+}
+
+func (t *SimulateTest) Readahead() {
+	t.readSequentially(1, "foo", 10*mib, 128*kib)
+
+	s := t.simulate(readtrace.Config{
+		CacheSize: 16 * mib,
+		BlockSize: 4 * kib,
+		Readahead: 1 * mib,
+	})
+
+	// Each miss reads a megabyte, serving the following seven reads.
+	ExpectEq(80, s.Reads)
+	ExpectEq(70, s.CacheHits)
+	ExpectEq(1, s.GCSRequests)
+	ExpectEq(10*mib, s.GCSBytes)
+}
@@ -0,0 +1,296 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package readtrace
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/util/lrucache"
+	"golang.org/x/net/context"
+)
+
+// Config describes a configuration under which to replay a trace.
+type Config struct {
+	// The capacity in bytes of an LRU cache of file contents placed in front of
+	// the file system, like the kernel's page cache, or zero for none.
+	CacheSize int64
+
+	// The granularity in bytes at which the cache holds contents. Must be
+	// positive.
+	BlockSize int64
+
+	// When a read misses the cache, the number of bytes to read from the file
+	// system starting at its offset, if larger than the read. Ignored without
+	// a cache, which would have nowhere to keep what is read ahead.
+	Readahead int64
+}
+
+// Stats describes the outcome of replaying a trace.
+type Stats struct {
+	// The reads replayed, and the bytes they covered within their files.
+	Reads uint64
+	Bytes uint64
+
+	// The reads served entirely by the cache, and the bytes they covered.
+	CacheHits     uint64
+	CacheHitBytes uint64
+
+	// The read requests made to GCS, and the bytes consumed from them. GCS
+	// typically sends several megabytes more than is consumed from a request
+	// that is abandoned early.
+	GCSRequests uint64
+	GCSBytes    uint64
+}
+
+// Simulate replays the reads in the supplied trace under the given
+// configuration. Reads that miss the cache are served by the random reader
+// the file system uses, reading from a simulated bucket, so the requests made
+// to GCS are those the file system would make.
+func Simulate(
+	ctx context.Context,
+	tr *Reader,
+	cfg Config) (s Stats, err error) {
+	if cfg.BlockSize <= 0 {
+		err = errors.New("BlockSize must be positive")
+		return
+	}
+
+	sim := &simulator{
+		cfg:     cfg,
+		bucket:  &zeroBucket{},
+		readers: make(map[uint64]gcsx.RandomReader),
+	}
+
+	if capacity := cfg.CacheSize / cfg.BlockSize; capacity > 0 {
+		cache := lrucache.New(int(capacity))
+		sim.cache = &cache
+	}
+
+	defer sim.destroy()
+
+	for {
+		var r Read
+		r, err = tr.Next()
+		if err == io.EOF {
+			err = nil
+			break
+		}
+
+		if err != nil {
+			err = fmt.Errorf("Next: %v", err)
+			return
+		}
+
+		err = sim.replay(ctx, r)
+		if err != nil {
+			err = fmt.Errorf("replay: %v", err)
+			return
+		}
+	}
+
+	s = sim.stats
+	s.GCSRequests = sim.bucket.requests
+	s.GCSBytes = sim.bucket.bytes
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+type simulator struct {
+	cfg    Config
+	bucket *zeroBucket
+	stats  Stats
+
+	// The cache of file contents, keyed by file and block, or nil if the
+	// configuration has none.
+	cache *lrucache.Cache
+
+	// A random reader for each handle seen, for the file it was last used to
+	// read.
+	readers map[uint64]gcsx.RandomReader
+
+	// A buffer reused for reads from the random readers.
+	buf []byte
+}
+
+func (sim *simulator) destroy() {
+	for _, rr := range sim.readers {
+		rr.Destroy()
+	}
+}
+
+// Return the cache key for the supplied block of a file. The size is
+// included so that a file that changes size doesn't hit on its old contents.
+func cacheKey(r Read, block int64) string {
+	return fmt.Sprintf("%d/%d/%s", r.Size, block, r.Name)
+}
+
+func (sim *simulator) replay(ctx context.Context, r Read) (err error) {
+	// Clip the read to the file, as the file system would.
+	length := int64(r.Length)
+	if r.Offset >= int64(r.Size) {
+		length = 0
+	} else if r.Offset+length > int64(r.Size) {
+		length = int64(r.Size) - r.Offset
+	}
+
+	sim.stats.Reads++
+	sim.stats.Bytes += uint64(length)
+
+	if length == 0 {
+		return
+	}
+
+	// Is every block covered by the read in the cache?
+	firstBlock := r.Offset / sim.cfg.BlockSize
+	lastBlock := (r.Offset + length - 1) / sim.cfg.BlockSize
+
+	if sim.cache != nil {
+		hit := true
+		for b := firstBlock; b <= lastBlock; b++ {
+			if sim.cache.LookUp(cacheKey(r, b)) == nil {
+				hit = false
+			}
+		}
+
+		if hit {
+			sim.stats.CacheHits++
+			sim.stats.CacheHitBytes += uint64(length)
+			return
+		}
+	}
+
+	// Read from the file system, with readahead.
+	fetch := length
+	if sim.cache != nil && sim.cfg.Readahead > fetch {
+		fetch = sim.cfg.Readahead
+	}
+
+	if r.Offset+fetch > int64(r.Size) {
+		fetch = int64(r.Size) - r.Offset
+	}
+
+	rr, err := sim.reader(r)
+	if err != nil {
+		return
+	}
+
+	if int64(len(sim.buf)) < fetch {
+		sim.buf = make([]byte, fetch)
+	}
+
+	n, err := rr.ReadAt(ctx, sim.buf[:fetch], r.Offset)
+	if err == io.EOF {
+		err = nil
+	}
+
+	if err != nil {
+		err = fmt.Errorf("ReadAt: %v", err)
+		return
+	}
+
+	// Cache what we read.
+	if sim.cache != nil && n > 0 {
+		lastBlock = (r.Offset + int64(n) - 1) / sim.cfg.BlockSize
+		for b := firstBlock; b <= lastBlock; b++ {
+			sim.cache.Insert(cacheKey(r, b), struct{}{})
+		}
+	}
+
+	return
+}
+
+// Return the random reader for the read's handle, creating it if the handle
+// hasn't been seen before or was last used with a different file.
+func (sim *simulator) reader(r Read) (rr gcsx.RandomReader, err error) {
+	rr = sim.readers[r.Handle]
+	if rr != nil {
+		o := rr.Object()
+		if o.Name == r.Name && o.Size == r.Size {
+			return
+		}
+
+		rr.Destroy()
+		delete(sim.readers, r.Handle)
+	}
+
+	rr, err = gcsx.NewRandomReader(
+		&gcs.Object{
+			Name:       r.Name,
+			Generation: 1,
+			Size:       r.Size,
+		},
+		sim.bucket,
+		gcsx.ReadAhead{})
+
+	if err != nil {
+		err = fmt.Errorf("NewRandomReader: %v", err)
+		return
+	}
+
+	sim.readers[r.Handle] = rr
+	return
+}
+
+// A bucket whose objects contain only zeros, which counts the read requests
+// made to it and the bytes consumed from them. Supports only NewReader.
+type zeroBucket struct {
+	gcs.Bucket
+
+	requests uint64
+	bytes    uint64
+}
+
+func (b *zeroBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	b.requests++
+	rc = ioutil.NopCloser(&countingReader{
+		r: io.LimitReader(zeroReader{}, int64(req.Range.Limit-req.Range.Start)),
+		n: &b.bytes,
+	})
+
+	return
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (n int, err error) {
+	for i := range p {
+		p[i] = 0
+	}
+
+	n = len(p)
+	return
+}
+
+type countingReader struct {
+	r io.Reader
+	n *uint64
+}
+
+func (cr *countingReader) Read(p []byte) (n int, err error) {
+	n, err = cr.r.Read(p)
+	*cr.n += uint64(n)
+	return
+}
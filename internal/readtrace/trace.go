@@ -0,0 +1,233 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package readtrace records the reads made against a file system to a compact
+// trace, and replays such traces against simulated configurations.
+//
+// A trace is a sequence of lines of two kinds. The first read through a file
+// handle, and the first after the size of its file changes, is preceded by a
+// line naming the file:
+//
+//	o <handle> <size> <name>
+//
+// Each read is then recorded as:
+//
+//	r <handle> <offset> <length>
+//
+// The name runs to the end of the line, and so may contain spaces.
+package readtrace
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A Read is a single read recorded in a trace.
+type Read struct {
+	// The handle through which the read was made. Handles are not reused within
+	// a trace.
+	Handle uint64
+
+	// The name and size of the file read at the time of the read.
+	Name string
+	Size uint64
+
+	// The range requested, which may extend past the end of the file.
+	Offset int64
+	Length int
+}
+
+////////////////////////////////////////////////////////////////////////
+// Writer
+////////////////////////////////////////////////////////////////////////
+
+// A Writer records reads to a trace. Safe for concurrent access.
+type Writer struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	w io.Writer
+
+	// The size last recorded for each handle seen and not yet forgotten.
+	//
+	// GUARDED_BY(mu)
+	sizes map[uint64]uint64
+
+	// Set once a write has failed and been logged, so that a full disk doesn't
+	// produce a log message for every read.
+	//
+	// GUARDED_BY(mu)
+	failed bool
+}
+
+// NewWriter creates a writer that records reads to w.
+func NewWriter(w io.Writer) (tw *Writer) {
+	tw = &Writer{
+		w:     w,
+		sizes: make(map[uint64]uint64),
+	}
+
+	return
+}
+
+// Record a read of length bytes at the given offset, made through the given
+// handle to the named file of the given size. Failures are logged rather than
+// returned, since they don't affect the read itself.
+//
+// LOCKS_EXCLUDED(tw.mu)
+func (tw *Writer) Record(
+	handle uint64,
+	name string,
+	size uint64,
+	offset int64,
+	length int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	var b []byte
+	if s, ok := tw.sizes[handle]; !ok || s != size {
+		b = append(b, fmt.Sprintf("o %d %d %s\n", handle, size, name)...)
+		tw.sizes[handle] = size
+	}
+
+	b = append(b, fmt.Sprintf("r %d %d %d\n", handle, offset, length)...)
+
+	_, err := tw.w.Write(b)
+	if err != nil && !tw.failed {
+		log.Printf("Read trace: recording read of %q: %v", name, err)
+		tw.failed = true
+	}
+}
+
+// Forget the supplied handle, which has been released.
+//
+// LOCKS_EXCLUDED(tw.mu)
+func (tw *Writer) Forget(handle uint64) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	delete(tw.sizes, handle)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Reader
+////////////////////////////////////////////////////////////////////////
+
+// A Reader parses the reads recorded in a trace. Not safe for concurrent
+// access.
+type Reader struct {
+	scanner *bufio.Scanner
+	line    int
+
+	// The name and size most recently recorded for each handle.
+	files map[uint64]Read
+}
+
+// NewReader creates a reader for the trace read from r.
+func NewReader(r io.Reader) (tr *Reader) {
+	tr = &Reader{
+		scanner: bufio.NewScanner(r),
+		files:   make(map[uint64]Read),
+	}
+
+	return
+}
+
+// Next returns the next read in the trace, or io.EOF if there are no more.
+func (tr *Reader) Next() (r Read, err error) {
+	for tr.scanner.Scan() {
+		tr.line++
+
+		var isRead bool
+		isRead, r, err = tr.parseLine(tr.scanner.Text())
+		if err != nil {
+			err = fmt.Errorf("line %d: %v", tr.line, err)
+			return
+		}
+
+		if isRead {
+			return
+		}
+	}
+
+	err = tr.scanner.Err()
+	if err == nil {
+		err = io.EOF
+	}
+
+	return
+}
+
+// Parse a single line of the trace, updating tr.files for those naming a
+// file and returning the read for the others.
+func (tr *Reader) parseLine(line string) (isRead bool, r Read, err error) {
+	fields := strings.SplitN(line, " ", 4)
+
+	switch {
+	case len(fields) == 4 && fields[0] == "o":
+		r.Handle, err = strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return
+		}
+
+		r.Size, err = strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return
+		}
+
+		r.Name = fields[3]
+		tr.files[r.Handle] = r
+
+	case len(fields) == 4 && fields[0] == "r":
+		var handle uint64
+		handle, err = strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return
+		}
+
+		var ok bool
+		r, ok = tr.files[handle]
+		if !ok {
+			err = fmt.Errorf("read through unknown handle %d", handle)
+			return
+		}
+
+		r.Offset, err = strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return
+		}
+
+		r.Length, err = strconv.Atoi(fields[3])
+		if err != nil {
+			return
+		}
+
+		if r.Offset < 0 || r.Length < 0 {
+			err = fmt.Errorf("illegal range in line: %q", line)
+			return
+		}
+
+		isRead = true
+
+	default:
+		err = fmt.Errorf("malformed line: %q", line)
+	}
+
+	return
+}
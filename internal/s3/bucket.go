@@ -0,0 +1,882 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fsutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+// The prefix of headers carrying user metadata.
+const metadataHeaderPrefix = "X-Amz-Meta-"
+
+type bucket struct {
+	conn *conn
+	name string
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Create a request for the named object, or for the bucket itself if name is
+// empty.
+func (b *bucket) newRequest(
+	ctx context.Context,
+	method string,
+	name string,
+	query url.Values,
+	body io.Reader) (req *http.Request, err error) {
+	u := *b.conn.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + b.name
+	if name != "" {
+		u.Path += "/" + name
+	}
+
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = query.Encode()
+
+	req, err = http.NewRequest(method, u.String(), body)
+	if err != nil {
+		err = fmt.Errorf("NewRequest: %v", err)
+		return
+	}
+
+	req = req.WithContext(ctx)
+	return
+}
+
+// Send the request, returning an error if the response doesn't have a 2xx
+// status. Not found and precondition errors are returned as the corresponding
+// gcs types; all others are returned as *googleapi.Error.
+func (b *bucket) do(
+	req *http.Request,
+	payloadHash string) (resp *http.Response, err error) {
+	resp, err = b.conn.send(req, payloadHash)
+	if err != nil {
+		return
+	}
+
+	if resp.StatusCode/100 == 2 {
+		return
+	}
+
+	defer resp.Body.Close()
+
+	// Attempt to extract a message from the body, if any.
+	var s3Err struct {
+		Code    string
+		Message string
+	}
+
+	msg := resp.Status
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if xml.Unmarshal(body, &s3Err) == nil && s3Err.Code != "" {
+		msg = fmt.Sprintf("%s: %s", s3Err.Code, s3Err.Message)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		err = &gcs.NotFoundError{Err: errors.New(msg)}
+
+	case http.StatusPreconditionFailed:
+		err = &gcs.PreconditionError{Err: errors.New(msg)}
+
+	default:
+		err = &googleapi.Error{Code: resp.StatusCode, Message: msg}
+	}
+
+	resp = nil
+	return
+}
+
+// S3 has no generation numbers, so we derive them from modification times.
+// These have only one-second resolution in HEAD responses, so we truncate
+// those in listings to match.
+func generation(updated time.Time) int64 {
+	return updated.Unix()
+}
+
+func generationFromHeaders(h http.Header) (gen int64, err error) {
+	updated, err := http.ParseTime(h.Get("Last-Modified"))
+	if err != nil {
+		err = fmt.Errorf("Parsing Last-Modified: %v", err)
+		return
+	}
+
+	gen = generation(updated)
+	return
+}
+
+// Fill in the MD5 field of the object if the ETag is an MD5 sum, which is the
+// case for objects not uploaded in multiple parts.
+func setMD5(o *gcs.Object, etag string) {
+	sum, err := hex.DecodeString(strings.Trim(etag, `"`))
+	if err != nil || len(sum) != 16 {
+		return
+	}
+
+	o.MD5 = new([16]byte)
+	copy(o.MD5[:], sum)
+}
+
+// Build an object record from the headers of a HEAD or GET response.
+func objectFromHeaders(
+	name string,
+	h http.Header) (o *gcs.Object, err error) {
+	o = &gcs.Object{
+		Name:            name,
+		ContentType:     h.Get("Content-Type"),
+		ContentLanguage: h.Get("Content-Language"),
+		ContentEncoding: h.Get("Content-Encoding"),
+		CacheControl:    h.Get("Cache-Control"),
+		StorageClass:    h.Get("X-Amz-Storage-Class"),
+		MetaGeneration:  1,
+	}
+
+	if o.StorageClass == "" {
+		o.StorageClass = "STANDARD"
+	}
+
+	o.Size, err = strconv.ParseUint(h.Get("Content-Length"), 10, 64)
+	if err != nil {
+		err = fmt.Errorf("Parsing Content-Length: %v", err)
+		return
+	}
+
+	o.Updated, err = http.ParseTime(h.Get("Last-Modified"))
+	if err != nil {
+		err = fmt.Errorf("Parsing Last-Modified: %v", err)
+		return
+	}
+
+	o.Generation = generation(o.Updated)
+	setMD5(o, h.Get("ETag"))
+
+	for k, vs := range h {
+		if strings.HasPrefix(k, metadataHeaderPrefix) && len(vs) > 0 {
+			if o.Metadata == nil {
+				o.Metadata = make(map[string]string)
+			}
+
+			key := strings.ToLower(strings.TrimPrefix(k, metadataHeaderPrefix))
+			o.Metadata[key] = vs[0]
+		}
+	}
+
+	return
+}
+
+// Stat the named object, returning its ETag along with the record.
+func (b *bucket) statObject(
+	ctx context.Context,
+	name string) (o *gcs.Object, etag string, err error) {
+	req, err := b.newRequest(ctx, "HEAD", name, nil, nil)
+	if err != nil {
+		return
+	}
+
+	resp, err := b.do(req, emptyPayloadHash)
+	if err != nil {
+		return
+	}
+
+	resp.Body.Close()
+
+	o, err = objectFromHeaders(name, resp.Header)
+	if err != nil {
+		return
+	}
+
+	etag = resp.Header.Get("ETag")
+	return
+}
+
+// Check generation and meta-generation preconditions for a mutation of the
+// named object. A generation precondition of zero can be checked atomically
+// by S3, so we add an If-None-Match header in that case instead.
+func (b *bucket) checkPreconditions(
+	ctx context.Context,
+	name string,
+	h http.Header,
+	genPrecond *int64,
+	metaGenPrecond *int64) (err error) {
+	if genPrecond == nil && metaGenPrecond == nil {
+		return
+	}
+
+	if genPrecond != nil && *genPrecond == 0 {
+		h.Set("If-None-Match", "*")
+		return
+	}
+
+	o, _, err := b.statObject(ctx, name)
+	if _, ok := err.(*gcs.NotFoundError); ok {
+		err = &gcs.PreconditionError{
+			Err: fmt.Errorf("Object %q does not exist", name),
+		}
+
+		return
+	}
+
+	if err != nil {
+		return
+	}
+
+	if genPrecond != nil && o.Generation != *genPrecond {
+		err = &gcs.PreconditionError{
+			Err: fmt.Errorf(
+				"Generation %d doesn't match %d",
+				o.Generation,
+				*genPrecond),
+		}
+
+		return
+	}
+
+	if metaGenPrecond != nil && o.MetaGeneration != *metaGenPrecond {
+		err = &gcs.PreconditionError{
+			Err: fmt.Errorf(
+				"Meta-generation %d doesn't match %d",
+				o.MetaGeneration,
+				*metaGenPrecond),
+		}
+
+		return
+	}
+
+	return
+}
+
+// Return a NotFoundError if the object doesn't have the given generation,
+// mimicking GCS's response to a request for a non-existent generation.
+func checkGeneration(o *gcs.Object, gen int64) (err error) {
+	if gen != 0 && o.Generation != gen {
+		err = &gcs.NotFoundError{
+			Err: fmt.Errorf("Object %q has no generation %d", o.Name, gen),
+		}
+	}
+
+	return
+}
+
+// Set the headers corresponding to the supplied object attributes.
+func setAttributeHeaders(
+	h http.Header,
+	contentType string,
+	contentLanguage string,
+	contentEncoding string,
+	cacheControl string,
+	metadata map[string]string) {
+	set := func(k, v string) {
+		if v != "" {
+			h.Set(k, v)
+		}
+	}
+
+	set("Content-Type", contentType)
+	set("Content-Language", contentLanguage)
+	set("Content-Encoding", contentEncoding)
+	set("Cache-Control", cacheControl)
+
+	for k, v := range metadata {
+		h.Set(metadataHeaderPrefix+k, v)
+	}
+}
+
+// PUT an object with the given headers and contents of the given size, then
+// return a record for the result.
+func (b *bucket) put(
+	ctx context.Context,
+	name string,
+	h http.Header,
+	contents io.Reader,
+	size int64) (o *gcs.Object, err error) {
+	// Make sure that the transport doesn't close the contents, which may belong
+	// to the caller.
+	var body io.Reader = http.NoBody
+	if size > 0 {
+		body = io.LimitReader(contents, size)
+	}
+
+	req, err := b.newRequest(ctx, "PUT", name, nil, body)
+	if err != nil {
+		return
+	}
+
+	req.ContentLength = size
+	for k, vs := range h {
+		req.Header[k] = vs
+	}
+
+	resp, err := b.do(req, unsignedPayload)
+	if err != nil {
+		return
+	}
+
+	resp.Body.Close()
+
+	// S3 doesn't tell us the modification time, so we must ask.
+	o, err = b.StatObject(ctx, &gcs.StatObjectRequest{Name: name})
+	if err != nil {
+		err = fmt.Errorf("StatObject: %v", err)
+		return
+	}
+
+	return
+}
+
+// S3 requires the size of an object up front. Seek to find the size if
+// possible, and otherwise spool the contents to an anonymous temporary file.
+// The caller must call the returned cleanup function.
+func sizeContents(
+	contents io.Reader) (rs io.Reader, size int64, cleanup func(), err error) {
+	cleanup = func() {}
+
+	if seeker, ok := contents.(io.Seeker); ok {
+		var cur, end int64
+		cur, err = seeker.Seek(0, io.SeekCurrent)
+		if err == nil {
+			end, err = seeker.Seek(0, io.SeekEnd)
+		}
+
+		if err == nil {
+			_, err = seeker.Seek(cur, io.SeekStart)
+		}
+
+		if err != nil {
+			err = fmt.Errorf("Seek: %v", err)
+			return
+		}
+
+		rs = contents
+		size = end - cur
+		return
+	}
+
+	f, err := fsutil.AnonymousFile("")
+	if err != nil {
+		err = fmt.Errorf("AnonymousFile: %v", err)
+		return
+	}
+
+	cleanup = func() { f.Close() }
+
+	size, err = io.Copy(f, contents)
+	if err != nil {
+		err = fmt.Errorf("Copy: %v", err)
+		return
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		err = fmt.Errorf("Seek: %v", err)
+		return
+	}
+
+	rs = f
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// gcs.Bucket
+////////////////////////////////////////////////////////////////////////
+
+func (b *bucket) Name() string {
+	return b.name
+}
+
+func (b *bucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	// GCS returns empty contents for empty ranges, but S3 would return the whole
+	// object.
+	if req.Range != nil && req.Range.Start >= req.Range.Limit {
+		rc = ioutil.NopCloser(strings.NewReader(""))
+		return
+	}
+
+	httpReq, err := b.newRequest(ctx, "GET", req.Name, nil, nil)
+	if err != nil {
+		return
+	}
+
+	if req.Range != nil {
+		if req.Range.Limit >= 1<<63 {
+			httpReq.Header.Set("Range", fmt.Sprintf("bytes=%d-", req.Range.Start))
+		} else {
+			httpReq.Header.Set(
+				"Range",
+				fmt.Sprintf("bytes=%d-%d", req.Range.Start, req.Range.Limit-1))
+		}
+	}
+
+	resp, err := b.do(httpReq, emptyPayloadHash)
+
+	// Special case: GCS returns empty contents for ranges beyond the end of the
+	// object.
+	if typed, ok := err.(*googleapi.Error); ok &&
+		typed.Code == http.StatusRequestedRangeNotSatisfiable {
+		rc = ioutil.NopCloser(strings.NewReader(""))
+		err = nil
+		return
+	}
+
+	if err != nil {
+		return
+	}
+
+	// Make sure we got the generation we were asked for. The headers describe
+	// the contents in the body, so this is not racy.
+	if req.Generation != 0 {
+		var gen int64
+		gen, err = generationFromHeaders(resp.Header)
+		if err == nil {
+			err = checkGeneration(
+				&gcs.Object{Name: req.Name, Generation: gen},
+				req.Generation)
+		}
+
+		if err != nil {
+			resp.Body.Close()
+			return
+		}
+	}
+
+	rc = resp.Body
+	return
+}
+
+func (b *bucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	h := make(http.Header)
+	setAttributeHeaders(
+		h,
+		req.ContentType,
+		req.ContentLanguage,
+		req.ContentEncoding,
+		req.CacheControl,
+		req.Metadata)
+
+	if req.MD5 != nil {
+		h.Set("Content-MD5", base64.StdEncoding.EncodeToString(req.MD5[:]))
+	}
+
+	err = b.checkPreconditions(
+		ctx,
+		req.Name,
+		h,
+		req.GenerationPrecondition,
+		req.MetaGenerationPrecondition)
+
+	if err != nil {
+		return
+	}
+
+	contents, size, cleanup, err := sizeContents(req.Contents)
+	if err != nil {
+		return
+	}
+
+	defer cleanup()
+
+	o, err = b.put(ctx, req.Name, h, contents, size)
+	return
+}
+
+func (b *bucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	src, etag, err := b.statObject(ctx, req.SrcName)
+	if err != nil {
+		return
+	}
+
+	if err = checkGeneration(src, req.SrcGeneration); err != nil {
+		return
+	}
+
+	p := req.SrcMetaGenerationPrecondition
+	if p != nil && *p != src.MetaGeneration {
+		err = &gcs.PreconditionError{
+			Err: fmt.Errorf(
+				"Meta-generation %d doesn't match %d",
+				src.MetaGeneration,
+				*p),
+		}
+
+		return
+	}
+
+	// Copy exactly the generation we checked above.
+	h := make(http.Header)
+	h.Set("X-Amz-Copy-Source", uriEncode("/"+b.name+"/"+req.SrcName, false))
+	h.Set("X-Amz-Copy-Source-If-Match", etag)
+
+	o, err = b.put(ctx, req.DstName, h, nil, 0)
+	if _, ok := err.(*gcs.PreconditionError); ok {
+		err = &gcs.NotFoundError{Err: err}
+	}
+
+	return
+}
+
+// A reader for the concatenation of several objects, which opens each in turn
+// as needed.
+type composeReader struct {
+	ctx     context.Context
+	b       *bucket
+	sources []*gcs.Object
+
+	// The reader for sources[0], if opened.
+	rc io.ReadCloser
+}
+
+func (cr *composeReader) Read(p []byte) (n int, err error) {
+	for len(cr.sources) > 0 {
+		if cr.rc == nil {
+			cr.rc, err = cr.b.NewReader(
+				cr.ctx,
+				&gcs.ReadObjectRequest{
+					Name:       cr.sources[0].Name,
+					Generation: cr.sources[0].Generation,
+				})
+
+			if err != nil {
+				return
+			}
+		}
+
+		n, err = cr.rc.Read(p)
+		if err != io.EOF {
+			return
+		}
+
+		cr.rc.Close()
+		cr.rc = nil
+		cr.sources = cr.sources[1:]
+
+		if n > 0 {
+			err = nil
+			return
+		}
+	}
+
+	err = io.EOF
+	return
+}
+
+func (cr *composeReader) Close() (err error) {
+	if cr.rc != nil {
+		err = cr.rc.Close()
+		cr.rc = nil
+	}
+
+	return
+}
+
+func (b *bucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	h := make(http.Header)
+	setAttributeHeaders(h, req.ContentType, "", "", "", req.Metadata)
+
+	err = b.checkPreconditions(
+		ctx,
+		req.DstName,
+		h,
+		req.DstGenerationPrecondition,
+		req.DstMetaGenerationPrecondition)
+
+	if err != nil {
+		return
+	}
+
+	// Find the sources, and therefore the size of the result.
+	cr := &composeReader{
+		ctx: ctx,
+		b:   b,
+	}
+
+	defer cr.Close()
+
+	var size int64
+	for _, s := range req.Sources {
+		var src *gcs.Object
+		src, _, err = b.statObject(ctx, s.Name)
+		if err != nil {
+			return
+		}
+
+		if err = checkGeneration(src, s.Generation); err != nil {
+			return
+		}
+
+		cr.sources = append(cr.sources, src)
+		size += int64(src.Size)
+	}
+
+	o, err = b.put(ctx, req.DstName, h, cr, size)
+	return
+}
+
+func (b *bucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	o, _, err = b.statObject(ctx, req.Name)
+	return
+}
+
+// The response to a ListObjectsV2 request.
+type listBucketResult struct {
+	Contents []struct {
+		Key          string
+		LastModified time.Time
+		ETag         string
+		Size         uint64
+		StorageClass string
+	}
+
+	CommonPrefixes []struct {
+		Prefix string
+	}
+
+	NextContinuationToken string
+}
+
+func (b *bucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	// S3 can't filter listings by pattern, so we drop the objects that don't
+	// match ourselves.
+	var glob *gcs.Glob
+	if req.MatchGlob != "" {
+		glob, err = gcs.ParseGlob(req.MatchGlob)
+		if err != nil {
+			err = fmt.Errorf("ParseGlob: %v", err)
+			return
+		}
+	}
+
+	// Ask for URL-encoded names, since XML can't represent all of the strings
+	// that are legal object names.
+	query := url.Values{
+		"list-type":     {"2"},
+		"encoding-type": {"url"},
+		"prefix":        {req.Prefix},
+	}
+
+	if req.Delimiter != "" {
+		query.Set("delimiter", req.Delimiter)
+	}
+
+	if req.ContinuationToken != "" {
+		query.Set("continuation-token", req.ContinuationToken)
+	}
+
+	if req.MaxResults != 0 {
+		query.Set("max-keys", strconv.Itoa(req.MaxResults))
+	}
+
+	httpReq, err := b.newRequest(ctx, "GET", "", query, nil)
+	if err != nil {
+		return
+	}
+
+	resp, err := b.do(httpReq, emptyPayloadHash)
+	if err != nil {
+		return
+	}
+
+	defer resp.Body.Close()
+
+	var result listBucketResult
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		err = fmt.Errorf("Decoding listing: %v", err)
+		return
+	}
+
+	// Convert the result.
+	listing = &gcs.Listing{
+		ContinuationToken: result.NextContinuationToken,
+	}
+
+	for _, c := range result.Contents {
+		o := &gcs.Object{
+			Size:           c.Size,
+			StorageClass:   c.StorageClass,
+			Updated:        c.LastModified,
+			Generation:     generation(c.LastModified),
+			MetaGeneration: 1,
+		}
+
+		o.Name, err = url.QueryUnescape(c.Key)
+		if err != nil {
+			err = fmt.Errorf("Unescaping key: %v", err)
+			return
+		}
+
+		if glob != nil && !glob.Match(o.Name) {
+			continue
+		}
+
+		setMD5(o, c.ETag)
+		listing.Objects = append(listing.Objects, o)
+	}
+
+	for _, p := range result.CommonPrefixes {
+		var prefix string
+		prefix, err = url.QueryUnescape(p.Prefix)
+		if err != nil {
+			err = fmt.Errorf("Unescaping prefix: %v", err)
+			return
+		}
+
+		listing.CollapsedRuns = append(listing.CollapsedRuns, prefix)
+	}
+
+	return
+}
+
+func (b *bucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	// S3 has nothing corresponding to GCS's lifecycle properties.
+	if req.CustomTime != nil || req.TemporaryHold != nil {
+		err = errors.New("Custom times and holds are not supported by S3")
+		return
+	}
+
+	src, etag, err := b.statObject(ctx, req.Name)
+	if err != nil {
+		return
+	}
+
+	if err = checkGeneration(src, req.Generation); err != nil {
+		return
+	}
+
+	p := req.MetaGenerationPrecondition
+	if p != nil && *p != src.MetaGeneration {
+		err = &gcs.PreconditionError{
+			Err: fmt.Errorf(
+				"Meta-generation %d doesn't match %d",
+				src.MetaGeneration,
+				*p),
+		}
+
+		return
+	}
+
+	// Apply the changes to the existing attributes.
+	update := func(dst *string, v *string) {
+		if v != nil {
+			*dst = *v
+		}
+	}
+
+	update(&src.ContentType, req.ContentType)
+	update(&src.ContentEncoding, req.ContentEncoding)
+	update(&src.ContentLanguage, req.ContentLanguage)
+	update(&src.CacheControl, req.CacheControl)
+
+	for k, v := range req.Metadata {
+		if v == nil {
+			delete(src.Metadata, k)
+			continue
+		}
+
+		if src.Metadata == nil {
+			src.Metadata = make(map[string]string)
+		}
+
+		src.Metadata[k] = *v
+	}
+
+	// S3 objects can't be modified in place, so copy the object onto itself,
+	// replacing its attributes.
+	h := make(http.Header)
+	setAttributeHeaders(
+		h,
+		src.ContentType,
+		src.ContentLanguage,
+		src.ContentEncoding,
+		src.CacheControl,
+		src.Metadata)
+
+	h.Set("X-Amz-Copy-Source", uriEncode("/"+b.name+"/"+req.Name, false))
+	h.Set("X-Amz-Copy-Source-If-Match", etag)
+	h.Set("X-Amz-Metadata-Directive", "REPLACE")
+
+	o, err = b.put(ctx, req.Name, h, nil, 0)
+	return
+}
+
+func (b *bucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	// S3 silently succeeds when deleting objects that don't exist, but GCS
+	// returns an error and callers rely on that. So check first.
+	o, _, err := b.statObject(ctx, req.Name)
+	if err != nil {
+		return
+	}
+
+	if err = checkGeneration(o, req.Generation); err != nil {
+		return
+	}
+
+	p := req.MetaGenerationPrecondition
+	if p != nil && *p != o.MetaGeneration {
+		err = &gcs.PreconditionError{
+			Err: fmt.Errorf(
+				"Meta-generation %d doesn't match %d",
+				o.MetaGeneration,
+				*p),
+		}
+
+		return
+	}
+
+	httpReq, err := b.newRequest(ctx, "DELETE", req.Name, nil, nil)
+	if err != nil {
+		return
+	}
+
+	resp, err := b.do(httpReq, emptyPayloadHash)
+	if err != nil {
+		return
+	}
+
+	resp.Body.Close()
+	return
+}
@@ -0,0 +1,421 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3_test
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs/gcsutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/s3"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Fake S3 server
+////////////////////////////////////////////////////////////////////////
+
+type fakeObject struct {
+	contents []byte
+	header   http.Header
+	modified time.Time
+}
+
+// A minimal in-memory implementation of the parts of the S3 API used by the
+// bucket, for a single bucket named "some_bucket".
+type fakeServer struct {
+	mu      sync.Mutex
+	objects map[string]*fakeObject
+}
+
+func (s *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Read the body before locking, since it may be streamed from other
+	// requests to this server.
+	body, _ := ioutil.ReadAll(r.Body)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		http.Error(w, "unsigned", http.StatusForbidden)
+		return
+	}
+
+	const bucketPath = "/some_bucket"
+	switch {
+	case r.URL.Path == bucketPath && r.Method == "HEAD":
+		return
+
+	case r.URL.Path == bucketPath && r.Method == "GET":
+		s.list(w, r)
+		return
+
+	case !strings.HasPrefix(r.URL.Path, bucketPath+"/"):
+		http.NotFound(w, r)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, bucketPath+"/")
+	o := s.objects[name]
+
+	switch r.Method {
+	case "HEAD", "GET":
+		if o == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		for k, vs := range o.header {
+			w.Header()[k] = vs
+		}
+
+		w.Header().Set("Last-Modified", o.modified.UTC().Format(http.TimeFormat))
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(string(o.contents)))
+
+	case "PUT":
+		if r.Header.Get("If-None-Match") == "*" && o != nil {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+
+		n := &fakeObject{header: make(http.Header), modified: time.Now()}
+		for k, vs := range r.Header {
+			if strings.HasPrefix(k, "X-Amz-Meta-") || k == "Content-Type" {
+				n.header[k] = vs
+			}
+		}
+
+		if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+			srcName := strings.TrimPrefix(src, bucketPath+"/")
+			srcName, _ = url.PathUnescape(srcName)
+			srcObj := s.objects[srcName]
+			if srcObj == nil {
+				http.NotFound(w, r)
+				return
+			}
+
+			n.contents = srcObj.contents
+			if r.Header.Get("X-Amz-Metadata-Directive") != "REPLACE" {
+				n.header = srcObj.header
+			}
+		} else {
+			n.contents = body
+		}
+
+		s.objects[name] = n
+
+	case "DELETE":
+		delete(s.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *fakeServer) list(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	delimiter := r.URL.Query().Get("delimiter")
+
+	var names []string
+	for name := range s.objects {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	type content struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int
+	}
+
+	var result struct {
+		XMLName        xml.Name `xml:"ListBucketResult"`
+		Contents       []content
+		CommonPrefixes []struct{ Prefix string }
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		rest := name[len(prefix):]
+		if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+			p := prefix + rest[:i+len(delimiter)]
+			if !seen[p] {
+				seen[p] = true
+				result.CommonPrefixes = append(
+					result.CommonPrefixes,
+					struct{ Prefix string }{url.QueryEscape(p)})
+			}
+
+			continue
+		}
+
+		o := s.objects[name]
+		result.Contents = append(result.Contents, content{
+			Key:          url.QueryEscape(name),
+			LastModified: o.modified.UTC().Format(time.RFC3339Nano),
+			ETag:         `"` + strconv.Itoa(len(o.contents)) + `"`,
+			Size:         len(o.contents),
+		})
+	}
+
+	xml.NewEncoder(w).Encode(&result)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type BucketTest struct {
+	ctx    context.Context
+	server *httptest.Server
+	bucket gcs.Bucket
+}
+
+var _ SetUpInterface = &BucketTest{}
+var _ TearDownInterface = &BucketTest{}
+
+func init() { RegisterTestSuite(&BucketTest{}) }
+
+func (t *BucketTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+	t.server = httptest.NewServer(&fakeServer{
+		objects: make(map[string]*fakeObject),
+	})
+
+	endpoint, err := url.Parse(t.server.URL)
+	AssertEq(nil, err)
+
+	conn, err := s3.NewConn(&s3.ConnConfig{
+		Endpoint:        endpoint,
+		Region:          "us-east-1",
+		AccessKeyID:     "foo",
+		SecretAccessKey: "bar",
+	})
+
+	AssertEq(nil, err)
+
+	t.bucket, err = conn.OpenBucket(
+		t.ctx,
+		&gcs.OpenBucketOptions{Name: "some_bucket"})
+
+	AssertEq(nil, err)
+}
+
+func (t *BucketTest) TearDown() {
+	t.server.Close()
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *BucketTest) UnknownBucket() {
+	endpoint, err := url.Parse(t.server.URL)
+	AssertEq(nil, err)
+
+	conn, err := s3.NewConn(&s3.ConnConfig{
+		Endpoint: endpoint,
+		Region:   "us-east-1",
+	})
+
+	AssertEq(nil, err)
+
+	_, err = conn.OpenBucket(t.ctx, &gcs.OpenBucketOptions{Name: "taco"})
+	ExpectThat(err, Error(HasSubstr("taco")))
+}
+
+func (t *BucketTest) CreateStatAndRead() {
+	o, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:        "foo bar/baz",
+			ContentType: "text/plain",
+			Metadata:    map[string]string{"taco": "burrito"},
+			Contents:    strings.NewReader("enchilada"),
+		})
+
+	AssertEq(nil, err)
+	ExpectEq("foo bar/baz", o.Name)
+	ExpectEq(9, o.Size)
+	ExpectEq("text/plain", o.ContentType)
+	ExpectEq("burrito", o.Metadata["taco"])
+	ExpectLt(0, o.Generation)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo bar/baz")
+	AssertEq(nil, err)
+	ExpectEq("enchilada", string(contents))
+
+	rc, err := t.bucket.NewReader(
+		t.ctx,
+		&gcs.ReadObjectRequest{
+			Name:       "foo bar/baz",
+			Generation: o.Generation,
+			Range:      &gcs.ByteRange{Start: 2, Limit: 5},
+		})
+
+	AssertEq(nil, err)
+	defer rc.Close()
+
+	contents, err = ioutil.ReadAll(rc)
+	AssertEq(nil, err)
+	ExpectEq("chi", string(contents))
+}
+
+func (t *BucketTest) NotFound() {
+	_, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	_, err = t.bucket.NewReader(t.ctx, &gcs.ReadObjectRequest{Name: "foo"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	err = t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "foo"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *BucketTest) GenerationPreconditions() {
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	var zero int64
+	_, err = t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:                   "foo",
+			Contents:               strings.NewReader(""),
+			GenerationPrecondition: &zero,
+		})
+
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+
+	wrong := o.Generation + 1
+	_, err = t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:                   "foo",
+			Contents:               strings.NewReader(""),
+			GenerationPrecondition: &wrong,
+		})
+
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+
+	_, err = t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:                   "foo",
+			Contents:               strings.NewReader("burrito"),
+			GenerationPrecondition: &o.Generation,
+		})
+
+	ExpectEq(nil, err)
+}
+
+func (t *BucketTest) ListObjects() {
+	err := gcsutil.CreateEmptyObjects(
+		t.ctx,
+		t.bucket,
+		[]string{"a", "b/", "b/c", "d/e/f", "g+h"})
+
+	AssertEq(nil, err)
+
+	listing, err := t.bucket.ListObjects(
+		t.ctx,
+		&gcs.ListObjectsRequest{Delimiter: "/"})
+
+	AssertEq(nil, err)
+
+	var names []string
+	for _, o := range listing.Objects {
+		names = append(names, o.Name)
+	}
+
+	ExpectThat(names, ElementsAre("a", "g+h"))
+	ExpectThat(listing.CollapsedRuns, ElementsAre("b/", "d/"))
+	ExpectEq("", listing.ContinuationToken)
+}
+
+func (t *BucketTest) ComposeObjects() {
+	err := gcsutil.CreateObjects(
+		t.ctx,
+		t.bucket,
+		map[string][]byte{
+			"foo": []byte("taco"),
+			"bar": []byte("burrito"),
+		})
+
+	AssertEq(nil, err)
+
+	o, err := t.bucket.ComposeObjects(
+		t.ctx,
+		&gcs.ComposeObjectsRequest{
+			DstName: "baz",
+			Sources: []gcs.ComposeSource{
+				{Name: "foo"},
+				{Name: "bar"},
+				{Name: "foo"},
+			},
+		})
+
+	AssertEq(nil, err)
+	ExpectEq(15, o.Size)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "baz")
+	AssertEq(nil, err)
+	ExpectEq("tacoburritotaco", string(contents))
+}
+
+func (t *BucketTest) UpdateObject() {
+	_, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:     "foo",
+			Metadata: map[string]string{"a": "1", "b": "2"},
+			Contents: strings.NewReader("taco"),
+		})
+
+	AssertEq(nil, err)
+
+	three := "3"
+	o, err := t.bucket.UpdateObject(
+		t.ctx,
+		&gcs.UpdateObjectRequest{
+			Name:     "foo",
+			Metadata: map[string]*string{"a": nil, "b": &three},
+		})
+
+	AssertEq(nil, err)
+	ExpectEq(4, o.Size)
+	ExpectEq(fmt.Sprint(map[string]string{"b": "3"}), fmt.Sprint(o.Metadata))
+}
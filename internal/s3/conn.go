@@ -0,0 +1,166 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package s3 implements gcs.Conn and gcs.Bucket on top of the S3 API, so that
+// gcsfuse can serve buckets from S3-compatible object stores.
+//
+// S3 lacks several GCS features that gcsfuse relies upon, which are emulated
+// as follows:
+//
+//   - Object generations are derived from modification times, which S3
+//     reports with one-second resolution. Overwrites within the same second
+//     are therefore indistinguishable, and meta-generations are always one.
+//
+//   - Generation preconditions other than "does not exist" are checked with an
+//     extra request before the mutation, so they are subject to races with
+//     other writers.
+//
+//   - Composition is performed by downloading the sources and uploading the
+//     result, and metadata updates by copying an object onto itself. Neither
+//     works for objects larger than 5 GiB.
+//
+//   - Listings don't include content types or user metadata.
+package s3
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// ConnConfig contains options accepted by NewConn.
+type ConnConfig struct {
+	// The base URL of the S3 API, e.g. "https://s3.us-east-1.amazonaws.com".
+	// Buckets are addressed using path-style URLs relative to this one.
+	Endpoint *url.URL
+
+	// The region with which requests are signed, e.g. "us-east-1".
+	Region string
+
+	// Credentials with which to sign requests. SessionToken is required only
+	// for temporary credentials.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	// The value to set in User-Agent headers for outgoing HTTP requests. If
+	// empty, Go's default is used.
+	UserAgent string
+
+	// The HTTP transport to use. If nil, http.DefaultTransport will be used.
+	Transport http.RoundTripper
+
+	// A logger for HTTP requests and their outcomes. If nil, no logging is
+	// performed.
+	HTTPDebugLogger *log.Logger
+}
+
+// NewConn creates a connection to the S3-compatible endpoint described by
+// cfg.
+func NewConn(cfg *ConnConfig) (c gcs.Conn, err error) {
+	if cfg.Endpoint == nil {
+		err = fmt.Errorf("You must set Endpoint.")
+		return
+	}
+
+	if cfg.Region == "" {
+		err = fmt.Errorf("You must set Region.")
+		return
+	}
+
+	c = &conn{
+		endpoint: cfg.Endpoint,
+		client:   &http.Client{Transport: cfg.Transport},
+		signer: signer{
+			accessKeyID:     cfg.AccessKeyID,
+			secretAccessKey: cfg.SecretAccessKey,
+			sessionToken:    cfg.SessionToken,
+			region:          cfg.Region,
+		},
+		userAgent: cfg.UserAgent,
+		logger:    cfg.HTTPDebugLogger,
+	}
+
+	return
+}
+
+type conn struct {
+	endpoint  *url.URL
+	client    *http.Client
+	signer    signer
+	userAgent string
+	logger    *log.Logger
+}
+
+// OpenBucket returns a bucket after checking that it exists and that we have
+// access to it. The billing project is ignored.
+func (c *conn) OpenBucket(
+	ctx context.Context,
+	options *gcs.OpenBucketOptions) (b gcs.Bucket, err error) {
+	bkt := &bucket{
+		conn: c,
+		name: options.Name,
+	}
+
+	req, err := bkt.newRequest(ctx, "HEAD", "", nil, nil)
+	if err != nil {
+		return
+	}
+
+	resp, err := bkt.do(req, emptyPayloadHash)
+	if err != nil {
+		err = fmt.Errorf("HEAD bucket %q: %v", options.Name, err)
+		return
+	}
+
+	resp.Body.Close()
+
+	b = bkt
+	return
+}
+
+// Sign and send the request, logging it if appropriate.
+func (c *conn) send(
+	req *http.Request,
+	payloadHash string) (resp *http.Response, err error) {
+	c.signer.sign(req, payloadHash, time.Now())
+
+	if c.userAgent != "" {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
+
+	start := time.Now()
+	resp, err = c.client.Do(req)
+
+	if c.logger != nil {
+		status := "error"
+		if err == nil {
+			status = resp.Status
+		}
+
+		c.logger.Printf(
+			"%s %s: %s (%v)",
+			req.Method,
+			req.URL,
+			status,
+			time.Since(start))
+	}
+
+	return
+}
@@ -0,0 +1,134 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package scrub redacts sensitive data from log output and error strings.
+//
+// Credentials (authorization headers, bearer tokens, and the query parameters
+// that make up a signed URL) are always redacted. Object names are redacted
+// only on request, since they are usually the most useful part of a log
+// message.
+package scrub
+
+import (
+	"errors"
+	"io"
+	"regexp"
+)
+
+// The string substituted for redacted data.
+const Redacted = "REDACTED"
+
+var (
+	// Authorization headers as dumped by net/http/httputil, e.g.
+	//
+	//     Authorization: Bearer ya29.foo
+	//
+	authHeaderRegexp = regexp.MustCompile(
+		`(?i)((?:proxy-)?authorization:[ \t]*)[^\r\n]*`)
+
+	// Bearer tokens that appear outside of a header dump.
+	bearerRegexp = regexp.MustCompile(`(?i)(bearer[ \t]+)[A-Za-z0-9\-._~+/]+=*`)
+
+	// Query parameters carrying credentials or signatures for signed URLs.
+	signedURLParamRegexp = regexp.MustCompile(
+		`(?i)([?&](?:x-goog-signature|x-goog-credential|x-amz-signature|` +
+			`x-amz-credential|x-amz-security-token|signature|googleaccessid|` +
+			`access_token|upload_id)=)[^&\s"']*`)
+
+	// Object names within GCS JSON and XML API URLs, e.g.
+	//
+	//     /storage/v1/b/some-bucket/o/foo%2Fbar?alt=json
+	//     /upload/storage/v1/b/some-bucket/o?name=foo%2Fbar
+	//
+	objectPathRegexp  = regexp.MustCompile(`(/b/[^/\s]+/o/)[^?\s"']+`)
+	objectParamRegexp = regexp.MustCompile(`([?&](?:name|prefix)=)[^&\s"']*`)
+
+	// Object names as they appear in our own log messages and errors, which
+	// consistently quote them using %q.
+	quotedRegexp = regexp.MustCompile(`"(?:[^"\\]|\\.)*"`)
+)
+
+// A Scrubber redacts sensitive data from strings. It is safe for concurrent
+// use.
+type Scrubber struct {
+	objectNames bool
+}
+
+// New returns a scrubber that always redacts credentials, and additionally
+// redacts object names if redactObjectNames is set.
+//
+// Object names are recognized within GCS request URLs and within double
+// quotes, which is how gcsfuse formats them in log messages and errors. This
+// means that other quoted strings are redacted too.
+func New(redactObjectNames bool) (s *Scrubber) {
+	s = &Scrubber{
+		objectNames: redactObjectNames,
+	}
+
+	return
+}
+
+// String returns a copy of the input with sensitive data redacted.
+func (s *Scrubber) String(in string) (out string) {
+	out = in
+	out = authHeaderRegexp.ReplaceAllString(out, "${1}"+Redacted)
+	out = bearerRegexp.ReplaceAllString(out, "${1}"+Redacted)
+	out = signedURLParamRegexp.ReplaceAllString(out, "${1}"+Redacted)
+
+	if s.objectNames {
+		out = objectPathRegexp.ReplaceAllString(out, "${1}"+Redacted)
+		out = objectParamRegexp.ReplaceAllString(out, "${1}"+Redacted)
+		out = quotedRegexp.ReplaceAllString(out, `"`+Redacted+`"`)
+	}
+
+	return
+}
+
+// Error returns an error whose message is the scrubbed message of the
+// supplied error, or nil if the error is nil.
+func (s *Scrubber) Error(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return errors.New(s.String(err.Error()))
+}
+
+// Writer returns a writer that scrubs each buffer passed to Write before
+// passing it on to w. Because the scrubbing is done one buffer at a time, this
+// is suitable for use with log.Logger, which makes a single call to Write per
+// message.
+func (s *Scrubber) Writer(w io.Writer) io.Writer {
+	return &writer{
+		s:       s,
+		wrapped: w,
+	}
+}
+
+type writer struct {
+	s       *Scrubber
+	wrapped io.Writer
+}
+
+func (w *writer) Write(p []byte) (n int, err error) {
+	_, err = io.WriteString(w.wrapped, w.s.String(string(p)))
+	if err != nil {
+		return
+	}
+
+	// Report the length of the input, as required by io.Writer, even though we
+	// may have written a different number of bytes.
+	n = len(p)
+	return
+}
@@ -0,0 +1,113 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scrub_test
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/scrub"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestScrub(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ScrubTest struct {
+}
+
+func init() { RegisterTestSuite(&ScrubTest{}) }
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ScrubTest) AuthorizationHeader() {
+	s := scrub.New(false)
+	in := "GET /foo HTTP/1.1\r\nAuthorization: Bearer ya29.taco\r\nHost: bar\r\n"
+
+	out := s.String(in)
+	ExpectThat(out, HasSubstr("Authorization: REDACTED\r\n"))
+	ExpectThat(out, HasSubstr("Host: bar"))
+	ExpectThat(out, Not(HasSubstr("taco")))
+}
+
+func (t *ScrubTest) BearerToken() {
+	s := scrub.New(false)
+
+	out := s.String("token was bearer ya29.a0-b_c~d+e/f== and then some")
+	ExpectEq("token was bearer REDACTED and then some", out)
+}
+
+func (t *ScrubTest) SignedURLParameters() {
+	s := scrub.New(false)
+	in := "https://storage.googleapis.com/b/o?X-Goog-Algorithm=GOOG4" +
+		"&X-Goog-Credential=foo%2Fbar&X-Goog-Signature=deadbeef&alt=media"
+
+	out := s.String(in)
+	ExpectThat(out, HasSubstr("X-Goog-Algorithm=GOOG4"))
+	ExpectThat(out, HasSubstr("&X-Goog-Credential=REDACTED"))
+	ExpectThat(out, HasSubstr("&X-Goog-Signature=REDACTED"))
+	ExpectThat(out, HasSubstr("&alt=media"))
+}
+
+func (t *ScrubTest) ObjectNamesKeptByDefault() {
+	s := scrub.New(false)
+	in := `StatObject "foo/bar": GET /storage/v1/b/some-bucket/o/foo%2Fbar?alt=json`
+
+	ExpectEq(in, s.String(in))
+}
+
+func (t *ScrubTest) ObjectNamesRedacted() {
+	s := scrub.New(true)
+
+	ExpectEq(
+		`Error destroying inode "REDACTED": EIO`,
+		s.String(`Error destroying inode "foo/\"bar\"": EIO`))
+
+	ExpectEq(
+		"GET /storage/v1/b/some-bucket/o/REDACTED?alt=json",
+		s.String("GET /storage/v1/b/some-bucket/o/foo%2Fbar?alt=json"))
+
+	ExpectEq(
+		"POST /upload/storage/v1/b/some-bucket/o?uploadType=media&name=REDACTED",
+		s.String(
+			"POST /upload/storage/v1/b/some-bucket/o?uploadType=media&name=foo%2Fbar"))
+}
+
+func (t *ScrubTest) Error() {
+	s := scrub.New(true)
+
+	ExpectEq(nil, s.Error(nil))
+	ExpectEq(
+		`ReadFile("REDACTED"): no such file`,
+		s.Error(errors.New(`ReadFile("taco"): no such file`)).Error())
+}
+
+func (t *ScrubTest) Writer() {
+	var buf bytes.Buffer
+	logger := log.New(scrub.New(true).Writer(&buf), "", 0)
+
+	logger.Printf("Authorization: Bearer foo")
+	logger.Printf("Looking up %q", "taco")
+
+	ExpectEq("Authorization: REDACTED\nLooking up \"REDACTED\"\n", buf.String())
+}
@@ -21,9 +21,12 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path"
@@ -39,9 +42,13 @@ import (
 
 	"github.com/codegangsta/cli"
 	"github.com/googlecloudplatform/gcsfuse/internal/canned"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/googlecloudplatform/gcsfuse/internal/lifecycle"
+	"github.com/googlecloudplatform/gcsfuse/internal/s3"
+	"github.com/googlecloudplatform/gcsfuse/internal/scrub"
 	"github.com/jacobsa/daemonize"
-	"github.com/jacobsa/fuse"
-	"github.com/jacobsa/gcloud/gcs"
 	"github.com/jacobsa/syncutil"
 	"github.com/kardianos/osext"
 )
@@ -182,52 +189,151 @@ func newTokenSourceFromPath(
 	return
 }
 
-func getConn(flags *flagStorage) (c gcs.Conn, err error) {
-	// Create the oauth2 token source.
+// Create the HTTP transport shared by all requests made by the mount.
+//
+// Go's default transport keeps only two idle connections per host, which is
+// far fewer than the number of concurrent requests fuse can cause us to make.
+// Once more than two are in flight, connections are torn down as requests
+// finish and new ones (including TLS handshakes) are set up for the next ones.
+// Keep more around so that they are reused instead, and as many as are
+// allowed to be open if the user limits that.
+func newHTTPTransport(flags *flagStorage) (t *http.Transport) {
+	t = http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConns = 0
+	t.MaxIdleConnsPerHost = 128
+
+	if flags.MaxConnsPerHost > 0 {
+		t.MaxConnsPerHost = flags.MaxConnsPerHost
+		t.MaxIdleConnsPerHost = flags.MaxConnsPerHost
+	}
+
+	t.ResponseHeaderTimeout = flags.HTTPClientTimeout
+
+	// Special case: a non-nil, empty map of protocols negotiated by TLS is the
+	// documented way to disable HTTP/2.
+	if !flags.HTTP2 {
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+
+	return
+}
+
+// Create the oauth2 token source with which requests to GCS are authorized.
+func newTokenSource(flags *flagStorage) (ts oauth2.TokenSource, err error) {
 	const scope = gcs.Scope_FullControl
 
-	var tokenSrc oauth2.TokenSource
 	if flags.KeyFile != "" {
-		tokenSrc, err = newTokenSourceFromPath(flags.KeyFile, scope)
+		ts, err = newTokenSourceFromPath(flags.KeyFile, scope)
 		if err != nil {
 			err = fmt.Errorf("newTokenSourceFromPath: %v", err)
 			return
 		}
 	} else {
-		tokenSrc, err = google.DefaultTokenSource(context.Background(), scope)
+		ts, err = google.DefaultTokenSource(context.Background(), scope)
 		if err != nil {
 			err = fmt.Errorf("DefaultTokenSource: %v", err)
 			return
 		}
 	}
 
-	// Create the connection.
+	return
+}
+
+// Create a connection to the object store, through which all of the mount's
+// requests are made. Middleware that applies to all requests (rate limiting,
+// caching, and so on) is layered on top of the bucket by setUpBucket.
+//
+// If admin is non-nil, GCS debug logging is set up so that the admin API can
+// turn it on and off.
+func getConn(
+	flags *flagStorage,
+	admin *adminServer) (c gcs.Conn, err error) {
+	transport := newHTTPTransport(flags)
+
+	// Special case: talk to an S3-compatible object store if requested.
+	if flags.S3Endpoint != "" {
+		c, err = getS3Conn(flags, transport)
+		return
+	}
+
+	tokenSrc, err := newTokenSource(flags)
+	if err != nil {
+		return
+	}
+
+	// Create the connection. Note that gcs.NewConn falls back to Go's default
+	// transport when HTTP debugging is enabled.
 	const userAgent = "gcsfuse/0.0"
 	cfg := &gcs.ConnConfig{
 		TokenSource: tokenSrc,
 		UserAgent:   userAgent,
+		Transport:   gcsx.NewOperationIDTransport(transport),
 	}
 
+	scrubber := scrub.New(flags.RedactObjectNames)
 	if flags.DebugHTTP {
-		cfg.HTTPDebugLogger = log.New(os.Stdout, "http: ", 0)
+		cfg.HTTPDebugLogger = log.New(scrubber.Writer(os.Stdout), "http: ", 0)
 	}
 
-	if flags.DebugGCS {
-		cfg.GCSDebugLogger = log.New(os.Stdout, "gcs: ", log.Flags())
+	if flags.DebugGCS || admin != nil {
+		w := scrubber.Writer(os.Stdout)
+		if admin != nil {
+			w = admin.debugGCS.Wrap(w)
+		}
+
+		cfg.GCSDebugLogger = log.New(w, "gcs: ", log.Flags())
 	}
 
 	return gcs.NewConn(cfg)
 }
 
+func getS3Conn(
+	flags *flagStorage,
+	transport http.RoundTripper) (c gcs.Conn, err error) {
+	endpoint, err := url.Parse(flags.S3Endpoint)
+	if err != nil {
+		err = fmt.Errorf("Parsing --s3-endpoint: %v", err)
+		return
+	}
+
+	cfg := &s3.ConnConfig{
+		Endpoint:        endpoint,
+		Region:          flags.S3Region,
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		UserAgent:       "gcsfuse/0.0",
+		Transport:       transport,
+	}
+
+	if flags.DebugHTTP || flags.DebugGCS {
+		cfg.HTTPDebugLogger = log.New(
+			scrub.New(flags.RedactObjectNames).Writer(os.Stdout),
+			"s3: ",
+			log.Flags())
+	}
+
+	c, err = s3.NewConn(cfg)
+	if err != nil {
+		err = fmt.Errorf("s3.NewConn: %v", err)
+		return
+	}
+
+	return
+}
+
 ////////////////////////////////////////////////////////////////////////
 // main logic
 ////////////////////////////////////////////////////////////////////////
 
-// Mount the file system according to arguments in the supplied context.
+// Mount the file system according to arguments in the supplied context,
+// filling in admin if it is non-nil.
 func mountWithArgs(
 	bucketName string,
 	mountPoint string,
 	flags *flagStorage,
+	admin *adminServer,
 	mountStatus *log.Logger) (mfs *fuse.MountedFileSystem, err error) {
 	// Enable invariant checking if requested.
 	if flags.DebugInvariants {
@@ -242,13 +348,30 @@ func mountWithArgs(
 	if bucketName != canned.FakeBucketName {
 		mountStatus.Println("Opening GCS connection...")
 
-		conn, err = getConn(flags)
+		conn, err = getConn(flags, admin)
 		if err != nil {
 			err = fmt.Errorf("getConn: %v", err)
 			return
 		}
 	}
 
+	// Describe the bucket through extended attributes on the root, and fetch
+	// its lifecycle configuration. This is best effort, since the credentials
+	// may allow access to objects but not to the bucket's metadata.
+	var rootXattrs map[string]string
+	var lc *lifecycle.Config
+	if bucketName != canned.FakeBucketName && flags.S3Endpoint == "" {
+		rootXattrs, lc, err = getBucketProperties(
+			context.Background(),
+			flags,
+			bucketName)
+
+		if err != nil {
+			log.Printf("Not reporting bucket properties: %v", err)
+			err = nil
+		}
+	}
+
 	// Mount the file system.
 	mfs, err = mountWithConn(
 		context.Background(),
@@ -256,6 +379,9 @@ func mountWithArgs(
 		mountPoint,
 		flags,
 		conn,
+		rootXattrs,
+		lc,
+		admin,
 		mountStatus)
 
 	if err != nil {
@@ -269,6 +395,36 @@ func mountWithArgs(
 func runCLIApp(c *cli.Context) (err error) {
 	flags := populateFlags(c)
 
+	// Redact sensitive data from all log output and from the error we return.
+	scrubber := scrub.New(flags.RedactObjectNames)
+	log.SetOutput(scrubber.Writer(os.Stderr))
+	defer func() {
+		err = scrubber.Error(err)
+	}()
+
+	// Refuse flag combinations that can't work, and correct those that are
+	// self-defeating.
+	warnings, err := validateFlags(flags)
+	if err != nil {
+		err = fmt.Errorf("Invalid flags: %v", err)
+		return
+	}
+
+	for _, w := range warnings {
+		fmt.Fprintf(os.Stdout, "WARNING: %s\n", w)
+	}
+
+	// Read the prefetch manifest now, so that problems with it are reported
+	// before daemonizing.
+	var prefetchPatterns []string
+	if flags.PrefetchManifest != "" {
+		prefetchPatterns, err = readPrefetchManifest(flags.PrefetchManifest)
+		if err != nil {
+			err = fmt.Errorf("Reading --prefetch-manifest: %v", err)
+			return
+		}
+	}
+
 	// Extract arguments.
 	if len(c.Args()) != 2 {
 		err = fmt.Errorf(
@@ -319,6 +475,17 @@ func runCLIApp(c *cli.Context) (err error) {
 		if p, ok := os.LookupEnv("GOOGLE_APPLICATION_CREDENTIALS"); ok {
 			env = append(env, fmt.Sprintf("GOOGLE_APPLICATION_CREDENTIALS=%s", p))
 		}
+		// Pass along credentials for --s3-endpoint.
+		for _, k := range []string{
+			"AWS_ACCESS_KEY_ID",
+			"AWS_SECRET_ACCESS_KEY",
+			"AWS_SESSION_TOKEN",
+		} {
+			if v, ok := os.LookupEnv(k); ok {
+				env = append(env, fmt.Sprintf("%s=%s", k, v))
+			}
+		}
+
 		// Pass through the http_proxy environment variable, in case the host
 		// requires a HTTP proxy server to reach the GCS endpoint.
 		if p, ok := os.LookupEnv("http_proxy"); ok {
@@ -338,16 +505,53 @@ func runCLIApp(c *cli.Context) (err error) {
 	// Mount, writing information about our progress to the writer that package
 	// daemonize gives us and telling it about the outcome.
 	var mfs *fuse.MountedFileSystem
+	var admin *adminServer
+	if flags.AdminSocket != "" {
+		admin = newAdminServer(bucketName, mountPoint, flags)
+	}
+
 	{
-		mountStatus := log.New(daemonize.StatusWriter, "", 0)
-		mfs, err = mountWithArgs(bucketName, mountPoint, flags, mountStatus)
+		mountStatus := log.New(scrubber.Writer(daemonize.StatusWriter), "", 0)
+		mfs, err = mountWithArgs(bucketName, mountPoint, flags, admin, mountStatus)
+
+		// Serve the admin API once there is something to manage.
+		if err == nil && admin != nil {
+			err = admin.Listen(flags.AdminSocket)
+			if err != nil {
+				err = fmt.Errorf("Serving the admin API: %v", err)
+				fuse.Unmount(mountPoint)
+			} else {
+				defer admin.Close()
+			}
+		}
+
+		// Warm caches before reporting that we're ready, if requested.
+		if err == nil && len(prefetchPatterns) > 0 {
+			mountStatus.Println("Prefetching...")
+			startTime := time.Now()
+
+			files, bytes, prefetchErr := prefetch(
+				context.Background(),
+				mountPoint,
+				prefetchPatterns)
+
+			if prefetchErr != nil {
+				log.Printf("Prefetch: %v", prefetchErr)
+			}
+
+			mountStatus.Printf(
+				"Prefetched %d files (%d bytes) in %v.",
+				files,
+				bytes,
+				time.Since(startTime))
+		}
 
 		if err == nil {
 			mountStatus.Println("File system has been successfully mounted.")
 			daemonize.SignalOutcome(nil)
 		} else {
 			err = fmt.Errorf("mountWithArgs: %v", err)
-			daemonize.SignalOutcome(err)
+			daemonize.SignalOutcome(scrubber.Error(err))
 			return
 		}
 	}
@@ -17,26 +17,42 @@ package main
 import (
 	"fmt"
 	"log"
+	"math"
 	"os"
+	"time"
 
 	"golang.org/x/net/context"
 
+	"github.com/googlecloudplatform/gcsfuse/internal/canned"
+	"github.com/googlecloudplatform/gcsfuse/internal/filecache"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/fuse/fsutil"
+	"github.com/googlecloudplatform/gcsfuse/internal/fork/jacobsa/gcloud/gcs"
 	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/handle"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/googlecloudplatform/gcsfuse/internal/lifecycle"
 	"github.com/googlecloudplatform/gcsfuse/internal/perms"
-	"github.com/jacobsa/fuse"
-	"github.com/jacobsa/fuse/fsutil"
-	"github.com/jacobsa/gcloud/gcs"
+	"github.com/googlecloudplatform/gcsfuse/internal/scrub"
 	"github.com/jacobsa/timeutil"
 )
 
 // Mount the file system based on the supplied arguments, returning a
-// fuse.MountedFileSystem that can be joined to wait for unmounting.
+// fuse.MountedFileSystem that can be joined to wait for unmounting. The
+// supplied extended attributes, if any, are reported for the root directory,
+// and the lifecycle configuration, if any, is used to advise on the fate of
+// files and directories. If admin is non-nil, it is filled in with what the
+// admin API needs.
 func mountWithConn(
 	ctx context.Context,
 	bucketName string,
 	mountPoint string,
 	flags *flagStorage,
 	conn gcs.Conn,
+	rootXattrs map[string]string,
+	lc *lifecycle.Config,
+	admin *adminServer,
 	status *log.Logger) (mfs *fuse.MountedFileSystem, err error) {
 	// Sanity check: make sure the temporary directory exists and is writable
 	// currently. This gives a better user experience than harder to debug EIO
@@ -84,7 +100,7 @@ be interacting with the file system.
 	// Set up the bucket.
 	status.Println("Opening bucket...")
 
-	bucket, err := setUpBucket(
+	bucket, statCache, err := setUpBucket(
 		ctx,
 		flags,
 		conn,
@@ -95,21 +111,211 @@ be interacting with the file system.
 		return
 	}
 
+	// S3 has no native composition, so appending would mean downloading the
+	// whole object and uploading it again. Uploading it from local disk is
+	// cheaper.
+	appendThreshold := int64(1 << 21) // 2 MiB, a total guess.
+	if flags.S3Endpoint != "" {
+		appendThreshold = math.MaxInt64
+	}
+
+	// Lifecycle rules match full object names, whereas the file system sees
+	// names relative to --only-dir.
+	if lc != nil && flags.OnlyDir != "" {
+		lc.NamePrefix = onlyDirPrefix(flags)
+	}
+
+	// Validated by validateFlags.
+	writeIsolation, err := handle.ParseWriteIsolation(flags.WriteIsolation)
+	if err != nil {
+		err = fmt.Errorf("ParseWriteIsolation: %v", err)
+		return
+	}
+
+	conflicts, err := inode.ParseConflictPolicy(flags.OnConflict)
+	if err != nil {
+		err = fmt.Errorf("ParseConflictPolicy: %v", err)
+		return
+	}
+
+	hash, err := configHash(bucketName, flags)
+	if err != nil {
+		err = fmt.Errorf("configHash: %v", err)
+		return
+	}
+
 	// Create a file system server.
 	serverCfg := &fs.ServerConfig{
 		CacheClock:             timeutil.RealClock(),
 		Bucket:                 bucket,
 		TempDir:                flags.TempDir,
 		ImplicitDirectories:    flags.ImplicitDirs,
+		StaleListingFallback:   flags.StaleListingFallback,
 		InodeAttributeCacheTTL: flags.StatCacheTTL,
 		DirTypeCacheTTL:        flags.TypeCacheTTL,
+		DirListCacheTTL:        flags.ListCacheTTL,
+		KernelListCacheTTL:     flags.KernelListCacheTTL,
 		Uid:                    uid,
 		Gid:                    gid,
 		FilePerms:              os.FileMode(flags.FileMode),
 		DirPerms:               os.FileMode(flags.DirMode),
 
-		AppendThreshold: 1 << 21, // 2 MiB, a total guess.
-		TmpObjectPrefix: ".gcsfuse_tmp/",
+		AppendThreshold:      appendThreshold,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+		ReadLatestGeneration: flags.ReadLatestGeneration,
+		WatchInterval:        flags.WatchInterval,
+		TailFollow:           flags.TailFollow,
+		DirectIOPatterns:     flags.DirectIOPatterns,
+		ReadAhead: gcsx.ReadAhead{
+			ChunkSize: flags.SequentialReadSizeMb * gcsx.MB,
+			Depth:     flags.SequentialReadDepth,
+		},
+		Download: gcsx.ParallelDownload{
+			Streams:   flags.DownloadParallelism,
+			ChunkSize: int64(flags.DownloadChunkSizeMb) * gcsx.MB,
+		},
+		Upload: gcsx.ParallelUpload{
+			Streams:   flags.UploadParallelism,
+			ChunkSize: int64(flags.UploadChunkSizeMb) * gcsx.MB,
+			Threshold: int64(flags.UploadThresholdMb) * gcsx.MB,
+		},
+
+		SkipDirPlaceholderCreation: !flags.CreateDirPlaceholders,
+		HideDirPlaceholders:        flags.HideDirPlaceholders,
+		KeepDirPlaceholders:        !flags.DeleteDirPlaceholders,
+		DeferredDeleteWorkers:      flags.DeferredDeleteWorkers,
+
+		CreateOnly:          flags.CreateOnly,
+		MetadataOnly:        flags.MetadataOnly,
+		ReadOnly:            flags.ReadOnly || flags.Snapshot,
+		StreamWrites:        flags.StreamWrites,
+		StreamChunkSize:     flags.StreamChunkSize,
+		SyncDelay:           flags.SyncDelay,
+		WriteIsolation:      writeIsolation,
+		ConflictPolicy:      conflicts,
+		BatchRenameManifest: flags.BatchRenameManifest,
+		RenameDirLimit:      flags.RenameDirLimit,
+		MaxNameLength:       fs.MaxObjectNameLength - len(onlyDirPrefix(flags)),
+		WriteBudget:         flags.WriteBudget,
+		DirtyLimit:          int64(flags.DirtyLimitMb) * gcsx.MB,
+		DirtyLimitHard:      flags.DirtyLimitHard,
+		TempDirMinFree:      int64(flags.TempDirMinFreeMb) * gcsx.MB,
+		RootXattrs:          rootXattrs,
+		Lifecycle:           lc,
+		CompactionThreshold: int64(flags.CompactionThreshold),
+		InodeLimit:          flags.InodeLimit,
+		TraversalLookahead:  flags.TraversalLookahead,
+		AccessDenialTTL:     flags.DeniedPrefixTTL,
+		ConfigHash:          hash,
+	}
+
+	if flags.CheckpointMode {
+		serverCfg.Checkpoints = &fs.CheckpointConfig{
+			Markers:                 flags.CheckpointMarkers,
+			ParallelUploadThreshold: 2 * gcsx.MinParallelUploadPartSize,
+			UploadParts:             flags.CheckpointUploadParts,
+		}
+
+		// As with appends, composing parts would cost more than it saves
+		// without native composition.
+		if flags.S3Endpoint != "" {
+			serverCfg.Checkpoints.UploadParts = 1
+		}
+	}
+
+	// Likewise for parallel uploads of new files.
+	if flags.S3Endpoint != "" {
+		serverCfg.Upload.Streams = 1
+	}
+
+	if flags.UploadMaxSize > 0 ||
+		len(flags.UploadAllowedExtensions) > 0 ||
+		flags.UploadScanCommand != "" {
+		serverCfg.UploadPolicy = &gcsx.UploadPolicy{
+			MaxSize:           flags.UploadMaxSize,
+			AllowedExtensions: flags.UploadAllowedExtensions,
+			ScanCommand:       flags.UploadScanCommand,
+		}
+	}
+
+	// Append to any existing log, so that remounting doesn't lose the records
+	// of earlier mounts.
+	if flags.UploadLog != "" {
+		serverCfg.UploadLog, err = os.OpenFile(
+			flags.UploadLog,
+			os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+			0644)
+
+		if err != nil {
+			err = fmt.Errorf("OpenFile: %v", err)
+			return
+		}
+	}
+
+	// The file cache is meant to outlive the mount, so it is reused as is,
+	// apart from entries a crashed earlier instance of the mount was writing.
+	if flags.FileCacheDir != "" {
+		var limits filecache.Limits
+		limits, err = fileCacheLimits(flags)
+		if err != nil {
+			err = fmt.Errorf("fileCacheLimits: %v", err)
+			return
+		}
+
+		serverCfg.FileCache, err = filecache.New(
+			flags.FileCacheDir,
+			mountID(bucketName, mountPoint),
+			limits,
+			timeutil.RealClock())
+
+		if err != nil {
+			err = fmt.Errorf("filecache.New: %v", err)
+			return
+		}
+	}
+
+	// Start a fresh trace for each mount, since handle IDs are reused across
+	// mounts.
+	if flags.ReadTrace != "" {
+		serverCfg.ReadTrace, err = os.OpenFile(
+			flags.ReadTrace,
+			os.O_WRONLY|os.O_TRUNC|os.O_CREATE,
+			0644)
+
+		if err != nil {
+			err = fmt.Errorf("OpenFile: %v", err)
+			return
+		}
+	}
+
+	// IAM permissions can't be checked with S3 or the canned bucket.
+	if flags.AccessCheckInterval > 0 &&
+		flags.S3Endpoint == "" &&
+		bucketName != canned.FakeBucketName {
+		serverCfg.BucketAccess, err = newBucketAccessFunc(flags, bucketName)
+		if err != nil {
+			err = fmt.Errorf("newBucketAccessFunc: %v", err)
+			return
+		}
+
+		serverCfg.BucketAccessInterval = flags.AccessCheckInterval
+	}
+
+	if flags.TuneSequentialReads {
+		serverCfg.TuneReadAhead = newReadAheadTuner(bucket)
+	}
+
+	if len(flags.AllowWriters) > 0 || len(flags.DenyWriters) > 0 {
+		serverCfg.WriterPolicy = &fs.WriterPolicy{
+			Allow: flags.AllowWriters,
+			Deny:  flags.DenyWriters,
+		}
+	}
+
+	if admin != nil {
+		serverCfg.Admin = new(fs.Admin)
+		admin.fs = serverCfg.Admin
+		admin.statCache = statCache
 	}
 
 	server, err := fs.NewServer(serverCfg)
@@ -121,15 +327,24 @@ be interacting with the file system.
 	// Mount the file system.
 	status.Println("Mounting file system...")
 
+	scrubber := scrub.New(flags.RedactObjectNames)
 	mountCfg := &fuse.MountConfig{
 		FSName:      bucket.Name(),
 		VolumeName:  bucket.Name(),
 		Options:     flags.MountOptions,
-		ErrorLogger: log.New(os.Stderr, "fuse: ", log.Flags()),
+		ReadOnly:    flags.ReadOnly || flags.Snapshot,
+		ErrorLogger: log.New(scrubber.Writer(os.Stderr), "fuse: ", log.Flags()),
+
+		DisableWritebackCaching: serverCfg.DisableWritebackCaching(),
 	}
 
-	if flags.DebugFuse {
-		mountCfg.DebugLogger = log.New(os.Stdout, "fuse_debug: ", log.Flags())
+	if flags.DebugFuse || admin != nil {
+		w := scrubber.Writer(os.Stdout)
+		if admin != nil {
+			w = admin.debugFuse.Wrap(w)
+		}
+
+		mountCfg.DebugLogger = log.New(w, "fuse_debug: ", log.Flags())
 	}
 
 	mfs, err = fuse.Mount(mountPoint, server, mountCfg)
@@ -140,3 +355,71 @@ be interacting with the file system.
 
 	return
 }
+
+// Work out the limits for the file cache from the flags and, if requested,
+// the cgroup I/O limits for the device holding its directory.
+func fileCacheLimits(flags *flagStorage) (limits filecache.Limits, err error) {
+	limits = filecache.Limits{
+		MaxSize:   int64(flags.FileCacheMaxSizeMb) * gcsx.MB,
+		MinFree:   int64(flags.FileCacheMinFreeMb) * gcsx.MB,
+		WriteRate: flags.FileCacheWriteMbPerSec * gcsx.MB,
+	}
+
+	if !flags.FileCacheRespectCgroup {
+		return
+	}
+
+	// The directory must exist for us to find its device.
+	err = os.MkdirAll(flags.FileCacheDir, 0700)
+	if err != nil {
+		err = fmt.Errorf("MkdirAll: %v", err)
+		return
+	}
+
+	bps, err := cgroupWriteLimit(flags.FileCacheDir)
+	if err != nil {
+		err = fmt.Errorf("cgroupWriteLimit: %v", err)
+		return
+	}
+
+	if bps > 0 && (limits.WriteRate == 0 || bps < limits.WriteRate) {
+		log.Printf(
+			"Limiting writes to the file cache to %.0f bytes/s, per cgroup io.max.",
+			bps)
+
+		limits.WriteRate = bps
+	}
+
+	return
+}
+
+// The read-ahead configurations tried by --tune-sequential-reads, and how much
+// of an object each reads.
+var readAheadCandidates = []gcsx.ReadAhead{
+	{ChunkSize: 1 * gcsx.MB, Depth: 1},
+	{ChunkSize: 1 * gcsx.MB, Depth: 4},
+	{ChunkSize: 4 * gcsx.MB, Depth: 1},
+	{ChunkSize: 4 * gcsx.MB, Depth: 4},
+	{ChunkSize: 16 * gcsx.MB, Depth: 1},
+	{ChunkSize: 16 * gcsx.MB, Depth: 2},
+}
+
+const readAheadSampleSize = 32 * gcsx.MB
+
+// Return a tuner that times reads from the bucket with each of
+// readAheadCandidates, giving up if that takes more than a minute.
+func newReadAheadTuner(bucket gcs.Bucket) fs.ReadAheadTuner {
+	return func(ctx context.Context) (ra gcsx.ReadAhead, err error) {
+		ctx, cancel := context.WithTimeout(ctx, time.Minute)
+		defer cancel()
+
+		ra, err = gcsx.TuneReadAhead(
+			ctx,
+			bucket,
+			timeutil.RealClock(),
+			readAheadCandidates,
+			readAheadSampleSize)
+
+		return
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/jacobsa/syncutil"
+	"golang.org/x/net/context"
+)
+
+// The number of files read concurrently when prefetching.
+const prefetchParallelism = 16
+
+// Read a prefetch manifest, which lists one path or glob pattern (in the
+// syntax of filepath.Match) per line, relative to the root of the mount.
+// Blank lines and lines beginning with '#' are ignored.
+func readPrefetchManifest(p string) (patterns []string, err error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if _, err = filepath.Match(line, ""); err != nil {
+			err = fmt.Errorf("Pattern %q: %v", line, err)
+			return
+		}
+
+		patterns = append(patterns, line)
+	}
+
+	err = scanner.Err()
+	return
+}
+
+// Find the files within dir matched by the supplied patterns, or contained in
+// directories matched by them. Patterns matching nothing are logged.
+func findPrefetchFiles(
+	dir string,
+	patterns []string) (files []string, err error) {
+	seen := make(map[string]bool)
+	walk := func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			log.Printf("Prefetch: %v", err)
+			return nil
+		}
+
+		if fi.Mode().IsRegular() && !seen[p] {
+			seen[p] = true
+			files = append(files, p)
+		}
+
+		return nil
+	}
+
+	for _, pattern := range patterns {
+		var matches []string
+		matches, err = filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			err = fmt.Errorf("Glob(%q): %v", pattern, err)
+			return
+		}
+
+		if len(matches) == 0 {
+			log.Printf("Prefetch: %q matches nothing.", pattern)
+			continue
+		}
+
+		for _, m := range matches {
+			filepath.Walk(m, walk)
+		}
+	}
+
+	return
+}
+
+// Read the contents of every file within dir matched by the supplied
+// patterns, or contained in a directory matched by them, so that their
+// metadata and contents are in the caches of the file system and the kernel.
+// Files that can't be read are logged and skipped.
+func prefetch(
+	ctx context.Context,
+	dir string,
+	patterns []string) (files int, bytes int64, err error) {
+	paths, err := findPrefetchFiles(dir, patterns)
+	if err != nil {
+		err = fmt.Errorf("findPrefetchFiles: %v", err)
+		return
+	}
+
+	b := syncutil.NewBundle(ctx)
+
+	// Feed paths to the workers.
+	pathChan := make(chan string, 100)
+	b.Add(func(ctx context.Context) (err error) {
+		defer close(pathChan)
+		for _, p := range paths {
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+				return
+
+			case pathChan <- p:
+			}
+		}
+
+		return
+	})
+
+	// Read files. Each worker accumulates into the totals atomically.
+	var filesRead int64
+	var bytesRead int64
+	for i := 0; i < prefetchParallelism; i++ {
+		b.Add(func(ctx context.Context) (err error) {
+			for p := range pathChan {
+				n, readErr := readFile(p)
+				if readErr != nil {
+					log.Printf("Prefetch: %v", readErr)
+					continue
+				}
+
+				atomic.AddInt64(&filesRead, 1)
+				atomic.AddInt64(&bytesRead, n)
+			}
+
+			return
+		})
+	}
+
+	err = b.Join()
+	files = int(filesRead)
+	bytes = bytesRead
+
+	return
+}
+
+// Read the named file to the end, returning the number of bytes read.
+func readFile(p string) (n int64, err error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	n, err = io.Copy(ioutil.Discard, f)
+	if err != nil {
+		err = fmt.Errorf("Reading %q: %v", p, err)
+		return
+	}
+
+	return
+}
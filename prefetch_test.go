@@ -0,0 +1,134 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type PrefetchTest struct {
+	ctx context.Context
+	dir string
+}
+
+var _ SetUpInterface = &PrefetchTest{}
+var _ TearDownInterface = &PrefetchTest{}
+
+func init() { RegisterTestSuite(&PrefetchTest{}) }
+
+func (t *PrefetchTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	t.dir, err = ioutil.TempDir("", "prefetch_test")
+	AssertEq(nil, err)
+
+	// Set up some files.
+	files := map[string]string{
+		"a.txt":         "taco",
+		"b.csv":         "burrito",
+		"dir/c.txt":     "enchilada",
+		"dir/sub/d.txt": "queso",
+	}
+
+	for name, contents := range files {
+		p := path.Join(t.dir, name)
+		AssertEq(nil, os.MkdirAll(path.Dir(p), 0700))
+		AssertEq(nil, ioutil.WriteFile(p, []byte(contents), 0600))
+	}
+}
+
+func (t *PrefetchTest) TearDown() {
+	os.RemoveAll(t.dir)
+}
+
+// Return the paths within t.dir of the files found for the supplied patterns,
+// sorted.
+func (t *PrefetchTest) find(patterns ...string) (names []string) {
+	files, err := findPrefetchFiles(t.dir, patterns)
+	AssertEq(nil, err)
+
+	for _, f := range files {
+		names = append(names, f[len(t.dir)+1:])
+	}
+
+	sort.Strings(names)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *PrefetchTest) ReadManifest() {
+	p := path.Join(t.dir, "manifest")
+	contents := `
+# Config files.
+*.txt
+
+  dir/sub
+`
+
+	AssertEq(nil, ioutil.WriteFile(p, []byte(contents), 0600))
+
+	patterns, err := readPrefetchManifest(p)
+	AssertEq(nil, err)
+	ExpectThat(patterns, ElementsAre("*.txt", "dir/sub"))
+}
+
+func (t *PrefetchTest) ReadManifest_BadPattern() {
+	p := path.Join(t.dir, "manifest")
+	AssertEq(nil, ioutil.WriteFile(p, []byte("[\n"), 0600))
+
+	_, err := readPrefetchManifest(p)
+	ExpectThat(err, Error(HasSubstr("[")))
+}
+
+func (t *PrefetchTest) Paths() {
+	ExpectThat(t.find("a.txt", "dir/c.txt"), ElementsAre("a.txt", "dir/c.txt"))
+}
+
+func (t *PrefetchTest) Patterns() {
+	ExpectThat(t.find("*.txt", "dir/*.txt"), ElementsAre("a.txt", "dir/c.txt"))
+}
+
+func (t *PrefetchTest) Directories() {
+	ExpectThat(
+		t.find("dir", "dir/sub"),
+		ElementsAre("dir/c.txt", "dir/sub/d.txt"))
+}
+
+func (t *PrefetchTest) NothingMatches() {
+	ExpectThat(t.find("nope", "*.csv"), ElementsAre("b.csv"))
+}
+
+func (t *PrefetchTest) ReadsFiles() {
+	files, bytes, err := prefetch(t.ctx, t.dir, []string{"*.txt", "dir"})
+
+	AssertEq(nil, err)
+	ExpectEq(3, files)
+	ExpectEq(len("taco")+len("enchilada")+len("queso"), bytes)
+}
@@ -0,0 +1,194 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+)
+
+// The "status" subcommand, which reports the state of a mounted file system.
+var statusCommand = cli.Command{
+	Name:      "status",
+	HelpName:  "gcsfuse status",
+	Usage:     "Report the state of a mounted file system",
+	ArgsUsage: "mountpoint",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print the status as a single JSON object.",
+		},
+	},
+	Action: runStatus,
+}
+
+// Return an identifier for the configuration of a mount, derived from the
+// bucket name and the flags other than --foreground, which doesn't affect
+// the file system.
+func configHash(
+	bucketName string,
+	flags *flagStorage) (h string, err error) {
+	f := *flags
+	f.Foreground = false
+
+	b, err := json.Marshal(struct {
+		Bucket string
+		Flags  *flagStorage
+	}{bucketName, &f})
+
+	if err != nil {
+		err = fmt.Errorf("Marshal: %v", err)
+		return
+	}
+
+	sum := sha256.Sum256(b)
+	h = hex.EncodeToString(sum[:8])
+	return
+}
+
+// Return an identifier for mounts of the named bucket at the supplied mount
+// point, which unlike configHash stays the same when the flags change, for
+// naming the files a mount leaves in directories that it may share with
+// others.
+func mountID(bucketName string, mountPoint string) string {
+	sum := sha256.Sum256([]byte(bucketName + "\x00" + mountPoint))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Quote the supplied strings and join them with spaces, so that the empty
+// prefix shows up.
+func quoteAll(strs []string) string {
+	var quoted []string
+	for _, s := range strs {
+		quoted = append(quoted, strconv.Quote(s))
+	}
+
+	return strings.Join(quoted, " ")
+}
+
+// Print the supplied status in a form meant for people.
+func printStatus(w io.Writer, s *fs.Status) {
+	fmt.Fprintf(w, "Config hash:       %s\n", s.ConfigHash)
+	fmt.Fprintf(w, "Operation IDs:     %s-<handle>\n", s.OperationIDPrefix)
+	fmt.Fprintf(w, "Inodes:            %d\n", s.Inodes)
+	fmt.Fprintf(
+		w,
+		"Pending uploads:   %d (%d bytes)\n",
+		s.PendingUploads,
+		s.DirtyBytes)
+	fmt.Fprintf(w, "Pending deletes:   %d\n", s.PendingDeletes)
+	fmt.Fprintf(w, "Syncs in progress: %d\n", s.SyncsInProgress)
+	fmt.Fprintf(w, "Streaming uploads: %d\n", s.StreamingUploads)
+	fmt.Fprintf(w, "Batch renames:     %d\n", s.BatchRenames)
+	fmt.Fprintf(w, "Cached files:      %d (%d bytes)\n", s.CacheFiles, s.CacheBytes)
+
+	var names []string
+	for name := range s.Errors {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var errs []string
+	for _, name := range names {
+		errs = append(errs, fmt.Sprintf("%s=%d", name, s.Errors[name]))
+	}
+
+	if len(errs) == 0 {
+		errs = append(errs, "none")
+	}
+
+	fmt.Fprintf(w, "Errors:            %s\n", strings.Join(errs, " "))
+
+	// Only mounts whose credentials have been denied access have these.
+	if len(s.UnreadablePrefixes) > 0 {
+		fmt.Fprintf(
+			w,
+			"Unreadable:        %s\n",
+			quoteAll(s.UnreadablePrefixes))
+	}
+
+	if len(s.UnwritablePrefixes) > 0 {
+		fmt.Fprintf(
+			w,
+			"Unwritable:        %s\n",
+			quoteAll(s.UnwritablePrefixes))
+	}
+
+	drain := "not started"
+	switch {
+	case s.Drained:
+		drain = "done"
+
+	case s.Draining:
+		drain = "in progress"
+	}
+
+	fmt.Fprintf(w, "Drain:             %s\n", drain)
+}
+
+func runStatus(c *cli.Context) (err error) {
+	if len(c.Args()) != 1 {
+		err = fmt.Errorf(
+			"%s status takes exactly one argument. Run `%s status --help` for "+
+				"more info.",
+			path.Base(os.Args[0]),
+			path.Base(os.Args[0]))
+
+		return
+	}
+
+	s, err := readStatus(c.Args()[0])
+	if err != nil {
+		return
+	}
+
+	if c.Bool("json") {
+		err = json.NewEncoder(os.Stdout).Encode(s)
+		return
+	}
+
+	printStatus(os.Stdout, s)
+	return
+}
+
+// Read the status of the file system mounted at the supplied mount point.
+func readStatus(mountPoint string) (s *fs.Status, err error) {
+	v, err := getXattr(mountPoint, fs.StatusXattr)
+	if err != nil {
+		err = fmt.Errorf("Reading status of %s: %v", mountPoint, err)
+		return
+	}
+
+	s = new(fs.Status)
+	err = json.Unmarshal(v, s)
+	if err != nil {
+		err = fmt.Errorf("Unmarshal: %v", err)
+		return
+	}
+
+	return
+}
@@ -0,0 +1,106 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type StatusTest struct {
+}
+
+func init() { RegisterTestSuite(&StatusTest{}) }
+
+func (t *StatusTest) hash(bucketName string, args []string) string {
+	h, err := configHash(bucketName, parseArgs(args))
+	AssertEq(nil, err)
+
+	return h
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *StatusTest) ConfigHash() {
+	h := t.hash("some-bucket", []string{"--implicit-dirs"})
+	ExpectEq(16, len(h))
+
+	// Stable, and unaffected by --foreground.
+	ExpectEq(h, t.hash("some-bucket", []string{"--implicit-dirs"}))
+	ExpectEq(h, t.hash("some-bucket", []string{"--implicit-dirs", "--foreground"}))
+
+	// Affected by other flags and the bucket.
+	ExpectNe(h, t.hash("some-bucket", []string{}))
+	ExpectNe(h, t.hash("other-bucket", []string{"--implicit-dirs"}))
+}
+
+func (t *StatusTest) Print() {
+	var buf bytes.Buffer
+	printStatus(&buf, &fs.Status{
+		ConfigHash:        "0123456789abcdef",
+		OperationIDPrefix: "fedcba9876543210",
+		Inodes:            12,
+		PendingUploads:    2,
+		DirtyBytes:        1024,
+		PendingDeletes:    5,
+		SyncsInProgress:   1,
+		CacheFiles:        3,
+		CacheBytes:        4096,
+		Errors:            map[string]uint64{"EIO": 1, "EAGAIN": 4},
+		Draining:          true,
+	})
+
+	ExpectEq(
+		"Config hash:       0123456789abcdef\n"+
+			"Operation IDs:     fedcba9876543210-<handle>\n"+
+			"Inodes:            12\n"+
+			"Pending uploads:   2 (1024 bytes)\n"+
+			"Pending deletes:   5\n"+
+			"Syncs in progress: 1\n"+
+			"Streaming uploads: 0\n"+
+			"Batch renames:     0\n"+
+			"Cached files:      3 (4096 bytes)\n"+
+			"Errors:            EAGAIN=4 EIO=1\n"+
+			"Drain:             in progress\n",
+		buf.String())
+}
+
+func (t *StatusTest) PrintDeniedPrefixes() {
+	var buf bytes.Buffer
+	printStatus(&buf, &fs.Status{
+		UnreadablePrefixes: []string{"", "team/b/"},
+		UnwritablePrefixes: []string{"team/a/"},
+	})
+
+	ExpectThat(buf.String(), HasSubstr("Unreadable:        \"\" \"team/b/\"\n"))
+	ExpectThat(buf.String(), HasSubstr("Unwritable:        \"team/a/\"\n"))
+}
+
+func (t *StatusTest) PrintNoErrors() {
+	var buf bytes.Buffer
+	printStatus(&buf, &fs.Status{})
+
+	ExpectThat(buf.String(), HasSubstr("Errors:            none\n"))
+	ExpectThat(buf.String(), HasSubstr("Drain:             not started\n"))
+}
@@ -147,6 +147,7 @@ func buildBinaries(dstDir, srcDir, version string, buildArgs []string) (err erro
 		// Set up environment.
 		cmd.Env = []string{
 			"GO15VENDOREXPERIMENT=1",
+			"GO111MODULE=off",
 			fmt.Sprintf("GOROOT=%s", runtime.GOROOT()),
 			fmt.Sprintf("GOPATH=%s", gopath),
 			fmt.Sprintf("GOCACHE=%s", gocache),
@@ -98,6 +98,7 @@ func build(
 		cmd.Dir = path.Join(gitDir, "tools/build_gcsfuse")
 		cmd.Env = []string{
 			"GO15VENDOREXPERIMENT=1",
+			"GO111MODULE=off",
 			fmt.Sprintf("GOROOT=%s", runtime.GOROOT()),
 			fmt.Sprintf("GOCACHE=%s", gocache),
 			"GOPATH=/does/not/exist",
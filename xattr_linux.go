@@ -0,0 +1,68 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// Read the named extended attribute of the supplied file.
+func getXattr(p string, name string) (v []byte, err error) {
+	// Find the size, then read the value. It may grow in between, so retry on
+	// ERANGE.
+	for {
+		var n int
+		n, err = syscall.Getxattr(p, name, nil)
+		if err != nil {
+			break
+		}
+
+		v = make([]byte, n)
+		n, err = syscall.Getxattr(p, name, v)
+		if err == syscall.ERANGE {
+			continue
+		}
+
+		v = v[:n]
+		break
+	}
+
+	switch {
+	case err == syscall.ENODATA || err == syscall.ENOTSUP:
+		err = errors.New("not a gcsfuse file system")
+
+	case err != nil:
+		err = fmt.Errorf("Getxattr: %v", err)
+	}
+
+	return
+}
+
+// Set the named extended attribute of the supplied file.
+func setXattr(p string, name string, v []byte) (err error) {
+	err = syscall.Setxattr(p, name, v, 0)
+
+	switch {
+	case err == syscall.ENOTSUP:
+		err = errors.New("not a gcsfuse file system")
+
+	case err != nil:
+		err = fmt.Errorf("Setxattr: %v", err)
+	}
+
+	return
+}
@@ -0,0 +1,36 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+// Read the named extended attribute of the supplied file. The syscall
+// package supports this only on Linux.
+func getXattr(p string, name string) (v []byte, err error) {
+	err = errors.New("Reading extended attributes is supported only on Linux")
+	return
+}
+
+// Set the named extended attribute of the supplied file. The syscall package
+// supports this only on Linux.
+func setXattr(p string, name string, v []byte) (err error) {
+	err = errors.New("Setting extended attributes is supported only on Linux")
+	return
+}